@@ -8,18 +8,39 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
 
 	"kexuedns/config"
 	"kexuedns/dns"
 	"kexuedns/log"
+	"kexuedns/util/dnsmsg"
 )
 
+// The start failed because the required self-test (startup_probe) failed.
+var ErrStartupProbe = errors.New("startup probe failed")
+
 type Handler struct {
 	forwarder *dns.Forwarder
-	config    *config.Config
+	config    *config.Config // replaced upon the remote config refresh
+	configMu  sync.RWMutex
 	myip      *config.MyIP
 	mux       *http.ServeMux
+
+	// Max size of the JSON request bodies (default: 1 MiB)
+	MaxBodySize int64
+
+	debug bool // debug endpoints enabled
+
+	runtimeStats runtimeStatsCache
 }
 
 func New() *Handler {
@@ -33,90 +54,839 @@ func New() *Handler {
 	h.mux.HandleFunc("POST /start", h.start)
 	h.mux.HandleFunc("POST /stop", h.stop)
 	h.mux.HandleFunc("GET /version", h.getVersion)
+	h.mux.HandleFunc("GET /config", h.getConfig)
+	h.mux.HandleFunc("GET /stats", h.getStats)
+	h.mux.HandleFunc("GET /metrics", h.getMetrics)
+	h.mux.HandleFunc("GET /cache", h.getCache)
+	h.mux.HandleFunc("GET /router/explain", h.explainRoute)
+	h.mux.HandleFunc("GET /router/zones", h.getRouterZones)
+	h.mux.HandleFunc("POST /router/drain", h.drainRouter)
+	h.mux.HandleFunc("POST /router/routes/{index}/toggle", h.toggleRoute)
+	h.mux.HandleFunc("POST /blocklist/reload", h.reloadBlocklist)
+	h.mux.HandleFunc("POST /myip/detect", h.detectMyIP)
+	h.mux.HandleFunc("GET /debug/stats", h.getDebugStats)
 	return h
 }
 
+// Enable the debug endpoints, which expose the internal states for
+// troubleshooting and thus are disabled by default.
+func (h *Handler) EnableDebug() {
+	h.debug = true
+	h.mux.HandleFunc("GET /debug/router/trie", h.getRouterTrie)
+}
+
+// Get the current configs.
+func (h *Handler) currentConfig() *config.Config {
+	h.configMu.RLock()
+	defer h.configMu.RUnlock()
+	return h.config
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.mux.ServeHTTP(w, r)
 }
 
+// Decode the JSON request body into v, limited by the max body size.
+// Upon error, the error response is written and false is returned.
+func (h *Handler) readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	limit := h.MaxBodySize
+	if limit <= 0 {
+		limit = defaultMaxBodySize
+	}
+	if err := readJSON(w, r, v, limit); err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, errBodyTooLarge):
+			status = http.StatusRequestEntityTooLarge
+		case errors.Is(err, errContentType):
+			status = http.StatusUnsupportedMediaType
+		}
+		writeError(w, status, "", err)
+		return false
+	}
+	return true
+}
+
 // Start the forwarder.
 // Input: nil
 // Return:
 // - 500: error
 // - 204: success
 func (h *Handler) start(w http.ResponseWriter, r *http.Request) {
-	if r := h.config.Resolver; r == nil {
-		log.Warnf("no resolver configured yet")
-	} else {
-		resolver := &dns.ResolverExport{
-			Name:       r.Name,
-			Protocol:   r.Protocol,
-			Address:    r.Address,
-			ServerName: r.ServerName,
+	if err := h.StartForwarder(); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeStartFailure, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Stop the forwarder.
+// Input: nil
+// Return:
+// - 204: success
+func (h *Handler) stop(w http.ResponseWriter, r *http.Request) {
+	h.StopForwarder()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Start the forwarder with the current configs.
+// This is the in-process counterpart of the "POST /start" API.
+func (h *Handler) StartForwarder() error {
+	conf := h.currentConfig()
+	if err := setResolver(h.forwarder, conf); err != nil {
+		log.Warnf("%v", err)
+	}
+
+	if err := setListens(h.forwarder, conf); err != nil {
+		return err
+	}
+	if err := setPolicies(h.forwarder, conf); err != nil {
+		return err
+	}
+	h.forwarder.DumpMessages = h.debug && conf.DumpMessages
+	if conf.DumpMessages && !h.debug {
+		log.Warnf("dump_messages ignored without the debug mode")
+	}
+	if err := setZones(h.forwarder, conf); err != nil {
+		return err
+	}
+	if err := setBlocklist(h.forwarder, conf); err != nil {
+		return err
+	}
+
+	if err := h.forwarder.Start(conf.User); err != nil {
+		return fmt.Errorf("start failure: %w", err)
+	}
+	log.Noticef("forwarder started: %s", h.forwarder.Summary())
+
+	if conf.StartupProbe != "" {
+		if err := startupProbe(h.forwarder, conf.StartupProbe); err != nil &&
+			conf.StartupProbeRequired {
+			h.forwarder.Stop()
+			return fmt.Errorf("%w: %w", ErrStartupProbe, err)
 		}
-		if err := h.forwarder.Router.SetResolver(resolver); err != nil {
-			log.Warnf("failed to set resolver: %+v, error: %v", r, err)
-		} else {
-			log.Infof("set default resolver: %+v", r)
+	}
+
+	return nil
+}
+
+// Stop the forwarder.
+// This is the in-process counterpart of the "POST /stop" API.
+func (h *Handler) StopForwarder() {
+	h.forwarder.Stop()
+}
+
+// Refresh the remote config (if configured) periodically until the context
+// (ctx) is done, and apply the updates, i.e., set the resolvers at once and
+// the others upon the next start.
+func (h *Handler) RefreshConfig(ctx context.Context) {
+	rf := config.GetRemote()
+	if rf == nil {
+		return
+	}
+	ticker := time.NewTicker(rf.Interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.refreshConfig(ctx, rf)
 		}
 	}
+}
 
-	err := h.forwarder.SetListen(h.config.ListenAddress)
+// Fetch the remote config by the fetcher (rf) and apply it if updated,
+// keeping the current one upon failure.
+func (h *Handler) refreshConfig(ctx context.Context, rf *config.RemoteFetcher) {
+	cf, err := rf.Fetch(ctx)
 	if err != nil {
-		log.Errorf("failed to set UDP+TCP listen: %v", err)
-		http.Error(w, "set UDP+TCP listen failure: "+err.Error(),
-			http.StatusInternalServerError)
+		log.Warnf("failed to refresh remote config [%s]: %v; keep the current one",
+			rf.URL(), err)
+		return
+	}
+	if cf == nil {
+		log.Debugf("remote config not modified: %s", rf.URL())
 		return
 	}
 
-	if dot := h.config.ListenDoT; dot != nil {
-		err := h.forwarder.SetListenDoT(dot.Address,
-			dot.CertFile.Path(), dot.KeyFile.Path())
-		if err != nil {
-			log.Errorf("failed to set DoT listen: %v", err)
-			http.Error(w, "set DoT listen failure: "+err.Error(),
-				http.StatusInternalServerError)
+	h.configMu.Lock()
+	conf := &config.Config{ConfigFile: *cf, CaPool: h.config.CaPool}
+	h.config = conf
+	h.configMu.Unlock()
+
+	if err := setResolver(h.forwarder, conf); err != nil {
+		log.Warnf("%v", err)
+	}
+	log.Noticef("applied remote config update: %s", rf.URL())
+}
+
+func (h *Handler) getVersion(w http.ResponseWriter, r *http.Request) {
+	vi := config.GetVersion()
+	var resp = struct {
+		Version   string `json:"version"`
+		Date      string `json:"date"`
+		GoVersion string `json:"go_version"`
+		Platform  string `json:"platform"`
+		Revision  string `json:"revision,omitempty"`
+		Modified  bool   `json:"modified,omitempty"`
+	}{
+		Version:   vi.Version,
+		Date:      vi.Date,
+		GoVersion: vi.GoVersion,
+		Platform:  vi.Platform,
+		Revision:  vi.Revision,
+		Modified:  vi.Modified,
+	}
+	writeJSON(w, &resp)
+}
+
+// Get the effective configs, with the secrets (e.g., TSIG secrets, proxy
+// passwords and TLS key paths) redacted unless the debug endpoints are
+// enabled and asked for.
+// Input: ?redacted=false (default: true)
+// Return:
+// - 400: invalid parameter
+// - 403: unredacted configs without the debug endpoints enabled
+// - 200: config.ConfigFile
+func (h *Handler) getConfig(w http.ResponseWriter, r *http.Request) {
+	redacted := true
+	if s := r.URL.Query().Get("redacted"); s != "" {
+		var err error
+		if redacted, err = strconv.ParseBool(s); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParam,
+				fmt.Errorf("invalid redacted: %s", s))
 			return
 		}
 	}
+	if !redacted && !h.debug {
+		writeError(w, http.StatusForbidden, errCodeForbidden,
+			errors.New("unredacted configs require the debug endpoints enabled"))
+		return
+	}
 
-	if doh := h.config.ListenDoH; doh != nil {
-		err := h.forwarder.SetListenDoH(doh.Address,
-			doh.CertFile.Path(), doh.KeyFile.Path())
-		if err != nil {
-			log.Errorf("failed to set DoH listen: %v", err)
-			http.Error(w, "set DoH listen failure: "+err.Error(),
-				http.StatusInternalServerError)
+	conf := h.currentConfig()
+	if redacted {
+		writeJSON(w, conf.ConfigFile.Redacted())
+	} else {
+		writeJSON(w, &conf.ConfigFile)
+	}
+}
+
+// Get the runtime statistics of the forwarder.
+func (h *Handler) getStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.forwarder.Stats())
+}
+
+// Get the metrics of the forwarder in the Prometheus text format.
+func (h *Handler) getMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := h.forwarder.WriteMetrics(&buf); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// Get the response cache statistics, and a sample of the cached responses
+// with the remaining TTLs if asked, which is only allowed with the debug
+// endpoints enabled because it exposes the queried names.
+// Input: ?dump=true&limit=N (limit defaults to 100)
+// Return:
+// - 400: invalid parameter
+// - 403: dump asked but the debug endpoints disabled
+// - 404: no in-memory cache (e.g., not started)
+// - 200: {"stats": dns.CacheStats, "entries": [dns.CacheEntry]}
+func (h *Handler) getCache(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	dump := false
+	if s := params.Get("dump"); s != "" {
+		var err error
+		if dump, err = strconv.ParseBool(s); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParam,
+				fmt.Errorf("invalid dump: %s", s))
 			return
 		}
 	}
+	limit := defaultCacheDumpLimit
+	if s := params.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParam,
+				fmt.Errorf("invalid limit: %s", s))
+			return
+		}
+		limit = n
+	}
+	if dump && !h.debug {
+		writeError(w, http.StatusForbidden, errCodeForbidden,
+			errors.New("cache dump requires the debug endpoints enabled"))
+		return
+	}
 
-	if err := h.forwarder.Start(h.config.User); err != nil {
-		http.Error(w, "start failure: "+err.Error(), http.StatusInternalServerError)
+	stats := h.forwarder.CacheStats()
+	if stats == nil {
+		writeError(w, http.StatusNotFound, errCodeNotFound,
+			errors.New("no in-memory cache"))
 		return
 	}
+	var resp = struct {
+		Stats   *dns.CacheStats   `json:"stats"`
+		Entries []*dns.CacheEntry `json:"entries,omitempty"`
+	}{
+		Stats: stats,
+	}
+	if dump {
+		resp.Entries = h.forwarder.DumpCache(limit)
+	}
+	writeJSON(w, &resp)
+}
 
-	w.WriteHeader(http.StatusNoContent)
+// Explain how a query is routed, i.e., the matched route and zone as well
+// as the chosen resolver, optionally via the server name (i.e., the SNI of
+// the DoT/DoH query) to consider the routes limited to it.
+// Input: ?name=www.example.com&type=A&server_name=kids.dns.example
+// (type defaults to A; server_name defaults to none)
+// Return:
+// - 400: invalid name or type
+// - 200: dns.RouteMatch
+func (h *Handler) explainRoute(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParam,
+			errors.New("name required"))
+		return
+	}
+	qtype := dnsmessage.TypeA
+	if s := r.URL.Query().Get("type"); s != "" {
+		t, err := dnsmsg.ParseType(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParam, err)
+			return
+		}
+		qtype = t
+	}
+	serverName := r.URL.Query().Get("server_name")
+	writeJSON(w, h.forwarder.Router.Explain(name, qtype, serverName))
 }
 
-// Stop the forwarder.
+// Get all the zones across the routes, each with the indexes of the routes
+// claiming it, where only the first route matches; a zone in multiple
+// routes is likely a misconfiguration.
 // Input: nil
 // Return:
-// - 204: success
-func (h *Handler) stop(w http.ResponseWriter, r *http.Request) {
-	h.forwarder.Stop()
-	w.WriteHeader(http.StatusNoContent)
+// - 200: {"<zone>": [<route index>, ...], ...}
+func (h *Handler) getRouterZones(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.forwarder.Router.AllZones())
 }
 
-func (h *Handler) getVersion(w http.ResponseWriter, r *http.Request) {
-	vi := config.GetVersion()
+// Drain the idle upstream connections, so that the subsequent queries use
+// new connections (e.g., after a known upstream restart, or to pick up the
+// upstream address changes), without dropping the in-flight queries.
+// Input: nil
+// Return:
+// - 200: {"closed": <number of closed connections>}
+func (h *Handler) drainRouter(w http.ResponseWriter, r *http.Request) {
 	var resp = struct {
-		Version string `json:"version"`
-		Date    string `json:"date"`
+		Closed int `json:"closed"`
 	}{
-		Version: vi.Version,
-		Date:    vi.Date,
+		Closed: h.forwarder.Router.Drain(),
+	}
+	writeJSON(w, &resp)
+}
+
+// Toggle a route between enabled and disabled while keeping its configs,
+// e.g., to bypass a misbehaving route quickly.
+// Input: nil
+// Return:
+// - 400: invalid index
+// - 404: route not configured
+// - 200: {"index": N, "enabled": true|false}
+func (h *Handler) toggleRoute(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "", dns.ErrRouteIndexInvalid)
+		return
+	}
+	enabled, err := h.forwarder.Router.ToggleRoute(index)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, dns.ErrRouteNotConfigured) {
+			status = http.StatusNotFound
+		}
+		writeError(w, status, "", err)
+		return
+	}
+	var resp = struct {
+		Index   int  `json:"index"`
+		Enabled bool `json:"enabled"`
+	}{
+		Index:   index,
+		Enabled: enabled,
+	}
+	writeJSON(w, &resp)
+}
+
+// Reload the blocklist files, e.g., after they're updated, leaving the
+// resolvers (and their warm upstream connections) untouched.
+// Input: nil
+// Return:
+// - 500: failed to read the files (the old blocklist is kept)
+// - 200: {"files": N, "zones": N, "invalid": N, "errors": [...]}
+func (h *Handler) reloadBlocklist(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.forwarder.Router.ReloadBlocklist(blocklistFiles(h.currentConfig()))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+// Re-detect my public IPs immediately, e.g., after a connection change
+// (new ISP lease, VPN connect), so that ECS uses the correct subnet.
+// Input: nil
+// Return:
+// - 502: neither IPv4 nor IPv6 detected
+// - 200: {"ipv4": "...", "ipv6": "..."} (empty if not detected)
+func (h *Handler) detectMyIP(w http.ResponseWriter, r *http.Request) {
+	v4, v6, err := h.myip.DetectPublic(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errCodeNoMyIP, err)
+		return
 	}
+	var resp = struct {
+		IPv4 string `json:"ipv4"`
+		IPv6 string `json:"ipv6"`
+	}{}
+	if v4.IsValid() {
+		resp.IPv4 = v4.String()
+	}
+	if v6.IsValid() {
+		resp.IPv6 = v6.String()
+	}
+	log.Infof("detected my public IPs: v4=[%s] v6=[%s]", resp.IPv4, resp.IPv6)
 	writeJSON(w, &resp)
 }
+
+// Get the basic runtime statistics (goroutines, heap, GC and uptime),
+// which is cheap and thus always available, unlike pprof.
+func (h *Handler) getDebugStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.runtimeStats.Get())
+}
+
+// Dump the zone trie of a route for troubleshooting the match problems.
+// Input: ?index=N
+// Return:
+// - 400: invalid index
+// - 404: route not configured
+// - 200: trie dump in text
+func (h *Handler) getRouterTrie(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "", dns.ErrRouteIndexInvalid)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := h.forwarder.Router.DumpTrie(index, &buf); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, dns.ErrRouteNotConfigured) {
+			status = http.StatusNotFound
+		}
+		writeError(w, status, "", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// Check the config by validating the resolvers and setting up the listeners
+// on a dummy forwarder, without actually starting anything.
+func CheckConfig(conf *config.Config) error {
+	if err := dns.SetAllowedProtocols(conf.ResolverProtocols); err != nil {
+		return fmt.Errorf("invalid resolver protocols: %w", err)
+	}
+	if err := dns.SetFaultInjection(newFaultConfig(conf.FaultInjection)); err != nil {
+		return fmt.Errorf("invalid fault injection: %w", err)
+	}
+	re := &dns.RouterExport{}
+	if r := conf.Resolver; r != nil {
+		re.Resolver = newResolverExport(r)
+	}
+	if err := dns.ValidateRouterExport(re); err != nil {
+		return err
+	}
+	if r := conf.BootstrapResolver; r != nil {
+		if err := newResolverExport(r).Validate(); err != nil {
+			return fmt.Errorf("invalid bootstrap resolver: %w", err)
+		}
+	}
+
+	f := &dns.Forwarder{}
+	if err := setListens(f, conf); err != nil {
+		return err
+	}
+	if err := setPolicies(f, conf); err != nil {
+		return err
+	}
+	if err := setZones(f, conf); err != nil {
+		return err
+	}
+	return setBlocklist(f, conf)
+}
+
+// Query the name (name) of the type (qtype) through a forwarder set up with
+// the config (conf) as the running one (i.e., the zones, routing and ECS),
+// but without the listeners and cache, e.g., to debug the configs from the
+// command line.  Return the response and how the query is routed.
+// NOTE: The response may be returned with the error, e.g., SERVFAIL upon
+// the upstream failure.
+func Query(ctx context.Context, conf *config.Config, name string,
+	qtype dnsmessage.Type) ([]byte, *dns.RouteMatch, error) {
+	f := &dns.Forwarder{}
+	defer f.Stop()
+
+	if err := setResolver(f, conf); err != nil {
+		return nil, nil, err
+	}
+	if err := setPolicies(f, conf); err != nil {
+		return nil, nil, err
+	}
+	if err := setZones(f, conf); err != nil {
+		return nil, nil, err
+	}
+	if err := setBlocklist(f, conf); err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := f.Query(ctx, name, qtype)
+	return resp, f.Router.Explain(name, qtype, ""), err
+}
+
+// Set the default resolver, or the bootstrap one (if configured) instead
+// if it's not configured yet or fails to create (e.g., protocol disabled).
+func setResolver(f *dns.Forwarder, conf *config.Config) error {
+	if err := dns.SetAllowedProtocols(conf.ResolverProtocols); err != nil {
+		log.Errorf("invalid resolver protocols: %v", err)
+		return fmt.Errorf("set resolver protocols failure: %w", err)
+	}
+	if err := dns.SetFaultInjection(newFaultConfig(conf.FaultInjection)); err != nil {
+		log.Errorf("invalid fault injection: %v", err)
+		return fmt.Errorf("set fault injection failure: %w", err)
+	}
+
+	var err error
+	if r := conf.Resolver; r == nil {
+		err = errors.New("no resolver configured yet")
+	} else if err = f.Router.SetResolver(newResolverExport(r)); err != nil {
+		log.Errorf("failed to set resolver: %+v, error: %v", r, err)
+		err = fmt.Errorf("set resolver failure: %w", err)
+	} else if err = probeResolver(f, conf); err != nil {
+		log.Errorf("resolver unreachable: %+v, error: %v", r, err)
+		err = fmt.Errorf("resolver unreachable: %w", err)
+	} else {
+		log.Infof("set default resolver: %+v", r)
+		return nil
+	}
+
+	if b := conf.BootstrapResolver; b != nil {
+		if berr := f.Router.SetResolver(newResolverExport(b)); berr != nil {
+			log.Errorf("failed to set bootstrap resolver: %+v, error: %v", b, berr)
+			err = errors.Join(err, fmt.Errorf("set bootstrap resolver failure: %w", berr))
+		} else if berr := probeResolver(f, conf); berr != nil {
+			log.Errorf("bootstrap resolver unreachable: %+v, error: %v", b, berr)
+			err = errors.Join(err, fmt.Errorf("bootstrap resolver unreachable: %w", berr))
+		} else {
+			log.Noticef("%v; using the bootstrap resolver: %+v", err, b)
+			return nil
+		}
+	}
+
+	if !conf.SystemFallback {
+		return err
+	}
+	re := &dns.ResolverExport{Protocol: dns.ResolverProtocolSystem}
+	if serr := f.Router.SetResolver(re); serr != nil {
+		log.Errorf("failed to set system resolver: %v", serr)
+		return errors.Join(err, fmt.Errorf("set system resolver failure: %w", serr))
+	}
+	log.Warnf("!!! FALLBACK TO THE SYSTEM RESOLVER (/etc/resolv.conf) !!! "+
+		"no configured resolver works: %v", err)
+	return nil
+}
+
+// Probe the default resolver by querying the canary name (name) as the
+// self-test upon start, so that a broken upstream is noticed at once
+// instead of upon the first real query.
+func startupProbe(f *dns.Forwarder, name string) error {
+	rcode, err := f.Router.ProbeName(name)
+	if err == nil && (rcode == dnsmessage.RCodeServerFailure || rcode == dnsmessage.RCodeRefused) {
+		err = fmt.Errorf("answered %s", rcode)
+	}
+	if err != nil {
+		log.Warnf("startup probe [%s] failed: %v", name, err)
+		return err
+	}
+	log.Noticef("startup probe [%s] succeeded: %s", name, rcode)
+	return nil
+}
+
+// Probe the default resolver if the system fallback is enabled, which is
+// otherwise not worth delaying the start.
+func probeResolver(f *dns.Forwarder, conf *config.Config) error {
+	if !conf.SystemFallback {
+		return nil
+	}
+	return f.Router.ProbeResolver()
+}
+
+// Load the zone files and set the authoritative zones.
+func setZones(f *dns.Forwarder, conf *config.Config) error {
+	zones := make([]*dns.Zone, 0, len(conf.Zones))
+	for _, zc := range conf.Zones {
+		zone, err := dns.LoadZoneFile(zc.Origin, zc.File.Path())
+		if err != nil {
+			log.Errorf("failed to load zone [%s]: %v", zc.Origin, err)
+			return fmt.Errorf("load zone failure: %w", err)
+		}
+		log.Infof("loaded zone [%s] from: %s", zc.Origin, zc.File.Path())
+		zones = append(zones, zone)
+	}
+	if err := f.SetZones(zones); err != nil {
+		log.Errorf("failed to set zones: %v", err)
+		return fmt.Errorf("set zones failure: %w", err)
+	}
+	if err := f.SetAXFRClients(conf.AXFRClients); err != nil {
+		log.Errorf("failed to set AXFR clients: %v", err)
+		return fmt.Errorf("set AXFR clients failure: %w", err)
+	}
+	return nil
+}
+
+// Load the blocklist files.
+func setBlocklist(f *dns.Forwarder, conf *config.Config) error {
+	if _, err := f.Router.ReloadBlocklist(blocklistFiles(conf)); err != nil {
+		return fmt.Errorf("load blocklist failure: %w", err)
+	}
+	return nil
+}
+
+func blocklistFiles(conf *config.Config) []string {
+	files := make([]string, len(conf.Blocklist))
+	for i, p := range conf.Blocklist {
+		files[i] = p.Path()
+	}
+	return files
+}
+
+// Set the forwarder policies, e.g., how to drop the junk packets, answer
+// the locally served zones and limit the ECS precision.
+func setPolicies(f *dns.Forwarder, conf *config.Config) error {
+	if err := f.SetMinQuerySize(conf.MinQuerySize); err != nil {
+		log.Errorf("failed to set min query size: %v", err)
+		return fmt.Errorf("set min query size failure: %w", err)
+	}
+	f.LogJunkSource = conf.LogJunkSource
+	f.DetectLoop = conf.DetectLoop
+
+	if err := f.Router.SetCloseGrace(conf.ResolverCloseGrace); err != nil {
+		log.Errorf("failed to set resolver close grace: %v", err)
+		return fmt.Errorf("set resolver close grace failure: %w", err)
+	}
+
+	if err := f.SetLocalZonePolicy(conf.LocalZones); err != nil {
+		log.Errorf("failed to set local zone policy: %v", err)
+		return fmt.Errorf("set local zone policy failure: %w", err)
+	}
+
+	if err := f.SetSynthTTL(conf.SynthTTL, conf.LocalZoneTTL); err != nil {
+		log.Errorf("failed to set synthesized TTL: %v", err)
+		return fmt.Errorf("set synthesized TTL failure: %w", err)
+	}
+
+	if err := f.SetDefaultAction(conf.DefaultAction); err != nil {
+		log.Errorf("failed to set default action: %v", err)
+		return fmt.Errorf("set default action failure: %w", err)
+	}
+
+	if err := f.SetNoResolverRCode(conf.NoResolverRCode); err != nil {
+		log.Errorf("failed to set no-resolver rcode: %v", err)
+		return fmt.Errorf("set no-resolver rcode failure: %w", err)
+	}
+
+	if err := f.SetECSPrefix(conf.EcsPrefixV4, conf.EcsPrefixV6); err != nil {
+		log.Errorf("failed to set ECS prefix: %v", err)
+		return fmt.Errorf("set ECS prefix failure: %w", err)
+	}
+	if err := f.SetECSSubnet(conf.EcsSubnetV4, conf.EcsSubnetV6); err != nil {
+		log.Errorf("failed to set ECS subnet: %v", err)
+		return fmt.Errorf("set ECS subnet failure: %w", err)
+	}
+
+	if err := f.SetPreloadNames(conf.PreloadNames); err != nil {
+		log.Errorf("failed to set preload names: %v", err)
+		return fmt.Errorf("set preload names failure: %w", err)
+	}
+
+	if err := f.SetTCPIdleTimeout(conf.TCPIdleTimeout); err != nil {
+		log.Errorf("failed to set TCP idle timeout: %v", err)
+		return fmt.Errorf("set TCP idle timeout failure: %w", err)
+	}
+	if err := f.SetMaxTCPConns(conf.MaxTCPConns); err != nil {
+		log.Errorf("failed to set max TCP connections: %v", err)
+		return fmt.Errorf("set max TCP connections failure: %w", err)
+	}
+	if err := f.SetUDPSockets(conf.UDPSockets); err != nil {
+		log.Errorf("failed to set UDP sockets: %v", err)
+		return fmt.Errorf("set UDP sockets failure: %w", err)
+	}
+	if err := f.SetUDPBatchSize(conf.UDPBatchSize); err != nil {
+		log.Errorf("failed to set UDP batch size: %v", err)
+		return fmt.Errorf("set UDP batch size failure: %w", err)
+	}
+	if err := f.SetLimits(dns.Limits(conf.Limits)); err != nil {
+		log.Errorf("failed to set size limits: %v", err)
+		return fmt.Errorf("set size limits failure: %w", err)
+	}
+
+	if err := f.SetCachePolicy(conf.CacheDefaultTTL, conf.CacheCleanupInterval); err != nil {
+		log.Errorf("failed to set cache policy: %v", err)
+		return fmt.Errorf("set cache policy failure: %w", err)
+	}
+
+	if err := f.SetCacheTTLJitter(conf.CacheTTLJitter); err != nil {
+		log.Errorf("failed to set cache TTL jitter: %v", err)
+		return fmt.Errorf("set cache TTL jitter failure: %w", err)
+	}
+
+	cacheFile := ""
+	if conf.CacheFile != "" {
+		cacheFile = conf.CacheFile.Path()
+	}
+	if err := f.SetCacheFile(cacheFile, conf.CacheSaveInterval, conf.CacheFileAnswersOnly); err != nil {
+		log.Errorf("failed to set cache file: %v", err)
+		return fmt.Errorf("set cache file failure: %w", err)
+	}
+
+	if err := f.SetStalePolicy(conf.StaleAnswerTTL, conf.MaxStale); err != nil {
+		log.Errorf("failed to set stale policy: %v", err)
+		return fmt.Errorf("set stale policy failure: %w", err)
+	}
+
+	if err := f.SetDNS64(conf.DNS64, conf.DNS64Prefix); err != nil {
+		log.Errorf("failed to set DNS64: %v", err)
+		return fmt.Errorf("set DNS64 failure: %w", err)
+	}
+
+	if err := f.SetStripTypes(conf.StripTypes); err != nil {
+		log.Errorf("failed to set strip types: %v", err)
+		return fmt.Errorf("set strip types failure: %w", err)
+	}
+	if err := f.SetAnswerOverrides(conf.AnswerOverrides); err != nil {
+		log.Errorf("failed to set answer overrides: %v", err)
+		return fmt.Errorf("set answer overrides failure: %w", err)
+	}
+	f.FormErrRetry = conf.FormErrRetry
+	f.RequestNSID = conf.RequestNSID
+	f.ClearRelayedAA = conf.ClearRelayedAA
+	f.RouteInfo = conf.RouteInfo
+
+	return nil
+}
+
+// Set the listen configs of the forwarder.
+func setListens(f *dns.Forwarder, conf *config.Config) error {
+	if err := f.SetListen(conf.GetListenAddresses()...); err != nil {
+		log.Errorf("failed to set UDP+TCP listen: %v", err)
+		return fmt.Errorf("set UDP+TCP listen failure: %w", err)
+	}
+
+	if dot := conf.ListenDoT; dot != nil {
+		err := f.SetListenDoT(dot.GetAddresses(), dot.CertFile.Path(), dot.KeyFile.Path())
+		if err != nil {
+			log.Errorf("failed to set DoT listen: %v", err)
+			return fmt.Errorf("set DoT listen failure: %w", err)
+		}
+	}
+
+	if doh := conf.ListenDoH; doh != nil {
+		err := f.SetListenDoH(doh.GetAddresses(), doh.CertFile.Path(), doh.KeyFile.Path())
+		if err != nil {
+			log.Errorf("failed to set DoH listen: %v", err)
+			return fmt.Errorf("set DoH listen failure: %w", err)
+		}
+		err = f.SetDoHServerLimits(dns.DoHServerLimits{
+			MaxConcurrentStreams: doh.MaxConcurrentStreams,
+			MaxConns:             doh.MaxConns,
+			ReadHeaderTimeout:    time.Duration(doh.ReadHeaderTimeout) * time.Second,
+			ReadTimeout:          time.Duration(doh.ReadTimeout) * time.Second,
+			WriteTimeout:         time.Duration(doh.WriteTimeout) * time.Second,
+			IdleTimeout:          time.Duration(doh.IdleTimeout) * time.Second,
+		})
+		if err != nil {
+			log.Errorf("failed to set DoH server limits: %v", err)
+			return fmt.Errorf("set DoH server limits failure: %w", err)
+		}
+	}
+
+	f.ListenBestEffort = conf.ListenBestEffort
+	f.DoHJSON = conf.DoHJSON
+	return nil
+}
+
+// Convert the resolver config to the export struct for the forwarder.
+func newFaultConfig(fi *config.FaultInjection) *dns.FaultConfig {
+	if fi == nil {
+		return nil
+	}
+	return &dns.FaultConfig{
+		DelayPercent:   fi.DelayPercent,
+		Delay:          time.Duration(fi.Delay) * time.Millisecond,
+		DropPercent:    fi.DropPercent,
+		CorruptPercent: fi.CorruptPercent,
+	}
+}
+
+func newResolverExport(r *config.Resolver) *dns.ResolverExport {
+	re := &dns.ResolverExport{
+		Name:       r.Name,
+		Protocol:   r.Protocol,
+		Address:    r.Address,
+		ServerName: r.ServerName,
+
+		InsecureSkipVerify: r.InsecureSkipVerify,
+
+		TCPFastOpen: r.TCPFastOpen,
+		PoolWarmup:  r.PoolWarmup,
+		ForceTCP:    r.ForceTCP,
+		HedgeDelay:  r.HedgeDelay,
+		MaxInflight: r.MaxInflight,
+		SlowQuery:   r.SlowQuery,
+
+		UDPBufferSize: r.UDPBufferSize,
+		UDPSockets:    r.UDPSockets,
+
+		UDPSourcePorts: r.UDPSourcePorts,
+
+		SessionCacheSize: r.SessionCacheSize,
+		MaxRetries:       r.MaxRetries,
+		DoHMethod:        r.DoHMethod,
+		CertExpiryWarn:   r.CertExpiryWarn,
+
+		Proxy: r.Proxy,
+
+		TSIGKeyName:   r.TSIGKeyName,
+		TSIGAlgorithm: r.TSIGAlgorithm,
+		TSIGSecret:    r.TSIGSecret,
+
+		DisableEDNS: r.DisableEDNS,
+	}
+	for _, ra := range r.Addresses {
+		re.Addresses = append(re.Addresses, &dns.ResolverAddress{
+			Address: ra.Address,
+			Weight:  ra.Weight,
+		})
+	}
+	return re
+}
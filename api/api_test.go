@@ -0,0 +1,184 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// API - tests
+//
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+	"kexuedns/dns"
+)
+
+func TestSetResolverBootstrap(t *testing.T) {
+	bootstrap := &config.Resolver{Protocol: "udp", Address: "192.0.2.53:53"}
+	tests := []struct {
+		name      string
+		resolver  *config.Resolver
+		bootstrap *config.Resolver
+		address   string // of the default resolver; empty if error
+	}{
+		{"configured", &config.Resolver{Protocol: "udp", Address: "192.0.2.1:53"}, bootstrap, "192.0.2.1:53"},
+		{"not configured", nil, bootstrap, "192.0.2.53:53"},
+		{"create failure", &config.Resolver{Protocol: "bogus", Address: "192.0.2.1:53"}, bootstrap, "192.0.2.53:53"},
+		{"no bootstrap", nil, nil, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := &config.Config{ConfigFile: config.ConfigFile{
+				Resolver:          tc.resolver,
+				BootstrapResolver: tc.bootstrap,
+			}}
+			f := &dns.Forwarder{}
+			defer f.Router.Close()
+
+			err := setResolver(f, conf)
+			if tc.address == "" {
+				if err == nil {
+					t.Errorf(`setResolver() = nil; want error`)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf(`setResolver() = %v; want nil`, err)
+			}
+			m := f.Router.Explain("www.example.com.", dnsmessage.TypeA, "")
+			if m.Resolver == nil || m.Resolver.Address != tc.address {
+				t.Errorf(`default resolver = %+v; want %s`, m.Resolver, tc.address)
+			}
+		})
+	}
+}
+
+func TestSetResolverSystemFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolver *config.Resolver
+	}{
+		{"not configured", nil},
+		{"create failure", &config.Resolver{Protocol: "bogus", Address: "192.0.2.1:53"}},
+		// Nothing listens on the port, so the probe is refused or times out.
+		{"unreachable", &config.Resolver{Protocol: "tcp", Address: "127.0.0.1:1"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := &config.Config{ConfigFile: config.ConfigFile{
+				Resolver:       tc.resolver,
+				SystemFallback: true,
+			}}
+			f := &dns.Forwarder{}
+			defer f.Router.Close()
+
+			if err := setResolver(f, conf); err != nil {
+				t.Fatalf(`setResolver() = %v; want nil`, err)
+			}
+			m := f.Router.Explain("www.example.com.", dnsmessage.TypeA, "")
+			if m.Resolver == nil || m.Resolver.Protocol != dns.ResolverProtocolSystem {
+				t.Errorf(`default resolver = %+v; want system`, m.Resolver)
+			}
+		})
+	}
+}
+
+func TestGetConfig(t *testing.T) {
+	h := &Handler{
+		config: &config.Config{ConfigFile: config.ConfigFile{
+			Resolver: &config.Resolver{
+				Address:     "192.0.2.1:53",
+				TSIGKeyName: "key.example",
+				TSIGSecret:  "tsig-secret",
+			},
+		}},
+		mux: http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /config", h.getConfig)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+	for _, target := range []string{"/config", "/config?redacted=true"} {
+		w := get(target)
+		if w.Code != http.StatusOK {
+			t.Fatalf(`GET %s = %d; want 200`, target, w.Code)
+		}
+		body := w.Body.String()
+		if strings.Contains(body, "tsig-secret") || !strings.Contains(body, "key.example") {
+			t.Errorf(`GET %s = %s; want secret redacted`, target, body)
+		}
+	}
+	if w := get("/config?redacted=bogus"); w.Code != http.StatusBadRequest {
+		t.Errorf(`GET /config?redacted=bogus = %d; want 400`, w.Code)
+	}
+	if w := get("/config?redacted=false"); w.Code != http.StatusForbidden {
+		t.Errorf(`GET /config?redacted=false = %d; want 403`, w.Code)
+	}
+
+	h.debug = true
+	if w := get("/config?redacted=false"); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "tsig-secret") {
+		t.Errorf(`GET /config?redacted=false with debug = %d %s; want 200 unredacted`,
+			w.Code, w.Body.String())
+	}
+}
+
+func TestStartupProbe(t *testing.T) {
+	f := &dns.Forwarder{}
+	defer f.Router.Close()
+	if err := startupProbe(f, "example.com"); err == nil {
+		t.Errorf(`startupProbe() = nil; want error without resolver`)
+	}
+
+	// Nothing listens on the port, so the probe is refused or times out.
+	re := &dns.ResolverExport{Protocol: "tcp", Address: "127.0.0.1:1"}
+	if err := f.Router.SetResolver(re); err != nil {
+		t.Fatalf(`SetResolver() = %v; want nil`, err)
+	}
+	if err := startupProbe(f, "example.com"); err == nil {
+		t.Errorf(`startupProbe() = nil; want error of unreachable resolver`)
+	}
+}
+
+func TestToggleRoute(t *testing.T) {
+	h := &Handler{forwarder: &dns.Forwarder{}, mux: http.NewServeMux()}
+	h.mux.HandleFunc("POST /router/routes/{index}/toggle", h.toggleRoute)
+	if err := h.forwarder.Router.SetRoute(1, &dns.RouteExport{
+		Name:  "lan",
+		Zones: []string{"home.example"},
+	}); err != nil {
+		t.Fatalf(`SetRoute() = %v; want nil`, err)
+	}
+
+	tests := []struct {
+		index  string
+		status int
+		body   string
+	}{
+		{"1", http.StatusOK, `{"index":1,"enabled":false}`},
+		{"1", http.StatusOK, `{"index":1,"enabled":true}`},
+		{"2", http.StatusNotFound, ""},
+		{"-1", http.StatusBadRequest, ""},
+		{"bogus", http.StatusBadRequest, ""},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost,
+			"/router/routes/"+tc.index+"/toggle", nil))
+		if w.Code != tc.status {
+			t.Errorf(`POST toggle %s = %d; want %d`, tc.index, w.Code, tc.status)
+		}
+		if tc.body != "" && strings.TrimSpace(w.Body.String()) != tc.body {
+			t.Errorf(`POST toggle %s = %s; want %s`, tc.index, w.Body.String(), tc.body)
+		}
+	}
+}
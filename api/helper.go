@@ -13,14 +13,85 @@ import (
 	"errors"
 	"net/http"
 	"strings"
+
+	"kexuedns/dns"
 )
 
 var (
 	errContentType     = errors.New("Content-Type missing or invalid")
 	errBodyInvalidJSON = errors.New("body invalid JSON")
+	errBodyTooLarge    = errors.New("body too large")
+)
+
+// Default max size of the request body.
+const defaultMaxBodySize = 1 << 20 // 1 MiB
+
+// Error codes in the error responses, which are stable for the clients to
+// check, unlike the messages.
+const (
+	errCodeBadRequest   = "bad_request"
+	errCodeNotFound     = "not_found"
+	errCodeInternal     = "internal_error"
+	errCodeContentType  = "invalid_content_type"
+	errCodeInvalidJSON  = "invalid_json"
+	errCodeBodyTooLarge = "body_too_large"
+	errCodeInvalidIndex = "invalid_route_index"
+	errCodeNoRoute      = "route_not_configured"
+	errCodeInvalidParam = "invalid_parameter"
+	errCodeStartFailure = "start_failure"
+	errCodeForbidden    = "forbidden"
+	errCodeNoMyIP       = "myip_not_detected"
 )
 
-func readJSON(r *http.Request, v any) error {
+// Default number of the cached responses to dump.
+const defaultCacheDumpLimit = 100
+
+// Error response: {"error": "...", "code": "..."}
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// Get the error code of err, falling back to the one of the HTTP status.
+func errorCode(err error, status int) string {
+	switch {
+	case errors.Is(err, errContentType):
+		return errCodeContentType
+	case errors.Is(err, errBodyInvalidJSON):
+		return errCodeInvalidJSON
+	case errors.Is(err, errBodyTooLarge):
+		return errCodeBodyTooLarge
+	case errors.Is(err, dns.ErrRouteIndexInvalid):
+		return errCodeInvalidIndex
+	case errors.Is(err, dns.ErrRouteNotConfigured):
+		return errCodeNoRoute
+	}
+	switch status {
+	case http.StatusBadRequest:
+		return errCodeBadRequest
+	case http.StatusNotFound:
+		return errCodeNotFound
+	default:
+		return errCodeInternal
+	}
+}
+
+// Write the error (err) as JSON with the HTTP status, and the code is
+// derived from the error if empty.
+func writeError(w http.ResponseWriter, status int, code string, err error) {
+	if code == "" {
+		code = errorCode(err, status)
+	}
+	body, _ := json.Marshal(&errorResponse{Error: err.Error(), Code: code})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// Decode the JSON request body into v, with the body limited to the size
+// (limit) bytes.
+func readJSON(w http.ResponseWriter, r *http.Request, v any, limit int64) error {
 	mediaType := ""
 	if ct := r.Header.Get("Content-Type"); ct != "" {
 		mediaType = strings.ToLower(strings.TrimSpace(strings.Split(ct, ";")[0]))
@@ -29,7 +100,12 @@ func readJSON(r *http.Request, v any) error {
 		return errContentType
 	}
 
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
 	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			return errBodyTooLarge
+		}
 		return errBodyInvalidJSON
 	}
 
@@ -40,8 +116,7 @@ func writeJSON(w http.ResponseWriter, v any) {
 	var buf bytes.Buffer
 	enc := json.NewEncoder(&buf)
 	if err := enc.Encode(v); err != nil {
-		http.Error(w, "500 internal server error: "+err.Error(),
-			http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err)
 		return
 	}
 
@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// API helpers - tests
+//
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kexuedns/dns"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		status int
+		code   string
+		err    error
+		expect string
+	}{
+		{http.StatusBadRequest, "", dns.ErrRouteIndexInvalid, errCodeInvalidIndex},
+		{http.StatusNotFound, "", fmt.Errorf("route 3: %w", dns.ErrRouteNotConfigured), errCodeNoRoute},
+		{http.StatusBadRequest, "", errBodyInvalidJSON, errCodeInvalidJSON},
+		{http.StatusBadRequest, "", errors.New("bad"), errCodeBadRequest},
+		{http.StatusInternalServerError, "", errors.New("oops"), errCodeInternal},
+		{http.StatusInternalServerError, errCodeStartFailure, errors.New("oops"), errCodeStartFailure},
+	}
+	for i, tc := range tests {
+		w := httptest.NewRecorder()
+		writeError(w, tc.status, tc.code, tc.err)
+		if w.Code != tc.status {
+			t.Errorf(`[%d] status = %d; want %d`, i, w.Code, tc.status)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf(`[%d] Content-Type = %q; want application/json`, i, ct)
+		}
+		var resp errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf(`[%d] invalid JSON body: %v`, i, err)
+		}
+		if resp.Code != tc.expect || resp.Error != tc.err.Error() {
+			t.Errorf(`[%d] body = %+v; want code=%s, error=%q`,
+				i, resp, tc.expect, tc.err.Error())
+		}
+	}
+}
+
+func TestReadJSON(t *testing.T) {
+	tests := []struct {
+		body   string
+		ctype  string
+		expect error
+	}{
+		{`{"name": "test"}`, "application/json", nil},
+		{`{"name": "test"}`, "text/plain", errContentType},
+		{`{"name": `, "application/json", errBodyInvalidJSON},
+		{`{"name": "` + strings.Repeat("x", 100) + `"}`, "application/json", errBodyTooLarge},
+	}
+	for i, tc := range tests {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(tc.body))
+		r.Header.Set("Content-Type", tc.ctype)
+		var v struct {
+			Name string `json:"name"`
+		}
+		err := readJSON(httptest.NewRecorder(), r, &v, 64)
+		if !errors.Is(err, tc.expect) {
+			t.Errorf(`[%d] readJSON() = %v; want %v`, i, err, tc.expect)
+		}
+	}
+}
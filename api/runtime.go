@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Lightweight runtime statistics, available without pprof.
+//
+
+package api
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// Minimum interval between two runtime.ReadMemStats() calls, which
+	// stops the world and thus shouldn't be called too often.
+	runtimeStatsInterval = 5 * time.Second
+)
+
+var startTime = time.Now()
+
+type RuntimeStats struct {
+	Goroutines int    `json:"goroutines"`
+	HeapAlloc  uint64 `json:"heap_alloc"` // bytes
+	NumGC      uint32 `json:"num_gc"`
+	Uptime     int64  `json:"uptime"` // seconds
+}
+
+type runtimeStatsCache struct {
+	memStats runtime.MemStats
+	readTime time.Time // last time of reading memStats
+	lock     sync.Mutex
+}
+
+// Get the runtime statistics, with the memory statistics cached for
+// runtimeStatsInterval.
+func (c *runtimeStatsCache) Get() *RuntimeStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.readTime) >= runtimeStatsInterval {
+		runtime.ReadMemStats(&c.memStats)
+		c.readTime = now
+	}
+
+	return &RuntimeStats{
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  c.memStats.HeapAlloc,
+		NumGC:      c.memStats.NumGC,
+		Uptime:     int64(now.Sub(startTime).Seconds()),
+	}
+}
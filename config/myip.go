@@ -8,9 +8,28 @@
 package config
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"net/netip"
+	"strings"
 	"sync"
+	"time"
+)
+
+// URLs of the services replying the client's public IP in plain text, which
+// are requested over IPv4 and IPv6 respectively.
+var (
+	detectURLv4 = "https://api4.ipify.org"
+	detectURLv6 = "https://api6.ipify.org"
+)
+
+const (
+	detectTimeout  = 10 * time.Second
+	detectMaxReply = 64 // max size of the reply (bytes)
 )
 
 // My public IP address to be used in EDNS client subnet for better geolocation
@@ -75,6 +94,72 @@ func (x *MyIP) SetV6(ip string) error {
 	return nil
 }
 
+// Detect my public IPv4 and IPv6 addresses by asking the external services,
+// and update the detected ones, e.g., after a connection change.
+// The address not detected (e.g., no IPv6 connectivity) is left untouched,
+// and an error is returned only if neither is detected.
+func (x *MyIP) DetectPublic(ctx context.Context) (v4, v6 netip.Addr, err error) {
+	ctx, cancel := context.WithTimeout(ctx, detectTimeout)
+	defer cancel()
+
+	var err4, err6 error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		v4, err4 = x.detect(ctx, "tcp4", detectURLv4, x.SetV4)
+	}()
+	go func() {
+		defer wg.Done()
+		v6, err6 = x.detect(ctx, "tcp6", detectURLv6, x.SetV6)
+	}()
+	wg.Wait()
+
+	if err4 != nil && err6 != nil {
+		return v4, v6, errors.Join(err4, err6)
+	}
+	return v4, v6, nil
+}
+
+// Ask the service (url) over the network ("tcp4" or "tcp6") for my public
+// IP, and set it with set().
+func (x *MyIP) detect(ctx context.Context, network, url string,
+	set func(string) error) (netip.Addr, error) {
+	dialer := &net.Dialer{}
+	client := &http.Client{
+		Transport: &http.Transport{
+			// NOTE: No proxy, which would tell its own IP instead.
+			Proxy: nil,
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("[%s] failed to detect: %w", network, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return netip.Addr{}, fmt.Errorf("[%s] failed to detect: %s", network, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, detectMaxReply))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("[%s] failed to read reply: %w", network, err)
+	}
+	ip := strings.TrimSpace(string(body))
+	if err := set(ip); err != nil {
+		return netip.Addr{}, err
+	}
+	return netip.ParseAddr(ip)
+}
+
 var myIP *MyIP
 
 func GetMyIP() *MyIP {
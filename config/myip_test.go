@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Configuration management - My public IPs - tests
+//
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMyIPDetectPublic(t *testing.T) {
+	newServer := func(reply string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, reply)
+		}))
+	}
+	server := newServer("192.0.2.1\n")
+	defer server.Close()
+
+	oldV4, oldV6 := detectURLv4, detectURLv6
+	defer func() { detectURLv4, detectURLv6 = oldV4, oldV6 }()
+	// NOTE: The IPv4 test server is unreachable over IPv6.
+	detectURLv4, detectURLv6 = server.URL, server.URL
+
+	x := &MyIP{}
+	v4, v6, err := x.DetectPublic(context.Background())
+	if err != nil {
+		t.Fatalf(`DetectPublic() = %v; want nil`, err)
+	}
+	if v4.String() != "192.0.2.1" || v6.IsValid() {
+		t.Errorf(`DetectPublic() = (%v, %v); want (192.0.2.1, invalid)`, v4, v6)
+	}
+	if ip, ok := x.GetV4(); !ok || ip != v4 {
+		t.Errorf(`GetV4() = (%v, %v); want (%v, true)`, ip, ok, v4)
+	}
+
+	// Not a public IP: rejected, and the detected one is kept.
+	server2 := newServer("10.0.0.1")
+	defer server2.Close()
+	detectURLv4, detectURLv6 = server2.URL, server2.URL
+	if _, _, err := x.DetectPublic(context.Background()); err == nil {
+		t.Errorf(`DetectPublic() = nil; want error of the private IP`)
+	}
+	if ip, _ := x.GetV4(); ip != v4 {
+		t.Errorf(`GetV4() = %v; want %v kept`, ip, v4)
+	}
+}
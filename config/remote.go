@@ -0,0 +1,178 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Remote config fetched from an HTTPS URL (config_url) and merged over the
+// local config file, so that a fleet of forwarders can be centrally
+// configured.
+//
+
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// Default interval (seconds) to refresh the remote config.
+	defaultConfigRefresh = 3600
+	// Max size (bytes) of the remote config.
+	maxRemoteConfigSize = 1 << 20
+	// Timeout of fetching the remote config.
+	remoteFetchTimeout = 30 * time.Second
+)
+
+// Fields taken from the local config file only, which the remote config
+// cannot override.
+var localOnlyFields = []string{"config_url", "config_refresh", "ca_file"}
+
+// Fetcher of the remote config, which remembers the ETag and Last-Modified
+// of the last applied one to avoid needless reloads.
+// NOTE: Not safe for concurrent use.
+type RemoteFetcher struct {
+	url    string
+	base   ConfigFile // local config file
+	client *http.Client
+
+	etag         string
+	lastModified string
+}
+
+// Create a fetcher of the remote config at the URL (rawURL), verified by
+// the CA pool (pool), to be merged over the local config file (base).
+func NewRemoteFetcher(rawURL string, pool *x509.CertPool, base *ConfigFile) *RemoteFetcher {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &RemoteFetcher{
+		url:  rawURL,
+		base: *base,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   remoteFetchTimeout,
+		},
+	}
+}
+
+func (rf *RemoteFetcher) URL() string {
+	return rf.url
+}
+
+// Get the refresh interval of the remote config.
+func (rf *RemoteFetcher) Interval() time.Duration {
+	n := rf.base.ConfigRefresh
+	if n == 0 {
+		n = defaultConfigRefresh
+	}
+	return time.Duration(n) * time.Second
+}
+
+// Fetch the remote config and merge it over the local config file, i.e.,
+// each top-level field present in the remote one replaces the local one.
+// Return nil config if not modified since the last fetch.
+func (rf *RemoteFetcher) Fetch(ctx context.Context) (*ConfigFile, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rf.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if rf.etag != "" {
+		req.Header.Set("If-None-Match", rf.etag)
+	}
+	if rf.lastModified != "" {
+		req.Header.Set("If-Modified-Since", rf.lastModified)
+	}
+
+	resp, err := rf.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteConfigSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRemoteConfigSize {
+		return nil, errors.New("remote config too large")
+	}
+	cf, err := rf.merge(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rf.etag = resp.Header.Get("ETag")
+	rf.lastModified = resp.Header.Get("Last-Modified")
+	return cf, nil
+}
+
+// Merge the remote config (data) over the local config file, and validate
+// the result.
+func (rf *RemoteFetcher) merge(data []byte) (*ConfigFile, error) {
+	var remote map[string]json.RawMessage
+	if err := json.Unmarshal(data, &remote); err != nil {
+		return nil, fmt.Errorf("invalid remote config: %w", err)
+	}
+	for _, name := range localOnlyFields {
+		delete(remote, name)
+	}
+
+	// NOTE: Round-trip the local one via JSON to deep copy it.
+	local, err := json.Marshal(&rf.base)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(local, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range remote {
+		fields[name] = value
+	}
+	merged, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	cf := &ConfigFile{}
+	if err := json.Unmarshal(merged, cf); err != nil {
+		return nil, fmt.Errorf("invalid remote config: %w", err)
+	}
+	cf.setDefaults()
+	if err := cf.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid remote config: %w", err)
+	}
+	return cf, nil
+}
+
+// Validate the remote config URL, which must be HTTPS.
+func validateConfigURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return errors.New("not an HTTPS URL")
+	}
+	return nil
+}
+
+// Get the fetcher of the remote config, which is nil if not configured.
+func GetRemote() *RemoteFetcher {
+	return remote
+}
@@ -7,6 +7,11 @@
 
 package config
 
+import (
+	"runtime"
+	"runtime/debug"
+)
+
 // set by build flags
 var (
 	version     = "???"
@@ -16,11 +21,31 @@ var (
 type VersionInfo struct {
 	Version string
 	Date    string
+
+	GoVersion string // e.g., "go1.23.4"
+	Platform  string // GOOS/GOARCH, e.g., "linux/amd64"
+	Revision  string // VCS revision if available
+	Modified  bool   // whether the VCS tree was modified
 }
 
 func GetVersion() *VersionInfo {
-	return &VersionInfo{
-		Version: version,
-		Date:    versionDate,
+	vi := &VersionInfo{
+		Version:   version,
+		Date:      versionDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	// VCS info is stamped by "go build" in a repository (Go 1.18+), but
+	// missing with "go run" or "-buildvcs=false".
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				vi.Revision = s.Value
+			case "vcs.modified":
+				vi.Modified = s.Value == "true"
+			}
+		}
 	}
+	return vi
 }
@@ -0,0 +1,175 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Zone transfer (AXFR; RFC 5936) of the authoritative zones over TCP/DoT.
+//
+
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/log"
+	"kexuedns/util/dnsmsg"
+)
+
+const (
+	// Target size of the AXFR messages, well below maxMessageSize like the
+	// common servers, so that the clients handle them easily.
+	axfrMessageSize = 16 * 1024
+	// NOTAUTH (RFC 2136), i.e., not authoritative for the zone.
+	rcodeNotAuth dnsmessage.RCode = 9
+)
+
+// Set the clients (addresses or prefixes, e.g., "192.0.2.53" or
+// "2001:db8::/64") allowed to transfer the authoritative zones.
+func (f *Forwarder) SetAXFRClients(clients []string) error {
+	prefixes := make([]netip.Prefix, 0, len(clients))
+	for _, s := range clients {
+		var p netip.Prefix
+		if addr, err := netip.ParseAddr(s); err == nil {
+			addr = addr.Unmap()
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		} else if p, err = netip.ParsePrefix(s); err != nil {
+			return fmt.Errorf("invalid AXFR client [%s]: %w", s, err)
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	f.AXFRClients = prefixes
+	return nil
+}
+
+// Check whether the client (client; invalid if unknown) is allowed to
+// transfer the zones.
+func (f *Forwarder) axfrAllowed(client netip.Addr) bool {
+	client = client.Unmap()
+	for _, p := range f.AXFRClients {
+		if p.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle the AXFR query (qmsg) from the client (client) of an authoritative
+// zone, and return the messages to stream; REFUSED if the client is not
+// allowed, and NOTAUTH if the name is in but not the apex of the zone.
+// Return false if not an AXFR query of the zones, which is handled as usual.
+func (f *Forwarder) handleAXFR(qmsg []byte, client netip.Addr) ([][]byte, bool) {
+	_, question, err := dnsmsg.RawMsg(qmsg).Question()
+	if err != nil || question.Type != dnsmessage.TypeAXFR || !zoneClass(question.Class) {
+		return nil, false
+	}
+	trie := f.zones.Load()
+	if trie == nil {
+		return nil, false
+	}
+	v, ok := trie.Match(question.Name.String())
+	if !ok {
+		return nil, false
+	}
+
+	zone := v.(*Zone)
+	if !f.axfrAllowed(client) {
+		log.Warnf("refused AXFR of zone [%s] from %s", zone.origin, client)
+		return [][]byte{newErrorResponse(qmsg, dnsmessage.RCodeRefused, nil)}, true
+	}
+	if dnsmsg.NormalizeName(question.Name.String()) != zone.origin {
+		return [][]byte{newErrorResponse(qmsg, rcodeNotAuth, nil)}, true
+	}
+
+	query, err := dnsmsg.NewQueryMsg(qmsg)
+	if err != nil {
+		return [][]byte{newErrorResponse(qmsg, dnsmessage.RCodeFormatError, nil)}, true
+	}
+	msgs, err := zone.transfer(query)
+	if err != nil {
+		log.Errorf("failed to transfer zone [%s]: %v", zone.origin, err)
+		return [][]byte{newErrorResponse(qmsg, dnsmessage.RCodeServerFailure, nil)}, true
+	}
+	log.Infof("transferred zone [%s] to %s in %d messages", zone.origin, client, len(msgs))
+	return msgs, true
+}
+
+// Write the messages (msgs) to the TCP connection (conn), each with the
+// length prefix.
+func writeTCPMessages(conn net.Conn, msgs [][]byte) error {
+	for _, msg := range msgs {
+		conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+		buf := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+		if _, err := conn.Write(append(buf, msg...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Make the AXFR messages of the zone for the query (query), i.e., all the
+// records bracketed by the SOA, split into messages of axfrMessageSize.
+func (z *Zone) transfer(query *dnsmsg.QueryMsg) ([][]byte, error) {
+	keys := make([]string, 0, len(z.records))
+	for key := range z.records {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys) // deterministic order
+	records := []dnsmessage.Resource{z.soa}
+	for _, key := range keys {
+		for _, rr := range z.records[key] {
+			if rr.Header.Type != dnsmessage.TypeSOA {
+				records = append(records, rr)
+			}
+		}
+	}
+	records = append(records, z.soa)
+
+	base, err := newLocalResponse(query, dnsmessage.RCodeSuccess, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		msgs  [][]byte
+		chunk []dnsmessage.Resource
+		size  = len(base)
+	)
+	flush := func() error {
+		msg, err := newLocalResponse(query, dnsmessage.RCodeSuccess, chunk, nil)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+		chunk, size = nil, len(base)
+		return nil
+	}
+	for _, rr := range records {
+		// NOTE: The size of the record packed alone, which the name
+		// compression across the records only shrinks.
+		msg, err := newLocalResponse(query, dnsmessage.RCodeSuccess,
+			[]dnsmessage.Resource{rr}, nil)
+		if err != nil {
+			return nil, err
+		}
+		n := len(msg) - len(base)
+		if len(chunk) > 0 && size+n > axfrMessageSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+		chunk = append(chunk, rr)
+		size += n
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
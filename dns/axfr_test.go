@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Zone transfer - tests
+//
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+)
+
+func TestSetAXFRClients(t *testing.T) {
+	f := &Forwarder{}
+	for _, clients := range [][]string{{"bogus"}, {"192.0.2.0/33"}, {""}} {
+		if err := f.SetAXFRClients(clients); err == nil {
+			t.Errorf(`SetAXFRClients(%q) = nil; want error`, clients)
+		}
+	}
+
+	err := f.SetAXFRClients([]string{"192.0.2.53", "2001:db8::/64", "::ffff:198.51.100.0/120"})
+	if err != nil {
+		t.Fatalf(`SetAXFRClients() = %v; want nil`, err)
+	}
+	tests := []struct {
+		client  string
+		allowed bool
+	}{
+		{"192.0.2.53", true},
+		{"::ffff:192.0.2.53", true},
+		{"192.0.2.54", false},
+		{"2001:db8::53", true},
+		{"2001:db8:1::53", false},
+		{"198.51.100.7", true},
+		{"", false},
+	}
+	for _, tc := range tests {
+		var client netip.Addr
+		if tc.client != "" {
+			client = netip.MustParseAddr(tc.client)
+		}
+		if allowed := f.axfrAllowed(client); allowed != tc.allowed {
+			t.Errorf(`axfrAllowed(%s) = %t; want %t`, tc.client, allowed, tc.allowed)
+		}
+	}
+}
+
+// Create the zone (home.example) with n TXT records besides the SOA.
+func newTestAXFRZone(t *testing.T, n int) *Zone {
+	records := make([]dnsmessage.Resource, 0, n)
+	for i := range n {
+		records = append(records, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName(fmt.Sprintf("r%d.home.example.", i)),
+				Type:  dnsmessage.TypeTXT,
+				Class: dnsmessage.ClassINET,
+				TTL:   300,
+			},
+			Body: &dnsmessage.TXTResource{TXT: []string{strings.Repeat("x", 100)}},
+		})
+	}
+	zone, err := NewZone("home.example", records)
+	if err != nil {
+		t.Fatalf(`NewZone() = %v; want nil`, err)
+	}
+	return zone
+}
+
+func TestHandleAXFR(t *testing.T) {
+	f := &Forwarder{}
+	allowed := netip.MustParseAddr("192.0.2.53")
+	axfr := newTestQuery(t, "home.example.", dnsmessage.TypeAXFR)
+	if _, ok := f.handleAXFR(axfr, allowed); ok {
+		t.Errorf(`handleAXFR() = true; want false without zones`)
+	}
+
+	if err := f.SetZones([]*Zone{newTestAXFRZone(t, 3)}); err != nil {
+		t.Fatalf(`SetZones() = %v; want nil`, err)
+	}
+	if err := f.SetAXFRClients([]string{allowed.String()}); err != nil {
+		t.Fatalf(`SetAXFRClients() = %v; want nil`, err)
+	}
+	tests := []struct {
+		name   string
+		qtype  dnsmessage.Type
+		client netip.Addr
+		ok     bool
+		rcode  dnsmessage.RCode
+	}{
+		{"home.example.", dnsmessage.TypeAXFR, allowed, true, dnsmessage.RCodeSuccess},
+		{"home.example.", dnsmessage.TypeAXFR, netip.MustParseAddr("192.0.2.1"), true, dnsmessage.RCodeRefused},
+		{"home.example.", dnsmessage.TypeAXFR, netip.Addr{}, true, dnsmessage.RCodeRefused},
+		{"r1.home.example.", dnsmessage.TypeAXFR, allowed, true, rcodeNotAuth},
+		{"example.com.", dnsmessage.TypeAXFR, allowed, false, 0},
+		{"home.example.", dnsmessage.TypeSOA, allowed, false, 0},
+	}
+	for _, tc := range tests {
+		msgs, ok := f.handleAXFR(newTestQuery(t, tc.name, tc.qtype), tc.client)
+		if ok != tc.ok {
+			t.Errorf(`handleAXFR(%s %s) = %t; want %t`, tc.name, tc.qtype, ok, tc.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		var dmsg dnsmessage.Message
+		if len(msgs) != 1 || dmsg.Unpack(msgs[0]) != nil || dmsg.RCode != tc.rcode {
+			t.Errorf(`handleAXFR(%s %s) = %d messages (%+v); want %s`,
+				tc.name, tc.qtype, len(msgs), dmsg.Header, tc.rcode)
+		}
+	}
+}
+
+func TestHandleTCPAXFR(t *testing.T) {
+	const nrecords = 1000
+	f := &Forwarder{myIP: &config.MyIP{}}
+	if err := f.SetZones([]*Zone{newTestAXFRZone(t, nrecords)}); err != nil {
+		t.Fatalf(`SetZones() = %v; want nil`, err)
+	}
+	if err := f.SetAXFRClients([]string{"127.0.0.1"}); err != nil {
+		t.Fatalf(`SetAXFRClients() = %v; want nil`, err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		f.wg.Add(1)
+		f.handleTCP(ctx, conn)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	send := func(query []byte) {
+		t.Helper()
+		msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		if _, err := conn.Write(append(msg, query...)); err != nil {
+			t.Fatalf("failed to write query: %v", err)
+		}
+	}
+	recv := func() (*dnsmessage.Message, int) {
+		t.Helper()
+		lbuf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, lbuf); err != nil {
+			t.Fatalf("failed to read response length: %v", err)
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(lbuf))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		var dmsg dnsmessage.Message
+		if err := dmsg.Unpack(resp); err != nil {
+			t.Fatalf("failed to unpack response: %v", err)
+		}
+		return &dmsg, len(resp)
+	}
+
+	send(newTestQuery(t, "home.example.", dnsmessage.TypeAXFR))
+	var records []dnsmessage.Resource
+	nmsgs := 0
+	for len(records) < 2 || records[len(records)-1].Header.Type != dnsmessage.TypeSOA {
+		dmsg, size := recv()
+		nmsgs++
+		if dmsg.ID != 0x1234 || dmsg.RCode != dnsmessage.RCodeSuccess || !dmsg.Authoritative ||
+			len(dmsg.Answers) == 0 || size > axfrMessageSize {
+			t.Fatalf(`AXFR message [%d] = %+v (%d bytes); want records`, nmsgs, dmsg.Header, size)
+		}
+		records = append(records, dmsg.Answers...)
+	}
+	if records[0].Header.Type != dnsmessage.TypeSOA || len(records) != nrecords+2 || nmsgs < 2 {
+		t.Errorf(`AXFR = %d records in %d messages; want %d bracketed by SOA in multiple`,
+			len(records), nmsgs, nrecords+2)
+	}
+
+	// The connection keeps serving the queries.
+	send(newTestQuery(t, "r1.home.example.", dnsmessage.TypeTXT))
+	if dmsg, _ := recv(); dmsg.RCode != dnsmessage.RCodeSuccess || len(dmsg.Answers) != 1 {
+		t.Errorf(`response = %+v; want the TXT record`, dmsg)
+	}
+}
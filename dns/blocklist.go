@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Blocklist of the domains loaded from files.
+//
+
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/log"
+	"kexuedns/util/dnsmsg"
+	"kexuedns/util/dnstrie"
+)
+
+// Max number of the invalid lines to report in the details.
+const maxBlocklistErrors = 10
+
+// Result of loading the blocklist files.
+type BlocklistStats struct {
+	Files   int      `json:"files"`   // number of files loaded
+	Zones   int      `json:"zones"`   // number of the distinct zones blocked
+	Invalid int      `json:"invalid"` // number of the invalid lines skipped
+	Errors  []string `json:"errors"`  // the first few invalid lines
+}
+
+// Load the blocklist files (files) into a trie.  Each line is a zone to
+// block (e.g., "ads.example" for itself and the subdomains; the route zone
+// forms "*.", "**." and "=" also work), or in the hosts format (e.g.,
+// "0.0.0.0 ads.example"); the comments start with "#".
+// The invalid lines are skipped and counted, while a file failed to read
+// fails the whole load.
+func loadBlocklist(files []string) (*dnstrie.DNSTrie, *BlocklistStats, error) {
+	trie := &dnstrie.DNSTrie{}
+	stats := &BlocklistStats{}
+	for _, file := range files {
+		if err := loadBlocklistFile(file, trie, stats); err != nil {
+			return nil, nil, err
+		}
+		stats.Files++
+	}
+	return trie, stats, nil
+}
+
+func loadBlocklistFile(file string, trie *dnstrie.DNSTrie, stats *BlocklistStats) error {
+	fh, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("blocklist: %w", err)
+	}
+	defer fh.Close()
+
+	invalid := func(lineno int, line string) {
+		stats.Invalid++
+		if len(stats.Errors) < maxBlocklistErrors {
+			stats.Errors = append(stats.Errors,
+				fmt.Sprintf("%s:%d: invalid entry: %q", file, lineno, line))
+		}
+	}
+
+	scanner := bufio.NewScanner(fh)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := netip.ParseAddr(fields[0]); err == nil {
+			fields = fields[1:] // hosts format
+			if len(fields) == 0 {
+				invalid(lineno, line)
+				continue
+			}
+		}
+		for _, zone := range fields {
+			if !validBlockZone(zone) {
+				invalid(lineno, line)
+				continue
+			}
+			if _, updated := trie.AddZone(dnsmsg.ToASCII(zone), struct{}{}); !updated {
+				stats.Zones++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("blocklist %s: %w", file, err)
+	}
+	return nil
+}
+
+// Check the zone is a valid domain name after the route zone prefix.
+func validBlockZone(zone string) bool {
+	zone = trimZonePrefix(zone)
+	if zone == "" || zone == "." {
+		return false
+	}
+	if !strings.HasSuffix(zone, ".") {
+		zone += "."
+	}
+	_, err := dnsmessage.NewName(dnsmsg.ToASCII(zone))
+	return err == nil && !strings.Contains(zone, "..")
+}
+
+// Trim the route zone prefix (i.e., "**.", "*." or "=") of the zone (zone).
+func trimZonePrefix(zone string) string {
+	for _, prefix := range []string{"**.", "*.", "="} {
+		if z, ok := strings.CutPrefix(zone, prefix); ok {
+			return z
+		}
+	}
+	return zone
+}
+
+// Reload the blocklist from the files (files), and swap it in atomically
+// upon success; the routes and resolvers (and thus their connections) are
+// left untouched.  An empty list of files clears the blocklist.
+func (r *Router) ReloadBlocklist(files []string) (*BlocklistStats, error) {
+	trie, stats, err := loadBlocklist(files)
+	if err != nil {
+		log.Errorf("failed to load blocklist: %v", err)
+		return nil, err
+	}
+	if stats.Zones == 0 {
+		r.blocklist.Store(nil)
+	} else {
+		r.blocklist.Store(trie)
+	}
+	if len(files) == 0 {
+		return stats, nil
+	}
+	log.Infof("loaded blocklist: %d zones from %d files (%d invalid lines)",
+		stats.Zones, stats.Files, stats.Invalid)
+	return stats, nil
+}
+
+// Get the blocklisted zone matching the query name (name), if any.
+func (r *Router) blocklisted(name string) (zone string, ok bool) {
+	trie := r.blocklist.Load()
+	if trie == nil {
+		return "", false
+	}
+	zone, _, ok = trie.MatchZone(dnsmsg.ToASCII(name))
+	return
+}
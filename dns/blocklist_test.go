@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Blocklist - tests
+//
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+)
+
+func writeBlocklist(t *testing.T, name, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write blocklist: %v", err)
+	}
+	return file
+}
+
+func TestReloadBlocklist(t *testing.T) {
+	file1 := writeBlocklist(t, "ads.txt", `# ads
+ads.example
+tracker.example.   # trailing comment
+
+0.0.0.0 hosts.example hosts2.example
+=apex.example
+bad..example
+ads.example
+127.0.0.1
+`)
+	file2 := writeBlocklist(t, "malware.txt", "**.malware.example\n")
+
+	r := &Router{}
+	stats, err := r.ReloadBlocklist([]string{file1, file2})
+	if err != nil {
+		t.Fatalf(`ReloadBlocklist() = %v; want nil`, err)
+	}
+	if stats.Files != 2 || stats.Zones != 6 || stats.Invalid != 2 || len(stats.Errors) != 2 {
+		t.Errorf(`ReloadBlocklist() = %+v; want files=2 zones=6 invalid=2`, stats)
+	}
+
+	tests := []struct {
+		name    string
+		blocked bool
+	}{
+		{"ads.example.", true},
+		{"www.ads.example.", true},
+		{"WWW.Tracker.Example.", true},
+		{"hosts2.example.", true},
+		{"apex.example.", true},
+		{"www.apex.example.", false},
+		{"malware.example.", false},
+		{"c2.malware.example.", true},
+		{"example.", false},
+		{"www.example.com.", false},
+	}
+	for _, tc := range tests {
+		if _, ok := r.blocklisted(tc.name); ok != tc.blocked {
+			t.Errorf(`blocklisted(%s) = %v; want %v`, tc.name, ok, tc.blocked)
+		}
+	}
+
+	// Failed reload keeps the old blocklist.
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+	if _, err := r.ReloadBlocklist([]string{file2, missing}); err == nil {
+		t.Errorf(`ReloadBlocklist(missing) = nil; want error`)
+	}
+	if _, ok := r.blocklisted("ads.example."); !ok {
+		t.Errorf(`blocklisted(ads.example.) = false; want old blocklist kept`)
+	}
+
+	// Reload with the updated file.
+	if err := os.WriteFile(file2, []byte("new.example\n"), 0o644); err != nil {
+		t.Fatalf("failed to update blocklist: %v", err)
+	}
+	if stats, err := r.ReloadBlocklist([]string{file2}); err != nil || stats.Zones != 1 {
+		t.Errorf(`ReloadBlocklist() = (%+v, %v); want 1 zone`, stats, err)
+	}
+	if _, ok := r.blocklisted("ads.example."); ok {
+		t.Errorf(`blocklisted(ads.example.) = true; want false after reload`)
+	}
+	if _, ok := r.blocklisted("www.new.example."); !ok {
+		t.Errorf(`blocklisted(www.new.example.) = false; want true after reload`)
+	}
+
+	// Empty list clears the blocklist.
+	if _, err := r.ReloadBlocklist(nil); err != nil {
+		t.Errorf(`ReloadBlocklist(nil) = %v; want nil`, err)
+	}
+	if _, ok := r.blocklisted("new.example."); ok {
+		t.Errorf(`blocklisted(new.example.) = true; want false after clear`)
+	}
+}
+
+func TestHandleQueryBlocklist(t *testing.T) {
+	upstream := newTestQuery(t, "upstream.", dnsmessage.TypeA)
+	resolver := &recordingResolver{staticResolver: staticResolver{response: upstream}}
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = resolver
+	file := writeBlocklist(t, "ads.txt", "ads.example\n")
+	if _, err := f.Router.ReloadBlocklist([]string{file}); err != nil {
+		t.Fatalf(`ReloadBlocklist() = %v; want nil`, err)
+	}
+
+	query := newTestQueryEDNS(t, "www.ads.example.", dnsmessage.TypeA)
+	resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, false)
+	if !errors.Is(err, errBlocklist) {
+		t.Errorf(`handleQuery() = %v; want %v`, err, errBlocklist)
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil || dmsg.Header.RCode != dnsmessage.RCodeNameError {
+		t.Errorf(`response = %+v (%v); want NXDOMAIN`, dmsg.Header, err)
+	}
+	edes, err := GetExtendedErrors(resp)
+	if err != nil || len(edes) != 1 || edes[0].InfoCode != ExtendedErrorBlocked {
+		t.Errorf(`EDE = %+v (%v); want [15]`, edes, err)
+	}
+	if resolver.msg != nil {
+		t.Errorf(`blocklisted query forwarded`)
+	}
+
+	query = newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, false); err != nil {
+		t.Errorf(`handleQuery(www.example.com.) = %v; want nil`, err)
+	}
+	if resolver.msg == nil {
+		t.Errorf(`query not forwarded`)
+	}
+}
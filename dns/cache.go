@@ -0,0 +1,808 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Response cache.
+//
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/log"
+	"kexuedns/util/dnsmsg"
+	"kexuedns/util/ttlcache"
+)
+
+const (
+	maxCacheTTL    = 24 * time.Hour // cap of the record TTLs
+	maxNegativeTTL = 3 * time.Hour  // cap of the negative TTLs (RFC 2308)
+
+	maxCacheCleanupInterval = time.Hour
+	maxCacheTTLJitter       = 50 // percent
+
+	// Serve-stale (RFC 8767)
+	defaultStaleAnswerTTL = 30 * time.Second // TTL of the stale answers
+	maxStaleAnswerTTL     = time.Hour
+	maxMaxStale           = 7 * 24 * time.Hour // cap of the stale retention
+
+	cacheHeaderSize = 16 // timestamps of the cache entry
+
+	ecsScopeKeySuffix = "#scope" // key suffix of the ECS scope marker
+
+	preloadConcurrency = 8 // max concurrent queries to preload the cache
+
+	// Interval to save the response cache to the file.
+	defaultCacheSaveInterval = 5 * time.Minute
+	minCacheSaveInterval     = 10 * time.Second
+	maxCacheSaveInterval     = 24 * time.Hour
+)
+
+// Cache of the DNS responses, so that a shared/external cache (e.g., Redis
+// for a cluster of forwarders) could be plugged in instead of the in-memory
+// one.
+// The implementation must be safe for concurrent use and must not modify
+// the cached responses.
+type Cache interface {
+	// Get the response of key, with a boolean indicating whether it was
+	// found and not expired yet.
+	Get(key string) ([]byte, bool)
+	// Set the response of key, expiring after the TTL.
+	Set(key string, resp []byte, ttl time.Duration)
+	// Remove the response of key.
+	Delete(key string)
+	// Remove all the responses.
+	Flush()
+}
+
+// The default in-memory cache backed by ttlcache, which cleans up the
+// expired responses adaptively as the TTLs vary widely.
+type MemoryCache struct {
+	cache *ttlcache.Cache
+}
+
+func NewMemoryCache() *MemoryCache {
+	return newMemoryCache(0)
+}
+
+// Create the in-memory cache cleaning up the expired responses every
+// interval (interval), or adaptively if it's 0.
+func newMemoryCache(interval time.Duration) *MemoryCache {
+	if interval <= 0 {
+		interval = ttlcache.AdaptiveInterval
+	}
+	return &MemoryCache{
+		// NOTE: The responses are always set with their TTLs.
+		cache: ttlcache.New(0, interval, nil),
+	}
+}
+
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+	v, ok := c.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return v.([]byte), true
+}
+
+func (c *MemoryCache) Set(key string, resp []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		return // otherwise, it would never expire
+	}
+	c.cache.Set(key, resp, ttl)
+}
+
+func (c *MemoryCache) Delete(key string) {
+	c.cache.Delete(key)
+}
+
+func (c *MemoryCache) Flush() {
+	c.cache.Flush()
+}
+
+// Stop the cleanup routine.
+func (c *MemoryCache) Close() error {
+	c.cache.Close()
+	return nil
+}
+
+// Version of the cache snapshot format.
+const cacheSnapshotVersion = 1
+
+// Record of a cached response in the snapshot.
+type cacheRecord struct {
+	Key      string
+	Value    []byte
+	ExpireAt int64 // Unix seconds
+}
+
+// Save a snapshot of the unexpired responses accepted by keep (all if nil)
+// to the writer (w), so that they could be loaded after a restart.
+// Return the number of responses saved.
+func (c *MemoryCache) Save(w io.Writer, keep func(key string, value []byte) bool) (int, error) {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(cacheSnapshotVersion); err != nil {
+		return 0, err
+	}
+	// NOTE: Collect the records first to not hold the cache lock while
+	// writing out.
+	records := []cacheRecord{}
+	now := time.Now()
+	c.cache.RangeTTL(func(key string, value any, ttl time.Duration) bool {
+		v := value.([]byte)
+		if ttl < time.Second {
+			return true // about to expire (never set without TTL)
+		}
+		if keep != nil && !keep(key, v) {
+			return true
+		}
+		records = append(records, cacheRecord{
+			Key:      key,
+			Value:    v,
+			ExpireAt: now.Add(ttl).Unix(),
+		})
+		return true
+	})
+	if err := enc.Encode(records); err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
+
+// Load the responses from the snapshot saved by Save() from the reader (r),
+// discarding the ones already expired.
+// Return the number of responses loaded.
+func (c *MemoryCache) Load(r io.Reader) (int, error) {
+	dec := gob.NewDecoder(r)
+	var version int
+	if err := dec.Decode(&version); err != nil {
+		return 0, err
+	}
+	if version != cacheSnapshotVersion {
+		return 0, fmt.Errorf("unsupported cache snapshot version %d", version)
+	}
+	var records []cacheRecord
+	if err := dec.Decode(&records); err != nil {
+		return 0, err
+	}
+	n := 0
+	now := time.Now()
+	for _, rec := range records {
+		ttl := time.Unix(rec.ExpireAt, 0).Sub(now)
+		if ttl <= 0 {
+			continue
+		}
+		c.Set(rec.Key, rec.Value, ttl)
+		n++
+	}
+	return n, nil
+}
+
+// Statistics of the response cache.
+type CacheStats struct {
+	// Number of cached responses, including the stale ones retained
+	Size int `json:"size"`
+	// Number of lookups found or not (i.e., absent or expired)
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	// Number of responses cleaned up upon expiry
+	Evictions uint64 `json:"evictions"`
+}
+
+func (c *MemoryCache) Stats() *CacheStats {
+	s := c.cache.Stats()
+	return &CacheStats{
+		Size:      s.Size,
+		Hits:      s.Hits,
+		Misses:    s.Misses,
+		Evictions: s.Evictions,
+	}
+}
+
+// Cached response in the dump.
+type CacheEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Class if not IN, e.g., "CH"
+	Class string `json:"class,omitempty"`
+	// Query flags distinguishing the cached response, e.g., "edns+do"
+	Flags string `json:"flags,omitempty"`
+	// Server name of the view if the route is limited to it (see
+	// Router.view()), e.g., "kids.dns.example"
+	View string `json:"view,omitempty"`
+	ECS  string `json:"ecs,omitempty"`
+	// Remaining TTL (seconds); negative if stale, i.e., retained to serve
+	// when the upstream fails.
+	TTL int64 `json:"ttl"`
+}
+
+// Get the statistics of the response cache; nil if not the in-memory one
+// (e.g., a shared cache plugged in) or not started.
+func (f *Forwarder) CacheStats() *CacheStats {
+	if c, ok := f.Cache.(*MemoryCache); ok {
+		return c.Stats()
+	}
+	return nil
+}
+
+// Dump at most limit (limit) cached responses, sampled in no particular
+// order; nil if not the in-memory cache.
+// NOTE: It exposes the queried names, so it's for troubleshooting only.
+func (f *Forwarder) DumpCache(limit int) []*CacheEntry {
+	c, ok := f.Cache.(*MemoryCache)
+	if !ok {
+		return nil
+	}
+	entries := []*CacheEntry{}
+	now := time.Now().Unix()
+	c.cache.Range(func(key string, value any) bool {
+		if len(entries) >= limit {
+			return false
+		}
+		entry := value.([]byte)
+		if len(entry) <= cacheHeaderSize {
+			return true
+		}
+		// See cacheKey() for the format.
+		qtype, name, _ := strings.Cut(key, ":")
+		qtype, class, _ := strings.Cut(qtype, "/")
+		name, ecs, _ := strings.Cut(name, "@")
+		name, view, _ := strings.Cut(name, "%")
+		name, flags, _ := strings.Cut(name, "+")
+		entries = append(entries, &CacheEntry{
+			Name:  name,
+			Type:  strings.TrimPrefix(qtype, "Type"),
+			Class: class,
+			Flags: flags,
+			View:  view,
+			ECS:   ecs,
+			TTL:   int64(binary.BigEndian.Uint64(entry[8:])) - now,
+		})
+		return true
+	})
+	return entries
+}
+
+// Key of the query (msg) to be sent to the upstream in the view (view; see
+// Router.view()), to look up the cached response.
+// The view is included because the routes limited to the server names may
+// answer differently, e.g., "TypeA:www.example.com%kids.dns.example".
+// The ECS prefix is included because the response may be tailored to it,
+// truncated to the scope of the last response of the query (see
+// cacheStoreKey()), so that the clients of the same scope share the
+// response; or without ECS if not scoped (yet), i.e., the global response.
+// Return empty if the query is invalid, i.e., not cacheable.
+func (f *Forwarder) cacheKey(msg []byte, view string) string {
+	key, err := viewCacheKey(msg, view)
+	if err != nil {
+		return ""
+	}
+	prefix, ok := dnsmsg.RawMsg(msg).EdnsSubnet()
+	if !ok {
+		return key
+	}
+	v, ok := f.Cache.Get(key + ecsScopeKeySuffix)
+	if !ok || len(v) != 1 {
+		return key
+	}
+	return scopedCacheKey(key, prefix, min(prefix.Bits(), int(v[0])))
+}
+
+// Key to cache the response (resp) of the query (msg) in the view (view).
+// With ECS, the response is keyed by the query prefix truncated to the
+// scope of the response (RFC 7871, Section 7.3.1), or without ECS if the
+// scope is 0 or no ECS in the response (i.e., valid for all clients).
+// A non-zero scope is also remembered for looking up the queries of the
+// other prefixes, while a global response forgets the remembered one.
+// Return empty if the query is invalid, i.e., not cacheable.
+func (f *Forwarder) cacheStoreKey(msg, resp []byte, view string) string {
+	key, err := viewCacheKey(msg, view)
+	if err != nil {
+		return ""
+	}
+	prefix, ok := dnsmsg.RawMsg(msg).EdnsSubnet()
+	if !ok {
+		return key
+	}
+	scope, _ := dnsmsg.RawMsg(resp).EdnsSubnetScope() // 0 if absent
+	scope = min(scope, prefix.Bits())
+	if scope == 0 {
+		f.Cache.Delete(key + ecsScopeKeySuffix)
+		return key
+	}
+	// NOTE: The scope marker is too short to be taken as a response.
+	f.Cache.Set(key+ecsScopeKeySuffix, []byte{byte(scope)}, maxCacheTTL+f.MaxStale)
+	return scopedCacheKey(key, prefix, scope)
+}
+
+// Key of the query (msg) in the view (view) without ECS.
+func viewCacheKey(msg []byte, view string) (string, error) {
+	key, err := dnsmsg.RawMsg(msg).CacheKey()
+	if err != nil || view == "" {
+		return key, err
+	}
+	return key + "%" + view, nil
+}
+
+// Key of the ECS prefix (prefix) truncated to the scope (scope).
+func scopedCacheKey(key string, prefix netip.Prefix, scope int) string {
+	if scope <= 0 {
+		return key
+	}
+	return key + "@" + netip.PrefixFrom(prefix.Addr(), scope).Masked().String()
+}
+
+// Set the cache policy, i.e., the default TTL (seconds) of the cached
+// responses, which the smaller record TTLs win over (0 for no limit but
+// maxCacheTTL), and the interval (seconds) to clean up the expired responses
+// of the default in-memory cache (0 to clean up adaptively).
+// NOTE: It applies to the cache created upon the next start.
+func (f *Forwarder) SetCachePolicy(defaultTTL, cleanupInterval int) error {
+	ttl := time.Duration(defaultTTL) * time.Second
+	if ttl < 0 || ttl > maxCacheTTL {
+		return fmt.Errorf("invalid cache default TTL %d: out of range [0, %d]",
+			defaultTTL, int(maxCacheTTL.Seconds()))
+	}
+	interval := time.Duration(cleanupInterval) * time.Second
+	if interval < 0 || interval > maxCacheCleanupInterval {
+		return fmt.Errorf("invalid cache cleanup interval %d: out of range [0, %d]",
+			cleanupInterval, int(maxCacheCleanupInterval.Seconds()))
+	}
+	f.CacheDefaultTTL = ttl
+	f.CacheCleanupInterval = interval
+	return nil
+}
+
+// Set the file (path) to persist the response cache, i.e., saved every
+// interval (seconds; 0 to use the default) and upon stop, and loaded upon
+// start (empty to disable); and whether to save only the fresh positive
+// answers, i.e., skipping the negative and stale ones.
+func (f *Forwarder) SetCacheFile(path string, interval int, answersOnly bool) error {
+	d := time.Duration(interval) * time.Second
+	if d == 0 {
+		d = defaultCacheSaveInterval
+	}
+	if d < minCacheSaveInterval || d > maxCacheSaveInterval {
+		return fmt.Errorf("invalid cache save interval %d: out of range [%d, %d]",
+			interval, int(minCacheSaveInterval.Seconds()),
+			int(maxCacheSaveInterval.Seconds()))
+	}
+	f.CacheFile = path
+	f.CacheSaveInterval = d
+	f.CacheFileAnswersOnly = answersOnly
+	return nil
+}
+
+// Load the response cache from CacheFile upon start if the default
+// in-memory cache is used.
+func (f *Forwarder) loadCache() {
+	c, ok := f.Cache.(*MemoryCache)
+	if !ok || f.CacheFile == "" {
+		return
+	}
+	file, err := os.Open(f.CacheFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.Debugf("no cache file [%s] to load", f.CacheFile)
+		} else {
+			log.Warnf("failed to open cache file: %v", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	n, err := c.Load(file)
+	if err != nil {
+		log.Warnf("failed to load cache file [%s]: %v", f.CacheFile, err)
+		return
+	}
+	log.Infof("loaded %d cached responses from [%s]", n, f.CacheFile)
+}
+
+// Save the response cache to CacheFile, i.e., to a temporary file renamed
+// over it, so that a crash never leaves a partial one.
+func (f *Forwarder) saveCache() error {
+	c, ok := f.Cache.(*MemoryCache)
+	if !ok || f.CacheFile == "" {
+		return nil
+	}
+	var keep func(key string, value []byte) bool
+	if f.CacheFileAnswersOnly {
+		now := time.Now().Unix()
+		keep = func(key string, value []byte) bool {
+			if strings.HasSuffix(key, ecsScopeKeySuffix) {
+				return true // needed to look up the scoped responses
+			}
+			if len(value) <= cacheHeaderSize ||
+				int64(binary.BigEndian.Uint64(value[8:])) <= now {
+				return false // stale
+			}
+			return ClassifyResponse(value[cacheHeaderSize:]) == ResponseAnswer
+		}
+	}
+
+	dir, name := filepath.Split(f.CacheFile)
+	tmp, err := os.CreateTemp(dir, name+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	n, err := c.Save(tmp, keep)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.CacheFile); err != nil {
+		return err
+	}
+	log.Debugf("saved %d cached responses to [%s]", n, f.CacheFile)
+	return nil
+}
+
+// Save the response cache every CacheSaveInterval until the context is
+// canceled; the last save is done upon stop.
+func (f *Forwarder) persistCache(ctx context.Context) {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(f.CacheSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.saveCache(); err != nil {
+				log.Warnf("failed to save cache file [%s]: %v", f.CacheFile, err)
+			}
+		}
+	}
+}
+
+// Set the jitter (percent) of the cache TTLs, i.e., the max fraction to
+// shorten the TTLs by at random (0 to disable).
+func (f *Forwarder) SetCacheTTLJitter(percent int) error {
+	if percent < 0 || percent > maxCacheTTLJitter {
+		return fmt.Errorf("invalid cache TTL jitter %d: out of range [0, %d]",
+			percent, maxCacheTTLJitter)
+	}
+	f.CacheTTLJitter = float64(percent) / 100
+	return nil
+}
+
+// Set the serve-stale policy (RFC 8767), i.e., the TTL (seconds) of the
+// stale answers (0 to use the default), and how long (seconds) the expired
+// responses are retained to be served when the upstream fails (0 to
+// disable serving stale).
+func (f *Forwarder) SetStalePolicy(staleAnswerTTL, maxStale int) error {
+	answerTTL := time.Duration(staleAnswerTTL) * time.Second
+	if answerTTL == 0 {
+		answerTTL = defaultStaleAnswerTTL
+	}
+	if answerTTL < 0 || answerTTL > maxStaleAnswerTTL {
+		return fmt.Errorf("invalid stale answer TTL %d: out of range [1, %d]",
+			staleAnswerTTL, int(maxStaleAnswerTTL.Seconds()))
+	}
+	stale := time.Duration(maxStale) * time.Second
+	if stale < 0 || stale > maxMaxStale {
+		return fmt.Errorf("invalid max stale %d: out of range [0, %d]",
+			maxStale, int(maxMaxStale.Seconds()))
+	}
+	f.StaleAnswerTTL = answerTTL
+	f.MaxStale = stale
+	return nil
+}
+
+// Cache the response (resp) of key if it's cacheable, for the TTL
+// overriding the record ones if override is non-zero (see
+// RouteExport.CacheTTLOverride).
+// The cache entry is the response prepended with the timestamps (Unix
+// seconds) when it's cached and when it expires, so that the TTLs can be
+// decreased upon retrieval, and the expired one can be served as stale.
+func (f *Forwarder) cacheResponse(key string, resp []byte, override time.Duration) {
+	ttl := cacheTTL(resp)
+	if ttl <= 0 {
+		return
+	}
+	if override > 0 {
+		// Rewrite the record TTLs to count down from the overridden one.
+		var msg dnsmessage.Message
+		if err := msg.Unpack(resp); err != nil {
+			return
+		}
+		setTTLs(&msg, uint32(override.Seconds()))
+		r, err := msg.Pack()
+		if err != nil {
+			log.Warnf("failed to pack response of [%s]: %v", key, err)
+			return
+		}
+		resp, ttl = r, override
+	} else if f.CacheDefaultTTL > 0 {
+		ttl = min(ttl, f.CacheDefaultTTL)
+	}
+	ttl = f.jitterTTL(ttl)
+	now := time.Now()
+	entry := make([]byte, cacheHeaderSize+len(resp))
+	binary.BigEndian.PutUint64(entry, uint64(now.Unix()))
+	binary.BigEndian.PutUint64(entry[8:], uint64(now.Add(ttl).Unix()))
+	copy(entry[cacheHeaderSize:], resp)
+	f.Cache.Set(key, entry, ttl+f.MaxStale) // retained for serving stale
+}
+
+// Shorten the cache TTL (ttl) by a random fraction up to CacheTTLJitter, so
+// that the responses cached together with the same TTLs (e.g., of a CDN
+// zone) expire apart instead of stampeding the upstream at once.
+// NOTE: The TTL is never lengthened, so that the records are never served
+// beyond their TTLs.
+func (f *Forwarder) jitterTTL(ttl time.Duration) time.Duration {
+	if f.CacheTTLJitter <= 0 {
+		return ttl
+	}
+	return ttl - time.Duration(rand.Float64()*f.CacheTTLJitter*float64(ttl))
+}
+
+// Get the cached response of key for the query (header and question), with
+// the query ID and question name (i.e., case preserved) restored and the TTLs
+// decreased by the time elapsed since cached.
+func (f *Forwarder) cachedResponse(key string, header *dnsmessage.Header,
+	question *dnsmessage.Question) ([]byte, bool) {
+	return f.readCache(key, header, question, false)
+}
+
+// Get the expired but retained response of key for the query (header and
+// question) to serve when the upstream fails, with the TTLs set to the stale
+// answer TTL and the Stale Answer EDE added (RFC 8767, Section 4).
+func (f *Forwarder) staleResponse(key string, header *dnsmessage.Header,
+	question *dnsmessage.Question) ([]byte, bool) {
+	if f.MaxStale <= 0 {
+		return nil, false
+	}
+	msg, ok := f.readCache(key, header, question, true)
+	if !ok {
+		return nil, false
+	}
+	resp, err := AddExtendedError(msg, &ExtendedError{
+		InfoCode:  ExtendedErrorStaleAnswer,
+		ExtraText: "upstream failed; served stale",
+	})
+	if err != nil {
+		return msg, true
+	}
+	return resp, true
+}
+
+// Read the cache entry of key, either fresh or stale (as stale is true).
+func (f *Forwarder) readCache(key string, header *dnsmessage.Header,
+	question *dnsmessage.Question, stale bool) ([]byte, bool) {
+	entry, ok := f.Cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if len(entry) <= cacheHeaderSize {
+		f.Cache.Delete(key)
+		return nil, false
+	}
+
+	now := time.Now().Unix()
+	cachedAt := int64(binary.BigEndian.Uint64(entry))
+	expireAt := int64(binary.BigEndian.Uint64(entry[8:]))
+	if expired := now >= expireAt; expired != stale {
+		return nil, false
+	}
+	if stale && now >= expireAt+int64(f.MaxStale.Seconds()) {
+		return nil, false // may be retained longer by the cache
+	}
+	elapsed := max(now-cachedAt, 0)
+	resp, err := ageResponse(entry[cacheHeaderSize:], uint32(elapsed))
+	if err != nil {
+		log.Warnf("invalid cached response of [%s]: %v", key, err)
+		f.Cache.Delete(key)
+		return nil, false
+	}
+	if stale {
+		setTTLs(resp, uint32(f.StaleAnswerTTL.Seconds()))
+	}
+	resp.Header.ID = header.ID
+	resp.Questions = []dnsmessage.Question{*question}
+	msg, err := resp.Pack()
+	if err != nil {
+		log.Warnf("failed to pack cached response of [%s]: %v", key, err)
+		return nil, false
+	}
+	return msg, true
+}
+
+// Get the TTL to cache the response (resp), i.e., the minimum TTL of the
+// answers and authorities, or the negative TTL from the SOA for the NODATA and NXDOMAIN
+// responses (RFC 2308, Section 5).
+// Return 0 if not cacheable.
+func cacheTTL(resp []byte) time.Duration {
+	kind := ClassifyResponse(resp)
+	if kind == ResponseError {
+		return 0
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return 0
+	}
+	if msg.Header.Truncated || len(msg.Questions) != 1 {
+		return 0
+	}
+
+	// NOTE: The records are all aged together in the cache, so the
+	// authorities (e.g., NS) also bound it.
+	ttl, found := dnsmsg.RawMsg(resp).MinTTL()
+	if kind == ResponseAnswer {
+		return min(time.Duration(ttl)*time.Second, maxCacheTTL)
+	}
+
+	// Negative response (NODATA or NXDOMAIN), which shouldn't be cached
+	// without the SOA (RFC 2308, Section 5).
+	for _, rr := range msg.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			// The SOA TTL is in ttl, which is also bounded by the
+			// CNAMEs if any.
+			if !found || soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+			return min(time.Duration(ttl)*time.Second, maxNegativeTTL)
+		}
+	}
+	return 0
+}
+
+// Parse the response (resp) and decrease its TTLs by elapsed seconds.
+func ageResponse(resp []byte, elapsed uint32) (*dnsmessage.Message, error) {
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(resp); err != nil {
+		return nil, err
+	}
+	if len(msg.Questions) != 1 {
+		return nil, errors.New("invalid question count")
+	}
+	for _, section := range [][]dnsmessage.Resource{
+		msg.Answers, msg.Authorities, msg.Additionals,
+	} {
+		for i := range section {
+			h := &section[i].Header
+			if h.Type == dnsmessage.TypeOPT {
+				continue // TTL field holds the extended RCODE and flags
+			}
+			if h.TTL > elapsed {
+				h.TTL -= elapsed
+			} else {
+				h.TTL = 0
+			}
+		}
+	}
+	return msg, nil
+}
+
+// Set the TTLs of the records (except OPT) in the message (msg).
+func setTTLs(msg *dnsmessage.Message, ttl uint32) {
+	for _, section := range [][]dnsmessage.Resource{
+		msg.Answers, msg.Authorities, msg.Additionals,
+	} {
+		for i := range section {
+			if h := &section[i].Header; h.Type != dnsmessage.TypeOPT {
+				h.TTL = ttl
+			}
+		}
+	}
+}
+
+// Set the names to preload into the cache upon start.
+func (f *Forwarder) SetPreloadNames(names []string) error {
+	preloads := make([]string, 0, len(names))
+	for _, name := range names {
+		if name == "" || name == "." {
+			return errors.New("empty preload name")
+		}
+		if !strings.HasSuffix(name, ".") {
+			name += "."
+		}
+		if _, err := dnsmessage.NewName(name); err != nil {
+			return fmt.Errorf("invalid preload name [%s]: %w", name, err)
+		}
+		preloads = append(preloads, name)
+	}
+	f.PreloadNames = preloads
+	return nil
+}
+
+// Warm up the cache by resolving the names (A and AAAA) through the normal
+// query path (so that the routing and ECS apply), and thus the first client
+// queries could be cache hits.
+func (f *Forwarder) preload(ctx context.Context, names []string) {
+	defer f.wg.Done()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	var nok, nfail atomic.Int32
+	sem := make(chan struct{}, preloadConcurrency)
+loop:
+	for _, name := range names {
+		for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			if ctx.Err() != nil {
+				break loop
+			}
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				break loop
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if err := f.preloadQuery(ctx, name, qtype); err != nil {
+					log.Debugf("failed to preload %s %s: %v", name, qtype, err)
+					nfail.Add(1)
+				} else {
+					nok.Add(1)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	log.Infof("preloaded cache: %d names, %d queries succeeded, %d failed, took %v",
+		len(names), nok.Load(), nfail.Load(), time.Since(start).Round(time.Millisecond))
+}
+
+// Query the name (name) of the type (qtype) through the normal query path
+// (i.e., the zones, routing, ECS and cache if started) as a TCP query to
+// get the complete response, e.g., to preload the cache or to debug the
+// configs without a DNS client.
+func (f *Forwarder) Query(ctx context.Context, name string, qtype dnsmessage.Type) ([]byte, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name [%s]: %w", name, err)
+	}
+	dmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(rand.IntN(1 << 16)),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{
+			{
+				Name:  qname,
+				Type:  qtype,
+				Class: dnsmessage.ClassINET,
+			},
+		},
+	}
+	msg, err := dmsg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	return f.handleQuery(ctx, msg, netip.Addr{}, false)
+}
+
+func (f *Forwarder) preloadQuery(ctx context.Context, name string, qtype dnsmessage.Type) error {
+	_, err := f.Query(ctx, name, qtype)
+	return err
+}
@@ -0,0 +1,923 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Response cache - tests
+//
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+	"kexuedns/util/dnsmsg"
+)
+
+func TestMemoryCache(t *testing.T) {
+	var cache Cache = NewMemoryCache()
+	defer cache.(*MemoryCache).Close()
+
+	key, resp := "TypeA:example.com", []byte("response")
+	if v, ok := cache.Get(key); ok || v != nil {
+		t.Errorf(`Get(%q) = (%v, %t); want (nil, false)`, key, v, ok)
+	}
+
+	cache.Set(key, resp, time.Minute)
+	if v, ok := cache.Get(key); !ok || string(v) != string(resp) {
+		t.Errorf(`Get(%q) = (%v, %t); want (%v, true)`, key, v, ok, resp)
+	}
+	cache.Delete(key)
+	if _, ok := cache.Get(key); ok {
+		t.Errorf(`Get(%q) after Delete() = true; want false`, key)
+	}
+
+	// Zero TTL: not cached at all.
+	cache.Set(key, resp, 0)
+	if _, ok := cache.Get(key); ok {
+		t.Errorf(`Get(%q) with zero TTL = true; want false`, key)
+	}
+
+	cache.Set(key, resp, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := cache.Get(key); ok {
+		t.Errorf(`Get(%q) after expired = true; want false`, key)
+	}
+
+	cache.Set("a", resp, time.Minute)
+	cache.Set("b", resp, time.Minute)
+	cache.Flush()
+	for _, k := range []string{"a", "b"} {
+		if _, ok := cache.Get(k); ok {
+			t.Errorf(`Get(%q) after Flush() = true; want false`, k)
+		}
+	}
+}
+
+func newTestResponse(t testing.TB, query []byte, rcode dnsmessage.RCode,
+	answers []dnsmessage.Resource, authorities []dnsmessage.Resource) []byte {
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(query); err != nil {
+		t.Fatalf("failed to unpack query: %v", err)
+	}
+	dmsg.Header.Response = true
+	dmsg.Header.RecursionAvailable = true
+	dmsg.Header.RCode = rcode
+	dmsg.Answers = answers
+	dmsg.Authorities = authorities
+	msg, err := dmsg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack response: %v", err)
+	}
+	return msg
+}
+
+func TestCacheTTL(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	name := dnsmessage.MustNewName("www.example.com.")
+	a := func(ttl uint32) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl,
+			},
+			Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}
+	}
+	cname := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name: name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 30,
+		},
+		Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("cdn.example.net.")},
+	}
+	soa := newLocalSOA("example.com", 600)
+	soa.Body.(*dnsmessage.SOAResource).MinTTL = 60
+	soaLong := newLocalSOA("example.com", 600)
+	soaLong.Header.TTL = 1 << 30
+	soaLong.Body.(*dnsmessage.SOAResource).MinTTL = 1 << 30
+
+	tests := []struct {
+		rcode       dnsmessage.RCode
+		answers     []dnsmessage.Resource
+		authorities []dnsmessage.Resource
+		ttl         time.Duration
+	}{
+		{dnsmessage.RCodeSuccess, []dnsmessage.Resource{a(300), a(100)}, nil, 100 * time.Second},
+		{dnsmessage.RCodeSuccess, []dnsmessage.Resource{a(1 << 30)}, nil, maxCacheTTL},
+		{dnsmessage.RCodeSuccess, nil, []dnsmessage.Resource{soa}, 60 * time.Second},
+		{dnsmessage.RCodeNameError, nil, []dnsmessage.Resource{soa}, 60 * time.Second},
+		{dnsmessage.RCodeSuccess, []dnsmessage.Resource{cname}, []dnsmessage.Resource{soa}, 30 * time.Second},
+		{dnsmessage.RCodeSuccess, []dnsmessage.Resource{cname}, nil, 0},
+		{dnsmessage.RCodeNameError, nil, []dnsmessage.Resource{soaLong}, maxNegativeTTL},
+		{dnsmessage.RCodeNameError, nil, nil, 0},
+		{dnsmessage.RCodeServerFailure, nil, nil, 0},
+		{dnsmessage.RCodeRefused, []dnsmessage.Resource{a(300)}, nil, 0},
+	}
+	for i, tc := range tests {
+		resp := newTestResponse(t, query, tc.rcode, tc.answers, tc.authorities)
+		if ttl := cacheTTL(resp); ttl != tc.ttl {
+			t.Errorf(`[%d] cacheTTL() = %v; want %v`, i, ttl, tc.ttl)
+		}
+	}
+}
+
+func TestForwarderCache(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	answer := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("www.example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+			TTL:   300,
+		},
+		Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}
+	upstream := newTestResponse(t, query, dnsmessage.RCodeSuccess,
+		[]dnsmessage.Resource{answer}, nil)
+
+	cache := NewMemoryCache()
+	defer cache.Close()
+	resolver := &recordingResolver{staticResolver: staticResolver{response: upstream}}
+	f := &Forwarder{myIP: &config.MyIP{}, Cache: cache}
+	f.Router.resolver = resolver
+
+	resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if err != nil || string(resp) != string(upstream) {
+		t.Fatalf(`handleQuery() = (%v, %v); want upstream response`, resp, err)
+	}
+
+	// Age the cached entry by rewinding its timestamp.
+	key := "TypeA:www.example.com"
+	entry, ok := cache.Get(key)
+	if !ok {
+		t.Fatalf(`Get(%q) = false; want cached`, key)
+	}
+	binary.BigEndian.PutUint64(entry, binary.BigEndian.Uint64(entry)-100)
+
+	// Same question with different ID and case: answered from cache.
+	resolver.msg = nil
+	query2 := newTestQuery(t, "WWW.Example.com.", dnsmessage.TypeA)
+	query2[0], query2[1] = 0xab, 0xcd
+	resp, err = f.handleQuery(context.Background(), query2, netip.Addr{}, true)
+	if err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if resolver.msg != nil {
+		t.Errorf(`handleQuery() forwarded the query; want answered from cache`)
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil {
+		t.Fatalf(`failed to unpack response: %v`, err)
+	}
+	if dmsg.Header.ID != 0xabcd {
+		t.Errorf(`response ID = %#x; want 0xabcd`, dmsg.Header.ID)
+	}
+	if name := dmsg.Questions[0].Name.String(); name != "WWW.Example.com." {
+		t.Errorf(`response question = %s; want WWW.Example.com.`, name)
+	}
+	if len(dmsg.Answers) != 1 || dmsg.Answers[0].Header.TTL != 200 {
+		t.Errorf(`response answers = %+v; want 1 answer with TTL=200`, dmsg.Answers)
+	}
+
+	// Other type: forwarded.
+	query3 := newTestQuery(t, "www.example.com.", dnsmessage.TypeAAAA)
+	if _, err := f.handleQuery(context.Background(), query3, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if resolver.msg == nil {
+		t.Errorf(`handleQuery() not forwarded; want forwarded`)
+	}
+}
+
+func TestCacheDNSSECOK(t *testing.T) {
+	newQuery := func(edns, do bool) []byte {
+		dmsg := dnsmessage.Message{
+			Header: dnsmessage.Header{ID: 0x1234, RecursionDesired: true},
+			Questions: []dnsmessage.Question{
+				{
+					Name:  dnsmessage.MustNewName("www.example.com."),
+					Type:  dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET,
+				},
+			},
+		}
+		if edns {
+			rh := dnsmessage.ResourceHeader{}
+			rh.SetEDNS0(1232, 0 /* extRCode */, do)
+			dmsg.Additionals = []dnsmessage.Resource{
+				{Header: rh, Body: &dnsmessage.OPTResource{}},
+			}
+		}
+		msg, err := dmsg.Pack()
+		if err != nil {
+			t.Fatalf("failed to pack query: %v", err)
+		}
+		return msg
+	}
+	answer := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("www.example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+			TTL:   300,
+		},
+		Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}
+	upstream := newTestResponse(t, newQuery(false, false), dnsmessage.RCodeSuccess,
+		[]dnsmessage.Resource{answer}, nil)
+
+	cache := NewMemoryCache()
+	defer cache.Close()
+	resolver := &recordingResolver{staticResolver: staticResolver{response: upstream}}
+	f := &Forwarder{myIP: &config.MyIP{}, Cache: cache}
+	f.Router.resolver = resolver
+
+	// The clients differing only in DO don't share the cached response,
+	// nor does the one without EDNS.
+	for i, tc := range []struct {
+		edns, do  bool
+		forwarded bool
+	}{
+		{edns: true, do: true, forwarded: true},
+		{edns: true, do: false, forwarded: true},
+		{edns: true, do: true, forwarded: false},
+		{edns: true, do: false, forwarded: false},
+		{edns: false, forwarded: true},
+	} {
+		resolver.msg = nil
+		query := newQuery(tc.edns, tc.do)
+		if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+			t.Fatalf(`[%d] handleQuery() = %v; want nil`, i, err)
+		}
+		if forwarded := resolver.msg != nil; forwarded != tc.forwarded {
+			t.Errorf(`[%d] forwarded = %v; want %v`, i, forwarded, tc.forwarded)
+		}
+	}
+	for _, key := range []string{
+		"TypeA:www.example.com", "TypeA:www.example.com+edns",
+		"TypeA:www.example.com+edns+do",
+	} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf(`Get(%q) = false; want cached`, key)
+		}
+	}
+}
+
+func TestCacheClass(t *testing.T) {
+	cache := NewMemoryCache()
+	defer cache.Close()
+	resolver := &answeringResolver{}
+	f := &Forwarder{myIP: &config.MyIP{}, Cache: cache}
+	f.Router.resolver = resolver
+
+	// The CH and IN queries of the same name don't collide.
+	for i, class := range []dnsmessage.Class{
+		dnsmessage.ClassCHAOS, dnsmessage.ClassINET, dnsmessage.ClassCHAOS,
+	} {
+		dmsg := dnsmessage.Message{
+			Header: dnsmessage.Header{ID: 0x1234, RecursionDesired: true},
+			Questions: []dnsmessage.Question{
+				{
+					Name:  dnsmessage.MustNewName("version.bind."),
+					Type:  dnsmessage.TypeA,
+					Class: class,
+				},
+			},
+		}
+		query, err := dmsg.Pack()
+		if err != nil {
+			t.Fatalf("failed to pack query: %v", err)
+		}
+		if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+			t.Fatalf(`[%d] handleQuery() = %v; want nil`, i, err)
+		}
+	}
+	if n := resolver.queries.Load(); n != 2 {
+		t.Errorf(`upstream queries = %d; want 2`, n)
+	}
+	entries := f.DumpCache(10)
+	classes := map[string]bool{}
+	for _, e := range entries {
+		classes[e.Class] = true
+	}
+	if len(entries) != 2 || !classes["CH"] || !classes[""] {
+		t.Errorf(`DumpCache() classes = %v; want CH and IN (empty)`, classes)
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	f := &Forwarder{myIP: &config.MyIP{}}
+	for _, tc := range []struct {
+		ttl, interval int
+	}{
+		{-1, 0}, {int(maxCacheTTL.Seconds()) + 1, 0},
+		{0, -1}, {0, int(maxCacheCleanupInterval.Seconds()) + 1},
+	} {
+		if err := f.SetCachePolicy(tc.ttl, tc.interval); err == nil {
+			t.Errorf(`SetCachePolicy(%d, %d) = nil; want error`, tc.ttl, tc.interval)
+		}
+	}
+	if err := f.SetCachePolicy(60, 10); err != nil {
+		t.Fatalf(`SetCachePolicy() = %v; want nil`, err)
+	}
+	if f.CacheDefaultTTL != time.Minute || f.CacheCleanupInterval != 10*time.Second {
+		t.Errorf(`CacheDefaultTTL = %v, CacheCleanupInterval = %v; want 1m, 10s`,
+			f.CacheDefaultTTL, f.CacheCleanupInterval)
+	}
+
+	cache := newMemoryCache(f.CacheCleanupInterval)
+	defer cache.Close()
+	f.Cache = cache
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	for _, tc := range []struct {
+		recordTTL uint32
+		ttl       int64
+	}{
+		{300, 60}, // capped at the default TTL
+		{30, 30},  // the record TTL wins when smaller
+	} {
+		answer := dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName("www.example.com."),
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   tc.recordTTL,
+			},
+			Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}
+		resp := newTestResponse(t, query, dnsmessage.RCodeSuccess,
+			[]dnsmessage.Resource{answer}, nil)
+		f.cacheResponse("key", resp, 0)
+		entry, ok := cache.Get("key")
+		if !ok {
+			t.Fatalf(`[%d] Get() = false; want cached`, tc.recordTTL)
+		}
+		cachedAt := int64(binary.BigEndian.Uint64(entry))
+		expireAt := int64(binary.BigEndian.Uint64(entry[8:]))
+		if ttl := expireAt - cachedAt; ttl != tc.ttl {
+			t.Errorf(`[%d] cached TTL = %d; want %d`, tc.recordTTL, ttl, tc.ttl)
+		}
+	}
+}
+
+func TestCacheTTLOverride(t *testing.T) {
+	f := &Forwarder{myIP: &config.MyIP{}}
+	if err := f.SetCachePolicy(60, 0); err != nil {
+		t.Fatalf(`SetCachePolicy() = %v; want nil`, err)
+	}
+	cache := NewMemoryCache()
+	defer cache.Close()
+	f.Cache = cache
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	for _, tc := range []struct {
+		recordTTL uint32
+		override  time.Duration
+	}{
+		{30, time.Hour},          // longer than the record and default TTLs
+		{3600, 10 * time.Second}, // shorter
+	} {
+		answer := dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName("www.example.com."),
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   tc.recordTTL,
+			},
+			Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}
+		resp := newTestResponse(t, query, dnsmessage.RCodeSuccess,
+			[]dnsmessage.Resource{answer}, nil)
+		f.cacheResponse("key", resp, tc.override)
+		entry, ok := cache.Get("key")
+		if !ok {
+			t.Fatalf(`[%v] Get() = false; want cached`, tc.override)
+		}
+		cachedAt := int64(binary.BigEndian.Uint64(entry))
+		expireAt := int64(binary.BigEndian.Uint64(entry[8:]))
+		want := int64(tc.override.Seconds())
+		if ttl := expireAt - cachedAt; ttl != want {
+			t.Errorf(`[%v] cached TTL = %d; want %d`, tc.override, ttl, want)
+		}
+
+		var header dnsmessage.Header
+		_, question, _ := dnsmsg.RawMsg(query).Question()
+		cached, ok := f.cachedResponse("key", &header, &question)
+		if !ok {
+			t.Fatalf(`[%v] cachedResponse() = false; want cached`, tc.override)
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(cached); err != nil || len(msg.Answers) != 1 {
+			t.Fatalf(`[%v] cached response = %v (%v); want 1 answer`, tc.override, msg, err)
+		}
+		if ttl := int64(msg.Answers[0].Header.TTL); ttl != want {
+			t.Errorf(`[%v] cached record TTL = %d; want %d`, tc.override, ttl, want)
+		}
+	}
+
+	// Uncacheable responses stay uncached.
+	cache.Delete("key")
+	f.cacheResponse("key", newTestResponse(t, query, dnsmessage.RCodeServerFailure, nil, nil), time.Hour)
+	if _, ok := cache.Get("key"); ok {
+		t.Errorf(`Get() of SERVFAIL = true; want uncached`)
+	}
+}
+
+func TestCacheTTLJitter(t *testing.T) {
+	f := &Forwarder{myIP: &config.MyIP{}}
+	for _, percent := range []int{-1, maxCacheTTLJitter + 1} {
+		if err := f.SetCacheTTLJitter(percent); err == nil {
+			t.Errorf(`SetCacheTTLJitter(%d) = nil; want error`, percent)
+		}
+	}
+	if err := f.SetCacheTTLJitter(10); err != nil {
+		t.Fatalf(`SetCacheTTLJitter(10) = %v; want nil`, err)
+	}
+
+	cache := NewMemoryCache()
+	defer cache.Close()
+	f.Cache = cache
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	answer := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("www.example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+			TTL:   3600,
+		},
+		Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}
+	resp := newTestResponse(t, query, dnsmessage.RCodeSuccess,
+		[]dnsmessage.Resource{answer}, nil)
+
+	ttls := make(map[int64]bool)
+	for i := range 100 {
+		key := strconv.Itoa(i)
+		f.cacheResponse(key, resp, 0)
+		entry, ok := cache.Get(key)
+		if !ok {
+			t.Fatalf(`Get(%s) = false; want cached`, key)
+		}
+		ttl := int64(binary.BigEndian.Uint64(entry[8:])) - int64(binary.BigEndian.Uint64(entry))
+		if ttl < 3240 || ttl > 3600 {
+			t.Errorf(`cached TTL = %d; want within [3240, 3600]`, ttl)
+		}
+		ttls[ttl] = true
+	}
+	if len(ttls) < 10 {
+		t.Errorf(`cached TTLs = %v; want spread out`, ttls)
+	}
+
+	// Disabled
+	if err := f.SetCacheTTLJitter(0); err != nil {
+		t.Fatalf(`SetCacheTTLJitter(0) = %v; want nil`, err)
+	}
+	f.cacheResponse("key", resp, 0)
+	entry, _ := cache.Get("key")
+	if ttl := int64(binary.BigEndian.Uint64(entry[8:])) - int64(binary.BigEndian.Uint64(entry)); ttl != 3600 {
+		t.Errorf(`cached TTL = %d; want 3600 without jitter`, ttl)
+	}
+}
+
+func TestCacheStatsDump(t *testing.T) {
+	f := &Forwarder{myIP: &config.MyIP{}}
+	if s := f.CacheStats(); s != nil {
+		t.Errorf(`CacheStats() = %+v; want nil without cache`, s)
+	}
+
+	cache := NewMemoryCache()
+	defer cache.Close()
+	f.Cache = cache
+	f.Router.resolver = &answeringResolver{}
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	for range 2 {
+		if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+			t.Fatalf(`handleQuery() = %v; want nil`, err)
+		}
+	}
+	want := CacheStats{Size: 1, Hits: 1, Misses: 1}
+	if s := f.CacheStats(); s == nil || *s != want {
+		t.Errorf(`CacheStats() = %+v; want %+v`, s, want)
+	}
+
+	f.cacheResponse("TypeAAAA:www.example.com+edns+do@192.0.2.0/24",
+		newTestResponse(t, newTestQuery(t, "www.example.com.", dnsmessage.TypeAAAA),
+			dnsmessage.RCodeSuccess, []dnsmessage.Resource{
+				{
+					Header: dnsmessage.ResourceHeader{
+						Name:  dnsmessage.MustNewName("www.example.com."),
+						Type:  dnsmessage.TypeAAAA,
+						Class: dnsmessage.ClassINET,
+						TTL:   100,
+					},
+					Body: &dnsmessage.AAAAResource{},
+				},
+			}, nil), 0)
+	entries := f.DumpCache(10)
+	if len(entries) != 2 {
+		t.Fatalf(`DumpCache() = %d entries; want 2`, len(entries))
+	}
+	slices.SortFunc(entries, func(a, b *CacheEntry) int { return strings.Compare(a.Type, b.Type) })
+	if e := entries[0]; e.Name != "www.example.com" || e.Type != "A" || e.ECS != "" || e.TTL != 300 {
+		t.Errorf(`DumpCache()[0] = %+v; want A with TTL 300`, e)
+	}
+	if e := entries[1]; e.Name != "www.example.com" || e.Type != "AAAA" ||
+		e.Flags != "edns+do" || e.ECS != "192.0.2.0/24" || e.TTL != 100 {
+		t.Errorf(`DumpCache()[1] = %+v; want AAAA of DO and ECS with TTL 100`, e)
+	}
+	if entries := f.DumpCache(1); len(entries) != 1 {
+		t.Errorf(`DumpCache(1) = %d entries; want 1`, len(entries))
+	}
+}
+
+// Fail every query, e.g., upstream unreachable.
+type failingResolver struct {
+	staticResolver
+}
+
+func (r *failingResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	return nil, errors.New("upstream unreachable")
+}
+
+func TestServeStale(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	answer := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("www.example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+			TTL:   300,
+		},
+		Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}
+	upstream := newTestResponse(t, query, dnsmessage.RCodeSuccess,
+		[]dnsmessage.Resource{answer}, nil)
+
+	cache := NewMemoryCache()
+	defer cache.Close()
+	f := &Forwarder{myIP: &config.MyIP{}, Cache: cache}
+	if err := f.SetStalePolicy(0, 3600); err != nil {
+		t.Fatalf(`SetStalePolicy() = %v; want nil`, err)
+	}
+	f.Router.resolver = &staticResolver{response: upstream}
+	if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+
+	// Expire the entry by rewinding its timestamps, but within max stale.
+	key := "TypeA:www.example.com"
+	entry, ok := cache.Get(key)
+	if !ok {
+		t.Fatalf(`Get(%q) = false; want cached`, key)
+	}
+	for _, off := range []int{0, 8} {
+		ts := binary.BigEndian.Uint64(entry[off:])
+		binary.BigEndian.PutUint64(entry[off:], ts-600)
+	}
+
+	// Upstream fails: served stale.
+	f.Router.resolver = &failingResolver{}
+	resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil {
+		t.Fatalf(`failed to unpack response: %v`, err)
+	}
+	if dmsg.Header.RCode != dnsmessage.RCodeSuccess || len(dmsg.Answers) != 1 ||
+		dmsg.Answers[0].Header.TTL != uint32(defaultStaleAnswerTTL.Seconds()) {
+		t.Errorf(`stale response = %+v; want 1 answer with TTL=%v`,
+			dmsg, defaultStaleAnswerTTL)
+	}
+
+	// Upstream works: the stale entry is not served.
+	f.Router.resolver = &staticResolver{response: upstream}
+	resp, err = f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if err != nil || string(resp) != string(upstream) {
+		t.Errorf(`handleQuery() = (%v, %v); want upstream response`, resp, err)
+	}
+
+	// Beyond max stale, or disabled: SERVFAIL.
+	for _, off := range []int{0, 8} {
+		ts := binary.BigEndian.Uint64(entry[off:])
+		binary.BigEndian.PutUint64(entry[off:], ts-3600)
+	}
+	cache.Set(key, entry, time.Hour)
+	f.Router.resolver = &failingResolver{}
+	resp, _ = f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if err := dmsg.Unpack(resp); err != nil || dmsg.Header.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf(`response = %+v; want SERVFAIL beyond max stale`, dmsg.Header)
+	}
+
+	if err := f.SetStalePolicy(0, -1); err == nil {
+		t.Errorf(`SetStalePolicy() with negative max stale = nil; want error`)
+	}
+}
+
+// Answer every A/AAAA query with a record.
+type answeringResolver struct {
+	staticResolver
+	queries atomic.Int32
+	a       [4]byte // answer of the A queries; 192.0.2.1 if zero
+}
+
+func (r *answeringResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	r.queries.Add(1)
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(msg); err != nil {
+		return nil, err
+	}
+	dmsg.Header.Response = true
+	q := dmsg.Questions[0]
+	a := r.a
+	if a == ([4]byte{}) {
+		a = [4]byte{192, 0, 2, 1}
+	}
+	var body dnsmessage.ResourceBody = &dnsmessage.AResource{A: a}
+	if q.Type == dnsmessage.TypeAAAA {
+		body = &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}
+	}
+	dmsg.Answers = []dnsmessage.Resource{
+		{
+			Header: dnsmessage.ResourceHeader{
+				Name:  q.Name,
+				Type:  q.Type,
+				Class: dnsmessage.ClassINET,
+				TTL:   300,
+			},
+			Body: body,
+		},
+	}
+	return dmsg.Pack()
+}
+
+func TestPreload(t *testing.T) {
+	cache := NewMemoryCache()
+	defer cache.Close()
+	resolver := &answeringResolver{}
+	f := &Forwarder{myIP: &config.MyIP{}, Cache: cache}
+	f.Router.resolver = resolver
+
+	names := []string{"www.example.com", "cdn.example.net."}
+	if err := f.SetPreloadNames(names); err != nil {
+		t.Fatalf(`SetPreloadNames() = %v; want nil`, err)
+	}
+	f.wg.Add(1)
+	f.preload(context.Background(), f.PreloadNames)
+
+	if n := resolver.queries.Load(); n != 4 {
+		t.Errorf(`upstream queries = %d; want 4`, n)
+	}
+	for _, key := range []string{
+		"TypeA:www.example.com", "TypeAAAA:www.example.com",
+		"TypeA:cdn.example.net", "TypeAAAA:cdn.example.net",
+	} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf(`Get(%q) = false; want preloaded`, key)
+		}
+	}
+
+	// Canceled: nothing more queried.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f.wg.Add(1)
+	f.preload(ctx, f.PreloadNames)
+	if n := resolver.queries.Load(); n != 4 {
+		t.Errorf(`upstream queries = %d; want 4`, n)
+	}
+
+	for _, name := range []string{"", ".", strings.Repeat("a.", 130)} {
+		if err := f.SetPreloadNames([]string{name}); err == nil {
+			t.Errorf(`SetPreloadNames(%q) = nil; want error`, name)
+		}
+	}
+}
+
+func TestForwarderQuery(t *testing.T) {
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = &answeringResolver{}
+
+	resp, err := f.Query(context.Background(), "www.example.com", dnsmessage.TypeAAAA)
+	if err != nil {
+		t.Fatalf(`Query() = %v; want nil`, err)
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil {
+		t.Fatalf(`failed to unpack response: %v`, err)
+	}
+	if q := dmsg.Questions[0]; q.Name.String() != "www.example.com." || q.Type != dnsmessage.TypeAAAA {
+		t.Errorf(`question = %+v; want www.example.com. AAAA`, q)
+	}
+	if len(dmsg.Answers) != 1 || dmsg.Answers[0].Header.Type != dnsmessage.TypeAAAA {
+		t.Errorf(`answers = %+v; want one AAAA`, dmsg.Answers)
+	}
+
+	if _, err := f.Query(context.Background(), strings.Repeat("a.", 130), dnsmessage.TypeA); err == nil {
+		t.Errorf(`Query(too long name) = nil; want error`)
+	}
+}
+
+// Answer every A query with the ECS address of the query, at the scope
+// (scope).
+type ecsScopeResolver struct {
+	answeringResolver
+	scope byte
+}
+
+func (r *ecsScopeResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	resp, err := r.answeringResolver.Query(ctx, msg, isUDP)
+	if err != nil {
+		return nil, err
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil {
+		return nil, err
+	}
+	for _, rr := range dmsg.Additionals {
+		if opt, ok := rr.Body.(*dnsmessage.OPTResource); ok {
+			for i, op := range opt.Options {
+				if op.Code == 8 && len(op.Data) >= 4 {
+					data := slices.Clone(op.Data)
+					data[3] = r.scope
+					opt.Options[i].Data = data
+					a := &dnsmessage.AResource{}
+					copy(a.A[:], data[4:])
+					dmsg.Answers[0].Body = a
+				}
+			}
+		}
+	}
+	return dmsg.Pack()
+}
+
+func TestCacheECSScope(t *testing.T) {
+	cache := NewMemoryCache()
+	defer cache.Close()
+	resolver := &ecsScopeResolver{}
+	f := &Forwarder{myIP: &config.MyIP{}, Cache: cache}
+	f.Router.resolver = resolver
+
+	// Query the name from the subnet (empty for no ECS), and return the
+	// answered address.
+	query := func(name, subnet string) string {
+		t.Helper()
+		q, err := dnsmsg.NewQueryMsg(newTestQueryEDNS(t, name, dnsmessage.TypeA))
+		if err != nil {
+			t.Fatalf(`NewQueryMsg() = %v; want nil`, err)
+		}
+		if subnet != "" {
+			prefix := netip.MustParsePrefix(subnet)
+			q.SetEdnsSubnet(prefix.Addr(), prefix.Bits())
+		}
+		msg, err := q.Build()
+		if err != nil {
+			t.Fatalf(`Build() = %v; want nil`, err)
+		}
+		resp, err := f.handleQuery(context.Background(), msg, netip.Addr{}, true)
+		if err != nil {
+			t.Fatalf(`handleQuery(%s, %s) = %v; want nil`, name, subnet, err)
+		}
+		var dmsg dnsmessage.Message
+		if err := dmsg.Unpack(resp); err != nil || len(dmsg.Answers) != 1 {
+			t.Fatalf(`handleQuery(%s, %s) = %+v; want an answer`, name, subnet, dmsg)
+		}
+		return netip.AddrFrom4(dmsg.Answers[0].Body.(*dnsmessage.AResource).A).String()
+	}
+
+	tests := []struct {
+		name    string
+		subnet  string
+		scope   byte // of the upstream response
+		answer  string
+		queries int32 // total upstream queries
+	}{
+		// Scope /16: shared by the clients of the /16.
+		{"cdn.example.com.", "198.51.100.0/24", 16, "198.51.100.0", 1},
+		{"cdn.example.com.", "198.51.7.0/24", 16, "198.51.100.0", 1},
+		{"cdn.example.com.", "203.0.113.0/24", 16, "203.0.113.0", 2},
+		{"cdn.example.com.", "203.0.113.0/24", 16, "203.0.113.0", 2},
+		// Scope /24 and then /0 (global) of the same name.
+		{"www.example.com.", "198.51.100.0/24", 24, "198.51.100.0", 3},
+		{"www.example.com.", "198.51.7.0/24", 24, "198.51.7.0", 4},
+		{"www.example.com.", "203.0.113.0/24", 0, "203.0.113.0", 5},
+		{"www.example.com.", "192.0.2.0/24", 0, "203.0.113.0", 5},
+		{"www.example.com.", "", 0, "203.0.113.0", 5},
+	}
+	for i, tc := range tests {
+		resolver.scope = tc.scope
+		if answer := query(tc.name, tc.subnet); answer != tc.answer {
+			t.Errorf(`[%d] query(%s, %s) = %s; want %s`, i, tc.name, tc.subnet, answer, tc.answer)
+		}
+		if n := resolver.queries.Load(); n != tc.queries {
+			t.Errorf(`[%d] upstream queries = %d; want %d`, i, n, tc.queries)
+		}
+	}
+
+	for _, key := range []string{
+		"TypeA:cdn.example.com+edns@198.51.0.0/16", "TypeA:cdn.example.com+edns@203.0.0.0/16",
+		"TypeA:www.example.com+edns@198.51.100.0/24", "TypeA:www.example.com+edns",
+	} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf(`Get(%s) = false; want cached`, key)
+		}
+	}
+	// Only the non-zero scope is remembered.
+	if v, ok := cache.Get("TypeA:cdn.example.com+edns" + ecsScopeKeySuffix); !ok || v[0] != 16 {
+		t.Errorf(`cdn.example.com scope marker = (%v, %v); want 16`, v, ok)
+	}
+	if _, ok := cache.Get("TypeA:www.example.com+edns" + ecsScopeKeySuffix); ok {
+		t.Errorf(`www.example.com scope marker found; want forgotten upon scope 0`)
+	}
+	if entries := f.DumpCache(100); len(entries) != 5 {
+		t.Errorf(`DumpCache() = %d entries; want 5 without the scope markers`, len(entries))
+	}
+}
+
+func TestCacheFile(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	answer := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("www.example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+			TTL:   300,
+		},
+		Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}
+	positive := newTestResponse(t, query, dnsmessage.RCodeSuccess,
+		[]dnsmessage.Resource{answer}, nil)
+	negative := newTestResponse(t, query, dnsmessage.RCodeNameError, nil,
+		[]dnsmessage.Resource{newLocalSOA("example.com", 600)})
+
+	path := t.TempDir() + "/cache.bin"
+	for _, answersOnly := range []bool{false, true} {
+		cache := NewMemoryCache()
+		f := &Forwarder{Cache: cache, MaxStale: time.Hour}
+		if err := f.SetCacheFile(path, 0, answersOnly); err != nil {
+			t.Fatalf(`SetCacheFile() = %v; want nil`, err)
+		}
+		f.cacheResponse("positive", positive, 0)
+		f.cacheResponse("negative", negative, 0)
+		f.cacheResponse("stale", positive, 0)
+		entry, _ := cache.Get("stale")
+		binary.BigEndian.PutUint64(entry[8:], uint64(time.Now().Unix()-10))
+		cache.Set("expiring", []byte("x"), time.Millisecond)
+		if err := f.saveCache(); err != nil {
+			t.Fatalf(`saveCache() = %v; want nil`, err)
+		}
+		cache.Close()
+
+		cache2 := NewMemoryCache()
+		f2 := &Forwarder{Cache: cache2, CacheFile: path}
+		f2.loadCache()
+		want := map[string]bool{
+			"positive": true,
+			"negative": !answersOnly,
+			"stale":    !answersOnly,
+		}
+		for key, ok := range want {
+			v, found := cache2.Get(key)
+			if found != ok {
+				t.Errorf(`[answersOnly=%t] Get(%q) after load = %t; want %t`,
+					answersOnly, key, found, ok)
+				continue
+			}
+			if v0, _ := cache.Get(key); found && !slices.Equal(v, v0) {
+				t.Errorf(`[answersOnly=%t] Get(%q) after load = %x; want %x`,
+					answersOnly, key, v, v0)
+			}
+		}
+		if _, ok := cache2.Get("expiring"); ok {
+			t.Errorf(`[answersOnly=%t] Get("expiring") after load = true; want false`,
+				answersOnly)
+		}
+		cache2.Close()
+	}
+
+	// Missing or corrupted file: nothing loaded.
+	cache := NewMemoryCache()
+	defer cache.Close()
+	if _, err := cache.Load(strings.NewReader("junk")); err == nil {
+		t.Errorf(`Load() of junk = nil; want error`)
+	}
+	f := &Forwarder{Cache: cache, CacheFile: path + ".missing"}
+	f.loadCache()
+	if s := cache.Stats(); s.Size != 0 {
+		t.Errorf(`cache size after loading missing file = %d; want 0`, s.Size)
+	}
+
+	if err := f.SetCacheFile(path, 1, false); err == nil {
+		t.Errorf(`SetCacheFile() with interval 1 = nil; want error`)
+	}
+}
@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Limit of the concurrent inbound TCP/DoT/DoH connections.
+//
+
+package dns
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kexuedns/log"
+)
+
+// Interval to repeat the warning of the connection limit hit.
+const connLimitNoticeInterval = time.Minute
+
+// Semaphore of the inbound connections shared by all the listeners, so that
+// a connection flood cannot exhaust the memory and file descriptors.
+type connLimiter struct {
+	sem  chan struct{}
+	last atomic.Int64 // unix nanoseconds of the last warning
+}
+
+// Create the limiter of max (max) connections; nil if unlimited (max <= 0).
+func newConnLimiter(max int) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimiter{sem: make(chan struct{}, max)}
+}
+
+// Wrap the listener (ln) to delay the accepts beyond the limit until some
+// connections close; return it as is if the limiter is nil.
+// NOTE: Wrap the plain TCP listener under TLS, so that the accepted
+// connections are still *tls.Conn.
+func (cl *connLimiter) wrap(ln net.Listener) net.Listener {
+	if cl == nil {
+		return ln
+	}
+	return &limitListener{Listener: ln, limiter: cl, done: make(chan struct{})}
+}
+
+// Log the limit hit, but at most once per connLimitNoticeInterval.
+func (cl *connLimiter) notice(addr net.Addr) {
+	now := time.Now().UnixNano()
+	t := cl.last.Load()
+	if now-t >= int64(connLimitNoticeInterval) && cl.last.CompareAndSwap(t, now) {
+		log.Warnf("too many connections (max %d); delaying the accepts at %s",
+			cap(cl.sem), addr)
+	} else {
+		log.Debugf("too many connections (max %d) at %s", cap(cl.sem), addr)
+	}
+}
+
+type limitListener struct {
+	net.Listener
+	limiter *connLimiter
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.limiter.sem <- struct{}{}:
+	default:
+		l.limiter.notice(l.Addr())
+		select {
+		case l.limiter.sem <- struct{}{}:
+		case <-l.done:
+			return nil, net.ErrClosed
+		}
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.limiter.sem
+		return nil, err
+	}
+	return &limitConn{Conn: conn, sem: l.limiter.sem}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// Connection releasing its slot of the limiter upon close.
+type limitConn struct {
+	net.Conn
+	sem  chan struct{}
+	once sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { <-c.sem })
+	return err
+}
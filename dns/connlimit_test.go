@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Limit of the inbound connections - tests
+//
+
+package dns
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimiter(t *testing.T) {
+	if newConnLimiter(0) != nil || newConnLimiter(-1) != nil {
+		t.Errorf(`newConnLimiter(<=0) != nil; want unlimited`)
+	}
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen TCP: %v", err)
+	}
+	ln := newConnLimiter(1).wrap(raw)
+	defer ln.Close()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	accept := func() {
+		conn, err := ln.Accept()
+		accepted <- result{conn, err}
+	}
+	for range 2 {
+		c, err := net.Dial("tcp", raw.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer c.Close()
+	}
+
+	go accept()
+	first := <-accepted
+	if first.err != nil {
+		t.Fatalf(`Accept() = %v; want nil`, first.err)
+	}
+
+	// The second accept is delayed until the first connection closes.
+	go accept()
+	select {
+	case r := <-accepted:
+		t.Fatalf(`Accept() = (%v, %v); want delayed beyond the limit`, r.conn, r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.conn.Close()
+	first.conn.Close() // releases only once
+	second := <-accepted
+	if second.err != nil {
+		t.Fatalf(`Accept() = %v; want nil after a close`, second.err)
+	}
+
+	// Closing the listener unblocks the delayed accept.
+	go accept()
+	time.Sleep(10 * time.Millisecond)
+	ln.Close()
+	if r := <-accepted; !errors.Is(r.err, net.ErrClosed) {
+		t.Errorf(`Accept() = %v; want %v`, r.err, net.ErrClosed)
+	}
+	second.conn.Close()
+}
+
+func TestSetMaxTCPConns(t *testing.T) {
+	f := &Forwarder{}
+	tests := []struct {
+		n      int
+		expect int
+		ok     bool
+	}{
+		{0, tcpMaxConns, true},
+		{10, 10, true},
+		{-1, -1, true},
+		{-2, 0, false},
+	}
+	for _, tc := range tests {
+		err := f.SetMaxTCPConns(tc.n)
+		if (err == nil) != tc.ok {
+			t.Errorf(`SetMaxTCPConns(%d) = %v; want ok=%v`, tc.n, err, tc.ok)
+			continue
+		}
+		if tc.ok && f.MaxTCPConns != tc.expect {
+			t.Errorf(`SetMaxTCPConns(%d) => %d; want %d`, tc.n, f.MaxTCPConns, tc.expect)
+		}
+	}
+}
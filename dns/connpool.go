@@ -10,20 +10,61 @@ package dns
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"net"
 	"net/netip"
+	"net/url"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"kexuedns/log"
 )
 
+var (
+	ErrPoolClosed = errors.New("connection pool closed")
+)
+
+// Max time to warm up a connection pool.
+const poolWarmupTimeout = 30 * time.Second
+
 type ConnPool interface {
 	Get(ctx context.Context) (net.Conn, error)
 	Put(conn net.Conn, discard bool)
+	Stats() *ConnPoolStats
+	Drain() int
 	Close()
 }
 
+// Runtime statistics of a connection pool.
+type ConnPoolStats struct {
+	// Number of active connections (checked out + idle)
+	Active int `json:"active"`
+	// Number of idle connections
+	Idle int `json:"idle"`
+	// Number of dialed connections, including the failed ones
+	Dials uint64 `json:"dials"`
+	// Number of failed dials
+	DialFailures uint64 `json:"dial_failures"`
+	// Number of reused idle connections
+	Reuses uint64 `json:"reuses"`
+	// Number of discarded connections (broken or requested by the user)
+	Discards uint64 `json:"discards"`
+	// Number of failed TLS handshakes (TLS pool only)
+	HandshakeFailures uint64 `json:"handshake_failures,omitempty"`
+}
+
+// Accumulate the other statistics (ps) into this one.
+func (s *ConnPoolStats) add(ps *ConnPoolStats) {
+	s.Active += ps.Active
+	s.Idle += ps.Idle
+	s.Dials += ps.Dials
+	s.DialFailures += ps.DialFailures
+	s.Reuses += ps.Reuses
+	s.Discards += ps.Discards
+	s.HandshakeFailures += ps.HandshakeFailures
+}
+
 // ConnPool manages a pool of TCP connections.
 type ConnPoolTCP struct {
 	address     netip.AddrPort      // resolver address
@@ -31,9 +72,19 @@ type ConnPoolTCP struct {
 	idleConns   int                 // max idle connections
 	dialTimeout time.Duration       // connection dial timeout
 	keepAlive   net.KeepAliveConfig // keepalive configs
+	fastOpen    bool                // TCP fast open (Linux only)
+	proxy       *url.URL            // outbound proxy (optional)
 
 	conns  chan *pooledConn // idle connections
 	active atomic.Int32     // number of active connections (checked out + idle)
+	closed bool             // pool closed; no more sends to conns
+	lock   sync.RWMutex     // protect closed and the close of conns
+
+	// Statistics counters
+	dials        atomic.Uint64
+	dialFailures atomic.Uint64
+	reuses       atomic.Uint64
+	discards     atomic.Uint64
 }
 
 // pooledConn wraps a net.Conn with last-used timestamp.
@@ -62,12 +113,41 @@ func NewConnPool(
 	}
 }
 
+// SetFastOpen enables/disables TCP Fast Open (TFO) for the new connections.
+// It's supported only on Linux, and the normal connect is used otherwise.
+func (p *ConnPoolTCP) SetFastOpen(enable bool) {
+	if enable && !fastOpenSupported {
+		log.Warnf("TCP fast open not supported on this platform; ignored")
+		enable = false
+	}
+	p.fastOpen = enable
+}
+
+// SetProxy sets the proxy (u) to connect to the resolver through; nil to
+// connect directly.
+func (p *ConnPoolTCP) SetProxy(u *url.URL) {
+	p.proxy = u
+}
+
 // dial creates a new TCP connection with keepalive.
 func (p *ConnPoolTCP) dial(ctx context.Context) (net.Conn, error) {
 	ctx, cancel := context.WithTimeout(ctx, p.dialTimeout)
 	defer cancel()
 
-	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", p.address.String())
+	dialer := &net.Dialer{}
+	if p.fastOpen {
+		dialer.Control = setFastOpen
+	}
+	if p.proxy != nil {
+		// The keepalive applies to the connection to the proxy.
+		dialer.KeepAliveConfig = p.keepAlive
+		pd, err := newProxyDialer(p.proxy, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return pd.DialContext(ctx, "tcp", p.address.String())
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", p.address.String())
 	if err != nil {
 		return nil, err
 	}
@@ -84,43 +164,65 @@ func (p *ConnPoolTCP) dial(ctx context.Context) (net.Conn, error) {
 // Get fetches a healthy connection from the pool (creates one if needed).
 func (p *ConnPoolTCP) Get(ctx context.Context) (conn net.Conn, err error) {
 	for {
+		p.lock.RLock()
+		closed := p.closed
+		p.lock.RUnlock()
+		if closed {
+			return nil, ErrPoolClosed
+		}
+
 		select {
 		case <-ctx.Done():
 			return nil, ctx.Err()
 
-		case pc := <-p.conns:
+		case pc, ok := <-p.conns:
+			if !ok {
+				return nil, ErrPoolClosed
+			}
 			conn = pc.conn
 
 		default:
 			if int(p.active.Load()) >= p.maxConns {
 				// Wait for an existing connection to be reused/discarded.
-				pc := <-p.conns
-				conn = pc.conn
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case pc, ok := <-p.conns:
+					if !ok {
+						return nil, ErrPoolClosed
+					}
+					conn = pc.conn
+				}
 				break
 			}
 
 			// Create a new one.
 			p.active.Add(1)
+			p.dials.Add(1)
 			conn, err = p.dial(ctx)
 			if err != nil {
-				log.Errorf("failed to connect to %s, error: %v", p.address, err)
+				log.Errorf("%s: failed to connect to %s, error: %v",
+					requestIDFrom(ctx), p.address, err)
 				p.active.Add(-1)
+				p.dialFailures.Add(1)
 				return nil, err
 			}
 
-			log.Debugf("created new connection to %s", p.address)
+			log.Debugf("%s: created new connection to %s", requestIDFrom(ctx), p.address)
 			return conn, nil
 		}
 
 		// Check connection health before reuse.
 		if p.isConnAlive(conn) {
-			log.Debugf("reuse idle connection to %s", p.address)
+			log.Debugf("%s: reuse idle connection to %s", requestIDFrom(ctx), p.address)
+			p.reuses.Add(1)
 			return conn, nil
 		}
 
-		log.Debugf("close broken connection to %s", p.address)
+		log.Debugf("%s: close broken connection to %s", requestIDFrom(ctx), p.address)
 		conn.Close()
 		p.active.Add(-1)
+		p.discards.Add(1)
 	}
 }
 
@@ -130,10 +232,20 @@ func (p *ConnPoolTCP) Put(conn net.Conn, discard bool) {
 	if discard {
 		conn.Close()
 		p.active.Add(-1)
+		p.discards.Add(1)
 		log.Debugf("discarded connection to %s", p.address)
 		return
 	}
 
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		conn.Close()
+		p.active.Add(-1)
+		log.Debugf("pool closed; closed connection to %s", p.address)
+		return
+	}
+
 	pc := &pooledConn{
 		conn:     conn,
 		lastUsed: time.Now(),
@@ -149,11 +261,60 @@ func (p *ConnPoolTCP) Put(conn net.Conn, discard bool) {
 	}
 }
 
+// Stats returns the runtime statistics of the pool.
+func (p *ConnPoolTCP) Stats() *ConnPoolStats {
+	return &ConnPoolStats{
+		Active:       int(p.active.Load()),
+		Idle:         len(p.conns),
+		Dials:        p.dials.Load(),
+		DialFailures: p.dialFailures.Load(),
+		Reuses:       p.reuses.Load(),
+		Discards:     p.discards.Load(),
+	}
+}
+
+// Drain closes all the idle connections so that the subsequent Get creates
+// new ones (e.g., after the resolver restarts), while the connections checked
+// out are kept. Return the number of the closed connections.
+func (p *ConnPoolTCP) Drain() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		return 0
+	}
+
+	// Only drain the current idle ones, against the concurrent Put.
+	n := 0
+	for i := len(p.conns); i > 0; i-- {
+		select {
+		case pc := <-p.conns:
+			pc.conn.Close()
+			p.active.Add(-1)
+			n++
+		default:
+			i = 0
+		}
+	}
+	log.Debugf("drained %d idle connections to %s", n, p.address)
+	return n
+}
+
 // Close shuts down the pool and all idle connections.
+// The connections checked out are closed when they're put back.
+// It's safe to call it multiple times and concurrently with Get/Put.
 func (p *ConnPoolTCP) Close() {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return
+	}
+	p.closed = true
 	close(p.conns)
+	p.lock.Unlock()
+
 	for pc := range p.conns {
 		pc.conn.Close()
+		p.active.Add(-1)
 	}
 }
 
@@ -172,12 +333,50 @@ func (p *ConnPoolTCP) isConnAlive(conn net.Conn) bool {
 	return err == nil
 }
 
+// Warm up the pool (pool) by getting n connections concurrently, i.e.,
+// dialing (and the TLS handshakes) if no idle ones, and putting them back
+// as the idle ones. Return the number of the warmed up connections and
+// the first error.
+func warmupPool(ctx context.Context, pool ConnPool, n int) (int, error) {
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		conns    []net.Conn
+		firstErr error
+	)
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := pool.Get(ctx)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}()
+	}
+	wg.Wait()
+
+	for _, conn := range conns {
+		pool.Put(conn, false)
+	}
+	return len(conns), firstErr
+}
+
 // ----------------------------------------------------------
 
 type ConnPoolTLS struct {
 	pool             *ConnPoolTCP
 	tlsConfig        *tls.Config
 	handshakeTimeout time.Duration
+	certExpiry       *certExpiry // record the server cert expiry (optional)
+
+	handshakeFailures atomic.Uint64
 }
 
 func NewConnPoolTLS(
@@ -206,15 +405,19 @@ func (p *ConnPoolTLS) Get(ctx context.Context) (net.Conn, error) {
 	ctx, cancel := context.WithTimeout(ctx, p.handshakeTimeout)
 	defer cancel()
 	if err := tlsConn.HandshakeContext(ctx); err != nil {
-		log.Errorf("TLS handshake failed: %v", err)
+		log.Errorf("%s: TLS handshake failed: %v", requestIDFrom(ctx), err)
+		p.handshakeFailures.Add(1)
 		p.pool.Put(conn, true)
 		return nil, err
 	}
 
 	cs := tlsConn.ConnectionState()
-	log.Debugf("TLS connected: Version=%s, CipherSuite=%s, ServerName=%s, ALPN=%s",
-		tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite),
-		cs.ServerName, cs.NegotiatedProtocol)
+	log.Debugf("%s: TLS connected: Version=%s, CipherSuite=%s, ServerName=%s, ALPN=%s, Resumed=%t",
+		requestIDFrom(ctx), tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite),
+		cs.ServerName, cs.NegotiatedProtocol, cs.DidResume)
+	if p.certExpiry != nil {
+		p.certExpiry.observe(cs.PeerCertificates)
+	}
 	return tlsConn, nil
 }
 
@@ -222,6 +425,16 @@ func (p *ConnPoolTLS) Put(conn net.Conn, discard bool) {
 	p.pool.Put(conn, discard)
 }
 
+func (p *ConnPoolTLS) Stats() *ConnPoolStats {
+	stats := p.pool.Stats()
+	stats.HandshakeFailures = p.handshakeFailures.Load()
+	return stats
+}
+
+func (p *ConnPoolTLS) Drain() int {
+	return p.pool.Drain()
+}
+
 func (p *ConnPoolTLS) Close() {
 	p.pool.Close()
 }
@@ -0,0 +1,274 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// TCP & TLS connection pool - tests
+//
+
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestConnPool(t *testing.T, address netip.AddrPort) *ConnPoolTCP {
+	p := NewConnPool(address, 2, 2, time.Second, net.KeepAliveConfig{})
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestConnPoolStats(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen TCP: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	address := netip.MustParseAddrPort(ln.Addr().String())
+	p := newTestConnPool(t, address)
+	ctx := context.Background()
+
+	conn, err := p.Get(ctx)
+	if err != nil {
+		t.Fatalf(`Get() = %v; want nil`, err)
+	}
+	p.Put(conn, false)
+	conn, err = p.Get(ctx)
+	if err != nil {
+		t.Fatalf(`Get() = %v; want nil`, err)
+	}
+	p.Put(conn, true)
+
+	want := ConnPoolStats{Dials: 1, Reuses: 1, Discards: 1}
+	if s := p.Stats(); *s != want {
+		t.Errorf(`Stats() = %+v; want %+v`, s, want)
+	}
+
+	// Dial failure
+	ln.Close()
+	p = newTestConnPool(t, address)
+	if _, err := p.Get(ctx); err == nil {
+		t.Fatalf(`Get() = nil; want error`)
+	}
+	want = ConnPoolStats{Dials: 1, DialFailures: 1}
+	if s := p.Stats(); *s != want {
+		t.Errorf(`Stats() = %+v; want %+v`, s, want)
+	}
+}
+
+func TestWarmupPool(t *testing.T) {
+	ln := newEchoTCPServer(t)
+	address := netip.MustParseAddrPort(ln.Addr().String())
+	p := NewConnPool(address, 4, 3, time.Second, net.KeepAliveConfig{})
+	defer p.Close()
+
+	ctx := context.Background()
+	if n, err := warmupPool(ctx, p, 3); n != 3 || err != nil {
+		t.Fatalf(`warmupPool() = (%d, %v); want (3, nil)`, n, err)
+	}
+	want := ConnPoolStats{Active: 3, Idle: 3, Dials: 3}
+	if s := p.Stats(); *s != want {
+		t.Errorf(`Stats() = %+v; want %+v`, s, want)
+	}
+
+	// Dial failure
+	ln.Close()
+	p = newTestConnPool(t, address)
+	if n, err := warmupPool(ctx, p, 2); n != 0 || err == nil {
+		t.Errorf(`warmupPool() = (%d, %v); want (0, error)`, n, err)
+	}
+}
+
+func TestConnPoolClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen TCP: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	p := newTestConnPool(t, netip.MustParseAddrPort(ln.Addr().String()))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Concurrent Get/Put while closing must neither panic nor deadlock.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				conn, err := p.Get(ctx)
+				if err != nil {
+					if !errors.Is(err, ErrPoolClosed) {
+						t.Errorf(`Get() = %v; want %v`, err, ErrPoolClosed)
+					}
+					return
+				}
+				p.Put(conn, false)
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	p.Close()
+	p.Close() // idempotent
+	wg.Wait()
+
+	if _, err := p.Get(ctx); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf(`Get() after Close() = %v; want %v`, err, ErrPoolClosed)
+	}
+	if n := p.Stats().Active; n != 0 {
+		t.Errorf(`Stats().Active = %d; want 0`, n)
+	}
+}
+
+func TestConnPoolDrain(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen TCP: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	p := newTestConnPool(t, netip.MustParseAddrPort(ln.Addr().String()))
+	ctx := context.Background()
+
+	idle, err := p.Get(ctx)
+	if err != nil {
+		t.Fatalf(`Get() = %v; want nil`, err)
+	}
+	inuse, err := p.Get(ctx)
+	if err != nil {
+		t.Fatalf(`Get() = %v; want nil`, err)
+	}
+	p.Put(idle, false)
+
+	// Only the idle connection is closed.
+	if n := p.Drain(); n != 1 {
+		t.Errorf(`Drain() = %d; want 1`, n)
+	}
+	if s := p.Stats(); s.Active != 1 || s.Idle != 0 {
+		t.Errorf(`Stats() = %+v; want 1 active and 0 idle`, s)
+	}
+	if _, err := inuse.Write([]byte{0}); err != nil {
+		t.Errorf(`Write() on the checked-out connection = %v; want nil`, err)
+	}
+
+	// The next Get creates a new connection.
+	conn, err := p.Get(ctx)
+	if err != nil {
+		t.Fatalf(`Get() = %v; want nil`, err)
+	}
+	if s := p.Stats(); s.Dials != 3 || s.Reuses != 0 {
+		t.Errorf(`Stats() = %+v; want 3 dials and no reuse`, s)
+	}
+	p.Put(conn, false)
+	p.Put(inuse, false)
+
+	p.Close()
+	if n := p.Drain(); n != 0 {
+		t.Errorf(`Drain() after Close() = %d; want 0`, n)
+	}
+}
+
+func TestConnPoolFastOpen(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen TCP: %v", err)
+	}
+	defer ln.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 16)
+		n, _ := conn.Read(buf)
+		received <- buf[:n]
+	}()
+
+	p := newTestConnPool(t, netip.MustParseAddrPort(ln.Addr().String()))
+	p.SetFastOpen(true)
+	if p.fastOpen != fastOpenSupported {
+		t.Errorf(`fastOpen = %v; want %v`, p.fastOpen, fastOpenSupported)
+	}
+
+	// Either with TFO or falling back to normal connect, the data must
+	// arrive just the same.
+	conn, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatalf(`Get() = %v; want nil`, err)
+	}
+	defer p.Put(conn, true)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf(`Write() = %v; want nil`, err)
+	}
+	select {
+	case data := <-received:
+		if string(data) != "hello" {
+			t.Errorf(`received %q; want "hello"`, data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("data not received")
+	}
+}
+
+func TestConnPoolTLSCertExpiry(t *testing.T) {
+	// Only the TLS listener is used.
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	address := netip.MustParseAddrPort(server.Listener.Addr().String())
+	config := &tls.Config{RootCAs: x509.NewCertPool(), ServerName: "example.com"}
+	config.RootCAs.AddCert(server.Certificate())
+	p := NewConnPoolTLS(newTestConnPool(t, address), config, time.Second)
+	p.certExpiry = newCertExpiry("dot", defaultCertExpiryWarn)
+
+	conn, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatalf(`Get() = %v; want nil`, err)
+	}
+	p.Put(conn, true)
+
+	want := server.Certificate().NotAfter
+	if rs := p.certExpiry.fill(&ResolverStats{}); rs.CertNotAfter == nil || !rs.CertNotAfter.Equal(want) {
+		t.Errorf(`CertNotAfter = %v; want %v`, rs.CertNotAfter, want)
+	}
+}
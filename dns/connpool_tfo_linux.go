@@ -0,0 +1,38 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// TCP Fast Open (TFO) for the upstream connections - Linux
+//
+
+package dns
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"kexuedns/log"
+)
+
+const fastOpenSupported = true
+
+// Enable the client-side TCP Fast Open on the socket, which defers the
+// connect() until the first write, so that the first query (or TLS
+// ClientHello) is sent in the SYN.
+// Require Linux 4.11+ (TCP_FASTOPEN_CONNECT); fall back to the normal
+// connect if failed to set the option.
+func setFastOpen(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP,
+			unix.TCP_FASTOPEN_CONNECT, 1)
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		log.Debugf("failed to enable TCP fast open to %s: %v", address, err)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// TCP Fast Open (TFO) for the upstream connections - unsupported platforms
+//
+
+//go:build !linux
+
+package dns
+
+import (
+	"syscall"
+)
+
+// NOTE: macOS supports client-side TFO only via connectx(2), which is not
+// usable with the Go dialer, so it uses the normal connect as well.
+const fastOpenSupported = false
+
+func setFastOpen(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,226 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// DoH JSON API (application/dns-json), as provided by Google and Cloudflare.
+//
+
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/log"
+	"kexuedns/util/dnsmsg"
+)
+
+const (
+	dohJSONContentType = "application/dns-json"
+	// EDNS payload size advertised in the JSON queries asking for DNSSEC
+	dohJSONUDPSize = 1232
+)
+
+// Response in the JSON API.
+// See https://developers.google.com/speed/public-dns/docs/doh/json
+type dohJSONResponse struct {
+	Status     int               `json:"Status"` // response code
+	TC         bool              `json:"TC"`
+	RD         bool              `json:"RD"`
+	RA         bool              `json:"RA"`
+	AD         bool              `json:"AD"`
+	CD         bool              `json:"CD"`
+	Question   []dohJSONQuestion `json:"Question"`
+	Answer     []dohJSONRecord   `json:"Answer,omitempty"`
+	Authority  []dohJSONRecord   `json:"Authority,omitempty"`
+	Additional []dohJSONRecord   `json:"Additional,omitempty"`
+	Comment    string            `json:"Comment,omitempty"` // extended errors
+}
+
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type dohJSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// Whether the DoH request (r) is a JSON API query, i.e., a GET request
+// with the "name" parameter instead of the "dns" one.
+func (f *Forwarder) isDoHJSON(r *http.Request) bool {
+	if !f.DoHJSON || r.Method != http.MethodGet {
+		return false
+	}
+	q := r.URL.Query()
+	return q.Has("name") && !q.Has("dns")
+}
+
+// Handle the JSON API query, whose response is in JSON by default, or in
+// the wire format if asked by the "ct" parameter.
+func (f *Forwarder) handleDoHJSON(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	wire := false
+	switch ct := params.Get("ct"); ct {
+	case "", dohJSONContentType, "application/json", "application/x-javascript":
+		// ok
+	case dohContentType:
+		wire = true
+	default:
+		http.Error(w, "415 unsupported media type: "+ct, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	query, err := newDoHJSONQuery(params)
+	if err != nil {
+		http.Error(w, "400 bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Debugf("dns-json: %s", r.URL.RawQuery)
+
+	client, _ := netip.ParseAddrPort(r.RemoteAddr)
+	resp, err := f.handleQuery(dohContext(r), query, client.Addr(), false)
+	if resp == nil {
+		http.Error(w, "400 bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if wire {
+		w.Header().Set("Content-Type", dohContentType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(resp)
+		return
+	}
+
+	body, err := marshalDoHJSON(resp)
+	if err != nil {
+		log.Errorf("failed to marshal JSON response: %v", err)
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohJSONContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// Synthesize the wire query from the JSON API parameters (params): name,
+// type (default: A), cd and do.
+func newDoHJSONQuery(params url.Values) ([]byte, error) {
+	name := params.Get("name")
+	if name == "" || name == "." {
+		return nil, fmt.Errorf("name missing")
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, fmt.Errorf("name invalid")
+	}
+	qtype := dnsmessage.TypeA
+	if s := params.Get("type"); s != "" {
+		if qtype, err = dnsmsg.ParseType(s); err != nil {
+			return nil, fmt.Errorf("type invalid")
+		}
+	}
+	cd, err := parseDoHJSONBool(params.Get("cd"))
+	if err != nil {
+		return nil, fmt.Errorf("cd invalid")
+	}
+	do, err := parseDoHJSONBool(params.Get("do"))
+	if err != nil {
+		return nil, fmt.Errorf("do invalid")
+	}
+
+	dmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			RecursionDesired: true,
+			CheckingDisabled: cd,
+		},
+		Questions: []dnsmessage.Question{
+			{Name: qname, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	if do {
+		var rh dnsmessage.ResourceHeader
+		rh.SetEDNS0(dohJSONUDPSize, dnsmessage.RCodeSuccess, true)
+		dmsg.Additionals = []dnsmessage.Resource{
+			{Header: rh, Body: &dnsmessage.OPTResource{}},
+		}
+	}
+	return dmsg.Pack()
+}
+
+// Parse the boolean parameter: empty, "0", "1", "false" or "true".
+func parseDoHJSONBool(s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+// Marshal the wire response (resp) into the JSON API format.
+func marshalDoHJSON(resp []byte) ([]byte, error) {
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil {
+		return nil, err
+	}
+
+	h := &dmsg.Header
+	jr := &dohJSONResponse{
+		Status: int(h.RCode),
+		TC:     h.Truncated,
+		RD:     h.RecursionDesired,
+		RA:     h.RecursionAvailable,
+		AD:     h.AuthenticData,
+		CD:     h.CheckingDisabled,
+	}
+	for _, q := range dmsg.Questions {
+		jr.Question = append(jr.Question, dohJSONQuestion{
+			Name: q.Name.String(),
+			Type: uint16(q.Type),
+		})
+	}
+	records := func(rrs []dnsmessage.Resource) []dohJSONRecord {
+		var jrs []dohJSONRecord
+		for _, rr := range rrs {
+			if rr.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			jrs = append(jrs, dohJSONRecord{
+				Name: rr.Header.Name.String(),
+				Type: uint16(rr.Header.Type),
+				TTL:  rr.Header.TTL,
+				Data: dnsmsg.FormatRData(rr.Body),
+			})
+		}
+		return jrs
+	}
+	jr.Answer = records(dmsg.Answers)
+	jr.Authority = records(dmsg.Authorities)
+	jr.Additional = records(dmsg.Additionals)
+
+	if edes, err := GetExtendedErrors(resp); err == nil && len(edes) > 0 {
+		comments := make([]string, 0, len(edes))
+		for _, ede := range edes {
+			c := fmt.Sprintf("EDE(%d)", ede.InfoCode)
+			if ede.ExtraText != "" {
+				c += ": " + ede.ExtraText
+			}
+			comments = append(comments, c)
+		}
+		jr.Comment = strings.Join(comments, "; ")
+	}
+
+	return json.Marshal(jr)
+}
@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// DoH JSON API - tests
+//
+
+package dns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+	"kexuedns/util/dnsmsg"
+)
+
+func doDoHJSON(f *Forwarder, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, dohPath+"?"+query, nil)
+	w := httptest.NewRecorder()
+	f.handleDoH(w, req)
+	return w
+}
+
+func TestDoHJSON(t *testing.T) {
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = &answeringResolver{}
+
+	// Disabled by default
+	if w := doDoHJSON(f, "name=www.example.com"); w.Code != http.StatusBadRequest {
+		t.Errorf(`disabled: status = %d; want %d`, w.Code, http.StatusBadRequest)
+	}
+
+	f.DoHJSON = true
+	w := doDoHJSON(f, "name=www.example.com&type=AAAA")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != dohJSONContentType {
+		t.Fatalf(`status = %d, content-type = %q; want 200 JSON`,
+			w.Code, w.Header().Get("Content-Type"))
+	}
+	var jr dohJSONResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &jr); err != nil {
+		t.Fatalf(`failed to unmarshal %s: %v`, w.Body, err)
+	}
+	if jr.Status != 0 || !jr.RD || len(jr.Question) != 1 ||
+		jr.Question[0] != (dohJSONQuestion{"www.example.com.", 28}) {
+		t.Errorf(`response = %+v; want NOERROR for www.example.com. AAAA`, jr)
+	}
+	want := dohJSONRecord{"www.example.com.", 28, 300, "2001:db8::1"}
+	if len(jr.Answer) != 1 || jr.Answer[0] != want {
+		t.Errorf(`Answer = %+v; want %+v`, jr.Answer, want)
+	}
+
+	// Wire format asked by ct
+	w = doDoHJSON(f, "name=www.example.com&ct="+url.QueryEscape(dohContentType))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != dohContentType {
+		t.Fatalf(`status = %d, content-type = %q; want 200 wire`,
+			w.Code, w.Header().Get("Content-Type"))
+	}
+	if _, q, err := dnsmsg.RawMsg(w.Body.Bytes()).Question(); err != nil ||
+		q.Type != dnsmessage.TypeA {
+		t.Errorf(`wire response question = (%+v, %v); want A`, q, err)
+	}
+
+	for _, tc := range []struct {
+		query string
+		code  int
+	}{
+		{"name=", http.StatusBadRequest},
+		{"name=www.example.com&type=bogus", http.StatusBadRequest},
+		{"name=www.example.com&cd=maybe", http.StatusBadRequest},
+		{"name=www.example.com&ct=text/plain", http.StatusUnsupportedMediaType},
+	} {
+		if w := doDoHJSON(f, tc.query); w.Code != tc.code {
+			t.Errorf(`[%s] status = %d; want %d`, tc.query, w.Code, tc.code)
+		}
+	}
+}
+
+func TestNewDoHJSONQuery(t *testing.T) {
+	params, _ := url.ParseQuery("name=Example.COM&type=https&cd=true&do=1")
+	msg, err := newDoHJSONQuery(params)
+	if err != nil {
+		t.Fatalf(`newDoHJSONQuery() = %v; want nil`, err)
+	}
+	query, err := dnsmsg.NewQueryMsg(msg)
+	if err != nil {
+		t.Fatalf(`NewQueryMsg() = %v; want nil`, err)
+	}
+	if query.QName() != "Example.COM." || query.QType() != 65 ||
+		!query.Header.CheckingDisabled || !query.Header.RecursionDesired {
+		t.Errorf(`query = %+v; want Example.COM. HTTPS with CD`, query)
+	}
+	if query.OPT.Header == nil || !query.OPT.Header.DNSSECAllowed() {
+		t.Errorf(`query OPT = %+v; want DO bit`, query.OPT)
+	}
+
+	params, _ = url.ParseQuery("name=example.com")
+	msg, _ = newDoHJSONQuery(params)
+	if query, err := dnsmsg.NewQueryMsg(msg); err != nil || query.QType() != dnsmessage.TypeA ||
+		query.OPT.Header != nil {
+		t.Errorf(`query = (%+v, %v); want A without OPT`, query, err)
+	}
+}
+
+func TestMarshalDoHJSONComment(t *testing.T) {
+	query := newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA)
+	resp := newErrorResponse(query, dnsmessage.RCodeServerFailure, &ExtendedError{
+		InfoCode:  ExtendedErrorNetworkError,
+		ExtraText: "upstream query failed",
+	})
+	body, err := marshalDoHJSON(resp)
+	if err != nil {
+		t.Fatalf(`marshalDoHJSON() = %v; want nil`, err)
+	}
+	var jr dohJSONResponse
+	if err := json.Unmarshal(body, &jr); err != nil {
+		t.Fatalf(`failed to unmarshal %s: %v`, body, err)
+	}
+	if jr.Status != int(dnsmessage.RCodeServerFailure) ||
+		jr.Comment != "EDE(23): upstream query failed" || len(jr.Additional) != 0 {
+		t.Errorf(`response = %s; want SERVFAIL with the EDE comment`, body)
+	}
+}
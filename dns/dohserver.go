@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Hardening limits of the DoH server.
+//
+
+package dns
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// Default max concurrent HTTP/2 streams per connection, i.e., the
+	// handler goroutines a single connection can spawn.
+	defaultDoHMaxStreams = 100
+	maxDoHMaxStreams     = 1000
+
+	defaultDoHReadHeaderTimeout = 5 * time.Second // against slowloris
+	defaultDoHReadTimeout       = 10 * time.Second
+	defaultDoHWriteTimeout      = 10 * time.Second
+	defaultDoHIdleTimeout       = 2 * time.Minute
+	maxDoHTimeout               = 10 * time.Minute
+)
+
+// Limits of the DoH server, which is the most exposed listener, against the
+// request floods and the slow clients; 0 to use the default.
+type DoHServerLimits struct {
+	// Max concurrent HTTP/2 streams per connection.
+	// Default: defaultDoHMaxStreams
+	MaxConcurrentStreams int
+	// Max concurrent connections over the DoH listeners, besides the
+	// MaxTCPConns shared by all the listeners. Default: 0 (i.e., only
+	// MaxTCPConns)
+	MaxConns int
+	// Timeouts to read the request headers, to read the whole request, to
+	// write the response, and of the idle keep-alive connections.
+	// Default: see the defaultDoH*Timeout
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+}
+
+// Set the DoH server limits (limits), with the unset (i.e., 0) ones
+// defaulted.
+func (f *Forwarder) SetDoHServerLimits(limits DoHServerLimits) error {
+	l := limits.withDefaults()
+	if l.MaxConcurrentStreams < 1 || l.MaxConcurrentStreams > maxDoHMaxStreams {
+		return fmt.Errorf("invalid DoH max concurrent streams %d: out of range [1, %d]",
+			l.MaxConcurrentStreams, maxDoHMaxStreams)
+	}
+	if l.MaxConns < 0 {
+		return fmt.Errorf("invalid DoH max connections %d: negative", l.MaxConns)
+	}
+	for _, v := range []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{"read header", l.ReadHeaderTimeout},
+		{"read", l.ReadTimeout},
+		{"write", l.WriteTimeout},
+		{"idle", l.IdleTimeout},
+	} {
+		if v.timeout < time.Second || v.timeout > maxDoHTimeout {
+			return fmt.Errorf("invalid DoH %s timeout %v: out of range [1s, %v]",
+				v.name, v.timeout, maxDoHTimeout)
+		}
+	}
+	f.DoHServer = l
+	return nil
+}
+
+// Get the limits with the unset ones defaulted.
+func (l DoHServerLimits) withDefaults() DoHServerLimits {
+	if l.MaxConcurrentStreams == 0 {
+		l.MaxConcurrentStreams = defaultDoHMaxStreams
+	}
+	if l.ReadHeaderTimeout == 0 {
+		l.ReadHeaderTimeout = defaultDoHReadHeaderTimeout
+	}
+	if l.ReadTimeout == 0 {
+		l.ReadTimeout = defaultDoHReadTimeout
+	}
+	if l.WriteTimeout == 0 {
+		l.WriteTimeout = defaultDoHWriteTimeout
+	}
+	if l.IdleTimeout == 0 {
+		l.IdleTimeout = defaultDoHIdleTimeout
+	}
+	return l
+}
+
+// Create the DoH server with the limits applied.
+// NOTE: The connections are limited by the listener instead (see
+// connLimiter).
+func (f *Forwarder) newDoHServer() *http.Server {
+	l := f.DoHServer.withDefaults()
+	return &http.Server{
+		Handler:           http.HandlerFunc(f.handleDoH),
+		ReadHeaderTimeout: l.ReadHeaderTimeout,
+		ReadTimeout:       l.ReadTimeout,
+		WriteTimeout:      l.WriteTimeout,
+		IdleTimeout:       l.IdleTimeout,
+		HTTP2: &http.HTTP2Config{
+			MaxConcurrentStreams: l.MaxConcurrentStreams,
+		},
+	}
+}
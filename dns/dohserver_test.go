@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Hardening limits of the DoH server - tests
+//
+
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSetDoHServerLimits(t *testing.T) {
+	f := &Forwarder{}
+	if err := f.SetDoHServerLimits(DoHServerLimits{}); err != nil {
+		t.Fatalf(`SetDoHServerLimits({}) = %v; want nil`, err)
+	}
+	want := DoHServerLimits{
+		MaxConcurrentStreams: defaultDoHMaxStreams,
+		ReadHeaderTimeout:    defaultDoHReadHeaderTimeout,
+		ReadTimeout:          defaultDoHReadTimeout,
+		WriteTimeout:         defaultDoHWriteTimeout,
+		IdleTimeout:          defaultDoHIdleTimeout,
+	}
+	if f.DoHServer != want {
+		t.Errorf(`DoHServer = %+v; want %+v`, f.DoHServer, want)
+	}
+
+	for _, l := range []DoHServerLimits{
+		{MaxConcurrentStreams: -1},
+		{MaxConcurrentStreams: maxDoHMaxStreams + 1},
+		{MaxConns: -1},
+		{ReadHeaderTimeout: time.Millisecond},
+		{ReadTimeout: -time.Second},
+		{WriteTimeout: maxDoHTimeout + time.Second},
+		{IdleTimeout: -1},
+	} {
+		if err := f.SetDoHServerLimits(l); err == nil {
+			t.Errorf(`SetDoHServerLimits(%+v) = nil; want error`, l)
+		}
+	}
+}
+
+func TestNewDoHServer(t *testing.T) {
+	// The defaults apply even without the setter.
+	f := &Forwarder{}
+	server := f.newDoHServer()
+	if server.ReadHeaderTimeout != defaultDoHReadHeaderTimeout ||
+		server.IdleTimeout != defaultDoHIdleTimeout {
+		t.Errorf(`newDoHServer() timeouts = (%v, %v); want defaults`,
+			server.ReadHeaderTimeout, server.IdleTimeout)
+	}
+
+	err := f.SetDoHServerLimits(DoHServerLimits{
+		MaxConcurrentStreams: 16,
+		ReadTimeout:          3 * time.Second,
+		WriteTimeout:         4 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf(`SetDoHServerLimits() = %v; want nil`, err)
+	}
+	server = f.newDoHServer()
+	if server.HTTP2 == nil || server.HTTP2.MaxConcurrentStreams != 16 {
+		t.Errorf(`newDoHServer() HTTP2 = %+v; want MaxConcurrentStreams=16`, server.HTTP2)
+	}
+	if server.ReadTimeout != 3*time.Second || server.WriteTimeout != 4*time.Second {
+		t.Errorf(`newDoHServer() read/write timeouts = (%v, %v); want (3s, 4s)`,
+			server.ReadTimeout, server.WriteTimeout)
+	}
+}
+
+func TestDoHMaxConns(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(`Listen() failed: %v`, err)
+	}
+	// Limited by both the shared and the DoH limiters.
+	ln = newConnLimiter(10).wrap(newConnLimiter(1).wrap(ln))
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	for range 2 {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf(`Dial() failed: %v`, err)
+		}
+		defer c.Close()
+	}
+
+	conn := <-accepted
+	select {
+	case <-accepted:
+		t.Fatalf(`second connection accepted; want delayed`)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Errorf(`second connection not accepted after the first closed`)
+	}
+}
@@ -8,7 +8,10 @@
 package dns
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/binary"
@@ -20,28 +23,48 @@ import (
 	"net/netip"
 	"os"
 	"os/user"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
 	"golang.org/x/sys/unix"
 
 	"kexuedns/config"
 	"kexuedns/log"
 	"kexuedns/util/dnsmsg"
+	"kexuedns/util/dnstrie"
 )
 
 const (
-	maxQuerySize = 512 // bytes
-	minQuerySize = 12  // bytes (header length)
+	minQuerySize = 12  // bytes (header length); default junk threshold
+	minUDPSize   = 512 // bytes; max UDP response size without EDNS
 
-	queryTimeout    = 4 * time.Second // less than dig's default (5s)
-	tcpReadTimeout  = 5 * time.Second // read timeout for TCP/DoT queries
-	tcpWriteTimeout = 5 * time.Second // write timeout for TCP/DoT queries
+	queryTimeout    = 4 * time.Second  // less than dig's default (5s)
+	tcpReadTimeout  = 5 * time.Second  // read timeout for TCP/DoT queries
+	tcpWriteTimeout = 5 * time.Second  // write timeout for TCP/DoT queries
+	tcpIdleTimeout  = 30 * time.Second // default idle timeout between queries
+	tcpMaxConns     = 1024             // default max inbound TCP/DoT/DoH connections
+	maxUDPBatchSize = 64               // max UDP packets received per syscall
+
+	// Max idle timeout representable in the edns-tcp-keepalive option
+	maxTCPIdleTimeout = 6553 * time.Second
 
 	dohPath        = "/dns-query"
 	dohContentType = "application/dns-message"
+	// Min size of the DoH responses to compress, below which the gzip
+	// overhead outweighs the saving.
+	dohGzipMinSize = 1024
+
+	opCodeQuery = dnsmessage.OpCode(0) // standard query (RFC 1035)
+
+	// Default max ECS source prefix lengths (RFC 7871, Section 11.1)
+	ecsPrefixV4 = 24
+	ecsPrefixV6 = 56
 )
 
 type dnsProto int
@@ -53,48 +76,310 @@ const (
 	dnsProtoDoH // DNS-over-HTTPS
 )
 
-// TODO: cache
+func (p dnsProto) String() string {
+	switch p {
+	case dnsProtoUDP:
+		return "udp"
+	case dnsProtoTCP:
+		return "tcp"
+	case dnsProtoDoT:
+		return "dot"
+	case dnsProtoDoH:
+		return "doh"
+	default:
+		return fmt.Sprintf("dnsProto(%d)", int(p))
+	}
+}
+
+// Error of a listener failed to bind upon start.
+type ListenError struct {
+	Protocol string // udp, tcp, dot, doh
+	Address  netip.AddrPort
+	Err      error
+}
+
+func (e *ListenError) Error() string {
+	return fmt.Sprintf("listen %s at %s: %v", e.Protocol, e.Address, e.Err)
+}
+
+func (e *ListenError) Unwrap() error {
+	return e.Err
+}
+
+// Errors of all the listeners failed to bind upon start.
+type ListenErrors []*ListenError
+
+func (e ListenErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, le := range e {
+		msgs[i] = le.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e ListenErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, le := range e {
+		errs[i] = le
+	}
+	return errs
+}
+
+var (
+	errJunkPacket = errors.New("junk packet")
+	errLoop       = errors.New("forwarding loop detected")
+	errRefused    = errors.New("query refused by policy")
+	errBlocked    = errors.New("query blocked by route")
+	errBlocklist  = errors.New("query blocked by blocklist")
+	errNoQuestion = errors.New("query without question")
+	errDropped    = errors.New("query dropped by route")
+)
+
+// What to do with the queries not matching any route.
+type DefaultAction string
+
+const (
+	// Forward to the default resolver. (default)
+	DefaultActionForward DefaultAction = "forward"
+	// Answer REFUSED, i.e., only the routed zones are answered.
+	DefaultActionRefuse DefaultAction = "refuse"
+)
+
+// Interval to repeat the notice of the queries failed for no resolver.
+const noResolverNoticeInterval = time.Minute
+
+// Random nonce of this process to detect the forwarding loops.
+var loopNonce = func() []byte {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return b
+}()
+
 type Forwarder struct {
 	Router Router // Resolver routing
 
+	// Response cache; the in-memory one is used if nil upon start.
+	Cache        Cache
+	defaultCache bool // whether Cache is the default one created by us
+	// Default TTL of the cached responses, unless the record TTLs are
+	// smaller, i.e., the record TTL wins when smaller. Default: 0 (i.e.,
+	// the record TTLs capped at maxCacheTTL)
+	CacheDefaultTTL time.Duration
+	// Interval to clean up the expired responses of the default in-memory
+	// cache. Default: 0 (i.e., adaptively upon the nearest expiry)
+	CacheCleanupInterval time.Duration
+	// Max fraction to shorten the cache TTLs by at random, so that the
+	// responses cached together don't expire together. Default: 0 (i.e.,
+	// disabled)
+	CacheTTLJitter float64
+	// File to persist the default in-memory cache, which is saved every
+	// CacheSaveInterval and upon stop, and loaded upon start with the
+	// expired responses discarded, so that a restart doesn't begin with a
+	// cold cache; only the fresh positive answers are saved with
+	// CacheFileAnswersOnly. Default: none (i.e., disabled)
+	CacheFile            string
+	CacheSaveInterval    time.Duration
+	CacheFileAnswersOnly bool
+	// Names (FQDN) to preload into the cache upon start in background.
+	PreloadNames []string
+
 	Listen    *ListenConfig // UDP+TCP protocols
 	ListenDoT *ListenConfig // DoT protocol
 	ListenDoH *ListenConfig // DoH protocol
+	// Start with the listeners bound successfully and log warnings for the
+	// failed ones, rather than failing the start; it still fails if none
+	// is bound.
+	ListenBestEffort bool
+	// Also serve the JSON API (application/dns-json; non-standard) at the
+	// DoH listener, i.e., the GET requests with the "name" and "type"
+	// parameters, for the browser-based and scripting clients.
+	DoHJSON bool
+	// Limits of the DoH server against the floods and slow clients.
+	// Default: see DoHServerLimits
+	DoHServer DoHServerLimits
 
 	cancel context.CancelFunc // cancel listners to stop the forwarder
 	wg     sync.WaitGroup     // wait for shutdown to complete
 
 	udpPool sync.Pool // Pool for UDP message buffers.
+
+	// Packets not larger than this size are dropped silently as junk.
+	// Default: minQuerySize
+	MinQuerySize int
+	// Max sizes of the queries and the responses per transport.
+	// Default: see Limits
+	Limits Limits
+	// Log the source addresses of the dropped junk packets (at debug level)
+	// to help identify the scanners.
+	LogJunkSource bool
+	// Log the raw queries and the responses (before the transport limits)
+	// in hex (at debug level) for chasing the malformed packets.
+	// NOTE: Very verbose; enabled only with the debug mode.
+	DumpMessages bool
+
+	// Attach a nonce (random per process) in an EDNS option to the upstream
+	// queries, and refuse the queries carrying our own nonce, which must
+	// have looped back, e.g., configured with itself as the upstream.
+	// NOTE: The nonce is exposed to the upstreams, though it changes upon
+	// every restart.
+	DetectLoop bool
+
+	// Policy for the locally served zones (private reverse zones and
+	// special-use names). Default: LocalZoneNXDomain
+	LocalZones LocalZonePolicy
+
+	// TTL of the synthesized answers: SynthTTL for the negative answers
+	// of the blocked queries, which carry a synthesized SOA so that the
+	// clients cache them (RFC 2308); LocalZoneTTL for the answers of the
+	// locally served zones (including localhost), which rarely change.
+	// NOTE: The DNS64 answers take the TTLs of the A records instead.
+	// Default: defaultSynthTTL and defaultLocalZoneTTL
+	SynthTTL     time.Duration
+	LocalZoneTTL time.Duration
+
+	// Action for the queries not matching any route, which are refused
+	// with DefaultActionRefuse, turning the router into an allowlist.
+	// NOTE: The authoritative and locally served zones are still answered.
+	// Default: DefaultActionForward
+	DefaultAction DefaultAction
+
+	// Response code for the queries without a resolver to forward to, i.e.,
+	// no default resolver configured; either ServFail or Refused.
+	// Default: dnsmessage.RCodeServerFailure (i.e., if zero)
+	NoResolverRCode dnsmessage.RCode
+	noResolverLast  atomic.Int64 // unix nanoseconds of the last notice
+
+	// Max ECS source prefix lengths sent to the upstreams, applying to
+	// both the ECS added by the forwarder and the one sent by the client.
+	// Default: /24 for IPv4 and /56 for IPv6
+	ECSPrefixV4 int
+	ECSPrefixV6 int
+	// Static ECS subnets used instead of my IPs (i.e., config.MyIP), e.g.,
+	// to pin the geolocation to a datacenter network; a route may also
+	// override them.  Default: unset (i.e., invalid prefix)
+	ECSSubnetV4 netip.Prefix
+	ECSSubnetV6 netip.Prefix
+
+	// Idle timeout of the TCP/DoT connections between the queries, which
+	// is also advertised to the clients that sent the edns-tcp-keepalive
+	// option (RFC 7828). Default: tcpIdleTimeout
+	TCPIdleTimeout time.Duration
+
+	// Max concurrent inbound TCP/DoT/DoH connections over all the
+	// listeners, beyond which the accepts are delayed until some close;
+	// negative for unlimited. Default: tcpMaxConns
+	MaxTCPConns int
+
+	// Number of the UDP sockets per listen address, which share the address
+	// by SO_REUSEPORT and each is served by its own goroutine, so that the
+	// kernel spreads the queries over them to scale across the cores.
+	// Linux only; a single socket elsewhere. Default: 1
+	UDPSockets int
+	// Max number of the UDP packets received per syscall (recvmmsg), which
+	// reduces the syscall overhead at high QPS. Linux only; one packet per
+	// read elsewhere. Default: 1 (no batching)
+	UDPBatchSize int
+
+	// Serve-stale (RFC 8767): the expired responses are retained in the
+	// cache for MaxStale, and served with the TTL of StaleAnswerTTL when
+	// the upstream fails. Default: disabled (i.e., MaxStale is 0)
+	StaleAnswerTTL time.Duration
+	MaxStale       time.Duration
+
+	// DNS64 (RFC 6147) for the IPv6-only clients behind NAT64: synthesize
+	// the AAAA records from the A records with this NAT64 prefix if the
+	// name has no AAAA records. Default: disabled (i.e., invalid prefix)
+	DNS64Prefix netip.Prefix
+
+	// Record types stripped from the answer section of the responses, e.g.,
+	// HTTPS to disable ECH; the response becomes NODATA if no records of
+	// the queried type are left. Default: none
+	StripTypes []dnsmessage.Type
+
+	// Addresses forced as the A/AAAA answers of the names (lower-case FQDN)
+	// regardless of the upstream ones, e.g., split-horizon; the queries are
+	// still forwarded, unlike the local zones. Default: none
+	AnswerOverrides map[string][]netip.Addr
+
+	// Retry the query once without EDNS (i.e., the OPT record with the ECS
+	// and other options) if the upstream answers FORMERR, which the strict
+	// or old upstreams may do upon the options they don't accept.
+	FormErrRetry bool
+
+	// Request the name server identifier (NSID; RFC 5001) from the upstream
+	// and log it with the query, e.g., to tell which anycast node answers.
+	// The NSID is relayed to the client along with the response.
+	RequestNSID bool
+
+	// Clear the AA bit of the responses relayed from the upstreams, as the
+	// forwarder isn't authoritative for them; the RA bit is always set.
+	// NOTE: The synthesized responses set AA only for the local zones.
+	ClearRelayedAA bool
+
+	// Attach the routing information (the matched route and the resolver)
+	// to the responses of the queries asking for it by the private EDNS
+	// option (optionCodeRouteInfo), e.g., to debug the routing without the
+	// server logs.  The option is never forwarded to the upstreams.
+	RouteInfo bool
+
+	// Clients allowed to transfer the authoritative zones (AXFR) over
+	// TCP/DoT. Default: none, i.e., refused
+	AXFRClients []netip.Prefix
+
+	// Custom rewriters of the forwarded queries before sent upstream, and
+	// of their responses before cached and returned, run in order after
+	// the built-in ones (e.g., ECS, NSID, StripTypes, AnswerOverrides).
+	// NOTE: The queries answered without forwarding (e.g., from the zones,
+	// blocked, or from the cache) are not rewritten again.
+	QueryRewriters    []QueryRewriter
+	ResponseRewriters []ResponseRewriter
+
+	zones atomic.Pointer[dnstrie.DNSTrie] // authoritative zones
+
+	junkDropped atomic.Uint64    // number of dropped junk packets
+	metrics     forwarderMetrics // response metrics per route
+	flights     flightGroup      // in-flight upstream queries to coalesce
+
+	myIP *config.MyIP // My public IPs for ECS; nil to use the global one
 }
 
 type ListenConfig struct {
-	Address     netip.AddrPort
+	Addresses   []netip.AddrPort // one listener per address
 	Certificate tls.Certificate
 }
 
-func (lc *ListenConfig) listen(proto dnsProto) (io.Closer, error) {
-	switch proto {
-	case dnsProtoUDP:
-		addr := net.UDPAddrFromAddrPort(lc.Address)
-		conn, err := net.ListenUDP("udp", addr)
-		if err != nil {
-			log.Errorf("failed to listen UDP at: %s, error: %v", addr, err)
-			return nil, err
+func (lc *ListenConfig) addressString() string {
+	addrs := make([]string, len(lc.Addresses))
+	for i, addr := range lc.Addresses {
+		addrs[i] = addr.String()
+	}
+	return strings.Join(addrs, ",")
+}
+
+// Listen at the address (address) for the protocol (proto), with the
+// TCP/DoT/DoH connections limited by all the limiters (nil ones skipped).
+// NOTE: Use listenUDP() for UDP.
+func (lc *ListenConfig) listen(proto dnsProto, address netip.AddrPort,
+	limiters ...*connLimiter) (io.Closer, error) {
+	limit := func(ln net.Listener) net.Listener {
+		for _, limiter := range limiters {
+			ln = limiter.wrap(ln)
 		}
-		log.Infof("bound UDP forwarder at: %s", addr)
-		return conn, nil
+		return ln
+	}
+	switch proto {
 	case dnsProtoTCP:
-		ln, err := net.Listen("tcp", lc.Address.String())
+		ln, err := net.Listen("tcp", address.String())
 		if err != nil {
-			log.Errorf("failed to listen TCP at: %s, error: %v", lc.Address, err)
+			log.Errorf("failed to listen TCP at: %s, error: %v", address, err)
 			return nil, err
 		}
-		log.Infof("bound TCP forwarder at: %s", lc.Address)
-		return ln, nil
+		log.Infof("bound TCP forwarder at: %s", address)
+		return limit(ln), nil
 	case dnsProtoDoT, dnsProtoDoH:
 		if len(lc.Certificate.Certificate) == 0 {
 			err := errors.New("certificate required but missing")
-			log.Errorf("failed to listen DoT/DoH at: %s, error: %v", lc.Address, err)
+			log.Errorf("failed to listen DoT/DoH at: %s, error: %v", address, err)
 			return nil, err
 		}
 		config := &tls.Config{
@@ -108,49 +393,89 @@ func (lc *ListenConfig) listen(proto dnsProto) (io.Closer, error) {
 		if proto == dnsProtoDoH {
 			config.NextProtos = []string{"h2"} // enable HTTP/2
 		}
-		ln, err := tls.Listen("tcp", lc.Address.String(), config)
+		ln, err := net.Listen("tcp", address.String())
 		if err != nil {
-			log.Errorf("failed to listen DoT/DoH at: %s, error: %v", lc.Address, err)
+			log.Errorf("failed to listen DoT/DoH at: %s, error: %v", address, err)
 			return nil, err
 		}
-		log.Infof("bound DoT/DoH forwarder at: %s", lc.Address)
-		return ln, nil
+		log.Infof("bound DoT/DoH forwarder at: %s", address)
+		return tls.NewListener(limit(ln), config), nil
 	default:
 		panic(fmt.Sprintf("unknown protocol: %v", proto))
 	}
 }
 
-// Set the address of UDP+TCP listeners.
-func (f *Forwarder) SetListen(address string) error {
+// Listen the UDP sockets (n) at the address (address), which share the
+// address by SO_REUSEPORT if more than one.
+func listenUDP(address netip.AddrPort, n int) ([]*net.UDPConn, error) {
+	lc := net.ListenConfig{}
+	if n > 1 {
+		lc.Control = setReusePort
+	}
+	conns := make([]*net.UDPConn, 0, n)
+	for range n {
+		pc, err := lc.ListenPacket(context.Background(), "udp", address.String())
+		if err != nil {
+			log.Errorf("failed to listen UDP at: %s, error: %v", address, err)
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		conn := pc.(*net.UDPConn)
+		if address.Port() == 0 {
+			// Bind the rest to the same ephemeral port.
+			port := conn.LocalAddr().(*net.UDPAddr).Port
+			address = netip.AddrPortFrom(address.Addr(), uint16(port))
+		}
+		conns = append(conns, conn)
+	}
+	if n > 1 {
+		log.Infof("bound UDP forwarder at: %s (%d sockets)", address, n)
+	} else {
+		log.Infof("bound UDP forwarder at: %s", address)
+	}
+	return conns, nil
+}
+
+// Set the address(es) of UDP+TCP listeners.
+func (f *Forwarder) SetListen(addresses ...string) error {
 	var err error
-	f.Listen, err = f.makeListenConfig(address, "", "")
+	f.Listen, err = f.makeListenConfig(addresses, "", "")
 	return err
 }
 
-// Set the address and certificate of DoT listener.
-func (f *Forwarder) SetListenDoT(address string, certFile, keyFile string) error {
+// Set the address(es) and certificate of DoT listeners.
+func (f *Forwarder) SetListenDoT(addresses []string, certFile, keyFile string) error {
 	var err error
-	f.ListenDoT, err = f.makeListenConfig(address, certFile, keyFile)
+	f.ListenDoT, err = f.makeListenConfig(addresses, certFile, keyFile)
 	return err
 }
 
-// Set the address and certificate of DoH listener.
-func (f *Forwarder) SetListenDoH(address string, certFile, keyFile string) error {
+// Set the address(es) and certificate of DoH listeners.
+func (f *Forwarder) SetListenDoH(addresses []string, certFile, keyFile string) error {
 	var err error
-	f.ListenDoH, err = f.makeListenConfig(address, certFile, keyFile)
+	f.ListenDoH, err = f.makeListenConfig(addresses, certFile, keyFile)
 	return err
 }
 
 func (f *Forwarder) makeListenConfig(
-	address string, certFile, keyFile string,
+	addresses []string, certFile, keyFile string,
 ) (*ListenConfig, error) {
-	addrport, err := netip.ParseAddrPort(address)
-	if err != nil {
-		return nil, fmt.Errorf("invalid address: %s, error: %v", address, err)
+	if len(addresses) == 0 {
+		return nil, errors.New("no listen address")
 	}
 
-	lc := &ListenConfig{
-		Address: addrport,
+	lc := &ListenConfig{}
+	for _, address := range addresses {
+		addrport, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address: %s, error: %v", address, err)
+		}
+		if slices.Contains(lc.Addresses, addrport) {
+			return nil, fmt.Errorf("duplicate address: %s", address)
+		}
+		lc.Addresses = append(lc.Addresses, addrport)
 	}
 
 	if certFile != "" && keyFile != "" {
@@ -164,6 +489,169 @@ func (f *Forwarder) makeListenConfig(
 	return lc, nil
 }
 
+// Runtime statistics of the forwarder.
+type ForwarderStats struct {
+	JunkDropped uint64       `json:"junk_dropped"`
+	Dedup       *DedupStats  `json:"dedup"`
+	Router      *RouterStats `json:"router"`
+}
+
+func (f *Forwarder) Stats() *ForwarderStats {
+	return &ForwarderStats{
+		JunkDropped: f.junkDropped.Load(),
+		Dedup:       f.metrics.dedupStats(),
+		Router:      f.Router.Stats(),
+	}
+}
+
+// Set the junk packet threshold (size), i.e., packets not larger than it are
+// dropped silently; 0 to use the default.
+func (f *Forwarder) SetMinQuerySize(size int) error {
+	if size == 0 {
+		size = minQuerySize
+	}
+	if size < minQuerySize || size >= minUDPSize {
+		return fmt.Errorf("invalid min query size %d: out of range [%d, %d)",
+			size, minQuerySize, minUDPSize)
+	}
+	f.MinQuerySize = size
+	return nil
+}
+
+// Set the idle timeout (seconds) of the TCP/DoT connections between the
+// queries; 0 to use the default.
+func (f *Forwarder) SetTCPIdleTimeout(seconds int) error {
+	timeout := time.Duration(seconds) * time.Second
+	if seconds == 0 {
+		timeout = tcpIdleTimeout
+	}
+	if timeout <= 0 || timeout > maxTCPIdleTimeout {
+		return fmt.Errorf("invalid TCP idle timeout %d: out of range [1, %d]",
+			seconds, int(maxTCPIdleTimeout.Seconds()))
+	}
+	f.TCPIdleTimeout = timeout
+	return nil
+}
+
+// Set the max concurrent inbound TCP/DoT/DoH connections; 0 to use the
+// default, and -1 for unlimited.
+func (f *Forwarder) SetMaxTCPConns(n int) error {
+	if n == 0 {
+		n = tcpMaxConns
+	}
+	if n < -1 {
+		return fmt.Errorf("invalid max TCP connections %d: negative", n)
+	}
+	f.MaxTCPConns = n
+	return nil
+}
+
+// Set the number of the UDP sockets per listen address; 0 to use the
+// default (1).
+func (f *Forwarder) SetUDPSockets(n int) error {
+	if n == 0 {
+		n = 1
+	}
+	if n < 1 || n > maxUDPSockets {
+		return fmt.Errorf("invalid UDP sockets %d: out of range [1, %d]",
+			n, maxUDPSockets)
+	}
+	if n > 1 && !reusePortSupported {
+		log.Warnf("multiple UDP sockets (%d) unsupported on this platform; "+
+			"using a single socket", n)
+	}
+	f.UDPSockets = n
+	return nil
+}
+
+// Set the max number of the UDP packets received per syscall; 0 to use
+// the default (1).
+func (f *Forwarder) SetUDPBatchSize(n int) error {
+	if n == 0 {
+		n = 1
+	}
+	if n < 1 || n > maxUDPBatchSize {
+		return fmt.Errorf("invalid UDP batch size %d: out of range [1, %d]",
+			n, maxUDPBatchSize)
+	}
+	if n > 1 && !udpBatchSupported {
+		log.Warnf("batched UDP receiving (%d) unsupported on this platform; "+
+			"receiving one packet per read", n)
+	}
+	f.UDPBatchSize = n
+	return nil
+}
+
+func (f *Forwarder) udpBatchSize() int {
+	if f.UDPBatchSize <= 1 || !udpBatchSupported {
+		return 1
+	}
+	return min(f.UDPBatchSize, maxUDPBatchSize)
+}
+
+func (f *Forwarder) udpSockets() int {
+	if f.UDPSockets <= 1 || !reusePortSupported {
+		return 1
+	}
+	return min(f.UDPSockets, maxUDPSockets)
+}
+
+func (f *Forwarder) maxTCPConns() int {
+	if f.MaxTCPConns == 0 {
+		return tcpMaxConns
+	}
+	return f.MaxTCPConns
+}
+
+func (f *Forwarder) tcpIdleTimeout() time.Duration {
+	if f.TCPIdleTimeout <= 0 {
+		return tcpIdleTimeout
+	}
+	return min(f.TCPIdleTimeout, maxTCPIdleTimeout)
+}
+
+// Summarize the effective configs in one line for logging.
+func (f *Forwarder) Summary() string {
+	listens := []string{}
+	if lc := f.Listen; lc != nil {
+		listens = append(listens, "udp+tcp="+lc.addressString())
+	}
+	if lc := f.ListenDoT; lc != nil {
+		listens = append(listens, "dot="+lc.addressString())
+	}
+	if lc := f.ListenDoH; lc != nil {
+		listens = append(listens, "doh="+lc.addressString())
+	}
+	if len(listens) == 0 {
+		listens = append(listens, "(none)")
+	}
+
+	myIP := f.getMyIP()
+	ecs := []string{}
+	if p := f.ECSSubnetV4; p.IsValid() {
+		ecs = append(ecs, "v4="+p.String())
+	} else if addr, ok := myIP.GetV4(); ok {
+		ecs = append(ecs, "v4="+addr.String())
+	}
+	if p := f.ECSSubnetV6; p.IsValid() {
+		ecs = append(ecs, "v6="+p.String())
+	} else if addr, ok := myIP.GetV6(); ok {
+		ecs = append(ecs, "v6="+addr.String())
+	}
+	if len(ecs) == 0 {
+		ecs = append(ecs, "off (no myip)")
+	}
+
+	cache := "off"
+	if f.Cache != nil {
+		cache = "on"
+	}
+
+	return fmt.Sprintf("listen: %s; %s; ecs: %s; cache: %s",
+		strings.Join(listens, ","), f.Router.Summary(), strings.Join(ecs, ","),
+		cache)
+}
+
 func (f *Forwarder) Stop() {
 	f.Router.Close()
 
@@ -172,43 +660,165 @@ func (f *Forwarder) Stop() {
 	}
 
 	f.wg.Wait()
+
+	if err := f.saveCache(); err != nil {
+		log.Warnf("failed to save cache file [%s]: %v", f.CacheFile, err)
+	}
+	if f.defaultCache {
+		f.Cache.(*MemoryCache).Close()
+		f.Cache = nil
+		f.defaultCache = false
+	}
+
 	log.Infof("forwarder stopped")
 }
 
+// Check that no resolver is the forwarder itself, i.e., at one of the listen
+// addresses (e.g., a copy-paste mistake), which would loop the queries.
+func (f *Forwarder) checkSelfLoop() error {
+	var listens []netip.AddrPort
+	for _, lc := range []*ListenConfig{f.Listen, f.ListenDoT, f.ListenDoH} {
+		if lc != nil {
+			listens = append(listens, lc.Addresses...)
+		}
+	}
+	if len(listens) == 0 {
+		return nil
+	}
+
+	var local []netip.Addr // lazily get the interface addresses
+	for _, addr := range f.Router.resolverAddresses() {
+		for _, listen := range listens {
+			if addr.Port() != listen.Port() {
+				continue
+			}
+			ip, lip := addr.Addr().Unmap(), listen.Addr().Unmap()
+			self := ip == lip
+			if !self && lip.IsUnspecified() {
+				if local == nil {
+					local = localAddrs()
+				}
+				self = ip.IsLoopback() || ip.IsUnspecified() || slices.Contains(local, ip)
+			}
+			if self {
+				log.Errorf("resolver address (%s) is the listen address (%s); "+
+					"forwarding to itself", addr, listen)
+				return fmt.Errorf("resolver address %s loops back to the listen address %s",
+					addr, listen)
+			}
+		}
+	}
+	return nil
+}
+
+// Get the addresses of the local interfaces.
+func localAddrs() []netip.Addr {
+	addrs := []netip.Addr{}
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Warnf("failed to get interface addresses: %v", err)
+		return addrs
+	}
+	for _, ifaddr := range ifaddrs {
+		if ipnet, ok := ifaddr.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipnet.IP); ok {
+				addrs = append(addrs, ip.Unmap())
+			}
+		}
+	}
+	return addrs
+}
+
 // Start the forwarder at the given address (address).
 // This function starts a goroutine to serve the queries so it doesn't block.
 func (f *Forwarder) Start(username string) (err error) {
+	// One more byte to detect the oversized queries.
+	bufSize := f.Limits.withDefaults().UDPQuery + 1
 	f.udpPool.New = func() any {
-		return make([]byte, maxQuerySize)
+		return make([]byte, bufSize)
+	}
+	if err = f.checkSelfLoop(); err != nil {
+		return
+	}
+
+	if f.Cache == nil {
+		f.Cache = newMemoryCache(f.CacheCleanupInterval)
+		f.defaultCache = true
+		f.loadCache()
 	}
 
-	listenConfigs := map[dnsProto]*ListenConfig{
-		dnsProtoUDP: f.Listen,
-		dnsProtoTCP: f.Listen,
-		dnsProtoDoT: f.ListenDoT,
-		dnsProtoDoH: f.ListenDoH,
+	listenConfigs := []struct {
+		proto dnsProto
+		lc    *ListenConfig
+	}{
+		{dnsProtoUDP, f.Listen},
+		{dnsProtoTCP, f.Listen},
+		{dnsProtoDoT, f.ListenDoT},
+		{dnsProtoDoH, f.ListenDoH},
 	}
 
 	// all opened connection/listeners
-	closers := map[dnsProto]io.Closer{}
+	type listener struct {
+		proto  dnsProto
+		closer io.Closer
+	}
+	var closers []listener
 	defer func() {
 		if err != nil {
 			for _, c := range closers {
-				c.Close()
+				c.closer.Close()
 			}
 		}
 	}()
 
-	for proto, lc := range listenConfigs {
-		if lc == nil {
+	// Try all the listeners to report every failure.
+	limiter := newConnLimiter(f.maxTCPConns())
+	dohLimiter := newConnLimiter(f.DoHServer.MaxConns)
+	var lerrs ListenErrors
+	for _, c := range listenConfigs {
+		if c.lc == nil {
 			continue
 		}
-		var ln io.Closer
-		ln, err = lc.listen(proto)
-		if err != nil {
+		for _, address := range c.lc.Addresses {
+			var lns []io.Closer
+			var lerr error
+			if c.proto == dnsProtoUDP {
+				var conns []*net.UDPConn
+				conns, lerr = listenUDP(address, f.udpSockets())
+				for _, conn := range conns {
+					lns = append(lns, conn)
+				}
+			} else {
+				var ln io.Closer
+				limiters := []*connLimiter{limiter}
+				if c.proto == dnsProtoDoH {
+					limiters = append(limiters, dohLimiter)
+				}
+				if ln, lerr = c.lc.listen(c.proto, address, limiters...); lerr == nil {
+					lns = append(lns, ln)
+				}
+			}
+			if lerr != nil {
+				lerrs = append(lerrs, &ListenError{
+					Protocol: c.proto.String(),
+					Address:  address,
+					Err:      lerr,
+				})
+				continue
+			}
+			for _, ln := range lns {
+				closers = append(closers, listener{c.proto, ln})
+			}
+		}
+	}
+	if len(lerrs) > 0 {
+		if !f.ListenBestEffort || len(closers) == 0 {
+			err = lerrs
 			return
 		}
-		closers[proto] = ln
+		for _, le := range lerrs {
+			log.Warnf("skipped listener (best effort): %v", le)
+		}
 	}
 	if len(closers) == 0 {
 		log.Infof("no listen address configured")
@@ -223,8 +833,8 @@ func (f *Forwarder) Start(username string) (err error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	f.cancel = cancel
 
-	for proto, ln := range closers {
-		switch proto {
+	for _, c := range closers {
+		switch proto, ln := c.proto, c.closer; proto {
 		case dnsProtoUDP:
 			f.wg.Add(1)
 			go f.serveUDP(ctx, ln.(*net.UDPConn))
@@ -239,6 +849,15 @@ func (f *Forwarder) Start(username string) (err error) {
 		}
 	}
 
+	if len(f.PreloadNames) > 0 {
+		f.wg.Add(1)
+		go f.preload(ctx, f.PreloadNames)
+	}
+	if f.CacheFile != "" && f.CacheSaveInterval > 0 {
+		f.wg.Add(1)
+		go f.persistCache(ctx)
+	}
+
 	return
 }
 
@@ -274,16 +893,23 @@ func (f *Forwarder) dropPrivileges(username string) error {
 	return nil
 }
 
-func (f *Forwarder) serveUDP(ctx context.Context, conn *net.UDPConn) {
+func (f *Forwarder) serveUDP(ctx context.Context, uconn *net.UDPConn) {
+	conn := newUDPConn(uconn)
 	go func() {
 		// Wait for cancellation from Stop().
 		<-ctx.Done()
 		conn.Close()
 	}()
 
+	if batch := f.udpBatchSize(); batch > 1 {
+		f.serveUDPBatch(ctx, conn, batch)
+		return
+	}
+
+	limits := f.Limits.withDefaults()
 	for {
 		buf := f.udpPool.Get().([]byte)
-		n, addr, err := conn.ReadFrom(buf)
+		n, addr, oob, err := conn.read(buf)
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				log.Infof("connection closed; stop UDP forwarder")
@@ -294,25 +920,92 @@ func (f *Forwarder) serveUDP(ctx context.Context, conn *net.UDPConn) {
 			log.Warnf("failed to read packet: %v", err)
 			continue
 		}
+		if n > limits.UDPQuery {
+			log.Debugf("dropped oversized UDP query from %s: length>%d",
+				addr, limits.UDPQuery)
+			//lint:ignore SA6002 using pointer adds no benefit here
+			f.udpPool.Put(buf)
+			continue
+		}
 
-		f.wg.Add(1)
-		go func(buf []byte, n int, addr net.Addr) {
-			log.Debugf("handle UDP query from %s", addr)
-			resp, _ := f.handleQuery(buf[:n], true)
-			if resp != nil {
-				_, err = conn.WriteTo(resp, addr)
-				if err != nil {
-					log.Warnf("failed to send packet: %v", err)
-				}
+		f.dispatchUDP(ctx, conn, buf, n, addr, oob, limits)
+	}
+}
+
+// Serve the UDP queries like serveUDP() but receive up to the batch size
+// (batch) packets per read.
+func (f *Forwarder) serveUDPBatch(ctx context.Context, conn *udpConn, batch int) {
+	limits := f.Limits.withDefaults()
+	msgs := make([]ipv4.Message, batch)
+	for i := range msgs {
+		msgs[i].OOB = conn.newControlMessage()
+	}
+	defer func() {
+		for i := range msgs {
+			if bufs := msgs[i].Buffers; bufs != nil {
+				//lint:ignore SA6002 using pointer adds no benefit here
+				f.udpPool.Put(bufs[0])
 			}
+		}
+	}()
 
-			//lint:ignore SA6002 using pointer adds no benefit here
-			f.udpPool.Put(buf)
-			f.wg.Done()
-		}(buf, n, addr)
+	for {
+		for i := range msgs {
+			if msgs[i].Buffers == nil {
+				msgs[i].Buffers = [][]byte{f.udpPool.Get().([]byte)}
+			}
+		}
+		count, err := conn.readBatch(msgs)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Infof("connection closed; stop UDP forwarder")
+				f.wg.Done()
+				return
+			}
+
+			log.Warnf("failed to read packets: %v", err)
+			continue
+		}
+
+		for i := range msgs[:count] {
+			m := &msgs[i]
+			addr, oob := conn.packet(m)
+			if m.N > limits.UDPQuery {
+				log.Debugf("dropped oversized UDP query from %s: length>%d",
+					addr, limits.UDPQuery)
+				continue // reuse the buffer
+			}
+			f.dispatchUDP(ctx, conn, m.Buffers[0], m.N, addr, oob, limits)
+			m.Buffers = nil
+		}
 	}
 }
 
+// Handle the UDP query in the buffer (buf[:n]) from the address (addr) in
+// a new goroutine, which replies with the control message (oob) and puts
+// the buffer back to the pool.
+func (f *Forwarder) dispatchUDP(ctx context.Context, conn *udpConn, buf []byte,
+	n int, addr netip.AddrPort, oob []byte, limits Limits) {
+	f.wg.Add(1)
+	go func() {
+		log.Debugf("handle UDP query from %s", addr)
+		resp, err := f.handleQuery(ctx, buf[:n], addr.Addr(), true)
+		if errors.Is(err, errJunkPacket) {
+			f.logJunkSource(addr.String())
+		}
+		if resp != nil {
+			resp = truncateUDP(buf[:n], resp, limits.UDPResponse)
+			if err := conn.write(resp, addr, oob); err != nil {
+				log.Warnf("failed to send packet: %v", err)
+			}
+		}
+
+		//lint:ignore SA6002 using pointer adds no benefit here
+		f.udpPool.Put(buf)
+		f.wg.Done()
+	}()
+}
+
 // Serve TCP and DoT connections.
 func (f *Forwarder) serveTCP(ctx context.Context, ln net.Listener) {
 	go func() {
@@ -340,9 +1033,7 @@ func (f *Forwarder) serveTCP(ctx context.Context, ln net.Listener) {
 }
 
 func (f *Forwarder) serveDoH(ctx context.Context, ln net.Listener) {
-	server := &http.Server{
-		Handler: http.HandlerFunc(f.handleDoH),
-	}
+	server := f.newDoHServer()
 
 	go func() {
 		// Wait for cancellation from Stop().
@@ -367,6 +1058,12 @@ func (f *Forwarder) handleDoH(w http.ResponseWriter, r *http.Request) {
 
 	log.Debugf("handle DoH query from %s, method=%s", r.RemoteAddr, r.Method)
 
+	if f.isDoHJSON(r) {
+		f.handleDoHJSON(w, r)
+		return
+	}
+
+	limits := f.Limits.withDefaults()
 	var query []byte
 	switch r.Method {
 	case http.MethodGet:
@@ -381,13 +1078,22 @@ func (f *Forwarder) handleDoH(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "400 bad request: dns invalid", http.StatusBadRequest)
 			return
 		}
+		if len(b) > limits.DoHQuery {
+			http.Error(w, "413 payload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		query = b
 	case http.MethodPost:
 		if r.Header.Get("Content-Type") != dohContentType {
 			http.Error(w, "400 bad request: content-type invalid", http.StatusBadRequest)
 			return
 		}
-		body, err := io.ReadAll(r.Body)
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(limits.DoHQuery)))
+		var mbErr *http.MaxBytesError
+		if errors.As(err, &mbErr) {
+			http.Error(w, "413 payload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		if err != nil || len(body) == 0 {
 			http.Error(w, "400 bad request: body", http.StatusBadRequest)
 			return
@@ -398,17 +1104,76 @@ func (f *Forwarder) handleDoH(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := f.handleQuery(query, false)
+	// Use the request context so that the upstream query is aborted once
+	// the client goes away.
+	client, _ := netip.ParseAddrPort(r.RemoteAddr)
+	resp, err := f.handleQuery(dohContext(r), query, client.Addr(), false)
+	if errors.Is(err, errJunkPacket) {
+		f.logJunkSource(r.RemoteAddr)
+	}
 	if resp == nil {
 		http.Error(w, "400 bad request: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	resp = limitResponse(query, resp, limits.DoHResponse)
 
 	w.Header().Set("Content-Type", dohContentType)
+	if len(resp) >= dohGzipMinSize {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			if body, err := gzipCompress(resp); err != nil {
+				log.Debugf("failed to compress DoH response: %v", err)
+			} else {
+				w.Header().Set("Content-Encoding", "gzip")
+				resp = body
+			}
+		}
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write(resp)
 }
 
+// Get the context of the DoH request (r), tagged with the server name (SNI)
+// if over TLS.
+func dohContext(r *http.Request) context.Context {
+	if r.TLS == nil {
+		return r.Context()
+	}
+	return withServerName(r.Context(), r.TLS.ServerName)
+}
+
+// Check whether the client of the request (r) accepts the gzip encoding,
+// i.e., not with "q=0".
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, token := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(token, ";")
+			if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !ok {
+				return true
+			}
+			qv, err := strconv.ParseFloat(q, 64)
+			return err == nil && qv > 0
+		}
+	}
+	return false
+}
+
+func gzipCompress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func (f *Forwarder) handleTCP(ctx context.Context, conn net.Conn) {
 	defer f.wg.Done()
 	defer conn.Close() // ensure exactly one close
@@ -417,6 +1182,11 @@ func (f *Forwarder) handleTCP(ctx context.Context, conn net.Conn) {
 	connCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	var client netip.Addr
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		client = addr.AddrPort().Addr()
+	}
+
 	go func() {
 		// Watch for parent context cancellation or this handler exiting.
 		<-connCtx.Done()
@@ -430,11 +1200,16 @@ func (f *Forwarder) handleTCP(ctx context.Context, conn net.Conn) {
 	}
 	log.Debugf("accepted %s connection from %s", proto, conn.RemoteAddr())
 
+	limits := f.Limits.withDefaults()
 	lbuf := make([]byte, 2)
+	queryCtx, named := connCtx, false // tagged with the server name (SNI)
+	// Wait for the next query up to the idle timeout, which is reset upon
+	// each query and also advertised to the clients asking for keepalive.
+	idleTimeout := f.tcpIdleTimeout()
 	for {
 		log.Debugf("handle %s query from %s", proto, conn.RemoteAddr())
 
-		conn.SetReadDeadline(time.Now().Add(tcpReadTimeout))
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
 		// Read query length.
 		if _, err := io.ReadFull(conn, lbuf); err != nil {
 			if errors.Is(err, io.EOF) {
@@ -447,19 +1222,46 @@ func (f *Forwarder) handleTCP(ctx context.Context, conn net.Conn) {
 			return
 		}
 		length := binary.BigEndian.Uint16(lbuf)
-		if length == 0 || length > maxQuerySize {
+		if length == 0 || int(length) > limits.TCPQuery {
 			log.Debugf("invalid length=%d", length)
 			return
 		}
-		// Read query content.
+		// Read query content, which is due soon once the length arrived.
+		conn.SetReadDeadline(time.Now().Add(tcpReadTimeout))
 		query := make([]byte, length)
 		if _, err := io.ReadFull(conn, query); err != nil {
 			log.Errorf("failed to read query content: %v", err)
 			return
 		}
 
-		resp, _ := f.handleQuery(query, false)
+		if tc, ok := conn.(*tls.Conn); ok && !named {
+			// The handshake is done by the first read.
+			queryCtx = withServerName(connCtx, tc.ConnectionState().ServerName)
+			named = true
+		}
+
+		query, keepalive := takeTCPKeepalive(query)
+		if msgs, ok := f.handleAXFR(query, client); ok {
+			if err := writeTCPMessages(conn, msgs); err != nil {
+				log.Warnf("failed to send AXFR: %v", err)
+				return
+			}
+			continue
+		}
+		resp, err := f.handleQuery(queryCtx, query, client, false)
+		if errors.Is(err, errJunkPacket) {
+			f.logJunkSource(conn.RemoteAddr().String())
+		}
+		if resp != nil && keepalive {
+			if r, err := addTCPKeepalive(resp, idleTimeout); err != nil {
+				log.Debugf("failed to add TCP keepalive: %v", err)
+			} else {
+				resp = r
+			}
+		}
 		if resp != nil {
+			resp = truncateTCP(query, resp)
+			resp = limitResponse(query, resp, limits.TCPResponse)
 			conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
 			// Prepend response length and send.
 			binary.BigEndian.PutUint16(lbuf, uint16(len(resp)))
@@ -472,56 +1274,704 @@ func (f *Forwarder) handleTCP(ctx context.Context, conn net.Conn) {
 	}
 }
 
-func (f *Forwarder) handleQuery(qmsg []byte, isUDP bool) ([]byte, error) {
-	if n := len(qmsg); n <= minQuerySize {
-		log.Debugf("junk packet: length=%d", n)
+// Handle the query (qmsg) from the client (client; may be invalid if unknown)
+// and return the response to reply.
+// The upstream query is bounded by queryTimeout or the deadline of the given
+// context (ctx) whichever is earlier, and is also aborted when the context is
+// canceled (e.g., the client disconnected or the forwarder stopped).
+func (f *Forwarder) handleQuery(ctx context.Context, qmsg []byte, client netip.Addr,
+	isUDP bool) (resp []byte, err error) {
+	dump := f.DumpMessages && requestIDFrom(ctx) == 0 // not for the nested calls
+	ctx, id := withRequestID(ctx)
+	if dump {
+		log.Debugf("%s: query from %s:\n%s", id, client, dnsmsg.RawMsg(qmsg).HexDump())
+		defer func() {
+			if resp != nil {
+				log.Debugf("%s: response:\n%s", id, dnsmsg.RawMsg(resp).HexDump())
+			}
+		}()
+	}
+	threshold := f.MinQuerySize
+	if threshold <= 0 {
+		threshold = minQuerySize
+	}
+	if n := len(qmsg); n <= threshold {
+		log.Debugf("%s: junk packet: length=%d", id, n)
 		// Unable to make a sensible reply; just drop it.
 		// Dropping also prevents from abusing for amplification attacks.
-		return nil, errors.New("junk packet")
-	} else if n > maxQuerySize {
+		f.junkDropped.Add(1)
+		return nil, errJunkPacket
+	} else if n > maxMessageSize {
 		return nil, errors.New("packet too large")
 	}
 
-	query, err := dnsmsg.NewQueryMsg(qmsg)
+	if f.RouteInfo {
+		if _, ok := dnsmsg.RawMsg(qmsg).Option(optionCodeRouteInfo); ok {
+			// Handle it without the option, which is not forwarded.
+			if q, err := removeOption(qmsg, optionCodeRouteInfo); err == nil {
+				resp, err := f.handleQuery(ctx, q, client, isUDP)
+				return f.addRouteInfo(ctx, q, resp), err
+			}
+		}
+	}
+
+	header, question, err := dnsmsg.RawMsg(qmsg).Question()
 	if err != nil {
-		log.Debugf("invalid query packet: %v", err)
+		if resp, rcode, ok := answerNoQuestion(qmsg); ok {
+			log.Debugf("%s: query without question: answered %s", id, rcode)
+			if rcode != dnsmessage.RCodeSuccess {
+				return resp, errNoQuestion
+			}
+			return resp, nil
+		}
+		log.Debugf("%s: invalid query packet: %v", id, err)
 		return nil, errors.New("invalid query")
 	}
 
-	// Make a fallback reply with RCode=ServFail.
-	rquery := dnsmsg.RawMsg(qmsg)
-	rquery.SetRCode(dnsmessage.RCodeServerFailure)
-	rresp := []byte(rquery)
+	if opcode := header.OpCode; opcode != opCodeQuery {
+		// Don't forward UPDATE/NOTIFY/etc. messages to the upstreams.
+		log.Debugf("%s: unsupported opcode=%d, header: %+v", id, opcode, header)
+		return newErrorResponse(qmsg, dnsmessage.RCodeNotImplemented,
+			&ExtendedError{
+				InfoCode:  ExtendedErrorNotSupported,
+				ExtraText: "opcode not implemented",
+			}), errors.New("opcode not implemented")
+	}
+
+	if resp, ok := f.answerZone(qmsg, &question); ok {
+		log.Debugf("%s: answered from zone: %s %s", id, question.Name, question.Type)
+		return resp, nil
+	}
 
-	qname := query.QName()
-	resolver, _ := f.Router.GetResolver(qname)
+	qname := question.Name.String()
+	if zone, ok := f.Router.blocklisted(qname); ok {
+		log.Debugf("%s: blocked by blocklist [%s]: %s %s", id, zone, qname, question.Type)
+		return f.newBlockedResponse(qmsg, zone,
+			&ExtendedError{
+				InfoCode:  ExtendedErrorBlocked,
+				ExtraText: "blocklist",
+			}), errBlocklist
+	}
+	// Pin the resolver so that a concurrent reload closes it only after
+	// this query is done.
+	resolver, index, release := f.Router.PinResolver(qname, serverNameFrom(ctx))
+	defer release()
+	if zone, text, ok := f.Router.blocked(index, qname); ok {
+		log.Debugf("%s: blocked by route [%d]: %s %s", id, index, qname, question.Type)
+		return f.newBlockedResponse(qmsg, zone,
+			&ExtendedError{
+				InfoCode:  ExtendedErrorBlocked,
+				ExtraText: text,
+			}), errBlocked
+	}
+	if f.Router.dropped(index) {
+		log.Debugf("%s: dropped by route [%d]: %s %s", id, index, qname, question.Type)
+		if isUDP {
+			return nil, errDropped
+		}
+		// No way to keep silent over TCP/DoT/DoH but holding the
+		// connection, so answer a minimal NXDOMAIN.
+		return newErrorResponse(qmsg, dnsmessage.RCodeNameError, nil), errDropped
+	}
+	if index < 0 {
+		// Not routed explicitly; check the locally served zones before
+		// leaking it to the default upstream.
+		if resp, ok := f.answerLocal(qmsg, &question); ok {
+			log.Debugf("%s: answered locally: %s %s", id, qname, question.Type)
+			return resp, nil
+		}
+		if f.DefaultAction == DefaultActionRefuse {
+			log.Debugf("%s: not routed: %s %s; refused", id, qname, question.Type)
+			return newErrorResponse(qmsg, dnsmessage.RCodeRefused,
+				&ExtendedError{
+					InfoCode:  ExtendedErrorProhibited,
+					ExtraText: "not in the allowed zones",
+				}), errRefused
+		}
+	}
 	if resolver == nil {
-		log.Debugf("no resolver found for qname [%s]", qname)
-		return rresp, errors.New("resolver not found")
+		f.noticeNoResolver(qname, question.Type)
+		rcode := f.NoResolverRCode
+		if rcode == dnsmessage.RCodeSuccess {
+			rcode = dnsmessage.RCodeServerFailure
+		}
+		return newErrorResponse(qmsg, rcode,
+			&ExtendedError{
+				InfoCode:  ExtendedErrorNoReachableAuthority,
+				ExtraText: "no upstream configured",
+			}), errors.New("resolver not found")
 	}
 
-	myIP := config.GetMyIP()
-	addr, ok := myIP.GetV4()
-	if query.QType() == dnsmessage.TypeAAAA {
-		addr, ok = myIP.GetV6()
+	if f.DetectLoop && f.isLooped(qmsg) {
+		log.Warnf("%s: forwarding loop detected: %s %s from %s; refused",
+			id, qname, question.Type, client)
+		return newErrorResponse(qmsg, dnsmessage.RCodeRefused,
+			&ExtendedError{
+				InfoCode:  ExtendedErrorOther,
+				ExtraText: "forwarding loop detected",
+			}), errLoop
 	}
-	if ok {
-		query.SetEdnsSubnet(addr, 0)
+
+	var msg []byte
+	if rewriters := f.queryRewriters(id, qmsg, question.Type, client, index); len(rewriters) > 0 {
+		query, err := dnsmsg.NewQueryMsg(qmsg)
+		if err != nil {
+			log.Debugf("%s: invalid query packet: %v", id, err)
+			return nil, errors.New("invalid query")
+		}
+		for _, rw := range rewriters {
+			if err := rw.Rewrite(query); err != nil {
+				log.Warnf("%s: failed to rewrite query by %T: %v", id, rw, err)
+				return newErrorResponse(qmsg, dnsmessage.RCodeServerFailure,
+					&ExtendedError{
+						InfoCode:  ExtendedErrorOther,
+						ExtraText: "failed to rewrite query",
+					}), err
+			}
+		}
+		log.Debugf("%s: query: %+v", id, query)
+
+		msg, err = query.Build()
+		if err != nil {
+			log.Errorf("%s: failed to build query: %v", id, err)
+			return newErrorResponse(qmsg, dnsmessage.RCodeServerFailure,
+				&ExtendedError{
+					InfoCode:  ExtendedErrorOther,
+					ExtraText: "failed to build query",
+				}), err
+		}
+	} else {
+		// Fast path: nothing to transform, so forward the query as is.
+		// NOTE: Copy it because the resolver may modify (e.g., query ID)
+		// or even retain it after return (e.g., queued UDP query).
+		log.Debugf("%s: query: %+v, %+v", id, header, question)
+		msg = slices.Clone(qmsg)
 	}
-	log.Debugf("query: %+v", query)
 
-	msg, err := query.Build()
-	if err != nil {
-		log.Errorf("failed to build query: %v", err)
-		return rresp, err
+	if f.DetectLoop {
+		m, err := dnsmsg.RawMsg(msg).AppendOption(optionCodeLoopNonce, loopNonce)
+		if err != nil {
+			log.Debugf("%s: failed to add loop nonce: %v", id, err)
+			return nil, errors.New("invalid query")
+		}
+		msg = m
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	view := f.Router.view(index, serverNameFrom(ctx))
+	var key string
+	if f.Cache != nil {
+		key = f.cacheKey(msg, view)
+	}
+	if key != "" {
+		if resp, ok := f.cachedResponse(key, &header, &question); ok {
+			log.Debugf("%s: answered from cache: %s", id, key)
+			f.metrics.observe(index, resp)
+			return resp, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
 	defer cancel()
-	resp, err := resolver.Query(ctx, msg, isUDP)
+	resp, shared, err := f.flights.do(ctx, msg, view, isUDP,
+		func(ctx context.Context) ([]byte, error) {
+			resp, meta, err := queryWithMeta(ctx, resolver, msg, isUDP)
+			if err == nil {
+				f.metrics.observeECSScope(resp)
+				log.Debugf("%s: answered by [%s] over %s in %v (retried: %v): %s %s",
+					id, meta.Resolver, meta.Transport, meta.Latency.Round(time.Microsecond),
+					meta.Retried, question.Name, question.Type)
+			}
+			return resp, err
+		})
+	f.metrics.observeUpstream(index, shared)
 	if err != nil {
-		return rresp, err
+		if key != "" {
+			if resp, ok := f.staleResponse(key, &header, &question); ok {
+				log.Infof("%s: upstream failed (%v); served stale: %s", id, err, key)
+				f.metrics.observe(index, resp)
+				return resp, nil
+			}
+		}
+		return newUpstreamErrorResponse(qmsg, err), err
+	}
+
+	if f.FormErrRetry && isFormErr(resp) {
+		resp = f.retryPlain(ctx, resolver, msg, resp, isUDP)
+	}
+	if f.RequestNSID {
+		if nsid, ok := dnsmsg.RawMsg(resp).NSID(); ok {
+			log.Debugf("%s: answered by NSID %x (%q): %s %s",
+				id, nsid, nsid, question.Name, question.Type)
+		}
+	}
+
+	if question.Type == dnsmessage.TypeAAAA && f.DNS64Prefix.IsValid() &&
+		!header.CheckingDisabled && ClassifyResponse(resp) == ResponseNoData {
+		// NOTE: Cache the synthesized response instead of the NODATA one.
+		resp = f.dns64(ctx, resolver, msg, resp, isUDP)
+	}
+	resp = normalizeRelayedFlags(resp, f.ClearRelayedAA)
+
+	for _, rw := range f.responseRewriters(id, &question) {
+		if rresp, err := rw.Rewrite(qmsg, resp); err != nil {
+			log.Warnf("%s: failed to rewrite response by %T: %v", id, rw, err)
+		} else {
+			resp = rresp
+		}
+	}
+
+	if f.Cache != nil {
+		if key := f.cacheStoreKey(msg, resp, view); key != "" {
+			f.cacheResponse(key, resp, f.Router.cacheTTL(index))
+		}
 	}
+	f.metrics.observe(index, resp)
 
+	// NOTE: Except the rewrites (e.g., the stripped and overridden answers),
+	// the response is relayed as is, so any EDNS options (e.g., EDE) from
+	// the upstream are preserved.
 	return resp, nil
 }
+
+// Add the routing information of the query (qmsg) to the response (resp),
+// which is returned as is upon failure or without OPT record.
+// The context (ctx) tells the server name that the query is routed via.
+func (f *Forwarder) addRouteInfo(ctx context.Context, qmsg, resp []byte) []byte {
+	if resp == nil {
+		return nil
+	}
+	_, question, err := dnsmsg.RawMsg(qmsg).Question()
+	if err != nil {
+		return resp
+	}
+	m := f.Router.Explain(question.Name.String(), question.Type, serverNameFrom(ctx))
+	ri := &RouteInfo{Index: m.Index, Route: m.Route}
+	if re := m.Resolver; re != nil {
+		ri.Resolver = re.Name
+		if ri.Resolver == "" {
+			ri.Resolver = re.Address
+		}
+	}
+	r, err := addOption(resp, routeInfoOption(ri))
+	if err != nil {
+		log.Debugf("failed to add route info: %v", err)
+		return resp
+	}
+	return r
+}
+
+// Query the A records with the forwarded AAAA query (msg) and synthesize
+// the AAAA response from them (DNS64); return the original NODATA response
+// (resp) if failed or no A records.
+// NOTE: The validating clients (i.e., with the CD bit) are skipped, which
+// would reject the synthesized records (RFC 6147, Section 5.5).
+func (f *Forwarder) dns64(ctx context.Context, resolver Resolver, msg, resp []byte,
+	isUDP bool) []byte {
+	query, err := dnsmsg.NewQueryMsg(msg)
+	if err != nil {
+		return resp
+	}
+	query.Question.Type = dnsmessage.TypeA
+	amsg, err := query.Build()
+	if err != nil {
+		log.Debugf("%s: failed to build DNS64 A query: %v", requestIDFrom(ctx), err)
+		return resp
+	}
+	aResp, err := resolver.Query(ctx, amsg, isUDP)
+	if err != nil {
+		log.Debugf("%s: DNS64 A query failed: %v", requestIDFrom(ctx), err)
+		return resp
+	}
+	sresp, ok := synthesizeDNS64(resp, aResp, f.DNS64Prefix)
+	if !ok {
+		return resp
+	}
+	log.Debugf("%s: DNS64 synthesized: %s", requestIDFrom(ctx), query.Question.Name)
+	return sresp
+}
+
+// Whether the response (resp) is FORMERR.
+// NOTE: The question section may be absent from the FORMERR responses.
+func isFormErr(resp []byte) bool {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	return err == nil && h.RCode == dnsmessage.RCodeFormatError
+}
+
+// Query again with the forwarded query (msg) stripped of EDNS after the
+// upstream answered FORMERR (resp), as suggested by RFC 6891, Section 7;
+// return the FORMERR response if the query has no EDNS or the retry failed.
+// NOTE: The downgraded query loses the ECS, DNSSEC OK bit and loop nonce.
+func (f *Forwarder) retryPlain(ctx context.Context, resolver Resolver, msg, resp []byte,
+	isUDP bool) []byte {
+	query, err := dnsmsg.NewQueryMsg(msg)
+	if err != nil || query.OPT.Header == nil {
+		return resp
+	}
+	query.OPT.Header = nil
+	query.OPT.Options = nil
+	pmsg, err := query.Build()
+	if err != nil {
+		log.Debugf("%s: failed to build plain query: %v", requestIDFrom(ctx), err)
+		return resp
+	}
+	presp, err := resolver.Query(ctx, pmsg, isUDP)
+	if err != nil {
+		log.Debugf("%s: plain query failed: %v", requestIDFrom(ctx), err)
+		return resp
+	}
+	log.Infof("[%s] %s: FORMERR upon EDNS; downgraded to plain query: %s %s",
+		resolver.Export().Name, requestIDFrom(ctx), query.Question.Name, query.Question.Type)
+	return presp
+}
+
+// Check whether the query (qmsg) carries our own loop nonce, i.e., it has
+// been forwarded by us before.
+// NOTE: Other forwarders in the chain may add their own nonces.
+func (f *Forwarder) isLooped(qmsg []byte) bool {
+	for _, data := range dnsmsg.RawMsg(qmsg).Options(optionCodeLoopNonce) {
+		if bytes.Equal(data, loopNonce) {
+			return true
+		}
+	}
+	return false
+}
+
+// Truncate the UDP response (resp) if it exceeds the max payload size
+// advertised by the client in its query (qmsg) or the limit (maxSize),
+// whichever is smaller, so that the client would retry over TCP instead of
+// receiving an oversized datagram that may be fragmented or dropped.
+func truncateUDP(qmsg, resp []byte, maxSize int) []byte {
+	if len(resp) <= minUDPSize {
+		return resp // fast path: always fits
+	}
+	size := min(dnsmsg.RawMsg(qmsg).UDPSize(), maxSize)
+	if len(resp) <= size {
+		return resp
+	}
+
+	log.Debugf("truncate response: length=%d, client UDP size=%d", len(resp), size)
+	tresp, err := dnsmsg.RawMsg(resp).Truncate()
+	if err != nil {
+		log.Warnf("failed to truncate response: %v", err)
+		return newErrorResponse(qmsg, dnsmessage.RCodeServerFailure, nil)
+	}
+	return tresp
+}
+
+// Truncate the TCP response (resp) exceeding the max message size, which
+// the 2-byte length prefix cannot tell (RFC 1035, Section 4.2.2), to a
+// minimal one with the TC bit set, rather than sending a corrupt length.
+func truncateTCP(qmsg, resp []byte) []byte {
+	if len(resp) <= maxMessageSize {
+		return resp
+	}
+
+	log.Warnf("response too large for TCP: length=%d; truncated", len(resp))
+	tresp, err := dnsmsg.RawMsg(resp).Truncate()
+	if err != nil || len(tresp) > maxMessageSize {
+		log.Warnf("failed to truncate response: %v", err)
+		return newErrorResponse(qmsg, dnsmessage.RCodeServerFailure, nil)
+	}
+	return tresp
+}
+
+// Log the source address (addr) of a dropped junk packet if enabled.
+func (f *Forwarder) logJunkSource(addr string) {
+	if f.LogJunkSource {
+		log.Debugf("dropped junk packet from %s", addr)
+	}
+}
+
+// Set the action for the queries not matching any route; empty to use the
+// default.
+func (f *Forwarder) SetDefaultAction(action string) error {
+	switch a := DefaultAction(action); a {
+	case "":
+		f.DefaultAction = DefaultActionForward
+	case DefaultActionForward, DefaultActionRefuse:
+		f.DefaultAction = a
+	default:
+		return fmt.Errorf("invalid default action: %s", action)
+	}
+	return nil
+}
+
+// Log the queries failed for no resolver at the notice level to make the
+// misconfiguration visible, but at most once per noResolverNoticeInterval.
+func (f *Forwarder) noticeNoResolver(qname string, qtype dnsmessage.Type) {
+	now := time.Now().UnixNano()
+	t := f.noResolverLast.Load()
+	if now-t >= int64(noResolverNoticeInterval) && f.noResolverLast.CompareAndSwap(t, now) {
+		log.Noticef("no resolver found for query [%s %s]; "+
+			"is the default resolver configured?", qname, qtype)
+	} else {
+		log.Debugf("no resolver found for query [%s %s]", qname, qtype)
+	}
+}
+
+// Set the response code for the queries without a resolver: "servfail"
+// (default) or "refused".
+func (f *Forwarder) SetNoResolverRCode(rcode string) error {
+	switch rcode {
+	case "", "servfail":
+		f.NoResolverRCode = dnsmessage.RCodeServerFailure
+	case "refused":
+		f.NoResolverRCode = dnsmessage.RCodeRefused
+	default:
+		return fmt.Errorf("invalid no-resolver rcode: %s", rcode)
+	}
+	return nil
+}
+
+// Enable/disable DNS64 with the NAT64 prefix (prefix), which defaults to
+// the well-known one (64:ff9b::/96) if empty.
+func (f *Forwarder) SetDNS64(enable bool, prefix string) error {
+	if !enable {
+		f.DNS64Prefix = netip.Prefix{}
+		return nil
+	}
+	p := DNS64WellKnownPrefix
+	if prefix != "" {
+		var err error
+		if p, err = netip.ParsePrefix(prefix); err != nil {
+			return fmt.Errorf("invalid NAT64 prefix: %w", err)
+		}
+		if err := validateDNS64Prefix(p); err != nil {
+			return err
+		}
+	}
+	f.DNS64Prefix = p
+	return nil
+}
+
+// Set the record types (e.g., "HTTPS" or "TYPE65") to strip from the
+// answers; CNAME is not allowed, which would break the alias chains.
+func (f *Forwarder) SetStripTypes(types []string) error {
+	stypes := make([]dnsmessage.Type, 0, len(types))
+	for _, s := range types {
+		t, err := dnsmsg.ParseType(s)
+		if err != nil {
+			return fmt.Errorf("invalid strip type: %w", err)
+		}
+		switch t {
+		case dnsmessage.TypeCNAME, dnsmessage.TypeOPT:
+			return fmt.Errorf("invalid strip type: %s", s)
+		}
+		if !slices.Contains(stypes, t) {
+			stypes = append(stypes, t)
+		}
+	}
+	f.StripTypes = stypes
+	return nil
+}
+
+// Set the max ECS source prefix lengths for IPv4 (v4) and IPv6 (v6) sent to
+// the upstreams; 0 to use the defaults (/24 and /56).
+func (f *Forwarder) SetECSPrefix(v4, v6 int) error {
+	if v4 < 0 || v4 > 32 {
+		return fmt.Errorf("invalid ECS IPv4 prefix length: %d", v4)
+	}
+	if v6 < 0 || v6 > 128 {
+		return fmt.Errorf("invalid ECS IPv6 prefix length: %d", v6)
+	}
+	f.ECSPrefixV4, f.ECSPrefixV6 = v4, v6
+	return nil
+}
+
+// Get the effective max ECS source prefix lengths for IPv4 and IPv6.
+func (f *Forwarder) ecsPrefix() (v4, v6 int) {
+	v4, v6 = f.ECSPrefixV4, f.ECSPrefixV6
+	if v4 <= 0 {
+		v4 = ecsPrefixV4
+	}
+	if v6 <= 0 {
+		v6 = ecsPrefixV6
+	}
+	return v4, v6
+}
+
+// Set the static ECS subnets for IPv4 (v4) and IPv6 (v6), e.g.,
+// "203.0.113.0/24", which are used instead of my IPs; empty to unset.
+func (f *Forwarder) SetECSSubnet(v4, v6 string) error {
+	p4, err := parseECSSubnet(v4, false)
+	if err != nil {
+		return err
+	}
+	p6, err := parseECSSubnet(v6, true)
+	if err != nil {
+		return err
+	}
+	f.ECSSubnetV4, f.ECSSubnetV6 = p4, p6
+	return nil
+}
+
+// Parse the static ECS subnet (s) of IPv4 or IPv6 (isIPv6), which must be
+// a public network; return the invalid prefix if empty.
+func parseECSSubnet(s string, isIPv6 bool) (netip.Prefix, error) {
+	if s == "" {
+		return netip.Prefix{}, nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid ECS subnet [%s]: %w", s, err)
+	}
+	if addr := p.Addr(); addr.Is6() != isIPv6 || addr.Is4In6() {
+		return netip.Prefix{}, fmt.Errorf("invalid ECS subnet [%s]: address family mismatch", s)
+	}
+	p = p.Masked()
+	if addr := p.Addr(); p.Bits() == 0 || addr.IsUnspecified() || addr.IsLoopback() ||
+		addr.IsPrivate() || addr.IsMulticast() || addr.IsLinkLocalUnicast() {
+		return netip.Prefix{}, fmt.Errorf("invalid ECS subnet [%s]: not public", s)
+	}
+	return p, nil
+}
+
+// Check whether the query (qmsg) carries an ECS option (e.g., set by the
+// client) that is more precise than allowed.
+func (f *Forwarder) ecsTooPrecise(qmsg []byte) bool {
+	prefix, ok := dnsmsg.RawMsg(qmsg).EdnsSubnet()
+	if !ok {
+		return false
+	}
+	v4, v6 := f.ecsPrefix()
+	if prefix.Addr().Is4() {
+		return prefix.Bits() > v4
+	}
+	return prefix.Bits() > v6
+}
+
+// Get my public IPs for ECS, i.e., the global ones unless set.
+func (f *Forwarder) getMyIP() *config.MyIP {
+	if f.myIP != nil {
+		return f.myIP
+	}
+	return config.GetMyIP()
+}
+
+// Get the EDNS client subnet for the query type (qtype) from the client
+// (client) routed to the index (index) route, which is the static subnet of
+// the route or the forwarder if set, otherwise my IP, with the prefix length
+// limited by ecsPrefix().
+// Prefer the address family of the client if known and available, because
+// e.g., a v6-only client would connect to the v6 address of any answer,
+// even for an A query; otherwise, fall back to guess by the query type.
+// NOTE: A loopback client is treated as unknown, since its address family
+// tells nothing about the host's connectivity.
+func (f *Forwarder) ecsSubnet(qtype dnsmessage.Type, client netip.Addr,
+	index int) (netip.Prefix, bool) {
+	myIP := f.getMyIP()
+	static4, static6 := f.Router.ecsSubnet(index)
+	if !static4.IsValid() {
+		static4 = f.ECSSubnetV4
+	}
+	if !static6.IsValid() {
+		static6 = f.ECSSubnetV6
+	}
+	limit4, limit6 := f.ecsPrefix()
+
+	get := func(isIPv6 bool) (netip.Prefix, bool) {
+		static, limit, getIP := static4, limit4, myIP.GetV4
+		if isIPv6 {
+			static, limit, getIP = static6, limit6, myIP.GetV6
+		}
+		if static.IsValid() {
+			return netip.PrefixFrom(static.Addr(), min(static.Bits(), limit)), true
+		}
+		if addr, ok := getIP(); ok {
+			return netip.PrefixFrom(addr, limit), true
+		}
+		return netip.Prefix{}, false
+	}
+
+	if client.IsValid() && !client.IsLoopback() {
+		if p, ok := get(!client.Unmap().Is4()); ok {
+			return p, true
+		}
+	}
+	return get(qtype == dnsmessage.TypeAAAA)
+}
+
+// Make the response to the query (qmsg) upon the upstream failure (err) by
+// its class: SERVFAIL with the EDE telling the timeout, the dial failure, or
+// other network error; or REFUSED relayed from the upstream.
+func newUpstreamErrorResponse(qmsg []byte, err error) []byte {
+	// NOTE: The error may come from the context of a shared query waiter,
+	// which hasn't been classified by the resolver.
+	err = classifyQueryError(err)
+	rcode := dnsmessage.RCodeServerFailure
+	ede := &ExtendedError{
+		InfoCode:  ExtendedErrorNetworkError,
+		ExtraText: "upstream query failed",
+	}
+	switch {
+	case errors.Is(err, ErrUpstreamTimeout):
+		ede.InfoCode = ExtendedErrorNoReachableAuthority
+		ede.ExtraText = "upstream query timed out"
+	case errors.Is(err, ErrUpstreamRefused):
+		rcode = dnsmessage.RCodeRefused
+		ede.InfoCode = ExtendedErrorProhibited
+		ede.ExtraText = "upstream refused the query"
+	case errors.Is(err, ErrResolverNotReady):
+		ede.InfoCode = ExtendedErrorNotReady
+		ede.ExtraText = "upstream not ready"
+	}
+	return newErrorResponse(qmsg, rcode, ede)
+}
+
+// Make a response with the given RCode (rcode) for the query (qmsg), leaving
+// the query itself untouched. The response has only the question and the OPT
+// record (if the query has one), so that the clients accept it as valid.
+// The Extended DNS Error (ede) is added if given and the client supports EDNS.
+func newErrorResponse(qmsg []byte, rcode dnsmessage.RCode, ede *ExtendedError) []byte {
+	return newNegativeResponse(qmsg, rcode, nil, ede)
+}
+
+// Make the NXDOMAIN response of the query (qmsg) blocked by the zone (zone)
+// with the EDE (ede), and the synthesized SOA of the zone so that the
+// clients cache it for the synthesized TTL (RFC 2308, Section 5).
+func (f *Forwarder) newBlockedResponse(qmsg []byte, zone string, ede *ExtendedError) []byte {
+	zone = strings.TrimSuffix(trimZonePrefix(zone), ".")
+	if _, err := dnsmessage.NewName(zone + "."); err != nil || zone == "" {
+		return newErrorResponse(qmsg, dnsmessage.RCodeNameError, ede)
+	}
+	soa := newLocalSOA(zone, f.synthTTL())
+	return newNegativeResponse(qmsg, dnsmessage.RCodeNameError,
+		[]dnsmessage.Resource{soa}, ede)
+}
+
+// Make the negative response of the query (qmsg) with the authority records
+// (authorities), e.g., the SOA for the negative caching, and the EDE (ede).
+func newNegativeResponse(qmsg []byte, rcode dnsmessage.RCode,
+	authorities []dnsmessage.Resource, ede *ExtendedError) []byte {
+	query, err := dnsmsg.NewQueryMsg(qmsg)
+	if err != nil {
+		// E.g., malformed additional records; answer without EDNS.
+		header, question, qerr := dnsmsg.RawMsg(qmsg).Question()
+		if qerr != nil {
+			log.Debugf("invalid query packet: %v", qerr)
+			return newRawErrorResponse(qmsg, rcode)
+		}
+		query = &dnsmsg.QueryMsg{Header: header, Question: question}
+	}
+
+	var options []dnsmessage.Option
+	if ede != nil {
+		options = append(options, extendedErrorOption(ede))
+	}
+	resp, err := buildResponse(query, rcode, false, nil, authorities, options)
+	if err != nil {
+		log.Debugf("failed to build error response: %v", err)
+		return newRawErrorResponse(qmsg, rcode)
+	}
+	return resp
+}
+
+// Make the error response by patching the raw query (qmsg), as the last
+// resort if it cannot be parsed.
+func newRawErrorResponse(qmsg []byte, rcode dnsmessage.RCode) []byte {
+	resp := dnsmsg.RawMsg(slices.Clone(qmsg)).ZeroCounts()
+	resp.SetFlags(dnsmsg.FlagRA, dnsmsg.FlagAA|dnsmsg.FlagTC|dnsmsg.FlagAD)
+	resp.SetRCode(rcode)
+	return resp
+}
@@ -0,0 +1,732 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Forwarder end-to-end - tests
+//
+
+package dns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+	"kexuedns/util/dnsmsg"
+	"kexuedns/util/leaktest"
+)
+
+// A tiny upstream DNS server over UDP and TCP on the same port, which
+// answers any A query with a fixed address and records the queries.
+type testUpstream struct {
+	address netip.AddrPort
+	answer  [4]byte
+
+	lock    sync.Mutex
+	queries map[string][]byte // the last query (raw) of each name
+	tcp     int               // number of queries over TCP
+}
+
+func newTestUpstream(t *testing.T, answer [4]byte) *testUpstream {
+	t.Helper()
+	conn, ln := listenUDPTCP(t)
+	u := &testUpstream{
+		address: conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		answer:  answer,
+		queries: make(map[string][]byte),
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		ln.Close()
+	})
+
+	go func() {
+		buf := make([]byte, defaultUDPQuerySize)
+		for {
+			n, addr, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			if resp := u.reply(buf[:n], false); resp != nil {
+				conn.WriteToUDPAddrPort(resp, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					msg, err := readTCPMsg(c)
+					if err != nil {
+						return
+					}
+					if resp := u.reply(msg, true); resp != nil {
+						writeTCPMsg(c, resp)
+					}
+				}
+			}()
+		}
+	}()
+
+	return u
+}
+
+func (u *testUpstream) reply(query []byte, isTCP bool) []byte {
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(query); err != nil || len(dmsg.Questions) != 1 {
+		return nil
+	}
+	q := dmsg.Questions[0]
+
+	u.lock.Lock()
+	u.queries[q.Name.String()] = append([]byte{}, query...)
+	if isTCP {
+		u.tcp++
+	}
+	u.lock.Unlock()
+
+	dmsg.Header.Response = true
+	dmsg.Header.RecursionAvailable = true
+	if q.Type == dnsmessage.TypeA {
+		dmsg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{
+				Name: q.Name, Type: q.Type, Class: q.Class, TTL: 300,
+			},
+			Body: &dnsmessage.AResource{A: u.answer},
+		}}
+	}
+	resp, err := dmsg.Pack() // the OPT record (with ECS) is echoed back
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// Get the last query of the name and the number of TCP queries.
+func (u *testUpstream) query(name string) ([]byte, int) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.queries[name], u.tcp
+}
+
+// Listen UDP and TCP on the same free port of the loopback address.
+func listenUDPTCP(t *testing.T) (*net.UDPConn, net.Listener) {
+	t.Helper()
+	conn, ln, err := listenUDPTCPAt(net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return conn, ln
+}
+
+func listenUDPTCPAt(ip net.IP) (*net.UDPConn, net.Listener, error) {
+	for i := 0; i < 10; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to listen UDP: %v", err)
+		}
+		ln, err := net.Listen("tcp", conn.LocalAddr().String())
+		if err != nil {
+			conn.Close()
+			continue // port taken by TCP; try another one
+		}
+		return conn, ln, nil
+	}
+	return nil, nil, errors.New("failed to find a free port for both UDP and TCP")
+}
+
+func readTCPMsg(r io.Reader) ([]byte, error) {
+	var lbuf [2]byte
+	if _, err := io.ReadFull(r, lbuf[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(lbuf[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMsg(w io.Writer, msg []byte) error {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// Send the query to the forwarder over UDP or TCP and return the response.
+func exchange(t *testing.T, network string, address netip.AddrPort, query []byte) []byte {
+	t.Helper()
+	conn, err := net.DialTimeout(network, address.String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial %s %s: %v", network, address, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if network == "tcp" {
+		if err := writeTCPMsg(conn, query); err != nil {
+			t.Fatalf("failed to send query: %v", err)
+		}
+		resp, err := readTCPMsg(conn)
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		return resp
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		t.Fatalf("failed to send query: %v", err)
+	}
+	buf := make([]byte, defaultUDPQuerySize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return buf[:n]
+}
+
+// Create the forwarder with the default resolver over UDP and a route of
+// zone "tcp.example" over TCP to the upstream, and 1.2.3.4 as my IP for ECS.
+func newTestForwarderE2E(t *testing.T, upstream *testUpstream) *Forwarder {
+	t.Helper()
+	router, err := NewRouterFromExport(&RouterExport{
+		Resolver: &ResolverExport{
+			Name:     "default",
+			Protocol: ResolverProtocolUDP,
+			Address:  upstream.address.String(),
+		},
+		Routes: []*RouteExport{{
+			Index: 0,
+			Name:  "tcp",
+			Resolver: &ResolverExport{
+				Name:     "tcp",
+				Protocol: ResolverProtocolTCP,
+				Address:  upstream.address.String(),
+			},
+			Zones: []string{"tcp.example"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf(`NewRouterFromExport() = %v; want nil`, err)
+	}
+
+	myIP := &config.MyIP{}
+	if err := myIP.SetV4("1.2.3.4"); err != nil {
+		t.Fatalf(`SetV4() = %v; want nil`, err)
+	}
+	f := &Forwarder{myIP: myIP}
+	// NOTE: The router can't be copied for its lock.
+	f.Router.resolver = router.resolver
+	f.Router.routes = router.routes
+	return f
+}
+
+// Check the response (resp) to the query (query) of the name (name) has
+// the upstream answer, and the upstream got the query with our ECS.
+func checkE2EResponse(t *testing.T, upstream *testUpstream, name string, query, resp []byte) {
+	t.Helper()
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil {
+		t.Fatalf("failed to unpack response: %v", err)
+	}
+	if h := dmsg.Header; !h.Response || h.RCode != dnsmessage.RCodeSuccess ||
+		h.ID != binary.BigEndian.Uint16(query) {
+		t.Errorf(`response header = %+v; want NOERROR of the query`, h)
+	}
+	if len(dmsg.Answers) != 1 {
+		t.Fatalf(`response answers = %v; want 1 A record`, dmsg.Answers)
+	}
+	if a, ok := dmsg.Answers[0].Body.(*dnsmessage.AResource); !ok ||
+		a.A != upstream.answer || dmsg.Answers[0].Header.Name.String() != name {
+		t.Errorf(`response answer = %v; want %s A %v`, dmsg.Answers[0], name, upstream.answer)
+	}
+
+	uquery, _ := upstream.query(name)
+	if uquery == nil {
+		t.Fatalf(`upstream got no query of %s`, name)
+	}
+	if prefix, ok := dnsmsg.RawMsg(uquery).EdnsSubnet(); !ok ||
+		prefix.String() != "1.2.3.0/24" {
+		t.Errorf(`upstream ECS = (%v, %v); want 1.2.3.0/24`, prefix, ok)
+	}
+}
+
+func TestForwarderEndToEnd(t *testing.T) {
+	upstream := newTestUpstream(t, [4]byte{192, 0, 2, 53})
+	f := newTestForwarderE2E(t, upstream)
+
+	// Listen on a free port for both UDP and TCP.
+	conn, ln := listenUDPTCP(t)
+	address := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	conn.Close()
+	ln.Close()
+	if err := f.SetListen(address.String()); err != nil {
+		t.Fatalf(`SetListen() = %v; want nil`, err)
+	}
+	if err := f.Start(""); err != nil {
+		t.Fatalf(`Start() = %v; want nil`, err)
+	}
+	defer f.Stop()
+
+	tests := []struct {
+		network string // to the forwarder
+		name    string
+		tcp     bool // whether forwarded over TCP
+	}{
+		{"udp", "www.example.com.", false},
+		{"tcp", "tcp.example.com.", false},
+		{"udp", "www.tcp.example.", true},
+		{"tcp", "ns.tcp.example.", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.network+"-"+tc.name, func(t *testing.T) {
+			_, ntcp := upstream.query(tc.name)
+			query := newTestQueryEDNS(t, tc.name, dnsmessage.TypeA)
+			resp := exchange(t, tc.network, address, query)
+			checkE2EResponse(t, upstream, tc.name, query, resp)
+			if _, utcp := upstream.query(tc.name); tc.tcp != (utcp > ntcp) {
+				t.Errorf(`forwarded over TCP = %v; want %v`, utcp > ntcp, tc.tcp)
+			}
+		})
+	}
+}
+
+func TestForwarderLeak(t *testing.T) {
+	upstream := newTestUpstream(t, [4]byte{192, 0, 2, 53})
+	defer leaktest.Check(t)()
+	f := newTestForwarderE2E(t, upstream)
+
+	conn, ln := listenUDPTCP(t)
+	address := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	conn.Close()
+	ln.Close()
+	if err := f.SetListen(address.String()); err != nil {
+		t.Fatalf(`SetListen() = %v; want nil`, err)
+	}
+	if err := f.Start(""); err != nil {
+		t.Fatalf(`Start() = %v; want nil`, err)
+	}
+	defer f.Stop()
+
+	// Serve and forward over both UDP and TCP.
+	for _, network := range []string{"udp", "tcp"} {
+		for _, name := range []string{"www.example.com.", "www.tcp.example."} {
+			query := newTestQueryEDNS(t, name, dnsmessage.TypeA)
+			resp := exchange(t, network, address, query)
+			checkE2EResponse(t, upstream, name, query, resp)
+		}
+	}
+}
+
+func TestForwarderEndToEndMultiListen(t *testing.T) {
+	upstream := newTestUpstream(t, [4]byte{192, 0, 2, 53})
+	f := newTestForwarderE2E(t, upstream)
+
+	// Listen on two loopback addresses, each with a free port.
+	var addresses []netip.AddrPort
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)} {
+		conn, ln, err := listenUDPTCPAt(ip)
+		if err != nil {
+			t.Skipf("failed to listen at %s: %v", ip, err)
+		}
+		addresses = append(addresses, conn.LocalAddr().(*net.UDPAddr).AddrPort())
+		conn.Close()
+		ln.Close()
+	}
+	if err := f.SetListen(addresses[0].String(), addresses[1].String()); err != nil {
+		t.Fatalf(`SetListen() = %v; want nil`, err)
+	}
+	if err := f.Start(""); err != nil {
+		t.Fatalf(`Start() = %v; want nil`, err)
+	}
+	defer f.Stop()
+
+	for _, address := range addresses {
+		for _, network := range []string{"udp", "tcp"} {
+			t.Run(network+"-"+address.String(), func(t *testing.T) {
+				name := "www.example.com."
+				query := newTestQueryEDNS(t, name, dnsmessage.TypeA)
+				resp := exchange(t, network, address, query)
+				checkE2EResponse(t, upstream, name, query, resp)
+			})
+		}
+	}
+}
+
+func TestForwarderEndToEndUDPSockets(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT unsupported")
+	}
+	upstream := newTestUpstream(t, [4]byte{192, 0, 2, 53})
+	f := newTestForwarderE2E(t, upstream)
+	if err := f.SetUDPSockets(4); err != nil {
+		t.Fatalf(`SetUDPSockets() = %v; want nil`, err)
+	}
+
+	conn, ln := listenUDPTCP(t)
+	address := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	conn.Close()
+	ln.Close()
+	if err := f.SetListen(address.String()); err != nil {
+		t.Fatalf(`SetListen() = %v; want nil`, err)
+	}
+	if err := f.Start(""); err != nil {
+		t.Fatalf(`Start() = %v; want nil`, err)
+	}
+	defer f.Stop()
+
+	// Queries from different source ports are spread over the sockets.
+	for i := range 16 {
+		name := fmt.Sprintf("www%d.example.com.", i)
+		query := newTestQueryEDNS(t, name, dnsmessage.TypeA)
+		resp := exchange(t, "udp", address, query)
+		checkE2EResponse(t, upstream, name, query, resp)
+	}
+}
+
+func TestForwarderEndToEndUDPBatch(t *testing.T) {
+	upstream := newTestUpstream(t, [4]byte{192, 0, 2, 53})
+	f := newTestForwarderE2E(t, upstream)
+	if err := f.SetUDPBatchSize(16); err != nil {
+		t.Fatalf(`SetUDPBatchSize() = %v; want nil`, err)
+	}
+
+	conn, ln := listenUDPTCP(t)
+	address := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	conn.Close()
+	ln.Close()
+	if err := f.SetListen(address.String()); err != nil {
+		t.Fatalf(`SetListen() = %v; want nil`, err)
+	}
+	if err := f.Start(""); err != nil {
+		t.Fatalf(`Start() = %v; want nil`, err)
+	}
+	defer f.Stop()
+
+	// Concurrent queries are likely received in batches.
+	var wg sync.WaitGroup
+	for i := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("www%d.example.com.", i)
+			query := newTestQueryEDNS(t, name, dnsmessage.TypeA)
+			resp := exchange(t, "udp", address, query)
+			checkE2EResponse(t, upstream, name, query, resp)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestListenUDPSockets(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT unsupported")
+	}
+	// Ephemeral port: the rest bind to the port of the first one.
+	conns, err := listenUDP(netip.MustParseAddrPort("127.0.0.1:0"), 3)
+	if err != nil {
+		t.Fatalf(`listenUDP() = %v; want nil`, err)
+	}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	if len(conns) != 3 {
+		t.Fatalf(`listenUDP() = %d sockets; want 3`, len(conns))
+	}
+	port := conns[0].LocalAddr().(*net.UDPAddr).Port
+	for i, conn := range conns {
+		if p := conn.LocalAddr().(*net.UDPAddr).Port; p != port {
+			t.Errorf(`[%d] port = %d; want %d`, i, p, port)
+		}
+	}
+
+	// Without SO_REUSEPORT, the address is taken.
+	address := conns[0].LocalAddr().(*net.UDPAddr).AddrPort()
+	if conns, err := listenUDP(address, 1); err == nil {
+		conns[0].Close()
+		t.Errorf(`listenUDP(%s) = nil; want address in use`, address)
+	}
+}
+
+func TestSetUDPSockets(t *testing.T) {
+	f := &Forwarder{}
+	tests := []struct {
+		n      int
+		expect int
+		ok     bool
+	}{
+		{0, 1, true},
+		{4, 4, true},
+		{maxUDPSockets, maxUDPSockets, true},
+		{-1, 0, false},
+		{maxUDPSockets + 1, 0, false},
+	}
+	for _, tc := range tests {
+		err := f.SetUDPSockets(tc.n)
+		if (err == nil) != tc.ok {
+			t.Errorf(`SetUDPSockets(%d) = %v; want ok=%v`, tc.n, err, tc.ok)
+			continue
+		}
+		if tc.ok && f.UDPSockets != tc.expect {
+			t.Errorf(`SetUDPSockets(%d) => %d; want %d`, tc.n, f.UDPSockets, tc.expect)
+		}
+	}
+}
+
+func TestSetUDPBatchSize(t *testing.T) {
+	f := &Forwarder{}
+	tests := []struct {
+		n      int
+		expect int
+		ok     bool
+	}{
+		{0, 1, true},
+		{16, 16, true},
+		{maxUDPBatchSize, maxUDPBatchSize, true},
+		{-1, 0, false},
+		{maxUDPBatchSize + 1, 0, false},
+	}
+	for _, tc := range tests {
+		err := f.SetUDPBatchSize(tc.n)
+		if (err == nil) != tc.ok {
+			t.Errorf(`SetUDPBatchSize(%d) = %v; want ok=%v`, tc.n, err, tc.ok)
+			continue
+		}
+		if tc.ok && f.UDPBatchSize != tc.expect {
+			t.Errorf(`SetUDPBatchSize(%d) => %d; want %d`, tc.n, f.UDPBatchSize, tc.expect)
+		}
+	}
+}
+
+// Compare the UDP throughput of a single socket against multiple ones
+// with SO_REUSEPORT, and with the batched receiving, e.g.:
+// go test -run=^$ -bench=ServeUDP -cpu=8 ./dns
+func BenchmarkServeUDP(b *testing.B) {
+	query := newTestQuery(b, "www.example.com.", dnsmessage.TypeA)
+	for _, tc := range []struct{ sockets, batch int }{{1, 1}, {4, 1}, {1, 32}, {4, 32}} {
+		b.Run(fmt.Sprintf("sockets=%d/batch=%d", tc.sockets, tc.batch), func(b *testing.B) {
+			if tc.sockets > 1 && !reusePortSupported {
+				b.Skip("SO_REUSEPORT unsupported")
+			}
+			f := &Forwarder{myIP: &config.MyIP{}}
+			f.Router.resolver = &staticResolver{response: query}
+			f.SetUDPSockets(tc.sockets)
+			f.SetUDPBatchSize(tc.batch)
+
+			conn, ln, err := listenUDPTCPAt(net.IPv4(127, 0, 0, 1))
+			if err != nil {
+				b.Fatalf("%v", err)
+			}
+			address := conn.LocalAddr().String()
+			conn.Close()
+			ln.Close()
+			if err := f.SetListen(address); err != nil {
+				b.Fatalf(`SetListen() = %v; want nil`, err)
+			}
+			if err := f.Start(""); err != nil {
+				b.Fatalf(`Start() = %v; want nil`, err)
+			}
+			defer f.Stop()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				c, err := net.Dial("udp", address)
+				if err != nil {
+					b.Errorf("failed to dial: %v", err)
+					return
+				}
+				defer c.Close()
+				buf := make([]byte, defaultUDPQuerySize)
+				for pb.Next() {
+					c.SetDeadline(time.Now().Add(time.Second))
+					if _, err := c.Write(query); err != nil {
+						b.Errorf("failed to send query: %v", err)
+						return
+					}
+					if _, err := c.Read(buf); err != nil {
+						b.Errorf("failed to read response: %v", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// Generate a self-signed certificate for "localhost" and 127.0.0.1, and
+// write it and the key in PEM to the files in a temporary directory.
+func newTestCertFiles(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		t.Fatalf("failed to write cert: %v", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+// Get a free TCP address of the loopback.
+func freeTCPAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen TCP: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestForwarderEndToEndTLS(t *testing.T) {
+	upstream := newTestUpstream(t, [4]byte{192, 0, 2, 54})
+	f := newTestForwarderE2E(t, upstream)
+
+	certFile, keyFile := newTestCertFiles(t)
+	dotAddress, dohAddress := freeTCPAddress(t), freeTCPAddress(t)
+	if err := f.SetListenDoT([]string{dotAddress}, certFile, keyFile); err != nil {
+		t.Fatalf(`SetListenDoT() = %v; want nil`, err)
+	}
+	if err := f.SetListenDoH([]string{dohAddress}, certFile, keyFile); err != nil {
+		t.Fatalf(`SetListenDoH() = %v; want nil`, err)
+	}
+	if err := f.Start(""); err != nil {
+		t.Fatalf(`Start() = %v; want nil`, err)
+	}
+	defer f.Stop()
+
+	tlsConfig := &tls.Config{
+		ServerName:         "localhost",
+		InsecureSkipVerify: true, // self-signed
+	}
+
+	t.Run("DoT", func(t *testing.T) {
+		dialer := &net.Dialer{Timeout: time.Second}
+		conn, err := tls.DialWithDialer(dialer, "tcp", dotAddress, tlsConfig)
+		if err != nil {
+			t.Fatalf("failed to dial DoT: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// Multiple queries on the same connection.
+		for _, name := range []string{"dot.example.com.", "www.tcp.example."} {
+			query := newTestQueryEDNS(t, name, dnsmessage.TypeA)
+			if err := writeTCPMsg(conn, query); err != nil {
+				t.Fatalf("failed to send query: %v", err)
+			}
+			resp, err := readTCPMsg(conn)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			checkE2EResponse(t, upstream, name, query, resp)
+		}
+	})
+
+	t.Run("DoH", func(t *testing.T) {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:   tlsConfig,
+				ForceAttemptHTTP2: true, // the listener only supports h2
+			},
+			Timeout: 5 * time.Second,
+		}
+		defer client.CloseIdleConnections()
+		url := "https://" + dohAddress + dohPath
+
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			name := strings.ToLower(method) + ".doh.example.com."
+			query := newTestQueryEDNS(t, name, dnsmessage.TypeA)
+			var req *http.Request
+			if method == http.MethodGet {
+				req, _ = http.NewRequest(method,
+					url+"?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+			} else {
+				req, _ = http.NewRequest(method, url, bytes.NewReader(query))
+				req.Header.Set("Content-Type", dohContentType)
+			}
+			req.Header.Set("Accept", dohContentType)
+
+			hresp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("%s failed: %v", method, err)
+			}
+			resp, err := io.ReadAll(hresp.Body)
+			hresp.Body.Close()
+			if err != nil || hresp.StatusCode != http.StatusOK || hresp.ProtoMajor != 2 ||
+				hresp.Header.Get("Content-Type") != dohContentType {
+				t.Fatalf("%s = (%s %s, %v); want 200 over HTTP/2",
+					method, hresp.Proto, hresp.Status, err)
+			}
+			checkE2EResponse(t, upstream, name, query, resp)
+		}
+
+		// Bad requests
+		hresp, err := client.Get("https://" + dohAddress + "/bad")
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		hresp.Body.Close()
+		if hresp.StatusCode != http.StatusBadRequest {
+			t.Errorf(`GET /bad = %s; want 400`, hresp.Status)
+		}
+	})
+}
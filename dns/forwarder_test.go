@@ -0,0 +1,1796 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Forwarder - tests
+//
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+	"kexuedns/util/dnsmsg"
+	"kexuedns/util/dnstrie"
+)
+
+// A resolver that blocks until the query context is canceled.
+type blockingResolver struct {
+	started  chan struct{}
+	canceled chan struct{}
+}
+
+func newBlockingResolver() *blockingResolver {
+	return &blockingResolver{
+		started:  make(chan struct{}),
+		canceled: make(chan struct{}),
+	}
+}
+
+func (r *blockingResolver) Export() *ResolverExport {
+	return &ResolverExport{Name: "blocking"}
+}
+
+func (r *blockingResolver) Stats() *ResolverStats {
+	return &ResolverStats{Name: "blocking"}
+}
+
+func (r *blockingResolver) Close() {}
+
+func (r *blockingResolver) Drain() int { return 0 }
+
+func (r *blockingResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	close(r.started)
+	<-ctx.Done()
+	close(r.canceled)
+	return nil, ctx.Err()
+}
+
+// A resolver that immediately replies with a fixed response.
+type staticResolver struct {
+	response []byte
+}
+
+func (r *staticResolver) Export() *ResolverExport {
+	return &ResolverExport{Name: "static"}
+}
+
+func (r *staticResolver) Stats() *ResolverStats {
+	return &ResolverStats{Name: "static"}
+}
+
+func (r *staticResolver) Close() {}
+
+func (r *staticResolver) Drain() int { return 0 }
+
+func (r *staticResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	return r.response, nil
+}
+
+func newTestQuery(t testing.TB, name string, qtype dnsmessage.Type) []byte {
+	dmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0x1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{
+				Name:  dnsmessage.MustNewName(name),
+				Type:  qtype,
+				Class: dnsmessage.ClassINET,
+			},
+		},
+	}
+	msg, err := dmsg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+	return msg
+}
+
+func TestHandleDoHCancel(t *testing.T) {
+	resolver := newBlockingResolver()
+	f := &Forwarder{}
+	f.Router.resolver = resolver
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequestWithContext(ctx, http.MethodPost, dohPath,
+		bytes.NewReader(query))
+	req.Header.Set("Content-Type", dohContentType)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.handleDoH(httptest.NewRecorder(), req)
+	}()
+
+	select {
+	case <-resolver.started:
+	case <-time.After(time.Second):
+		t.Fatalf("upstream query not started")
+	}
+
+	// Client goes away; the upstream query must be aborted well before
+	// the query timeout.
+	cancel()
+	select {
+	case <-resolver.canceled:
+	case <-time.After(queryTimeout / 4):
+		t.Fatalf("upstream query not canceled")
+	}
+	<-done
+}
+
+func TestHandleQueryDeadline(t *testing.T) {
+	resolver := newBlockingResolver()
+	f := &Forwarder{}
+	f.Router.resolver = resolver
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	timeout := 50 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := f.handleQuery(ctx, query, netip.Addr{}, true)
+	if elapsed := time.Since(start); elapsed >= queryTimeout/2 {
+		t.Errorf(`handleQuery() took %v; want about %v`, elapsed, timeout)
+	}
+	if err == nil || resp == nil {
+		t.Errorf(`handleQuery() = (%v, %v); want (!nil, error)`, resp, err)
+	}
+}
+
+func TestHandleQueryOpCode(t *testing.T) {
+	resolver := newBlockingResolver()
+	f := &Forwarder{}
+	f.Router.resolver = resolver
+
+	dmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0x1234, OpCode: 5}, // UPDATE
+		Questions: []dnsmessage.Question{
+			{
+				Name:  dnsmessage.MustNewName("example.com."),
+				Type:  dnsmessage.TypeSOA,
+				Class: dnsmessage.ClassINET,
+			},
+		},
+	}
+	query, _ := dmsg.Pack()
+	orig := append([]byte{}, query...)
+
+	resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if resp == nil || err == nil {
+		t.Fatalf(`handleQuery() = (%v, %v); want (!nil, error)`, resp, err)
+	}
+	if !bytes.Equal(query, orig) {
+		t.Errorf(`handleQuery() modified the query`)
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		t.Fatalf(`failed to parse response: %v`, err)
+	}
+	if !h.Response || h.RCode != dnsmessage.RCodeNotImplemented || h.ID != 0x1234 {
+		t.Errorf(`response header = %+v; want NotImplemented response`, h)
+	}
+
+	select {
+	case <-resolver.started:
+		t.Errorf(`query with opcode UPDATE was forwarded`)
+	default:
+	}
+}
+
+func TestHandleQueryJunk(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = &staticResolver{response: query}
+
+	resp, err := f.handleQuery(context.Background(), query[:minQuerySize], netip.Addr{}, true)
+	if resp != nil || !errors.Is(err, errJunkPacket) {
+		t.Errorf(`handleQuery() = (%v, %v); want (nil, %v)`, resp, err, errJunkPacket)
+	}
+	if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+		t.Errorf(`handleQuery() = %v; want nil`, err)
+	}
+
+	// Raise the threshold to drop the query.
+	if err := f.SetMinQuerySize(len(query)); err != nil {
+		t.Fatalf(`SetMinQuerySize() = %v; want nil`, err)
+	}
+	resp, err = f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if resp != nil || !errors.Is(err, errJunkPacket) {
+		t.Errorf(`handleQuery() = (%v, %v); want (nil, %v)`, resp, err, errJunkPacket)
+	}
+	if n := f.Stats().JunkDropped; n != 2 {
+		t.Errorf(`Stats().JunkDropped = %d; want 2`, n)
+	}
+
+	for _, size := range []int{-1, minQuerySize - 1, minUDPSize} {
+		if err := f.SetMinQuerySize(size); err == nil {
+			t.Errorf(`SetMinQuerySize(%d) = nil; want error`, size)
+		}
+	}
+}
+
+// Make a query without any question, but the records (additionals).
+func newTestQueryNoQuestion(t testing.TB, edns bool, answers ...dnsmessage.Resource) []byte {
+	dmsg := dnsmessage.Message{
+		Header:  dnsmessage.Header{ID: 0x1234, RecursionDesired: true},
+		Answers: answers,
+	}
+	if edns {
+		rh := dnsmessage.ResourceHeader{}
+		rh.SetEDNS0(1232, 0, false)
+		dmsg.Additionals = []dnsmessage.Resource{
+			{Header: rh, Body: &dnsmessage.OPTResource{}},
+		}
+	}
+	msg, err := dmsg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+	return msg
+}
+
+func TestHandleQueryNoQuestion(t *testing.T) {
+	resolver := &recordingResolver{}
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = resolver
+
+	record := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("www.example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		},
+		Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}
+	tests := []struct {
+		desc  string
+		query []byte
+		rcode dnsmessage.RCode
+		edns  bool
+	}{
+		{"EDNS only", newTestQueryNoQuestion(t, true), dnsmessage.RCodeSuccess, true},
+		{"EDNS with answer", newTestQueryNoQuestion(t, true, record), dnsmessage.RCodeFormatError, true},
+		{"answer only", newTestQueryNoQuestion(t, false, record), dnsmessage.RCodeFormatError, false},
+	}
+	for _, tc := range tests {
+		resp, err := f.handleQuery(context.Background(), tc.query, netip.Addr{}, true)
+		if (err == nil) != (tc.rcode == dnsmessage.RCodeSuccess) {
+			t.Errorf(`[%s] handleQuery() = %v; want rcode %v`, tc.desc, err, tc.rcode)
+		}
+		var dmsg dnsmessage.Message
+		if err := dmsg.Unpack(resp); err != nil {
+			t.Errorf(`[%s] invalid response: %v`, tc.desc, err)
+			continue
+		}
+		if !dmsg.Header.Response || dmsg.Header.ID != 0x1234 || dmsg.Header.RCode != tc.rcode ||
+			len(dmsg.Questions) != 0 || len(dmsg.Answers) != 0 {
+			t.Errorf(`[%s] response = %+v; want %v without records`, tc.desc, dmsg, tc.rcode)
+		}
+		if edns := len(dmsg.Additionals) == 1; edns != tc.edns {
+			t.Errorf(`[%s] response EDNS = %v; want %v`, tc.desc, edns, tc.edns)
+		}
+	}
+	if resolver.msg != nil {
+		t.Errorf(`query without question forwarded`)
+	}
+
+	// Header only: still junk.
+	query := newTestQueryNoQuestion(t, false)
+	if resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); resp != nil ||
+		!errors.Is(err, errJunkPacket) {
+		t.Errorf(`handleQuery(header only) = (%v, %v); want (nil, %v)`, resp, err, errJunkPacket)
+	}
+}
+
+func TestHandleQueryExtendedError(t *testing.T) {
+	f := &Forwarder{myIP: &config.MyIP{}}
+
+	// No resolver: ServFail with EDE.
+	query := newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA)
+	resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if resp == nil || err == nil {
+		t.Fatalf(`handleQuery() = (%v, %v); want (!nil, error)`, resp, err)
+	}
+	edes, err := GetExtendedErrors(resp)
+	if err != nil {
+		t.Fatalf(`GetExtendedErrors() = %v; want nil`, err)
+	}
+	if len(edes) != 1 || edes[0].InfoCode != ExtendedErrorNoReachableAuthority {
+		t.Errorf(`GetExtendedErrors() = %+v; want NoReachableAuthority`, edes)
+	}
+
+	// Upstream response with EDE: relayed as is.
+	upstream := newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA)
+	dnsmsg.RawMsg(upstream).SetRCode(dnsmessage.RCodeServerFailure)
+	dnsmsg.RawMsg(upstream).SetFlags(dnsmsg.FlagRA, 0)
+	upstream, err = AddExtendedError(upstream, &ExtendedError{
+		InfoCode:  18, // Prohibited
+		ExtraText: "upstream says no",
+	})
+	if err != nil {
+		t.Fatalf(`AddExtendedError() = %v; want nil`, err)
+	}
+	f.Router.resolver = &staticResolver{response: upstream}
+	resp, err = f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if !bytes.Equal(resp, upstream) {
+		t.Errorf(`handleQuery() = %v; want %v`, resp, upstream)
+	}
+}
+
+func TestHandleQueryUpstreamError(t *testing.T) {
+	resolver := newFakeResolver("default")
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = resolver
+	query := newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA)
+
+	tests := []struct {
+		err   error
+		rcode dnsmessage.RCode
+		ede   ExtendedErrorCode
+	}{
+		{context.DeadlineExceeded, dnsmessage.RCodeServerFailure, ExtendedErrorNoReachableAuthority},
+		{&net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded},
+			dnsmessage.RCodeServerFailure, ExtendedErrorNoReachableAuthority},
+		{fmt.Errorf("%w: DoH server returned 403", ErrUpstreamRefused),
+			dnsmessage.RCodeRefused, ExtendedErrorProhibited},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED},
+			dnsmessage.RCodeServerFailure, ExtendedErrorNotReady},
+		{ErrPoolClosed, dnsmessage.RCodeServerFailure, ExtendedErrorNotReady},
+		{errors.New("connection reset"), dnsmessage.RCodeServerFailure, ExtendedErrorNetworkError},
+	}
+	for i, tc := range tests {
+		resolver.setError(tc.err)
+		resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+		if !errors.Is(err, tc.err) {
+			t.Errorf(`[%d] handleQuery() = %v; want %v`, i, err, tc.err)
+		}
+		var dmsg dnsmessage.Message
+		if err := dmsg.Unpack(resp); err != nil || dmsg.Header.RCode != tc.rcode {
+			t.Errorf(`[%d] response = %+v (%v); want %v`, i, dmsg.Header, err, tc.rcode)
+		}
+		edes, err := GetExtendedErrors(resp)
+		if err != nil || len(edes) != 1 || edes[0].InfoCode != tc.ede {
+			t.Errorf(`[%d] GetExtendedErrors() = (%+v, %v); want %d`, i, edes, err, tc.ede)
+		}
+	}
+
+	// REFUSED answered by the upstream: relayed as is.
+	resolver.setError(nil)
+	resolver.setRCode("www.example.com.", dnsmessage.TypeA, dnsmessage.RCodeRefused)
+	resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	var dmsg dnsmessage.Message
+	if err != nil || dmsg.Unpack(resp) != nil || dmsg.Header.RCode != dnsmessage.RCodeRefused {
+		t.Errorf(`handleQuery() = (%+v, %v); want REFUSED`, dmsg.Header, err)
+	}
+	if edes, _ := GetExtendedErrors(resp); len(edes) != 0 {
+		t.Errorf(`GetExtendedErrors() = %+v; want none added`, edes)
+	}
+}
+
+// A resolver that records the last query message it received.
+type recordingResolver struct {
+	staticResolver
+	msg []byte
+	id  requestID
+}
+
+func (r *recordingResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	r.msg = msg
+	r.id = requestIDFrom(ctx)
+	return r.response, nil
+}
+
+// A resolver answering FORMERR to the queries with EDNS, like the strict
+// upstreams rejecting the ECS option.
+type ednsRejectingResolver struct {
+	answeringResolver
+	rejected int
+}
+
+func (r *ednsRejectingResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	qmsg, err := dnsmsg.NewQueryMsg(msg)
+	if err != nil {
+		return nil, err
+	}
+	if qmsg.OPT.Header == nil {
+		return r.answeringResolver.Query(ctx, msg, isUDP)
+	}
+	r.rejected++
+	resp := dnsmsg.RawMsg(bytes.Clone(msg)).ZeroCounts()
+	resp.SetRCode(dnsmessage.RCodeFormatError)
+	return resp, nil
+}
+
+func TestHandleQueryRequestNSID(t *testing.T) {
+	upstream := newTestQuery(t, "upstream.", dnsmessage.TypeA)
+	resolver := &recordingResolver{staticResolver: staticResolver{response: upstream}}
+	f := &Forwarder{myIP: &config.MyIP{}, RequestNSID: true}
+	f.Router.resolver = resolver
+	if err := f.SetECSSubnet("203.0.113.0/24", ""); err != nil {
+		t.Fatalf(`SetECSSubnet() = %v; want nil`, err)
+	}
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA) // no EDNS
+	if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if data, ok := dnsmsg.RawMsg(resolver.msg).Option(3); !ok || len(data) != 0 {
+		t.Errorf(`forwarded NSID option = (%v, %v); want empty request`, data, ok)
+	}
+	if prefix, ok := dnsmsg.RawMsg(resolver.msg).EdnsSubnet(); !ok ||
+		prefix.String() != "203.0.113.0/24" {
+		t.Errorf(`forwarded ECS = (%v, %v); want 203.0.113.0/24`, prefix, ok)
+	}
+}
+
+func TestHandleQueryRouteInfo(t *testing.T) {
+	upstream := newTestQueryEDNS(t, "upstream.", dnsmessage.TypeA)
+	resolver := &recordingResolver{staticResolver: staticResolver{response: upstream}}
+	f := &Forwarder{myIP: &config.MyIP{}, RouteInfo: true}
+	f.Router.resolver = resolver
+	f.Router.routes[2] = &Route{name: "lan", resolver: resolver, trie: &dnstrie.DNSTrie{}}
+	f.Router.routes[2].trie.AddZone("home.example", struct{}{})
+	f.Router.routes[3] = &Route{name: "kids", resolver: resolver, trie: &dnstrie.DNSTrie{},
+		serverNames: []string{"kids.dns.example"}}
+	f.Router.routes[3].trie.AddZone("example.com", struct{}{})
+
+	tests := []struct {
+		name       string
+		serverName string
+		want       RouteInfo
+	}{
+		{"nas.home.example.", "", RouteInfo{Index: 2, Route: "lan", Resolver: "static"}},
+		{"www.example.com.", "", RouteInfo{Index: -1, Resolver: "static"}},
+		{"www.example.com.", "kids.dns.example", RouteInfo{Index: 3, Route: "kids", Resolver: "static"}},
+	}
+	for _, tc := range tests {
+		query := newTestQueryEDNS(t, tc.name, dnsmessage.TypeA,
+			dnsmessage.Option{Code: optionCodeRouteInfo})
+		ctx := withServerName(context.Background(), tc.serverName)
+		resp, err := f.handleQuery(ctx, query, netip.Addr{}, true)
+		if err != nil {
+			t.Fatalf(`handleQuery(%s) = %v; want nil`, tc.name, err)
+		}
+		if ri, ok := GetRouteInfo(resp); !ok || *ri != tc.want {
+			t.Errorf(`GetRouteInfo(%s, %q) = (%+v, %v); want %+v`,
+				tc.name, tc.serverName, ri, ok, tc.want)
+		}
+		// Private to the forwarder: not forwarded to the upstream.
+		if _, ok := dnsmsg.RawMsg(resolver.msg).Option(optionCodeRouteInfo); ok {
+			t.Errorf(`upstream query has the route info option; want removed`)
+		}
+	}
+
+	// Not asked: none attached.
+	query := newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA)
+	resp, _ := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if ri, ok := GetRouteInfo(resp); ok {
+		t.Errorf(`GetRouteInfo() = %+v; want none if not asked`, ri)
+	}
+}
+
+func TestHandleQueryFormErrRetry(t *testing.T) {
+	resolver := &ednsRejectingResolver{}
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.myIP.SetV4("1.2.3.4") // add ECS
+	f.Router.resolver = resolver
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+
+	// Disabled: the FORMERR is relayed.
+	resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if !isFormErr(resp) {
+		t.Errorf(`response = %x; want FORMERR`, resp)
+	}
+
+	f.FormErrRetry = true
+	resp, err = f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil {
+		t.Fatalf(`failed to unpack response: %v`, err)
+	}
+	if dmsg.Header.RCode != dnsmessage.RCodeSuccess || len(dmsg.Answers) != 1 {
+		t.Errorf(`response = %+v; want the answer to the plain query`, dmsg)
+	}
+	if dmsg.Header.ID != binary.BigEndian.Uint16(query) {
+		t.Errorf(`response ID = %d; want the query ID`, dmsg.Header.ID)
+	}
+	if resolver.rejected != 2 || resolver.queries.Load() != 1 {
+		t.Errorf(`rejected = %d, plain queries = %d; want 2, 1`,
+			resolver.rejected, resolver.queries.Load())
+	}
+
+	// The query without EDNS is not retried.
+	resolver.queries.Store(0)
+	if resp := f.retryPlain(context.Background(), resolver, query, nil, true); resp != nil {
+		t.Errorf(`retryPlain() without EDNS = %x; want the FORMERR response`, resp)
+	}
+	if n := resolver.queries.Load(); n != 0 {
+		t.Errorf(`plain queries = %d; want 0`, n)
+	}
+}
+
+func TestHandleQueryFastPath(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	resolver := &recordingResolver{staticResolver: staticResolver{response: query}}
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = resolver
+
+	// No ECS address: the query is forwarded as is, but as a copy.
+	if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if !bytes.Equal(resolver.msg, query) {
+		t.Errorf(`forwarded query = %v; want %v`, resolver.msg, query)
+	}
+	if &resolver.msg[0] == &query[0] {
+		t.Errorf(`forwarded query shares the buffer of the original`)
+	}
+
+	// With an ECS address: the query is rebuilt with the ECS option.
+	f.myIP.SetV4("1.2.3.4")
+	if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	qmsg, err := dnsmsg.NewQueryMsg(resolver.msg)
+	if err != nil {
+		t.Fatalf(`NewQueryMsg() = %v; want nil`, err)
+	}
+	if qmsg.OPT.Header == nil || len(qmsg.OPT.Options) != 1 ||
+		qmsg.OPT.Options[0].Code != 8 { // ECS
+		t.Errorf(`forwarded query OPT = %+v; want ECS option`, qmsg.OPT)
+	}
+}
+
+func TestHandleQueryInvalidOptions(t *testing.T) {
+	upstream := newTestQuery(t, "upstream.", dnsmessage.TypeA)
+	resolver := &recordingResolver{staticResolver: staticResolver{response: upstream}}
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = resolver
+
+	cookie := dnsmessage.Option{Code: 10, Data: []byte("12345678")}
+	tests := []struct {
+		desc    string
+		options []dnsmessage.Option
+		want    []uint16 // codes of the forwarded options
+	}{
+		{"valid", []dnsmessage.Option{
+			{Code: 8, Data: []byte{0, 1, 16, 0, 10, 1}}, cookie,
+		}, []uint16{8, 10}},
+		{"ECS address too long", []dnsmessage.Option{
+			{Code: 8, Data: []byte{0, 1, 8, 0, 10, 1, 2, 3, 4, 5, 6}}, cookie,
+		}, []uint16{10}},
+		{"ECS unknown family", []dnsmessage.Option{
+			{Code: 8, Data: []byte{0, 9, 8, 0, 10}},
+		}, []uint16{}},
+		{"cookie too short", []dnsmessage.Option{
+			{Code: 10, Data: []byte("1234")}, {Code: 65100, Data: []byte("x")},
+		}, []uint16{65100}},
+		{"cookie too long", []dnsmessage.Option{
+			{Code: 10, Data: make([]byte, 41)},
+		}, []uint16{}},
+	}
+	for _, tc := range tests {
+		query := newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA, tc.options...)
+		if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+			t.Fatalf(`[%s] handleQuery() = %v; want nil`, tc.desc, err)
+		}
+		qmsg, err := dnsmsg.NewQueryMsg(resolver.msg)
+		if err != nil {
+			t.Fatalf(`[%s] NewQueryMsg() = %v; want nil`, tc.desc, err)
+		}
+		codes := []uint16{}
+		for _, op := range qmsg.OPT.Options {
+			codes = append(codes, op.Code)
+		}
+		if !slices.Equal(codes, tc.want) {
+			t.Errorf(`[%s] forwarded options = %v; want %v`, tc.desc, codes, tc.want)
+		}
+	}
+}
+
+func TestTruncateUDP(t *testing.T) {
+	name := dnsmessage.MustNewName("www.example.com.")
+	dmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0x1234, Response: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+		},
+	}
+	txt := string(bytes.Repeat([]byte("x"), 200))
+	for i := 0; i < 5; i++ {
+		dmsg.Answers = append(dmsg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  name,
+				Type:  dnsmessage.TypeTXT,
+				Class: dnsmessage.ClassINET,
+			},
+			Body: &dnsmessage.TXTResource{TXT: []string{txt}},
+		})
+	}
+	resp, err := dmsg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack response: %v", err)
+	}
+
+	// No EDNS: max 512 bytes.
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeTXT)
+	var p dnsmessage.Parser
+	tresp := truncateUDP(query, resp, defaultUDPResponseSize)
+	if h, err := p.Start(tresp); err != nil || !h.Truncated || len(tresp) > 512 {
+		t.Errorf(`truncateUDP() = (%d bytes, %+v, %v); want truncated`,
+			len(tresp), h, err)
+	}
+
+	// Large enough EDNS payload size: untouched.
+	query = newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeTXT)
+	if tresp := truncateUDP(query, resp, defaultUDPResponseSize); !bytes.Equal(tresp, resp) {
+		t.Errorf(`truncateUDP() modified the response fitting the client size`)
+	}
+
+	// Small response: untouched.
+	small := newTestQuery(t, "www.example.com.", dnsmessage.TypeTXT)
+	if tresp := truncateUDP(query, small, defaultUDPResponseSize); !bytes.Equal(tresp, small) {
+		t.Errorf(`truncateUDP() modified the small response`)
+	}
+}
+
+// Make a response to the query (query) larger than the max message size.
+func newTestHugeResponse(t testing.TB, query []byte) []byte {
+	txt := strings.Repeat("x", 250)
+	var answers []dnsmessage.Resource
+	for range 300 {
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName("www.example.com."),
+				Type:  dnsmessage.TypeTXT,
+				Class: dnsmessage.ClassINET,
+				TTL:   300,
+			},
+			Body: &dnsmessage.TXTResource{TXT: []string{txt}},
+		})
+	}
+	resp := newTestResponse(t, query, dnsmessage.RCodeSuccess, answers, nil)
+	if len(resp) <= maxMessageSize {
+		t.Fatalf("response length = %d; want > %d", len(resp), maxMessageSize)
+	}
+	return resp
+}
+
+func TestTruncateTCP(t *testing.T) {
+	query := newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeTXT)
+	resp := newTestHugeResponse(t, query)
+	tresp := truncateTCP(query, resp)
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(tresp); err != nil || !dmsg.Truncated ||
+		len(dmsg.Answers) != 0 || len(dmsg.Questions) != 1 {
+		t.Errorf(`truncateTCP() = %+v (%v); want truncated`, dmsg.Header, err)
+	}
+
+	small := newTestResponse(t, query, dnsmessage.RCodeSuccess, nil, nil)
+	if tresp := truncateTCP(query, small); !bytes.Equal(tresp, small) {
+		t.Errorf(`truncateTCP() modified the small response`)
+	}
+}
+
+func TestHandleTCPHugeResponse(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeTXT)
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = &staticResolver{response: newTestHugeResponse(t, query)}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f.wg.Add(1)
+	go f.handleTCP(ctx, server)
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := client.Write(append(msg, query...)); err != nil {
+		t.Fatalf("failed to write query: %v", err)
+	}
+	lbuf := make([]byte, 2)
+	if _, err := io.ReadFull(client, lbuf); err != nil {
+		t.Fatalf("failed to read response length: %v", err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lbuf))
+	if _, err := io.ReadFull(client, resp); err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil || !dmsg.Truncated || dmsg.ID != 0x1234 {
+		t.Errorf(`response = %+v (%v); want truncated`, dmsg.Header, err)
+	}
+}
+
+func TestECSAddress(t *testing.T) {
+	v4, v6 := netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("2001:db8::1")
+	dual := &config.MyIP{}
+	dual.SetV4(v4.String())
+	dual.SetV6(v6.String())
+	v4Only := &config.MyIP{}
+	v4Only.SetV4(v4.String())
+
+	client4 := netip.MustParseAddr("192.0.2.1")
+	client6 := netip.MustParseAddr("2001:db8::53")
+	tests := []struct {
+		myIP   *config.MyIP
+		qtype  dnsmessage.Type
+		client netip.Addr
+		want   netip.Addr
+	}{
+		// No client: guess by qtype.
+		{dual, dnsmessage.TypeA, netip.Addr{}, v4},
+		{dual, dnsmessage.TypeAAAA, netip.Addr{}, v6},
+		{dual, dnsmessage.TypeMX, netip.Addr{}, v4},
+		// Client family wins.
+		{dual, dnsmessage.TypeA, client6, v6},
+		{dual, dnsmessage.TypeTXT, client6, v6},
+		{dual, dnsmessage.TypeAAAA, client4, v4},
+		{dual, dnsmessage.TypeAAAA, netip.AddrFrom16(client4.As16()), v4},
+		// Loopback client: guess by qtype.
+		{dual, dnsmessage.TypeA, netip.IPv6Loopback(), v4},
+		{dual, dnsmessage.TypeAAAA, netip.MustParseAddr("127.0.0.1"), v6},
+		// Client family unavailable: guess by qtype.
+		{v4Only, dnsmessage.TypeA, client6, v4},
+		{v4Only, dnsmessage.TypeAAAA, client6, netip.Addr{}},
+	}
+	for i, tc := range tests {
+		f := &Forwarder{myIP: tc.myIP}
+		got, ok := f.ecsSubnet(tc.qtype, tc.client, -1)
+		if ok != tc.want.IsValid() || got.Addr() != tc.want {
+			t.Errorf(`[%d] ecsSubnet(%v, %v) = (%v, %v); want %v`,
+				i, tc.qtype, tc.client, got, ok, tc.want)
+		}
+	}
+
+	// A query from a v6 client gets the v6 subnet.
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	resolver := &recordingResolver{staticResolver: staticResolver{response: query}}
+	f := &Forwarder{myIP: dual}
+	f.Router.resolver = resolver
+	if _, err := f.handleQuery(context.Background(), query, client6, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	qmsg, err := dnsmsg.NewQueryMsg(resolver.msg)
+	if err != nil {
+		t.Fatalf(`NewQueryMsg() = %v; want nil`, err)
+	}
+	if len(qmsg.OPT.Options) != 1 || qmsg.OPT.Options[0].Data[1] != 2 { // family
+		t.Errorf(`forwarded query OPT = %+v; want v6 ECS option`, qmsg.OPT)
+	}
+}
+
+func TestHandleQueryECSPrefix(t *testing.T) {
+	getECS := func(msg []byte) string {
+		prefix, _ := dnsmsg.RawMsg(msg).EdnsSubnet()
+		return prefix.String()
+	}
+
+	// Client ECS too precise: limited.
+	ecs := dnsmessage.Option{Code: 8, Data: []byte{0, 1, 32, 0, 1, 2, 3, 4}} // 1.2.3.4/32
+	query := newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA, ecs)
+	resolver := &recordingResolver{staticResolver: staticResolver{response: query}}
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = resolver
+	if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if got := getECS(resolver.msg); got != "1.2.3.0/24" {
+		t.Errorf(`forwarded ECS = %q; want "1.2.3.0/24"`, got)
+	}
+
+	// Stricter configured prefix applies to both client's and own ECS.
+	if err := f.SetECSPrefix(16, 48); err != nil {
+		t.Fatalf(`SetECSPrefix() = %v; want nil`, err)
+	}
+	f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if got := getECS(resolver.msg); got != "1.2.0.0/16" {
+		t.Errorf(`forwarded ECS = %q; want "1.2.0.0/16"`, got)
+	}
+	f.myIP.SetV4("5.6.7.8")
+	f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if got := getECS(resolver.msg); got != "5.6.0.0/16" {
+		t.Errorf(`forwarded ECS = %q; want "5.6.0.0/16"`, got)
+	}
+
+	for _, v := range [][2]int{{-1, 0}, {33, 0}, {0, 129}} {
+		if err := f.SetECSPrefix(v[0], v[1]); err == nil {
+			t.Errorf(`SetECSPrefix(%d, %d) = nil; want error`, v[0], v[1])
+		}
+	}
+}
+
+func TestECSSubnetStatic(t *testing.T) {
+	for _, tc := range []struct {
+		v4, v6 string
+		ok     bool
+	}{
+		{"", "", true},
+		{"203.0.113.0/24", "2001:db8:1::/48", true},
+		{"203.0.113.77/24", "", true}, // masked
+		{"2001:db8::/48", "", false},  // family mismatch
+		{"", "203.0.113.0/24", false},
+		{"10.1.0.0/16", "", false}, // private
+		{"127.0.0.0/8", "", false},
+		{"0.0.0.0/0", "", false},
+		{"", "fe80::/64", false},
+		{"", "fd00::/48", false},
+		{"203.0.113.0", "", false}, // not a prefix
+	} {
+		f := &Forwarder{}
+		if err := f.SetECSSubnet(tc.v4, tc.v6); (err == nil) != tc.ok {
+			t.Errorf(`SetECSSubnet(%q, %q) = %v; want ok=%v`, tc.v4, tc.v6, err, tc.ok)
+		}
+	}
+
+	myIP := &config.MyIP{}
+	myIP.SetV4("1.2.3.4")
+	myIP.SetV6("2001:db8::1")
+	f := &Forwarder{myIP: myIP}
+	if err := f.SetECSSubnet("203.0.113.77/24", ""); err != nil {
+		t.Fatalf(`SetECSSubnet() = %v; want nil`, err)
+	}
+	route := &RouteExport{Name: "dc", ECSSubnetV4: "198.51.100.0/22", ECSSubnetV6: "2001:db8:200::/40"}
+	routes, err := f.Router.newRoutes([]*RouteExport{route})
+	if err != nil {
+		t.Fatalf(`newRoutes() = %v; want nil`, err)
+	}
+	f.Router.routes = routes
+
+	client6 := netip.MustParseAddr("2001:db8::53")
+	tests := []struct {
+		qtype  dnsmessage.Type
+		client netip.Addr
+		index  int
+		want   string
+	}{
+		// Forwarder's static subnet instead of my IP.
+		{dnsmessage.TypeA, netip.Addr{}, -1, "203.0.113.0/24"},
+		// No static v6 subnet: my IP
+		{dnsmessage.TypeAAAA, netip.Addr{}, -1, "2001:db8::1/56"},
+		{dnsmessage.TypeA, client6, -1, "2001:db8::1/56"},
+		// Route's override, limited by the max prefix length.
+		{dnsmessage.TypeA, netip.Addr{}, 0, "198.51.100.0/22"},
+		{dnsmessage.TypeAAAA, netip.Addr{}, 0, "2001:db8:200::/40"},
+		// Route without override.
+		{dnsmessage.TypeA, netip.Addr{}, 1, "203.0.113.0/24"},
+	}
+	for i, tc := range tests {
+		got, ok := f.ecsSubnet(tc.qtype, tc.client, tc.index)
+		if !ok || got.String() != tc.want {
+			t.Errorf(`[%d] ecsSubnet(%v, %v, %d) = (%v, %v); want %s`,
+				i, tc.qtype, tc.client, tc.index, got, ok, tc.want)
+		}
+	}
+
+	// Summarized with my IPs of the forwarder.
+	if s := f.Summary(); !strings.Contains(s, "ecs: v4=203.0.113.0/24,v6=2001:db8::1;") {
+		t.Errorf(`Summary() = %q; want the ECS of the static subnet and my IP`, s)
+	}
+
+	// Stricter max prefix length applies.
+	f.SetECSPrefix(16, 32)
+	if got, _ := f.ecsSubnet(dnsmessage.TypeA, netip.Addr{}, -1); got.String() != "203.0.113.0/16" {
+		t.Errorf(`ecsSubnet() = %v; want limited to /16`, got)
+	}
+	if got, _ := f.ecsSubnet(dnsmessage.TypeA, netip.Addr{}, 0); got.String() != "198.51.100.0/16" {
+		t.Errorf(`ecsSubnet() = %v; want limited to /16`, got)
+	}
+
+	// Sent to the upstream.
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	resolver := &recordingResolver{staticResolver: staticResolver{response: query}}
+	f.Router.resolver = resolver
+	if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if prefix, _ := dnsmsg.RawMsg(resolver.msg).EdnsSubnet(); prefix.String() != "203.0.0.0/16" {
+		t.Errorf(`forwarded ECS = %v; want 203.0.0.0/16`, prefix)
+	}
+
+	// Validated with the route.
+	route.ECSSubnetV4 = "192.168.0.0/16"
+	if err := ValidateRouterExport(&RouterExport{Routes: []*RouteExport{route}}); err == nil {
+		t.Errorf(`ValidateRouterExport() with private ECS subnet = nil; want error`)
+	}
+	if _, err := f.Router.newRoutes([]*RouteExport{route}); err == nil {
+		t.Errorf(`newRoutes() with private ECS subnet = nil; want error`)
+	}
+}
+
+func BenchmarkHandleQuery(b *testing.B) {
+	query := newTestQuery(b, "www.example.com.", dnsmessage.TypeA)
+	ctx := context.Background()
+
+	ecsIP := &config.MyIP{}
+	ecsIP.SetV4("1.2.3.4")
+	benchmarks := []struct {
+		name string
+		myIP *config.MyIP
+	}{
+		{"FastPath", &config.MyIP{}},
+		{"ECS", ecsIP},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			f := &Forwarder{myIP: bm.myIP}
+			f.Router.resolver = &staticResolver{response: query}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if resp, err := f.handleQuery(ctx, query, netip.Addr{}, true); resp == nil || err != nil {
+					b.Fatalf(`handleQuery() = (%v, %v); want (!nil, nil)`, resp, err)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleTCPKeepalive(t *testing.T) {
+	upstream := newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA)
+	resolver := &recordingResolver{staticResolver: staticResolver{response: upstream}}
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = resolver
+	if err := f.SetTCPIdleTimeout(60); err != nil {
+		t.Fatalf(`SetTCPIdleTimeout() = %v; want nil`, err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f.wg.Add(1)
+	go f.handleTCP(ctx, server)
+
+	exchange := func(query []byte) []byte {
+		client.SetDeadline(time.Now().Add(time.Second))
+		msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		if _, err := client.Write(append(msg, query...)); err != nil {
+			t.Fatalf("failed to write query: %v", err)
+		}
+		lbuf := make([]byte, 2)
+		if _, err := io.ReadFull(client, lbuf); err != nil {
+			t.Fatalf("failed to read response length: %v", err)
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(lbuf))
+		if _, err := io.ReadFull(client, resp); err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		return resp
+	}
+
+	// No keepalive asked: none in the response.
+	resp := exchange(newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA))
+	if _, ok := dnsmsg.RawMsg(resp).Option(optionCodeTCPKeepalive); ok {
+		t.Errorf(`response has TCP keepalive; want none`)
+	}
+
+	query := newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA,
+		dnsmessage.Option{Code: optionCodeTCPKeepalive})
+	resp = exchange(query)
+	data, ok := dnsmsg.RawMsg(resp).Option(optionCodeTCPKeepalive)
+	if !ok || len(data) != 2 || binary.BigEndian.Uint16(data) != 600 {
+		t.Errorf(`response TCP keepalive = (%v, %t); want 600 (60s)`, data, ok)
+	}
+	// Hop-by-hop: not forwarded to the upstream.
+	if _, ok := dnsmsg.RawMsg(resolver.msg).Option(optionCodeTCPKeepalive); ok {
+		t.Errorf(`upstream query has TCP keepalive; want removed`)
+	}
+
+	// Keepalive probe without question.
+	query, err := dnsmsg.RawMsg(newTestQueryNoQuestion(t, true)).AppendOption(
+		optionCodeTCPKeepalive, nil)
+	if err != nil {
+		t.Fatalf("failed to add TCP keepalive: %v", err)
+	}
+	resp = exchange(query)
+	if data, ok := dnsmsg.RawMsg(resp).Option(optionCodeTCPKeepalive); !ok || len(data) != 2 {
+		t.Errorf(`probe response TCP keepalive = (%v, %t); want 600 (60s)`, data, ok)
+	}
+	if rcode := dnsmessage.RCode(resp[3] & 0x0f); rcode != dnsmessage.RCodeSuccess {
+		t.Errorf(`probe response rcode = %v; want %v`, rcode, dnsmessage.RCodeSuccess)
+	}
+
+	for _, seconds := range []int{-1, 6554} {
+		if err := f.SetTCPIdleTimeout(seconds); err == nil {
+			t.Errorf(`SetTCPIdleTimeout(%d) = nil; want error`, seconds)
+		}
+	}
+}
+
+func TestHandleTCPIdleTimeout(t *testing.T) {
+	upstream := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	f := &Forwarder{myIP: &config.MyIP{}, TCPIdleTimeout: 300 * time.Millisecond}
+	f.Router.resolver = &staticResolver{response: upstream}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f.wg.Add(1)
+	go f.handleTCP(ctx, server)
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	exchange := func() error {
+		client.SetDeadline(time.Now().Add(time.Second))
+		msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		if _, err := client.Write(append(msg, query...)); err != nil {
+			return err
+		}
+		lbuf := make([]byte, 2)
+		if _, err := io.ReadFull(client, lbuf); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(client, make([]byte, binary.BigEndian.Uint16(lbuf)))
+		return err
+	}
+
+	// Queries within the idle window reuse the connection, which is reset
+	// upon each query.
+	for i := range 3 {
+		if err := exchange(); err != nil {
+			t.Fatalf(`query %d = %v; want nil`, i, err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	// Closed after idle for longer.
+	time.Sleep(200 * time.Millisecond)
+	if err := exchange(); err == nil {
+		t.Errorf(`query after idle timeout = nil; want closed`)
+	}
+}
+
+func TestHandleQueryLoop(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	resolver := &recordingResolver{staticResolver: staticResolver{response: query}}
+	f := &Forwarder{myIP: &config.MyIP{}, DetectLoop: true}
+	f.Router.resolver = resolver
+
+	// The forwarded query carries our nonce.
+	if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	looped := resolver.msg
+	nonces := dnsmsg.RawMsg(looped).Options(optionCodeLoopNonce)
+	if len(nonces) != 1 || !bytes.Equal(nonces[0], loopNonce) {
+		t.Fatalf(`forwarded query nonces = %v; want [%v]`, nonces, loopNonce)
+	}
+
+	// Another forwarder's nonce: forwarded, with ours added.
+	other, err := dnsmsg.RawMsg(query).AppendOption(optionCodeLoopNonce, []byte("other"))
+	if err != nil {
+		t.Fatalf(`AppendOption() = %v; want nil`, err)
+	}
+	if _, err := f.handleQuery(context.Background(), other, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if n := len(dnsmsg.RawMsg(resolver.msg).Options(optionCodeLoopNonce)); n != 2 {
+		t.Errorf(`forwarded query has %d nonces; want 2`, n)
+	}
+
+	// Looped back: refused without forwarding.
+	resolver.msg = nil
+	resp, err := f.handleQuery(context.Background(), looped, netip.Addr{}, true)
+	if !errors.Is(err, errLoop) {
+		t.Errorf(`handleQuery() = %v; want %v`, err, errLoop)
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil || dmsg.Header.RCode != dnsmessage.RCodeRefused {
+		t.Errorf(`response = %+v (%v); want REFUSED`, dmsg.Header, err)
+	}
+	if resolver.msg != nil {
+		t.Errorf(`looped query forwarded; want refused`)
+	}
+
+	// Disabled: forwarded as is.
+	f.DetectLoop = false
+	if _, err := f.handleQuery(context.Background(), looped, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if !bytes.Equal(resolver.msg, looped) {
+		t.Errorf(`forwarded query = %v; want as is`, resolver.msg)
+	}
+}
+
+func TestHandleQueryBlocked(t *testing.T) {
+	upstream := newTestQuery(t, "upstream.", dnsmessage.TypeA)
+	resolver := &recordingResolver{staticResolver: staticResolver{response: upstream}}
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = resolver
+	if err := f.Router.ReplaceRoutes([]*RouteExport{
+		{Name: "ads", Zones: []string{"ads.example"}, Block: true},
+		{
+			Name:      "malware",
+			Zones:     []string{"malware.example"},
+			Block:     true,
+			BlockText: "malware (list: abuse)",
+		},
+	}); err != nil {
+		t.Fatalf(`ReplaceRoutes() = %v; want nil`, err)
+	}
+
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"www.ads.example.", defaultBlockText},
+		{"c2.malware.example.", "malware (list: abuse)"},
+	}
+	for _, tc := range tests {
+		query := newTestQueryEDNS(t, tc.name, dnsmessage.TypeA)
+		resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, false)
+		if !errors.Is(err, errBlocked) {
+			t.Errorf(`handleQuery(%s) = %v; want %v`, tc.name, err, errBlocked)
+		}
+		var dmsg dnsmessage.Message
+		if err := dmsg.Unpack(resp); err != nil || dmsg.Header.RCode != dnsmessage.RCodeNameError {
+			t.Errorf(`response(%s) = %+v (%v); want NXDOMAIN`, tc.name, dmsg.Header, err)
+		}
+		edes, err := GetExtendedErrors(resp)
+		if err != nil || len(edes) != 1 || edes[0].InfoCode != ExtendedErrorBlocked ||
+			edes[0].ExtraText != tc.text {
+			t.Errorf(`EDE(%s) = %+v (%v); want [15 %q]`, tc.name, edes, err, tc.text)
+		}
+	}
+	if resolver.msg != nil {
+		t.Errorf(`blocked query forwarded`)
+	}
+
+	// Not blocked: forwarded.
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if resolver.msg == nil {
+		t.Errorf(`unblocked query not forwarded`)
+	}
+
+	for _, re := range []*RouteExport{
+		{Name: "text", BlockText: "no block"},
+		{Name: "long", Block: true, BlockText: strings.Repeat("x", maxExtraTextLength+1)},
+	} {
+		if err := ValidateRouterExport(&RouterExport{Routes: []*RouteExport{re}}); err == nil {
+			t.Errorf(`ValidateRouterExport(%s) = nil; want error`, re.Name)
+		}
+	}
+}
+
+func TestHandleQueryDropped(t *testing.T) {
+	upstream := newTestQuery(t, "upstream.", dnsmessage.TypeA)
+	resolver := &recordingResolver{staticResolver: staticResolver{response: upstream}}
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = resolver
+	if err := f.Router.ReplaceRoutes([]*RouteExport{
+		{Name: "telemetry", Zones: []string{"telemetry.example"}, Drop: true},
+	}); err != nil {
+		t.Fatalf(`ReplaceRoutes() = %v; want nil`, err)
+	}
+
+	// UDP: no reply at all.
+	query := newTestQueryEDNS(t, "www.telemetry.example.", dnsmessage.TypeA)
+	resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if resp != nil || !errors.Is(err, errDropped) {
+		t.Errorf(`handleQuery(UDP) = (%v, %v); want (nil, %v)`, resp, err, errDropped)
+	}
+
+	// TCP/DoT/DoH: minimal NXDOMAIN
+	resp, err = f.handleQuery(context.Background(), query, netip.Addr{}, false)
+	if !errors.Is(err, errDropped) {
+		t.Errorf(`handleQuery(TCP) = %v; want %v`, err, errDropped)
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil || dmsg.Header.RCode != dnsmessage.RCodeNameError {
+		t.Errorf(`response = %+v (%v); want NXDOMAIN`, dmsg.Header, err)
+	}
+	if edes, _ := GetExtendedErrors(resp); len(edes) != 0 {
+		t.Errorf(`EDE = %+v; want none`, edes)
+	}
+	if resolver.msg != nil {
+		t.Errorf(`dropped query forwarded`)
+	}
+
+	if m := f.Router.Explain("www.telemetry.example.", dnsmessage.TypeA, ""); !m.Dropped {
+		t.Errorf(`Explain() = %+v; want dropped`, m)
+	}
+	re := &RouteExport{Name: "both", Block: true, Drop: true}
+	if err := ValidateRouterExport(&RouterExport{Routes: []*RouteExport{re}}); err == nil {
+		t.Errorf(`ValidateRouterExport(block+drop) = nil; want error`)
+	}
+}
+
+func TestHandleQueryCacheTTLOverride(t *testing.T) {
+	query := newTestQuery(t, "www.lan.example.", dnsmessage.TypeA)
+	answer := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("www.lan.example."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+			TTL:   30,
+		},
+		Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}
+	resolver := &staticResolver{response: newTestResponse(t, query,
+		dnsmessage.RCodeSuccess, []dnsmessage.Resource{answer}, nil)}
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = resolver
+	cache := NewMemoryCache()
+	defer cache.Close()
+	f.Cache = cache
+	if err := f.Router.ReplaceRoutes([]*RouteExport{
+		{Name: "lan", Zones: []string{"lan.example"}, CacheTTLOverride: 86400},
+	}); err != nil {
+		t.Fatalf(`ReplaceRoutes() = %v; want nil`, err)
+	}
+	f.Router.routes[0].resolver = resolver
+
+	if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil || len(dmsg.Answers) != 1 {
+		t.Fatalf(`response = %+v (%v); want 1 answer`, dmsg, err)
+	}
+	if ttl := dmsg.Answers[0].Header.TTL; ttl != 86400 {
+		t.Errorf(`cached TTL = %d; want 86400`, ttl)
+	}
+
+	for _, ttl := range []int{-1, 86401} {
+		re := &RouteExport{Name: "bad", CacheTTLOverride: ttl}
+		if err := ValidateRouterExport(&RouterExport{Routes: []*RouteExport{re}}); err == nil {
+			t.Errorf(`ValidateRouterExport(cache_ttl_override=%d) = nil; want error`, ttl)
+		}
+		if err := f.Router.SetRoute(2, re); err == nil {
+			t.Errorf(`SetRoute(cache_ttl_override=%d) = nil; want error`, ttl)
+		}
+	}
+}
+
+func TestHandleQueryDefaultAction(t *testing.T) {
+	upstream := newTestQuery(t, "upstream.", dnsmessage.TypeA)
+	resolver := &recordingResolver{staticResolver: staticResolver{response: upstream}}
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = resolver
+	f.Router.routes[0] = &Route{name: "lan", resolver: resolver, trie: &dnstrie.DNSTrie{}}
+	f.Router.routes[0].trie.AddZone("home.example", struct{}{})
+	if err := f.SetDefaultAction("refuse"); err != nil {
+		t.Fatalf(`SetDefaultAction() = %v; want nil`, err)
+	}
+
+	// Not routed: refused without forwarding.
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if !errors.Is(err, errRefused) {
+		t.Errorf(`handleQuery() = %v; want %v`, err, errRefused)
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil || dmsg.Header.RCode != dnsmessage.RCodeRefused {
+		t.Errorf(`response = %+v (%v); want REFUSED`, dmsg.Header, err)
+	}
+	if resolver.msg != nil {
+		t.Errorf(`unmatched query forwarded; want refused`)
+	}
+
+	// Routed: forwarded.
+	query = newTestQuery(t, "nas.home.example.", dnsmessage.TypeA)
+	if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if resolver.msg == nil {
+		t.Errorf(`routed query not forwarded`)
+	}
+
+	// Forward (default): forwarded to the default resolver.
+	if err := f.SetDefaultAction(""); err != nil || f.DefaultAction != DefaultActionForward {
+		t.Fatalf(`SetDefaultAction("") = %v, %q; want nil, forward`, err, f.DefaultAction)
+	}
+	resolver.msg = nil
+	query = newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if resolver.msg == nil {
+		t.Errorf(`unmatched query not forwarded`)
+	}
+
+	if err := f.SetDefaultAction("drop"); err == nil {
+		t.Errorf(`SetDefaultAction("drop") = nil; want error`)
+	}
+}
+
+func TestHandleQueryNoResolver(t *testing.T) {
+	f := &Forwarder{myIP: &config.MyIP{}}
+	query := newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA)
+
+	for _, tc := range []struct {
+		rcode string
+		want  dnsmessage.RCode
+	}{
+		{"", dnsmessage.RCodeServerFailure},
+		{"servfail", dnsmessage.RCodeServerFailure},
+		{"refused", dnsmessage.RCodeRefused},
+	} {
+		if err := f.SetNoResolverRCode(tc.rcode); err != nil {
+			t.Fatalf(`SetNoResolverRCode(%q) = %v; want nil`, tc.rcode, err)
+		}
+		resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+		if err == nil {
+			t.Errorf(`handleQuery() = nil; want error`)
+		}
+		var dmsg dnsmessage.Message
+		if err := dmsg.Unpack(resp); err != nil || dmsg.Header.RCode != tc.want {
+			t.Errorf(`[%q] response = %+v (%v); want %v`, tc.rcode, dmsg.Header, err, tc.want)
+		}
+		edes, err := GetExtendedErrors(resp)
+		if err != nil || len(edes) != 1 ||
+			edes[0].InfoCode != ExtendedErrorNoReachableAuthority ||
+			edes[0].ExtraText != "no upstream configured" {
+			t.Errorf(`GetExtendedErrors() = (%v, %v); want no upstream configured`, edes, err)
+		}
+	}
+
+	// The zero value is ServFail.
+	f.NoResolverRCode = dnsmessage.RCodeSuccess
+	resp, _ := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if h, _, err := dnsmsg.RawMsg(resp).Question(); err != nil ||
+		h.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf(`response = %+v (%v); want SERVFAIL`, h, err)
+	}
+
+	if err := f.SetNoResolverRCode("nxdomain"); err == nil {
+		t.Errorf(`SetNoResolverRCode("nxdomain") = nil; want error`)
+	}
+}
+
+func TestNewErrorResponse(t *testing.T) {
+	// A weird query with the AA/TC bits, an answer record, and an OPT
+	// record with the ECS option.
+	rh := dnsmessage.ResourceHeader{}
+	rh.SetEDNS0(4096, 0, false)
+	name := dnsmessage.MustNewName("www.example.com.")
+	dmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               0x1234,
+			Authoritative:    true,
+			Truncated:        true,
+			RecursionDesired: true,
+			CheckingDisabled: true,
+			RCode:            dnsmessage.RCodeNameError,
+		},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		},
+		Answers: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{
+					Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET,
+				},
+				Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			},
+		},
+		Additionals: []dnsmessage.Resource{
+			{
+				Header: rh,
+				Body: &dnsmessage.OPTResource{
+					Options: []dnsmessage.Option{{Code: 8, Data: []byte{0, 1, 24, 0, 192, 0, 2}}},
+				},
+			},
+		},
+	}
+	query, err := dmsg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+
+	resp := newErrorResponse(query, dnsmessage.RCodeServerFailure, &ExtendedError{
+		InfoCode:  ExtendedErrorNetworkError,
+		ExtraText: "upstream query failed",
+	})
+	var rmsg dnsmessage.Message
+	if err := rmsg.Unpack(resp); err != nil {
+		t.Fatalf("failed to unpack response: %v", err)
+	}
+	want := dnsmessage.Header{
+		ID:                 0x1234,
+		Response:           true,
+		RecursionDesired:   true,
+		RecursionAvailable: true,
+		CheckingDisabled:   true,
+		RCode:              dnsmessage.RCodeServerFailure,
+	}
+	if rmsg.Header != want {
+		t.Errorf(`response header = %+v; want %+v`, rmsg.Header, want)
+	}
+	if len(rmsg.Questions) != 1 || rmsg.Questions[0] != dmsg.Questions[0] ||
+		len(rmsg.Answers) != 0 || len(rmsg.Authorities) != 0 || len(rmsg.Additionals) != 1 {
+		t.Errorf(`response = %+v; want only the question and OPT`, rmsg)
+	}
+	edes, err := GetExtendedErrors(resp)
+	if err != nil || len(edes) != 1 || edes[0].InfoCode != ExtendedErrorNetworkError {
+		t.Errorf(`GetExtendedErrors() = (%v, %v); want the network error`, edes, err)
+	}
+	if opt := rmsg.Additionals[0].Body.(*dnsmessage.OPTResource); len(opt.Options) != 1 {
+		t.Errorf(`OPT options = %v; want only the EDE`, opt.Options)
+	}
+
+	// Without EDNS: no OPT record.
+	query = newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	resp = newErrorResponse(query, dnsmessage.RCodeRefused, &ExtendedError{})
+	if err := rmsg.Unpack(resp); err != nil {
+		t.Fatalf("failed to unpack response: %v", err)
+	}
+	if !rmsg.Header.Response || rmsg.Header.RCode != dnsmessage.RCodeRefused ||
+		len(rmsg.Additionals) != 0 {
+		t.Errorf(`response = %+v; want REFUSED without OPT`, rmsg)
+	}
+}
+
+func TestStartListenInUse(t *testing.T) {
+	// Occupy the TCP port, so only the UDP listener can bind.
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen TCP: %v", err)
+	}
+	defer busy.Close()
+	address := busy.Addr().String()
+
+	f := &Forwarder{myIP: &config.MyIP{}}
+	if err := f.SetListen(address); err != nil {
+		t.Fatalf(`SetListen() = %v; want nil`, err)
+	}
+	f.ListenDoT = &ListenConfig{ // no cert
+		Addresses: []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:0")},
+	}
+
+	err = f.Start("")
+	var lerrs ListenErrors
+	if !errors.As(err, &lerrs) || len(lerrs) != 2 {
+		t.Fatalf(`Start() = %v; want 2 listen errors`, err)
+	}
+	if le := lerrs[0]; le.Protocol != "tcp" || le.Address.String() != address ||
+		!errors.Is(le, syscall.EADDRINUSE) {
+		t.Errorf(`Start() error[0] = %v; want tcp address in use`, le)
+	}
+	if le := lerrs[1]; le.Protocol != "dot" {
+		t.Errorf(`Start() error[1] = %v; want dot`, le)
+	}
+	var le *ListenError
+	if !errors.As(err, &le) || le.Protocol != "tcp" {
+		t.Errorf(`errors.As(*ListenError) = %v; want tcp`, le)
+	}
+
+	// The bound UDP listener must be closed upon failure.
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Fatalf(`UDP listener left open: %v`, err)
+	}
+	conn.Close()
+
+	// Best effort: start with the UDP listener only.
+	f.ListenBestEffort = true
+	if err := f.Start(""); err != nil {
+		t.Fatalf(`Start() best effort = %v; want nil`, err)
+	}
+	if conn, err := net.ListenPacket("udp", address); err == nil {
+		conn.Close()
+		t.Errorf(`UDP listener not started in best effort mode`)
+	}
+	f.Stop()
+}
+
+func TestStartListenAllFailed(t *testing.T) {
+	busyTCP, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen TCP: %v", err)
+	}
+	defer busyTCP.Close()
+	address := busyTCP.Addr().String()
+	busyUDP, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Skipf("failed to listen UDP at the same port: %v", err)
+	}
+	defer busyUDP.Close()
+
+	f := &Forwarder{myIP: &config.MyIP{}, ListenBestEffort: true}
+	if err := f.SetListen(address); err != nil {
+		t.Fatalf(`SetListen() = %v; want nil`, err)
+	}
+	err = f.Start("")
+	var lerrs ListenErrors
+	if !errors.As(err, &lerrs) || len(lerrs) != 2 ||
+		lerrs[0].Protocol != "udp" || lerrs[1].Protocol != "tcp" {
+		t.Errorf(`Start() = %v; want udp and tcp listen errors`, err)
+	}
+}
+
+// A resolver exporting the address.
+type addressResolver struct {
+	staticResolver
+	address string
+}
+
+func (r *addressResolver) Export() *ResolverExport {
+	return &ResolverExport{Name: "address", Address: r.address}
+}
+
+func TestForwarderStartSelfLoop(t *testing.T) {
+	tests := []struct {
+		listen   string
+		resolver string
+		loop     bool
+	}{
+		{"127.0.0.1:5353", "127.0.0.1:5353", true},
+		{"0.0.0.0:5353", "127.0.0.1:5353", true},
+		{"[::]:5353", "[::1]:5353", true},
+		{"[::]:5353", "127.0.0.1:5353", true},
+		{"127.0.0.1:5353", "127.0.0.1:53", false},
+		{"127.0.0.1:5353", "192.0.2.1:5353", false},
+		{"0.0.0.0:5353", "192.0.2.1:5353", false},
+	}
+	for _, tc := range tests {
+		f := &Forwarder{myIP: &config.MyIP{}}
+		if err := f.SetListen(tc.listen); err != nil {
+			t.Fatalf(`SetListen(%s) = %v; want nil`, tc.listen, err)
+		}
+		f.Router.resolver = &addressResolver{address: tc.resolver}
+		if err := f.checkSelfLoop(); (err != nil) != tc.loop {
+			t.Errorf(`[%s -> %s] checkSelfLoop() = %v; want loop=%t`,
+				tc.listen, tc.resolver, err, tc.loop)
+		}
+	}
+
+	// Checked against the routes as well, before binding.
+	f := &Forwarder{myIP: &config.MyIP{}}
+	if err := f.SetListen("127.0.0.1:5353"); err != nil {
+		t.Fatalf(`SetListen() = %v; want nil`, err)
+	}
+	f.Router.routes[0] = &Route{resolver: &addressResolver{address: "127.0.0.1:5353"}}
+	if err := f.Start(""); err == nil {
+		f.Stop()
+		t.Errorf(`Start() = nil; want the self-loop error`)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip", true},
+		{"br;q=1.0, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip;q=0.0, *", false},
+		{"deflate, br", false},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, dohPath, nil)
+		if tc.header != "" {
+			req.Header.Set("Accept-Encoding", tc.header)
+		}
+		if got := acceptsGzip(req); got != tc.want {
+			t.Errorf(`acceptsGzip(%q) = %t; want %t`, tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestHandleDoHGzip(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeTXT)
+	var answers []dnsmessage.Resource
+	for range 20 {
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName("www.example.com."),
+				Type:  dnsmessage.TypeTXT,
+				Class: dnsmessage.ClassINET,
+				TTL:   300,
+			},
+			Body: &dnsmessage.TXTResource{TXT: []string{strings.Repeat("x", 200)}},
+		})
+	}
+	large := newTestResponse(t, query, dnsmessage.RCodeSuccess, answers, nil)
+	small := newTestResponse(t, query, dnsmessage.RCodeSuccess, answers[:1], nil)
+
+	f := &Forwarder{myIP: &config.MyIP{}}
+	resolver := &staticResolver{}
+	f.Router.resolver = resolver
+	srv := httptest.NewServer(http.HandlerFunc(f.handleDoH))
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		response   []byte
+		noGzip     bool // client not accepting gzip
+		compressed bool
+	}{
+		{"large", large, false, true},
+		{"small", small, false, false},
+		{"large-no-gzip", large, true, false},
+	}
+	for _, tc := range tests {
+		resolver.response = tc.response
+		// NOTE: The transport asks for and decompresses gzip by itself.
+		client := &http.Client{
+			Transport: &http.Transport{DisableCompression: tc.noGzip},
+		}
+		resp, err := client.Post(srv.URL+dohPath, dohContentType, bytes.NewReader(query))
+		if err != nil {
+			t.Fatalf(`[%s] POST = %v; want nil`, tc.name, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf(`[%s] status = %d (%v); want 200`, tc.name, resp.StatusCode, err)
+		}
+		if resp.Uncompressed != tc.compressed {
+			t.Errorf(`[%s] compressed = %t; want %t`, tc.name, resp.Uncompressed, tc.compressed)
+		}
+		if !bytes.Equal(body, tc.response) {
+			t.Errorf(`[%s] body = %d bytes; want %d bytes of the response`,
+				tc.name, len(body), len(tc.response))
+		}
+	}
+}
+
+func TestHandleDoHServerName(t *testing.T) {
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = &answeringResolver{}
+	err := f.Router.SetRoute(1, &RouteExport{
+		Name:        "kids",
+		Zones:       []string{"example.com"},
+		Block:       true,
+		ServerNames: []string{"kids.dns.example"},
+	})
+	if err != nil {
+		t.Fatalf(`SetRoute() = %v; want nil`, err)
+	}
+
+	tests := []struct {
+		serverName string // empty: not over TLS
+		rcode      dnsmessage.RCode
+	}{
+		{"kids.dns.example", dnsmessage.RCodeNameError},
+		{"open.dns.example", dnsmessage.RCodeSuccess},
+		{"", dnsmessage.RCodeSuccess},
+	}
+	for _, tc := range tests {
+		query := newTestQuery(t, "www.example.com.", dnsmessage.TypeAAAA)
+		req := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(query))
+		req.Header.Set("Content-Type", dohContentType)
+		if tc.serverName != "" {
+			req.TLS = &tls.ConnectionState{ServerName: tc.serverName}
+		}
+		w := httptest.NewRecorder()
+		f.handleDoH(w, req)
+		var dmsg dnsmessage.Message
+		if err := dmsg.Unpack(w.Body.Bytes()); err != nil || dmsg.RCode != tc.rcode {
+			t.Errorf(`[%s] response = %+v (%v); want %s`, tc.serverName, dmsg.Header, err, tc.rcode)
+		}
+	}
+}
+
+func TestHandleQueryViews(t *testing.T) {
+	cache := NewMemoryCache()
+	defer cache.Close()
+	f := &Forwarder{myIP: &config.MyIP{}, Cache: cache}
+	f.Router.resolver = &answeringResolver{}
+	views := []struct {
+		serverName string
+		resolver   *gatedResolver
+		answer     string
+	}{
+		{"kids.dns.example", &gatedResolver{release: make(chan struct{})}, "192.0.2.10"},
+		{"open.dns.example", &gatedResolver{release: make(chan struct{})}, "192.0.2.20"},
+	}
+	for i, v := range views {
+		v.resolver.a = netip.MustParseAddr(v.answer).As4()
+		err := f.Router.SetRoute(i+1, &RouteExport{
+			Zones:       []string{"example.com"},
+			ServerNames: []string{v.serverName},
+		})
+		if err != nil {
+			t.Fatalf(`SetRoute(%d) = %v; want nil`, i+1, err)
+		}
+		f.Router.routes[i+1].resolver = v.resolver
+	}
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	ask := func(serverName, want string) {
+		ctx := withServerName(context.Background(), serverName)
+		resp, err := f.handleQuery(ctx, query, netip.Addr{}, false)
+		var dmsg dnsmessage.Message
+		if err == nil {
+			err = dmsg.Unpack(resp)
+		}
+		if err != nil || len(dmsg.Answers) != 1 {
+			t.Errorf(`[%s] handleQuery() = (%+v, %v); want 1 answer`, serverName, dmsg, err)
+			return
+		}
+		a := dmsg.Answers[0].Body.(*dnsmessage.AResource).A
+		if got := netip.AddrFrom4(a).String(); got != want {
+			t.Errorf(`[%s] answer = %s; want %s`, serverName, got, want)
+		}
+	}
+
+	// In flight: not coalesced across the views.
+	var wg sync.WaitGroup
+	for i, v := range views {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ask(v.serverName, v.answer)
+		}()
+		for deadline := time.Now().Add(time.Second); ; {
+			f.flights.lock.Lock()
+			n := len(f.flights.calls)
+			f.flights.lock.Unlock()
+			if n == i+1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf(`%d queries in flight; want %d`, n, i+1)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for _, v := range views {
+		close(v.resolver.release)
+	}
+	wg.Wait()
+
+	// Cached apart.
+	for _, v := range views {
+		ask(v.serverName, v.answer)
+		if n := v.resolver.queries.Load(); n != 1 {
+			t.Errorf(`[%s] upstream queries = %d; want 1`, v.serverName, n)
+		}
+	}
+	dumped := map[string]bool{}
+	for _, e := range f.DumpCache(10) {
+		dumped[e.View] = true
+	}
+	if len(dumped) != 2 || !dumped["kids.dns.example"] || !dumped["open.dns.example"] {
+		t.Errorf(`DumpCache() views = %v; want both server names`, dumped)
+	}
+}
@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Size limits of the inbound queries and the responses per transport.
+//
+
+package dns
+
+import (
+	"fmt"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/log"
+)
+
+const (
+	// Default max size of the UDP queries: the EDNS buffer size recommended
+	// by DNS Flag Day 2020 to avoid the IP fragmentation, which is plenty
+	// for a query even with the cookie and padding (RFC 7830) options.
+	defaultUDPQuerySize = 1232
+	// Default max size of the UDP responses, further limited by the
+	// payload size the client advertises (RFC 6891, Section 6.2.5).
+	defaultUDPResponseSize = 4096
+)
+
+// Max sizes (bytes) of the inbound queries and the responses per transport;
+// 0 to use the default.  The oversized queries are dropped (UDP), close the
+// connection (TCP/DoT), or are rejected with 413 (DoH); the oversized UDP
+// responses are truncated, while the TCP/DoT/DoH ones are answered SERVFAIL.
+// The TCP/DoT/DoH messages are bounded by the 2-byte length field (RFC 1035,
+// Section 4.2.2; RFC 8484, Section 6), thus the defaults of maxMessageSize.
+// Range: [512, 65535]
+type Limits struct {
+	UDPQuery    int // default: defaultUDPQuerySize
+	UDPResponse int // default: defaultUDPResponseSize
+	TCPQuery    int // TCP/DoT; default: maxMessageSize
+	TCPResponse int // TCP/DoT; default: maxMessageSize
+	DoHQuery    int // default: maxMessageSize
+	DoHResponse int // default: maxMessageSize
+}
+
+// Set the size limits (limits), with the unset (i.e., 0) ones defaulted.
+func (f *Forwarder) SetLimits(limits Limits) error {
+	l := limits.withDefaults()
+	for _, v := range []struct {
+		name string
+		size int
+	}{
+		{"UDP query", l.UDPQuery},
+		{"UDP response", l.UDPResponse},
+		{"TCP query", l.TCPQuery},
+		{"TCP response", l.TCPResponse},
+		{"DoH query", l.DoHQuery},
+		{"DoH response", l.DoHResponse},
+	} {
+		if v.size < minUDPSize || v.size > maxMessageSize {
+			return fmt.Errorf("invalid %s size limit %d: out of range [%d, %d]",
+				v.name, v.size, minUDPSize, maxMessageSize)
+		}
+	}
+	f.Limits = l
+	return nil
+}
+
+// Get the limits with the unset ones defaulted.
+func (l Limits) withDefaults() Limits {
+	if l.UDPQuery == 0 {
+		l.UDPQuery = defaultUDPQuerySize
+	}
+	if l.UDPResponse == 0 {
+		l.UDPResponse = defaultUDPResponseSize
+	}
+	if l.TCPQuery == 0 {
+		l.TCPQuery = maxMessageSize
+	}
+	if l.TCPResponse == 0 {
+		l.TCPResponse = maxMessageSize
+	}
+	if l.DoHQuery == 0 {
+		l.DoHQuery = maxMessageSize
+	}
+	if l.DoHResponse == 0 {
+		l.DoHResponse = maxMessageSize
+	}
+	return l
+}
+
+// Answer SERVFAIL to the query (qmsg) if the response (resp) over TCP/DoT/DoH
+// exceeds the limit (maxSize), where truncation doesn't help.
+func limitResponse(qmsg, resp []byte, maxSize int) []byte {
+	if len(resp) <= maxSize {
+		return resp
+	}
+	log.Warnf("response too large: length=%d, limit=%d", len(resp), maxSize)
+	return newErrorResponse(qmsg, dnsmessage.RCodeServerFailure,
+		&ExtendedError{
+			InfoCode:  ExtendedErrorOther,
+			ExtraText: "response too large",
+		})
+}
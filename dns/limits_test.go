@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Size limits - tests
+//
+
+package dns
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+)
+
+func TestSetLimits(t *testing.T) {
+	f := &Forwarder{}
+	if err := f.SetLimits(Limits{}); err != nil {
+		t.Fatalf(`SetLimits({}) = %v; want nil`, err)
+	}
+	want := Limits{1232, 4096, 65535, 65535, 65535, 65535}
+	if f.Limits != want {
+		t.Errorf(`Limits = %+v; want %+v`, f.Limits, want)
+	}
+
+	if err := f.SetLimits(Limits{UDPQuery: 512, TCPResponse: 16384}); err != nil {
+		t.Fatalf(`SetLimits() = %v; want nil`, err)
+	}
+	if f.Limits.UDPQuery != 512 || f.Limits.TCPResponse != 16384 ||
+		f.Limits.UDPResponse != defaultUDPResponseSize {
+		t.Errorf(`Limits = %+v; want UDPQuery=512, TCPResponse=16384`, f.Limits)
+	}
+
+	for _, l := range []Limits{
+		{UDPQuery: 511},
+		{UDPResponse: -1},
+		{TCPQuery: 65536},
+		{DoHResponse: 100},
+	} {
+		if err := f.SetLimits(l); err == nil {
+			t.Errorf(`SetLimits(%+v) = nil; want error`, l)
+		}
+	}
+}
+
+func TestLimitResponse(t *testing.T) {
+	query := newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeTXT)
+	resp := make([]byte, 1000)
+	copy(resp, query)
+	if r := limitResponse(query, resp, 1000); !bytes.Equal(r, resp) {
+		t.Errorf(`limitResponse() modified the response within the limit`)
+	}
+
+	r := limitResponse(query, resp, 999)
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(r); err != nil || dmsg.Header.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf(`limitResponse() = %+v (%v); want SERVFAIL`, dmsg.Header, err)
+	}
+}
+
+// Make a query padded (RFC 7830) to the size (size).
+func newTestQueryPadded(t *testing.T, name string, size int) []byte {
+	t.Helper()
+	query := newTestQueryEDNS(t, name, dnsmessage.TypeA)
+	return newTestQueryEDNS(t, name, dnsmessage.TypeA, dnsmessage.Option{
+		Code: 12, // padding
+		Data: make([]byte, size-len(query)-4),
+	})
+}
+
+func TestForwarderEndToEndLimits(t *testing.T) {
+	upstream := newTestUpstream(t, [4]byte{192, 0, 2, 53})
+	f := newTestForwarderE2E(t, upstream)
+	if err := f.SetLimits(Limits{UDPQuery: 800, TCPQuery: 800}); err != nil {
+		t.Fatalf(`SetLimits() = %v; want nil`, err)
+	}
+
+	conn, ln := listenUDPTCP(t)
+	address := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	conn.Close()
+	ln.Close()
+	if err := f.SetListen(address.String()); err != nil {
+		t.Fatalf(`SetListen() = %v; want nil`, err)
+	}
+	if err := f.Start(""); err != nil {
+		t.Fatalf(`Start() = %v; want nil`, err)
+	}
+	defer f.Stop()
+
+	// Larger than 512 bytes but within the limits: answered.
+	for _, network := range []string{"udp", "tcp"} {
+		query := newTestQueryPadded(t, "www.example.com.", 700)
+		resp := exchange(t, network, address, query)
+		checkE2EResponse(t, upstream, "www.example.com.", query, resp)
+	}
+
+	// Beyond the limits: dropped, or the connection closed.
+	query := newTestQueryPadded(t, "www.example.com.", 900)
+	for _, network := range []string{"udp", "tcp"} {
+		conn, err := net.Dial(network, address.String())
+		if err != nil {
+			t.Fatalf("failed to dial %s: %v", network, err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+		if network == "tcp" {
+			if err := writeTCPMsg(conn, query); err != nil {
+				t.Fatalf("failed to send query: %v", err)
+			}
+			if resp, err := readTCPMsg(conn); err == nil {
+				t.Errorf(`TCP response = %x; want connection closed`, resp)
+			}
+		} else {
+			if _, err := conn.Write(query); err != nil {
+				t.Fatalf("failed to send query: %v", err)
+			}
+			buf := make([]byte, 1500)
+			if n, err := conn.Read(buf); err == nil {
+				t.Errorf(`UDP response = %x; want dropped`, buf[:n])
+			}
+		}
+	}
+}
+
+func TestHandleDoHLimits(t *testing.T) {
+	upstream := newTestQuery(t, "upstream.", dnsmessage.TypeA)
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = &staticResolver{response: upstream}
+	if err := f.SetLimits(Limits{DoHQuery: 600}); err != nil {
+		t.Fatalf(`SetLimits() = %v; want nil`, err)
+	}
+
+	tests := []struct {
+		size   int
+		status int
+	}{
+		{600, http.StatusOK},
+		{601, http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range tests {
+		query := newTestQueryPadded(t, "www.example.com.", tc.size)
+		req := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(query))
+		req.Header.Set("Content-Type", dohContentType)
+		req.RemoteAddr = netip.MustParseAddrPort("192.0.2.1:12345").String()
+		w := httptest.NewRecorder()
+		f.handleDoH(w, req)
+		if w.Code != tc.status {
+			t.Errorf(`[%d] status = %d; want %d`, tc.size, w.Code, tc.status)
+		}
+	}
+}
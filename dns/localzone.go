@@ -0,0 +1,285 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Locally served zones: private reverse zones and special-use names, which
+// should never leak to the public upstreams.
+//
+
+package dns
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/util/dnsmsg"
+	"kexuedns/util/dnstrie"
+)
+
+// Policy to answer the queries in the locally served zones.
+type LocalZonePolicy string
+
+const (
+	// Answer NXDOMAIN authoritatively as AS112 does. (default)
+	LocalZoneNXDomain LocalZonePolicy = "nxdomain"
+	// Answer REFUSED.
+	LocalZoneRefuse LocalZonePolicy = "refuse"
+	// Forward to the upstream as usual, i.e., disable the local zones.
+	LocalZoneForward LocalZonePolicy = "forward"
+)
+
+const (
+	// Default TTL of the locally synthesized records.
+	defaultLocalZoneTTL = 10800 * time.Second // SOA minimum per RFC 6303
+	// Default TTL of the synthesized negative answers, e.g., of the blocked
+	// queries, so that the clients cache them rather than asking again.
+	defaultSynthTTL = 300 * time.Second
+	maxSynthTTL     = 7 * 24 * time.Hour
+	// Zone for loopback names, which is always answered with the loopback
+	// addresses (RFC 6761, Section 6.3) unless the policy is forward.
+	localhostZone = "localhost"
+	// Reverse zone of the IPv4 loopback addresses (127.0.0.0/8), whose
+	// PTR is always answered with localhost unless the policy is forward.
+	loopbackV4Zone = "127.in-addr.arpa"
+)
+
+// Reverse name of the IPv6 loopback address (::1), like loopbackV4Zone.
+var loopbackV6Zone = "1." + strings.Repeat("0.", 31) + "ip6.arpa"
+
+// The locally served zones (RFC 6303, RFC 6761, RFC 6762, RFC 7686,
+// RFC 7793, RFC 8375).
+// NOTE: The routes take precedence, so that e.g., the private reverse zones
+// can still be routed to a local resolver.
+var localZones = func() *dnstrie.DNSTrie {
+	zones := []string{
+		// RFC 1918 and other IPv4 reverse zones (RFC 6303, RFC 7793)
+		"10.in-addr.arpa",
+		"168.192.in-addr.arpa",
+		"0.in-addr.arpa",
+		loopbackV4Zone,
+		"254.169.in-addr.arpa",
+		"2.0.192.in-addr.arpa",
+		"100.51.198.in-addr.arpa",
+		"113.0.203.in-addr.arpa",
+		"255.255.255.255.in-addr.arpa",
+		// IPv6 reverse zones (RFC 6303)
+		strings.Repeat("0.", 32) + "ip6.arpa", // unspecified (::)
+		loopbackV6Zone,                        // loopback (::1)
+		"d.f.ip6.arpa",                        // ULA (fd00::/8)
+		"8.e.f.ip6.arpa",                      // link-local (fe80::/10)
+		"9.e.f.ip6.arpa",                      // link-local
+		"a.e.f.ip6.arpa",                      // link-local
+		"b.e.f.ip6.arpa",                      // link-local
+		"8.b.d.0.1.0.0.2.ip6.arpa",            // documentation (2001:db8::/32)
+		// Special-use names
+		localhostZone, // RFC 6761
+		"invalid",     // RFC 6761
+		"test",        // RFC 6761
+		"local",       // RFC 6762 (mDNS)
+		"onion",       // RFC 7686
+		"home.arpa",   // RFC 8375
+	}
+	for i := 16; i <= 31; i++ {
+		zones = append(zones, strconv.Itoa(i)+".172.in-addr.arpa")
+	}
+	for i := 64; i <= 127; i++ {
+		zones = append(zones, strconv.Itoa(i)+".100.in-addr.arpa")
+	}
+
+	trie := &dnstrie.DNSTrie{}
+	for _, z := range zones {
+		trie.AddZone(z, z)
+	}
+	return trie
+}()
+
+// Set the policy for the locally served zones; empty to use the default.
+func (f *Forwarder) SetLocalZonePolicy(policy string) error {
+	switch p := LocalZonePolicy(policy); p {
+	case "":
+		f.LocalZones = LocalZoneNXDomain
+	case LocalZoneNXDomain, LocalZoneRefuse, LocalZoneForward:
+		f.LocalZones = p
+	default:
+		return fmt.Errorf("invalid local zone policy: %s", policy)
+	}
+	return nil
+}
+
+// Set the TTLs (seconds) of the synthesized answers, i.e., the default one
+// (ttl) for the negative answers of the blocked queries, and the one
+// (localTTL) overriding it for the locally served zones (including
+// localhost); 0 to use the defaults.
+func (f *Forwarder) SetSynthTTL(ttl, localTTL int) error {
+	synth := time.Duration(ttl) * time.Second
+	if synth == 0 {
+		synth = defaultSynthTTL
+	}
+	if synth < 0 || synth > maxSynthTTL {
+		return fmt.Errorf("invalid synthesized TTL %d: out of range [1, %d]",
+			ttl, int(maxSynthTTL.Seconds()))
+	}
+	local := time.Duration(localTTL) * time.Second
+	if local == 0 {
+		local = defaultLocalZoneTTL
+	}
+	if local < 0 || local > maxSynthTTL {
+		return fmt.Errorf("invalid local zone TTL %d: out of range [1, %d]",
+			localTTL, int(maxSynthTTL.Seconds()))
+	}
+	f.SynthTTL = synth
+	f.LocalZoneTTL = local
+	return nil
+}
+
+// Get the TTL (seconds) of the synthesized negative answers.
+func (f *Forwarder) synthTTL() uint32 {
+	if f.SynthTTL == 0 {
+		return uint32(defaultSynthTTL.Seconds())
+	}
+	return uint32(f.SynthTTL.Seconds())
+}
+
+// Get the TTL (seconds) of the answers of the locally served zones.
+func (f *Forwarder) localZoneTTL() uint32 {
+	if f.LocalZoneTTL == 0 {
+		return uint32(defaultLocalZoneTTL.Seconds())
+	}
+	return uint32(f.LocalZoneTTL.Seconds())
+}
+
+// Answer the query (qmsg) if it's in a locally served zone.
+// Return the response and true if answered.
+func (f *Forwarder) answerLocal(qmsg []byte, question *dnsmessage.Question) ([]byte, bool) {
+	policy := f.LocalZones
+	if policy == "" {
+		policy = LocalZoneNXDomain
+	}
+	if policy == LocalZoneForward {
+		return nil, false
+	}
+
+	v, ok := localZones.Match(question.Name.String())
+	if !ok {
+		return nil, false
+	}
+	zone := v.(string)
+	ttl := f.localZoneTTL()
+
+	query, err := dnsmsg.NewQueryMsg(qmsg)
+	if err != nil {
+		return nil, false
+	}
+
+	var resp []byte
+	switch {
+	case zone == localhostZone:
+		resp, err = newLocalhostResponse(query, ttl)
+	case zone == loopbackV4Zone || zone == loopbackV6Zone:
+		resp, err = newLoopbackPTRResponse(query, zone, ttl)
+	case policy == LocalZoneRefuse:
+		resp, err = newLocalResponse(query, dnsmessage.RCodeRefused, nil, nil)
+	default:
+		resp, err = newLocalResponse(query, dnsmessage.RCodeNameError, nil,
+			[]dnsmessage.Resource{newLocalSOA(zone, ttl)})
+	}
+	if err != nil {
+		return nil, false
+	}
+	return resp, true
+}
+
+// Answer the loopback addresses for the localhost names, and NODATA for the
+// other types (RFC 6761, Section 6.3), with the TTL (ttl).
+func newLocalhostResponse(query *dnsmsg.QueryMsg, ttl uint32) ([]byte, error) {
+	b := NewResponseBuilder(query).Authoritative()
+	switch query.Question.Type {
+	case dnsmessage.TypeA:
+		b.AddA(netip.AddrFrom4([4]byte{127, 0, 0, 1}), ttl)
+	case dnsmessage.TypeAAAA:
+		b.AddAAAA(netip.IPv6Loopback(), ttl)
+	default:
+		soa := newLocalSOA(localhostZone, ttl)
+		b.NODATA(&soa)
+	}
+	return b.Build()
+}
+
+// Answer localhost for the PTR queries of the loopback addresses in the
+// reverse zone (zone), NODATA for the other types and the empty
+// non-terminals (e.g., "0.127.in-addr.arpa"), and NXDOMAIN otherwise, with
+// the TTL (ttl).
+func newLoopbackPTRResponse(query *dnsmsg.QueryMsg, zone string, ttl uint32) ([]byte, error) {
+	name := strings.ToLower(query.Question.Name.String())
+	labels := []string{}
+	if prefix, ok := strings.CutSuffix(name, "."+zone+"."); ok {
+		labels = strings.Split(prefix, ".")
+	}
+
+	exists := false
+	if zone == loopbackV4Zone {
+		switch {
+		case len(labels) < 3:
+			exists = true // empty non-terminal
+		case len(labels) == 3:
+			slices.Reverse(labels)
+			_, err := netip.ParseAddr("127." + strings.Join(labels, "."))
+			exists = err == nil
+		}
+	} else {
+		exists = len(labels) == 0
+	}
+	if !exists {
+		return newLocalResponse(query, dnsmessage.RCodeNameError, nil,
+			[]dnsmessage.Resource{newLocalSOA(zone, ttl)})
+	}
+
+	isHost := len(labels) == 3 || zone == loopbackV6Zone
+	if isHost && query.Question.Type == dnsmessage.TypePTR {
+		answer := dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  query.Question.Name,
+				Type:  dnsmessage.TypePTR,
+				Class: dnsmessage.ClassINET,
+				TTL:   ttl,
+			},
+			Body: &dnsmessage.PTRResource{
+				PTR: dnsmessage.MustNewName(localhostZone + "."),
+			},
+		}
+		return newLocalResponse(query, dnsmessage.RCodeSuccess,
+			[]dnsmessage.Resource{answer}, nil)
+	}
+	return newLocalResponse(query, dnsmessage.RCodeSuccess, nil,
+		[]dnsmessage.Resource{newLocalSOA(zone, ttl)})
+}
+
+// Make the SOA record of the locally served zone (zone) for the negative
+// answers, as recommended by RFC 6303, Section 3, where both the TTL and
+// the negative caching TTL (i.e., minimum) are the TTL (ttl).
+func newLocalSOA(zone string, ttl uint32) dnsmessage.Resource {
+	name := dnsmessage.MustNewName(zone + ".")
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  name,
+			Type:  dnsmessage.TypeSOA,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		},
+		Body: &dnsmessage.SOAResource{
+			NS:      name,
+			MBox:    dnsmessage.MustNewName("nobody.invalid."),
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   1200,
+			Expire:  604800,
+			MinTTL:  ttl,
+		},
+	}
+}
@@ -0,0 +1,196 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Locally served zones - tests
+//
+
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+	"kexuedns/util/dnsmsg"
+	"kexuedns/util/dnstrie"
+)
+
+func TestLocalZones(t *testing.T) {
+	upstream := newTestQuery(t, "upstream.", dnsmessage.TypeA)
+	tests := []struct {
+		policy LocalZonePolicy
+		name   string
+		qtype  dnsmessage.Type
+		rcode  dnsmessage.RCode
+		nans   int
+		local  bool
+	}{
+		{"", "1.1.168.192.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeNameError, 0, true},
+		{"", "4.3.2.10.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeNameError, 0, true},
+		{"", "1.0.20.172.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeNameError, 0, true},
+		{"", "1.0.32.172.in-addr.arpa.", dnsmessage.TypePTR, 0, 0, false},
+		{"", "printer.local.", dnsmessage.TypeA, dnsmessage.RCodeNameError, 0, true},
+		{"", "localhost.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1, true},
+		{"", "a.localhost.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 1, true},
+		{"", "localhost.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, 0, true},
+		{"", "1.0.0.127.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, 1, true},
+		{"", "2.1.0.127.In-Addr.Arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, 1, true},
+		{"", "1.0.0.127.in-addr.arpa.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 0, true},
+		{"", "0.127.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, 0, true},
+		{"", "x.0.0.127.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeNameError, 0, true},
+		{"", "1.1.0.0.127.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeNameError, 0, true},
+		{"", "1." + strings.Repeat("0.", 31) + "ip6.arpa.", dnsmessage.TypePTR,
+			dnsmessage.RCodeSuccess, 1, true},
+		{"", "x.1." + strings.Repeat("0.", 31) + "ip6.arpa.", dnsmessage.TypePTR,
+			dnsmessage.RCodeNameError, 0, true},
+		{"", "www.example.com.", dnsmessage.TypeA, 0, 0, false},
+		{LocalZoneRefuse, "x.test.", dnsmessage.TypeA, dnsmessage.RCodeRefused, 0, true},
+		{LocalZoneRefuse, "localhost.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1, true},
+		{LocalZoneForward, "x.test.", dnsmessage.TypeA, 0, 0, false},
+		{LocalZoneForward, "localhost.", dnsmessage.TypeA, 0, 0, false},
+		{LocalZoneRefuse, "1.0.0.127.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, 1, true},
+		{LocalZoneForward, "1.0.0.127.in-addr.arpa.", dnsmessage.TypePTR, 0, 0, false},
+	}
+	for i, tc := range tests {
+		f := &Forwarder{myIP: &config.MyIP{}}
+		if err := f.SetLocalZonePolicy(string(tc.policy)); err != nil {
+			t.Fatalf(`[%d] SetLocalZonePolicy() = %v; want nil`, i, err)
+		}
+		f.Router.resolver = &staticResolver{response: upstream}
+
+		query := newTestQuery(t, tc.name, tc.qtype)
+		resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+		if err != nil {
+			t.Fatalf(`[%d] handleQuery() = %v; want nil`, i, err)
+		}
+		var dmsg dnsmessage.Message
+		if err := dmsg.Unpack(resp); err != nil {
+			t.Fatalf(`[%d] failed to unpack response: %v`, i, err)
+		}
+		local := dmsg.Header.Authoritative
+		if local != tc.local {
+			t.Errorf(`[%d] %s answered locally = %v; want %v`, i, tc.name, local, tc.local)
+			continue
+		}
+		if !local {
+			continue
+		}
+		if dmsg.Header.RCode != tc.rcode || len(dmsg.Answers) != tc.nans {
+			t.Errorf(`[%d] %s response = %+v; want RCode=%v with %d answers`,
+				i, tc.name, dmsg, tc.rcode, tc.nans)
+		}
+		if tc.rcode == dnsmessage.RCodeNameError &&
+			(len(dmsg.Authorities) != 1 || dmsg.Authorities[0].Header.Type != dnsmessage.TypeSOA) {
+			t.Errorf(`[%d] %s authorities = %+v; want SOA`, i, tc.name, dmsg.Authorities)
+		}
+		if tc.qtype == dnsmessage.TypePTR && tc.nans == 1 {
+			if ptr, ok := dmsg.Answers[0].Body.(*dnsmessage.PTRResource); !ok ||
+				ptr.PTR.String() != "localhost." {
+				t.Errorf(`[%d] %s answer = %+v; want PTR localhost.`, i, tc.name, dmsg.Answers[0])
+			}
+		}
+	}
+
+	f := &Forwarder{}
+	if err := f.SetLocalZonePolicy("bogus"); err == nil {
+		t.Errorf(`SetLocalZonePolicy("bogus") = nil; want error`)
+	}
+}
+
+func TestLocalZonesRouted(t *testing.T) {
+	// An explicit route takes precedence over the local zones.
+	query := newTestQuery(t, "1.1.168.192.in-addr.arpa.", dnsmessage.TypePTR)
+	upstream := slices.Clone(query)
+	dnsmsg.RawMsg(upstream).SetFlags(dnsmsg.FlagQR|dnsmsg.FlagRA, 0)
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.routes[1] = &Route{
+		name:     "lan",
+		resolver: &staticResolver{response: upstream},
+		trie:     &dnstrie.DNSTrie{},
+	}
+	f.Router.routes[1].trie.AddZone("168.192.in-addr.arpa", struct{}{})
+
+	resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if string(resp) != string(upstream) {
+		t.Errorf(`handleQuery() answered locally; want routed`)
+	}
+}
+
+func TestSynthTTL(t *testing.T) {
+	upstream := newTestQuery(t, "upstream.", dnsmessage.TypeA)
+	newForwarder := func(t *testing.T) *Forwarder {
+		f := &Forwarder{myIP: &config.MyIP{}}
+		f.Router.resolver = &staticResolver{response: upstream}
+		if err := f.Router.ReplaceRoutes([]*RouteExport{
+			{Name: "ads", Zones: []string{"**.ads.example"}, Block: true},
+		}); err != nil {
+			t.Fatalf(`ReplaceRoutes() = %v; want nil`, err)
+		}
+		file := writeBlocklist(t, "tracker.txt", "Tracker.Example.\n")
+		if _, err := f.Router.ReloadBlocklist([]string{file}); err != nil {
+			t.Fatalf(`ReloadBlocklist() = %v; want nil`, err)
+		}
+		return f
+	}
+	query := func(t *testing.T, f *Forwarder, name string) *dnsmessage.Message {
+		q := newTestQuery(t, name, dnsmessage.TypeA)
+		resp, _ := f.handleQuery(context.Background(), q, netip.Addr{}, false)
+		var dmsg dnsmessage.Message
+		if err := dmsg.Unpack(resp); err != nil {
+			t.Fatalf(`failed to unpack response: %v`, err)
+		}
+		return &dmsg
+	}
+	checkSOA := func(t *testing.T, dmsg *dnsmessage.Message, zone string, ttl uint32) {
+		t.Helper()
+		if len(dmsg.Authorities) != 1 {
+			t.Fatalf(`authorities = %+v; want SOA`, dmsg.Authorities)
+		}
+		soa, ok := dmsg.Authorities[0].Body.(*dnsmessage.SOAResource)
+		if !ok || dmsg.Authorities[0].Header.Name.String() != zone ||
+			dmsg.Authorities[0].Header.TTL != ttl || soa.MinTTL != ttl {
+			t.Errorf(`authority = %+v; want SOA %s with TTL %d`, dmsg.Authorities[0], zone, ttl)
+		}
+	}
+
+	tests := []struct {
+		ttl, localTTL         int
+		wantTTL, wantLocalTTL uint32
+	}{
+		{0, 0, 300, 10800},
+		{60, 86400, 60, 86400},
+	}
+	for _, tc := range tests {
+		f := newForwarder(t)
+		if err := f.SetSynthTTL(tc.ttl, tc.localTTL); err != nil {
+			t.Fatalf(`SetSynthTTL(%d, %d) = %v; want nil`, tc.ttl, tc.localTTL, err)
+		}
+		checkSOA(t, query(t, f, "www.ads.example."), "ads.example.", tc.wantTTL)
+		checkSOA(t, query(t, f, "www.tracker.example."), "Tracker.Example.", tc.wantTTL)
+		checkSOA(t, query(t, f, "printer.local."), "local.", tc.wantLocalTTL)
+		dmsg := query(t, f, "localhost.")
+		if len(dmsg.Answers) != 1 || dmsg.Answers[0].Header.TTL != tc.wantLocalTTL {
+			t.Errorf(`localhost answers = %+v; want TTL %d`, dmsg.Answers, tc.wantLocalTTL)
+		}
+	}
+
+	// Unset: the defaults.
+	f := &Forwarder{}
+	if ttl, local := f.synthTTL(), f.localZoneTTL(); ttl != 300 || local != 10800 {
+		t.Errorf(`TTLs = (%d, %d); want (300, 10800)`, ttl, local)
+	}
+	for _, ttls := range [][2]int{{-1, 0}, {0, -1}, {7*86400 + 1, 0}, {0, 7*86400 + 1}} {
+		if err := f.SetSynthTTL(ttls[0], ttls[1]); err == nil {
+			t.Errorf(`SetSynthTTL(%d, %d) = nil; want error`, ttls[0], ttls[1])
+		}
+	}
+}
@@ -0,0 +1,740 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// DNS message helpers for the synthesized responses.
+//
+
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/util/dnsmsg"
+)
+
+const (
+	// UDP payload size to advertise in the synthesized responses.
+	localPayloadSize = 1232
+
+	// EDNS option code for the TCP keepalive, RFC 7828
+	optionCodeTCPKeepalive = 11
+	// EDNS option code for the Extended DNS Errors (EDE), RFC 8914
+	optionCodeExtendedError = 15
+	// EDNS option code for the loop detection nonce, taken from the range
+	// for local/experimental use (RFC 6891, Section 9)
+	optionCodeLoopNonce = 65001
+	// EDNS option code for the routing information (see RouteInfo), also
+	// from the local/experimental range; the clients ask for it by sending
+	// the option empty.
+	optionCodeRouteInfo = 65002
+	// Maximum length of the EXTRA-TEXT to keep the responses small.
+	maxExtraTextLength = 128
+)
+
+// INFO-CODE of the Extended DNS Errors (RFC 8914).
+// Only the ones used by this forwarder are defined.
+type ExtendedErrorCode uint16
+
+const (
+	ExtendedErrorOther                ExtendedErrorCode = 0
+	ExtendedErrorStaleAnswer          ExtendedErrorCode = 3
+	ExtendedErrorNotReady             ExtendedErrorCode = 14
+	ExtendedErrorBlocked              ExtendedErrorCode = 15
+	ExtendedErrorProhibited           ExtendedErrorCode = 18
+	ExtendedErrorNotSupported         ExtendedErrorCode = 21
+	ExtendedErrorNoReachableAuthority ExtendedErrorCode = 22
+	ExtendedErrorNetworkError         ExtendedErrorCode = 23
+)
+
+type ExtendedError struct {
+	InfoCode  ExtendedErrorCode
+	ExtraText string // human readable message; optional
+}
+
+// Add the Extended DNS Error (ede) to the message (msg) and return the
+// rebuilt message.
+// NOTE: EDE is carried in the OPT record, so the message is returned as is
+// if it has no OPT record, i.e., the client doesn't support EDNS.
+// The existing EDNS options (including any EDE ones) are all preserved.
+func AddExtendedError(msg []byte, ede *ExtendedError) ([]byte, error) {
+	if ede == nil {
+		return msg, nil
+	}
+	return addOption(msg, extendedErrorOption(ede))
+}
+
+// Add the EDNS option (option) to the message (msg) and return the rebuilt
+// message, or the message as is if it has no OPT record.
+func addOption(msg []byte, option dnsmessage.Option) ([]byte, error) {
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(msg); err != nil {
+		return nil, err
+	}
+
+	var opt *dnsmessage.OPTResource
+	for _, r := range dmsg.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			opt, _ = r.Body.(*dnsmessage.OPTResource)
+			break
+		}
+	}
+	if opt == nil {
+		return msg, nil
+	}
+
+	opt.Options = append(opt.Options, option)
+	return dmsg.Pack()
+}
+
+// Add the edns-tcp-keepalive option (RFC 7828) with the idle timeout
+// (timeout) to the response (msg) sent over TCP.
+func addTCPKeepalive(msg []byte, timeout time.Duration) ([]byte, error) {
+	// Option data: the timeout in units of 100 milliseconds (2B)
+	units := min(timeout/(100*time.Millisecond), math.MaxUint16)
+	data := binary.BigEndian.AppendUint16(nil, uint16(units))
+	return addOption(msg, dnsmessage.Option{
+		Code: optionCodeTCPKeepalive,
+		Data: data,
+	})
+}
+
+// Remove the edns-tcp-keepalive option from the query (msg), because it's
+// hop-by-hop and must not be forwarded to the upstreams (which may be UDP).
+// Return the query and whether the option was present.
+func takeTCPKeepalive(msg []byte) ([]byte, bool) {
+	if _, ok := dnsmsg.RawMsg(msg).Option(optionCodeTCPKeepalive); !ok {
+		return msg, false
+	}
+	qmsg, err := removeOption(msg, optionCodeTCPKeepalive)
+	if err != nil {
+		return msg, true // let the later handling reject it
+	}
+	return qmsg, true
+}
+
+// Remove the EDNS option (code) from the query (msg).
+func removeOption(msg []byte, code uint16) ([]byte, error) {
+	query, err := dnsmsg.NewQueryMsg(msg)
+	if err != nil {
+		return nil, err
+	}
+	query.RemoveOption(code)
+	return query.Build()
+}
+
+// Remove the EDNS (i.e., the OPT record) from the query (msg); the query is
+// returned as is if without it.
+func removeEDNS(msg []byte) ([]byte, error) {
+	query, err := dnsmsg.NewQueryMsg(msg)
+	if err != nil {
+		return nil, err
+	}
+	if query.OPT.Header == nil {
+		return msg, nil
+	}
+	query.OPT.Header, query.OPT.Options = nil, nil
+	return query.Build()
+}
+
+// Routing information of a query for debugging, i.e., the matched route and
+// the resolver, which is attached to the response in the private EDNS option
+// (optionCodeRouteInfo) if the client asks for it.
+// Option data: index (1B; signed, -1 for the default), route name length
+// (1B), route name, resolver name length (1B), resolver name.
+type RouteInfo struct {
+	Index    int    // -1 if the default
+	Route    string // route name
+	Resolver string // resolver name, or address if unnamed
+}
+
+// Make the routing information option (ri); the names are cut to 255 bytes.
+func routeInfoOption(ri *RouteInfo) dnsmessage.Option {
+	data := []byte{byte(int8(ri.Index))}
+	for _, name := range []string{ri.Route, ri.Resolver} {
+		name = name[:min(len(name), math.MaxUint8)]
+		data = append(data, byte(len(name)))
+		data = append(data, name...)
+	}
+	return dnsmessage.Option{Code: optionCodeRouteInfo, Data: data}
+}
+
+// Get the routing information from the response (msg), with a boolean
+// indicating whether it's found and valid.
+func GetRouteInfo(msg []byte) (*RouteInfo, bool) {
+	data, ok := dnsmsg.RawMsg(msg).Option(optionCodeRouteInfo)
+	if !ok || len(data) < 1 {
+		return nil, false
+	}
+	ri := &RouteInfo{Index: int(int8(data[0]))}
+	data = data[1:]
+	for _, name := range []*string{&ri.Route, &ri.Resolver} {
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return nil, false
+		}
+		n := int(data[0])
+		*name = string(data[1 : 1+n])
+		data = data[1+n:]
+	}
+	return ri, true
+}
+
+// Get the Extended DNS Errors from the message (msg).
+func GetExtendedErrors(msg []byte) ([]*ExtendedError, error) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return nil, err
+	}
+
+	var edes []*ExtendedError
+	for {
+		h, err := p.AdditionalHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if h.Type != dnsmessage.TypeOPT {
+			if err := p.SkipAdditional(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		opt, err := p.OPTResource()
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range opt.Options {
+			if o.Code != optionCodeExtendedError || len(o.Data) < 2 {
+				continue
+			}
+			edes = append(edes, &ExtendedError{
+				InfoCode:  ExtendedErrorCode(binary.BigEndian.Uint16(o.Data)),
+				ExtraText: string(o.Data[2:]),
+			})
+		}
+	}
+
+	return edes, nil
+}
+
+// Make an authoritative response to the query (query) with the given RCode
+// (rcode), answer (answers) and authority (authorities) records.
+// The OPT record is included only if the query has one.
+func newLocalResponse(query *dnsmsg.QueryMsg, rcode dnsmessage.RCode,
+	answers, authorities []dnsmessage.Resource) ([]byte, error) {
+	return buildResponse(query, rcode, true, answers, authorities, nil)
+}
+
+// Build the response to the query (query), with the QR bit set, the RD and
+// CD bits copied, and only the question and the given records.
+// The OPT record with the EDNS options (options) is included only if the
+// query has one.
+func buildResponse(query *dnsmsg.QueryMsg, rcode dnsmessage.RCode, authoritative bool,
+	answers, authorities []dnsmessage.Resource, options []dnsmessage.Option) ([]byte, error) {
+	dmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.Header.ID,
+			Response:           true,
+			OpCode:             query.Header.OpCode,
+			Authoritative:      authoritative,
+			RecursionDesired:   query.Header.RecursionDesired,
+			RecursionAvailable: true,
+			CheckingDisabled:   query.Header.CheckingDisabled,
+			RCode:              rcode,
+		},
+		Questions:   []dnsmessage.Question{query.Question},
+		Answers:     answers,
+		Authorities: authorities,
+	}
+	if query.OPT.Header != nil {
+		rh := dnsmessage.ResourceHeader{}
+		rh.SetEDNS0(localPayloadSize, 0 /* extRCode */, false /* dnssecOK */)
+		dmsg.Additionals = append(dmsg.Additionals, dnsmessage.Resource{
+			Header: rh,
+			Body:   &dnsmessage.OPTResource{Options: options},
+		})
+	}
+	return dmsg.Pack()
+}
+
+// Builder of the synthesized responses to a query (e.g., the blocked,
+// local and refused ones), which sets the header flags and the OPT record
+// as buildResponse() does.
+// The answers are owned by the question name, or the target of the last
+// added CNAME, so that a CNAME chain can be built in order.
+// The first error (e.g., an invalid address) is reported by Build().
+type ResponseBuilder struct {
+	query         *dnsmsg.QueryMsg
+	rcode         dnsmessage.RCode
+	authoritative bool
+	owner         dnsmessage.Name
+	answers       []dnsmessage.Resource
+	authorities   []dnsmessage.Resource
+	options       []dnsmessage.Option
+	err           error
+}
+
+// Create a builder of the response (NOERROR by default) to the query.
+func NewResponseBuilder(query *dnsmsg.QueryMsg) *ResponseBuilder {
+	return &ResponseBuilder{
+		query: query,
+		rcode: dnsmessage.RCodeSuccess,
+		owner: query.Question.Name,
+	}
+}
+
+// Set the AA bit, i.e., answering for a locally served zone.
+func (b *ResponseBuilder) Authoritative() *ResponseBuilder {
+	b.authoritative = true
+	return b
+}
+
+// Answer NXDOMAIN with the SOA record (soa; optional) of the zone for the
+// negative caching (RFC 2308, Section 3).
+func (b *ResponseBuilder) NXDOMAIN(soa *dnsmessage.Resource) *ResponseBuilder {
+	b.rcode = dnsmessage.RCodeNameError
+	return b.addSOA(soa)
+}
+
+// Answer NODATA, i.e., NOERROR without records of the queried type but the
+// CNAMEs (if any), with the SOA record (soa; optional) of the zone.
+func (b *ResponseBuilder) NODATA(soa *dnsmessage.Resource) *ResponseBuilder {
+	b.rcode = dnsmessage.RCodeSuccess
+	b.answers = slices.DeleteFunc(b.answers, func(rr dnsmessage.Resource) bool {
+		return rr.Header.Type != dnsmessage.TypeCNAME
+	})
+	return b.addSOA(soa)
+}
+
+// Answer REFUSED without any records.
+func (b *ResponseBuilder) Refused() *ResponseBuilder {
+	b.rcode = dnsmessage.RCodeRefused
+	b.answers, b.authorities = nil, nil
+	return b
+}
+
+func (b *ResponseBuilder) addSOA(soa *dnsmessage.Resource) *ResponseBuilder {
+	if soa != nil {
+		b.authorities = append(b.authorities, *soa)
+	}
+	return b
+}
+
+// Add an A record of the IPv4 address (ip).
+func (b *ResponseBuilder) AddA(ip netip.Addr, ttl uint32) *ResponseBuilder {
+	ip = ip.Unmap()
+	if !ip.Is4() {
+		b.setErr(fmt.Errorf("invalid IPv4 address: %v", ip))
+		return b
+	}
+	return b.add(dnsmessage.TypeA, ttl, &dnsmessage.AResource{A: ip.As4()})
+}
+
+// Add an AAAA record of the IPv6 address (ip).
+func (b *ResponseBuilder) AddAAAA(ip netip.Addr, ttl uint32) *ResponseBuilder {
+	if !ip.Is6() || ip.Is4In6() {
+		b.setErr(fmt.Errorf("invalid IPv6 address: %v", ip))
+		return b
+	}
+	return b.add(dnsmessage.TypeAAAA, ttl, &dnsmessage.AAAAResource{AAAA: ip.As16()})
+}
+
+// Add a CNAME record to the target (target), which owns the later answers.
+func (b *ResponseBuilder) AddCNAME(target string, ttl uint32) *ResponseBuilder {
+	if !strings.HasSuffix(target, ".") {
+		target += "."
+	}
+	name, err := dnsmessage.NewName(target)
+	if err != nil {
+		b.setErr(fmt.Errorf("invalid CNAME target [%s]: %w", target, err))
+		return b
+	}
+	b.add(dnsmessage.TypeCNAME, ttl, &dnsmessage.CNAMEResource{CNAME: name})
+	b.owner = name
+	return b
+}
+
+// Add a TXT record of the text (txt), which is split into the character
+// strings of at most 255 bytes.
+func (b *ResponseBuilder) AddTXT(txt string, ttl uint32) *ResponseBuilder {
+	return b.add(dnsmessage.TypeTXT, ttl, &dnsmessage.TXTResource{TXT: splitTXT(txt)})
+}
+
+// Add the Extended DNS Error (ede), if the query has the OPT record.
+func (b *ResponseBuilder) AddExtendedError(ede *ExtendedError) *ResponseBuilder {
+	b.options = append(b.options, extendedErrorOption(ede))
+	return b
+}
+
+func (b *ResponseBuilder) add(rtype dnsmessage.Type, ttl uint32,
+	body dnsmessage.ResourceBody) *ResponseBuilder {
+	b.answers = append(b.answers, dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  b.owner,
+			Type:  rtype,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		},
+		Body: body,
+	})
+	return b
+}
+
+func (b *ResponseBuilder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Build the response.
+// The flags are normalized: RA is always set as the recursion is available
+// through us, while TC and AD are never; AA is set only for the NOERROR and
+// NXDOMAIN answers, which are the only ones a zone is authoritative for.
+func (b *ResponseBuilder) Build() (dnsmsg.RawMsg, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	authoritative := b.authoritative &&
+		(b.rcode == dnsmessage.RCodeSuccess || b.rcode == dnsmessage.RCodeNameError)
+	return buildResponse(b.query, b.rcode, authoritative,
+		b.answers, b.authorities, b.options)
+}
+
+// Normalize the header flags of the response (resp) relayed from the
+// upstream, i.e., set the RA bit as the recursion is available through us
+// regardless of the upstream (e.g., an authoritative server), and clear the
+// AA bit if clearAA, as we aren't authoritative for the relayed answers.
+// The response is copied if modified, since it may be shared by the
+// coalesced queries.
+func normalizeRelayedFlags(resp []byte, clearAA bool) []byte {
+	flags := dnsmsg.RawMsg(resp).Flags()
+	set, clr := dnsmsg.FlagRA&^flags, dnsmsg.Flags(0)
+	if clearAA {
+		clr = dnsmsg.FlagAA & flags
+	}
+	if set == 0 && clr == 0 {
+		return resp
+	}
+	out := dnsmsg.RawMsg(slices.Clone(resp))
+	out.SetFlags(set, clr)
+	return out
+}
+
+// Answer the query (msg) without any question (QDCOUNT=0): NOERROR if it
+// carries nothing but the OPT record, e.g., an EDNS keepalive (RFC 7828) or
+// cookie (RFC 7873) probe, otherwise FORMERR (RFC 1035 doesn't define such
+// a query), both with the OPT record if the query has one.
+// Return false if the query has a question or is malformed otherwise.
+func answerNoQuestion(msg []byte) ([]byte, dnsmessage.RCode, bool) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil || header.Response {
+		return nil, 0, false
+	}
+	if _, err := p.Question(); err != dnsmessage.ErrSectionDone {
+		return nil, 0, false
+	}
+
+	rcode := dnsmessage.RCodeSuccess
+	if _, err := p.AnswerHeader(); err != dnsmessage.ErrSectionDone {
+		rcode = dnsmessage.RCodeFormatError
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return nil, 0, false
+	}
+	if _, err := p.AuthorityHeader(); err != dnsmessage.ErrSectionDone {
+		rcode = dnsmessage.RCodeFormatError
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return nil, 0, false
+	}
+	hasOPT := false
+	for {
+		h, err := p.AdditionalHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil || h.Type != dnsmessage.TypeOPT || hasOPT {
+			rcode = dnsmessage.RCodeFormatError
+			break
+		}
+		if err := p.SkipAdditional(); err != nil {
+			rcode = dnsmessage.RCodeFormatError
+			break
+		}
+		hasOPT = true
+	}
+	if !hasOPT || header.OpCode != opCodeQuery {
+		rcode = dnsmessage.RCodeFormatError
+	}
+
+	dmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			OpCode:             header.OpCode,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+	}
+	if hasOPT {
+		rh := dnsmessage.ResourceHeader{}
+		rh.SetEDNS0(localPayloadSize, 0 /* extRCode */, false /* dnssecOK */)
+		dmsg.Additionals = []dnsmessage.Resource{
+			{Header: rh, Body: &dnsmessage.OPTResource{}},
+		}
+	}
+	resp, err := dmsg.Pack()
+	if err != nil {
+		return nil, 0, false
+	}
+	return resp, rcode, true
+}
+
+// Make the EDE option (ede).
+func extendedErrorOption(ede *ExtendedError) dnsmessage.Option {
+	text := ede.ExtraText
+	if len(text) > maxExtraTextLength {
+		// Back off to a rune boundary to keep the text valid UTF-8.
+		n := maxExtraTextLength
+		for n > 0 && !utf8.RuneStart(text[n]) {
+			n--
+		}
+		text = text[:n]
+	}
+	// Option data format:
+	// - info-code (2B)
+	// - extra-text (variable; UTF-8 without NUL termination)
+	data := make([]byte, 0, 2+len(text))
+	data = binary.BigEndian.AppendUint16(data, uint16(ede.InfoCode))
+	data = append(data, text...)
+	return dnsmessage.Option{
+		Code: optionCodeExtendedError,
+		Data: data,
+	}
+}
+
+// Kind of a response, which decides how it's cached (RFC 2308).
+type ResponseKind int
+
+const (
+	ResponseAnswer   ResponseKind = iota // NOERROR with answers of the type
+	ResponseNoData                       // NOERROR without answers of the type
+	ResponseNXDomain                     // NXDOMAIN
+	ResponseError                        // other RCODEs, or malformed
+)
+
+func (k ResponseKind) String() string {
+	switch k {
+	case ResponseAnswer:
+		return "answer"
+	case ResponseNoData:
+		return "nodata"
+	case ResponseNXDomain:
+		return "nxdomain"
+	default:
+		return "error"
+	}
+}
+
+// Classify the response (msg).
+// NOTE: A response with only the CNAMEs (i.e., the chain ends at a name
+// without records of the type) is NODATA, see RFC 2308, Section 2.2.
+func ClassifyResponse(msg []byte) ResponseKind {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || !h.Response {
+		return ResponseError
+	}
+	q, err := p.Question()
+	if err != nil {
+		return ResponseError
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+		// check the answers below
+	case dnsmessage.RCodeNameError:
+		return ResponseNXDomain
+	default:
+		return ResponseError
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return ResponseError
+	}
+	for {
+		ah, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			return ResponseNoData
+		} else if err != nil {
+			return ResponseError
+		}
+		if ah.Type == q.Type || q.Type == dnsmessage.TypeALL {
+			return ResponseAnswer
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return ResponseError
+		}
+	}
+}
+
+// Well-known prefix for the IPv4-embedded IPv6 addresses, RFC 6052
+var DNS64WellKnownPrefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// Validate the NAT64 prefix (prefix), whose length must be one of those
+// defined in RFC 6052, Section 2.2.
+func validateDNS64Prefix(prefix netip.Prefix) error {
+	if !prefix.IsValid() || !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return fmt.Errorf("invalid NAT64 prefix: %s", prefix)
+	}
+	switch prefix.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+		// ok
+	default:
+		return fmt.Errorf("invalid NAT64 prefix length: %d", prefix.Bits())
+	}
+	if prefix.Masked() != prefix {
+		return fmt.Errorf("NAT64 prefix has host bits set: %s", prefix)
+	}
+	return nil
+}
+
+// Embed the IPv4 address (v4) into the NAT64 prefix (prefix), skipping the
+// bits 64-71 (the "u" octet), RFC 6052, Section 2.2.
+func embedIPv4(prefix netip.Prefix, v4 [4]byte) netip.Addr {
+	a := prefix.Addr().As16()
+	i := prefix.Bits() / 8
+	for _, b := range v4 {
+		if i == 8 {
+			i++ // skip the "u" octet
+		}
+		a[i] = b
+		i++
+	}
+	return netip.AddrFrom16(a)
+}
+
+// Synthesize the AAAA response for DNS64 (RFC 6147) from the NODATA
+// response (aaaaResp) to the AAAA query and the response (aResp) to the A
+// query of the same name, by embedding the IPv4 addresses into the NAT64
+// prefix (prefix). The CNAMEs in the A response are kept.
+// Return false if there are no A records to synthesize from.
+func synthesizeDNS64(aaaaResp, aResp []byte, prefix netip.Prefix) ([]byte, bool) {
+	var amsg dnsmessage.Message
+	if err := amsg.Unpack(aResp); err != nil || amsg.Header.RCode != dnsmessage.RCodeSuccess {
+		return nil, false
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(aaaaResp); err != nil {
+		return nil, false
+	}
+
+	// The TTL is bounded by the negative TTL of the AAAA response.
+	// See RFC 6147, Section 5.1.7.
+	maxTTL := uint32(math.MaxUint32)
+	for _, rr := range dmsg.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			maxTTL = min(rr.Header.TTL, soa.MinTTL)
+		}
+	}
+
+	answers := make([]dnsmessage.Resource, 0, len(amsg.Answers))
+	synthesized := false
+	for _, rr := range amsg.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.CNAMEResource:
+			rr.Header.TTL = min(rr.Header.TTL, maxTTL)
+			answers = append(answers, rr)
+		case *dnsmessage.AResource:
+			rr.Header.Type = dnsmessage.TypeAAAA
+			rr.Header.TTL = min(rr.Header.TTL, maxTTL)
+			rr.Body = &dnsmessage.AAAAResource{
+				AAAA: embedIPv4(prefix, body.A).As16(),
+			}
+			answers = append(answers, rr)
+			synthesized = true
+		}
+	}
+	if !synthesized {
+		return nil, false
+	}
+
+	dmsg.Answers = answers
+	dmsg.Authorities = nil
+	additionals := dmsg.Additionals[:0]
+	for _, rr := range dmsg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			additionals = append(additionals, rr)
+		}
+	}
+	dmsg.Additionals = additionals
+	dmsg.Header.Authoritative = false
+
+	resp, err := dmsg.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return resp, true
+}
+
+// Record type of the DNSSEC signatures (RFC 4034), unknown by dnsmessage.
+const typeRRSIG dnsmessage.Type = 46
+
+// Strip the records of the types (types) from the answer section of the
+// response (resp), together with their RRSIGs; the other sections, e.g.,
+// the SOA in the authority section, are kept.  If no records of the
+// queried type are left, it becomes a NODATA response (with the CNAMEs if
+// any).  Only the successful responses are stripped.
+// Return false if nothing is stripped.
+func stripAnswers(resp []byte, types []dnsmessage.Type) ([]byte, bool) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil || msg.Header.RCode != dnsmessage.RCodeSuccess {
+		return nil, false
+	}
+
+	answers := msg.Answers[:0]
+	for _, rr := range msg.Answers {
+		t := rr.Header.Type
+		if t == typeRRSIG {
+			// The type covered is the first field.
+			if body, ok := rr.Body.(*dnsmessage.UnknownResource); ok && len(body.Data) >= 2 {
+				t = dnsmessage.Type(binary.BigEndian.Uint16(body.Data))
+			}
+		}
+		if !slices.Contains(types, t) {
+			answers = append(answers, rr)
+		}
+	}
+	if len(answers) == len(msg.Answers) {
+		return nil, false
+	}
+	msg.Answers = answers
+
+	resp, err := msg.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return resp, true
+}
@@ -0,0 +1,662 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// DNS message helpers - tests
+//
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+	"kexuedns/util/dnsmsg"
+)
+
+// Make a query with an OPT record holding the given options.
+func newTestQueryEDNS(t testing.TB, name string, qtype dnsmessage.Type,
+	options ...dnsmessage.Option) []byte {
+	rh := dnsmessage.ResourceHeader{}
+	rh.SetEDNS0(1232, 0, false)
+	dmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0x1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{
+				Name:  dnsmessage.MustNewName(name),
+				Type:  qtype,
+				Class: dnsmessage.ClassINET,
+			},
+		},
+		Additionals: []dnsmessage.Resource{
+			{
+				Header: rh,
+				Body:   &dnsmessage.OPTResource{Options: options},
+			},
+		},
+	}
+	msg, err := dmsg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+	return msg
+}
+
+func TestResponseBuilder(t *testing.T) {
+	parse := func(t *testing.T, msg []byte) *dnsmsg.QueryMsg {
+		t.Helper()
+		query, err := dnsmsg.NewQueryMsg(msg)
+		if err != nil {
+			t.Fatalf(`NewQueryMsg() = %v; want nil`, err)
+		}
+		return query
+	}
+	unpack := func(t *testing.T, b *ResponseBuilder) (dnsmsg.RawMsg, *dnsmessage.Message) {
+		t.Helper()
+		resp, err := b.Build()
+		if err != nil {
+			t.Fatalf(`Build() = %v; want nil`, err)
+		}
+		var dmsg dnsmessage.Message
+		if err := dmsg.Unpack(resp); err != nil {
+			t.Fatalf(`Unpack() = %v; want nil`, err)
+		}
+		return resp, &dmsg
+	}
+	query := parse(t, newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA))
+	soa := newLocalSOA("example.com", 300)
+
+	t.Run("answers", func(t *testing.T) {
+		b := NewResponseBuilder(query).
+			AddCNAME("cdn.example.net", 300).
+			AddA(netip.MustParseAddr("192.0.2.1"), 60).
+			AddA(netip.MustParseAddr("::ffff:192.0.2.2"), 60)
+		resp, dmsg := unpack(t, b)
+		h := dmsg.Header
+		if h.ID != 0x1234 || !h.Response || !h.RecursionDesired || !h.RecursionAvailable ||
+			h.Authoritative || h.RCode != dnsmessage.RCodeSuccess {
+			t.Errorf(`header = %+v; want NOERROR response`, h)
+		}
+		if len(dmsg.Questions) != 1 || dmsg.Questions[0] != query.Question {
+			t.Errorf(`questions = %+v; want %+v`, dmsg.Questions, query.Question)
+		}
+		if len(dmsg.Answers) != 3 || len(dmsg.Authorities) != 0 || len(dmsg.Additionals) != 1 {
+			t.Fatalf(`answers = %+v; want 3 answers and OPT`, dmsg)
+		}
+		if rr := dmsg.Answers[0]; rr.Header.Name != query.Question.Name ||
+			rr.Body.(*dnsmessage.CNAMEResource).CNAME.String() != "cdn.example.net." {
+			t.Errorf(`answers[0] = %+v; want CNAME`, rr)
+		}
+		for _, rr := range dmsg.Answers[1:] {
+			if rr.Header.Name.String() != "cdn.example.net." ||
+				rr.Header.Type != dnsmessage.TypeA || rr.Header.TTL != 60 {
+				t.Errorf(`answer = %+v; want A of the CNAME target`, rr)
+			}
+		}
+		if kind := ClassifyResponse(resp); kind != ResponseAnswer {
+			t.Errorf(`ClassifyResponse() = %v; want %v`, kind, ResponseAnswer)
+		}
+	})
+
+	t.Run("nxdomain", func(t *testing.T) {
+		resp, dmsg := unpack(t, NewResponseBuilder(query).Authoritative().NXDOMAIN(&soa))
+		if !dmsg.Header.Authoritative || len(dmsg.Answers) != 0 || len(dmsg.Authorities) != 1 ||
+			dmsg.Authorities[0].Header.Type != dnsmessage.TypeSOA {
+			t.Errorf(`response = %+v; want authoritative with SOA`, dmsg)
+		}
+		if kind := ClassifyResponse(resp); kind != ResponseNXDomain {
+			t.Errorf(`ClassifyResponse() = %v; want %v`, kind, ResponseNXDomain)
+		}
+	})
+
+	t.Run("nodata", func(t *testing.T) {
+		b := NewResponseBuilder(query).
+			AddCNAME("cdn.example.net.", 300).
+			AddA(netip.MustParseAddr("192.0.2.1"), 60).
+			NODATA(&soa)
+		resp, dmsg := unpack(t, b)
+		if len(dmsg.Answers) != 1 || dmsg.Answers[0].Header.Type != dnsmessage.TypeCNAME ||
+			len(dmsg.Authorities) != 1 {
+			t.Errorf(`response = %+v; want only CNAME and SOA`, dmsg)
+		}
+		if kind := ClassifyResponse(resp); kind != ResponseNoData {
+			t.Errorf(`ClassifyResponse() = %v; want %v`, kind, ResponseNoData)
+		}
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		b := NewResponseBuilder(query).
+			AddTXT(strings.Repeat("x", 300), 60).
+			Refused().
+			AddExtendedError(&ExtendedError{InfoCode: ExtendedErrorProhibited})
+		resp, dmsg := unpack(t, b)
+		if dmsg.Header.RCode != dnsmessage.RCodeRefused || len(dmsg.Answers) != 0 {
+			t.Errorf(`response = %+v; want REFUSED without answers`, dmsg)
+		}
+		// Never authoritative for a refusal.
+		_, dmsg = unpack(t, NewResponseBuilder(query).Authoritative().Refused())
+		if h := dmsg.Header; h.Authoritative || !h.RecursionAvailable {
+			t.Errorf(`header = %+v; want AA=0, RA=1`, h)
+		}
+		edes, err := GetExtendedErrors(resp)
+		if err != nil || len(edes) != 1 || edes[0].InfoCode != ExtendedErrorProhibited {
+			t.Errorf(`GetExtendedErrors() = (%v, %v); want prohibited`, edes, err)
+		}
+	})
+
+	t.Run("txt", func(t *testing.T) {
+		query := parse(t, newTestQuery(t, "www.example.com.", dnsmessage.TypeTXT))
+		b := NewResponseBuilder(query).AddTXT(strings.Repeat("x", 300), 60)
+		_, dmsg := unpack(t, b)
+		if len(dmsg.Additionals) != 0 {
+			t.Errorf(`additionals = %+v; want no OPT`, dmsg.Additionals)
+		}
+		if len(dmsg.Answers) != 1 {
+			t.Fatalf(`answers = %+v; want 1`, dmsg.Answers)
+		}
+		txt := dmsg.Answers[0].Body.(*dnsmessage.TXTResource).TXT
+		if len(txt) != 2 || len(txt[0]) != 255 || len(txt[1]) != 45 {
+			t.Errorf(`TXT = %q; want split by 255 bytes`, txt)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for i, b := range []*ResponseBuilder{
+			NewResponseBuilder(query).AddA(netip.MustParseAddr("2001:db8::1"), 60),
+			NewResponseBuilder(query).AddAAAA(netip.MustParseAddr("192.0.2.1"), 60),
+			NewResponseBuilder(query).AddAAAA(netip.MustParseAddr("::ffff:192.0.2.1"), 60),
+			NewResponseBuilder(query).AddCNAME("bad..name", 60),
+		} {
+			if resp, err := b.Build(); err == nil {
+				t.Errorf(`[%d] Build() = %x; want error`, i, resp)
+			}
+		}
+	})
+}
+
+func TestNormalizeRelayedFlags(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	tests := []struct {
+		flags   dnsmsg.Flags
+		clearAA bool
+		want    dnsmsg.Flags
+	}{
+		{dnsmsg.FlagQR | dnsmsg.FlagRD | dnsmsg.FlagRA, false, dnsmsg.FlagQR | dnsmsg.FlagRD | dnsmsg.FlagRA},
+		{dnsmsg.FlagQR | dnsmsg.FlagRD, false, dnsmsg.FlagQR | dnsmsg.FlagRD | dnsmsg.FlagRA},
+		{dnsmsg.FlagQR | dnsmsg.FlagAA, false, dnsmsg.FlagQR | dnsmsg.FlagAA | dnsmsg.FlagRA},
+		{dnsmsg.FlagQR | dnsmsg.FlagAA | dnsmsg.FlagAD, true, dnsmsg.FlagQR | dnsmsg.FlagRA | dnsmsg.FlagAD},
+		{dnsmsg.FlagQR | dnsmsg.FlagRA, true, dnsmsg.FlagQR | dnsmsg.FlagRA},
+	}
+	for i, tc := range tests {
+		resp := dnsmsg.RawMsg(slices.Clone(query))
+		resp.SetFlags(tc.flags, ^tc.flags)
+		orig := slices.Clone(resp)
+		out := dnsmsg.RawMsg(normalizeRelayedFlags(resp, tc.clearAA))
+		if flags := out.Flags(); flags != tc.want {
+			t.Errorf(`[%d] normalizeRelayedFlags() flags = %#x; want %#x`, i, flags, tc.want)
+		}
+		if !bytes.Equal(resp, orig) {
+			t.Errorf(`[%d] normalizeRelayedFlags() modified the response in place`, i)
+		}
+		if tc.want == tc.flags && &out[0] != &resp[0] {
+			t.Errorf(`[%d] normalizeRelayedFlags() copied the unmodified response`, i)
+		}
+	}
+
+	// Relayed responses through the forwarder.
+	upstream := newTestResponse(t, query, dnsmessage.RCodeSuccess, nil, nil)
+	dnsmsg.RawMsg(upstream).SetFlags(dnsmsg.FlagAA, dnsmsg.FlagRA)
+	for _, clearAA := range []bool{false, true} {
+		f := &Forwarder{myIP: &config.MyIP{}, ClearRelayedAA: clearAA}
+		f.Router.resolver = &staticResolver{response: upstream}
+		resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+		if err != nil {
+			t.Fatalf(`handleQuery() = %v; want nil`, err)
+		}
+		flags := dnsmsg.RawMsg(resp).Flags()
+		if flags&dnsmsg.FlagRA == 0 || (flags&dnsmsg.FlagAA != 0) == clearAA {
+			t.Errorf(`[clearAA=%t] handleQuery() flags = %#x; want RA=1, AA=%t`,
+				clearAA, flags, !clearAA)
+		}
+	}
+}
+
+func TestClassifyResponse(t *testing.T) {
+	// Responses (with EDNS) captured from the upstream resolvers.
+	tests := []struct {
+		desc string
+		hex  string
+		kind ResponseKind
+	}{
+		{
+			"example.com A",
+			"4e2b81800001000100000001076578616d706c6503636f6d0000010001c00c00010001" +
+				"0000012c00045db8d70e00002904d0000000000000",
+			ResponseAnswer,
+		},
+		{
+			"example.com MX: NODATA",
+			"4e2b81800001000000010001076578616d706c6503636f6d00000f0001c00c00060001" +
+				"00000e10002c026e73056963616e6e036f726700036e6f6303646e73c02c78b44dae" +
+				"00001c2000000e100012750000000e1000002904d0000000000000",
+			ResponseNoData,
+		},
+		{
+			"www.example.com AAAA: CNAME only, NODATA",
+			"4e2b8180000100010001000103777777076578616d706c6503636f6d00001c0001c00c" +
+				"00050001000002580002c010c0100006000100000e10002c026e73056963616e6e03" +
+				"6f726700036e6f6303646e73c03e78b44dae00001c2000000e100012750000000e10" +
+				"00002904d0000000000000",
+			ResponseNoData,
+		},
+		{
+			"nonexistent.example.com A: NXDOMAIN",
+			"4e2b818300010000000100010b6e6f6e6578697374656e74076578616d706c6503636f" +
+				"6d0000010001c0180006000100000e10002c026e73056963616e6e036f726700036e" +
+				"6f6303646e73c03878b44dae00001c2000000e100012750000000e1000002904d000" +
+				"0000000000",
+			ResponseNXDomain,
+		},
+		{
+			"example.com A: SERVFAIL",
+			"4e2b81820001000000000001076578616d706c6503636f6d000001000100002904d000" +
+				"0000000000",
+			ResponseError,
+		},
+		{
+			"example.com A: REFUSED",
+			"4e2b81850001000000000001076578616d706c6503636f6d000001000100002904d000" +
+				"0000000000",
+			ResponseError,
+		},
+	}
+	for _, tc := range tests {
+		msg, err := hex.DecodeString(tc.hex)
+		if err != nil {
+			t.Fatalf(`[%s] invalid hex: %v`, tc.desc, err)
+		}
+		if kind := ClassifyResponse(msg); kind != tc.kind {
+			t.Errorf(`[%s] ClassifyResponse() = %v; want %v`, tc.desc, kind, tc.kind)
+		}
+	}
+
+	// Query or truncated message: error.
+	query := newTestQuery(t, "example.com.", dnsmessage.TypeA)
+	if kind := ClassifyResponse(query); kind != ResponseError {
+		t.Errorf(`ClassifyResponse(query) = %v; want %v`, kind, ResponseError)
+	}
+	if kind := ClassifyResponse([]byte{0x4e, 0x2b, 0x81}); kind != ResponseError {
+		t.Errorf(`ClassifyResponse(truncated) = %v; want %v`, kind, ResponseError)
+	}
+}
+
+func TestAddExtendedError(t *testing.T) {
+	ede := &ExtendedError{
+		InfoCode:  ExtendedErrorNetworkError,
+		ExtraText: "upstream query failed",
+	}
+
+	// No OPT: returned as is.
+	msg := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	resp, err := AddExtendedError(msg, ede)
+	if err != nil {
+		t.Fatalf(`AddExtendedError() = %v; want nil`, err)
+	}
+	if !bytes.Equal(resp, msg) {
+		t.Errorf(`AddExtendedError() modified message without OPT`)
+	}
+
+	// With OPT: the existing options are preserved.
+	cookie := dnsmessage.Option{Code: 10, Data: []byte("12345678")}
+	msg = newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA, cookie)
+	resp, err = AddExtendedError(msg, ede)
+	if err != nil {
+		t.Fatalf(`AddExtendedError() = %v; want nil`, err)
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil {
+		t.Fatalf(`failed to unpack: %v`, err)
+	}
+	opt := dmsg.Additionals[0].Body.(*dnsmessage.OPTResource)
+	if n := len(opt.Options); n != 2 {
+		t.Fatalf(`len(Options) = %d; want 2`, n)
+	}
+	if o := opt.Options[0]; o.Code != cookie.Code || !bytes.Equal(o.Data, cookie.Data) {
+		t.Errorf(`Options[0] = %+v; want %+v`, o, cookie)
+	}
+
+	edes, err := GetExtendedErrors(resp)
+	if err != nil {
+		t.Fatalf(`GetExtendedErrors() = %v; want nil`, err)
+	}
+	if len(edes) != 1 || *edes[0] != *ede {
+		t.Errorf(`GetExtendedErrors() = %+v; want [%+v]`, edes, ede)
+	}
+
+	// Long text is truncated.
+	long := &ExtendedError{ExtraText: strings.Repeat("x", 1000)}
+	resp, _ = AddExtendedError(msg, long)
+	edes, _ = GetExtendedErrors(resp)
+	if len(edes) != 1 || len(edes[0].ExtraText) != maxExtraTextLength {
+		t.Errorf(`GetExtendedErrors() = %+v; want truncated text`, edes)
+	}
+	// Truncated at a rune boundary.
+	long = &ExtendedError{ExtraText: strings.Repeat("科", 1000)}
+	resp, _ = AddExtendedError(msg, long)
+	edes, _ = GetExtendedErrors(resp)
+	if len(edes) != 1 || !utf8.ValidString(edes[0].ExtraText) ||
+		len(edes[0].ExtraText) != maxExtraTextLength/3*3 {
+		t.Errorf(`GetExtendedErrors() = %+v; want text truncated at a rune boundary`, edes)
+	}
+}
+
+func TestRouteInfo(t *testing.T) {
+	tests := []*RouteInfo{
+		{Index: -1, Resolver: "192.0.2.53:53"},
+		{Index: 3, Route: "lan", Resolver: "home"},
+		{Index: 0, Route: strings.Repeat("r", 300), Resolver: ""},
+	}
+	query := newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA)
+	for _, ri := range tests {
+		msg, err := addOption(query, routeInfoOption(ri))
+		if err != nil {
+			t.Fatalf(`addOption() = %v; want nil`, err)
+		}
+		got, ok := GetRouteInfo(msg)
+		want := *ri
+		want.Route = want.Route[:min(len(want.Route), 255)]
+		if !ok || *got != want {
+			t.Errorf(`GetRouteInfo() = (%+v, %v); want %+v`, got, ok, want)
+		}
+	}
+
+	// Invalid or missing
+	for _, data := range [][]byte{{}, {0}, {0, 3, 'a'}, {0, 0, 2, 'a'}} {
+		msg, _ := addOption(query, dnsmessage.Option{Code: optionCodeRouteInfo, Data: data})
+		if ri, ok := GetRouteInfo(msg); ok {
+			t.Errorf(`GetRouteInfo(%v) = %+v; want invalid`, data, ri)
+		}
+	}
+	if ri, ok := GetRouteInfo(query); ok {
+		t.Errorf(`GetRouteInfo() = %+v; want not found`, ri)
+	}
+}
+
+func TestEmbedIPv4(t *testing.T) {
+	// Examples from RFC 6052, Section 2.4
+	v4 := netip.MustParseAddr("192.0.2.33").As4()
+	tests := []struct {
+		prefix string
+		addr   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100::"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+	}
+	for _, tc := range tests {
+		prefix := netip.MustParsePrefix(tc.prefix)
+		if err := validateDNS64Prefix(prefix); err != nil {
+			t.Errorf(`validateDNS64Prefix(%s) = %v; want nil`, prefix, err)
+		}
+		if addr := embedIPv4(prefix, v4); addr != netip.MustParseAddr(tc.addr) {
+			t.Errorf(`embedIPv4(%s) = %s; want %s`, prefix, addr, tc.addr)
+		}
+	}
+
+	for _, s := range []string{"64:ff9b::/80", "10.0.0.0/8", "64:ff9b::1/96"} {
+		if err := validateDNS64Prefix(netip.MustParsePrefix(s)); err == nil {
+			t.Errorf(`validateDNS64Prefix(%s) = nil; want error`, s)
+		}
+	}
+}
+
+// Answer the A queries with a CNAME and an A record, and the AAAA queries
+// with NODATA, or a real AAAA record for the names starting with "v6".
+type ipv4OnlyResolver struct {
+	staticResolver
+}
+
+func (r *ipv4OnlyResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(msg); err != nil {
+		return nil, err
+	}
+	dmsg.Header.Response = true
+	q := dmsg.Questions[0]
+	target := dnsmessage.MustNewName("target.example.")
+	switch {
+	case q.Type == dnsmessage.TypeA:
+		dmsg.Answers = []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{
+					Name: q.Name, Type: dnsmessage.TypeCNAME,
+					Class: dnsmessage.ClassINET, TTL: 600,
+				},
+				Body: &dnsmessage.CNAMEResource{CNAME: target},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{
+					Name: target, Type: dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET, TTL: 600,
+				},
+				Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 33}},
+			},
+		}
+	case strings.HasPrefix(q.Name.String(), "v6"):
+		dmsg.Answers = []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{
+					Name: q.Name, Type: dnsmessage.TypeAAAA,
+					Class: dnsmessage.ClassINET, TTL: 600,
+				},
+				Body: &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}},
+			},
+		}
+	default:
+		dmsg.Authorities = []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{
+					Name: dnsmessage.MustNewName("example."), Type: dnsmessage.TypeSOA,
+					Class: dnsmessage.ClassINET, TTL: 300,
+				},
+				Body: &dnsmessage.SOAResource{
+					NS:     dnsmessage.MustNewName("ns.example."),
+					MBox:   dnsmessage.MustNewName("admin.example."),
+					MinTTL: 120,
+				},
+			},
+		}
+	}
+	return dmsg.Pack()
+}
+
+func TestDNS64(t *testing.T) {
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = &ipv4OnlyResolver{}
+
+	tests := []struct {
+		prefix string
+		name   string
+		addr   string // the AAAA answer; empty for NODATA
+	}{
+		{"", "www.example.", "64:ff9b::c000:221"},
+		{"2001:db8:122:344::/64", "www.example.", "2001:db8:122:344:c0:2:2100::"},
+		{"", "v6.example.", "2001:db8::1"}, // real AAAA
+	}
+	for i, tc := range tests {
+		if err := f.SetDNS64(true, tc.prefix); err != nil {
+			t.Fatalf(`[%d] SetDNS64(%q) = %v; want nil`, i, tc.prefix, err)
+		}
+		query := newTestQuery(t, tc.name, dnsmessage.TypeAAAA)
+		resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, false)
+		if err != nil {
+			t.Fatalf(`[%d] handleQuery() = %v; want nil`, i, err)
+		}
+		var dmsg dnsmessage.Message
+		if err := dmsg.Unpack(resp); err != nil {
+			t.Fatalf(`[%d] failed to unpack response: %v`, i, err)
+		}
+		var aaaa *dnsmessage.Resource
+		for j := range dmsg.Answers {
+			if dmsg.Answers[j].Header.Type == dnsmessage.TypeAAAA {
+				aaaa = &dmsg.Answers[j]
+			}
+		}
+		if aaaa == nil {
+			t.Fatalf(`[%d] answers = %+v; want AAAA %s`, i, dmsg.Answers, tc.addr)
+		}
+		addr := netip.AddrFrom16(aaaa.Body.(*dnsmessage.AAAAResource).AAAA)
+		if addr != netip.MustParseAddr(tc.addr) {
+			t.Errorf(`[%d] AAAA = %s; want %s`, i, addr, tc.addr)
+		}
+		if strings.HasPrefix(tc.name, "v6") {
+			continue
+		}
+		// CNAME kept; TTL bounded by the SOA negative TTL.
+		if len(dmsg.Answers) != 2 || dmsg.Answers[0].Header.Type != dnsmessage.TypeCNAME ||
+			aaaa.Header.TTL != 120 || len(dmsg.Authorities) != 0 {
+			t.Errorf(`[%d] response = %+v; want CNAME + AAAA with TTL 120`, i, dmsg)
+		}
+	}
+
+	// Disabled: NODATA as is.
+	if err := f.SetDNS64(false, ""); err != nil {
+		t.Fatalf(`SetDNS64(false) = %v; want nil`, err)
+	}
+	query := newTestQuery(t, "www.example.", dnsmessage.TypeAAAA)
+	resp, _ := f.handleQuery(context.Background(), query, netip.Addr{}, false)
+	if kind := ClassifyResponse(resp); kind != ResponseNoData {
+		t.Errorf(`ClassifyResponse() = %v; want nodata`, kind)
+	}
+
+	if err := f.SetDNS64(true, "64:ff9b::/80"); err == nil {
+		t.Errorf(`SetDNS64() with invalid prefix = nil; want error`)
+	}
+}
+
+func TestStripAnswers(t *testing.T) {
+	name := dnsmessage.MustNewName("www.example.")
+	target := dnsmessage.MustNewName("target.example.")
+	rr := func(name dnsmessage.Name, rtype dnsmessage.Type, body dnsmessage.ResourceBody) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name: name, Type: rtype,
+				Class: dnsmessage.ClassINET, TTL: 600,
+			},
+			Body: body,
+		}
+	}
+	soa := rr(dnsmessage.MustNewName("example."), dnsmessage.TypeSOA, &dnsmessage.SOAResource{
+		NS:     dnsmessage.MustNewName("ns.example."),
+		MBox:   dnsmessage.MustNewName("admin.example."),
+		MinTTL: 120,
+	})
+	dmsg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 0x1234, Response: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		Answers: []dnsmessage.Resource{
+			rr(name, dnsmessage.TypeCNAME, &dnsmessage.CNAMEResource{CNAME: target}),
+			rr(target, dnsmessage.TypeA, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}),
+			// RRSIG covering the A records
+			rr(target, typeRRSIG, &dnsmessage.UnknownResource{Type: typeRRSIG, Data: []byte{0, 1, 13, 2}}),
+			rr(target, dnsmessage.TypeTXT, &dnsmessage.TXTResource{TXT: []string{"v=spf1 -all"}}),
+			rr(target, 65, &dnsmessage.UnknownResource{Type: 65, Data: []byte{0, 1, 0}}),
+		},
+		Authorities: []dnsmessage.Resource{soa},
+	}
+	resp, err := dmsg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack response: %v", err)
+	}
+
+	tests := []struct {
+		types []dnsmessage.Type
+		want  []dnsmessage.Type // types of the left answers; nil if unchanged
+	}{
+		{[]dnsmessage.Type{dnsmessage.TypeMX}, nil},
+		{
+			[]dnsmessage.Type{dnsmessage.TypeTXT, 65},
+			[]dnsmessage.Type{dnsmessage.TypeCNAME, dnsmessage.TypeA, typeRRSIG},
+		},
+		// NODATA with the CNAME
+		{
+			[]dnsmessage.Type{dnsmessage.TypeA},
+			[]dnsmessage.Type{dnsmessage.TypeCNAME, dnsmessage.TypeTXT, 65},
+		},
+	}
+	for i, tc := range tests {
+		sresp, ok := stripAnswers(resp, tc.types)
+		if ok != (tc.want != nil) {
+			t.Fatalf(`[%d] stripAnswers() = %v; want %v`, i, ok, tc.want != nil)
+		}
+		if !ok {
+			continue
+		}
+		var smsg dnsmessage.Message
+		if err := smsg.Unpack(sresp); err != nil {
+			t.Fatalf(`[%d] failed to unpack response: %v`, i, err)
+		}
+		types := []dnsmessage.Type{}
+		for _, rr := range smsg.Answers {
+			types = append(types, rr.Header.Type)
+		}
+		if !slices.Equal(types, tc.want) {
+			t.Errorf(`[%d] answers = %v; want %v`, i, types, tc.want)
+		}
+		if smsg.Header.ID != 0x1234 || smsg.Header.RCode != dnsmessage.RCodeSuccess ||
+			len(smsg.Authorities) != 1 || smsg.Authorities[0].Header.Type != dnsmessage.TypeSOA {
+			t.Errorf(`[%d] response = %+v; want header and SOA kept`, i, smsg)
+		}
+	}
+
+	// Only the successful responses are stripped.
+	dmsg.Header.RCode = dnsmessage.RCodeNameError
+	resp, _ = dmsg.Pack()
+	if _, ok := stripAnswers(resp, []dnsmessage.Type{dnsmessage.TypeA}); ok {
+		t.Errorf(`stripAnswers(NXDOMAIN) = true; want false`)
+	}
+}
+
+func TestHandleQueryStripTypes(t *testing.T) {
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = &ipv4OnlyResolver{}
+	if err := f.SetStripTypes([]string{"a", "https", "A"}); err != nil {
+		t.Fatalf(`SetStripTypes() = %v; want nil`, err)
+	}
+	if want := []dnsmessage.Type{dnsmessage.TypeA, 65}; !slices.Equal(f.StripTypes, want) {
+		t.Errorf(`StripTypes = %v; want %v`, f.StripTypes, want)
+	}
+
+	query := newTestQuery(t, "www.example.", dnsmessage.TypeA)
+	resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, false)
+	if err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil {
+		t.Fatalf(`failed to unpack response: %v`, err)
+	}
+	if dmsg.Header.RCode != dnsmessage.RCodeSuccess || len(dmsg.Answers) != 1 ||
+		dmsg.Answers[0].Header.Type != dnsmessage.TypeCNAME {
+		t.Errorf(`response = %+v; want NODATA with the CNAME`, dmsg)
+	}
+
+	for _, s := range []string{"cname", "OPT", "bogus"} {
+		if err := f.SetStripTypes([]string{s}); err == nil {
+			t.Errorf(`SetStripTypes(%q) = nil; want error`, s)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Metrics in the Prometheus text format.
+//
+
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+
+	"kexuedns/util/dnsmsg"
+)
+
+const metricsPrefix = "kexuedns_"
+
+// Bucket upper bounds of the response sizes (bytes) and answer counts.
+var (
+	responseSizeBuckets = [...]uint64{64, 128, 256, 512, 1024, 2048, 4096}
+	answerCountBuckets  = [...]uint64{0, 1, 2, 4, 8, 16, 32}
+)
+
+// Histogram with 7 fixed buckets, plus the implicit +Inf one.
+// The counts are not cumulative but per bucket, and summed up upon export.
+type histogram struct {
+	counts [8]atomic.Uint64
+	sum    atomic.Uint64
+}
+
+func (h *histogram) observe(bounds *[7]uint64, v uint64) {
+	i := 0
+	for i < len(bounds) && v > bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(v)
+}
+
+// Get the total number of the observations.
+func (h *histogram) total() uint64 {
+	var n uint64
+	for i := range h.counts {
+		n += h.counts[i].Load()
+	}
+	return n
+}
+
+// Write the histogram samples of the metric (name) with the labels.
+func (h *histogram) write(w io.Writer, bounds *[7]uint64, name, labels string) {
+	var count uint64
+	for i := range h.counts {
+		count += h.counts[i].Load()
+		le := "+Inf"
+		if i < len(bounds) {
+			le = strconv.FormatUint(bounds[i], 10)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, le, count)
+	}
+	fmt.Fprintf(w, "%s_sum{%s} %d\n", name, labels, h.sum.Load())
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, count)
+}
+
+type routeMetrics struct {
+	responseSize histogram
+	answerCount  histogram
+
+	// Number of the queries sent upstream, and served by coalescing with
+	// the identical in-flight ones
+	upstream  atomic.Uint64
+	coalesced atomic.Uint64
+}
+
+// Metrics of the responses per route; slot 0 is for the default resolver,
+// and slot i+1 for the route of index i.
+type forwarderMetrics struct {
+	routes [MaxRoutes + 1]routeMetrics
+
+	// Number of the queries with the ECS added by the forwarder, and the
+	// ones without because of no subnet (i.e., neither my IP nor a static
+	// subnet) or the client's own ECS
+	ecsInjected atomic.Uint64
+	ecsNoSubnet atomic.Uint64
+	ecsClient   atomic.Uint64
+	// Number of the upstream responses with a nonzero ECS scope, i.e.,
+	// the answers tailored to the client subnet
+	ecsScoped atomic.Uint64
+}
+
+// Observe the response (resp) of the route (index); -1 for the default
+// resolver.
+func (m *forwarderMetrics) observe(index int, resp []byte) {
+	if len(resp) < 12 || index+1 >= len(m.routes) {
+		return
+	}
+	rm := &m.routes[index+1]
+	rm.responseSize.observe(&responseSizeBuckets, uint64(len(resp)))
+	rm.answerCount.observe(&answerCountBuckets, uint64(binary.BigEndian.Uint16(resp[6:])))
+}
+
+// Observe an upstream query of the route (index; -1 for the default
+// resolver), which is either sent or coalesced (shared).
+func (m *forwarderMetrics) observeUpstream(index int, shared bool) {
+	if index+1 >= len(m.routes) {
+		return
+	}
+	rm := &m.routes[index+1]
+	if shared {
+		rm.coalesced.Add(1)
+	} else {
+		rm.upstream.Add(1)
+	}
+}
+
+// Observe the ECS handling of a query: added by the forwarder (injected),
+// or skipped with the client's own ECS (own) or not.
+func (m *forwarderMetrics) observeECS(injected, own bool) {
+	switch {
+	case injected:
+		m.ecsInjected.Add(1)
+	case own:
+		m.ecsClient.Add(1)
+	default:
+		m.ecsNoSubnet.Add(1)
+	}
+}
+
+// Observe the ECS scope of an upstream response (resp).
+func (m *forwarderMetrics) observeECSScope(resp []byte) {
+	if scope, ok := dnsmsg.RawMsg(resp).EdnsSubnetScope(); ok && scope > 0 {
+		m.ecsScoped.Add(1)
+	}
+}
+
+// Statistics of the query deduplication (i.e., coalescing), globally and
+// per route.
+type DedupStats struct {
+	// Number of the queries sent upstream
+	Upstream uint64 `json:"upstream"`
+	// Number of the queries served by coalescing with the identical
+	// in-flight ones, i.e., saved from being sent upstream
+	Coalesced uint64 `json:"coalesced"`
+	// Per route, only the used ones
+	Routes []*RouteDedupStats `json:"routes"`
+}
+
+type RouteDedupStats struct {
+	Index     int    `json:"index"` // -1 if the default
+	Upstream  uint64 `json:"upstream"`
+	Coalesced uint64 `json:"coalesced"`
+}
+
+func (m *forwarderMetrics) dedupStats() *DedupStats {
+	ds := &DedupStats{Routes: []*RouteDedupStats{}}
+	for i := range m.routes {
+		rm := &m.routes[i]
+		rs := &RouteDedupStats{
+			Index:     i - 1,
+			Upstream:  rm.upstream.Load(),
+			Coalesced: rm.coalesced.Load(),
+		}
+		if rs.Upstream == 0 && rs.Coalesced == 0 {
+			continue
+		}
+		ds.Upstream += rs.Upstream
+		ds.Coalesced += rs.Coalesced
+		ds.Routes = append(ds.Routes, rs)
+	}
+	return ds
+}
+
+// Write the metrics in the Prometheus text format (version 0.0.4).
+func (f *Forwarder) WriteMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	name := metricsPrefix + "junk_dropped_total"
+	fmt.Fprintf(bw, "# HELP %s Number of the dropped junk packets.\n", name)
+	fmt.Fprintf(bw, "# TYPE %s counter\n", name)
+	fmt.Fprintf(bw, "%s %d\n", name, f.junkDropped.Load())
+
+	name = metricsPrefix + "ecs_injected_total"
+	fmt.Fprintf(bw, "# HELP %s Number of the queries with the ECS added.\n", name)
+	fmt.Fprintf(bw, "# TYPE %s counter\n", name)
+	fmt.Fprintf(bw, "%s %d\n", name, f.metrics.ecsInjected.Load())
+	name = metricsPrefix + "ecs_skipped_total"
+	fmt.Fprintf(bw, "# HELP %s Number of the queries without the ECS added by reason.\n", name)
+	fmt.Fprintf(bw, "# TYPE %s counter\n", name)
+	fmt.Fprintf(bw, "%s{reason=\"no_subnet\"} %d\n", name, f.metrics.ecsNoSubnet.Load())
+	fmt.Fprintf(bw, "%s{reason=\"client_ecs\"} %d\n", name, f.metrics.ecsClient.Load())
+	name = metricsPrefix + "ecs_scoped_responses_total"
+	fmt.Fprintf(bw, "# HELP %s Number of the upstream responses with a nonzero ECS scope.\n", name)
+	fmt.Fprintf(bw, "# TYPE %s counter\n", name)
+	fmt.Fprintf(bw, "%s %d\n", name, f.metrics.ecsScoped.Load())
+
+	counters := []struct {
+		name string
+		help string
+		get  func(rm *routeMetrics) uint64
+	}{
+		{
+			name: metricsPrefix + "upstream_queries_total",
+			help: "Number of the queries sent upstream per route.",
+			get:  func(rm *routeMetrics) uint64 { return rm.upstream.Load() },
+		},
+		{
+			name: metricsPrefix + "coalesced_queries_total",
+			help: "Number of the queries served by coalescing with the identical in-flight ones per route.",
+			get:  func(rm *routeMetrics) uint64 { return rm.coalesced.Load() },
+		},
+	}
+	for _, cm := range counters {
+		fmt.Fprintf(bw, "# HELP %s %s\n", cm.name, cm.help)
+		fmt.Fprintf(bw, "# TYPE %s counter\n", cm.name)
+		for i := range f.metrics.routes {
+			rm := &f.metrics.routes[i]
+			if i > 0 && rm.upstream.Load() == 0 && rm.coalesced.Load() == 0 {
+				continue // route unused or not configured
+			}
+			fmt.Fprintf(bw, "%s{route=\"%s\"} %d\n", cm.name, metricsRouteLabel(i), cm.get(rm))
+		}
+	}
+
+	histograms := []struct {
+		name   string
+		help   string
+		bounds *[7]uint64
+		get    func(rm *routeMetrics) *histogram
+	}{
+		{
+			name:   metricsPrefix + "response_size_bytes",
+			help:   "Size of the responses per route.",
+			bounds: &responseSizeBuckets,
+			get:    func(rm *routeMetrics) *histogram { return &rm.responseSize },
+		},
+		{
+			name:   metricsPrefix + "response_answers",
+			help:   "Number of the answer records in the responses per route.",
+			bounds: &answerCountBuckets,
+			get:    func(rm *routeMetrics) *histogram { return &rm.answerCount },
+		},
+	}
+	for _, hm := range histograms {
+		fmt.Fprintf(bw, "# HELP %s %s\n", hm.name, hm.help)
+		fmt.Fprintf(bw, "# TYPE %s histogram\n", hm.name)
+		for i := range f.metrics.routes {
+			rm := &f.metrics.routes[i]
+			if i > 0 && rm.responseSize.total() == 0 {
+				continue // route unused or not configured
+			}
+			hm.get(rm).write(bw, hm.bounds, hm.name, `route="`+metricsRouteLabel(i)+`"`)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Get the route label of the metrics slot (i).
+func metricsRouteLabel(i int) string {
+	if i == 0 {
+		return "default"
+	}
+	return strconv.Itoa(i - 1)
+}
@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Metrics - tests
+//
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+	"kexuedns/util/dnsmsg"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for _, v := range []uint64{0, 64, 65, 4096, 4097, 100000} {
+		h.observe(&responseSizeBuckets, v)
+	}
+	expected := [8]uint64{2, 1, 0, 0, 0, 0, 1, 2}
+	for i := range h.counts {
+		if n := h.counts[i].Load(); n != expected[i] {
+			t.Errorf(`counts[%d] = %d; want %d`, i, n, expected[i])
+		}
+	}
+	if n := h.total(); n != 6 {
+		t.Errorf(`total() = %d; want 6`, n)
+	}
+	if s := h.sum.Load(); s != 108322 {
+		t.Errorf(`sum = %d; want 108322`, s)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = &answeringResolver{}
+	for range 3 {
+		if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+			t.Fatalf(`handleQuery() = %v; want nil`, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := f.WriteMetrics(&buf); err != nil {
+		t.Fatalf(`WriteMetrics() = %v; want nil`, err)
+	}
+	out := buf.String()
+	t.Logf("metrics:\n%s", out)
+	for _, line := range []string{
+		"# TYPE kexuedns_response_size_bytes histogram\n",
+		`kexuedns_response_size_bytes_bucket{route="default",le="64"} 3` + "\n",
+		`kexuedns_response_size_bytes_bucket{route="default",le="+Inf"} 3` + "\n",
+		`kexuedns_response_size_bytes_count{route="default"} 3` + "\n",
+		`kexuedns_response_answers_bucket{route="default",le="0"} 0` + "\n",
+		`kexuedns_response_answers_bucket{route="default",le="1"} 3` + "\n",
+		`kexuedns_response_answers_sum{route="default"} 3` + "\n",
+		"kexuedns_junk_dropped_total 0\n",
+		"# TYPE kexuedns_upstream_queries_total counter\n",
+		`kexuedns_upstream_queries_total{route="default"} 3` + "\n",
+		`kexuedns_coalesced_queries_total{route="default"} 0` + "\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf(`WriteMetrics() missing line %q`, line)
+		}
+	}
+	if strings.Contains(out, `route="1"`) {
+		t.Errorf(`WriteMetrics() has the unused route`)
+	}
+}
+
+// Resolver answering with the ECS scope set to the source prefix length.
+type scopingResolver struct {
+	answeringResolver
+}
+
+func (r *scopingResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	resp, err := r.answeringResolver.Query(ctx, msg, isUDP)
+	if err != nil {
+		return nil, err
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil {
+		return nil, err
+	}
+	for _, rr := range dmsg.Additionals {
+		if opt, ok := rr.Body.(*dnsmessage.OPTResource); ok {
+			for i, op := range opt.Options {
+				if op.Code == 8 && len(op.Data) >= 4 {
+					data := slices.Clone(op.Data)
+					data[3] = data[2]
+					opt.Options[i].Data = data
+				}
+			}
+		}
+	}
+	return dmsg.Pack()
+}
+
+func TestWriteMetricsECS(t *testing.T) {
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = &scopingResolver{}
+	handle := func(query []byte) {
+		t.Helper()
+		if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+			t.Fatalf(`handleQuery() = %v; want nil`, err)
+		}
+	}
+
+	// No subnet to add.
+	handle(newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA))
+	// Client's own ECS.
+	q, err := dnsmsg.NewQueryMsg(newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatalf(`NewQueryMsg() = %v; want nil`, err)
+	}
+	q.SetEdnsSubnet(netip.MustParseAddr("198.51.100.0"), 24)
+	query, err := q.Build()
+	if err != nil {
+		t.Fatalf(`Build() = %v; want nil`, err)
+	}
+	handle(query)
+	// ECS added.
+	if err := f.SetECSSubnet("203.0.113.0/24", ""); err != nil {
+		t.Fatalf(`SetECSSubnet() = %v; want nil`, err)
+	}
+	handle(newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA))
+	handle(newTestQuery(t, "www.example.com.", dnsmessage.TypeA))
+
+	var buf bytes.Buffer
+	if err := f.WriteMetrics(&buf); err != nil {
+		t.Fatalf(`WriteMetrics() = %v; want nil`, err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		"kexuedns_ecs_injected_total 2\n",
+		`kexuedns_ecs_skipped_total{reason="no_subnet"} 1` + "\n",
+		`kexuedns_ecs_skipped_total{reason="client_ecs"} 1` + "\n",
+		"kexuedns_ecs_scoped_responses_total 3\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf(`WriteMetrics() missing line %q`, line)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Answer overrides: force the A/AAAA answers of the names regardless of the
+// upstream ones, e.g., split-horizon.
+//
+
+package dns
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/log"
+	"kexuedns/util/dnsmsg"
+)
+
+// Set the answer overrides (overrides) mapping the names (e.g.,
+// "internal.example.com") to the addresses (e.g., ["192.168.1.10"]).
+func (f *Forwarder) SetAnswerOverrides(overrides map[string][]string) error {
+	m := make(map[string][]netip.Addr, len(overrides))
+	for name, addrs := range overrides {
+		key := strings.ToLower(name)
+		if !strings.HasSuffix(key, ".") {
+			key += "."
+		}
+		if _, err := dnsmessage.NewName(key); err != nil || key == "." {
+			return fmt.Errorf("invalid override name [%s]", name)
+		}
+		if len(addrs) == 0 {
+			return fmt.Errorf("no override addresses for [%s]", name)
+		}
+		for _, s := range addrs {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return fmt.Errorf("invalid override address [%s] for [%s]: %w",
+					s, name, err)
+			}
+			m[key] = append(m[key], addr.Unmap())
+		}
+	}
+	f.AnswerOverrides = m
+	return nil
+}
+
+// Override the answers to the A/AAAA query (qmsg) of the question
+// (question) if its name is overridden: the addresses of the queried family
+// with the TTL of the synthesized answers, or NODATA if none, so that the
+// upstream address of the other family doesn't leak.
+// Return false if not overridden.
+func (f *Forwarder) overrideAnswers(qmsg []byte, question *dnsmessage.Question) ([]byte, bool) {
+	if question.Type != dnsmessage.TypeA && question.Type != dnsmessage.TypeAAAA {
+		return nil, false
+	}
+	addrs, ok := f.AnswerOverrides[strings.ToLower(question.Name.String())]
+	if !ok {
+		return nil, false
+	}
+	query, err := dnsmsg.NewQueryMsg(qmsg)
+	if err != nil {
+		return nil, false
+	}
+
+	ttl := f.synthTTL()
+	b := NewResponseBuilder(query)
+	n := 0
+	for _, addr := range addrs {
+		switch {
+		case question.Type == dnsmessage.TypeA && addr.Is4():
+			b.AddA(addr, ttl)
+		case question.Type == dnsmessage.TypeAAAA && addr.Is6():
+			b.AddAAAA(addr, ttl)
+		default:
+			continue
+		}
+		n++
+	}
+	if n == 0 {
+		b.NODATA(nil)
+	}
+	resp, err := b.Build()
+	if err != nil {
+		log.Debugf("failed to build override response: %v", err)
+		return nil, false
+	}
+	return resp, true
+}
@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Answer overrides - tests
+//
+
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+)
+
+func TestSetAnswerOverrides(t *testing.T) {
+	tests := []struct {
+		overrides map[string][]string
+		ok        bool
+	}{
+		{nil, true},
+		{map[string][]string{"Internal.Example.com": {"192.168.1.10", "fd00::10"}}, true},
+		{map[string][]string{"internal.example.com.": {"::ffff:192.168.1.10"}}, true},
+		{map[string][]string{"internal.example.com": {}}, false},
+		{map[string][]string{"internal.example.com": {"bogus"}}, false},
+		{map[string][]string{".": {"192.168.1.10"}}, false},
+		{map[string][]string{"": {"192.168.1.10"}}, false},
+	}
+	for i, tc := range tests {
+		f := &Forwarder{}
+		if err := f.SetAnswerOverrides(tc.overrides); (err == nil) != tc.ok {
+			t.Errorf(`[%d] SetAnswerOverrides(%v) = %v; want ok=%t`, i, tc.overrides, err, tc.ok)
+		}
+	}
+
+	f := &Forwarder{}
+	f.SetAnswerOverrides(map[string][]string{"Internal.Example.com": {"::ffff:192.168.1.10"}})
+	addrs := f.AnswerOverrides["internal.example.com."]
+	if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.168.1.10") {
+		t.Errorf(`AnswerOverrides = %v; want the normalized name and address`, f.AnswerOverrides)
+	}
+}
+
+func TestHandleQueryAnswerOverride(t *testing.T) {
+	resolver := &answeringResolver{}
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = resolver
+	err := f.SetAnswerOverrides(map[string][]string{
+		"internal.example.com": {"192.168.1.10", "192.168.1.11"},
+	})
+	if err != nil {
+		t.Fatalf(`SetAnswerOverrides() = %v; want nil`, err)
+	}
+
+	tests := []struct {
+		name    string
+		qtype   dnsmessage.Type
+		answers []string // empty for NODATA
+	}{
+		{"INTERNAL.example.com.", dnsmessage.TypeA, []string{"192.168.1.10", "192.168.1.11"}},
+		{"internal.example.com.", dnsmessage.TypeAAAA, nil},
+		{"www.example.com.", dnsmessage.TypeA, []string{"192.0.2.1"}},
+		{"www.example.com.", dnsmessage.TypeAAAA, []string{"2001:db8::1"}},
+	}
+	for _, tc := range tests {
+		query := newTestQuery(t, tc.name, tc.qtype)
+		resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+		if err != nil {
+			t.Fatalf(`handleQuery(%s %s) = %v; want nil`, tc.name, tc.qtype, err)
+		}
+		var dmsg dnsmessage.Message
+		if err := dmsg.Unpack(resp); err != nil {
+			t.Fatalf(`Unpack() = %v; want nil`, err)
+		}
+		if dmsg.ID != 0x1234 || dmsg.RCode != dnsmessage.RCodeSuccess ||
+			len(dmsg.Answers) != len(tc.answers) {
+			t.Errorf(`handleQuery(%s %s) = %+v; want %v`, tc.name, tc.qtype, dmsg, tc.answers)
+			continue
+		}
+		for i, rr := range dmsg.Answers {
+			var addr netip.Addr
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				addr = netip.AddrFrom4(body.A)
+			case *dnsmessage.AAAAResource:
+				addr = netip.AddrFrom16(body.AAAA)
+			}
+			if addr.String() != tc.answers[i] {
+				t.Errorf(`handleQuery(%s %s) answer[%d] = %v; want %s`,
+					tc.name, tc.qtype, i, addr, tc.answers[i])
+			}
+		}
+	}
+	// The overridden ones are still forwarded.
+	if n := resolver.queries.Load(); n != int32(len(tests)) {
+		t.Errorf(`upstream queries = %d; want %d`, n, len(tests))
+	}
+}
@@ -0,0 +1,42 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Per-query request ID carried in the context, to correlate the log
+// messages of a query across the forwarder, router, resolver and pool.
+//
+
+package dns
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+)
+
+// Request ID of a query, which is 0 if untagged, e.g., for the internal
+// probes.
+type requestID uint64
+
+var lastRequestID atomic.Uint64
+
+type requestIDKey struct{}
+
+func (id requestID) String() string {
+	return "req#" + strconv.FormatUint(uint64(id), 10)
+}
+
+// Tag the context with a new request ID, unless already tagged.
+func withRequestID(ctx context.Context) (context.Context, requestID) {
+	if id := requestIDFrom(ctx); id != 0 {
+		return ctx, id
+	}
+	id := requestID(lastRequestID.Add(1))
+	return context.WithValue(ctx, requestIDKey{}, id), id
+}
+
+// Get the request ID of the context.
+func requestIDFrom(ctx context.Context) requestID {
+	id, _ := ctx.Value(requestIDKey{}).(requestID)
+	return id
+}
@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Request ID - tests
+//
+
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+)
+
+func TestRequestID(t *testing.T) {
+	ctx := context.Background()
+	if id := requestIDFrom(ctx); id != 0 {
+		t.Errorf(`requestIDFrom(untagged) = %d; want 0`, id)
+	}
+
+	ctx1, id1 := withRequestID(ctx)
+	if id1 == 0 || requestIDFrom(ctx1) != id1 {
+		t.Errorf(`withRequestID() = %d, requestIDFrom() = %d; want same non-zero`,
+			id1, requestIDFrom(ctx1))
+	}
+	// Already tagged
+	if ctx2, id2 := withRequestID(ctx1); ctx2 != ctx1 || id2 != id1 {
+		t.Errorf(`withRequestID(tagged) = %d; want %d`, id2, id1)
+	}
+	if _, id3 := withRequestID(ctx); id3 <= id1 {
+		t.Errorf(`withRequestID() = %d; want > %d`, id3, id1)
+	}
+
+	if s := requestID(42).String(); s != "req#42" {
+		t.Errorf(`String() = %q; want "req#42"`, s)
+	}
+}
+
+func TestHandleQueryRequestID(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	resolver := &recordingResolver{
+		staticResolver: staticResolver{
+			response: newTestResponse(t, query, dnsmessage.RCodeSuccess, nil, nil),
+		},
+	}
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = resolver
+
+	var last requestID
+	for i := range 2 {
+		if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+			t.Fatalf(`[%d] handleQuery() = %v; want nil`, i, err)
+		}
+		if resolver.id == 0 || resolver.id == last {
+			t.Errorf(`[%d] request ID = %d; want new non-zero`, i, resolver.id)
+		}
+		last = resolver.id
+	}
+
+	// The tagged ID is kept.
+	ctx, id := withRequestID(context.Background())
+	if _, err := f.handleQuery(ctx, query, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if resolver.id != id {
+		t.Errorf(`request ID = %d; want %d`, resolver.id, id)
+	}
+}
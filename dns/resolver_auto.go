@@ -0,0 +1,258 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Resolver probing the transports to use the most secure working one.
+//
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/log"
+)
+
+// Transports probed by the auto protocol in the preference order, with
+// their standard ports.
+// NOTE: DoQ is not supported yet.
+var autoTransports = []struct {
+	protocol string
+	port     uint16
+}{
+	{ResolverProtocolDoH, 443},
+	{ResolverProtocolDoT, 853},
+	{ResolverProtocolTCP, 53},
+	{ResolverProtocolUDP, 53},
+}
+
+const (
+	autoProbeTimeout    = 2 * time.Second
+	autoReprobeFailures = 5 // consecutive query failures to re-probe
+)
+
+type ResolverAuto struct {
+	re ResolverExport // the original config
+
+	lock      sync.RWMutex
+	resolver  Resolver // resolver of the chosen transport
+	transport string
+	closed    bool
+
+	failures atomic.Int32 // consecutive query failures
+	probing  atomic.Bool
+	wg       sync.WaitGroup
+}
+
+// Create a resolver which probes the transports (DoH, DoT, TCP, UDP) in
+// order on the IP of the address (re.Address) and settles on the first
+// working one. It re-probes after the queries fail repeatedly.
+// If no transport works, it falls back to the default one (UDP+TCP), or TCP
+// if a proxy is configured; the UDP probe is skipped with a proxy or force
+// TCP.
+func NewResolverAuto(re *ResolverExport) (*ResolverAuto, error) {
+	if err := re.Validate(); err != nil {
+		return nil, err
+	}
+
+	r := &ResolverAuto{re: *re}
+	resolver, transport, err := r.probe()
+	if err != nil {
+		return nil, err
+	}
+	r.resolver, r.transport = resolver, transport
+	return r, nil
+}
+
+// Probe the transports and return the resolver of the first working one.
+func (r *ResolverAuto) probe() (Resolver, string, error) {
+	addrport, _ := netip.ParseAddrPort(r.re.Address) // validated
+	for _, t := range autoTransports {
+		if t.protocol == ResolverProtocolUDP && (r.re.Proxy != "" || r.re.ForceTCP) {
+			continue // cannot go through the proxy, or UDP unwanted
+		}
+		re := r.re
+		re.Protocol = t.protocol
+		re.Address = netip.AddrPortFrom(addrport.Addr(), t.port).String()
+		re.Addresses = nil
+		resolver, err := newResolver(&re)
+		if err != nil {
+			log.Debugf("[%s] failed to create %s resolver: %v",
+				r.re.Name, t.protocol, err)
+			continue
+		}
+		if err := probeResolver(resolver); err != nil {
+			log.Debugf("[%s] probe %s at %s failed: %v",
+				r.re.Name, t.protocol, re.Address, err)
+			resolver.Close()
+			continue
+		}
+		log.Infof("[%s] probed and chose transport: %s at %s",
+			r.re.Name, t.protocol, re.Address)
+		return resolver, t.protocol, nil
+	}
+
+	fallback := ResolverProtocolDefault
+	if r.re.Proxy != "" {
+		fallback = ResolverProtocolTCP
+	}
+	log.Warnf("[%s] no transport worked; fall back to %s", r.re.Name, fallback)
+	re := r.re
+	re.Protocol = fallback
+	re.Addresses = nil
+	resolver, err := newResolver(&re)
+	if err != nil {
+		return nil, "", err
+	}
+	return resolver, fallback, nil
+}
+
+// Query the root NS to check the resolver works.
+func probeResolver(resolver Resolver) error {
+	_, err := queryProbe(resolver, ".", dnsmessage.TypeNS)
+	return err
+}
+
+// Query the name (name) of the type (qtype) by the resolver, and return
+// the rcode of the response.
+func queryProbe(resolver Resolver, name string, qtype dnsmessage.Type) (dnsmessage.RCode, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return 0, err
+	}
+	dmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{
+				Name:  qname,
+				Type:  qtype,
+				Class: dnsmessage.ClassINET,
+			},
+		},
+	}
+	msg, err := dmsg.Pack()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), autoProbeTimeout)
+	defer cancel()
+	resp, err := resolver.Query(ctx, msg, false)
+	if err != nil {
+		return 0, err
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return 0, err
+	}
+	if !h.Response {
+		return 0, errors.New("not a response")
+	}
+	return h.RCode, nil
+}
+
+// Re-probe the transports in background and switch to the new resolver.
+func (r *ResolverAuto) reprobe() {
+	defer r.wg.Done()
+	defer r.probing.Store(false)
+
+	log.Warnf("[%s] %d consecutive failures; re-probing transports",
+		r.re.Name, r.failures.Load())
+	resolver, transport, err := r.probe()
+	if err != nil {
+		log.Errorf("[%s] failed to re-probe: %v", r.re.Name, err)
+		return
+	}
+
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		resolver.Close()
+		return
+	}
+	old := r.resolver
+	r.resolver, r.transport = resolver, transport
+	r.lock.Unlock()
+
+	r.failures.Store(0)
+	old.Close() // wait for its in-flight queries
+}
+
+func (r *ResolverAuto) current() Resolver {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.resolver
+}
+
+func (r *ResolverAuto) Export() *ResolverExport {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	re := r.resolver.Export()
+	re.Name = r.re.Name
+	re.Protocol = ResolverProtocolAuto
+	re.Address = r.re.Address
+	re.Transport = r.transport
+	return re
+}
+
+func (r *ResolverAuto) Stats() *ResolverStats {
+	rs := r.current().Stats()
+	rs.Name = r.re.Name
+	return rs
+}
+
+func (r *ResolverAuto) Drain() int {
+	return r.current().Drain()
+}
+
+func (r *ResolverAuto) Close() {
+	r.lock.Lock()
+	r.closed = true
+	r.lock.Unlock()
+
+	r.wg.Wait()
+	r.resolver.Close()
+	log.Infof("[%s] closed", r.re.Name)
+}
+
+func (r *ResolverAuto) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	resp, _, err := r.QueryWithMeta(ctx, msg, isUDP)
+	return resp, err
+}
+
+func (r *ResolverAuto) QueryWithMeta(ctx context.Context, msg []byte,
+	isUDP bool) ([]byte, QueryMeta, error) {
+	resp, meta, err := queryWithMeta(ctx, r.current(), msg, isUDP)
+	if err == nil {
+		r.failures.Store(0)
+		return resp, meta, nil
+	}
+	if errors.Is(err, context.Canceled) {
+		return nil, meta, err // canceled by the client; not a failure
+	}
+
+	if r.failures.Add(1) >= autoReprobeFailures && r.probing.CompareAndSwap(false, true) {
+		r.lock.RLock()
+		if r.closed {
+			r.probing.Store(false)
+		} else {
+			r.wg.Add(1)
+			go r.reprobe()
+		}
+		r.lock.RUnlock()
+	}
+	return nil, meta, err
+}
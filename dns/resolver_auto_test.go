@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Resolver probing the transports - tests
+//
+
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResolverAuto(t *testing.T) {
+	server := newPaddingUDPServer(t, 64)
+	port := uint16(server.LocalAddr().(*net.UDPAddr).Port)
+	silent := newSilentUDPServer(t)
+	silentPort := uint16(silent.LocalAddr().(*net.UDPAddr).Port)
+
+	saved := autoTransports
+	defer func() { autoTransports = saved }()
+	autoTransports = []struct {
+		protocol string
+		port     uint16
+	}{
+		{ResolverProtocolTCP, port}, // no TCP listener: refused
+		{ResolverProtocolUDP, silentPort},
+		{ResolverProtocolUDP, port},
+	}
+
+	r, err := NewResolverFromExport(&ResolverExport{
+		Protocol: ResolverProtocolAuto,
+		Address:  "127.0.0.1:53",
+	})
+	if err != nil {
+		t.Fatalf("NewResolverFromExport() = %v; want nil", err)
+	}
+	defer r.Close()
+
+	re := r.Export()
+	if re.Protocol != ResolverProtocolAuto || re.Transport != ResolverProtocolUDP ||
+		re.Address != "127.0.0.1:53" {
+		t.Errorf("Export() = %+v; want auto with transport %s",
+			re, ResolverProtocolUDP)
+	}
+	if ra := r.(*ResolverAuto); ra.resolver.Export().Address != server.LocalAddr().String() {
+		t.Errorf("chose address %s; want %s",
+			ra.resolver.Export().Address, server.LocalAddr())
+	}
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := r.Query(ctx, query, true); err != nil {
+		t.Errorf("Query() = %v; want nil", err)
+	}
+}
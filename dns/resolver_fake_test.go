@@ -0,0 +1,253 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// In-memory fake resolver for the hermetic tests.
+//
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+	"kexuedns/util/dnsmsg"
+)
+
+// A resolver answering the canned records per question and recording the
+// queries it received, without any network I/O, so that the tests can
+// assert the routing, ECS, caching and single-flight behaviors.
+// The unknown questions are answered NXDOMAIN.
+type fakeResolver struct {
+	name    string
+	lock    sync.Mutex
+	answers map[fakeQuestion]*fakeAnswer
+	queries [][]byte
+	err     error // error to return instead of the responses
+}
+
+type fakeQuestion struct {
+	name  string // lower case and fully qualified
+	qtype dnsmessage.Type
+}
+
+type fakeAnswer struct {
+	rcode   dnsmessage.RCode
+	records []dnsmessage.Resource
+}
+
+func newFakeResolver(name string) *fakeResolver {
+	return &fakeResolver{
+		name:    name,
+		answers: make(map[fakeQuestion]*fakeAnswer),
+	}
+}
+
+func newFakeQuestion(name string, qtype dnsmessage.Type) fakeQuestion {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return fakeQuestion{name: name, qtype: qtype}
+}
+
+func (r *fakeResolver) entry(name string, qtype dnsmessage.Type) *fakeAnswer {
+	q := newFakeQuestion(name, qtype)
+	a := r.answers[q]
+	if a == nil {
+		a = &fakeAnswer{}
+		r.answers[q] = a
+	}
+	return a
+}
+
+// Add the record (body) of the TTL (ttl) to answer the question (name, qtype).
+func (r *fakeResolver) add(name string, qtype dnsmessage.Type, ttl uint32,
+	body dnsmessage.ResourceBody) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	a := r.entry(name, qtype)
+	a.records = append(a.records, dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(newFakeQuestion(name, qtype).name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		},
+		Body: body,
+	})
+}
+
+// Answer the question (name, qtype) with the response code (rcode).
+func (r *fakeResolver) setRCode(name string, qtype dnsmessage.Type, rcode dnsmessage.RCode) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.entry(name, qtype).rcode = rcode
+}
+
+// Fail all the queries with the error (err); nil to answer again.
+func (r *fakeResolver) setError(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.err = err
+}
+
+// Get the copies of the queries received so far.
+func (r *fakeResolver) received() [][]byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	queries := make([][]byte, len(r.queries))
+	for i, q := range r.queries {
+		queries[i] = bytes.Clone(q)
+	}
+	return queries
+}
+
+// Get the number of the queries received so far.
+func (r *fakeResolver) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.queries)
+}
+
+func (r *fakeResolver) Export() *ResolverExport {
+	return &ResolverExport{Name: r.name}
+}
+
+func (r *fakeResolver) Stats() *ResolverStats {
+	return &ResolverStats{Name: r.name}
+}
+
+func (r *fakeResolver) Close() {}
+
+func (r *fakeResolver) Drain() int { return 0 }
+
+func (r *fakeResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(msg); err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.queries = append(r.queries, bytes.Clone(msg))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 dmsg.Header.ID,
+			Response:           true,
+			OpCode:             dmsg.Header.OpCode,
+			RecursionDesired:   dmsg.Header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              dnsmessage.RCodeNameError,
+		},
+		Questions: dmsg.Questions,
+	}
+	if len(dmsg.Questions) > 0 {
+		q := dmsg.Questions[0]
+		if a, ok := r.answers[newFakeQuestion(q.Name.String(), q.Type)]; ok {
+			resp.Header.RCode = a.rcode
+			resp.Answers = a.records
+		}
+	}
+	// Echo the EDNS without the options.
+	for _, rr := range dmsg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			resp.Additionals = []dnsmessage.Resource{
+				{Header: rr.Header, Body: &dnsmessage.OPTResource{}},
+			}
+			break
+		}
+	}
+	return resp.Pack()
+}
+
+func TestFakeResolver(t *testing.T) {
+	cache := NewMemoryCache()
+	defer cache.Close()
+	myIP := &config.MyIP{}
+	myIP.SetV4("203.0.113.1")
+	f := &Forwarder{myIP: myIP, Cache: cache}
+
+	def := newFakeResolver("default")
+	def.add("www.example.com", dnsmessage.TypeA, 300,
+		&dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+	f.Router.resolver = def
+	corp := newFakeResolver("corp")
+	corp.add("www.corp.example", dnsmessage.TypeA, 300,
+		&dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}})
+	routes, err := f.Router.newRoutes([]*RouteExport{
+		{Name: "corp", Zones: []string{"corp.example"}, ECSSubnetV4: "198.51.100.0/24"},
+	})
+	if err != nil {
+		t.Fatalf(`newRoutes() = %v; want nil`, err)
+	}
+	routes[0].resolver = corp
+	f.Router.routes = routes
+
+	query := func(name string) ([]byte, error) {
+		q := newTestQuery(t, name, dnsmessage.TypeA)
+		return f.handleQuery(context.Background(), q, netip.Addr{}, false)
+	}
+
+	// Routed, with the route's ECS.
+	resp, err := query("WWW.Corp.Example.")
+	if err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil || len(dmsg.Answers) != 1 ||
+		dmsg.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{10, 0, 0, 1} {
+		t.Errorf(`response = %+v (%v); want answer 10.0.0.1`, dmsg.Answers, err)
+	}
+	if n := corp.count(); n != 1 || def.count() != 0 {
+		t.Errorf(`queries = (corp: %d, default: %d); want (1, 0)`, n, def.count())
+	}
+	if p, ok := dnsmsg.RawMsg(corp.received()[0]).EdnsSubnet(); !ok ||
+		p.String() != "198.51.100.0/24" {
+		t.Errorf(`ECS = (%v, %v); want 198.51.100.0/24`, p, ok)
+	}
+
+	// Default, and then cached.
+	for range 2 {
+		if _, err := query("www.example.com."); err != nil {
+			t.Errorf(`handleQuery() = %v; want nil`, err)
+		}
+	}
+	if n := def.count(); n != 1 {
+		t.Errorf(`default queries = %d; want 1 with the cache`, n)
+	}
+	if p, ok := dnsmsg.RawMsg(def.received()[0]).EdnsSubnet(); !ok ||
+		p.String() != "203.0.113.0/24" {
+		t.Errorf(`ECS = (%v, %v); want 203.0.113.0/24`, p, ok)
+	}
+
+	// Unknown question: NXDOMAIN
+	resp, err = query("missing.example.com.")
+	if err != nil || dmsg.Unpack(resp) != nil || dmsg.Header.RCode != dnsmessage.RCodeNameError {
+		t.Errorf(`handleQuery(missing) = (%+v, %v); want NXDOMAIN`, dmsg.Header, err)
+	}
+
+	// Injected failure.
+	def.setError(errors.New("upstream down"))
+	if _, err := query("other.example.com."); err == nil {
+		t.Errorf(`handleQuery() = nil; want error`)
+	}
+	if n := def.count(); n != 3 {
+		t.Errorf(`default queries = %d; want 3`, n)
+	}
+}
@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Fault injection into the upstream queries for the resilience testing,
+// e.g., of the timeouts, failover and serve-stale, without a flaky upstream.
+// NOTE: It can only be enabled in the builds with the "faultinject" tag.
+//
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"kexuedns/log"
+)
+
+const (
+	maxFaultDelay   = 30 * time.Second // cap of the injected delay
+	dnsHeaderLength = 12               // kept by the corrupted responses
+)
+
+// Faults to inject, each into the percentage [0, 100] of the queries.
+type FaultConfig struct {
+	// Delay the queries by Delay.
+	DelayPercent int
+	Delay        time.Duration
+	// Drop the queries, i.e., time out.
+	DropPercent int
+	// Corrupt the responses, i.e., truncate them after the header.
+	CorruptPercent int
+}
+
+// Faults injected into the resolvers; nil if disabled.
+var faultConfig atomic.Pointer[FaultConfig]
+
+var ErrFaultInjectionUnsupported = errors.New(
+	"fault injection not supported (built without the faultinject tag)")
+
+// Set the faults (fc) to inject into the upstream queries of the resolvers
+// created afterwards; nil to disable.
+func SetFaultInjection(fc *FaultConfig) error {
+	if fc == nil {
+		faultConfig.Store(nil)
+		return nil
+	}
+	if !faultInjectionSupported {
+		return ErrFaultInjectionUnsupported
+	}
+	for _, p := range []int{fc.DelayPercent, fc.DropPercent, fc.CorruptPercent} {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("invalid fault percent %d: out of range [0, 100]", p)
+		}
+	}
+	if fc.Delay < 0 || fc.Delay > maxFaultDelay {
+		return fmt.Errorf("invalid fault delay %v: out of range [0, %v]",
+			fc.Delay, maxFaultDelay)
+	}
+	c := *fc
+	faultConfig.Store(&c)
+	log.Warnf("!!! FAULT INJECTION ENABLED !!! %+v", c)
+	return nil
+}
+
+// Wrap the resolver (r) to inject the faults if enabled.
+func withFaults(r Resolver, name string) Resolver {
+	if !faultInjectionSupported || faultConfig.Load() == nil {
+		return r
+	}
+	return &faultResolver{Resolver: r, name: name}
+}
+
+type faultResolver struct {
+	Resolver
+	name string
+}
+
+func (r *faultResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	resp, _, err := r.QueryWithMeta(ctx, msg, isUDP)
+	return resp, err
+}
+
+func (r *faultResolver) QueryWithMeta(ctx context.Context, msg []byte,
+	isUDP bool) ([]byte, QueryMeta, error) {
+	fc := faultConfig.Load()
+	if fc == nil {
+		return queryWithMeta(ctx, r.Resolver, msg, isUDP)
+	}
+
+	id := requestIDFrom(ctx)
+	if faultHit(fc.DropPercent) {
+		log.Debugf("[%s] %s: injected fault: drop", r.name, id)
+		ctx, cancel := withQueryBudget(ctx)
+		defer cancel()
+		<-ctx.Done()
+		return nil, QueryMeta{}, fmt.Errorf("%w: injected drop: %w",
+			ErrUpstreamTimeout, ctx.Err())
+	}
+	if faultHit(fc.DelayPercent) {
+		log.Debugf("[%s] %s: injected fault: delay %v", r.name, id, fc.Delay)
+		timer := time.NewTimer(fc.Delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, QueryMeta{}, fmt.Errorf("%w: injected delay: %w",
+				ErrUpstreamTimeout, ctx.Err())
+		case <-timer.C:
+		}
+	}
+
+	resp, meta, err := queryWithMeta(ctx, r.Resolver, msg, isUDP)
+	if err == nil && len(resp) > dnsHeaderLength && faultHit(fc.CorruptPercent) {
+		log.Debugf("[%s] %s: injected fault: corrupt", r.name, id)
+		resp = slices.Clone(resp[:dnsHeaderLength+rand.IntN(len(resp)-dnsHeaderLength)])
+	}
+	return resp, meta, err
+}
+
+// Whether to inject the fault of the percentage (percent).
+func faultHit(percent int) bool {
+	return percent > 0 && rand.IntN(100) < percent
+}
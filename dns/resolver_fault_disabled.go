@@ -0,0 +1,13 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Fault injection - disabled in the production builds
+//
+
+//go:build !faultinject
+
+package dns
+
+// NOTE: The fault resolver is never created, so it's dead code.
+const faultInjectionSupported = false
@@ -0,0 +1,12 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Fault injection - enabled in the testing builds
+//
+
+//go:build faultinject
+
+package dns
+
+const faultInjectionSupported = true
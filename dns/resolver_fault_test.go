@@ -0,0 +1,151 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Fault injection - tests
+//
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+)
+
+func TestSetFaultInjection(t *testing.T) {
+	t.Cleanup(func() { faultConfig.Store(nil) })
+	if err := SetFaultInjection(nil); err != nil || faultConfig.Load() != nil {
+		t.Errorf(`SetFaultInjection(nil) = %v; want disabled`, err)
+	}
+
+	fc := &FaultConfig{DropPercent: 10}
+	if !faultInjectionSupported {
+		if err := SetFaultInjection(fc); !errors.Is(err, ErrFaultInjectionUnsupported) {
+			t.Errorf(`SetFaultInjection() = %v; want %v`, err, ErrFaultInjectionUnsupported)
+		}
+		res := &staticResolver{}
+		if r := withFaults(res, "static"); r != res {
+			t.Errorf(`withFaults() = %T; want the resolver as is`, r)
+		}
+		return
+	}
+
+	for _, bad := range []*FaultConfig{
+		{DelayPercent: -1},
+		{DropPercent: 101},
+		{CorruptPercent: 200},
+		{DelayPercent: 10, Delay: maxFaultDelay + time.Second},
+	} {
+		if err := SetFaultInjection(bad); err == nil {
+			t.Errorf(`SetFaultInjection(%+v) = nil; want error`, bad)
+		}
+	}
+	if err := SetFaultInjection(fc); err != nil {
+		t.Fatalf(`SetFaultInjection() = %v; want nil`, err)
+	}
+	if _, ok := withFaults(&staticResolver{}, "static").(*faultResolver); !ok {
+		t.Errorf(`withFaults() not wrapped; want fault resolver`)
+	}
+}
+
+func TestFaultResolver(t *testing.T) {
+	// NOTE: Set the faults directly to test regardless of the build tag.
+	t.Cleanup(func() { faultConfig.Store(nil) })
+	setFaults := func(fc *FaultConfig) {
+		faultConfig.Store(fc)
+	}
+
+	upstream := &answeringResolver{}
+	cache := NewMemoryCache()
+	defer cache.Close()
+	f := &Forwarder{myIP: &config.MyIP{}, Cache: cache}
+	if err := f.SetStalePolicy(0, 3600); err != nil {
+		t.Fatalf(`SetStalePolicy() = %v; want nil`, err)
+	}
+	f.Router.resolver = &faultResolver{Resolver: upstream, name: "faulty"}
+
+	// Query with the timeout, and return the response.
+	query := func(name string, timeout time.Duration) ([]byte, error) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return f.handleQuery(ctx, newTestQuery(t, name, dnsmessage.TypeA), netip.Addr{}, true)
+	}
+	expire := func(key string) {
+		t.Helper()
+		entry, ok := cache.Get(key)
+		if !ok {
+			t.Fatalf(`Get(%q) = false; want cached`, key)
+		}
+		for _, off := range []int{0, 8} {
+			ts := binary.BigEndian.Uint64(entry[off:])
+			binary.BigEndian.PutUint64(entry[off:], ts-600)
+		}
+	}
+
+	// No faults.
+	if _, err := query("www.example.com.", time.Second); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+
+	tests := []struct {
+		name    string
+		faults  *FaultConfig
+		timeout time.Duration
+		stale   bool  // served stale
+		queries int32 // total upstream queries
+	}{
+		{"drop", &FaultConfig{DropPercent: 100}, 100 * time.Millisecond, true, 1},
+		{"long delay", &FaultConfig{DelayPercent: 100, Delay: time.Second}, 100 * time.Millisecond, true, 1},
+		{"short delay", &FaultConfig{DelayPercent: 100, Delay: 10 * time.Millisecond}, time.Second, false, 2},
+	}
+	for _, tc := range tests {
+		expire("TypeA:www.example.com") // the stale answers refresh it
+		setFaults(tc.faults)
+		resp, err := query("www.example.com.", tc.timeout)
+		if err != nil {
+			t.Fatalf(`[%s] handleQuery() = %v; want nil`, tc.name, err)
+		}
+		var dmsg dnsmessage.Message
+		if err := dmsg.Unpack(resp); err != nil || len(dmsg.Answers) != 1 {
+			t.Fatalf(`[%s] response = %+v (%v); want answered`, tc.name, dmsg, err)
+		}
+		// The stale answers have the TTL of StaleAnswerTTL.
+		if stale := dmsg.Answers[0].Header.TTL == uint32(defaultStaleAnswerTTL.Seconds()); stale != tc.stale {
+			t.Errorf(`[%s] stale = %t; want %t`, tc.name, stale, tc.stale)
+		}
+		if n := upstream.queries.Load(); n != tc.queries {
+			t.Errorf(`[%s] upstream queries = %d; want %d`, tc.name, n, tc.queries)
+		}
+	}
+
+	// Dropped without stale: time out.
+	setFaults(&FaultConfig{DropPercent: 100})
+	if _, err := query("new.example.com.", 100*time.Millisecond); !errors.Is(err, ErrUpstreamTimeout) {
+		t.Errorf(`handleQuery() = %v; want %v`, err, ErrUpstreamTimeout)
+	}
+
+	// Corrupted responses are never cached.
+	setFaults(&FaultConfig{CorruptPercent: 100})
+	resp, _ := query("corrupt.example.com.", time.Second)
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err == nil {
+		t.Errorf(`response = %+v; want corrupted`, dmsg)
+	}
+	setFaults(nil)
+	n := upstream.queries.Load()
+	if _, err := query("corrupt.example.com.", time.Second); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if m := upstream.queries.Load(); m != n+1 {
+		t.Errorf(`upstream queries = %d; want %d without the corrupted one cached`, m, n+1)
+	}
+}
@@ -0,0 +1,214 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Resolver answering from a file of the fixed answers, e.g., for the offline
+// tests and demos.
+//
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/log"
+	"kexuedns/util/dnsmsg"
+	"kexuedns/util/zonefile"
+)
+
+// Entry of the answers file, which is a JSON array of them, e.g.:
+//
+//	[
+//	  {"name": "www.example.com", "type": "A",
+//	   "answers": ["www.example.com. 300 IN A 192.0.2.1"]},
+//	  {"name": "gone.example.com", "type": "A", "rcode": "SERVFAIL"},
+//	  {"name": "example.org", "type": "MX", "response": "<base64>"}
+//	]
+//
+// where the answers are in the zone file format (relative to the name), and
+// the response is a recorded DNS response (base64 of the wire format)
+// replayed as is except the ID.
+type fileEntry struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	RCode    string   `json:"rcode,omitempty"` // default: NOERROR
+	Answers  []string `json:"answers,omitempty"`
+	Response []byte   `json:"response,omitempty"`
+}
+
+type fileAnswer struct {
+	rcode    dnsmessage.RCode
+	answers  []dnsmessage.Resource
+	response []byte // recorded response if non-nil
+}
+
+// A resolver looking up the question of each query in the answers file,
+// and answering NXDOMAIN if absent, without any network I/O.
+type ResolverFile struct {
+	name    string
+	path    string
+	answers map[string]*fileAnswer // by the key of fileKey()
+}
+
+// Validate the file resolver, of which the address is the file path.
+func (re *ResolverExport) validateFile() error {
+	if re.Address == "" && len(re.Addresses) > 0 {
+		re.Address = re.Addresses[0].Address
+	}
+	if re.Address == "" || len(re.Addresses) > 1 {
+		log.Errorf("file resolver requires exactly one path")
+		return fmt.Errorf("file resolver requires exactly one path")
+	}
+	re.Addresses = []*ResolverAddress{{Address: re.Address, Weight: 1}}
+	if re.Name == "" {
+		re.Name = re.Address
+	}
+	return nil
+}
+
+func NewResolverFile(re *ResolverExport) (*ResolverFile, error) {
+	if err := re.Validate(); err != nil {
+		return nil, err
+	}
+	answers, err := loadAnswersFile(re.Address)
+	if err != nil {
+		log.Errorf("[%s] failed to load answers: %v", re.Name, err)
+		return nil, err
+	}
+	log.Infof("[%s] loaded %d answers from file: %s", re.Name, len(answers), re.Address)
+	return &ResolverFile{
+		name:    re.Name,
+		path:    re.Address,
+		answers: answers,
+	}, nil
+}
+
+// Load the answers file (path), see fileEntry.
+func loadAnswersFile(path string) (map[string]*fileAnswer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*fileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("answers file %s: %w", path, err)
+	}
+
+	answers := make(map[string]*fileAnswer, len(entries))
+	for i, e := range entries {
+		a, key, err := e.parse()
+		if err != nil {
+			return nil, fmt.Errorf("answers file %s: entry #%d (%s %s): %w",
+				path, i, e.Name, e.Type, err)
+		}
+		answers[key] = a
+	}
+	return answers, nil
+}
+
+// Parse the entry into the answer and its key.
+func (e *fileEntry) parse() (*fileAnswer, string, error) {
+	name := dnsmsg.ToASCII(e.Name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	if _, err := dnsmessage.NewName(name); err != nil || e.Name == "" {
+		return nil, "", fmt.Errorf("invalid name")
+	}
+	qtype, err := dnsmsg.ParseType(e.Type)
+	if err != nil {
+		return nil, "", err
+	}
+	key := fileKey(name, qtype)
+
+	if e.Response != nil {
+		if e.RCode != "" || len(e.Answers) > 0 {
+			return nil, "", fmt.Errorf("response conflicts with rcode/answers")
+		}
+		var p dnsmessage.Parser
+		if h, err := p.Start(e.Response); err != nil || !h.Response {
+			return nil, "", fmt.Errorf("invalid response")
+		}
+		return &fileAnswer{response: e.Response}, key, nil
+	}
+
+	a := &fileAnswer{}
+	if e.RCode != "" {
+		if a.rcode, err = dnsmsg.ParseRCode(e.RCode); err != nil {
+			return nil, "", err
+		}
+	}
+	if len(e.Answers) > 0 {
+		r := strings.NewReader(strings.Join(e.Answers, "\n"))
+		if a.answers, err = zonefile.Parse(r, name); err != nil {
+			return nil, "", err
+		}
+	}
+	return a, key, nil
+}
+
+// Make the lookup key of the question (name, qtype), ignoring the case and
+// final dot of the name, e.g., "TypeA:www.example.com".
+func fileKey(name string, qtype dnsmessage.Type) string {
+	return qtype.String() + ":" + dnsmsg.NormalizeName(name)
+}
+
+func (r *ResolverFile) Export() *ResolverExport {
+	return &ResolverExport{
+		Name:     r.name,
+		Protocol: ResolverProtocolFile,
+		Address:  r.path,
+	}
+}
+
+func (r *ResolverFile) Stats() *ResolverStats {
+	return &ResolverStats{Name: r.name}
+}
+
+func (r *ResolverFile) Drain() int { return 0 }
+
+func (r *ResolverFile) Close() {
+	log.Infof("[%s] closed", r.name)
+}
+
+func (r *ResolverFile) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	resp, _, err := r.QueryWithMeta(ctx, msg, isUDP)
+	return resp, err
+}
+
+func (r *ResolverFile) QueryWithMeta(ctx context.Context, msg []byte,
+	_ bool) ([]byte, QueryMeta, error) {
+	start := time.Now()
+	resp, err := r.query(msg)
+	meta := QueryMeta{
+		Resolver:  r.name,
+		Transport: ResolverProtocolFile,
+		Latency:   time.Since(start),
+	}
+	return resp, meta, err
+}
+
+func (r *ResolverFile) query(msg []byte) ([]byte, error) {
+	query, err := dnsmsg.NewQueryMsg(msg)
+	if err != nil {
+		return nil, err
+	}
+	a, ok := r.answers[fileKey(query.QName(), query.QType())]
+	if !ok {
+		return buildResponse(query, dnsmessage.RCodeNameError, false, nil, nil, nil)
+	}
+	if a.response != nil {
+		resp := bytes.Clone(a.response)
+		dnsmsg.RawMsg(resp).SetID(query.Header.ID)
+		return resp, nil
+	}
+	return buildResponse(query, a.rcode, false, a.answers, nil, nil)
+}
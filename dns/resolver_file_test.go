@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// File resolver - tests
+//
+
+package dns
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func writeAnswersFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "answers.json")
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write answers file: %v", err)
+	}
+	return file
+}
+
+func TestResolverFile(t *testing.T) {
+	recorded := newTestQuery(t, "example.org.", dnsmessage.TypeMX)
+	recorded[2] |= 0x80 // QR
+	file := writeAnswersFile(t, `[
+  {"name": "www.example.com", "type": "A",
+   "answers": ["@ 300 IN A 192.0.2.1", "www.example.com. 300 IN A 192.0.2.2"]},
+  {"name": "gone.example.com.", "type": "a", "rcode": "servfail"},
+  {"name": "example.org", "type": "MX", "response": "`+
+		base64.StdEncoding.EncodeToString(recorded)+`"}
+]`)
+
+	r, err := NewResolverFromExport(&ResolverExport{Protocol: ResolverProtocolFile, Address: file})
+	if err != nil {
+		t.Fatalf(`NewResolverFromExport() = %v; want nil`, err)
+	}
+	defer r.Close()
+	if re := r.Export(); re.Name != file || re.Protocol != ResolverProtocolFile || re.Address != file {
+		t.Errorf(`Export() = %+v; want the file resolver`, re)
+	}
+
+	query := func(name string, qtype dnsmessage.Type) (*dnsmessage.Message, QueryMeta) {
+		t.Helper()
+		q := newTestQuery(t, name, qtype)
+		resp, meta, err := queryWithMeta(context.Background(), r, q, true)
+		if err != nil {
+			t.Fatalf(`Query(%s) = %v; want nil`, name, err)
+		}
+		var dmsg dnsmessage.Message
+		if err := dmsg.Unpack(resp); err != nil {
+			t.Fatalf(`Query(%s) = %x; unpack error: %v`, name, resp, err)
+		}
+		var qmsg dnsmessage.Message
+		qmsg.Unpack(q)
+		if dmsg.Header.ID != qmsg.Header.ID {
+			t.Errorf(`Query(%s) ID = %d; want %d`, name, dmsg.Header.ID, qmsg.Header.ID)
+		}
+		return &dmsg, meta
+	}
+
+	dmsg, meta := query("WWW.Example.COM.", dnsmessage.TypeA)
+	if dmsg.Header.RCode != dnsmessage.RCodeSuccess || len(dmsg.Answers) != 2 ||
+		dmsg.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{192, 0, 2, 1} ||
+		dmsg.Answers[0].Header.TTL != 300 {
+		t.Errorf(`Query(www) = %+v; want 2 answers`, dmsg)
+	}
+	if meta.Transport != ResolverProtocolFile || meta.Resolver != file {
+		t.Errorf(`meta = %+v; want transport file`, meta)
+	}
+
+	if dmsg, _ = query("gone.example.com.", dnsmessage.TypeA); dmsg.Header.RCode !=
+		dnsmessage.RCodeServerFailure {
+		t.Errorf(`Query(gone) rcode = %v; want SERVFAIL`, dmsg.Header.RCode)
+	}
+	if dmsg, _ = query("example.org.", dnsmessage.TypeMX); dmsg.Header.RCode !=
+		dnsmessage.RCodeSuccess || !dmsg.Header.Response {
+		t.Errorf(`Query(recorded) = %+v; want the recorded response`, dmsg.Header)
+	}
+	for _, q := range []struct {
+		name  string
+		qtype dnsmessage.Type
+	}{
+		{"www.example.com.", dnsmessage.TypeAAAA},
+		{"missing.example.com.", dnsmessage.TypeA},
+	} {
+		if dmsg, _ = query(q.name, q.qtype); dmsg.Header.RCode != dnsmessage.RCodeNameError {
+			t.Errorf(`Query(%s %v) rcode = %v; want NXDOMAIN`, q.name, q.qtype, dmsg.Header.RCode)
+		}
+	}
+}
+
+func TestResolverFileInvalid(t *testing.T) {
+	for _, content := range []string{
+		`{"name": "www.example.com"}`,
+		`[{"name": "", "type": "A"}]`,
+		`[{"name": "www.example.com", "type": "BOGUS"}]`,
+		`[{"name": "www.example.com", "type": "A", "rcode": "BOGUS"}]`,
+		`[{"name": "www.example.com", "type": "A", "answers": ["@ IN A 300.0.0.1"]}]`,
+		`[{"name": "www.example.com", "type": "A", "response": "AAAA"}]`,
+	} {
+		file := writeAnswersFile(t, content)
+		re := &ResolverExport{Protocol: ResolverProtocolFile, Address: file}
+		if _, err := NewResolverFromExport(re); err == nil {
+			t.Errorf(`NewResolverFromExport(%s) = nil; want error`, content)
+		}
+	}
+
+	for _, re := range []*ResolverExport{
+		{Protocol: ResolverProtocolFile},
+		{Protocol: ResolverProtocolFile, Addresses: []*ResolverAddress{
+			{Address: "a.json"}, {Address: "b.json"},
+		}},
+		{Protocol: ResolverProtocolFile, Address: filepath.Join(t.TempDir(), "missing.json")},
+	} {
+		if _, err := NewResolverFromExport(re); err == nil {
+			t.Errorf(`NewResolverFromExport(%+v) = nil; want error`, re)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Resolver sending the plain DNS queries without EDNS, for the legacy
+// upstreams misbehaving with any OPT record.
+//
+
+package dns
+
+import (
+	"context"
+
+	"kexuedns/log"
+)
+
+type noEDNSResolver struct {
+	Resolver
+	name string
+}
+
+func newNoEDNSResolver(r Resolver, name string) *noEDNSResolver {
+	log.Infof("[%s] sending queries without EDNS", name)
+	return &noEDNSResolver{Resolver: r, name: name}
+}
+
+func (r *noEDNSResolver) Export() *ResolverExport {
+	re := r.Resolver.Export()
+	re.DisableEDNS = true
+	return re
+}
+
+func (r *noEDNSResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	resp, _, err := r.QueryWithMeta(ctx, msg, isUDP)
+	return resp, err
+}
+
+func (r *noEDNSResolver) QueryWithMeta(ctx context.Context, msg []byte,
+	isUDP bool) ([]byte, QueryMeta, error) {
+	plain, err := removeEDNS(msg)
+	if err != nil {
+		log.Debugf("[%s] %s: failed to remove EDNS: %v", r.name, requestIDFrom(ctx), err)
+		return nil, QueryMeta{}, err
+	}
+	return queryWithMeta(ctx, r.Resolver, plain, isUDP)
+}
@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Resolver without EDNS - tests
+//
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/util/dnsmsg"
+)
+
+// Check that the message (msg) has the question of the name (name) but no
+// OPT record.
+func checkNoEDNS(t *testing.T, msg []byte, name string) {
+	t.Helper()
+	query, err := dnsmsg.NewQueryMsg(msg)
+	if err != nil {
+		t.Fatalf(`NewQueryMsg() = %v; want nil`, err)
+	}
+	if query.OPT.Header != nil || query.QName() != name || !query.Header.RecursionDesired {
+		t.Errorf(`query = %+v; want %s without EDNS`, query, name)
+	}
+}
+
+func TestNoEDNSResolver(t *testing.T) {
+	response := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	rr := &recordingResolver{staticResolver: staticResolver{response: response}}
+	r := newNoEDNSResolver(rr, "legacy")
+
+	ecs := dnsmessage.Option{Code: 8, Data: []byte{0, 1, 24, 0, 192, 0, 2}} // 192.0.2.0/24
+	for _, query := range [][]byte{
+		newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA, ecs),
+		newTestQuery(t, "www.example.com.", dnsmessage.TypeA),
+	} {
+		resp, err := r.Query(context.Background(), query, true)
+		if err != nil || !bytes.Equal(resp, response) {
+			t.Errorf(`Query() = (%x, %v); want the response as is`, resp, err)
+		}
+		checkNoEDNS(t, rr.msg, "www.example.com.")
+	}
+
+	if _, err := r.Query(context.Background(), []byte{0x12, 0x34}, true); err == nil {
+		t.Errorf(`Query(invalid) = nil; want error`)
+	}
+	if re := r.Export(); !re.DisableEDNS {
+		t.Errorf(`Export() = %+v; want DisableEDNS`, re)
+	}
+}
+
+func TestResolverDisableEDNS(t *testing.T) {
+	upstream := newTestUpstream(t, [4]byte{192, 0, 2, 53})
+	r, err := NewResolverFromExport(&ResolverExport{
+		Name:        "legacy",
+		Protocol:    ResolverProtocolUDP,
+		Address:     upstream.address.String(),
+		DisableEDNS: true,
+	})
+	if err != nil {
+		t.Fatalf(`NewResolverFromExport() = %v; want nil`, err)
+	}
+	defer r.Close()
+
+	query := newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA)
+	resp, err := r.Query(context.Background(), query, true)
+	if err != nil {
+		t.Fatalf(`Query() = %v; want nil`, err)
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil || dmsg.ID != 0x1234 || len(dmsg.Answers) != 1 {
+		t.Errorf(`response = %+v (%v); want the answer`, dmsg, err)
+	}
+	sent, _ := upstream.query("www.example.com.")
+	checkNoEDNS(t, sent, "www.example.com.")
+}
@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Sharing the resolvers of identical configs among the routes.
+//
+
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+
+	"kexuedns/log"
+)
+
+// Pool of the resolvers keyed by their canonical configs, so that the routes
+// pointing at the same upstream share one resolver (and connection pool).
+// The zero value is ready to use.
+type resolverPool struct {
+	lock      sync.Mutex
+	resolvers map[string]*sharedResolver
+}
+
+type sharedResolver struct {
+	resolver Resolver
+	key      string
+	refs     int // protected by the pool lock
+	// The references plus the pinned (in-flight) queries; the resolver is
+	// closed when it drops to zero.
+	users atomic.Int32
+}
+
+// Reference to a shared resolver, which is released by Close().
+type resolverRef struct {
+	*sharedResolver
+	pool   *resolverPool
+	closed atomic.Bool
+}
+
+// Get the resolver of the configs (re), creating it if not exists yet.
+// The returned resolver must be closed after use, which closes the shared
+// one upon the last reference.
+func (p *resolverPool) get(re *ResolverExport) (Resolver, error) {
+	if err := re.Validate(); err != nil {
+		return nil, err
+	}
+	key := resolverKey(re)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	sr, ok := p.resolvers[key]
+	if ok {
+		log.Debugf("[%s] shared resolver (refs=%d)", re.Name, sr.refs+1)
+	} else {
+		res, err := NewResolverFromExport(re)
+		if err != nil {
+			return nil, err
+		}
+		sr = &sharedResolver{resolver: res, key: key}
+		if p.resolvers == nil {
+			p.resolvers = make(map[string]*sharedResolver)
+		}
+		p.resolvers[key] = sr
+	}
+	sr.refs++
+	sr.users.Add(1)
+	return &resolverRef{sharedResolver: sr, pool: p}, nil
+}
+
+func (p *resolverPool) release(sr *sharedResolver) {
+	p.lock.Lock()
+	sr.refs--
+	last := sr.refs == 0
+	if last {
+		delete(p.resolvers, sr.key)
+	}
+	p.lock.Unlock()
+
+	if last {
+		sr.unpin()
+	}
+}
+
+func (sr *sharedResolver) unpin() {
+	if sr.users.Add(-1) == 0 {
+		sr.resolver.Close()
+	}
+}
+
+// Get the number of the distinct resolvers in the pool.
+func (p *resolverPool) size() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.resolvers)
+}
+
+// Make the key of the validated configs, which ignores the name because
+// it's only for logging.
+func resolverKey(re *ResolverExport) string {
+	c := *re
+	c.Name = ""
+	data, _ := json.Marshal(&c)
+	return string(data)
+}
+
+func (r *resolverRef) Export() *ResolverExport {
+	return r.resolver.Export()
+}
+
+func (r *resolverRef) Stats() *ResolverStats {
+	return r.resolver.Stats()
+}
+
+// NOTE: It drains the connections shared with the other references.
+func (r *resolverRef) Drain() int {
+	return r.resolver.Drain()
+}
+
+func (r *resolverRef) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	return r.resolver.Query(ctx, msg, isUDP)
+}
+
+func (r *resolverRef) QueryWithMeta(ctx context.Context, msg []byte,
+	isUDP bool) ([]byte, QueryMeta, error) {
+	return queryWithMeta(ctx, r.resolver, msg, isUDP)
+}
+
+// Pin the shared resolver for a query, so that it's closed only after the
+// returned function is called, even if the reference is released (e.g., by
+// a reload) meanwhile.
+// NOTE: It must be called while the reference is held, e.g., within the
+// router lock.
+func (r *resolverRef) pin() func() {
+	r.users.Add(1)
+	return r.sharedResolver.unpin
+}
+
+// Release the reference; only the first call takes effect.
+func (r *resolverRef) Close() {
+	if r.closed.CompareAndSwap(false, true) {
+		r.pool.release(r.sharedResolver)
+	}
+}
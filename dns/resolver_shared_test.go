@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Sharing the resolvers - tests
+//
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRouterSharedResolvers(t *testing.T) {
+	re := &RouterExport{
+		Resolver: &ResolverExport{
+			Name:     "default",
+			Protocol: ResolverProtocolUDP,
+			Address:  "127.0.0.1:53",
+		},
+		Routes: []*RouteExport{
+			{
+				Name: "a",
+				Resolver: &ResolverExport{
+					Name:     "a",
+					Protocol: ResolverProtocolUDP,
+					Address:  "127.0.0.1:53",
+				},
+				Zones: []string{"a.example"},
+			},
+			{
+				Name: "b",
+				Resolver: &ResolverExport{
+					Protocol: ResolverProtocolUDP,
+					Address:  "127.0.0.2:53",
+				},
+				Zones: []string{"b.example"},
+			},
+		},
+	}
+	r, err := NewRouterFromExport(re)
+	if err != nil {
+		t.Fatalf(`NewRouterFromExport() = %v; want nil`, err)
+	}
+	if n := r.pool.size(); n != 2 {
+		t.Errorf(`pool.size() = %d; want 2`, n)
+	}
+	ra := r.routes[0].resolver.(*resolverRef)
+	rd := r.resolver.(*resolverRef)
+	if ra.sharedResolver != rd.sharedResolver || ra.refs != 2 {
+		t.Errorf(`route [a] resolver not shared with the default`)
+	}
+
+	// Replacing the default with the same config keeps the shared one.
+	shared := rd.resolver
+	if err := r.SetResolver(&ResolverExport{
+		Protocol: ResolverProtocolUDP,
+		Address:  "127.0.0.1:53",
+	}); err != nil {
+		t.Fatalf(`SetResolver() = %v; want nil`, err)
+	}
+	if rd = r.resolver.(*resolverRef); rd.resolver != shared || rd.refs != 2 {
+		t.Errorf(`SetResolver() recreated the shared resolver`)
+	}
+
+	// Double close releases only once.
+	ra.Close()
+	ra.Close()
+	if rd.refs != 1 || r.pool.size() != 2 {
+		t.Errorf(`refs = %d, pool.size() = %d; want 1, 2`, rd.refs, r.pool.size())
+	}
+
+	r.Close()
+	if n := r.pool.size(); n != 0 {
+		t.Errorf(`pool.size() = %d; want 0 after Close()`, n)
+	}
+}
+
+func TestRouterPinResolver(t *testing.T) {
+	servers := []string{
+		newEchoUDPServer(t, 2).LocalAddr().String(),
+		newEchoUDPServer(t, 2).LocalAddr().String(),
+	}
+	r := &Router{}
+	if err := r.SetResolver(&ResolverExport{
+		Protocol: ResolverProtocolUDP,
+		Address:  servers[0],
+	}); err != nil {
+		t.Fatalf(`SetResolver() = %v; want nil`, err)
+	}
+
+	// A pinned resolver outlives its released reference.
+	res, _, release := r.PinResolver("www.example.", "")
+	sr := res.(*resolverRef).sharedResolver
+	if err := r.SetResolver(&ResolverExport{
+		Protocol: ResolverProtocolUDP,
+		Address:  servers[1],
+	}); err != nil {
+		t.Fatalf(`SetResolver() = %v; want nil`, err)
+	}
+	if n := sr.users.Load(); n != 1 {
+		t.Errorf(`users = %d; want 1 (pinned)`, n)
+	}
+	release()
+	if n := sr.users.Load(); n != 0 {
+		t.Errorf(`users = %d; want 0 after release`, n)
+	}
+
+	// Reload the resolver repeatedly while hammering the queries, which
+	// must all succeed instead of hitting a closed resolver.
+	query := newTestQuery(t, "www.example.", dnsmessage.TypeA)
+	var (
+		wg       sync.WaitGroup
+		stop     atomic.Bool
+		queries  atomic.Int64
+		failures atomic.Int64
+	)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				res, _, release := r.PinResolver("www.example.", "")
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				_, err := res.Query(ctx, bytes.Clone(query), true)
+				cancel()
+				release()
+				queries.Add(1)
+				if err != nil {
+					failures.Add(1)
+				}
+			}
+		}()
+	}
+	for i := range 50 {
+		if err := r.SetResolver(&ResolverExport{
+			Protocol: ResolverProtocolUDP,
+			Address:  servers[i%2],
+		}); err != nil {
+			t.Errorf(`SetResolver() = %v; want nil`, err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	if n := failures.Load(); n > 0 {
+		t.Errorf(`%d of %d queries failed during reloads`, n, queries.Load())
+	}
+	r.Close()
+	if n := r.pool.size(); n != 0 {
+		t.Errorf(`pool.size() = %d; want 0 after Close()`, n)
+	}
+}
@@ -0,0 +1,292 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Resolver adapting the system resolver (i.e., net.Resolver with the
+// nameservers in /etc/resolv.conf), as the last resort when no configured
+// upstream works.
+//
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/log"
+	"kexuedns/util/dnsmsg"
+)
+
+// TTL (seconds) of the answers from the system resolver, which doesn't
+// tell the original TTLs; short to pick up the configured upstreams soon.
+const systemTTL = 30
+
+// A resolver looking up the queries by the system resolver, which only
+// supports the common types (A, AAAA, CNAME, MX, NS, TXT, SRV and PTR) and
+// answers NOTIMP to the others.
+// NOTE: The system resolver doesn't tell NXDOMAIN from NODATA, so both are
+// answered as NODATA, which is less harmful to be cached by the clients.
+type ResolverSystem struct {
+	name     string
+	resolver *net.Resolver
+}
+
+// Validate the system resolver, which has no address.
+func (re *ResolverExport) validateSystem() error {
+	re.Address = ""
+	re.Addresses = nil
+	if re.Name == "" {
+		re.Name = ResolverProtocolSystem
+	}
+	return nil
+}
+
+func NewResolverSystem(re *ResolverExport) (*ResolverSystem, error) {
+	if err := re.Validate(); err != nil {
+		return nil, err
+	}
+	log.Warnf("[%s] using the system resolver (/etc/resolv.conf)", re.Name)
+	return &ResolverSystem{
+		name:     re.Name,
+		resolver: &net.Resolver{},
+	}, nil
+}
+
+func (r *ResolverSystem) Export() *ResolverExport {
+	return &ResolverExport{
+		Name:     r.name,
+		Protocol: ResolverProtocolSystem,
+	}
+}
+
+func (r *ResolverSystem) Stats() *ResolverStats {
+	return &ResolverStats{Name: r.name}
+}
+
+func (r *ResolverSystem) Drain() int { return 0 }
+
+func (r *ResolverSystem) Close() {
+	log.Infof("[%s] closed", r.name)
+}
+
+func (r *ResolverSystem) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	resp, _, err := r.QueryWithMeta(ctx, msg, isUDP)
+	return resp, err
+}
+
+func (r *ResolverSystem) QueryWithMeta(ctx context.Context, msg []byte,
+	_ bool) ([]byte, QueryMeta, error) {
+	start := time.Now()
+	resp, err := r.query(ctx, msg)
+	meta := QueryMeta{
+		Resolver:  r.name,
+		Transport: ResolverProtocolSystem,
+		Latency:   time.Since(start),
+	}
+	return resp, meta, err
+}
+
+func (r *ResolverSystem) query(ctx context.Context, msg []byte) ([]byte, error) {
+	query, err := dnsmsg.NewQueryMsg(msg)
+	if err != nil {
+		return nil, err
+	}
+	if query.Question.Class != dnsmessage.ClassINET {
+		return buildResponse(query, dnsmessage.RCodeNotImplemented, false, nil, nil, nil)
+	}
+
+	answers, err := r.lookup(ctx, query.Question)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return buildResponse(query, dnsmessage.RCodeNotImplemented, false, nil, nil, nil)
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		answers, err = nil, nil // NODATA
+	}
+	if err != nil {
+		log.Debugf("[%s] %s: lookup failed: %v", r.name, requestIDFrom(ctx), err)
+		return nil, err
+	}
+	return buildResponse(query, dnsmessage.RCodeSuccess, false, answers, nil, nil)
+}
+
+// Look up the question by the system resolver, and return the answers.
+func (r *ResolverSystem) lookup(ctx context.Context,
+	q dnsmessage.Question) ([]dnsmessage.Resource, error) {
+	name := q.Name.String()
+	host := strings.TrimSuffix(name, ".")
+	header := dnsmessage.ResourceHeader{
+		Name:  q.Name,
+		Type:  q.Type,
+		Class: dnsmessage.ClassINET,
+		TTL:   systemTTL,
+	}
+	var answers []dnsmessage.Resource
+	add := func(body dnsmessage.ResourceBody) {
+		answers = append(answers, dnsmessage.Resource{Header: header, Body: body})
+	}
+
+	switch q.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		network := "ip4"
+		if q.Type == dnsmessage.TypeAAAA {
+			network = "ip6"
+		}
+		addrs, err := r.resolver.LookupNetIP(ctx, network, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			addr = addr.Unmap()
+			if addr.Is4() {
+				add(&dnsmessage.AResource{A: addr.As4()})
+			} else {
+				add(&dnsmessage.AAAAResource{AAAA: addr.As16()})
+			}
+		}
+
+	case dnsmessage.TypeCNAME:
+		cname, err := r.resolver.LookupCNAME(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(cname, name) {
+			target, err := dnsmessage.NewName(cname)
+			if err != nil {
+				return nil, err
+			}
+			add(&dnsmessage.CNAMEResource{CNAME: target})
+		}
+
+	case dnsmessage.TypeMX:
+		mxs, err := r.resolver.LookupMX(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			target, err := dnsmessage.NewName(mx.Host)
+			if err != nil {
+				return nil, err
+			}
+			add(&dnsmessage.MXResource{Pref: mx.Pref, MX: target})
+		}
+
+	case dnsmessage.TypeNS:
+		nss, err := r.resolver.LookupNS(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ns := range nss {
+			target, err := dnsmessage.NewName(ns.Host)
+			if err != nil {
+				return nil, err
+			}
+			add(&dnsmessage.NSResource{NS: target})
+		}
+
+	case dnsmessage.TypeTXT:
+		txts, err := r.resolver.LookupTXT(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, txt := range txts {
+			add(&dnsmessage.TXTResource{TXT: splitTXT(txt)})
+		}
+
+	case dnsmessage.TypeSRV:
+		_, srvs, err := r.resolver.LookupSRV(ctx, "", "", host)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			target, err := dnsmessage.NewName(srv.Target)
+			if err != nil {
+				return nil, err
+			}
+			add(&dnsmessage.SRVResource{
+				Priority: srv.Priority,
+				Weight:   srv.Weight,
+				Port:     srv.Port,
+				Target:   target,
+			})
+		}
+
+	case dnsmessage.TypePTR:
+		addr, ok := parseReverseName(name)
+		if !ok {
+			return nil, errors.ErrUnsupported
+		}
+		ptrs, err := r.resolver.LookupAddr(ctx, addr.String())
+		if err != nil {
+			return nil, err
+		}
+		for _, ptr := range ptrs {
+			target, err := dnsmessage.NewName(ptr)
+			if err != nil {
+				return nil, err
+			}
+			add(&dnsmessage.PTRResource{PTR: target})
+		}
+
+	default:
+		return nil, errors.ErrUnsupported
+	}
+
+	return answers, nil
+}
+
+// Split the TXT record, which the system resolver joins, into the
+// character strings of at most 255 bytes.
+func splitTXT(txt string) []string {
+	var s []string
+	for len(txt) > 255 {
+		s = append(s, txt[:255])
+		txt = txt[255:]
+	}
+	return append(s, txt)
+}
+
+// Parse the reverse lookup name, e.g., "4.3.2.1.in-addr.arpa." (IPv4) or
+// "b.a.9.8.[...].ip6.arpa." (IPv6), into the address.
+func parseReverseName(name string) (netip.Addr, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if s, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		labels := strings.Split(s, ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		var ip [4]byte
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 10, 8)
+			if err != nil || (len(label) > 1 && label[0] == '0') {
+				return netip.Addr{}, false
+			}
+			ip[3-i] = byte(n)
+		}
+		return netip.AddrFrom4(ip), true
+	}
+	if s, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		labels := strings.Split(s, ".")
+		if len(labels) != 32 {
+			return netip.Addr{}, false
+		}
+		var ip [16]byte
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return netip.Addr{}, false
+			}
+			j := 31 - i // nibble index
+			ip[j/2] |= byte(n) << (4 * (1 - j%2))
+		}
+		return netip.AddrFrom16(ip), true
+	}
+	return netip.Addr{}, false
+}
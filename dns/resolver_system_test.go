@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// System resolver - tests
+//
+
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResolverSystem(t *testing.T) {
+	re := &ResolverExport{Protocol: ResolverProtocolSystem}
+	r, err := NewResolverFromExport(re)
+	if err != nil {
+		t.Fatalf("NewResolverFromExport() = %v", err)
+	}
+	defer r.Close()
+	if exp := r.Export(); exp.Name != "system" || exp.Protocol != ResolverProtocolSystem {
+		t.Errorf("Export() = %+v; want system", exp)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Answered from /etc/hosts without the network.
+	query := newTestQuery(t, "localhost.", dnsmessage.TypeA)
+	resp, err := r.Query(ctx, query, true)
+	if err != nil {
+		t.Fatalf("Query(localhost A) = %v", err)
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil {
+		t.Fatalf("Unpack() = %v", err)
+	}
+	if dmsg.ID != 0x1234 || dmsg.RCode != dnsmessage.RCodeSuccess || len(dmsg.Answers) == 0 {
+		t.Fatalf("Query(localhost A) = %+v; want answers", dmsg)
+	}
+	for _, rr := range dmsg.Answers {
+		a, ok := rr.Body.(*dnsmessage.AResource)
+		if !ok || !netip.AddrFrom4(a.A).IsLoopback() || rr.Header.TTL != systemTTL {
+			t.Errorf("answer = %v; want loopback A with TTL %d", rr, systemTTL)
+		}
+	}
+
+	query = newTestQuery(t, "localhost.", dnsmessage.TypeHINFO)
+	if resp, err := r.Query(ctx, query, true); err != nil {
+		t.Errorf("Query(HINFO) = %v; want NOTIMP", err)
+	} else if err := dmsg.Unpack(resp); err != nil || dmsg.RCode != dnsmessage.RCodeNotImplemented {
+		t.Errorf("Query(HINFO) = %v (%v); want NOTIMP", dmsg.RCode, err)
+	}
+}
+
+func TestParseReverseName(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string // empty if invalid
+	}{
+		{"4.3.2.1.in-addr.arpa.", "1.2.3.4"},
+		{"1.0.0.127.IN-ADDR.ARPA", "127.0.0.1"},
+		{"3.2.1.in-addr.arpa.", ""},
+		{"256.3.2.1.in-addr.arpa.", ""},
+		{"04.3.2.1.in-addr.arpa.", ""},
+		{strings.Repeat("0.", 8) + "8.b.d.0.1.0.0.2.ip6.arpa.", ""},
+		{"1." + strings.Repeat("0.", 23) + "8.b.d.0.1.0.0.2.ip6.arpa.", "2001:db8::1"},
+		{"www.example.com.", ""},
+	}
+	for _, tc := range tests {
+		addr, ok := parseReverseName(tc.name)
+		if tc.addr == "" {
+			if ok {
+				t.Errorf("parseReverseName(%q) = %v; want invalid", tc.name, addr)
+			}
+			continue
+		}
+		if !ok || addr != netip.MustParseAddr(tc.addr) {
+			t.Errorf("parseReverseName(%q) = (%v, %t); want %s", tc.name, addr, ok, tc.addr)
+		}
+	}
+}
+
+func TestSplitTXT(t *testing.T) {
+	txt := strings.Repeat("a", 255) + strings.Repeat("b", 10)
+	s := splitTXT(txt)
+	if len(s) != 2 || len(s[0]) != 255 || s[1] != strings.Repeat("b", 10) {
+		t.Errorf("splitTXT() = %q; want 255 + 10 bytes", s)
+	}
+	if s := splitTXT(""); len(s) != 1 || s[0] != "" {
+		t.Errorf(`splitTXT("") = %q; want [""]`, s)
+	}
+}
@@ -0,0 +1,1191 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Resolvers - tests
+//
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/util/leaktest"
+)
+
+// Listen a UDP socket that never replies, acting as a black-hole upstream.
+func newSilentUDPServer(t testing.TB) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen UDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestResolverMaxInflight(t *testing.T) {
+	server := newSilentUDPServer(t)
+	r, err := NewResolverUDP(&ResolverExport{
+		Address:     server.LocalAddr().String(),
+		MaxInflight: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewResolverUDP() failed: %v", err)
+	}
+	defer r.Close()
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Query(ctx1, append([]byte{}, query...), true)
+	}()
+
+	// Wait for the first query to be in flight.
+	for i := 0; r.Stats().Inflight != 1; i++ {
+		if i >= 100 {
+			t.Fatalf("Stats().Inflight = %d; want 1", r.Stats().Inflight)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The second query must wait and then fail with its context.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel2()
+	_, err = r.Query(ctx2, append([]byte{}, query...), true)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf(`Query() = %v; want DeadlineExceeded`, err)
+	}
+	if n := r.Stats().Rejected; n != 1 {
+		t.Errorf(`Stats().Rejected = %d; want 1`, n)
+	}
+
+	cancel1()
+	<-done
+	if n := r.Stats().Inflight; n != 0 {
+		t.Errorf(`Stats().Inflight = %d; want 0`, n)
+	}
+}
+
+func TestResolverUDPUnreachable(t *testing.T) {
+	// Get a free port that nobody listens on.
+	conn := newSilentUDPServer(t)
+	address := conn.LocalAddr().String()
+	conn.Close()
+
+	r, err := NewResolverUDP(&ResolverExport{Address: address})
+	if err != nil {
+		t.Fatalf("NewResolverUDP() failed: %v", err)
+	}
+	defer r.Close()
+
+	baseline := runtime.NumGoroutine()
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if _, err := r.Query(ctx, append([]byte{}, query...), true); err == nil {
+				t.Errorf(`Query() = nil; want error`)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The failed queries must be dropped rather than requeued forever, and
+	// no goroutines should be left behind except the receiver.
+	deadline := time.Now().Add(time.Second)
+	for {
+		n, queued := runtime.NumGoroutine(), len(r.queries)
+		if n <= baseline+1 && queued == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines = %d (baseline %d), queued = %d; want bounded",
+				n, baseline, queued)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Listen a UDP socket that replies to every query with a response padded to
+// the size (size).
+func newPaddingUDPServer(t testing.TB, size int) *net.UDPConn {
+	conn := newSilentUDPServer(t)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			resp := make([]byte, size)
+			copy(resp, buf[:n])
+			resp[2] |= 0x80 // QR
+			conn.WriteToUDPAddrPort(resp, addr)
+		}
+	}()
+	return conn
+}
+
+// Listen a UDP socket that echoes every query as the response, with the
+// readers (readers) in parallel.
+func newEchoUDPServer(t testing.TB, readers int) *net.UDPConn {
+	conn := newSilentUDPServer(t)
+	for range readers {
+		go func() {
+			buf := make([]byte, 512)
+			for {
+				n, addr, err := conn.ReadFromUDPAddrPort(buf)
+				if err != nil {
+					return
+				}
+				buf[2] |= 0x80 // QR
+				conn.WriteToUDPAddrPort(buf[:n], addr)
+			}
+		}()
+	}
+	return conn
+}
+
+func TestResolverUDPSockets(t *testing.T) {
+	server := newEchoUDPServer(t, 1)
+	r, err := NewResolverUDP(&ResolverExport{
+		Address:    server.LocalAddr().String(),
+		UDPSockets: 4,
+	})
+	if err != nil {
+		t.Fatalf("NewResolverUDP() failed: %v", err)
+	}
+	defer r.Close()
+	if n := r.Export().UDPSockets; n != 4 {
+		t.Errorf(`Export().UDPSockets = %d; want 4`, n)
+	}
+
+	// Every response is matched to its query, whichever socket it's sent
+	// and received on.
+	var wg sync.WaitGroup
+	for i := range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("www%d.example.com.", i)
+			query := newTestQuery(t, name, dnsmessage.TypeA)
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			resp, err := r.Query(ctx, append([]byte{}, query...), true)
+			if err != nil {
+				t.Errorf(`[%s] Query() = %v; want nil`, name, err)
+				return
+			}
+			if !bytes.Equal(resp[3:], query[3:]) || !bytes.Equal(resp[:2], query[:2]) {
+				t.Errorf(`[%s] Query() = %x; want the echoed %x`, name, resp, query)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, n := range []int{-1, maxUDPSockets + 1} {
+		re := &ResolverExport{Address: server.LocalAddr().String(), UDPSockets: n}
+		if err := re.Validate(); err == nil {
+			t.Errorf(`Validate() with %d UDP sockets = nil; want error`, n)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		s      string
+		lo, hi uint16
+		ok     bool
+	}{
+		{"20000-20999", 20000, 20999, true},
+		{"5353", 5353, 5353, true},
+		{" 1 - 65535 ", 1, 65535, true},
+		{"", 0, 0, false},
+		{"0-100", 0, 0, false},
+		{"100-99", 0, 0, false},
+		{"1-65536", 0, 0, false},
+		{"a-b", 0, 0, false},
+	}
+	for _, tc := range tests {
+		lo, hi, err := parsePortRange(tc.s)
+		if (err == nil) != tc.ok || lo != tc.lo || hi != tc.hi {
+			t.Errorf(`parsePortRange(%q) = %d, %d, %v; want %d, %d, ok=%t`,
+				tc.s, lo, hi, err, tc.lo, tc.hi, tc.ok)
+		}
+	}
+}
+
+func TestResolverUDPSourcePorts(t *testing.T) {
+	// Find a free port.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("failed to listen UDP: %v", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	// Receive the query and return its source port.
+	sourcePort := func(ports string) int {
+		t.Helper()
+		server := newSilentUDPServer(t)
+		r, err := NewResolverUDP(&ResolverExport{
+			Address:        server.LocalAddr().String(),
+			UDPSourcePorts: ports,
+		})
+		if err != nil {
+			t.Fatalf("NewResolverUDP() failed: %v", err)
+		}
+		defer r.Close()
+
+		query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		go r.Query(ctx, append([]byte{}, query...), true)
+
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 512)
+		_, addr, err := server.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			t.Fatalf("failed to receive query: %v", err)
+		}
+		return int(addr.Port())
+	}
+
+	ports := strconv.Itoa(port)
+	if got := sourcePort(ports); got != port {
+		t.Errorf(`source port = %d; want %d`, got, port)
+	}
+
+	// Fall back to an ephemeral port if the range is exhausted.
+	busy, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		t.Skipf("failed to listen UDP on port %d: %v", port, err)
+	}
+	defer busy.Close()
+	if got := sourcePort(ports); got == port || got == 0 {
+		t.Errorf(`source port = %d; want an ephemeral one`, got)
+	}
+
+	re := &ResolverExport{Address: "127.0.0.1:53", UDPSourcePorts: "2000-1000"}
+	if err := re.Validate(); err == nil {
+		t.Errorf(`Validate() with invalid source ports = nil; want error`)
+	}
+}
+
+func BenchmarkResolverUDP(b *testing.B) {
+	server := newEchoUDPServer(b, 8)
+	query := newTestQuery(b, "www.example.com.", dnsmessage.TypeA)
+	for _, sockets := range []int{1, 4} {
+		b.Run(fmt.Sprintf("sockets=%d", sockets), func(b *testing.B) {
+			r, err := NewResolverUDP(&ResolverExport{
+				Address:    server.LocalAddr().String(),
+				UDPSockets: sockets,
+			})
+			if err != nil {
+				b.Fatalf("NewResolverUDP() failed: %v", err)
+			}
+			defer r.Close()
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := r.Query(context.Background(),
+						append([]byte{}, query...), true); err != nil {
+						b.Errorf(`Query() = %v; want nil`, err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestResolverUDPBufferSize(t *testing.T) {
+	tests := []struct {
+		bufSize  int
+		respSize int
+		ok       bool
+	}{
+		{0, 4000, true},
+		{0, 4096, true},
+		{0, 6000, false},
+		{8192, 6000, true},
+		{maxMessageSize, 65000, true},
+	}
+	for i, tc := range tests {
+		server := newPaddingUDPServer(t, tc.respSize)
+		r, err := NewResolverUDP(&ResolverExport{
+			Address:       server.LocalAddr().String(),
+			UDPBufferSize: tc.bufSize,
+		})
+		if err != nil {
+			t.Fatalf("[%d] NewResolverUDP() failed: %v", i, err)
+		}
+
+		query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		resp, err := r.Query(ctx, append([]byte{}, query...), true)
+		cancel()
+		r.Close()
+		if tc.ok {
+			if err != nil || len(resp) != tc.respSize {
+				t.Errorf("[%d] Query() = (len=%d, %v); want (len=%d, nil)",
+					i, len(resp), err, tc.respSize)
+			} else if resp[0] != query[0] || resp[1] != query[1] {
+				t.Errorf("[%d] response ID not restored", i)
+			}
+		} else if err == nil {
+			t.Errorf("[%d] Query() = nil; want error for oversized response", i)
+		}
+	}
+
+	for _, size := range []int{-1, 511, maxMessageSize + 1} {
+		re := &ResolverExport{Address: "127.0.0.1:53", UDPBufferSize: size}
+		if err := re.Validate(); err == nil {
+			t.Errorf("Validate() with UDP buffer size %d = nil; want error", size)
+		}
+	}
+}
+
+func TestResolverSlowQuery(t *testing.T) {
+	for _, proto := range []string{ResolverProtocolDefault, ResolverProtocolUDP,
+		ResolverProtocolTCP} {
+		r, err := NewResolverFromExport(&ResolverExport{
+			Protocol:  proto,
+			Address:   "127.0.0.1:53",
+			SlowQuery: 500,
+		})
+		if err != nil {
+			t.Fatalf("[%s] NewResolverFromExport() failed: %v", proto, err)
+		}
+		if n := r.Export().SlowQuery; n != 500 {
+			t.Errorf("[%s] Export().SlowQuery = %d; want 500", proto, n)
+		}
+		r.Close()
+	}
+
+	re := &ResolverExport{Address: "127.0.0.1:53", SlowQuery: -1}
+	if err := re.Validate(); err == nil {
+		t.Errorf("Validate() with slow query -1 = nil; want error")
+	}
+}
+
+func TestResolverQueryWithMeta(t *testing.T) {
+	udpServer := newPaddingUDPServer(t, 64)
+	tcpServer := newEchoTCPServer(t)
+	newResolver := func(proto, address string) Resolver {
+		r, err := NewResolverFromExport(&ResolverExport{
+			Name:     proto + "-upstream",
+			Protocol: proto,
+			Address:  address,
+		})
+		if err != nil {
+			t.Fatalf("[%s] NewResolverFromExport() failed: %v", proto, err)
+		}
+		t.Cleanup(r.Close)
+		return r
+	}
+
+	tests := []struct {
+		resolver  Resolver
+		isUDP     bool
+		name      string
+		transport string
+	}{
+		{newResolver(ResolverProtocolUDP, udpServer.LocalAddr().String()),
+			true, "udp-upstream", ResolverProtocolUDP},
+		{newResolver(ResolverProtocolTCP, tcpServer.Addr().String()),
+			true, "tcp-upstream", ResolverProtocolTCP},
+		// Default (UDP+TCP): over TCP if the query is not from UDP.
+		{newResolver(ResolverProtocolDefault, udpServer.LocalAddr().String()),
+			true, "default-upstream", ResolverProtocolUDP},
+		{newResolver(ResolverProtocolDefault, tcpServer.Addr().String()),
+			false, "default-upstream", ResolverProtocolTCP},
+		// Not reporting the metadata: only timed.
+		{&staticResolver{response: []byte{0}}, true, "", ""},
+	}
+	for i, tc := range tests {
+		query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, meta, err := queryWithMeta(ctx, tc.resolver, query, tc.isUDP)
+		cancel()
+		if err != nil {
+			t.Fatalf("[%d] queryWithMeta() = %v; want nil", i, err)
+		}
+		if meta.Resolver != tc.name || meta.Transport != tc.transport ||
+			meta.Latency <= 0 || meta.Retried {
+			t.Errorf("[%d] meta = %+v; want resolver=%q transport=%q", i, meta,
+				tc.name, tc.transport)
+		}
+	}
+}
+
+func TestResolverSessionCacheSize(t *testing.T) {
+	tests := []struct {
+		size     int
+		expected int
+	}{
+		{0, defaultSessionCacheSize},
+		{16, 16},
+		{-5, -1},
+	}
+	for _, tc := range tests {
+		re := &ResolverExport{Address: "127.0.0.1:853", SessionCacheSize: tc.size}
+		if err := re.Validate(); err != nil {
+			t.Fatalf("Validate() = %v; want nil", err)
+		}
+		if re.SessionCacheSize != tc.expected {
+			t.Errorf("SessionCacheSize(%d) = %d; want %d",
+				tc.size, re.SessionCacheSize, tc.expected)
+		}
+	}
+}
+
+func TestResolverHealth(t *testing.T) {
+	server := newPaddingUDPServer(t, 64)
+	r, err := NewResolverUDP(&ResolverExport{Address: server.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("NewResolverUDP() failed: %v", err)
+	}
+	defer r.Close()
+
+	if rs := r.Stats(); rs.LastSuccess != nil || rs.LastErrorTime != nil {
+		t.Errorf("Stats() = %+v; want no health yet", rs)
+	}
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	start := time.Now()
+	if _, err := r.Query(context.Background(), append([]byte{}, query...), true); err != nil {
+		t.Fatalf("Query() = %v; want nil", err)
+	}
+	rs := r.Stats()
+	if rs.LastSuccess == nil || rs.LastSuccess.Before(start) {
+		t.Errorf("Stats().LastSuccess = %v; want after %v", rs.LastSuccess, start)
+	}
+
+	// Canceled by the client: not recorded.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r.Query(ctx, append([]byte{}, query...), true)
+	if rs := r.Stats(); rs.LastErrorTime != nil {
+		t.Errorf("Stats().LastError = %q; want none", rs.LastError)
+	}
+
+	r.health.record(context.DeadlineExceeded)
+	rs = r.Stats()
+	if rs.LastErrorTime == nil || rs.LastError != context.DeadlineExceeded.Error() {
+		t.Errorf("Stats() = (%v, %q); want the last error", rs.LastErrorTime, rs.LastError)
+	}
+	if rs.LastSuccess == nil {
+		t.Errorf("Stats().LastSuccess = nil; want kept")
+	}
+}
+
+// Listen a TCP socket that replies the queries as they are, with the QR bit
+// set.
+func newEchoTCPServer(t testing.TB) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen TCP: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					lbuf := make([]byte, 2)
+					if _, err := io.ReadFull(conn, lbuf); err != nil {
+						return
+					}
+					msg := make([]byte, binary.BigEndian.Uint16(lbuf))
+					if _, err := io.ReadFull(conn, msg); err != nil {
+						return
+					}
+					msg[2] |= 0x80 // QR
+					conn.Write(append(lbuf, msg...))
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestResolverUDPLeak(t *testing.T) {
+	server := newSilentUDPServer(t)
+	defer leaktest.Check(t)()
+	r, err := NewResolverUDP(&ResolverExport{
+		Address:    server.LocalAddr().String(),
+		UDPSockets: 4,
+	})
+	if err != nil {
+		t.Fatalf("NewResolverUDP() failed: %v", err)
+	}
+	defer r.Close()
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.Query(ctx, query, true); err == nil {
+		t.Errorf(`Query() = nil; want error`)
+	}
+}
+
+func TestResolverTCPLeak(t *testing.T) {
+	ln := newEchoTCPServer(t)
+	defer leaktest.Check(t)()
+	r, err := NewResolverTCP(&ResolverExport{Address: ln.Addr().String()})
+	if err != nil {
+		t.Fatalf("NewResolverTCP() failed: %v", err)
+	}
+	defer r.Close()
+
+	// Pooled connections, and a drained one.
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.Query(context.Background(), bytes.Clone(query), false); err != nil {
+				t.Errorf(`Query() = %v; want nil`, err)
+			}
+		}()
+	}
+	wg.Wait()
+	r.Drain()
+	if _, err := r.Query(context.Background(), query, false); err != nil {
+		t.Errorf(`Query() = %v; want nil`, err)
+	}
+}
+
+func TestResolverTCPPoolWarmup(t *testing.T) {
+	ln := newEchoTCPServer(t)
+	r, err := NewResolverTCP(&ResolverExport{
+		Address:       ln.Addr().String(),
+		PoolIdleConns: 2,
+		PoolWarmup:    true,
+	})
+	if err != nil {
+		t.Fatalf("NewResolverTCP() failed: %v", err)
+	}
+	defer r.Close()
+	if !r.Export().PoolWarmup {
+		t.Errorf(`Export().PoolWarmup = false; want true`)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for r.Stats().Pool.Idle < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := r.Stats().Pool; s.Idle != 2 || s.Dials != 2 {
+		t.Errorf(`Stats().Pool = %+v; want 2 idle connections`, s)
+	}
+}
+
+func TestResolverForceTCP(t *testing.T) {
+	ln := newEchoTCPServer(t)
+	re := &ResolverExport{
+		Address:  ln.Addr().String(),
+		ForceTCP: true,
+	}
+	r, err := NewResolverUT(re)
+	if err != nil {
+		t.Fatalf("NewResolverUT() failed: %v", err)
+	}
+	defer r.Close()
+	if r.udp != nil {
+		t.Errorf(`udp = %v; want nil`, r.udp)
+	}
+	if !r.Export().ForceTCP {
+		t.Errorf(`Export().ForceTCP = false; want true`)
+	}
+
+	// There is no UDP server; the UDP query must go over TCP.
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := r.Query(ctx, append([]byte{}, query...), true)
+	if err != nil {
+		t.Fatalf(`Query() = %v; want nil`, err)
+	}
+	if len(resp) != len(query) || resp[2]&0x80 == 0 {
+		t.Errorf(`Query() = %x; want the echoed response`, resp)
+	}
+
+	// Proxy is allowed for the default protocol only with force TCP.
+	re = &ResolverExport{Address: ln.Addr().String(), Proxy: "socks5://127.0.0.1:1080"}
+	if err := re.Validate(); err == nil {
+		t.Errorf(`Validate() with proxy = nil; want error`)
+	}
+	re.ForceTCP = true
+	if err := re.Validate(); err != nil {
+		t.Errorf(`Validate() with proxy and force TCP = %v; want nil`, err)
+	}
+}
+
+func TestSetAllowedProtocols(t *testing.T) {
+	defer SetAllowedProtocols(nil)
+	if err := SetAllowedProtocols([]string{ResolverProtocolUDP, "bogus"}); err == nil {
+		t.Errorf(`SetAllowedProtocols() with bogus = nil; want error`)
+	}
+	err := SetAllowedProtocols([]string{ResolverProtocolDefault, ResolverProtocolTCP})
+	if err != nil {
+		t.Fatalf(`SetAllowedProtocols() = %v; want nil`, err)
+	}
+
+	tests := []struct {
+		protocol string
+		ok       bool
+	}{
+		{"", true},
+		{ResolverProtocolDefault, true},
+		{ResolverProtocolTCP, true},
+		{ResolverProtocolUDP, false},
+		{ResolverProtocolDoT, false},
+		{ResolverProtocolDoH, false},
+		{ResolverProtocolSystem, false},
+	}
+	for _, tc := range tests {
+		r, err := NewResolverFromExport(&ResolverExport{
+			Protocol:   tc.protocol,
+			Address:    "127.0.0.1:53",
+			ServerName: "dns.example",
+		})
+		if tc.ok {
+			if err != nil {
+				t.Errorf(`NewResolverFromExport(%q) = %v; want nil`, tc.protocol, err)
+			} else {
+				r.Close()
+			}
+		} else if !errors.Is(err, ErrProtocolDisabled) {
+			t.Errorf(`NewResolverFromExport(%q) = %v; want %v`,
+				tc.protocol, err, ErrProtocolDisabled)
+		}
+	}
+
+	SetAllowedProtocols(nil)
+	r, err := NewResolverFromExport(&ResolverExport{
+		Protocol: ResolverProtocolUDP,
+		Address:  "127.0.0.1:53",
+	})
+	if err != nil {
+		t.Fatalf(`NewResolverFromExport() with all allowed = %v; want nil`, err)
+	}
+	r.Close()
+}
+
+func TestResolverHedge(t *testing.T) {
+	// The UDP queries are lost, while TCP answers on the same port.
+	ln := newEchoTCPServer(t)
+	port := ln.Addr().(*net.TCPAddr).Port
+	udpServer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Skipf("failed to listen UDP on port %d: %v", port, err)
+	}
+	defer udpServer.Close()
+
+	r, err := NewResolverUT(&ResolverExport{
+		Address:    ln.Addr().String(),
+		HedgeDelay: 20,
+	})
+	if err != nil {
+		t.Fatalf("NewResolverUT() failed: %v", err)
+	}
+	defer r.Close()
+	if got := r.Export().HedgeDelay; got != 20 {
+		t.Errorf(`Export().HedgeDelay = %d; want 20`, got)
+	}
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	resp, meta, err := r.QueryWithMeta(ctx, append([]byte{}, query...), true)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf(`Query() = %v; want nil`, err)
+	}
+	if len(resp) != len(query) || resp[2]&0x80 == 0 {
+		t.Errorf(`Query() = %x; want the echoed response over TCP`, resp)
+	}
+	if id := binary.BigEndian.Uint16(resp); id != binary.BigEndian.Uint16(query) {
+		t.Errorf(`Query() response ID = %#04x; want %#04x`, id, binary.BigEndian.Uint16(query))
+	}
+	if meta.Transport != ResolverProtocolTCP || !meta.Retried || meta.Latency < 20*time.Millisecond {
+		t.Errorf(`meta = %+v; want retried over TCP after the hedge delay`, meta)
+	}
+	if elapsed > time.Second {
+		t.Errorf(`Query() took %v; want TCP to win well before the timeout`, elapsed)
+	}
+	// The UDP query is canceled.
+	for i := 0; r.Stats().Inflight != 0; i++ {
+		if i > 100 {
+			t.Fatalf(`Stats().Inflight = %d; want 0`, r.Stats().Inflight)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	re := &ResolverExport{Address: ln.Addr().String(), HedgeDelay: -1}
+	if err := re.Validate(); err == nil {
+		t.Errorf(`Validate() with negative hedge delay = nil; want error`)
+	}
+}
+
+func TestResolverServerName(t *testing.T) {
+	for _, protocol := range []string{ResolverProtocolDoT, ResolverProtocolDoH} {
+		re := &ResolverExport{Protocol: protocol, Address: "127.0.0.1:853"}
+		if err := re.Validate(); err == nil {
+			t.Errorf(`[%s] Validate() without server name = nil; want error`, protocol)
+		}
+		re.InsecureSkipVerify = true
+		if err := re.Validate(); err != nil {
+			t.Errorf(`[%s] Validate() with insecure = %v; want nil`, protocol, err)
+		}
+		re.InsecureSkipVerify = false
+		re.ServerName = "dns.example"
+		if err := re.Validate(); err != nil {
+			t.Errorf(`[%s] Validate() = %v; want nil`, protocol, err)
+		}
+	}
+
+	// Not required by the auto protocol, which then skips DoT/DoH.
+	re := &ResolverExport{Protocol: ResolverProtocolAuto, Address: "127.0.0.1:53"}
+	if err := re.Validate(); err != nil {
+		t.Errorf(`[auto] Validate() = %v; want nil`, err)
+	}
+}
+
+// Listen a TCP socket that accepts the connections but never replies.
+func newSilentTCPServer(t testing.TB) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen TCP: %v", err)
+	}
+	var conns []net.Conn
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return ln
+}
+
+func TestResolverQueryBudget(t *testing.T) {
+	saved := defaultTimeouts.Query
+	defaultTimeouts.Query = 100 * time.Millisecond
+	defer func() { defaultTimeouts.Query = saved }()
+
+	udpServer := newSilentUDPServer(t)
+	udp, err := NewResolverUDP(&ResolverExport{Address: udpServer.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("NewResolverUDP() failed: %v", err)
+	}
+	defer udp.Close()
+
+	tcpServer := newSilentTCPServer(t)
+	tcp, err := NewResolverTCP(&ResolverExport{Address: tcpServer.Addr().String()})
+	if err != nil {
+		t.Fatalf("NewResolverTCP() failed: %v", err)
+	}
+	defer tcp.Close()
+
+	ut, err := NewResolverUT(&ResolverExport{
+		Address:  tcpServer.Addr().String(),
+		ForceTCP: true,
+	})
+	if err != nil {
+		t.Fatalf("NewResolverUT() failed: %v", err)
+	}
+	defer ut.Close()
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	for _, r := range []Resolver{udp, tcp, ut} {
+		start := time.Now()
+		// No deadline in the context: bounded by the budget.
+		_, err := r.Query(context.Background(), append([]byte{}, query...), true)
+		elapsed := time.Since(start)
+		if err == nil {
+			t.Errorf(`[%T] Query() = nil; want error`, r)
+		}
+		if elapsed > 5*defaultTimeouts.Query {
+			t.Errorf(`[%T] Query() took %v; want within the budget %v`,
+				r, elapsed, defaultTimeouts.Query)
+		}
+	}
+}
+
+// Create a DoH resolver of the test server (server), bypassing the configs
+// (e.g., the CA pool) needed by NewResolverDoH().
+func newTestResolverDoH(t *testing.T, server *httptest.Server, maxRetries int) *ResolverDoH {
+	t.Helper()
+	u, err := url.Parse(server.URL + dohPath)
+	if err != nil {
+		t.Fatalf("failed to parse URL: %v", err)
+	}
+	r := &ResolverDoH{
+		name:       "doh",
+		url:        u,
+		maxRetries: maxRetries,
+		certExpiry: newCertExpiry("doh", defaultCertExpiryWarn),
+		limiter:    newQueryLimiter(defaultMaxInflight),
+		health:     &resolverHealth{},
+	}
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.VerifyConnection = r.certExpiry.verifier(nil)
+	r.client = &http.Client{Transport: transport}
+	return r
+}
+
+func TestResolverDoHRetry(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+
+	var requests atomic.Int32
+	var failures []int // status codes of the failed requests in order; 0 to reset
+	var lock sync.Mutex
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1))
+		lock.Lock()
+		status := http.StatusOK
+		if n <= len(failures) {
+			status = failures[n-1]
+		}
+		lock.Unlock()
+
+		switch status {
+		case http.StatusOK:
+			w.Header().Set("Content-Type", dohContentType)
+			io.Copy(w, r.Body)
+		case 0:
+			// Reset the connection.
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		default:
+			w.WriteHeader(status)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		failures   []int
+		maxRetries int
+		ok         bool
+		requests   int
+	}{
+		{nil, 2, true, 1},
+		// Fail once then succeed.
+		{[]int{http.StatusServiceUnavailable}, 2, true, 2},
+		{[]int{0}, 2, true, 2},
+		{[]int{http.StatusBadGateway, 0}, 2, true, 3},
+		// Too many failures
+		{[]int{500, 500, 500}, 2, false, 3},
+		// Retry disabled
+		{[]int{500}, -1, false, 1},
+		// No retry on the client errors.
+		{[]int{http.StatusBadRequest}, 2, false, 1},
+		{[]int{http.StatusUnsupportedMediaType}, 2, false, 1},
+	}
+	for i, tc := range tests {
+		lock.Lock()
+		failures = tc.failures
+		lock.Unlock()
+		requests.Store(0)
+
+		r := newTestResolverDoH(t, server, tc.maxRetries)
+		resp, meta, err := r.QueryWithMeta(context.Background(), query, false)
+		if (err == nil) != tc.ok || (tc.ok && !bytes.Equal(resp, query)) {
+			t.Errorf(`[%d] Query() = (%v, %v); want ok=%v`, i, resp, err, tc.ok)
+		}
+		if meta.Transport != ResolverProtocolDoH || meta.Retried != (tc.requests > 1) {
+			t.Errorf(`[%d] meta = %+v; want retried=%v over DoH`, i, meta, tc.requests > 1)
+		}
+		if n := int(requests.Load()); n != tc.requests {
+			t.Errorf(`[%d] requests = %d; want %d`, i, n, tc.requests)
+		}
+	}
+}
+
+func TestClassifyQueryError(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no route to host")}
+	readErr := &net.OpError{Op: "read", Net: "udp", Err: syscall.ECONNREFUSED}
+	timeoutErr := &net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded}
+	tests := []struct {
+		err  error
+		want error // nil if unclassified
+	}{
+		{context.DeadlineExceeded, ErrUpstreamTimeout},
+		{fmt.Errorf("query: %w", timeoutErr), ErrUpstreamTimeout},
+		{dialErr, ErrResolverNotReady},
+		{readErr, ErrResolverNotReady},
+		{ErrPoolClosed, ErrResolverNotReady},
+		{ErrUpstreamRefused, ErrUpstreamRefused},
+		{context.Canceled, nil},
+		{errors.New("DoH server returned 500"), nil},
+	}
+	for i, tc := range tests {
+		err := classifyQueryError(tc.err)
+		if !errors.Is(err, tc.err) {
+			t.Errorf(`[%d] classifyQueryError(%v) = %v; want it wrapped`, i, tc.err, err)
+		}
+		for _, class := range []error{ErrUpstreamTimeout, ErrUpstreamRefused, ErrResolverNotReady} {
+			if errors.Is(err, class) != (class == tc.want) {
+				t.Errorf(`[%d] classifyQueryError(%v) = %v; want class %v`, i, tc.err, err, tc.want)
+			}
+		}
+		if again := classifyQueryError(err); again != err {
+			t.Errorf(`[%d] classifyQueryError() = %v; want not wrapped again`, i, again)
+		}
+	}
+	if err := classifyQueryError(nil); err != nil {
+		t.Errorf(`classifyQueryError(nil) = %v; want nil`, err)
+	}
+
+	// DoH 403: refused without retry.
+	var requests atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+	r := newTestResolverDoH(t, server, 2)
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	if _, _, err := queryWithMeta(context.Background(), r, query, false); !errors.Is(err, ErrUpstreamRefused) {
+		t.Errorf(`Query() = %v; want %v`, err, ErrUpstreamRefused)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf(`requests = %d; want 1`, n)
+	}
+}
+
+func TestResolverDoHMethod(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+
+	var lock sync.Mutex
+	var method string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		method = r.Method
+		lock.Unlock()
+
+		var msg []byte
+		switch r.Method {
+		case http.MethodGet:
+			var err error
+			msg, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+			if err != nil || r.ContentLength > 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohContentType {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			msg, _ = io.ReadAll(r.Body)
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(msg)
+	}))
+	defer server.Close()
+
+	for _, m := range []string{"", "get", "POST"} {
+		re := &ResolverExport{
+			Protocol:           ResolverProtocolDoH,
+			Address:            "127.0.0.1:443",
+			InsecureSkipVerify: true,
+			DoHMethod:          m,
+		}
+		if err := re.Validate(); err != nil {
+			t.Fatalf(`[%q] Validate() = %v; want nil`, m, err)
+		}
+		want := strings.ToUpper(m)
+		if want == "" {
+			want = http.MethodPost
+		}
+		if re.DoHMethod != want {
+			t.Errorf(`[%q] DoHMethod = %q; want %q`, m, re.DoHMethod, want)
+		}
+
+		r := newTestResolverDoH(t, server, 0)
+		r.method = re.DoHMethod
+		resp, err := r.Query(context.Background(), query, false)
+		if err != nil || !bytes.Equal(resp, query) {
+			t.Errorf(`[%q] Query() = (%v, %v); want the echoed query`, m, resp, err)
+		}
+		lock.Lock()
+		if method != want {
+			t.Errorf(`[%q] request method = %s; want %s`, m, method, want)
+		}
+		lock.Unlock()
+	}
+
+	re := &ResolverExport{Protocol: ResolverProtocolDoH, Address: "127.0.0.1:443",
+		ServerName: "dns.example", DoHMethod: "PUT"}
+	if err := re.Validate(); err == nil {
+		t.Errorf(`Validate(PUT) = nil; want error`)
+	}
+}
+
+func TestResolverDoHRetryDeadline(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	// The backoff grows to retryBackoffMax, so only the first few retries
+	// fit in the deadline.
+	r := newTestResolverDoH(t, server, 100)
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := r.Query(ctx, query, false); err == nil {
+		t.Errorf(`Query() = nil; want error`)
+	}
+	// Some slack for the return after the deadline.
+	if d := time.Since(start); d > 400*time.Millisecond {
+		t.Errorf(`Query() took %v; want within the deadline`, d)
+	}
+	if n := requests.Load(); n < 2 || n > 6 {
+		t.Errorf(`requests = %d; want a few retries`, n)
+	}
+}
+
+func TestSleepBackoff(t *testing.T) {
+	for attempt, want := range []time.Duration{50, 100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		ctx, cancel := context.WithTimeout(context.Background(), want/2-time.Millisecond)
+		if sleepBackoff(ctx, attempt) {
+			t.Errorf(`sleepBackoff(%d) = true; want false with short deadline`, attempt)
+		}
+		cancel()
+	}
+
+	start := time.Now()
+	if !sleepBackoff(context.Background(), 0) {
+		t.Errorf(`sleepBackoff(0) = false; want true`)
+	}
+	if d := time.Since(start); d < retryBackoffBase/2 {
+		t.Errorf(`sleepBackoff(0) slept %v; want >= %v`, d, retryBackoffBase/2)
+	}
+	// Huge attempts must not overflow.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if sleepBackoff(ctx, 100) {
+		t.Errorf(`sleepBackoff(100) = true; want false`)
+	}
+}
+
+func TestCertExpiry(t *testing.T) {
+	now := time.Now()
+	cert := func(d time.Duration) []*x509.Certificate {
+		return []*x509.Certificate{{NotAfter: now.Add(d)}}
+	}
+
+	c := newCertExpiry("test", 0)
+	if c.warnDays() != -1 {
+		t.Errorf(`warnDays() = %d; want -1`, c.warnDays())
+	}
+	if rs := c.fill(&ResolverStats{}); rs.CertNotAfter != nil {
+		t.Errorf(`CertNotAfter = %v; want nil`, rs.CertNotAfter)
+	}
+	c.observe(nil)
+	c.observe(cert(30 * 24 * time.Hour))
+	c.observe(cert(10 * 24 * time.Hour))
+	c.observe(cert(20 * 24 * time.Hour))
+	rs := c.fill(&ResolverStats{})
+	if want := now.Add(10 * 24 * time.Hour); rs.CertNotAfter == nil || !rs.CertNotAfter.Equal(want) {
+		t.Errorf(`CertNotAfter = %v; want %v`, rs.CertNotAfter, want)
+	}
+
+	c = newCertExpiry("test", 14)
+	if c.warnDays() != 14 {
+		t.Errorf(`warnDays() = %d; want 14`, c.warnDays())
+	}
+	c.observe(cert(30 * 24 * time.Hour))
+	if c.lastWarn.Load() != 0 {
+		t.Errorf(`warned about a cert expiring in 30 days`)
+	}
+	c.observe(cert(7 * 24 * time.Hour))
+	last := c.lastWarn.Load()
+	if last == 0 {
+		t.Errorf(`not warned about a cert expiring in 7 days`)
+	}
+	// Rate limited
+	c.observe(cert(time.Hour))
+	if c.lastWarn.Load() != last {
+		t.Errorf(`warned again within %v`, certExpiryWarnInterval)
+	}
+}
+
+func TestResolverDoHCertExpiry(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", dohContentType)
+		io.Copy(w, r.Body)
+	}))
+	defer server.Close()
+
+	r := newTestResolverDoH(t, server, 0)
+	if rs := r.Stats(); rs.CertNotAfter != nil {
+		t.Errorf(`CertNotAfter = %v; want nil before any handshake`, rs.CertNotAfter)
+	}
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	if _, err := r.Query(context.Background(), query, false); err != nil {
+		t.Fatalf(`Query() = %v; want nil`, err)
+	}
+	want := server.Certificate().NotAfter
+	if rs := r.Stats(); rs.CertNotAfter == nil || !rs.CertNotAfter.Equal(want) {
+		t.Errorf(`CertNotAfter = %v; want %v`, rs.CertNotAfter, want)
+	}
+}
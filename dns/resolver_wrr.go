@@ -0,0 +1,149 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Weighted round-robin resolver over multiple upstream addresses.
+//
+
+package dns
+
+import (
+	"context"
+	"sync"
+
+	"kexuedns/log"
+)
+
+type ResolverWRR struct {
+	name     string
+	protocol string
+	backends []*wrrBackend
+	lock     sync.Mutex // protect the current weights
+}
+
+type wrrBackend struct {
+	resolver Resolver
+	address  string
+	weight   int
+	current  int // current weight for the smooth WRR
+}
+
+// Create a resolver distributing the queries among the addresses
+// (re.Addresses) in weighted round-robin, with each address getting its own
+// resolver (and thus connection pool).
+func NewResolverWRR(re *ResolverExport) (*ResolverWRR, error) {
+	if err := re.Validate(); err != nil {
+		return nil, err
+	}
+
+	r := &ResolverWRR{
+		name:     re.Name,
+		protocol: re.Protocol,
+	}
+	for _, ra := range re.Addresses {
+		bre := *re
+		bre.Name = re.Name + "/" + ra.Address
+		bre.Address = ra.Address
+		bre.Addresses = nil
+		res, err := newResolver(&bre)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.backends = append(r.backends, &wrrBackend{
+			resolver: res,
+			address:  ra.Address,
+			weight:   ra.Weight,
+		})
+	}
+
+	log.Debugf("[%s] created with %d addresses", r.name, len(r.backends))
+	return r, nil
+}
+
+func (r *ResolverWRR) Export() *ResolverExport {
+	re := r.backends[0].resolver.Export()
+	re.Name = r.name
+	re.Protocol = r.protocol
+	re.Address = r.backends[0].address
+	re.Addresses = make([]*ResolverAddress, 0, len(r.backends))
+	for _, b := range r.backends {
+		re.Addresses = append(re.Addresses, &ResolverAddress{
+			Address: b.address,
+			Weight:  b.weight,
+		})
+	}
+	return re
+}
+
+func (r *ResolverWRR) Stats() *ResolverStats {
+	rs := &ResolverStats{Name: r.name}
+	for _, b := range r.backends {
+		bs := b.resolver.Stats()
+		rs.Inflight += bs.Inflight
+		rs.Rejected += bs.Rejected
+		// Report the latest of the backends.
+		if t := bs.LastSuccess; t != nil && (rs.LastSuccess == nil || t.After(*rs.LastSuccess)) {
+			rs.LastSuccess = t
+		}
+		if t := bs.LastErrorTime; t != nil && (rs.LastErrorTime == nil || t.After(*rs.LastErrorTime)) {
+			rs.LastErrorTime = t
+			rs.LastError = bs.LastError
+		}
+		// Report the earliest of the backends.
+		if t := bs.CertNotAfter; t != nil && (rs.CertNotAfter == nil || t.Before(*rs.CertNotAfter)) {
+			rs.CertNotAfter = t
+		}
+		if ps := bs.Pool; ps != nil {
+			if rs.Pool == nil {
+				rs.Pool = &ConnPoolStats{}
+			}
+			rs.Pool.add(ps)
+		}
+	}
+	return rs
+}
+
+func (r *ResolverWRR) Drain() int {
+	n := 0
+	for _, b := range r.backends {
+		n += b.resolver.Drain()
+	}
+	return n
+}
+
+func (r *ResolverWRR) Close() {
+	for _, b := range r.backends {
+		b.resolver.Close()
+	}
+	log.Infof("[%s] closed", r.name)
+}
+
+func (r *ResolverWRR) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	return r.next().Query(ctx, msg, isUDP)
+}
+
+func (r *ResolverWRR) QueryWithMeta(ctx context.Context, msg []byte,
+	isUDP bool) ([]byte, QueryMeta, error) {
+	return queryWithMeta(ctx, r.next(), msg, isUDP)
+}
+
+// Pick the next backend with the smooth weighted round-robin algorithm
+// (as used by nginx), which spreads the picks of a heavy backend evenly
+// instead of bursting them.
+func (r *ResolverWRR) next() Resolver {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var best *wrrBackend
+	total := 0
+	for _, b := range r.backends {
+		b.current += b.weight
+		total += b.weight
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	best.current -= total
+	return best.resolver
+}
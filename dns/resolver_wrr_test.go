@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Weighted round-robin resolver - tests
+//
+
+package dns
+
+import (
+	"testing"
+)
+
+func TestResolverAddressValidate(t *testing.T) {
+	re := &ResolverExport{Address: "127.0.0.1:53"}
+	if err := re.Validate(); err != nil {
+		t.Fatalf(`Validate() = %v; want nil`, err)
+	}
+	if n := len(re.Addresses); n != 1 {
+		t.Fatalf(`len(Addresses) = %d; want 1`, n)
+	}
+	if ra := re.Addresses[0]; ra.Address != re.Address || ra.Weight != 1 {
+		t.Errorf(`Addresses[0] = %+v; want {%s 1}`, ra, re.Address)
+	}
+
+	re = &ResolverExport{
+		Addresses: []*ResolverAddress{
+			{Address: "127.0.0.1:53", Weight: 3},
+			{Address: "[::1]:53"},
+		},
+	}
+	if err := re.Validate(); err != nil {
+		t.Fatalf(`Validate() = %v; want nil`, err)
+	}
+	if re.Address != "127.0.0.1:53" {
+		t.Errorf(`Address = %q; want %q`, re.Address, "127.0.0.1:53")
+	}
+	if w := re.Addresses[1].Weight; w != 1 {
+		t.Errorf(`Addresses[1].Weight = %d; want 1`, w)
+	}
+
+	invalids := []*ResolverExport{
+		{Addresses: []*ResolverAddress{{Address: "127.0.0.1"}}},
+		{Addresses: []*ResolverAddress{{Address: "127.0.0.1:53", Weight: -1}}},
+	}
+	for i, re := range invalids {
+		if err := re.Validate(); err == nil {
+			t.Errorf(`[%d] Validate() = nil; want error`, i)
+		}
+	}
+}
+
+func TestResolverWRR(t *testing.T) {
+	res1, res2, res3 := newBlockingResolver(), newBlockingResolver(), newBlockingResolver()
+	r := &ResolverWRR{
+		backends: []*wrrBackend{
+			{resolver: res1, weight: 5},
+			{resolver: res2, weight: 1},
+			{resolver: res3, weight: 1},
+		},
+	}
+
+	// Smooth WRR sequence: a a b a c a a
+	expected := []Resolver{res1, res1, res2, res1, res3, res1, res1}
+	for round := 0; round < 3; round++ {
+		for i, res := range expected {
+			if got := r.next(); got != res {
+				t.Errorf(`[%d:%d] next() = %p; want %p`, round, i, got, res)
+			}
+		}
+	}
+}
+
+func TestNewResolverWRR(t *testing.T) {
+	re := &ResolverExport{
+		Name:     "wrr",
+		Protocol: ResolverProtocolUDP,
+		Addresses: []*ResolverAddress{
+			{Address: "127.0.0.1:5301", Weight: 2},
+			{Address: "127.0.0.1:5302"},
+		},
+	}
+	res, err := NewResolverFromExport(re)
+	if err != nil {
+		t.Fatalf(`NewResolverFromExport() = %v; want nil`, err)
+	}
+	defer res.Close()
+
+	if _, ok := res.(*ResolverWRR); !ok {
+		t.Fatalf(`NewResolverFromExport() = %T; want *ResolverWRR`, res)
+	}
+	ex := res.Export()
+	if ex.Name != "wrr" || ex.Protocol != ResolverProtocolUDP || len(ex.Addresses) != 2 {
+		t.Errorf(`Export() = %+v; unexpected`, ex)
+	}
+	if ra := ex.Addresses[0]; ra.Address != "127.0.0.1:5301" || ra.Weight != 2 {
+		t.Errorf(`Export().Addresses[0] = %+v; want {127.0.0.1:5301 2}`, ra)
+	}
+}
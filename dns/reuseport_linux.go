@@ -0,0 +1,29 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// SO_REUSEPORT for the UDP listeners - Linux
+//
+
+package dns
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const reusePortSupported = true
+
+// Set SO_REUSEPORT on the socket, so that multiple sockets can bind the same
+// address and the kernel load-balances the datagrams over them.
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err == nil {
+		err = serr
+	}
+	return err
+}
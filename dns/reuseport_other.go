@@ -0,0 +1,23 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// SO_REUSEPORT for the UDP listeners - unsupported platforms
+//
+
+//go:build !linux
+
+package dns
+
+import (
+	"syscall"
+)
+
+// NOTE: The BSDs and macOS have SO_REUSEPORT as well, but it doesn't
+// load-balance the datagrams (only the last bound socket receives them),
+// so a single socket is used instead.
+const reusePortSupported = false
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Rewriters of the forwarded queries and their responses, composing the
+// built-in transformations (e.g., ECS, NSID, stripping the answers) and the
+// custom ones of the library users into a chain.
+//
+
+package dns
+
+import (
+	"net/netip"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/log"
+	"kexuedns/util/dnsmsg"
+)
+
+// Rewriter of the queries before sent to the upstream.
+type QueryRewriter interface {
+	// Rewrite the query (q) in place; an error fails the query with
+	// SERVFAIL.
+	Rewrite(q *dnsmsg.QueryMsg) error
+}
+
+// Function as a QueryRewriter.
+type QueryRewriterFunc func(q *dnsmsg.QueryMsg) error
+
+func (fn QueryRewriterFunc) Rewrite(q *dnsmsg.QueryMsg) error {
+	return fn(q)
+}
+
+// Rewriter of the upstream responses before cached and returned to the
+// clients.
+type ResponseRewriter interface {
+	// Rewrite the response (resp) to the client query (query), and return
+	// the rewritten one, or resp as is if nothing to rewrite.  An error
+	// keeps the response as before this rewriter.
+	// NOTE: The response must not be modified in place.
+	Rewrite(query, resp []byte) ([]byte, error)
+}
+
+// Function as a ResponseRewriter.
+type ResponseRewriterFunc func(query, resp []byte) ([]byte, error)
+
+func (fn ResponseRewriterFunc) Rewrite(query, resp []byte) ([]byte, error) {
+	return fn(query, resp)
+}
+
+// Remove the malformed EDNS options (e.g., crafted ECS) rather than relaying
+// them to the upstream.
+type sanitizeRewriter struct {
+	id     requestID
+	client netip.Addr
+}
+
+func (rw *sanitizeRewriter) Rewrite(q *dnsmsg.QueryMsg) error {
+	if codes := q.RemoveInvalidOptions(); len(codes) > 0 {
+		log.Debugf("%s: removed malformed EDNS options %v from client %s: %s %s",
+			rw.id, codes, rw.client, q.QName(), q.QType())
+	}
+	return nil
+}
+
+// Set the ECS to the subnet (subnet).
+type ecsSubnetRewriter struct {
+	subnet netip.Prefix
+}
+
+func (rw *ecsSubnetRewriter) Rewrite(q *dnsmsg.QueryMsg) error {
+	return q.SetEdnsSubnet(rw.subnet.Addr(), rw.subnet.Bits())
+}
+
+// Limit the client's own ECS to the max prefix lengths.
+type ecsLimitRewriter struct {
+	maxV4, maxV6 int
+}
+
+func (rw *ecsLimitRewriter) Rewrite(q *dnsmsg.QueryMsg) error {
+	q.LimitEdnsSubnet(rw.maxV4, rw.maxV6)
+	return nil
+}
+
+// Request the NSID from the upstream.
+type nsidRewriter struct{}
+
+func (nsidRewriter) Rewrite(q *dnsmsg.QueryMsg) error {
+	q.SetEdnsNSID()
+	return nil
+}
+
+// Strip the records of the types (types) from the answers.
+type stripTypesRewriter struct {
+	id       requestID
+	question *dnsmessage.Question
+	types    []dnsmessage.Type
+}
+
+func (rw *stripTypesRewriter) Rewrite(query, resp []byte) ([]byte, error) {
+	if sresp, ok := stripAnswers(resp, rw.types); ok {
+		log.Debugf("%s: stripped answers: %s %s", rw.id, rw.question.Name, rw.question.Type)
+		return sresp, nil
+	}
+	return resp, nil
+}
+
+// Override the answers by the forwarder's AnswerOverrides.
+type overrideRewriter struct {
+	f        *Forwarder
+	id       requestID
+	question *dnsmessage.Question
+}
+
+func (rw *overrideRewriter) Rewrite(query, resp []byte) ([]byte, error) {
+	if oresp, ok := rw.f.overrideAnswers(query, rw.question); ok {
+		log.Debugf("%s: overrode answers: %s %s", rw.id, rw.question.Name, rw.question.Type)
+		return oresp, nil
+	}
+	return resp, nil
+}
+
+// Make the chain of the rewriters of the query (qmsg) from the client
+// (client) routed to the index (index) route, i.e., the built-in ones as
+// needed followed by the custom ones; empty if nothing to rewrite, so the
+// query is forwarded as is.
+func (f *Forwarder) queryRewriters(id requestID, qmsg []byte, qtype dnsmessage.Type,
+	client netip.Addr, index int) []QueryRewriter {
+	var chain []QueryRewriter
+	if dnsmsg.RawMsg(qmsg).HasInvalidOption() {
+		chain = append(chain, &sanitizeRewriter{id: id, client: client})
+	}
+
+	// NOTE: The query name is always forwarded verbatim, i.e., never
+	// appended with search domains or other labels, so the only client
+	// information added is the ECS, whose precision is strictly limited.
+	subnet, setECS := f.ecsSubnet(qtype, client, index)
+	limitECS := !setECS && f.ecsTooPrecise(qmsg)
+	own := limitECS
+	if !setECS && !limitECS {
+		_, own = dnsmsg.RawMsg(qmsg).EdnsSubnet()
+	}
+	f.metrics.observeECS(setECS, own)
+	if setECS {
+		chain = append(chain, &ecsSubnetRewriter{subnet: subnet})
+	} else if limitECS {
+		// Client's own ECS is more precise than allowed.
+		maxV4, maxV6 := f.ecsPrefix()
+		chain = append(chain, &ecsLimitRewriter{maxV4: maxV4, maxV6: maxV6})
+	}
+
+	if f.RequestNSID {
+		chain = append(chain, nsidRewriter{})
+	}
+	return append(chain, f.QueryRewriters...)
+}
+
+// Make the chain of the rewriters of the upstream responses to the query of
+// the question (question), i.e., the built-in ones as configured followed
+// by the custom ones.
+func (f *Forwarder) responseRewriters(id requestID,
+	question *dnsmessage.Question) []ResponseRewriter {
+	var chain []ResponseRewriter
+	if len(f.StripTypes) > 0 {
+		chain = append(chain, &stripTypesRewriter{id: id, question: question, types: f.StripTypes})
+	}
+	if len(f.AnswerOverrides) > 0 {
+		chain = append(chain, &overrideRewriter{f: f, id: id, question: question})
+	}
+	return append(chain, f.ResponseRewriters...)
+}
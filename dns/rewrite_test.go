@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Rewriters of the queries and responses - tests
+//
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+	"kexuedns/util/dnsmsg"
+)
+
+func TestQueryRewritersChain(t *testing.T) {
+	f := &Forwarder{myIP: &config.MyIP{}}
+	plain := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	if chain := f.queryRewriters(0, plain, dnsmessage.TypeA, netip.Addr{}, -1); len(chain) != 0 {
+		t.Errorf(`queryRewriters() = %T; want empty to forward as is`, chain)
+	}
+
+	f.RequestNSID = true
+	if err := f.SetECSSubnet("203.0.113.0/24", ""); err != nil {
+		t.Fatalf(`SetECSSubnet() = %v; want nil`, err)
+	}
+	custom := QueryRewriterFunc(func(q *dnsmsg.QueryMsg) error { return nil })
+	f.QueryRewriters = []QueryRewriter{custom}
+	chain := f.queryRewriters(0, plain, dnsmessage.TypeA, netip.Addr{}, -1)
+	if len(chain) != 3 {
+		t.Fatalf(`queryRewriters() = %T; want ECS, NSID and custom`, chain)
+	}
+	if _, ok := chain[0].(*ecsSubnetRewriter); !ok {
+		t.Errorf(`queryRewriters()[0] = %T; want *ecsSubnetRewriter`, chain[0])
+	}
+	if _, ok := chain[1].(nsidRewriter); !ok {
+		t.Errorf(`queryRewriters()[1] = %T; want nsidRewriter`, chain[1])
+	}
+}
+
+func TestHandleQueryRewriters(t *testing.T) {
+	upstream := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	resolver := &recordingResolver{staticResolver: staticResolver{response: upstream}}
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = resolver
+	if err := f.SetECSSubnet("203.0.113.0/24", ""); err != nil {
+		t.Fatalf(`SetECSSubnet() = %v; want nil`, err)
+	}
+
+	// The custom rewriter runs after the built-in ECS one.
+	seenECS := false
+	f.QueryRewriters = []QueryRewriter{
+		QueryRewriterFunc(func(q *dnsmsg.QueryMsg) error {
+			for _, op := range q.OPT.Options {
+				seenECS = seenECS || op.Code == 8
+			}
+			q.Header.RecursionDesired = false
+			q.Question.Name = dnsmessage.MustNewName("www.example.net.")
+			return nil
+		}),
+	}
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	if _, err := f.handleQuery(context.Background(), query, netip.Addr{}, true); err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	header, question, err := dnsmsg.RawMsg(resolver.msg).Question()
+	if err != nil || header.RecursionDesired || question.Name.String() != "www.example.net." {
+		t.Errorf(`forwarded query = (%+v, %+v, %v); want rewritten`, header, question, err)
+	}
+	if prefix, ok := dnsmsg.RawMsg(resolver.msg).EdnsSubnet(); !ok ||
+		prefix.String() != "203.0.113.0/24" {
+		t.Errorf(`forwarded ECS = (%v, %v); want 203.0.113.0/24`, prefix, ok)
+	}
+	if !seenECS {
+		t.Errorf(`custom rewriter saw no ECS; want after the built-in one`)
+	}
+
+	// Failed rewrite: SERVFAIL without forwarding.
+	errRewrite := errors.New("rewrite failure")
+	f.QueryRewriters = []QueryRewriter{
+		QueryRewriterFunc(func(q *dnsmsg.QueryMsg) error { return errRewrite }),
+	}
+	resolver.msg = nil
+	query = newTestQuery(t, "www.example.org.", dnsmessage.TypeA)
+	resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	var dmsg dnsmessage.Message
+	if !errors.Is(err, errRewrite) || dmsg.Unpack(resp) != nil ||
+		dmsg.RCode != dnsmessage.RCodeServerFailure || resolver.msg != nil {
+		t.Errorf(`handleQuery() = (%+v, %v); want SERVFAIL not forwarded`, dmsg.Header, err)
+	}
+}
+
+func TestHandleResponseRewriters(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	upstream := newTestResponse(t, query, dnsmessage.RCodeSuccess, nil, nil)
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = &staticResolver{response: upstream}
+
+	var got [][]byte // responses seen by the rewriters
+	record := func(query, resp []byte) ([]byte, error) {
+		got = append(got, resp)
+		return resp, nil
+	}
+	f.ResponseRewriters = []ResponseRewriter{
+		ResponseRewriterFunc(record),
+		ResponseRewriterFunc(func(query, resp []byte) ([]byte, error) {
+			return nil, errors.New("rewrite failure") // skipped
+		}),
+		ResponseRewriterFunc(func(query, resp []byte) ([]byte, error) {
+			r := bytes.Clone(resp)
+			dnsmsg.RawMsg(r).SetRCode(dnsmessage.RCodeNameError)
+			return r, nil
+		}),
+		ResponseRewriterFunc(record),
+	}
+	resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if err != nil {
+		t.Fatalf(`handleQuery() = %v; want nil`, err)
+	}
+	if len(got) != 2 || !bytes.Equal(got[0], upstream) || !bytes.Equal(got[1], resp) {
+		t.Fatalf(`rewriters saw %d responses; want the upstream and the rewritten`, len(got))
+	}
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(resp); err != nil || dmsg.RCode != dnsmessage.RCodeNameError {
+		t.Errorf(`response = %+v (%v); want NXDOMAIN rewritten`, dmsg.Header, err)
+	}
+}
@@ -0,0 +1,301 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Comparison of the route resolver with a shadow one, e.g., to validate a
+// migration.
+//
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/log"
+	"kexuedns/util/dnsmsg"
+)
+
+const (
+	// Default max concurrent shadow queries of a route.
+	defaultCompareMaxInflight = 64
+	maxCompareMaxInflight     = 1024
+)
+
+// Comparison of the route resolver (primary) with another resolver (shadow),
+// e.g., to validate a migration.  The queries are also sent to the shadow,
+// whose answers are compared with the primary's, and the differences (e.g.,
+// of the IPs or RCODEs) are logged and counted, while the clients only get
+// the primary's answers.
+type RouteCompare struct {
+	// The shadow resolver.
+	Resolver *ResolverExport `json:"resolver"`
+	// Percentage of the queries also sent to the shadow.
+	// Range: [0, 100]; default: 0 (i.e., all)
+	Percent int `json:"percent,omitempty"`
+	// Max concurrent shadow queries, beyond which the queries are not
+	// shadowed, to bound the extra load upon a burst or a slow shadow.
+	// Range: [0, 1024]; default: 0 (i.e., defaultCompareMaxInflight)
+	MaxInflight int `json:"max_inflight,omitempty"`
+}
+
+// Statistics of the comparison with the shadow resolver.
+type CompareStats struct {
+	Resolver string `json:"resolver"` // the shadow
+	// Number of the shadow queries answered and compared, failed without a
+	// response, and skipped for too many in flight.
+	Compared uint64 `json:"compared"`
+	Errors   uint64 `json:"errors"`
+	Skipped  uint64 `json:"skipped"`
+	// Number of the divergences: of the RCODEs, and of the answers (e.g.,
+	// the IPs) despite the same RCODE.
+	RCodeDiffs  uint64 `json:"rcode_diffs"`
+	AnswerDiffs uint64 `json:"answer_diffs"`
+}
+
+// The primary resolver shadowing the queries to compare.
+type routeCompare struct {
+	Resolver // the primary
+	shadow   *compareShadow
+	percent  int
+	inflight chan struct{} // semaphore of the shadow queries
+
+	compared    atomic.Uint64
+	errors      atomic.Uint64
+	skipped     atomic.Uint64
+	rcodeDiffs  atomic.Uint64
+	answerDiffs atomic.Uint64
+}
+
+// The shadow resolver, which is no longer pinned by the new shadow queries
+// once closed (e.g., retired by a reload), while the in-flight ones keep it
+// open until done.
+type compareShadow struct {
+	Resolver
+	lock   sync.Mutex
+	closed bool
+}
+
+func (c *RouteCompare) validate() error {
+	if c.Resolver == nil {
+		return errors.New("resolver missing")
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("percent %d out of range [0, 100]", c.Percent)
+	}
+	if c.MaxInflight < 0 || c.MaxInflight > maxCompareMaxInflight {
+		return fmt.Errorf("max inflight %d out of range [0, %d]",
+			c.MaxInflight, maxCompareMaxInflight)
+	}
+	if err := c.Resolver.Validate(); err != nil {
+		return fmt.Errorf("invalid resolver: %w", err)
+	}
+	return nil
+}
+
+// Create the comparison of the primary resolver (primary) with the shadow
+// one (shadow) by the configs (rc).
+func newRouteCompare(primary, shadow Resolver, rc *RouteCompare) *routeCompare {
+	percent := rc.Percent
+	if percent == 0 {
+		percent = 100
+	}
+	maxInflight := rc.MaxInflight
+	if maxInflight == 0 {
+		maxInflight = defaultCompareMaxInflight
+	}
+	return &routeCompare{
+		Resolver: primary,
+		shadow:   &compareShadow{Resolver: shadow},
+		percent:  percent,
+		inflight: make(chan struct{}, maxInflight),
+	}
+}
+
+func (c *routeCompare) resolverOf(string) Resolver {
+	return c
+}
+
+func (c *routeCompare) other() Resolver {
+	return c.shadow
+}
+
+func (c *routeCompare) export(re *RouteExport) {
+	re.Policy = RoutePolicyCompare
+	re.Compare = &RouteCompare{
+		Resolver:    c.shadow.Export(),
+		Percent:     c.percent,
+		MaxInflight: cap(c.inflight),
+	}
+}
+
+func (c *routeCompare) stats(rs *RouteStats) {
+	rs.Compare = &CompareStats{
+		Resolver:    c.shadow.Export().Name,
+		Compared:    c.compared.Load(),
+		Errors:      c.errors.Load(),
+		Skipped:     c.skipped.Load(),
+		RCodeDiffs:  c.rcodeDiffs.Load(),
+		AnswerDiffs: c.answerDiffs.Load(),
+	}
+}
+
+func (c *routeCompare) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	resp, _, err := c.QueryWithMeta(ctx, msg, isUDP)
+	return resp, err
+}
+
+func (c *routeCompare) QueryWithMeta(ctx context.Context, msg []byte,
+	isUDP bool) ([]byte, QueryMeta, error) {
+	resp, meta, err := queryWithMeta(ctx, c.Resolver, msg, isUDP)
+	if err == nil {
+		c.shadowQuery(msg, resp, isUDP)
+	}
+	return resp, meta, err
+}
+
+// Pin the primary resolver if it's pinnable (see resolverRef.pin()), while
+// the shadow is pinned by the shadow queries themselves.
+func (c *routeCompare) pin() func() {
+	if pr, ok := c.Resolver.(pinnableResolver); ok {
+		return pr.pin()
+	}
+	return func() {}
+}
+
+// Send the query (msg) to the shadow in the background, and compare its
+// response with the primary's (resp), unless not sampled or too many in
+// flight.
+func (c *routeCompare) shadowQuery(msg, resp []byte, isUDP bool) {
+	if c.percent < 100 && rand.IntN(100) >= c.percent {
+		return
+	}
+	select {
+	case c.inflight <- struct{}{}:
+	default:
+		c.skipped.Add(1)
+		return
+	}
+	release, ok := c.shadow.tryPin()
+	if !ok {
+		<-c.inflight
+		return
+	}
+
+	// The buffers may be reused once the query returns.
+	msg, resp = slices.Clone(msg), slices.Clone(resp)
+	go func() {
+		defer func() {
+			release()
+			<-c.inflight
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+		defer cancel()
+		sresp, _, err := queryWithMeta(ctx, c.shadow.Resolver, msg, isUDP)
+		if err != nil {
+			log.Debugf("shadow query to [%s] failed: %v", c.shadow.Export().Name, err)
+			c.errors.Add(1)
+			return
+		}
+		c.compare(resp, sresp)
+	}()
+}
+
+// Compare the shadow response (sresp) with the primary's (resp), and log
+// and count the divergence if any.
+func (c *routeCompare) compare(resp, sresp []byte) {
+	p, err := digestAnswers(resp)
+	if err != nil {
+		log.Debugf("invalid primary response: %v", err)
+		return
+	}
+	s, err := digestAnswers(sresp)
+	if err != nil {
+		log.Debugf("invalid shadow response from [%s]: %v", c.shadow.Export().Name, err)
+		c.errors.Add(1)
+		return
+	}
+	c.compared.Add(1)
+
+	var kind string
+	switch {
+	case p.rcode != s.rcode:
+		c.rcodeDiffs.Add(1)
+		kind = "rcode"
+	case p.truncated || s.truncated:
+		return // incomplete answers
+	case !slices.Equal(p.answers, s.answers):
+		c.answerDiffs.Add(1)
+		kind = "answer"
+	default:
+		return
+	}
+	log.Noticef("%s %s: %s diverged: [%s] %s %v vs. [%s] %s %v",
+		p.name, dnsmsg.TypeString(p.qtype), kind,
+		c.Resolver.Export().Name, dnsmsg.RCodeString(p.rcode), p.answers,
+		c.shadow.Export().Name, dnsmsg.RCodeString(s.rcode), s.answers)
+}
+
+// Digest of a response for the comparison.
+type answerDigest struct {
+	name      string
+	qtype     dnsmessage.Type
+	rcode     dnsmessage.RCode
+	truncated bool
+	// Sorted data of the answers of the queried type, e.g., the IPs of an
+	// A query, ignoring the TTLs, the order and the CNAMEs.
+	answers []string
+}
+
+func digestAnswers(resp []byte) (*answerDigest, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, err
+	}
+	if len(msg.Questions) != 1 {
+		return nil, fmt.Errorf("%d questions", len(msg.Questions))
+	}
+	q := msg.Questions[0]
+	d := &answerDigest{
+		name:      q.Name.String(),
+		qtype:     q.Type,
+		rcode:     msg.Header.RCode,
+		truncated: msg.Header.Truncated,
+	}
+	for _, rr := range msg.Answers {
+		if rr.Header.Type == q.Type {
+			d.answers = append(d.answers, strings.ToLower(dnsmsg.FormatRData(rr.Body)))
+		}
+	}
+	slices.Sort(d.answers)
+	return d, nil
+}
+
+// Pin the shadow resolver for a shadow query (see resolverRef.pin()); false
+// if already closed.
+func (s *compareShadow) tryPin() (func(), bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil, false
+	}
+	if pr, ok := s.Resolver.(pinnableResolver); ok {
+		return pr.pin(), true
+	}
+	return func() {}, true
+}
+
+func (s *compareShadow) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	s.Resolver.Close()
+}
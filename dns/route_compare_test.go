@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Comparison of the route resolver with a shadow one - tests
+//
+
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Wait for the in-flight shadow queries of the comparison (c) to finish.
+func waitShadows(t *testing.T, c *routeCompare) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for len(c.inflight) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf(`%d shadow queries still in flight`, len(c.inflight))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRouteCompare(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	name := dnsmessage.MustNewName("www.example.com.")
+	a := func(ip string) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300,
+			},
+			Body: &dnsmessage.AResource{A: netip.MustParseAddr(ip).As4()},
+		}
+	}
+	primary := newTestResponse(t, query, dnsmessage.RCodeSuccess,
+		[]dnsmessage.Resource{a("192.0.2.1"), a("192.0.2.2")}, nil)
+
+	for _, tc := range []struct {
+		name   string
+		shadow []byte
+		rcode  uint64
+		answer uint64
+	}{
+		{
+			name: "same answers in another order",
+			shadow: newTestResponse(t, query, dnsmessage.RCodeSuccess,
+				[]dnsmessage.Resource{a("192.0.2.2"), a("192.0.2.1")}, nil),
+		},
+		{
+			name: "different IPs",
+			shadow: newTestResponse(t, query, dnsmessage.RCodeSuccess,
+				[]dnsmessage.Resource{a("198.51.100.1")}, nil),
+			answer: 1,
+		},
+		{
+			name:   "different RCODEs",
+			shadow: newTestResponse(t, query, dnsmessage.RCodeNameError, nil, nil),
+			rcode:  1,
+		},
+	} {
+		c := newRouteCompare(&staticResolver{response: primary},
+			&staticResolver{response: tc.shadow}, &RouteCompare{})
+		resp, err := c.Query(context.Background(), query, true)
+		if err != nil || string(resp) != string(primary) {
+			t.Errorf(`[%s] Query() = (%x, %v); want the primary response`, tc.name, resp, err)
+		}
+		waitShadows(t, c)
+		rs := &RouteStats{}
+		c.stats(rs)
+		want := CompareStats{
+			Resolver:    "static",
+			Compared:    1,
+			RCodeDiffs:  tc.rcode,
+			AnswerDiffs: tc.answer,
+		}
+		if *rs.Compare != want {
+			t.Errorf(`[%s] stats = %+v; want %+v`, tc.name, *rs.Compare, want)
+		}
+	}
+
+	// Shadow failures are counted as errors.
+	c := newRouteCompare(&staticResolver{response: primary}, &staticResolver{}, &RouteCompare{})
+	if _, err := c.Query(context.Background(), query, true); err != nil {
+		t.Errorf(`Query() = %v; want nil`, err)
+	}
+	waitShadows(t, c)
+	if n, m := c.errors.Load(), c.compared.Load(); n != 1 || m != 0 {
+		t.Errorf(`errors = %d, compared = %d; want 1, 0`, n, m)
+	}
+
+	// Not shadowed once closed.
+	c.shadow.Close()
+	if _, err := c.Query(context.Background(), query, true); err != nil {
+		t.Errorf(`Query() = %v; want nil`, err)
+	}
+	if n := c.errors.Load() + c.compared.Load() + c.skipped.Load(); n != 1 {
+		t.Errorf(`shadow queries = %d; want 1`, n)
+	}
+}
+
+func TestRouteCompareInflight(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	shadow := &gatedResolver{release: make(chan struct{})}
+	c := newRouteCompare(&answeringResolver{}, shadow, &RouteCompare{MaxInflight: 2})
+
+	for range 5 {
+		if _, err := c.Query(context.Background(), query, true); err != nil {
+			t.Fatalf(`Query() = %v; want nil`, err)
+		}
+	}
+	close(shadow.release)
+	waitShadows(t, c)
+	if n, m := c.compared.Load(), c.skipped.Load(); n != 2 || m != 3 {
+		t.Errorf(`compared = %d, skipped = %d; want 2, 3`, n, m)
+	}
+	if n := c.answerDiffs.Load(); n != 0 {
+		t.Errorf(`answer diffs = %d; want 0`, n)
+	}
+}
+
+func TestRouteCompareConfig(t *testing.T) {
+	udp := func(addr string) *ResolverExport {
+		return &ResolverExport{Protocol: ResolverProtocolUDP, Address: addr}
+	}
+	for i, re := range []*RouteExport{
+		{Resolver: udp("127.0.0.1:53"), Policy: RoutePolicyCompare},
+		{Resolver: udp("127.0.0.1:53"), Compare: &RouteCompare{Resolver: udp("127.0.0.2:53")}},
+		{
+			Resolver: udp("127.0.0.1:53"),
+			Policy:   RoutePolicySplit,
+			Split:    &RouteSplit{Resolver: udp("127.0.0.2:53")},
+			Compare:  &RouteCompare{Resolver: udp("127.0.0.2:53")},
+		},
+		{Policy: RoutePolicyCompare, Compare: &RouteCompare{Resolver: udp("127.0.0.2:53")}},
+		{
+			Resolver: udp("127.0.0.1:53"),
+			Policy:   RoutePolicyCompare,
+			Compare:  &RouteCompare{Resolver: udp("127.0.0.2:53"), Percent: -1},
+		},
+		{
+			Resolver: udp("127.0.0.1:53"),
+			Policy:   RoutePolicyCompare,
+			Compare: &RouteCompare{
+				Resolver:    udp("127.0.0.2:53"),
+				MaxInflight: maxCompareMaxInflight + 1,
+			},
+		},
+	} {
+		if err := ValidateRouterExport(&RouterExport{Routes: []*RouteExport{re}}); err == nil {
+			t.Errorf(`[%d] ValidateRouterExport() = nil; want error`, i)
+		}
+		r := &Router{}
+		if err := r.SetRoute(1, re); err == nil {
+			t.Errorf(`[%d] SetRoute() = nil; want error`, i)
+		}
+		r.Close()
+	}
+
+	r := &Router{}
+	defer r.Close()
+	re := &RouteExport{
+		Name:     "migration",
+		Resolver: udp("127.0.0.1:53"),
+		Zones:    []string{"example.com"},
+		Policy:   RoutePolicyCompare,
+		Compare:  &RouteCompare{Resolver: udp("127.0.0.2:53"), Percent: 10},
+	}
+	if err := r.SetRoute(1, re); err != nil {
+		t.Fatalf(`SetRoute() = %v; want nil`, err)
+	}
+	res, index := r.GetResolver("www.example.com.")
+	if _, ok := res.(*routeCompare); !ok || index != 1 {
+		t.Errorf(`GetResolver() = (%T, %d); want compare of route [1]`, res, index)
+	}
+	exported := &RouteExport{}
+	r.routes[1].policy.export(exported)
+	if c := exported.Compare; exported.Policy != RoutePolicyCompare || c == nil ||
+		c.Percent != 10 || c.MaxInflight != defaultCompareMaxInflight ||
+		c.Resolver.Address != "127.0.0.2:53" {
+		t.Errorf(`compare export = %+v; want 10%% to 127.0.0.2:53`, c)
+	}
+	if stats := r.Stats().Routes[0]; stats.Compare == nil || stats.Split != nil {
+		t.Errorf(`Stats() route = %+v; want compare stats`, stats)
+	}
+	if n := len(r.resolverAddresses()); n != 2 {
+		t.Errorf(`resolverAddresses() = %d; want 2`, n)
+	}
+
+	// Back to the default policy, closing the shadow.
+	shadow := r.routes[1].policy.(*routeCompare).shadow
+	if err := r.SetRoute(1, &RouteExport{}); err != nil {
+		t.Fatalf(`SetRoute() = %v; want nil`, err)
+	}
+	if r.routes[1].policy != nil || !shadow.closed {
+		t.Errorf(`route [1] policy = %v, shadow closed = %v; want nil, true`,
+			r.routes[1].policy, shadow.closed)
+	}
+}
@@ -0,0 +1,173 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Split of the route queries between two resolvers for A/B testing.
+//
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/util/dnsmsg"
+)
+
+// Split of the route queries between the route resolver (A) and another
+// resolver (B), e.g., to A/B test a new upstream. The split is by the hash
+// of the query name, so that a name consistently hits the same resolver and
+// the cached answers stay consistent.
+type RouteSplit struct {
+	// The other resolver (B).
+	Resolver *ResolverExport `json:"resolver"`
+	// Percentage of the query names sent to the route resolver (A), and
+	// the rest to B. Range: [0, 100]
+	Percent int `json:"percent"`
+}
+
+// Comparison of the two resolvers of a split route.
+type SplitStats struct {
+	Percent int            `json:"percent"`
+	A       *SplitArmStats `json:"a"`
+	B       *SplitArmStats `json:"b"`
+}
+
+type SplitArmStats struct {
+	Resolver string `json:"resolver"`
+	// Number of the queries sent, and failed without a response
+	Queries uint64 `json:"queries"`
+	Errors  uint64 `json:"errors"`
+	// Mean latency (milliseconds) of the answered queries
+	AvgLatency float64 `json:"avg_latency_ms"`
+	// Number of the responses by RCODE, e.g., {"NOERROR": 10}
+	RCodes map[string]uint64 `json:"rcodes,omitempty"`
+}
+
+type routeSplit struct {
+	percent int
+	arms    [2]*splitArm // A and B
+}
+
+// One side of the split, i.e., the resolver with the statistics of the
+// queries sent to it.
+type splitArm struct {
+	Resolver
+	queries atomic.Uint64
+	errors  atomic.Uint64
+	latency atomic.Int64 // total nanoseconds of the answered queries
+	rcodes  [16]atomic.Uint64
+}
+
+func (s *RouteSplit) validate() error {
+	if s.Resolver == nil {
+		return errors.New("resolver missing")
+	}
+	if s.Percent < 0 || s.Percent > 100 {
+		return fmt.Errorf("percent %d out of range [0, 100]", s.Percent)
+	}
+	if err := s.Resolver.Validate(); err != nil {
+		return fmt.Errorf("invalid resolver: %w", err)
+	}
+	return nil
+}
+
+// Create the split between the resolvers (a and b).
+func newRouteSplit(a, b Resolver, percent int) *routeSplit {
+	return &routeSplit{
+		percent: percent,
+		arms:    [2]*splitArm{{Resolver: a}, {Resolver: b}},
+	}
+}
+
+// Pick the resolver of the name (name), i.e., A if the hash of the name
+// falls into the percent.
+func (s *routeSplit) pick(name string) *splitArm {
+	h := fnv.New32a()
+	h.Write([]byte(dnsmsg.NormalizeName(dnsmsg.ToASCII(name))))
+	if int(h.Sum32()%100) < s.percent {
+		return s.arms[0]
+	}
+	return s.arms[1]
+}
+
+func (s *routeSplit) resolverOf(name string) Resolver {
+	return s.pick(name)
+}
+
+func (s *routeSplit) other() Resolver {
+	return s.arms[1].Resolver
+}
+
+func (s *routeSplit) export(re *RouteExport) {
+	re.Policy = RoutePolicySplit
+	re.Split = &RouteSplit{
+		Resolver: s.arms[1].Export(),
+		Percent:  s.percent,
+	}
+}
+
+func (s *routeSplit) stats(rs *RouteStats) {
+	rs.Split = &SplitStats{
+		Percent: s.percent,
+		A:       s.arms[0].stats(),
+		B:       s.arms[1].stats(),
+	}
+}
+
+func (a *splitArm) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	resp, _, err := a.QueryWithMeta(ctx, msg, isUDP)
+	return resp, err
+}
+
+func (a *splitArm) QueryWithMeta(ctx context.Context, msg []byte,
+	isUDP bool) ([]byte, QueryMeta, error) {
+	a.queries.Add(1)
+	resp, meta, err := queryWithMeta(ctx, a.Resolver, msg, isUDP)
+	if err != nil {
+		a.errors.Add(1)
+		return resp, meta, err
+	}
+	a.latency.Add(int64(meta.Latency))
+	if len(resp) >= 4 {
+		a.rcodes[resp[3]&0xF].Add(1)
+	}
+	return resp, meta, nil
+}
+
+// Pin the underlying resolver if it's pinnable (see resolverRef.pin()).
+func (a *splitArm) pin() func() {
+	if pr, ok := a.Resolver.(pinnableResolver); ok {
+		return pr.pin()
+	}
+	return func() {}
+}
+
+func (a *splitArm) stats() *SplitArmStats {
+	s := &SplitArmStats{
+		Resolver: a.Export().Name,
+		Queries:  a.queries.Load(),
+		Errors:   a.errors.Load(),
+	}
+	var answered uint64
+	for i := range a.rcodes {
+		if n := a.rcodes[i].Load(); n > 0 {
+			if s.RCodes == nil {
+				s.RCodes = make(map[string]uint64)
+			}
+			s.RCodes[dnsmsg.RCodeString(dnsmessage.RCode(i))] = n
+			answered += n
+		}
+	}
+	if answered > 0 {
+		avg := time.Duration(a.latency.Load() / int64(answered))
+		s.AvgLatency = float64(avg.Microseconds()) / 1000
+	}
+	return s
+}
@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Split of the route queries - tests
+//
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/util/dnstrie"
+)
+
+func TestRouteSplitRatio(t *testing.T) {
+	a, b := &staticResolver{}, &staticResolver{}
+	for _, percent := range []int{0, 10, 50, 90, 100} {
+		s := newRouteSplit(a, b, percent)
+		const n = 10000
+		na := 0
+		for i := range n {
+			name := fmt.Sprintf("host%d.example.com.", i)
+			arm := s.pick(name)
+			if arm == s.arms[0] {
+				na++
+			}
+			// Deterministic per name, regardless of the case.
+			if s.pick(name) != arm || s.pick(fmt.Sprintf("HOST%d.Example.com.", i)) != arm {
+				t.Fatalf(`[%d%%] pick(%q) not consistent`, percent, name)
+			}
+		}
+		got := na * 100 / n
+		if got < percent-2 || got > percent+2 {
+			t.Errorf(`[%d%%] %d%% of the names picked A; want ~%d%%`, percent, got, percent)
+		}
+		if (percent == 0 && na != 0) || (percent == 100 && na != n) {
+			t.Errorf(`[%d%%] %d of %d names picked A; want exact`, percent, na, n)
+		}
+	}
+}
+
+func TestRouteSplitStats(t *testing.T) {
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	noerror := newTestResponse(t, query, dnsmessage.RCodeSuccess, nil, nil)
+	nxdomain := newTestResponse(t, query, dnsmessage.RCodeNameError, nil, nil)
+	a := newFakeResolver("a")
+	a.err = errors.New("upstream failure")
+	r := &Router{}
+	r.routes[1] = &Route{
+		name:     "ab",
+		resolver: &staticResolver{response: noerror},
+		trie:     &dnstrie.DNSTrie{},
+	}
+	r.routes[1].trie.AddZone("example.com", struct{}{})
+	split := newRouteSplit(r.routes[1].resolver, &staticResolver{response: nxdomain}, 50)
+	r.routes[1].policy = split
+
+	for i := range 100 {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		res, index := r.GetResolver(name)
+		if index != 1 {
+			t.Fatalf(`GetResolver(%q) index = %d; want 1`, name, index)
+		}
+		if _, _, err := queryWithMeta(context.Background(), res, query, true); err != nil {
+			t.Fatalf(`queryWithMeta() = %v; want nil`, err)
+		}
+	}
+	// Failures are counted as errors.
+	arm := split.arms[0]
+	arm.Resolver = a
+	if _, err := arm.Query(context.Background(), query, true); err == nil {
+		t.Errorf(`Query() = nil; want error`)
+	}
+
+	stats := r.Stats().Routes[0].Split
+	if stats == nil || stats.Percent != 50 {
+		t.Fatalf(`Stats() split = %+v; want 50%%`, stats)
+	}
+	if stats.A.Queries+stats.B.Queries != 101 || stats.A.Errors != 1 || stats.B.Errors != 0 {
+		t.Errorf(`split stats = A %+v, B %+v; want 101 queries with 1 error of A`,
+			stats.A, stats.B)
+	}
+	if n := stats.A.RCodes["NOERROR"]; n != stats.A.Queries-1 || n == 0 {
+		t.Errorf(`split stats A RCodes = %v; want %d NOERROR`, stats.A.RCodes, stats.A.Queries-1)
+	}
+	if n := stats.B.RCodes["NXDOMAIN"]; n != stats.B.Queries || n == 0 {
+		t.Errorf(`split stats B RCodes = %v; want %d NXDOMAIN`, stats.B.RCodes, stats.B.Queries)
+	}
+}
+
+func TestRouteSplitConfig(t *testing.T) {
+	udp := func(addr string) *ResolverExport {
+		return &ResolverExport{Protocol: ResolverProtocolUDP, Address: addr}
+	}
+	for i, re := range []*RouteExport{
+		{Resolver: udp("127.0.0.1:53"), Split: &RouteSplit{Resolver: udp("127.0.0.2:53")}},
+		{Resolver: udp("127.0.0.1:53"), Policy: RoutePolicySplit},
+		{Resolver: udp("127.0.0.1:53"), Policy: "random"},
+		{Policy: RoutePolicySplit, Split: &RouteSplit{Resolver: udp("127.0.0.2:53")}},
+		{
+			Resolver: udp("127.0.0.1:53"),
+			Policy:   RoutePolicySplit,
+			Split:    &RouteSplit{Resolver: udp("127.0.0.2:53"), Percent: 101},
+		},
+		{
+			Resolver: udp("127.0.0.1:53"),
+			Policy:   RoutePolicySplit,
+			Split:    &RouteSplit{Resolver: udp("invalid")},
+		},
+	} {
+		if err := ValidateRouterExport(&RouterExport{Routes: []*RouteExport{re}}); err == nil {
+			t.Errorf(`[%d] ValidateRouterExport() = nil; want error`, i)
+		}
+		r := &Router{}
+		if err := r.SetRoute(1, re); err == nil {
+			t.Errorf(`[%d] SetRoute() = nil; want error`, i)
+		}
+		r.Close()
+	}
+
+	r := &Router{}
+	defer r.Close()
+	re := &RouteExport{
+		Name:     "ab",
+		Resolver: udp("127.0.0.1:53"),
+		Zones:    []string{"example.com"},
+		Policy:   RoutePolicySplit,
+		Split:    &RouteSplit{Resolver: udp("127.0.0.2:53"), Percent: 30},
+	}
+	if err := r.SetRoute(1, re); err != nil {
+		t.Fatalf(`SetRoute() = %v; want nil`, err)
+	}
+	if m := r.Explain("www.example.com.", dnsmessage.TypeA, ""); m.Index != 1 || m.Resolver == nil {
+		t.Errorf(`Explain() = %+v; want route [1]`, m)
+	}
+	if _, ok := r.routes[1].policy.(*routeSplit); !ok {
+		t.Fatalf(`route [1] policy = %T; want split`, r.routes[1].policy)
+	}
+	exported := &RouteExport{}
+	r.routes[1].policy.export(exported)
+	if s := exported.Split; exported.Policy != RoutePolicySplit || s == nil ||
+		s.Percent != 30 || s.Resolver.Address != "127.0.0.2:53" {
+		t.Errorf(`split export = %+v; want 30%% to 127.0.0.2:53`, s)
+	}
+	if n := len(r.resolverAddresses()); n != 2 {
+		t.Errorf(`resolverAddresses() = %d; want 2`, n)
+	}
+
+	// Back to the default policy, keeping the resolver.
+	if err := r.SetRoute(1, &RouteExport{}); err != nil {
+		t.Fatalf(`SetRoute() = %v; want nil`, err)
+	}
+	res, _ := r.GetResolver("www.example.com.")
+	if _, ok := res.(*splitArm); ok || r.routes[1].policy != nil {
+		t.Errorf(`GetResolver() = %T; want not split`, res)
+	}
+	if n := r.pool.size(); n != 1 {
+		t.Errorf(`pool size = %d; want 1 after the split resolver retired`, n)
+	}
+}
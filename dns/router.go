@@ -9,9 +9,19 @@ package dns
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
 
 	"kexuedns/log"
+	"kexuedns/util/dnsmsg"
 	"kexuedns/util/dnstrie"
 )
 
@@ -20,14 +30,32 @@ import (
 // Smaller index means higher priority.
 const MaxRoutes = 10
 
+// Cap of the grace period before closing the replaced resolvers.
+const maxResolverCloseGrace = 5 * time.Minute
+
 var (
-	ErrRouteIndexInvalid = errors.New("route index invalid")
+	ErrRouteIndexInvalid  = errors.New("route index invalid")
+	ErrRouteNotConfigured = errors.New("route not configured")
+	ErrRoutesFull         = errors.New("no free route index")
 )
 
 type Router struct {
 	resolver Resolver // default resolver
 	routes   [MaxRoutes]*Route
 	lock     sync.RWMutex
+
+	// Resolvers shared among the routes (and the default) of identical
+	// configs; the name of the first one is used.
+	pool resolverPool
+
+	// Domains to block regardless of the routes, reloaded separately.
+	blocklist atomic.Pointer[dnstrie.DNSTrie]
+
+	// Grace period (time.Duration) before closing the replaced resolvers,
+	// and the pending ones with their close timers.
+	closeGrace  atomic.Int64
+	retiredLock sync.Mutex
+	retired     map[Resolver]*time.Timer
 }
 
 // TODO: resolver group & dispatch policy
@@ -35,8 +63,51 @@ type Route struct {
 	name     string
 	resolver Resolver
 	trie     *dnstrie.DNSTrie
+	// Static ECS subnets overriding the forwarder's ones.
+	ecsSubnetV4 netip.Prefix
+	ecsSubnetV6 netip.Prefix
+	// Block the matched queries instead of forwarding them.
+	block     bool
+	blockText string
+	// Drop the matched queries without any reply (UDP only).
+	drop bool
+	// Cache TTL of the responses overriding the record TTLs (0: not).
+	cacheTTL time.Duration
+	// Skipped by the lookups while keeping the configs.
+	disabled bool
+	// Limited to the queries via these server names (SNI) if not empty.
+	serverNames []string
+	// Dispatch policy of the queries with another resolver besides the
+	// route resolver, e.g., a split; nil to forward all to the resolver.
+	policy routePolicy
 }
 
+// Dispatch policies of the route queries.
+const (
+	// Forward all to the route resolver. (default)
+	RoutePolicyDefault = ""
+	// Split between the route resolver and another one, see RouteSplit.
+	RoutePolicySplit = "split"
+	// Forward to the route resolver and shadow to another one to compare
+	// the answers, see RouteCompare.
+	RoutePolicyCompare = "compare"
+)
+
+// Dispatch policy of a route, e.g., routeSplit.
+type routePolicy interface {
+	// Get the resolver of the query name (name).
+	resolverOf(name string) Resolver
+	// Get the other resolver, which is closed together with the route.
+	other() Resolver
+	// Export the configs into the route (re) and the statistics into the
+	// route stats (rs).
+	export(re *RouteExport)
+	stats(rs *RouteStats)
+}
+
+// Default EDE text of the blocked responses.
+const defaultBlockText = "blocked"
+
 // Export struct for external interactions, e.g., with the API.
 type RouterExport struct {
 	Resolver *ResolverExport `json:"resolver"`
@@ -47,7 +118,75 @@ type RouteExport struct {
 	Index    int             `json:"index"`
 	Name     string          `json:"name"`
 	Resolver *ResolverExport `json:"resolver"`
-	Zones    []string        `json:"zones"`
+	// Zones to match, e.g., "example.com" for itself and the subdomains,
+	// "**.example.com" for only the subdomains, "*.example.com" for only
+	// the single-label subdomains (e.g., "www.example.com" but not
+	// "a.www.example.com"), and "=example.com" for only itself.
+	Zones []string `json:"zones"`
+	// Static ECS subnets (e.g., "203.0.113.0/24") overriding the forwarder's
+	// ones and my IPs for the queries of this route.
+	ECSSubnetV4 string `json:"ecs_subnet_v4,omitempty"`
+	ECSSubnetV6 string `json:"ecs_subnet_v6,omitempty"`
+	// Block the matched queries, i.e., answer NXDOMAIN with the Extended
+	// DNS Error "Blocked" (15), without forwarding them to the resolver.
+	Block bool `json:"block,omitempty"`
+	// The EDE text of the blocked responses (default: "blocked"), e.g., to
+	// tell the reason.
+	BlockText string `json:"block_text,omitempty"`
+	// Drop the matched queries without forwarding them, e.g., to blackhole
+	// the telemetry domains whose clients retry even upon NXDOMAIN.
+	// NOTE: Only the UDP queries are dropped silently; the TCP/DoT/DoH ones
+	// are answered a minimal NXDOMAIN instead, because the silence would
+	// just hold the connection until the idle timeout.
+	Drop bool `json:"drop,omitempty"`
+	// Cache the responses of this route for this TTL (seconds), instead of
+	// their record TTLs and regardless of the forwarder's cache default
+	// TTL, e.g., longer for the stable internal zones or shorter for the
+	// rapidly changing ones; the record TTLs of the cached responses are
+	// rewritten accordingly. Range: [0, 86400]; default: 0 (disabled)
+	CacheTTLOverride int `json:"cache_ttl_override,omitempty"`
+	// Whether the route matches the queries (default: true); a disabled
+	// route keeps its zones and resolver but is skipped, e.g., to bypass a
+	// misbehaving route temporarily.
+	Enabled *bool `json:"enabled,omitempty"`
+	// Server names (SNI) of the DoT/DoH listeners that the route is limited
+	// to (e.g., "kids.dns.example"), i.e., a view matching only the queries
+	// via these names, so that one listener serves differently filtered
+	// views by hostname; default: empty, matching the queries via any.
+	ServerNames []string `json:"server_names,omitempty"`
+	// Dispatch policy of the matched queries: "" (default) to forward all
+	// to the resolver, "split" to split them between the resolver and the
+	// one of split, e.g., for A/B testing, or "compare" to also shadow them
+	// to the one of compare, e.g., to validate a migration.
+	Policy  string        `json:"policy,omitempty"`
+	Split   *RouteSplit   `json:"split,omitempty"`
+	Compare *RouteCompare `json:"compare,omitempty"`
+}
+
+// Runtime statistics of the router and its resolvers.
+type RouterStats struct {
+	Resolver *ResolverStats `json:"resolver"`
+	Routes   []*RouteStats  `json:"routes"`
+}
+
+type RouteStats struct {
+	Index    int            `json:"index"`
+	Name     string         `json:"name"`
+	Resolver *ResolverStats `json:"resolver"`
+	Split    *SplitStats    `json:"split,omitempty"`
+	Compare  *CompareStats  `json:"compare,omitempty"`
+}
+
+// Details of the routing decision for a query, see Router.Explain().
+type RouteMatch struct {
+	Name     string          `json:"name"`
+	Type     string          `json:"type"`
+	Index    int             `json:"index"`           // -1 if the default
+	Route    string          `json:"route,omitempty"` // route name
+	Zone     string          `json:"zone,omitempty"`  // matched zone
+	Blocked  bool            `json:"blocked,omitempty"`
+	Dropped  bool            `json:"dropped,omitempty"`
+	Resolver *ResolverExport `json:"resolver"` // nil if none
 }
 
 // Create the router from exported configs.
@@ -55,37 +194,355 @@ func NewRouterFromExport(re *RouterExport) (*Router, error) {
 	r := &Router{}
 
 	if ree := re.Resolver; ree != nil {
-		res, err := NewResolverFromExport(ree)
+		res, err := r.pool.get(ree)
 		if err != nil {
 			log.Errorf("failed to create resolver: %+v, error: %v", ree, err)
 			return nil, err
 		}
 		r.resolver = res
 	}
-	for i, route := range re.Routes {
-		if i >= MaxRoutes {
-			return nil, ErrRouteIndexInvalid
+	routes, err := r.newRoutes(re.Routes)
+	if err != nil {
+		if r.resolver != nil {
+			r.resolver.Close()
 		}
+		return nil, err
+	}
+	r.routes = routes
+	warnShadowedZones(&r.routes, -1)
+
+	return r, nil
+}
+
+// Create the routes from exported configs, with the route of index i from
+// routes[i]. Upon error, the created resolvers are closed.
+func (r *Router) newRoutes(routes []*RouteExport) ([MaxRoutes]*Route, error) {
+	var rrs [MaxRoutes]*Route
+	if len(routes) > MaxRoutes {
+		return rrs, ErrRouteIndexInvalid
+	}
+	for i, route := range routes {
 		rr := &Route{
 			name: route.Name,
 			trie: &dnstrie.DNSTrie{},
 		}
+		var err error
+		if rr.ecsSubnetV4, rr.ecsSubnetV6, err = route.ecsSubnet(); err != nil {
+			log.Errorf("invalid route [%s] ECS subnet: %v", route.Name, err)
+			closeRoutes(&rrs)
+			return rrs, err
+		}
+		if rr.block, rr.blockText, err = route.blockConfig(); err != nil {
+			log.Errorf("invalid route [%s] block: %v", route.Name, err)
+			closeRoutes(&rrs)
+			return rrs, err
+		}
+		rr.drop = route.Drop
+		rr.disabled = !route.enabled()
+		if rr.serverNames, err = route.serverNames(); err != nil {
+			log.Errorf("invalid route [%s] server names: %v", route.Name, err)
+			closeRoutes(&rrs)
+			return rrs, err
+		}
+		if rr.cacheTTL, err = route.cacheTTL(); err != nil {
+			log.Errorf("invalid route [%s] cache TTL: %v", route.Name, err)
+			closeRoutes(&rrs)
+			return rrs, err
+		}
 		if ree := route.Resolver; ree != nil {
-			res, err := NewResolverFromExport(ree)
+			res, err := r.pool.get(ree)
 			if err != nil {
 				log.Errorf("failed to create route [%s] resolver: %+v, error: %v",
 					route.Name, ree, err)
-				return nil, err
+				closeRoutes(&rrs)
+				return rrs, err
 			}
 			rr.resolver = res
 		}
+		if rr.policy, err = r.newPolicy(route, rr.resolver); err != nil {
+			log.Errorf("invalid route [%s] policy: %v", route.Name, err)
+			if rr.resolver != nil {
+				rr.resolver.Close()
+			}
+			closeRoutes(&rrs)
+			return rrs, err
+		}
 		for _, z := range route.Zones {
 			rr.trie.AddZone(z, struct{}{})
 		}
-		r.routes[i] = rr
+		rrs[i] = rr
+	}
+	return rrs, nil
+}
+
+// A zone of a route shadowed by a zone of an earlier route.
+type shadowedZone struct {
+	zone    string
+	index   int // route index
+	byZone  string
+	byIndex int
+}
+
+// Warn about the zones of the routes overlapping with the zones of the
+// routes before them, which match first, so that the queries of those zones
+// (or part of them) never reach the later routes; only check the overlaps
+// involving the index (only) route if it's not negative.
+// NOTE: The overlaps may be intentional, e.g., an exception subzone in an
+// earlier route than its parent zone, which is fine and not warned.
+func warnShadowedZones(routes *[MaxRoutes]*Route, only int) {
+	for _, s := range findShadowedZones(routes, only) {
+		log.Warnf("zone [%s] of route [%d] %s is shadowed by zone [%s] "+
+			"of route [%d] %s, which matches first",
+			s.zone, s.index, routes[s.index].name, s.byZone, s.byIndex, routes[s.byIndex].name)
 	}
+}
 
-	return r, nil
+func findShadowedZones(routes *[MaxRoutes]*Route, only int) []shadowedZone {
+	var shadowed []shadowedZone
+	for j, rr := range routes {
+		if rr == nil || rr.trie == nil {
+			continue
+		}
+		for z := range rr.trie.Export() {
+			names := shadowProbeNames(z)
+			for i := range j {
+				ri := routes[i]
+				if ri == nil || ri.trie == nil || (only >= 0 && i != only && j != only) {
+					continue
+				}
+				if zone, ok := matchAllZones(ri.trie, names); ok {
+					shadowed = append(shadowed, shadowedZone{
+						zone:    z,
+						index:   j,
+						byZone:  zone,
+						byIndex: i,
+					})
+					break
+				}
+			}
+		}
+	}
+	return shadowed
+}
+
+// Get the names to probe whether the zone (zone) as added to the trie is
+// shadowed, i.e., the apex, a single-label subdomain and a deeper one, as
+// far as the zone matches them, where the "*" labels stand for any label.
+func shadowProbeNames(zone string) []string {
+	if z, ok := strings.CutPrefix(zone, "**."); ok {
+		return []string{"*." + z, "*.*." + z}
+	}
+	if strings.HasPrefix(zone, "*.") {
+		return []string{zone}
+	}
+	if z, ok := strings.CutPrefix(zone, "="); ok {
+		return []string{z}
+	}
+	return []string{zone, "*." + zone, "*.*." + zone}
+}
+
+// Check whether all the names (names) match the zones in the trie (trie),
+// and return the zone matching the first name.
+func matchAllZones(trie *dnstrie.DNSTrie, names []string) (string, bool) {
+	var first string
+	for i, name := range names {
+		zone, _, ok := trie.MatchZone(name)
+		if !ok {
+			return "", false
+		}
+		if i == 0 {
+			first = zone
+		}
+	}
+	return first, true
+}
+
+// Parse the static ECS subnets of the route.
+func (re *RouteExport) ecsSubnet() (v4, v6 netip.Prefix, err error) {
+	if v4, err = parseECSSubnet(re.ECSSubnetV4, false); err != nil {
+		return
+	}
+	v6, err = parseECSSubnet(re.ECSSubnetV6, true)
+	return
+}
+
+// Get whether the route is enabled, which is the default if unset.
+func (re *RouteExport) enabled() bool {
+	return re.Enabled == nil || *re.Enabled
+}
+
+// Get the cache TTL override of the route.
+func (re *RouteExport) cacheTTL() (time.Duration, error) {
+	ttl := time.Duration(re.CacheTTLOverride) * time.Second
+	if ttl < 0 || ttl > maxCacheTTL {
+		return 0, fmt.Errorf("cache_ttl_override %d out of range [0, %d]",
+			re.CacheTTLOverride, int(maxCacheTTL.Seconds()))
+	}
+	return ttl, nil
+}
+
+// Get the normalized server names of the route.
+func (re *RouteExport) serverNames() ([]string, error) {
+	var names []string
+	for _, s := range re.ServerNames {
+		name := normalizeServerName(s)
+		if name == "" {
+			return nil, fmt.Errorf("invalid server name [%s]", s)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Get the block configs of the route, with the text defaulted.
+func (re *RouteExport) blockConfig() (block bool, text string, err error) {
+	if re.Block && re.Drop {
+		return false, "", errors.New("both block and drop set")
+	}
+	if !re.Block {
+		if re.BlockText != "" {
+			return false, "", errors.New("block_text set without block")
+		}
+		return false, "", nil
+	}
+	text = re.BlockText
+	if text == "" {
+		text = defaultBlockText
+	}
+	if len(text) > maxExtraTextLength {
+		return false, "", fmt.Errorf("block_text too long: %d > %d",
+			len(text), maxExtraTextLength)
+	}
+	return true, text, nil
+}
+
+// Validate the dispatch policy configs of the route.
+func (re *RouteExport) policyConfig() error {
+	switch re.Policy {
+	case RoutePolicyDefault:
+	case RoutePolicySplit:
+		if re.Split == nil {
+			return errors.New("split configs missing")
+		}
+		if err := re.Split.validate(); err != nil {
+			return fmt.Errorf("invalid split: %w", err)
+		}
+	case RoutePolicyCompare:
+		if re.Compare == nil {
+			return errors.New("compare configs missing")
+		}
+		if err := re.Compare.validate(); err != nil {
+			return fmt.Errorf("invalid compare: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown policy [%s]", re.Policy)
+	}
+	if re.Split != nil && re.Policy != RoutePolicySplit {
+		return errors.New("split set without the split policy")
+	}
+	if re.Compare != nil && re.Policy != RoutePolicyCompare {
+		return errors.New("compare set without the compare policy")
+	}
+	return nil
+}
+
+// Create the dispatch policy of the route (re) with its resolver (a);
+// nil if the default.
+func (r *Router) newPolicy(re *RouteExport, a Resolver) (routePolicy, error) {
+	if err := re.policyConfig(); err != nil || re.Policy == RoutePolicyDefault {
+		return nil, err
+	}
+	if a == nil {
+		return nil, fmt.Errorf("policy [%s] without the route resolver", re.Policy)
+	}
+	if re.Policy == RoutePolicySplit {
+		b, err := r.pool.get(re.Split.Resolver)
+		if err != nil {
+			return nil, err
+		}
+		return newRouteSplit(a, b, re.Split.Percent), nil
+	}
+	b, err := r.pool.get(re.Compare.Resolver)
+	if err != nil {
+		return nil, err
+	}
+	return newRouteCompare(a, b, re.Compare), nil
+}
+
+// Close the resolvers of the routes.
+func closeRoutes(routes *[MaxRoutes]*Route) {
+	for _, rr := range routes {
+		if rr == nil {
+			continue
+		}
+		if rr.resolver != nil {
+			rr.resolver.Close()
+		}
+		if rr.policy != nil {
+			rr.policy.other().Close()
+		}
+	}
+}
+
+// Get the resolver of the query name (name) by the dispatch policy, e.g.,
+// either side of the split if the route splits.
+func (rr *Route) resolverOf(name string) Resolver {
+	if rr.policy != nil {
+		return rr.policy.resolverOf(name)
+	}
+	return rr.resolver
+}
+
+// Get all the resolvers of the route, including the one of the policy.
+func (rr *Route) allResolvers() []Resolver {
+	var resolvers []Resolver
+	if rr.resolver != nil {
+		resolvers = append(resolvers, rr.resolver)
+	}
+	if rr.policy != nil {
+		resolvers = append(resolvers, rr.policy.other())
+	}
+	return resolvers
+}
+
+// Validate the router configs without creating the resolvers (hence no
+// goroutines or connections), e.g., to check the configs before applying.
+func ValidateRouterExport(re *RouterExport) error {
+	if ree := re.Resolver; ree != nil {
+		if err := ree.Validate(); err != nil {
+			return fmt.Errorf("invalid resolver: %w", err)
+		}
+	}
+	for i, route := range re.Routes {
+		if i >= MaxRoutes {
+			return ErrRouteIndexInvalid
+		}
+		if ree := route.Resolver; ree != nil {
+			if err := ree.Validate(); err != nil {
+				return fmt.Errorf("invalid route [%s] resolver: %w",
+					route.Name, err)
+			}
+		}
+		if _, _, err := route.ecsSubnet(); err != nil {
+			return fmt.Errorf("invalid route [%s]: %w", route.Name, err)
+		}
+		if _, _, err := route.blockConfig(); err != nil {
+			return fmt.Errorf("invalid route [%s]: %w", route.Name, err)
+		}
+		if _, err := route.cacheTTL(); err != nil {
+			return fmt.Errorf("invalid route [%s]: %w", route.Name, err)
+		}
+		if _, err := route.serverNames(); err != nil {
+			return fmt.Errorf("invalid route [%s]: %w", route.Name, err)
+		}
+		if err := route.policyConfig(); err != nil {
+			return fmt.Errorf("invalid route [%s]: %w", route.Name, err)
+		} else if route.Policy != RoutePolicyDefault && route.Resolver == nil {
+			return fmt.Errorf("invalid route [%s]: policy [%s] without the route resolver",
+				route.Name, route.Policy)
+		}
+	}
+	return nil
 }
 
 // Export the router configs for external interactions.
@@ -105,6 +562,24 @@ func (r *Router) Export() *RouterExport {
 		if rr.resolver != nil {
 			route.Resolver = rr.resolver.Export()
 		}
+		if rr.ecsSubnetV4.IsValid() {
+			route.ECSSubnetV4 = rr.ecsSubnetV4.String()
+		}
+		if rr.ecsSubnetV6.IsValid() {
+			route.ECSSubnetV6 = rr.ecsSubnetV6.String()
+		}
+		if rr.block {
+			route.Block = true
+			route.BlockText = rr.blockText
+		}
+		route.Drop = rr.drop
+		route.CacheTTLOverride = int(rr.cacheTTL.Seconds())
+		enabled := !rr.disabled
+		route.Enabled = &enabled
+		route.ServerNames = slices.Clone(rr.serverNames)
+		if rr.policy != nil {
+			rr.policy.export(route)
+		}
 		if rr.trie != nil {
 			zones := rr.trie.Export()
 			route.Zones = make([]string, 0, len(zones))
@@ -117,19 +592,125 @@ func (r *Router) Export() *RouterExport {
 	return re
 }
 
+// Collect the runtime statistics.
+func (r *Router) Stats() *RouterStats {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	rs := &RouterStats{}
+	if r.resolver != nil {
+		rs.Resolver = r.resolver.Stats()
+	}
+	for i, rr := range r.routes {
+		if rr == nil {
+			continue
+		}
+		route := &RouteStats{
+			Index: i,
+			Name:  rr.name,
+		}
+		if rr.resolver != nil {
+			route.Resolver = rr.resolver.Stats()
+		}
+		if rr.policy != nil {
+			rr.policy.stats(route)
+		}
+		rs.Routes = append(rs.Routes, route)
+	}
+	return rs
+}
+
+// Get the addresses of all the resolvers, e.g., to check against the listen
+// addresses.
+func (r *Router) resolverAddresses() []netip.AddrPort {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var addrs []netip.AddrPort
+	add := func(resolver Resolver) {
+		re := resolver.Export()
+		all := []string{re.Address}
+		for _, ra := range re.Addresses {
+			all = append(all, ra.Address)
+		}
+		for _, s := range all {
+			if ap, err := netip.ParseAddrPort(s); err == nil && !slices.Contains(addrs, ap) {
+				addrs = append(addrs, ap)
+			}
+		}
+	}
+	if r.resolver != nil {
+		add(r.resolver)
+	}
+	for _, rr := range r.routes {
+		if rr != nil {
+			for _, res := range rr.allResolvers() {
+				add(res)
+			}
+		}
+	}
+	return addrs
+}
+
+// Drain the idle upstream connections of all the resolvers, e.g., after a
+// known upstream restart, so that the subsequent queries use new ones.
+// Return the number of the closed connections.
+func (r *Router) Drain() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	n := 0
+	if r.resolver != nil {
+		n += r.resolver.Drain()
+	}
+	for _, rr := range r.routes {
+		if rr != nil {
+			for _, res := range rr.allResolvers() {
+				n += res.Drain()
+			}
+		}
+	}
+	log.Infof("drained %d upstream connections", n)
+	return n
+}
+
+// Summarize the router configs in one line for logging.
+func (r *Router) Summary() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	resolver := "(none)"
+	if r.resolver != nil {
+		re := r.resolver.Export()
+		resolver = fmt.Sprintf("%s (%s) %s", re.Name, re.Protocol, re.Address)
+	}
+	nroutes, nzones := 0, 0
+	for _, rr := range r.routes {
+		if rr == nil {
+			continue
+		}
+		nroutes++
+		if rr.trie != nil {
+			nzones += len(rr.trie.Export())
+		}
+	}
+	return fmt.Sprintf("resolver: %s; routes: %d; zones: %d",
+		resolver, nroutes, nzones)
+}
+
 // Set the default resolver.
 func (r *Router) SetResolver(re *ResolverExport) error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
-	res, err := NewResolverFromExport(re)
+	res, err := r.pool.get(re)
 	if err != nil {
 		log.Errorf("failed to create resolver: %+v, error: %v", re, err)
 		return err
 	}
 
 	if r.resolver != nil {
-		r.resolver.Close()
+		r.retire(r.resolver)
 	}
 
 	r.resolver = res
@@ -138,35 +719,144 @@ func (r *Router) SetResolver(re *ResolverExport) error {
 	return nil
 }
 
+// Probe the default resolver by querying the root NS, e.g., to check
+// whether it's reachable upon start.
+func (r *Router) ProbeResolver() error {
+	_, err := r.probe(".", dnsmessage.TypeNS)
+	return err
+}
+
+// Probe the default resolver by querying the A record of the name (name),
+// e.g., a canary domain as the self-test upon start, and return the rcode
+// of the response.
+func (r *Router) ProbeName(name string) (dnsmessage.RCode, error) {
+	return r.probe(name, dnsmessage.TypeA)
+}
+
+// Query the name (name) of the type (qtype) by the default resolver.
+func (r *Router) probe(name string, qtype dnsmessage.Type) (dnsmessage.RCode, error) {
+	r.lock.RLock()
+	resolver := r.resolver
+	release := func() {}
+	if pr, ok := resolver.(pinnableResolver); ok {
+		release = pr.pin()
+	}
+	r.lock.RUnlock()
+	defer release()
+
+	if resolver == nil {
+		return 0, errors.New("no default resolver")
+	}
+	return queryProbe(resolver, name, qtype)
+}
+
 // Set the index (index) route.
-// NOTE: re.Resolver and re.Zones may be empty to skip updating them.
+// NOTE: re.Resolver and re.Zones may be empty and re.Enabled may be nil to
+// skip updating them, while re.Block, re.BlockText, re.Drop,
+// re.CacheTTLOverride, re.ServerNames, re.Policy, re.Split and re.Compare
+// are always updated.
 func (r *Router) SetRoute(index int, re *RouteExport) error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
+	return r.setRoute(index, re)
+}
+
+// Update the route of the name (name) like SetRoute(), or create it at the
+// first free index if not exists, and return the index used.
+// NOTE: The name of re is ignored.
+func (r *Router) UpsertRouteByName(name string, re *RouteExport) (int, error) {
+	if name == "" {
+		return 0, errors.New("route name missing")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// NOTE: Index 0 is reserved, see MaxRoutes.
+	index := slices.IndexFunc(r.routes[1:], func(rr *Route) bool {
+		return rr != nil && rr.name == name
+	})
+	if index < 0 {
+		if index = slices.Index(r.routes[1:], nil); index < 0 {
+			return 0, fmt.Errorf("%w: route [%s]", ErrRoutesFull, name)
+		}
+	}
+	index++
+
+	c := *re
+	c.Name = name
+	if err := r.setRoute(index, &c); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
 
+// Set the index (index) route with the lock held.
+// The route is not created (or updated) upon error.
+func (r *Router) setRoute(index int, re *RouteExport) error {
 	if index <= 0 || index >= MaxRoutes {
 		return ErrRouteIndexInvalid
 	}
+	block, blockText, err := re.blockConfig()
+	if err != nil {
+		return err
+	}
+	cacheTTL, err := re.cacheTTL()
+	if err != nil {
+		return err
+	}
+	serverNames, err := re.serverNames()
+	if err != nil {
+		return err
+	}
+	if err := re.policyConfig(); err != nil {
+		return err
+	}
+	var res Resolver
+	if ree := re.Resolver; ree != nil {
+		if res, err = r.pool.get(ree); err != nil {
+			log.Errorf("failed to create resolver: %+v, error: %v", ree, err)
+			return err
+		}
+	}
+	a := res
+	if a == nil && r.routes[index] != nil {
+		a = r.routes[index].resolver
+	}
+	policy, err := r.newPolicy(re, a)
+	if err != nil {
+		log.Errorf("failed to create policy [%s], error: %v", re.Policy, err)
+		if res != nil {
+			res.Close()
+		}
+		return err
+	}
 
 	if r.routes[index] == nil {
-		r.routes[index] = &Route{}
+		r.routes[index] = &Route{trie: &dnstrie.DNSTrie{}}
 	}
 
 	route := r.routes[index]
 	if re.Name != "" {
 		route.name = re.Name
 	}
-	if ree := re.Resolver; ree != nil {
-		res, err := NewResolverFromExport(ree)
-		if err != nil {
-			log.Errorf("failed to create resolver: %+v, error: %v", ree, err)
-			return err
-		}
+	route.block, route.blockText = block, blockText
+	route.drop = re.Drop
+	route.cacheTTL = cacheTTL
+	if re.Enabled != nil {
+		route.disabled = !*re.Enabled
+	}
+	route.serverNames = serverNames
+	if res != nil {
 		if route.resolver != nil {
-			route.resolver.Close()
+			r.retire(route.resolver)
 		}
 		route.resolver = res
 	}
+	if route.policy != nil {
+		r.retire(route.policy.other())
+	}
+	route.policy = policy
 	if len(re.Zones) > 0 {
 		trie := &dnstrie.DNSTrie{}
 		for _, z := range re.Zones {
@@ -174,28 +864,303 @@ func (r *Router) SetRoute(index int, re *RouteExport) error {
 		}
 		route.trie = trie
 	}
+	warnShadowedZones(&r.routes, index)
 
 	return nil
 }
 
+// Replace all the routes at once, so that the queries never see a partial
+// set of them (unlike updating them one by one with SetRoute()).
+// The new routes (and resolvers) are created first without the lock, and
+// the old resolvers are retired (see retire()) after the swap.
+func (r *Router) ReplaceRoutes(routes []*RouteExport) error {
+	rrs, err := r.newRoutes(routes)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	old := r.routes
+	r.routes = rrs
+	r.lock.Unlock()
+
+	for _, rr := range old {
+		if rr != nil {
+			for _, res := range rr.allResolvers() {
+				r.retire(res)
+			}
+		}
+	}
+	log.Infof("replaced routes: %d", len(routes))
+	warnShadowedZones(&rrs, -1)
+	return nil
+}
+
+// Toggle the index (index) route between enabled and disabled, keeping its
+// configs, and return whether it's enabled now.
+func (r *Router) ToggleRoute(index int) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if index < 0 || index >= MaxRoutes {
+		return false, ErrRouteIndexInvalid
+	}
+	rr := r.routes[index]
+	if rr == nil {
+		return false, ErrRouteNotConfigured
+	}
+	rr.disabled = !rr.disabled
+	if rr.disabled {
+		log.Noticef("disabled route [%d] %s", index, rr.name)
+	} else {
+		log.Noticef("enabled route [%d] %s", index, rr.name)
+	}
+	return !rr.disabled, nil
+}
+
+// Resolvers that can be pinned for the duration of a query, see
+// resolverRef.pin().
+type pinnableResolver interface {
+	pin() func()
+}
+
 // Get the best-matched resolver for the query name.
 func (r *Router) GetResolver(name string) (Resolver, int) {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
+	return r.lookup(name, "")
+}
+
+// Get the best-matched resolver like GetResolver() but also considering the
+// routes limited to the server name (serverName; empty if none), and pin it
+// so that it's not closed (e.g., replaced by a reload) until the returned
+// function is called after the query.
+func (r *Router) PinResolver(name, serverName string) (Resolver, int, func()) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	resolver, index := r.lookup(name, serverName)
+	release := func() {}
+	if pr, ok := resolver.(pinnableResolver); ok {
+		release = pr.pin()
+	}
+	return resolver, index, release
+}
+
+func (r *Router) lookup(name, serverName string) (Resolver, int) {
+	// Make the lookup key once for all the routes, on stack unless the
+	// name is too long.  The zones are in the ASCII form, so convert the
+	// U-labels (if any) sent by the client.
+	var buf [256]byte
+	key := dnstrie.AppendKey(buf[:0], dnsmsg.ToASCII(name))
 
 	for i, rr := range r.routes {
-		if rr == nil {
+		if rr == nil || rr.disabled || !rr.matchServerName(serverName) {
 			continue
 		}
-		if _, ok := rr.trie.Match(name); ok {
-			return rr.resolver, i
+		if _, ok := rr.trie.MatchKey(key); ok {
+			return rr.resolverOf(name), i
 		}
 	}
 
 	return r.resolver, -1
 }
 
-// Close all resolvers.
+// Check whether the route applies to the queries via the server name
+// (serverName; empty if none).
+func (rr *Route) matchServerName(serverName string) bool {
+	return len(rr.serverNames) == 0 || slices.Contains(rr.serverNames, serverName)
+}
+
+// Get the static ECS subnets of the index (index) route, which are invalid
+// if not set (or not routed).
+func (r *Router) ecsSubnet(index int) (v4, v6 netip.Prefix) {
+	if index < 0 || index >= MaxRoutes {
+		return
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if rr := r.routes[index]; rr != nil {
+		v4, v6 = rr.ecsSubnetV4, rr.ecsSubnetV6
+	}
+	return
+}
+
+// Get the zone matching the name (name) and the EDE text of the index
+// (index) route if it blocks the queries.
+func (r *Router) blocked(index int, name string) (zone, text string, ok bool) {
+	if index < 0 || index >= MaxRoutes {
+		return
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if rr := r.routes[index]; rr != nil && rr.block {
+		zone, _, _ = rr.trie.MatchZone(dnsmsg.ToASCII(name))
+		text, ok = rr.blockText, true
+	}
+	return
+}
+
+// Get the cache TTL override of the index (index) route (0 if not set or
+// not routed).
+func (r *Router) cacheTTL(index int) time.Duration {
+	if index < 0 || index >= MaxRoutes {
+		return 0
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if rr := r.routes[index]; rr != nil {
+		return rr.cacheTTL
+	}
+	return 0
+}
+
+// Get the view of the queries via the server name (serverName) routed to
+// the index (index) route, i.e., the server name if the route is limited to
+// the server names, or empty if the route (or the default) is shared by all,
+// so that the responses of the different views are cached and coalesced
+// apart.
+func (r *Router) view(index int, serverName string) string {
+	if index < 0 || index >= MaxRoutes {
+		return ""
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if rr := r.routes[index]; rr != nil && len(rr.serverNames) > 0 {
+		return serverName
+	}
+	return ""
+}
+
+// Check whether the index (index) route drops the queries.
+func (r *Router) dropped(index int) bool {
+	if index < 0 || index >= MaxRoutes {
+		return false
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	rr := r.routes[index]
+	return rr != nil && rr.drop
+}
+
+// Dump the zone trie of the index (index) route for debugging.
+func (r *Router) DumpTrie(index int, w io.Writer) error {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if index < 0 || index >= MaxRoutes {
+		return ErrRouteIndexInvalid
+	}
+	rr := r.routes[index]
+	if rr == nil {
+		return ErrRouteNotConfigured
+	}
+
+	fmt.Fprintf(w, "route [%d] %s:\n", index, rr.name)
+	if rr.trie == nil {
+		fmt.Fprintf(w, "(empty)\n")
+		return nil
+	}
+	rr.trie.Dump(w)
+	return nil
+}
+
+// Get all the zones across the routes, each with the indexes of the routes
+// claiming it in order, so that the zones in multiple routes, where only
+// the first route matches, are visible.
+// The zones are normalized (see dnsmsg.NormalizeName()) to match each other.
+func (r *Router) AllZones() map[string][]int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	zones := make(map[string][]int)
+	for i, rr := range r.routes {
+		if rr == nil || rr.trie == nil {
+			continue
+		}
+		for z := range rr.trie.Export() {
+			z = dnsmsg.NormalizeName(z)
+			zones[z] = append(zones[z], i)
+		}
+	}
+	return zones
+}
+
+// Explain how the query (name and qtype) via the server name (serverName;
+// empty if none) is routed, i.e., the matched route and zone as well as the
+// chosen resolver, for troubleshooting.
+// NOTE: The query type doesn't affect the routing for now.
+func (r *Router) Explain(name string, qtype dnsmessage.Type, serverName string) *RouteMatch {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	m := &RouteMatch{
+		Name:  name,
+		Type:  qtype.String(),
+		Index: -1,
+	}
+	name = dnsmsg.ToASCII(name)
+	serverName = normalizeServerName(serverName)
+	resolver := r.resolver
+	for i, rr := range r.routes {
+		if rr == nil || rr.trie == nil || rr.disabled || !rr.matchServerName(serverName) {
+			continue
+		}
+		if zone, _, ok := rr.trie.MatchZone(name); ok {
+			m.Index = i
+			m.Route = rr.name
+			m.Zone = zone
+			m.Blocked = rr.block
+			m.Dropped = rr.drop
+			resolver = rr.resolverOf(name)
+			break
+		}
+	}
+	if resolver != nil {
+		m.Resolver = resolver.Export()
+	}
+	return m
+}
+
+// Set the grace period (seconds) before closing the replaced resolvers
+// (0 to close them at once).
+func (r *Router) SetCloseGrace(seconds int) error {
+	grace := time.Duration(seconds) * time.Second
+	if grace < 0 || grace > maxResolverCloseGrace {
+		return fmt.Errorf("invalid resolver close grace %d: out of range [0, %d]",
+			seconds, int(maxResolverCloseGrace.Seconds()))
+	}
+	r.closeGrace.Store(int64(grace))
+	return nil
+}
+
+// Close the replaced resolver (res) after the grace period, so that it
+// keeps serving the queries in flight or just routed to it meanwhile for a
+// smooth handover; or at once if no grace period.
+func (r *Router) retire(res Resolver) {
+	grace := time.Duration(r.closeGrace.Load())
+	if grace <= 0 {
+		res.Close()
+		return
+	}
+
+	r.retiredLock.Lock()
+	defer r.retiredLock.Unlock()
+	if r.retired == nil {
+		r.retired = make(map[Resolver]*time.Timer)
+	}
+	r.retired[res] = time.AfterFunc(grace, func() {
+		r.retiredLock.Lock()
+		_, ok := r.retired[res]
+		delete(r.retired, res)
+		r.retiredLock.Unlock()
+		if ok {
+			res.Close()
+		}
+	})
+}
+
+// Close all resolvers, including the retired ones pending close.
 func (r *Router) Close() {
 	r.lock.Lock()
 	defer r.lock.Unlock()
@@ -203,10 +1168,14 @@ func (r *Router) Close() {
 	if r.resolver != nil {
 		r.resolver.Close()
 	}
+	closeRoutes(&r.routes)
 
-	for _, rr := range r.routes {
-		if rr != nil && rr.resolver != nil {
-			rr.resolver.Close()
-		}
+	r.retiredLock.Lock()
+	retired := r.retired
+	r.retired = nil
+	r.retiredLock.Unlock()
+	for res, timer := range retired {
+		timer.Stop()
+		res.Close()
 	}
 }
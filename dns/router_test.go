@@ -0,0 +1,538 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Resolver routing - tests
+//
+
+package dns
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/util/dnstrie"
+)
+
+func TestRouterExplain(t *testing.T) {
+	r := &Router{resolver: &staticResolver{}}
+	r.routes[1] = &Route{
+		name:     "lan",
+		resolver: &staticResolver{},
+		trie:     &dnstrie.DNSTrie{},
+	}
+	r.routes[1].trie.AddZone("Home.example", struct{}{})
+	r.routes[2] = &Route{name: "empty"} // no zones yet
+
+	m := r.Explain("www.home.example.", dnsmessage.TypeAAAA, "")
+	if m.Index != 1 || m.Route != "lan" || m.Zone != "Home.example" ||
+		m.Type != "TypeAAAA" || m.Resolver == nil {
+		t.Errorf(`Explain() = %+v; want route [1] lan with zone Home.example`, m)
+	}
+
+	// U-labels from the client match the A-labels in the zones.
+	r.routes[1].trie.AddZone("xn--bcher-kva.example", struct{}{})
+	m = r.Explain("www.Bücher.example.", dnsmessage.TypeA, "")
+	if m.Index != 1 || m.Zone != "xn--bcher-kva.example" || m.Name != "www.Bücher.example." {
+		t.Errorf(`Explain() = %+v; want route [1] with zone xn--bcher-kva.example`, m)
+	}
+	if _, index := r.GetResolver("www.bücher.example."); index != 1 {
+		t.Errorf(`GetResolver() index = %d; want 1`, index)
+	}
+
+	m = r.Explain("www.example.com.", dnsmessage.TypeA, "")
+	if m.Index != -1 || m.Route != "" || m.Zone != "" || m.Resolver == nil {
+		t.Errorf(`Explain() = %+v; want the default resolver`, m)
+	}
+
+	r.resolver = nil
+	if m = r.Explain("www.example.com.", dnsmessage.TypeA, ""); m.Resolver != nil {
+		t.Errorf(`Explain() = %+v; want no resolver`, m)
+	}
+}
+
+func TestRouterAllZones(t *testing.T) {
+	r := &Router{}
+	if zones := r.AllZones(); len(zones) != 0 {
+		t.Errorf(`AllZones() = %v; want empty`, zones)
+	}
+
+	for i, zones := range [][]string{
+		{"example.com", "=apex.example"},
+		nil, // not configured
+		{"Example.COM.", "**.corp.example"},
+		{}, // no zones yet
+		{"example.com", "corp.example"},
+	} {
+		if zones == nil {
+			continue
+		}
+		r.routes[i] = &Route{name: strconv.Itoa(i)}
+		if len(zones) > 0 {
+			r.routes[i].trie = &dnstrie.DNSTrie{}
+		}
+		for _, z := range zones {
+			r.routes[i].trie.AddZone(z, struct{}{})
+		}
+	}
+
+	want := map[string][]int{
+		"example.com":     {0, 2, 4},
+		"=apex.example":   {0},
+		"**.corp.example": {2},
+		"corp.example":    {4},
+	}
+	if zones := r.AllZones(); !maps.EqualFunc(zones, want, slices.Equal) {
+		t.Errorf(`AllZones() = %v; want %v`, zones, want)
+	}
+}
+
+func TestFindShadowedZones(t *testing.T) {
+	var routes [MaxRoutes]*Route
+	for i, zones := range [][]string{
+		// Exceptions of the later zones: not shadowing them.
+		{"www.corp.example", "=apex.example", "*.sub.example"},
+		{"corp.example", "apex.example", "**.sub.example"},
+		{"a.corp.example", "apex.example", "x.sub.example", "=sub.example"},
+		nil,
+		{"*.Apex.Example", "other.example", "**.corp.example"},
+	} {
+		if zones == nil {
+			continue
+		}
+		routes[i] = &Route{name: strconv.Itoa(i), trie: &dnstrie.DNSTrie{}}
+		for _, z := range zones {
+			routes[i].trie.AddZone(z, struct{}{})
+		}
+	}
+
+	want := []shadowedZone{
+		{"a.corp.example", 2, "corp.example", 1},
+		{"apex.example", 2, "apex.example", 1},
+		{"x.sub.example", 2, "**.sub.example", 1},
+		{"*.Apex.Example", 4, "apex.example", 1},
+		{"**.corp.example", 4, "corp.example", 1},
+	}
+	cmp := func(a, b shadowedZone) int {
+		return cmp.Or(a.index-b.index, strings.Compare(a.zone, b.zone))
+	}
+	slices.SortFunc(want, cmp)
+	got := findShadowedZones(&routes, -1)
+	slices.SortFunc(got, cmp)
+	if !slices.Equal(got, want) {
+		t.Errorf(`findShadowedZones() = %+v; want %+v`, got, want)
+	}
+
+	// Only the overlaps involving the route [4].
+	got = findShadowedZones(&routes, 4)
+	if len(got) != 2 || got[0].index != 4 || got[1].index != 4 {
+		t.Errorf(`findShadowedZones(4) = %+v; want 2 of route [4]`, got)
+	}
+}
+
+// Resolver recording whether it's closed.
+type closeRecordingResolver struct {
+	staticResolver
+	closed bool
+}
+
+func (r *closeRecordingResolver) Close() { r.closed = true }
+
+func TestRouterReplaceRoutes(t *testing.T) {
+	old := &closeRecordingResolver{}
+	r := &Router{}
+	r.routes[0] = &Route{name: "old", resolver: old, trie: &dnstrie.DNSTrie{}}
+	r.routes[0].trie.AddZone("old.example", struct{}{})
+
+	// Failure: the old routes are kept.
+	err := r.ReplaceRoutes([]*RouteExport{
+		{Name: "lan", Resolver: &ResolverExport{Address: "127.0.0.1:53"}},
+		{Name: "bad", Resolver: &ResolverExport{Address: "invalid"}},
+	})
+	if err == nil {
+		t.Fatalf(`ReplaceRoutes() = nil; want error`)
+	}
+	if res, i := r.GetResolver("www.old.example."); res != old || i != 0 || old.closed {
+		t.Errorf(`GetResolver() = (%v, %d); want the old route`, res, i)
+	}
+
+	err = r.ReplaceRoutes([]*RouteExport{
+		{
+			Name:     "lan",
+			Resolver: &ResolverExport{Protocol: ResolverProtocolUDP, Address: "127.0.0.1:53"},
+			Zones:    []string{"home.example"},
+		},
+	})
+	if err != nil {
+		t.Fatalf(`ReplaceRoutes() = %v; want nil`, err)
+	}
+	defer r.Close()
+	if !old.closed {
+		t.Errorf(`old resolver not closed`)
+	}
+	if res, i := r.GetResolver("www.home.example."); res == nil || i != 0 {
+		t.Errorf(`GetResolver() = (%v, %d); want route [0]`, res, i)
+	}
+	if res, i := r.GetResolver("www.old.example."); res != nil || i != -1 {
+		t.Errorf(`GetResolver() = (%v, %d); want the default`, res, i)
+	}
+
+	if err := r.ReplaceRoutes(make([]*RouteExport, MaxRoutes+1)); err != ErrRouteIndexInvalid {
+		t.Errorf(`ReplaceRoutes() = %v; want %v`, err, ErrRouteIndexInvalid)
+	}
+}
+
+func TestRouterProbeName(t *testing.T) {
+	r := &Router{}
+	if _, err := r.ProbeName("example.com"); err == nil {
+		t.Errorf(`ProbeName() = nil; want error without resolver`)
+	}
+
+	resolver := &answeringResolver{}
+	r.resolver = resolver
+	if rcode, err := r.ProbeName("example.com"); err != nil || rcode != dnsmessage.RCodeSuccess {
+		t.Errorf(`ProbeName() = (%v, %v); want success`, rcode, err)
+	}
+	if n := resolver.queries.Load(); n != 1 {
+		t.Errorf(`upstream queries = %d; want 1`, n)
+	}
+	if _, err := r.ProbeName("bad..name"); err == nil {
+		t.Errorf(`ProbeName(bad..name) = nil; want error`)
+	}
+
+	query := newTestQuery(t, "example.com.", dnsmessage.TypeA)
+	r.resolver = &staticResolver{
+		response: newTestResponse(t, query, dnsmessage.RCodeServerFailure, nil, nil),
+	}
+	if rcode, err := r.ProbeName("example.com."); err != nil || rcode != dnsmessage.RCodeServerFailure {
+		t.Errorf(`ProbeName() = (%v, %v); want SERVFAIL`, rcode, err)
+	}
+	r.resolver = &staticResolver{response: query} // not a response
+	if _, err := r.ProbeName("example.com."); err == nil {
+		t.Errorf(`ProbeName() = nil; want error of not a response`)
+	}
+}
+
+func TestRouterDisabledRoute(t *testing.T) {
+	lan := &staticResolver{}
+	r := &Router{resolver: &staticResolver{}}
+	disabled := false
+	rrs, err := r.newRoutes([]*RouteExport{
+		{Name: "lan", Zones: []string{"home.example"}, Enabled: &disabled},
+	})
+	if err != nil {
+		t.Fatalf(`newRoutes() = %v; want nil`, err)
+	}
+	r.routes = rrs
+	r.routes[0].resolver = lan
+
+	// Disabled: matching the default resolver.
+	if res, i := r.GetResolver("www.home.example."); res == lan || i != -1 {
+		t.Errorf(`GetResolver() = (%v, %d); want the default of disabled route`, res, i)
+	}
+	if m := r.Explain("www.home.example.", dnsmessage.TypeA, ""); m.Index != -1 || m.Zone != "" {
+		t.Errorf(`Explain() = %+v; want the default of disabled route`, m)
+	}
+	if zones := r.AllZones(); len(zones["home.example"]) != 1 {
+		t.Errorf(`AllZones() = %v; want the zones of disabled route kept`, zones)
+	}
+
+	if enabled, err := r.ToggleRoute(0); err != nil || !enabled {
+		t.Fatalf(`ToggleRoute(0) = (%t, %v); want enabled`, enabled, err)
+	}
+	if res, i := r.GetResolver("www.home.example."); res != lan || i != 0 {
+		t.Errorf(`GetResolver() = (%v, %d); want route [0]`, res, i)
+	}
+	if enabled, err := r.ToggleRoute(0); err != nil || enabled {
+		t.Fatalf(`ToggleRoute(0) = (%t, %v); want disabled`, enabled, err)
+	}
+	if _, i := r.GetResolver("www.home.example."); i != -1 {
+		t.Errorf(`GetResolver() index = %d; want -1 of disabled route`, i)
+	}
+
+	// Enabled by default upon set.
+	if err := r.SetRoute(1, &RouteExport{Name: "wan", Zones: []string{"example.net"}}); err != nil {
+		t.Fatalf(`SetRoute() = %v; want nil`, err)
+	}
+	if _, i := r.GetResolver("www.example.net."); i != 1 {
+		t.Errorf(`GetResolver() index = %d; want 1 of enabled route`, i)
+	}
+
+	if _, err := r.ToggleRoute(2); err != ErrRouteNotConfigured {
+		t.Errorf(`ToggleRoute(2) = %v; want %v`, err, ErrRouteNotConfigured)
+	}
+	if _, err := r.ToggleRoute(MaxRoutes); err != ErrRouteIndexInvalid {
+		t.Errorf(`ToggleRoute(%d) = %v; want %v`, MaxRoutes, err, ErrRouteIndexInvalid)
+	}
+}
+
+func TestRouterSetRouteUpdate(t *testing.T) {
+	r := &Router{resolver: &staticResolver{}}
+	defer r.Close()
+	disabled := false
+	err := r.SetRoute(1, &RouteExport{
+		Name:    "ads",
+		Zones:   []string{"ads.example"},
+		Block:   true,
+		Enabled: &disabled,
+	})
+	if err != nil {
+		t.Fatalf(`SetRoute() = %v; want nil`, err)
+	}
+
+	// Updating the zones without Enabled keeps the route disabled.
+	if err := r.SetRoute(1, &RouteExport{Zones: []string{"ads.example.net"}, Block: true}); err != nil {
+		t.Fatalf(`SetRoute() = %v; want nil`, err)
+	}
+	if rr := r.routes[1]; !rr.disabled || !rr.block {
+		t.Errorf(`route [1] (disabled, block) = (%t, %t); want (true, true)`, rr.disabled, rr.block)
+	}
+	if _, i := r.GetResolver("www.ads.example.net."); i != -1 {
+		t.Errorf(`GetResolver() index = %d; want -1 of disabled route`, i)
+	}
+
+	// Unblocked and enabled.
+	enabled := true
+	if err := r.SetRoute(1, &RouteExport{Enabled: &enabled}); err != nil {
+		t.Fatalf(`SetRoute() = %v; want nil`, err)
+	}
+	if rr := r.routes[1]; rr.disabled || rr.block || rr.blockText != "" {
+		t.Errorf(`route [1] (disabled, block) = (%t, %t); want (false, false)`, rr.disabled, rr.block)
+	}
+	if _, i := r.GetResolver("www.ads.example.net."); i != 1 {
+		t.Errorf(`GetResolver() index = %d; want 1 of unblocked route`, i)
+	}
+}
+
+// Resolver failing the queries after closed.
+type closingResolver struct {
+	staticResolver
+	closed atomic.Bool
+}
+
+func (r *closingResolver) Close() { r.closed.Store(true) }
+
+func (r *closingResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	if r.closed.Load() {
+		return nil, errors.New("resolver closed")
+	}
+	return r.staticResolver.Query(ctx, msg, isUDP)
+}
+
+func TestRouterCloseGrace(t *testing.T) {
+	r := &Router{}
+	for _, seconds := range []int{-1, int(maxResolverCloseGrace.Seconds()) + 1} {
+		if err := r.SetCloseGrace(seconds); err == nil {
+			t.Errorf(`SetCloseGrace(%d) = nil; want error`, seconds)
+		}
+	}
+	if err := r.SetCloseGrace(1); err != nil {
+		t.Fatalf(`SetCloseGrace(1) = %v; want nil`, err)
+	}
+	grace := 200 * time.Millisecond
+	r.closeGrace.Store(int64(grace))
+
+	// Reload under load: the queries routed to the old resolver (e.g.,
+	// just before the reload) keep working within the grace period.
+	old := &closingResolver{}
+	r.resolver = old
+	var (
+		wg       sync.WaitGroup
+		stop     atomic.Bool
+		queries  atomic.Int32
+		failures atomic.Int32
+	)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				res, _ := r.GetResolver("www.example.com.")
+				time.Sleep(time.Millisecond) // in flight
+				if res != old {
+					continue
+				}
+				queries.Add(1)
+				if _, err := res.Query(context.Background(), nil, true); err != nil {
+					failures.Add(1)
+				}
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	re := &ResolverExport{Protocol: ResolverProtocolUDP, Address: "127.0.0.1:53"}
+	if err := r.SetResolver(re); err != nil {
+		t.Fatalf(`SetResolver() = %v; want nil`, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	stop.Store(true)
+	wg.Wait()
+	if queries.Load() == 0 || failures.Load() != 0 {
+		t.Errorf(`queries to old resolver = %d, failures = %d; want none failed`,
+			queries.Load(), failures.Load())
+	}
+	if old.closed.Load() {
+		t.Errorf(`old resolver closed within grace period`)
+	}
+	for deadline := time.Now().Add(5 * grace); !old.closed.Load(); {
+		if time.Now().After(deadline) {
+			t.Fatalf(`old resolver not closed after grace period`)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The pending ones are closed at once upon Close().
+	old = &closingResolver{}
+	r.routes[1] = &Route{name: "lan", resolver: old, trie: &dnstrie.DNSTrie{}}
+	if err := r.SetRoute(1, &RouteExport{Resolver: re}); err != nil {
+		t.Fatalf(`SetRoute() = %v; want nil`, err)
+	}
+	if old.closed.Load() {
+		t.Errorf(`old route resolver closed within grace period`)
+	}
+	r.Close()
+	if !old.closed.Load() {
+		t.Errorf(`old route resolver not closed upon Close()`)
+	}
+
+	// No grace period.
+	r = &Router{}
+	old = &closingResolver{}
+	r.resolver = old
+	if err := r.SetResolver(re); err != nil {
+		t.Fatalf(`SetResolver() = %v; want nil`, err)
+	}
+	defer r.Close()
+	if !old.closed.Load() {
+		t.Errorf(`old resolver not closed at once without grace period`)
+	}
+}
+
+func TestRouterUpsertRouteByName(t *testing.T) {
+	r := &Router{}
+	r.routes[1] = &Route{name: "lan", trie: &dnstrie.DNSTrie{}}
+	r.routes[1].trie.AddZone("home.example", struct{}{})
+
+	// Create at the first free index.
+	index, err := r.UpsertRouteByName("wan", &RouteExport{Name: "ignored", Zones: []string{"example.net"}})
+	if err != nil || index != 2 {
+		t.Fatalf(`UpsertRouteByName(wan) = (%d, %v); want (2, nil)`, index, err)
+	}
+	if rr := r.routes[2]; rr.name != "wan" {
+		t.Errorf(`route [2] name = %q; want wan`, rr.name)
+	}
+	if _, i := r.GetResolver("www.example.net."); i != 2 {
+		t.Errorf(`GetResolver() index = %d; want 2`, i)
+	}
+	// Created without zones: matching nothing.
+	if index, err := r.UpsertRouteByName("empty", &RouteExport{}); err != nil || index != 3 {
+		t.Fatalf(`UpsertRouteByName(empty) = (%d, %v); want (3, nil)`, index, err)
+	}
+	if _, i := r.GetResolver("www.example.org."); i != -1 {
+		t.Errorf(`GetResolver() index = %d; want -1`, i)
+	}
+
+	// Update the existing one, keeping its zones.
+	index, err = r.UpsertRouteByName("lan", &RouteExport{Block: true})
+	if err != nil || index != 1 {
+		t.Fatalf(`UpsertRouteByName(lan) = (%d, %v); want (1, nil)`, index, err)
+	}
+	if m := r.Explain("www.home.example.", dnsmessage.TypeA, ""); m.Index != 1 || !m.Blocked {
+		t.Errorf(`Explain() = %+v; want blocked route [1]`, m)
+	}
+
+	// Failure: not created.
+	bad := &RouteExport{Resolver: &ResolverExport{Address: "invalid"}}
+	if _, err := r.UpsertRouteByName("bad", bad); err == nil {
+		t.Errorf(`UpsertRouteByName(bad) = nil; want error`)
+	}
+	if r.routes[4] != nil {
+		t.Errorf(`route [4] = %+v; want not created upon error`, r.routes[4])
+	}
+	if _, err := r.UpsertRouteByName("", &RouteExport{}); err == nil {
+		t.Errorf(`UpsertRouteByName("") = nil; want error`)
+	}
+
+	// Full.
+	for i := 4; i < MaxRoutes; i++ {
+		if _, err := r.UpsertRouteByName("r"+strconv.Itoa(i), &RouteExport{}); err != nil {
+			t.Fatalf(`UpsertRouteByName(r%d) = %v; want nil`, i, err)
+		}
+	}
+	if _, err := r.UpsertRouteByName("more", &RouteExport{}); !errors.Is(err, ErrRoutesFull) {
+		t.Errorf(`UpsertRouteByName(more) = %v; want %v`, err, ErrRoutesFull)
+	}
+	if index, err := r.UpsertRouteByName("wan", &RouteExport{}); err != nil || index != 2 {
+		t.Errorf(`UpsertRouteByName(wan) when full = (%d, %v); want (2, nil)`, index, err)
+	}
+}
+
+func TestRouterServerNames(t *testing.T) {
+	kids, open, all := &staticResolver{}, &staticResolver{}, &staticResolver{}
+	r := &Router{resolver: &staticResolver{}}
+	rrs, err := r.newRoutes([]*RouteExport{
+		{Name: "kids", Zones: []string{"adult.example"}, ServerNames: []string{"Kids.DNS.example."}},
+		{Name: "open", Zones: []string{"example.com"}, ServerNames: []string{"open.dns.example"}},
+		{Name: "all", Zones: []string{"example.com"}},
+	})
+	if err != nil {
+		t.Fatalf(`newRoutes() = %v; want nil`, err)
+	}
+	r.routes = rrs
+	r.routes[0].resolver, r.routes[1].resolver, r.routes[2].resolver = kids, open, all
+
+	tests := []struct {
+		name       string
+		serverName string
+		resolver   Resolver
+		index      int
+	}{
+		{"www.adult.example.", "kids.dns.example", kids, 0},
+		{"www.adult.example.", "open.dns.example", r.resolver, -1},
+		{"www.adult.example.", "", r.resolver, -1},
+		{"www.example.com.", "open.dns.example", open, 1},
+		{"www.example.com.", "kids.dns.example", all, 2},
+		{"www.example.com.", "", all, 2},
+	}
+	for _, tc := range tests {
+		res, i, release := r.PinResolver(tc.name, tc.serverName)
+		release()
+		if res != tc.resolver || i != tc.index {
+			t.Errorf(`PinResolver(%s, %q) = (%v, %d); want (%v, %d)`,
+				tc.name, tc.serverName, res, i, tc.resolver, tc.index)
+		}
+		if m := r.Explain(tc.name, dnsmessage.TypeA, tc.serverName); m.Index != tc.index {
+			t.Errorf(`Explain(%s, %q) = %+v; want route [%d]`, tc.name, tc.serverName, m, tc.index)
+		}
+	}
+	if m := r.Explain("www.adult.example.", dnsmessage.TypeA, "Kids.DNS.example."); m.Index != 0 {
+		t.Errorf(`Explain() = %+v; want route [0] of the normalized server name`, m)
+	}
+
+	if err := r.SetRoute(1, &RouteExport{ServerNames: []string{"kids.dns.example"}}); err != nil {
+		t.Fatalf(`SetRoute() = %v; want nil`, err)
+	}
+	if _, i := r.lookup("www.example.com.", "kids.dns.example"); i != 1 {
+		t.Errorf(`lookup() index = %d; want 1 with server names updated`, i)
+	}
+
+	for _, names := range [][]string{{""}, {"."}} {
+		if _, err := r.newRoutes([]*RouteExport{{Name: "x", ServerNames: names}}); err == nil {
+			t.Errorf(`newRoutes(server names %q) = nil; want error`, names)
+		}
+		if err := r.SetRoute(1, &RouteExport{ServerNames: names}); err == nil {
+			t.Errorf(`SetRoute(server names %q) = nil; want error`, names)
+		}
+	}
+}
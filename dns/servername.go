@@ -0,0 +1,37 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Server name (SNI) that the client used to reach the DoT/DoH listener,
+// carried in the context to select the routes of the views.
+//
+
+package dns
+
+import (
+	"context"
+	"strings"
+)
+
+type serverNameKey struct{}
+
+// Tag the context with the server name (name; normalized), if any.
+func withServerName(ctx context.Context, name string) context.Context {
+	if name = normalizeServerName(name); name == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, serverNameKey{}, name)
+}
+
+// Get the server name of the context; empty if not over TLS or without
+// the SNI.
+func serverNameFrom(ctx context.Context) string {
+	name, _ := ctx.Value(serverNameKey{}).(string)
+	return name
+}
+
+// Normalize the server name, i.e., lower-cased and without the trailing
+// dot, which are insignificant to the SNI.
+func normalizeServerName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,96 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Coalescing of the identical in-flight upstream queries.
+//
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+)
+
+// In-flight upstream query shared by the identical queries.
+type flightCall struct {
+	done chan struct{}
+	resp []byte
+	err  error
+	dups int // number of the queries waiting for it
+}
+
+// Group of the in-flight upstream queries, so that the identical queries
+// (e.g., a burst of clients asking for the same name upon its expiry) are
+// sent upstream only once and share the response.
+type flightGroup struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+// Query the message (msg) by the function (query), or wait for the
+// in-flight one of the identical message, i.e., only differing in the ID,
+// in the same view (view; see Router.view()).
+// Return the response with the ID of the message, and whether it's shared
+// from the other query.
+// NOTE: If the in-flight query is canceled (e.g., by its client) while this
+// one is not, it's queried again by itself.
+func (g *flightGroup) do(ctx context.Context, msg []byte, view string, isUDP bool,
+	query func(ctx context.Context) ([]byte, error)) ([]byte, bool, error) {
+	if len(msg) < 2 {
+		resp, err := query(ctx)
+		return resp, false, err
+	}
+	// NOTE: UDP responses may be truncated and thus not shared with TCP.
+	proto := "t"
+	if isUDP {
+		proto = "u"
+	}
+	// NOTE: The server name of the view never contains NUL.
+	key := proto + view + "\x00" + string(msg[2:])
+
+	g.lock.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		c.dups++
+		g.lock.Unlock()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if errors.Is(c.err, context.Canceled) && ctx.Err() == nil {
+			resp, err := query(ctx)
+			return resp, false, err
+		}
+		if c.err != nil {
+			return nil, true, c.err
+		}
+		resp := slices.Clone(c.resp)
+		if len(resp) >= 2 {
+			copy(resp, msg[:2]) // restore the query ID
+		}
+		return resp, true, nil
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.lock.Unlock()
+
+	c.resp, c.err = query(ctx)
+
+	g.lock.Lock()
+	delete(g.calls, key)
+	dups := c.dups
+	g.lock.Unlock()
+	close(c.done)
+
+	if dups > 0 && c.err == nil {
+		// The caller may modify the response while the others copy it.
+		return slices.Clone(c.resp), false, nil
+	}
+	return c.resp, false, c.err
+}
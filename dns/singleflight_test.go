@@ -0,0 +1,201 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Coalescing of the in-flight upstream queries - tests
+//
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+)
+
+// Make a copy of the message (msg) with the ID (id).
+func withID(msg []byte, id uint16) []byte {
+	m := slices.Clone(msg)
+	binary.BigEndian.PutUint16(m, id)
+	return m
+}
+
+// Wait until the key of the message is in flight.
+func waitInFlight(t *testing.T, g *flightGroup, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		g.lock.Lock()
+		dups := -1
+		for _, c := range g.calls {
+			dups = c.dups
+		}
+		g.lock.Unlock()
+		if dups >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d queries in flight", n)
+}
+
+func TestFlightGroup(t *testing.T) {
+	var g flightGroup
+	msg := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	release := make(chan struct{})
+	var queries atomic.Int32
+	query := func(m []byte) func(context.Context) ([]byte, error) {
+		return func(ctx context.Context) ([]byte, error) {
+			queries.Add(1)
+			<-release
+			return slices.Clone(m), nil // echo
+		}
+	}
+
+	const n = 5
+	var wg sync.WaitGroup
+	results := make([][]byte, n)
+	shared := make([]bool, n)
+	for i := range n {
+		if i == 1 {
+			waitInFlight(t, &g, 0)
+		}
+		m := withID(msg, uint16(i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, sh, err := g.do(context.Background(), m, "", false, query(m))
+			if err != nil {
+				t.Errorf(`[%d] do() = %v; want nil`, i, err)
+			}
+			results[i], shared[i] = resp, sh
+		}()
+	}
+	waitInFlight(t, &g, n-1)
+	close(release)
+	wg.Wait()
+
+	if q := queries.Load(); q != 1 {
+		t.Errorf(`queries = %d; want 1`, q)
+	}
+	for i := range n {
+		if !slices.Equal(results[i], withID(msg, uint16(i))) {
+			t.Errorf(`[%d] response = %v; want with ID %d`, i, results[i], i)
+		}
+		if shared[i] != (i > 0) {
+			t.Errorf(`[%d] shared = %v; want %v`, i, shared[i], i > 0)
+		}
+	}
+	if len(g.calls) != 0 {
+		t.Errorf(`calls = %v; want empty`, g.calls)
+	}
+
+	// Not shared between UDP and TCP
+	queries.Store(0)
+	release = make(chan struct{})
+	close(release)
+	g.do(context.Background(), msg, "", true, query(msg))
+	g.do(context.Background(), msg, "", false, query(msg))
+	if q := queries.Load(); q != 2 {
+		t.Errorf(`queries = %d; want 2`, q)
+	}
+}
+
+func TestFlightGroupCanceled(t *testing.T) {
+	var g flightGroup
+	msg := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	var queries atomic.Int32
+	query := func(ctx context.Context) ([]byte, error) {
+		if queries.Add(1) == 1 {
+			<-ctx.Done() // the first one blocks until canceled
+			return nil, ctx.Err()
+		}
+		return msg, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, _, err := g.do(ctx, msg, "", false, query); err != context.Canceled {
+			t.Errorf(`do() = %v; want canceled`, err)
+		}
+	}()
+	waitInFlight(t, &g, 0)
+
+	// The waiting one queries by itself once the in-flight one is canceled.
+	result := make(chan error)
+	go func() {
+		resp, shared, err := g.do(context.Background(), withID(msg, 2), "", false, query)
+		if err == nil && (shared || !slices.Equal(resp, msg)) {
+			t.Errorf(`do() = (%v, %v); want own response`, resp, shared)
+		}
+		result <- err
+	}()
+	waitInFlight(t, &g, 1)
+	cancel()
+	<-done
+	if err := <-result; err != nil {
+		t.Errorf(`do() = %v; want nil`, err)
+	}
+	if q := queries.Load(); q != 2 {
+		t.Errorf(`queries = %d; want 2`, q)
+	}
+}
+
+// Resolver answering after released.
+type gatedResolver struct {
+	answeringResolver
+	release chan struct{}
+}
+
+func (r *gatedResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	<-r.release
+	return r.answeringResolver.Query(ctx, msg, isUDP)
+}
+
+func TestHandleQueryCoalesced(t *testing.T) {
+	resolver := &gatedResolver{release: make(chan struct{})}
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = resolver
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+
+	const n = 4
+	var wg sync.WaitGroup
+	for i := range n {
+		q := withID(query, uint16(100+i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := f.handleQuery(context.Background(), q, netip.Addr{}, false)
+			if err != nil || binary.BigEndian.Uint16(resp) != uint16(100+i) {
+				t.Errorf(`handleQuery() = (%v, %v); want response with ID %d`, resp, err, 100+i)
+			}
+		}()
+		if i == 0 {
+			waitInFlight(t, &f.flights, 0)
+		}
+	}
+	waitInFlight(t, &f.flights, n-1)
+	close(resolver.release)
+	wg.Wait()
+
+	if q := resolver.queries.Load(); q != 1 {
+		t.Errorf(`upstream queries = %d; want 1`, q)
+	}
+	want := DedupStats{Upstream: 1, Coalesced: n - 1}
+	ds := f.Stats().Dedup
+	if ds.Upstream != want.Upstream || ds.Coalesced != want.Coalesced || len(ds.Routes) != 1 ||
+		*ds.Routes[0] != (RouteDedupStats{Index: -1, Upstream: 1, Coalesced: n - 1}) {
+		t.Errorf(`Dedup = %+v; want %+v for the default route`, ds, want)
+	}
+}
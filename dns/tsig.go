@@ -0,0 +1,393 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Transaction signature (TSIG; RFC 8945) of the queries to the upstreams
+// requiring the authentication.
+//
+
+package dns
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/log"
+	"kexuedns/util/dnsmsg"
+)
+
+const (
+	defaultTSIGAlgorithm = "hmac-sha256"
+	// Allowed clock skew (seconds) between the signer and verifier,
+	// as recommended by RFC 8945, Section 10.
+	tsigFudge = 300
+
+	tsigType     = dnsmessage.Type(250)
+	tsigClassANY = dnsmessage.Class(255)
+
+	// TSIG error codes (RFC 8945, Section 5.2)
+	tsigBadSig  = 16
+	tsigBadKey  = 17
+	tsigBadTime = 18
+)
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha256": sha256.New,
+	"hmac-sha384": sha512.New384,
+	"hmac-sha512": sha512.New,
+}
+
+var errTSIGUnsigned = errors.New("response not signed by TSIG")
+
+// TSIG key shared with the upstream.
+type tsigKey struct {
+	name      string // in lower case without the final dot
+	algorithm string // e.g., "hmac-sha256"
+	secret    []byte
+	newHash   func() hash.Hash
+}
+
+// Create the TSIG key of the name, algorithm and secret (base64).
+func newTSIGKey(name, algorithm, secret string) (*tsigKey, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if _, err := dnsmessage.NewName(name + "."); err != nil || name == "" {
+		return nil, fmt.Errorf("invalid key name: %s", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return nil, fmt.Errorf("invalid key name: %s", name)
+		}
+	}
+	algorithm = strings.ToLower(strings.TrimSuffix(algorithm, "."))
+	newHash, ok := tsigAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm: %s", algorithm)
+	}
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret: %w", err)
+	}
+	if len(key) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	return &tsigKey{
+		name:      name,
+		algorithm: algorithm,
+		secret:    key,
+		newHash:   newHash,
+	}, nil
+}
+
+// Validate the TSIG key if configured, which requires the key name and
+// secret, with the algorithm defaulting to HMAC-SHA256.
+func (re *ResolverExport) validateTSIG() error {
+	if re.TSIGKeyName == "" {
+		if re.TSIGAlgorithm != "" || re.TSIGSecret != "" {
+			log.Errorf("TSIG key name missing")
+			return fmt.Errorf("TSIG key name missing")
+		}
+		return nil
+	}
+	if re.TSIGAlgorithm == "" {
+		re.TSIGAlgorithm = defaultTSIGAlgorithm
+	}
+	key, err := newTSIGKey(re.TSIGKeyName, re.TSIGAlgorithm, re.TSIGSecret)
+	if err != nil {
+		log.Errorf("invalid TSIG key (%s): %v", re.TSIGKeyName, err)
+		return fmt.Errorf("invalid TSIG key: %w", err)
+	}
+	re.TSIGKeyName, re.TSIGAlgorithm = key.name, key.algorithm
+	return nil
+}
+
+// Sign the message (msg) at the time (now), by appending the TSIG record,
+// and return the signed message and the MAC.
+// For a response, the MAC of the request (reqMAC) is also covered.
+func (k *tsigKey) sign(msg, reqMAC []byte, now time.Time) ([]byte, []byte, error) {
+	if len(msg) < 12 {
+		return nil, nil, errors.New("message too short")
+	}
+	arcount := binary.BigEndian.Uint16(msg[10:])
+	if arcount == 0xffff {
+		return nil, nil, errors.New("too many additional records")
+	}
+
+	ts := uint64(now.Unix())
+	mac := k.mac(msg, reqMAC, ts, tsigFudge, 0, nil)
+
+	// Record: name, type, class, TTL, RDLENGTH, RDATA
+	out := make([]byte, 0, len(msg)+128)
+	out = append(out, msg...)
+	out = appendWireName(out, k.name)
+	out = binary.BigEndian.AppendUint16(out, uint16(tsigType))
+	out = binary.BigEndian.AppendUint16(out, uint16(tsigClassANY))
+	out = binary.BigEndian.AppendUint32(out, 0)
+	rdlenOff := len(out)
+	out = binary.BigEndian.AppendUint16(out, 0) // placeholder
+	// RDATA: algorithm, time, fudge, MAC size, MAC, original ID, error,
+	// other length, other data
+	out = appendWireName(out, k.algorithm)
+	out = appendUint48(out, ts)
+	out = binary.BigEndian.AppendUint16(out, tsigFudge)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(mac)))
+	out = append(out, mac...)
+	out = append(out, msg[0:2]...)
+	out = binary.BigEndian.AppendUint16(out, 0)
+	out = binary.BigEndian.AppendUint16(out, 0)
+	binary.BigEndian.PutUint16(out[rdlenOff:], uint16(len(out)-rdlenOff-2))
+	binary.BigEndian.PutUint16(out[10:], arcount+1)
+	return out, mac, nil
+}
+
+// Verify the TSIG record of the message (msg) at the time (now), and
+// return the message without the record and the MAC.
+// For a response, the MAC of the request (reqMAC) is also covered.
+func (k *tsigKey) verify(msg, reqMAC []byte, now time.Time) ([]byte, []byte, error) {
+	stripped, err := dnsmsg.RawMsg(msg).CutLastAdditional()
+	if err != nil {
+		return nil, nil, errTSIGUnsigned
+	}
+	rr, err := parseTSIG(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.EqualFold(rr.name, k.name) {
+		return nil, nil, fmt.Errorf("TSIG key mismatch: %s", rr.name)
+	}
+	if !strings.EqualFold(rr.algorithm, k.algorithm) {
+		return nil, nil, fmt.Errorf("TSIG algorithm mismatch: %s", rr.algorithm)
+	}
+	switch rr.error {
+	case 0:
+		// ok
+	case tsigBadSig:
+		return nil, nil, errors.New("TSIG error: BADSIG")
+	case tsigBadKey:
+		return nil, nil, errors.New("TSIG error: BADKEY")
+	case tsigBadTime:
+		return nil, nil, errors.New("TSIG error: BADTIME")
+	default:
+		return nil, nil, fmt.Errorf("TSIG error: %d", rr.error)
+	}
+
+	// The MAC covers the message with the original ID.
+	binary.BigEndian.PutUint16(stripped[0:], rr.origID)
+	mac := k.mac(stripped, reqMAC, rr.time, rr.fudge, rr.error, rr.other)
+	if !hmac.Equal(mac, rr.mac) {
+		return nil, nil, errors.New("TSIG signature mismatch")
+	}
+	if d := now.Unix() - int64(rr.time); d > int64(rr.fudge) || -d > int64(rr.fudge) {
+		return nil, nil, fmt.Errorf("TSIG time skew too large: %ds", d)
+	}
+
+	binary.BigEndian.PutUint16(stripped[0:], binary.BigEndian.Uint16(msg))
+	return stripped, rr.mac, nil
+}
+
+// Calculate the MAC of the message (msg), which is without the TSIG
+// record, along with the request MAC (reqMAC) if a response, and the TSIG
+// variables (RFC 8945, Section 4.3).
+func (k *tsigKey) mac(msg, reqMAC []byte, ts uint64, fudge, rcode uint16,
+	other []byte) []byte {
+	h := hmac.New(k.newHash, k.secret)
+	if reqMAC != nil {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(reqMAC))))
+		h.Write(reqMAC)
+	}
+	h.Write(msg)
+
+	vars := make([]byte, 0, 64+len(other))
+	vars = appendWireName(vars, k.name)
+	vars = binary.BigEndian.AppendUint16(vars, uint16(tsigClassANY))
+	vars = binary.BigEndian.AppendUint32(vars, 0) // TTL
+	vars = appendWireName(vars, k.algorithm)
+	vars = appendUint48(vars, ts)
+	vars = binary.BigEndian.AppendUint16(vars, fudge)
+	vars = binary.BigEndian.AppendUint16(vars, rcode)
+	vars = binary.BigEndian.AppendUint16(vars, uint16(len(other)))
+	vars = append(vars, other...)
+	h.Write(vars)
+	return h.Sum(nil)
+}
+
+// Fields of a TSIG record.
+type tsigRecord struct {
+	name      string
+	algorithm string
+	time      uint64
+	fudge     uint16
+	mac       []byte
+	origID    uint16
+	error     uint16
+	other     []byte
+}
+
+// Parse the TSIG record, i.e., the last additional record, of the message.
+func parseTSIG(msg []byte) (*tsigRecord, error) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return nil, err
+	}
+	var (
+		rh   dnsmessage.ResourceHeader
+		data []byte
+	)
+	for {
+		h, err := p.AdditionalHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if h.Type != tsigType {
+			if err := p.SkipAdditional(); err != nil {
+				return nil, err
+			}
+			data = nil // TSIG must be the last one
+			continue
+		}
+		res, err := p.UnknownResource()
+		if err != nil {
+			return nil, err
+		}
+		rh, data = h, res.Data
+	}
+	if data == nil {
+		return nil, errTSIGUnsigned
+	}
+	if rh.Class != tsigClassANY {
+		return nil, fmt.Errorf("invalid TSIG class: %d", rh.Class)
+	}
+
+	rr := &tsigRecord{name: strings.TrimSuffix(rh.Name.String(), ".")}
+	var err error
+	if rr.algorithm, data, err = readWireName(data); err != nil {
+		return nil, err
+	}
+	if len(data) < 10 {
+		return nil, errors.New("TSIG record too short")
+	}
+	rr.time = uint64(binary.BigEndian.Uint16(data))<<32 |
+		uint64(binary.BigEndian.Uint32(data[2:]))
+	rr.fudge = binary.BigEndian.Uint16(data[6:])
+	n := int(binary.BigEndian.Uint16(data[8:]))
+	data = data[10:]
+	if len(data) < n+6 {
+		return nil, errors.New("TSIG record too short")
+	}
+	rr.mac, data = data[:n], data[n:]
+	rr.origID = binary.BigEndian.Uint16(data)
+	rr.error = binary.BigEndian.Uint16(data[2:])
+	n = int(binary.BigEndian.Uint16(data[4:]))
+	data = data[6:]
+	if len(data) != n {
+		return nil, errors.New("invalid TSIG other data")
+	}
+	rr.other = data
+	return rr, nil
+}
+
+// Append the name (without the final dot) in the uncompressed wire format.
+func appendWireName(b []byte, name string) []byte {
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// Read the uncompressed name (without the final dot) at the beginning of
+// the data, and return it with the remaining data.
+func readWireName(data []byte) (string, []byte, error) {
+	var labels []string
+	for {
+		if len(data) == 0 {
+			return "", nil, errors.New("invalid name")
+		}
+		n := int(data[0])
+		if n == 0 {
+			return strings.Join(labels, "."), data[1:], nil
+		}
+		if n > 63 || len(data) < 1+n {
+			return "", nil, errors.New("invalid name")
+		}
+		labels = append(labels, string(data[1:1+n]))
+		data = data[1+n:]
+	}
+}
+
+func appendUint48(b []byte, v uint64) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(v>>32))
+	return binary.BigEndian.AppendUint32(b, uint32(v))
+}
+
+// A resolver signing the queries with the TSIG key, and verifying and
+// stripping the TSIG records of the responses.
+type tsigResolver struct {
+	Resolver
+	name string
+	key  *tsigKey
+}
+
+func newTSIGResolver(r Resolver, re *ResolverExport) (*tsigResolver, error) {
+	key, err := newTSIGKey(re.TSIGKeyName, re.TSIGAlgorithm, re.TSIGSecret)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("[%s] signing queries with TSIG key: %s", re.Name, key.name)
+	return &tsigResolver{Resolver: r, name: re.Name, key: key}, nil
+}
+
+// Export the configs with the secret omitted.
+func (r *tsigResolver) Export() *ResolverExport {
+	re := r.Resolver.Export()
+	re.TSIGKeyName = r.key.name
+	re.TSIGAlgorithm = r.key.algorithm
+	return re
+}
+
+func (r *tsigResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	resp, _, err := r.QueryWithMeta(ctx, msg, isUDP)
+	return resp, err
+}
+
+func (r *tsigResolver) QueryWithMeta(ctx context.Context, msg []byte,
+	isUDP bool) ([]byte, QueryMeta, error) {
+	signed, mac, err := r.key.sign(msg, nil, time.Now())
+	if err != nil {
+		return nil, QueryMeta{}, err
+	}
+	resp, meta, err := queryWithMeta(ctx, r.Resolver, signed, isUDP)
+	if err != nil {
+		return nil, meta, err
+	}
+	resp, _, err = r.key.verify(resp, mac, time.Now())
+	if err != nil {
+		log.Warnf("[%s] %s: TSIG verification failed: %v", r.name, requestIDFrom(ctx), err)
+		return nil, meta, err
+	}
+	return resp, meta, nil
+}
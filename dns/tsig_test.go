@@ -0,0 +1,216 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// TSIG - tests
+//
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var testTSIGSecret = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+func newTestTSIGKey(t testing.TB, secret string) *tsigKey {
+	key, err := newTSIGKey("Key.Example.", "HMAC-SHA256", secret)
+	if err != nil {
+		t.Fatalf("newTSIGKey() = %v", err)
+	}
+	return key
+}
+
+func TestTSIGSign(t *testing.T) {
+	key := newTestTSIGKey(t, testTSIGSecret)
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	now := time.Unix(0x123456789a, 0)
+
+	signed, mac, err := key.sign(query, nil, now)
+	if err != nil {
+		t.Fatalf("sign() = %v", err)
+	}
+
+	// MAC over the query and the TSIG variables (RFC 8945, Section 4.3).
+	vars := []byte("\x03key\x07example\x00" + // key name
+		"\x00\xff" + "\x00\x00\x00\x00" + // class ANY, TTL
+		"\x0bhmac-sha256\x00" + // algorithm
+		"\x00\x12\x34\x56\x78\x9a" + "\x01\x2c" + // time, fudge
+		"\x00\x00" + "\x00\x00") // error, other length
+	h := hmac.New(sha256.New, []byte("0123456789abcdef0123456789abcdef"))
+	h.Write(query)
+	h.Write(vars)
+	if want := h.Sum(nil); !bytes.Equal(mac, want) {
+		t.Errorf("sign() MAC = %x; want %x", mac, want)
+	}
+
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(signed); err != nil {
+		t.Fatalf("Unpack() = %v", err)
+	}
+	if n := len(dmsg.Additionals); n != 1 {
+		t.Fatalf("additionals = %d; want 1", n)
+	}
+	rr := dmsg.Additionals[0]
+	if rr.Header.Type != tsigType || rr.Header.Class != tsigClassANY ||
+		rr.Header.Name.String() != "key.example." {
+		t.Errorf("TSIG header = %+v; want key.example. ANY TSIG", rr.Header)
+	}
+	rdata := rr.Body.(*dnsmessage.UnknownResource).Data
+	want := append([]byte("\x0bhmac-sha256\x00"+
+		"\x00\x12\x34\x56\x78\x9a"+"\x01\x2c"+"\x00\x20"), mac...)
+	want = append(want, query[0:2]...)
+	want = append(want, 0, 0, 0, 0)
+	if !bytes.Equal(rdata, want) {
+		t.Errorf("TSIG RDATA = %x; want %x", rdata, want)
+	}
+}
+
+func TestTSIGVerify(t *testing.T) {
+	key := newTestTSIGKey(t, testTSIGSecret)
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	now := time.Now()
+
+	signed, mac, err := key.sign(query, nil, now)
+	if err != nil {
+		t.Fatalf("sign() = %v", err)
+	}
+	stripped, qmac, err := key.verify(signed, nil, now)
+	if err != nil {
+		t.Fatalf("verify(query) = %v", err)
+	}
+	if !bytes.Equal(stripped, query) || !bytes.Equal(qmac, mac) {
+		t.Errorf("verify(query) = (%x, %x); want (%x, %x)", stripped, qmac, query, mac)
+	}
+
+	resp := newTestResponse(t, query, dnsmessage.RCodeSuccess, nil, nil)
+	sresp, _, err := key.sign(resp, mac, now)
+	if err != nil {
+		t.Fatalf("sign(response) = %v", err)
+	}
+	if got, _, err := key.verify(sresp, mac, now); err != nil || !bytes.Equal(got, resp) {
+		t.Errorf("verify(response) = (%x, %v); want (%x, nil)", got, err, resp)
+	}
+
+	// The request MAC is covered by the response MAC.
+	if _, _, err := key.verify(sresp, nil, now); err == nil {
+		t.Errorf("verify(response) without request MAC = nil; want error")
+	}
+	// Tampered
+	tampered := bytes.Clone(sresp)
+	tampered[3] ^= 0x01
+	if _, _, err := key.verify(tampered, mac, now); err == nil {
+		t.Errorf("verify(tampered) = nil; want error")
+	}
+	// Wrong secret
+	other := base64.StdEncoding.EncodeToString([]byte("another secret"))
+	if _, _, err := newTestTSIGKey(t, other).verify(sresp, mac, now); err == nil {
+		t.Errorf("verify() with wrong secret = nil; want error")
+	}
+	// Time skew
+	if _, _, err := key.verify(sresp, mac, now.Add(tsigFudge*time.Second+time.Minute)); err == nil {
+		t.Errorf("verify() with time skew = nil; want error")
+	}
+	// Unsigned
+	if _, _, err := key.verify(resp, mac, now); !errors.Is(err, errTSIGUnsigned) {
+		t.Errorf("verify(unsigned) = %v; want %v", err, errTSIGUnsigned)
+	}
+	edns := newTestQueryEDNS(t, "www.example.com.", dnsmessage.TypeA)
+	if _, _, err := key.verify(edns, mac, now); !errors.Is(err, errTSIGUnsigned) {
+		t.Errorf("verify(EDNS only) = %v; want %v", err, errTSIGUnsigned)
+	}
+}
+
+// Fake upstream verifying the TSIG of the queries and signing the responses.
+type tsigTestResolver struct {
+	staticResolver
+	t   testing.TB
+	key *tsigKey
+}
+
+func (r *tsigTestResolver) Query(ctx context.Context, msg []byte, isUDP bool) ([]byte, error) {
+	query, mac, err := r.key.verify(msg, nil, time.Now())
+	if err != nil {
+		r.t.Errorf("upstream verify() = %v", err)
+		return nil, err
+	}
+	resp := newTestResponse(r.t, query, dnsmessage.RCodeSuccess, nil, nil)
+	resp, _, err = r.key.sign(resp, mac, time.Now())
+	return resp, err
+}
+
+func TestTSIGResolver(t *testing.T) {
+	re := &ResolverExport{
+		Name:        "tsig",
+		Address:     "127.0.0.1:53",
+		TSIGKeyName: "key.example",
+		TSIGSecret:  testTSIGSecret,
+	}
+	if err := re.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	if re.TSIGAlgorithm != defaultTSIGAlgorithm {
+		t.Errorf("TSIGAlgorithm = %q; want %q", re.TSIGAlgorithm, defaultTSIGAlgorithm)
+	}
+
+	upstream := &tsigTestResolver{t: t, key: newTestTSIGKey(t, testTSIGSecret)}
+	r, err := newTSIGResolver(upstream, re)
+	if err != nil {
+		t.Fatalf("newTSIGResolver() = %v", err)
+	}
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	resp, err := r.Query(context.Background(), query, true)
+	if err != nil {
+		t.Fatalf("Query() = %v", err)
+	}
+	want := newTestResponse(t, query, dnsmessage.RCodeSuccess, nil, nil)
+	if !bytes.Equal(resp, want) {
+		t.Errorf("Query() = %x; want %x", resp, want)
+	}
+
+	exp := r.Export()
+	if exp.TSIGKeyName != "key.example" || exp.TSIGAlgorithm != "hmac-sha256" ||
+		exp.TSIGSecret != "" {
+		t.Errorf("Export() TSIG = (%q, %q, %q); want (key.example, hmac-sha256, \"\")",
+			exp.TSIGKeyName, exp.TSIGAlgorithm, exp.TSIGSecret)
+	}
+
+	// Unsigned response
+	r, _ = newTSIGResolver(&staticResolver{response: want}, re)
+	if _, err := r.Query(context.Background(), query, true); err == nil {
+		t.Errorf("Query() with unsigned response = nil; want error")
+	}
+}
+
+func TestResolverExportTSIGInvalid(t *testing.T) {
+	tests := []struct {
+		name, algorithm, secret string
+	}{
+		{"", "", testTSIGSecret},
+		{"", "hmac-sha256", ""},
+		{"key.example", "", ""},
+		{"key.example", "", "not base64!"},
+		{"key.example", "hmac-md5", testTSIGSecret},
+		{"bad..name", "", testTSIGSecret},
+	}
+	for i, tc := range tests {
+		re := &ResolverExport{
+			Address:       "127.0.0.1:53",
+			TSIGKeyName:   tc.name,
+			TSIGAlgorithm: tc.algorithm,
+			TSIGSecret:    tc.secret,
+		}
+		if err := re.Validate(); err == nil {
+			t.Errorf("[%d] Validate(%+v) = nil; want error", i, tc)
+		}
+	}
+}
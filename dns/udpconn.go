@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// UDP listener replying from the destination address of the queries.
+//
+
+package dns
+
+import (
+	"net"
+	"net/netip"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"kexuedns/log"
+)
+
+// UDP listener that sends the replies from the destination address of the
+// queries, i.e., by IP_PKTINFO/IPV6_PKTINFO, because the kernel picks the
+// source address by the route, which may differ from the one the client
+// sent to on a multi-homed host, and then the client would drop the reply.
+// NOTE: It's only needed if bound to the unspecified address (e.g.,
+// 0.0.0.0 or [::]).
+type udpConn struct {
+	*net.UDPConn
+	pktinfo bool
+	ipv6    bool // whether it's an IPv6 (maybe dual-stack) socket
+	batch   batchReader
+}
+
+// Reader of multiple packets at once, i.e., ipv4.PacketConn or
+// ipv6.PacketConn, whose messages are the same type.
+type batchReader interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newUDPConn(conn *net.UDPConn) *udpConn {
+	c := &udpConn{UDPConn: conn}
+	addr := conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr()
+	if addr.Is4() {
+		c.batch = ipv4.NewPacketConn(conn)
+	} else {
+		c.ipv6 = true
+		c.batch = ipv6.NewPacketConn(conn)
+	}
+	if !addr.IsUnspecified() {
+		return c
+	}
+
+	var err error
+	if !c.ipv6 {
+		err = ipv4.NewPacketConn(conn).SetControlMessage(ipv4.FlagDst, true)
+	} else {
+		// Also work for the IPv4 packets on a dual-stack socket, whose
+		// addresses are IPv4-mapped.
+		err = ipv6.NewPacketConn(conn).SetControlMessage(
+			ipv6.FlagDst|ipv6.FlagInterface, true)
+	}
+	if err != nil {
+		log.Warnf("failed to enable PKTINFO on UDP socket %s: %v; "+
+			"replies may be sent from a different address", conn.LocalAddr(), err)
+		return c
+	}
+
+	c.pktinfo = true
+	return c
+}
+
+// Read a packet into the buffer (buf), and return its size, the source
+// address, and the control message to send the reply from its destination
+// address.
+func (c *udpConn) read(buf []byte) (n int, addr netip.AddrPort, oob []byte, err error) {
+	if !c.pktinfo {
+		n, addr, err = c.ReadFromUDPAddrPort(buf)
+		return
+	}
+
+	cmsg := c.newControlMessage()
+	var oobn int
+	n, oobn, _, addr, err = c.ReadMsgUDPAddrPort(buf, cmsg)
+	if err != nil {
+		return
+	}
+	oob = replyControlMessage(cmsg[:oobn], c.ipv6)
+	return
+}
+
+// Make the buffer of the control message to receive; nil if not needed.
+func (c *udpConn) newControlMessage() []byte {
+	switch {
+	case !c.pktinfo:
+		return nil
+	case c.ipv6:
+		return ipv6.NewControlMessage(ipv6.FlagDst | ipv6.FlagInterface)
+	default:
+		return ipv4.NewControlMessage(ipv4.FlagDst)
+	}
+}
+
+// Read up to len(msgs) packets at once (by recvmmsg(2) on Linux) into the
+// messages (msgs), each with a buffer and the control message buffer made
+// by newControlMessage(), and return the number of the packets read.
+// Use packet() to get the source address and the reply control message of
+// each packet.
+func (c *udpConn) readBatch(msgs []ipv4.Message) (int, error) {
+	return c.batch.ReadBatch(msgs, 0)
+}
+
+// Get the source address and the control message to send the reply of the
+// packet in the message (m) read by readBatch(), like read().
+func (c *udpConn) packet(m *ipv4.Message) (addr netip.AddrPort, oob []byte) {
+	if ua, ok := m.Addr.(*net.UDPAddr); ok {
+		addr = ua.AddrPort()
+		if !c.ipv6 {
+			addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		}
+	}
+	if c.pktinfo {
+		oob = replyControlMessage(m.OOB[:m.NN], c.ipv6)
+	}
+	return
+}
+
+// Send the reply (b) to the address (addr) with the control message (oob)
+// returned by read().
+func (c *udpConn) write(b []byte, addr netip.AddrPort, oob []byte) error {
+	if oob == nil {
+		_, err := c.WriteToUDPAddrPort(b, addr)
+		return err
+	}
+	_, _, err := c.WriteMsgUDPAddrPort(b, oob, addr)
+	return err
+}
+
+// Make the control message to send the reply from the destination address
+// of the query in the received control message (cmsg).
+func replyControlMessage(cmsg []byte, isIPv6 bool) []byte {
+	if isIPv6 {
+		var cm ipv6.ControlMessage
+		if err := cm.Parse(cmsg); err != nil || cm.Dst == nil {
+			return nil
+		}
+		if cm.Dst.To4() != nil {
+			// IPv4 packet on a dual-stack socket, which is not marshaled
+			// by ipv6.ControlMessage; leave the interface to the route
+			// as below.
+			return pktinfoMapped(cm.Dst)
+		}
+		// The interface is required by the link-local addresses.
+		return (&ipv6.ControlMessage{Src: cm.Dst, IfIndex: cm.IfIndex}).Marshal()
+	}
+
+	var cm ipv4.ControlMessage
+	if err := cm.Parse(cmsg); err != nil || cm.Dst == nil {
+		return nil
+	}
+	// Only set the source address but leave the interface to the route.
+	return (&ipv4.ControlMessage{Src: cm.Dst}).Marshal()
+}
@@ -0,0 +1,25 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// UDP listener replying from the destination address - Linux
+//
+
+package dns
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// Make the IPV6_PKTINFO control message with the IPv4-mapped source
+// address (src), which Linux accepts on a dual-stack socket.
+func pktinfoMapped(src net.IP) []byte {
+	info := &unix.Inet6Pktinfo{}
+	copy(info.Addr[:], src.To16())
+	return unix.PktInfo6(info)
+}
+
+// Receiving multiple packets per syscall by recvmmsg(2).
+const udpBatchSupported = true
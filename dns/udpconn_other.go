@@ -0,0 +1,24 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// UDP listener replying from the destination address - other platforms
+//
+
+//go:build !linux
+
+package dns
+
+import (
+	"net"
+)
+
+// Setting the IPv4-mapped source address on a dual-stack socket is not
+// supported, so leave it to the kernel.
+func pktinfoMapped(src net.IP) []byte {
+	return nil
+}
+
+// Receiving multiple packets per syscall (recvmmsg) is not supported, so
+// read one packet at a time.
+const udpBatchSupported = false
@@ -0,0 +1,241 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// UDP listener - tests
+//
+
+package dns
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Send a packet from the client address (client) to the server at the
+// destination address (dst), echo it back by the udpConn, and return the
+// source address of the reply.
+func udpConnEcho(t *testing.T, c *udpConn, client, dst netip.AddrPort) netip.AddrPort {
+	t.Helper()
+
+	cc, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(client))
+	if err != nil {
+		t.Skipf("failed to listen UDP at %s: %v", client, err)
+	}
+	defer cc.Close()
+	if _, err := cc.WriteToUDPAddrPort([]byte("hello"), dst); err != nil {
+		t.Fatalf("failed to send to %s: %v", dst, err)
+	}
+
+	buf := make([]byte, 512)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, oob, err := c.read(buf)
+	if err != nil {
+		t.Fatalf(`read() = %v; want nil`, err)
+	}
+	if c.pktinfo && oob == nil {
+		t.Errorf(`read() oob = nil; want control message`)
+	}
+	if err := c.write(buf[:n], addr, oob); err != nil {
+		t.Fatalf(`write() = %v; want nil`, err)
+	}
+
+	cc.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := cc.ReadFromUDPAddrPort(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf(`ReadFrom() = (%q, %v); want "hello"`, buf[:n], err)
+	}
+	return netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+}
+
+func TestUDPConnPktinfo(t *testing.T) {
+	tests := []struct {
+		network string
+		listen  string
+		client  string
+		dst     string // without the port
+	}{
+		// The kernel would reply from 127.0.0.1 by the route.
+		{"udp4", "0.0.0.0:0", "127.0.0.2:0", "127.0.0.2"},
+		// NOTE: It's a dual-stack socket as the forwarder listens.
+		{"udp", "0.0.0.0:0", "127.0.0.2:0", "127.0.0.2"},
+		{"udp", "[::]:0", "127.0.0.2:0", "127.0.0.2"},
+		{"udp", "[::]:0", "[::1]:0", "::1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.network+"-"+tc.listen+"-"+tc.dst, func(t *testing.T) {
+			laddr := net.UDPAddrFromAddrPort(netip.MustParseAddrPort(tc.listen))
+			conn, err := net.ListenUDP(tc.network, laddr)
+			if err != nil {
+				t.Skipf("failed to listen UDP at %s: %v", tc.listen, err)
+			}
+			defer conn.Close()
+			c := newUDPConn(conn)
+			if !c.pktinfo {
+				t.Fatalf(`newUDPConn(%s).pktinfo = false; want true`, tc.listen)
+			}
+
+			port := conn.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+			dst := netip.AddrPortFrom(netip.MustParseAddr(tc.dst), port)
+			client := netip.MustParseAddrPort(tc.client)
+			if from := udpConnEcho(t, c, client, dst); from != dst {
+				t.Errorf(`reply from %s; want %s`, from, dst)
+			}
+		})
+	}
+}
+
+func TestUDPConnBound(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Skipf("failed to listen UDP: %v", err)
+	}
+	defer conn.Close()
+
+	// No need of PKTINFO when bound to a specific address.
+	c := newUDPConn(conn)
+	if c.pktinfo {
+		t.Errorf(`newUDPConn().pktinfo = true; want false`)
+	}
+	dst := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	client := netip.MustParseAddrPort("127.0.0.1:0")
+	if from := udpConnEcho(t, c, client, dst); from != dst {
+		t.Errorf(`reply from %s; want %s`, from, dst)
+	}
+}
+
+func TestUDPConnReadBatch(t *testing.T) {
+	tests := []struct {
+		network string
+		listen  string
+		client  string
+	}{
+		{"udp4", "0.0.0.0:0", "127.0.0.2:0"},
+		{"udp", "[::]:0", "127.0.0.2:0"},
+		{"udp", "[::]:0", "[::1]:0"},
+		{"udp", "127.0.0.2:0", "127.0.0.1:0"}, // bound without PKTINFO
+	}
+	for _, tc := range tests {
+		t.Run(tc.network+"-"+tc.listen+"-"+tc.client, func(t *testing.T) {
+			laddr := net.UDPAddrFromAddrPort(netip.MustParseAddrPort(tc.listen))
+			conn, err := net.ListenUDP(tc.network, laddr)
+			if err != nil {
+				t.Skipf("failed to listen UDP at %s: %v", tc.listen, err)
+			}
+			defer conn.Close()
+			c := newUDPConn(conn)
+
+			cc, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(
+				netip.MustParseAddrPort(tc.client)))
+			if err != nil {
+				t.Skipf("failed to listen UDP at %s: %v", tc.client, err)
+			}
+			defer cc.Close()
+			client := cc.LocalAddr().(*net.UDPAddr).AddrPort()
+			dst := netip.AddrPortFrom(client.Addr(),
+				conn.LocalAddr().(*net.UDPAddr).AddrPort().Port())
+			if !laddr.IP.IsUnspecified() {
+				dst = conn.LocalAddr().(*net.UDPAddr).AddrPort()
+			}
+			const npackets = 3
+			for i := range npackets {
+				if _, err := cc.WriteToUDPAddrPort([]byte{byte(i)}, dst); err != nil {
+					t.Fatalf("failed to send to %s: %v", dst, err)
+				}
+			}
+
+			msgs := make([]ipv4.Message, 8)
+			for i := range msgs {
+				msgs[i].Buffers = [][]byte{make([]byte, 512)}
+				msgs[i].OOB = c.newControlMessage()
+			}
+			for got := 0; got < npackets; {
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				n, err := c.readBatch(msgs)
+				if err != nil {
+					t.Fatalf(`readBatch() = %v; want nil`, err)
+				}
+				for i := range msgs[:n] {
+					m := &msgs[i]
+					addr, oob := c.packet(m)
+					if addr.Addr().Unmap() != client.Addr() || addr.Port() != client.Port() ||
+						m.N != 1 || m.Buffers[0][0] != byte(got) {
+						t.Errorf(`packet [%d] = (%s, %v); want (%s, [%d])`,
+							got, addr, m.Buffers[0][:m.N], client, got)
+					}
+					if c.pktinfo && oob == nil {
+						t.Errorf(`packet [%d] oob = nil; want control message`, got)
+					}
+					if err := c.write(m.Buffers[0][:m.N], addr, oob); err != nil {
+						t.Fatalf(`write() = %v; want nil`, err)
+					}
+					got++
+				}
+			}
+
+			buf := make([]byte, 512)
+			for range npackets {
+				cc.SetReadDeadline(time.Now().Add(time.Second))
+				_, from, err := cc.ReadFromUDPAddrPort(buf)
+				if err != nil {
+					t.Fatalf(`ReadFrom() = %v; want nil`, err)
+				}
+				if from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port()); from != dst {
+					t.Errorf(`reply from %s; want %s`, from, dst)
+				}
+			}
+		})
+	}
+}
+
+// Compare the packets received per read (i.e., syscall on Linux) with and
+// without batching, e.g.:
+// go test -run=^$ -bench=UDPConnRead ./dns
+func BenchmarkUDPConnRead(b *testing.B) {
+	const burst = 32
+	for _, batch := range []int{1, burst} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				b.Skipf("failed to listen UDP: %v", err)
+			}
+			defer conn.Close()
+			conn.SetReadBuffer(1 << 20)
+			c := newUDPConn(conn)
+			cc, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+			if err != nil {
+				b.Fatalf("failed to dial: %v", err)
+			}
+			defer cc.Close()
+
+			msgs := make([]ipv4.Message, batch)
+			for i := range msgs {
+				msgs[i].Buffers = [][]byte{make([]byte, 512)}
+			}
+			packet := make([]byte, 64)
+			reads := 0
+			b.ResetTimer()
+			for range b.N {
+				for range burst {
+					if _, err := cc.Write(packet); err != nil {
+						b.Fatalf("failed to send: %v", err)
+					}
+				}
+				for got := 0; got < burst; reads++ {
+					c.SetReadDeadline(time.Now().Add(time.Second))
+					n, err := c.readBatch(msgs)
+					if err != nil {
+						b.Fatalf(`readBatch() = %v; want nil`, err)
+					}
+					got += n
+				}
+			}
+			b.ReportMetric(float64(b.N*burst)/float64(reads), "packets/read")
+		})
+	}
+}
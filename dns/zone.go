@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Authoritative zones loaded from zone files.
+//
+
+package dns
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/util/dnsmsg"
+	"kexuedns/util/dnstrie"
+	"kexuedns/util/zonefile"
+)
+
+// Maximum number of CNAMEs to follow within a zone.
+const maxCNAMEChain = 8
+
+// A small zone answered authoritatively from memory.
+// NOTE: Wildcards and delegations (i.e., NS records below the apex) are not
+// supported; all names are answered as if they're in this zone.
+type Zone struct {
+	origin  string // normalized; e.g., "home.example"
+	soa     dnsmessage.Resource
+	records map[string][]dnsmessage.Resource // key: "TypeA:www.home.example"
+	names   map[string]struct{}              // names that own any records
+}
+
+// Load the zone (origin) from the zone file (path).
+func LoadZoneFile(origin string, path string) (*Zone, error) {
+	records, err := zonefile.ParseFile(path, origin)
+	if err != nil {
+		return nil, fmt.Errorf("zone [%s]: %w", origin, err)
+	}
+	return NewZone(origin, records)
+}
+
+// Create the zone (origin) from the records (records).
+// A default SOA record is created if missing.
+func NewZone(origin string, records []dnsmessage.Resource) (*Zone, error) {
+	z := &Zone{
+		origin:  dnsmsg.NormalizeName(origin),
+		records: map[string][]dnsmessage.Resource{},
+		names:   map[string]struct{}{},
+	}
+	if z.origin == "" {
+		return nil, fmt.Errorf("zone origin missing")
+	}
+
+	hasSOA := false
+	for _, rr := range records {
+		name := dnsmsg.NormalizeName(rr.Header.Name.String())
+		if name != z.origin && !strings.HasSuffix(name, "."+z.origin) {
+			return nil, fmt.Errorf("zone [%s]: out-of-zone record: %s",
+				z.origin, name)
+		}
+		if rr.Header.Type == dnsmessage.TypeSOA {
+			if name != z.origin || hasSOA {
+				return nil, fmt.Errorf("zone [%s]: invalid SOA record: %s",
+					z.origin, name)
+			}
+			z.soa = rr
+			hasSOA = true
+		}
+		key := zoneKey(rr.Header.Type, name)
+		z.records[key] = append(z.records[key], rr)
+		z.names[name] = struct{}{}
+	}
+	if !hasSOA {
+		z.soa = newLocalSOA(z.origin, uint32(defaultLocalZoneTTL.Seconds()))
+		z.records[zoneKey(dnsmessage.TypeSOA, z.origin)] = []dnsmessage.Resource{z.soa}
+		z.names[z.origin] = struct{}{}
+	}
+
+	for key, rrs := range z.records {
+		if strings.HasPrefix(key, dnsmessage.TypeCNAME.String()+":") && len(rrs) > 1 {
+			return nil, fmt.Errorf("zone [%s]: multiple CNAMEs: %s",
+				z.origin, key)
+		}
+	}
+
+	return z, nil
+}
+
+func (z *Zone) Origin() string {
+	return z.origin
+}
+
+func zoneKey(rtype dnsmessage.Type, name string) string {
+	return rtype.String() + ":" + name
+}
+
+// Answer the query (query) from the zone.
+func (z *Zone) answer(query *dnsmsg.QueryMsg) ([]byte, error) {
+	qtype := query.Question.Type
+	name := dnsmsg.NormalizeName(query.Question.Name.String())
+
+	var answers []dnsmessage.Resource
+	for i := 0; i <= maxCNAMEChain; i++ {
+		if rrs, ok := z.records[zoneKey(qtype, name)]; ok {
+			answers = append(answers, z.withName(rrs, i == 0, query)...)
+			return newLocalResponse(query, dnsmessage.RCodeSuccess, answers, nil)
+		}
+		if qtype == dnsmessage.TypeCNAME {
+			break
+		}
+		rrs, ok := z.records[zoneKey(dnsmessage.TypeCNAME, name)]
+		if !ok {
+			break
+		}
+		answers = append(answers, z.withName(rrs, i == 0, query)...)
+		target := rrs[0].Body.(*dnsmessage.CNAMEResource).CNAME.String()
+		name = dnsmsg.NormalizeName(target)
+		if name != z.origin && !strings.HasSuffix(name, "."+z.origin) {
+			// Out of zone; leave it to the client to resolve the target.
+			return newLocalResponse(query, dnsmessage.RCodeSuccess, answers, nil)
+		}
+	}
+
+	rcode := dnsmessage.RCodeNameError
+	if _, ok := z.names[name]; ok {
+		rcode = dnsmessage.RCodeSuccess // NODATA
+	}
+	return newLocalResponse(query, rcode, answers, []dnsmessage.Resource{z.soa})
+}
+
+// Use the query name as is (e.g., case preserved) for the records owned by
+// the query name (i.e., first in the CNAME chain).
+func (z *Zone) withName(rrs []dnsmessage.Resource, first bool,
+	query *dnsmsg.QueryMsg) []dnsmessage.Resource {
+	if !first {
+		return rrs
+	}
+	out := make([]dnsmessage.Resource, len(rrs))
+	for i, rr := range rrs {
+		rr.Header.Name = query.Question.Name
+		out[i] = rr
+	}
+	return out
+}
+
+// Set the authoritative zones, replacing the old ones.
+func (f *Forwarder) SetZones(zones []*Zone) error {
+	trie := &dnstrie.DNSTrie{}
+	for _, z := range zones {
+		if _, updated := trie.AddZone(z.origin, z); updated {
+			return fmt.Errorf("duplicate zone: %s", z.origin)
+		}
+	}
+	f.zones.Store(trie)
+	return nil
+}
+
+// Check whether the query of the class (class) is answered from the zones,
+// which are all of class IN; the other classes (e.g., CH) are forwarded as
+// usual.
+func zoneClass(class dnsmessage.Class) bool {
+	return class == dnsmessage.ClassINET || class == dnsmessage.ClassANY
+}
+
+// Answer the query (qmsg) if it's in an authoritative zone.
+// Return the response and true if answered.
+func (f *Forwarder) answerZone(qmsg []byte, question *dnsmessage.Question) ([]byte, bool) {
+	if !zoneClass(question.Class) {
+		return nil, false
+	}
+	trie := f.zones.Load()
+	if trie == nil {
+		return nil, false
+	}
+	v, ok := trie.Match(question.Name.String())
+	if !ok {
+		return nil, false
+	}
+
+	query, err := dnsmsg.NewQueryMsg(qmsg)
+	if err != nil {
+		return nil, false
+	}
+	resp, err := v.(*Zone).answer(query)
+	if err != nil {
+		return nil, false
+	}
+	return resp, true
+}
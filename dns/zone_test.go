@@ -0,0 +1,124 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Authoritative zones - tests
+//
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"kexuedns/config"
+	"kexuedns/util/dnsmsg"
+)
+
+const testZoneFile = `
+$TTL 300
+@	SOA	ns1 admin 1 3600 1200 604800 60
+www	A	192.168.1.10
+www	A	192.168.1.11
+alias	CNAME	www
+ext	CNAME	www.example.com.
+`
+
+func TestZone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "home.zone")
+	if err := os.WriteFile(path, []byte(testZoneFile), 0o644); err != nil {
+		t.Fatalf("failed to write zone file: %v", err)
+	}
+	zone, err := LoadZoneFile("home.example", path)
+	if err != nil {
+		t.Fatalf(`LoadZoneFile() = %v; want nil`, err)
+	}
+
+	upstream := newTestQuery(t, "upstream.", dnsmessage.TypeA)
+	dnsmsg.RawMsg(upstream).SetFlags(dnsmsg.FlagQR|dnsmsg.FlagRA, 0)
+	f := &Forwarder{myIP: &config.MyIP{}}
+	f.Router.resolver = &staticResolver{response: upstream}
+	if err := f.SetZones([]*Zone{zone}); err != nil {
+		t.Fatalf(`SetZones() = %v; want nil`, err)
+	}
+
+	tests := []struct {
+		name   string
+		qtype  dnsmessage.Type
+		rcode  dnsmessage.RCode
+		nans   int
+		nauths int
+	}{
+		{"WWW.home.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 2, 0},
+		{"www.home.example.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 0, 1},
+		{"alias.home.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 3, 0},
+		{"alias.home.example.", dnsmessage.TypeCNAME, dnsmessage.RCodeSuccess, 1, 0},
+		{"ext.home.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1, 0},
+		{"home.example.", dnsmessage.TypeSOA, dnsmessage.RCodeSuccess, 1, 0},
+		{"none.home.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, 0, 1},
+	}
+	for i, tc := range tests {
+		query := newTestQuery(t, tc.name, tc.qtype)
+		resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+		if err != nil {
+			t.Fatalf(`[%d] handleQuery() = %v; want nil`, i, err)
+		}
+		var dmsg dnsmessage.Message
+		if err := dmsg.Unpack(resp); err != nil {
+			t.Fatalf(`[%d] failed to unpack response: %v`, i, err)
+		}
+		if !dmsg.Header.Authoritative || dmsg.Header.RCode != tc.rcode ||
+			len(dmsg.Answers) != tc.nans || len(dmsg.Authorities) != tc.nauths {
+			t.Errorf(`[%d] %s %s response = %+v; want RCode=%v, %d answers, %d authorities`,
+				i, tc.name, tc.qtype, dmsg, tc.rcode, tc.nans, tc.nauths)
+		}
+		if tc.nans > 0 && dmsg.Answers[0].Header.Name.String() != tc.name {
+			t.Errorf(`[%d] answer name = %s; want %s`,
+				i, dmsg.Answers[0].Header.Name, tc.name)
+		}
+	}
+
+	// Out of the zones: forwarded.
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	resp, err := f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if err != nil || string(resp) != string(upstream) {
+		t.Errorf(`handleQuery() = (%v, %v); want forwarded`, resp, err)
+	}
+
+	// Not of class IN: forwarded.
+	query = newTestQuery(t, "www.home.example.", dnsmessage.TypeA)
+	binary.BigEndian.PutUint16(query[len(query)-2:], uint16(dnsmessage.ClassCHAOS))
+	resp, err = f.handleQuery(context.Background(), query, netip.Addr{}, true)
+	if err != nil || string(resp) != string(upstream) {
+		t.Errorf(`handleQuery() of class CH = (%v, %v); want forwarded`, resp, err)
+	}
+}
+
+func TestNewZoneInvalid(t *testing.T) {
+	a := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("www.other.example."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		},
+		Body: &dnsmessage.AResource{},
+	}
+	if _, err := NewZone("home.example", []dnsmessage.Resource{a}); err == nil {
+		t.Errorf(`NewZone() with out-of-zone record = nil; want error`)
+	}
+
+	zone, err := NewZone("home.example.", nil)
+	if err != nil {
+		t.Fatalf(`NewZone() = %v; want nil`, err)
+	}
+	f := &Forwarder{}
+	if err := f.SetZones([]*Zone{zone, zone}); err == nil {
+		t.Errorf(`SetZones() with duplicates = nil; want error`)
+	}
+}
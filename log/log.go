@@ -124,6 +124,14 @@ func Fatalf(format string, v ...any) {
 	errLogger.Fatalf(format, v...)
 }
 
+// Flush the logs to the outputs (e.g., the files redirected to), which is
+// called before exiting so that the tail isn't lost.
+// NOTE: The errors are ignored, e.g., a terminal or pipe doesn't sync.
+func Flush() {
+	os.Stdout.Sync()
+	os.Stderr.Sync()
+}
+
 // Get the file and function information of the logger caller.
 // Result: "file:line:function"
 func getOrigin() string {
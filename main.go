@@ -8,10 +8,10 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"net/http/pprof"
@@ -22,33 +22,51 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"kexuedns/api"
 	"kexuedns/config"
 	"kexuedns/log"
 	"kexuedns/ui"
+	"kexuedns/util/dnsmsg"
 )
 
 const progname = "KexueDNS"
 
 func main() {
 	enablePprof := flag.Bool("pprof", false, "enable debug profiling")
+	enableDebug := flag.Bool("debug", false, "enable debug API endpoints")
 	logLevel := flag.String("log-level", "info", "log level: debug/info/notice/warn/error")
 	configDir := flag.String("config-dir", "",
 		fmt.Sprintf("config directory (default \"${XDG_CONFIG_HOME}/%s\")",
 			strings.ToLower(progname)))
 	configInit := flag.Bool("config-init", false, "initialize with the default configs")
-	httpAddr := flag.String("http-addr", "127.0.0.1", "HTTP webui address")
+	configCheck := flag.Bool("config-check", false, "check the configs and exit")
+	query := flag.String("query", "",
+		"query \"name[:type]\" through the configured router, print the response and exit")
+	httpAddr := flag.String("http-addr", "127.0.0.1",
+		"HTTP webui address, or \"unix:/path/to.sock\" for a Unix socket")
 	httpPort := flag.Uint("http-port", 5580, "HTTP webui port")
+	httpMaxBody := flag.Int64("http-max-body", 1<<20,
+		"max size (bytes) of the API request bodies")
+	noAutostart := flag.Bool("no-autostart", false,
+		"don't start the forwarder until requested via the API")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second,
+		"max time to wait for the graceful shutdown before force exiting")
 	showVersion := flag.Bool("version", false, "show version")
 	flag.Parse()
 
 	if *showVersion {
 		vi := config.GetVersion()
-		fmt.Printf("%s %s (%s)\n", progname, vi.Version, vi.Date)
+		fmt.Printf("%s %s (%s) %s %s\n", progname, vi.Version, vi.Date,
+			vi.GoVersion, vi.Platform)
 		return
 	}
 
+	if *query != "" && !isFlagSet("log-level") {
+		// Keep the output clean for the response.
+		*logLevel = "warn"
+	}
 	log.SetLevelString(*logLevel)
 	log.Infof("set log level to [%s]", *logLevel)
 
@@ -73,26 +91,34 @@ func main() {
 		log.Fatalf("failed to load config: %v", err)
 	}
 
-	addr, err := netip.ParseAddr(*httpAddr)
-	if err != nil {
-		log.Fatalf("invalid http-addr: %s, error: %v", *httpAddr, err)
+	if *configCheck {
+		if err := api.CheckConfig(config.Get()); err != nil {
+			fmt.Printf("ERROR: config check failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("config OK: %s\n", *configDir)
+		return
 	}
 
-	addrport := netip.AddrPortFrom(addr, uint16(*httpPort))
-	baseURL := "http://" + addrport.String()
-	if addr.IsUnspecified() {
-		log.Warnf("webui server is public accessible! (addr=%s)", addr.String())
-
-		addr := addr
-		if addr.Is4() {
-			addr = netip.AddrFrom4([4]byte{127, 0, 0, 1})
-		} else {
-			addr = netip.IPv6Loopback()
+	if *query != "" {
+		if err := runQuery(*query); err != nil {
+			fmt.Printf("ERROR: query failed: %v\n", err)
+			os.Exit(1)
 		}
-		baseURL = "http://" + netip.AddrPortFrom(addr, uint16(*httpPort)).String()
+		return
+	}
+
+	listener, baseURL, err := listenHTTP(*httpAddr, uint16(*httpPort))
+	if err != nil {
+		log.Fatalf("failed to listen at: %s, error: %v", *httpAddr, err)
 	}
 
 	apiHandler := api.New()
+	apiHandler.MaxBodySize = *httpMaxBody
+	if *enableDebug {
+		apiHandler.EnableDebug()
+		log.Infof("enabled debug API endpoints at: %s/api/debug/", baseURL)
+	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/api/", http.StripPrefix("/api", apiHandler))
@@ -109,11 +135,6 @@ func main() {
 		log.Infof("enabled debug profiling at: %s%s", baseURL, path)
 	}
 
-	listener, err := net.Listen("tcp", addrport.String())
-	if err != nil {
-		log.Fatalf("failed to listen at: %s, error: %v", addrport.String(), err)
-	}
-
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 	server := &http.Server{Handler: mux}
@@ -127,30 +148,153 @@ func main() {
 	}()
 
 	// Start the forwarder.
-	// Do this after listen, so this request would wait for the server to
-	// accept instead of simply failing if it races aganist the server listen.
-	resp, err := http.Post(baseURL+"/api/start", "", nil)
-	if err != nil {
-		log.Warnf("failed to request: %v", err)
-	} else {
-		body, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if resp.StatusCode >= 400 {
-			log.Warnf("failed to start forwarder: %s", body)
+	if *noAutostart {
+		log.Infof("autostart disabled; start the forwarder via: %s/api/start",
+			baseURL)
+	} else if err := apiHandler.StartForwarder(); err != nil {
+		if errors.Is(err, api.ErrStartupProbe) {
+			log.Fatalf("failed to start forwarder: %v", err)
 		}
+		log.Warnf("failed to start forwarder: %v", err)
 	}
 
+	// Refresh the remote config (if configured) in the background.
+	refreshCtx, stopRefresh := context.WithCancel(context.Background())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		apiHandler.RefreshConfig(refreshCtx)
+	}()
+
 	// Set up signal capturing.
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 	<-stop
 
-	// Clean up.
-	_, _ = http.Post(baseURL+"/api/stop", "", nil)
-	if err := server.Close(); err != nil {
-		log.Errorf("failed to close the webui server: %v", err)
+	// Clean up, bounded by the shutdown timeout in case anything (e.g., a
+	// stuck resolver goroutine) hangs.
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stopRefresh()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Errorf("failed to shut down the webui server: %v", err)
+		}
+		apiHandler.StopForwarder()
+		wg.Wait()
+		// Flush the tail of the logs after everything stopped.
+		log.Flush()
+	}()
+
+	select {
+	case <-done:
+		log.Infof("done; exiting")
+	case <-ctx.Done():
+		log.Errorf("shutdown exceeded %v; force exiting", *shutdownTimeout)
+		os.Exit(1)
+	case <-stop:
+		log.Errorf("signaled again during shutdown; force exiting")
+		os.Exit(1)
 	}
+}
 
-	wg.Wait()
-	log.Infof("done; exiting")
+// Listen at the HTTP webui address (addr) and port, or the Unix socket if
+// the address has the "unix:" prefix.
+// Return the listener and the base URL to access the webui.
+func listenHTTP(addr string, port uint16) (net.Listener, string, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return nil, "", errors.New("empty unix socket path")
+		}
+		// Remove the stale socket left by an unclean exit, but never
+		// other files.
+		if fi, err := os.Lstat(path); err == nil && fi.Mode().Type() == os.ModeSocket {
+			log.Warnf("removing stale socket: %s", path)
+			os.Remove(path)
+		}
+		// NOTE: The socket file is removed when the listener is closed
+		// (i.e., upon the server shutdown).
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, "", err
+		}
+		return listener, "http://unix:" + path, nil
+	}
+
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid http-addr: %w", err)
+	}
+	addrport := netip.AddrPortFrom(ip, port)
+	baseURL := "http://" + addrport.String()
+	if ip.IsUnspecified() {
+		log.Warnf("webui server is public accessible! (addr=%s)", ip.String())
+
+		if ip.Is4() {
+			ip = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+		} else {
+			ip = netip.IPv6Loopback()
+		}
+		baseURL = "http://" + netip.AddrPortFrom(ip, port).String()
+	}
+
+	listener, err := net.Listen("tcp", addrport.String())
+	if err != nil {
+		return nil, "", err
+	}
+	return listener, baseURL, nil
+}
+
+// Whether the flag (name) is set on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// Query the name with an optional type (arg; "name[:type]", default type A)
+// through the configured router without starting the server, and print the
+// response like dig, for debugging the routing and resolver configs.
+func runQuery(arg string) error {
+	name, typ, ok := strings.Cut(arg, ":")
+	if !ok {
+		typ = "A"
+	}
+	qtype, err := dnsmsg.ParseType(typ)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	resp, match, err := api.Query(context.Background(), config.Get(), name, qtype)
+	elapsed := time.Since(start)
+	if resp != nil {
+		out, err := dnsmsg.Format(resp)
+		if err != nil {
+			return err
+		}
+		fmt.Print(out)
+	}
+
+	fmt.Println()
+	if match != nil {
+		route := "(default)"
+		if match.Index >= 0 {
+			route = fmt.Sprintf("[%d] %s (zone: %s)", match.Index, match.Route, match.Zone)
+		}
+		fmt.Printf(";; ROUTE: %s\n", route)
+		if re := match.Resolver; re != nil {
+			fmt.Printf(";; RESOLVER: %s (%s %s)\n", re.Name, re.Protocol, re.Address)
+		} else {
+			fmt.Printf(";; RESOLVER: (none)\n")
+		}
+	}
+	fmt.Printf(";; Query time: %d msec\n", elapsed.Milliseconds())
+	return err
 }
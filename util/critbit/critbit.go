@@ -464,6 +464,11 @@ func (t *Tree) walkPrefixed(top treeNode, prefix []byte, fn WalkFn) bool {
 	return true // continue
 }
 
+// Remove all the keys from the tree, which is then empty and can be reused.
+func (t *Tree) Clear() {
+	t.root = nil
+}
+
 // Print the whole tree for debugging.
 func (t *Tree) Dump(w io.Writer) {
 	if t.root == nil {
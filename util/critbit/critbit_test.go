@@ -58,6 +58,44 @@ func TestEmpty1(t *testing.T) {
 	})
 }
 
+func TestClear(t *testing.T) {
+	tree := &Tree{}
+	tree.Clear() // no-op on an empty tree
+
+	keys := []string{"a", "ab", "abc", "b", "xyz"}
+	for _, k := range keys {
+		tree.Insert([]byte(k), k)
+	}
+	tree.Clear()
+
+	for _, k := range keys {
+		if v, ok := tree.Get([]byte(k)); ok {
+			t.Errorf(`Get(%q) = (%v, true); want (nil, false)`, k, v)
+		}
+	}
+	if k, v, ok := tree.LongestPrefix([]byte("abcd")); ok {
+		t.Errorf(`LongestPrefix("abcd") = (%q, %v, true); want no match`, k, v)
+	}
+	n := 0
+	tree.Walk(func(key []byte, value any) bool { n++; return true })
+	if n != 0 {
+		t.Errorf(`Walk() = %d; want 0`, n)
+	}
+	buf := &bytes.Buffer{}
+	tree.Dump(buf)
+	if s := buf.String(); s != "(empty)\n" {
+		t.Errorf(`Dump() = %q; want "(empty)\n"`, s)
+	}
+
+	// Reusable after clear.
+	if ok := tree.Insert([]byte("ab"), 1); !ok {
+		t.Errorf(`Insert("ab") after clear = false; want true`)
+	}
+	if v, ok := tree.Get([]byte("ab")); v != 1 || !ok {
+		t.Errorf(`Get("ab") = (%v, %t); want (1, true)`, v, ok)
+	}
+}
+
 func TestInsert1(t *testing.T) {
 	tree := &Tree{}
 
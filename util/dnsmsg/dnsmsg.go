@@ -8,9 +8,13 @@
 package dnsmsg
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
 	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -20,6 +24,18 @@ import (
 const (
 	// UDP payload size. EDNS(0), RFC 6891
 	maxPayloadSize = 1232
+	// Max UDP payload size without EDNS, and also the lower bound of the
+	// advertised payload size. RFC 1035, RFC 6891
+	minPayloadSize = 512
+
+	// Size of the message header. RFC 1035
+	headerSize = 12
+
+	// Initial buffer size to build a query, enough for most queries.
+	buildBufferSize = 512
+
+	// Name server identifier, RFC 5001
+	optionCodeNSID = 3
 
 	// EDNS client subnet, RFC 7871
 	// Option code for client subnet.
@@ -27,6 +43,14 @@ const (
 	// Default source prefix length for IPv4 and IPv6.
 	ipv4PrefixLength = 24
 	ipv6PrefixLength = 56
+
+	// DNS cookie, RFC 7873
+	// The client cookie is 8 bytes, optionally followed by the server
+	// cookie of 8 to 32 bytes.
+	optionCodeCookie   = 10
+	clientCookieSize   = 8
+	minServerCookieLen = 8
+	maxServerCookieLen = 32
 )
 
 var (
@@ -53,11 +77,61 @@ func (s *querySession) String() string {
 	fields := []string{
 		strconv.Itoa(int(s.ID)),
 		s.Type.String(),
-		strings.ToLower(s.Name),
+		NormalizeName(s.Name),
 	}
 	return strings.Join(fields, ":")
 }
 
+// Normalize the DNS name (name) for use in keys (e.g., session and cache),
+// i.e., convert the U-labels to the A-labels (see ToASCII()) and to lower
+// case, and remove the final dot if exists.
+// e.g., "www.Example.COM." => "www.example.com"
+// e.g., "www.Bücher.example." => "www.xn--bcher-kva.example"
+func NormalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(ToASCII(name), "."))
+}
+
+// Types known by name, i.e., those that dnsmessage.Type.String() knows.
+var knownTypes = []dnsmessage.Type{
+	dnsmessage.TypeA, dnsmessage.TypeNS, dnsmessage.TypeCNAME,
+	dnsmessage.TypeSOA, dnsmessage.TypePTR, dnsmessage.TypeMX,
+	dnsmessage.TypeTXT, dnsmessage.TypeAAAA, dnsmessage.TypeSRV,
+	dnsmessage.TypeOPT, dnsmessage.TypeWKS, dnsmessage.TypeHINFO,
+	dnsmessage.TypeMINFO, dnsmessage.TypeAXFR, dnsmessage.TypeALL,
+}
+
+// Types unknown by dnsmessage but commonly referred to by name.
+var extraTypes = map[string]dnsmessage.Type{
+	"DS":     43,
+	"RRSIG":  46,
+	"DNSKEY": 48,
+	"SVCB":   64,
+	"HTTPS":  65,
+	"CAA":    257,
+}
+
+// Parse the record type from its name (case-insensitive, e.g., "aaaa"),
+// the generic form (e.g., "TYPE65"; RFC 3597) or the number (e.g., "65").
+func ParseType(s string) (dnsmessage.Type, error) {
+	for _, t := range knownTypes {
+		if strings.EqualFold("Type"+s, t.String()) {
+			return t, nil
+		}
+	}
+	if t, ok := extraTypes[strings.ToUpper(s)]; ok {
+		return t, nil
+	}
+	num := s
+	if len(s) > 4 && strings.EqualFold(s[:4], "TYPE") {
+		num = s[4:]
+	}
+	n, err := strconv.ParseUint(num, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid type [%s]", s)
+	}
+	return dnsmessage.Type(n), nil
+}
+
 type RawMsg []byte
 
 // Parse the raw message (should be a response) and compose the session key
@@ -83,10 +157,537 @@ func (m RawMsg) SessionKey() (string, error) {
 	return s.String(), nil
 }
 
-// Set the QR bit and given RCode.
+// Parse only the header and the first question, which is much cheaper than
+// NewQueryMsg() but already enough for routing the query.
+func (m RawMsg) Question() (dnsmessage.Header, dnsmessage.Question, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(m)
+	if err != nil {
+		return header, dnsmessage.Question{}, &nestedError{"invalid message", err}
+	}
+	question, err := p.Question()
+	if err != nil {
+		return header, question, &nestedError{"invalid question", err}
+	}
+	return header, question, nil
+}
+
+// Get the max UDP payload size that the sender of this message (should be a
+// query) accepts, i.e., the EDNS(0) payload size or 512 if no EDNS.
+// This is cheaper than NewQueryMsg() and fits the fast path.
+func (m RawMsg) UDPSize() int {
+	h, ok := m.optHeader()
+	if !ok {
+		return minPayloadSize
+	}
+	return udpSize(&h)
+}
+
+// Compose the cache key of the message (should be a query), which ignores
+// the query ID as well as the case and final dot of the query name, but
+// distinguishes the class (if not IN), the CD bit, the EDNS presence and
+// the DO bit, because the response differs by them (e.g., the RRSIGs and
+// the OPT record).
+// e.g., "TypeA:www.example.com", "TypeA:www.example.com+edns+do",
+// "TypeTXT/CH:version.bind"
+func (m RawMsg) CacheKey() (string, error) {
+	header, question, err := m.Question()
+	if err != nil {
+		return "", err
+	}
+	key := question.Type.String()
+	if question.Class != dnsmessage.ClassINET {
+		key += "/" + classString(question.Class)
+	}
+	key += ":" + NormalizeName(question.Name.String())
+	if header.CheckingDisabled {
+		key += "+cd"
+	}
+	if h, ok := m.optHeader(); ok {
+		key += "+edns"
+		if h.DNSSECAllowed() {
+			key += "+do"
+		}
+	}
+	return key, nil
+}
+
+// Get the header of the OPT record; false if no EDNS or invalid message.
+func (m RawMsg) optHeader() (dnsmessage.ResourceHeader, bool) {
+	if len(m) < 12 || binary.BigEndian.Uint16(m[10:12]) == 0 {
+		return dnsmessage.ResourceHeader{}, false // ARCOUNT = 0
+	}
+
+	var p dnsmessage.Parser
+	if _, err := p.Start(m); err != nil {
+		return dnsmessage.ResourceHeader{}, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return dnsmessage.ResourceHeader{}, false
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return dnsmessage.ResourceHeader{}, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return dnsmessage.ResourceHeader{}, false
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return dnsmessage.ResourceHeader{}, false
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			return h, true
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return dnsmessage.ResourceHeader{}, false
+		}
+	}
+}
+
+// Get the EDNS client subnet carried in the message (should be a query),
+// which is cheaper than NewQueryMsg() and returns early if no additional
+// records at all.
+func (m RawMsg) EdnsSubnet() (netip.Prefix, bool) {
+	data, ok := m.Option(optionCodeSubnet)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	return parseEdnsSubnet(data)
+}
+
+// Get the scope prefix length of the EDNS client subnet carried in the
+// message (should be a response), i.e., how the upstream honored it; 0 if
+// the answer doesn't depend on the client subnet.
+func (m RawMsg) EdnsSubnetScope() (int, bool) {
+	data, ok := m.Option(optionCodeSubnet)
+	if !ok || len(data) < 4 {
+		return 0, false
+	}
+	return int(data[3]), true
+}
+
+// Get the name server identifier (NSID) carried in the message (should be
+// a response), which is not empty if found.
+func (m RawMsg) NSID() ([]byte, bool) {
+	data, ok := m.Option(optionCodeNSID)
+	if !ok || len(data) == 0 {
+		return nil, false
+	}
+	return data, true
+}
+
+// Get the data of the EDNS option (code) with a boolean indicating whether
+// it's found. Only the first one is returned if multiple.
+func (m RawMsg) Option(code uint16) ([]byte, bool) {
+	for _, op := range m.options() {
+		if op.Code == code {
+			return op.Data, true
+		}
+	}
+	return nil, false
+}
+
+// Check whether the message (should be a query) carries any malformed
+// known EDNS option, see validOption().
+func (m RawMsg) HasInvalidOption() bool {
+	for _, op := range m.options() {
+		if !validOption(op) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the data of all the EDNS options of the code (code).
+func (m RawMsg) Options(code uint16) [][]byte {
+	var data [][]byte
+	for _, op := range m.options() {
+		if op.Code == code {
+			data = append(data, op.Data)
+		}
+	}
+	return data
+}
+
+// Get all the EDNS options; nil if no OPT record or invalid message.
+func (m RawMsg) options() []dnsmessage.Option {
+	if len(m) < 12 || binary.BigEndian.Uint16(m[10:12]) == 0 {
+		return nil // ARCOUNT = 0
+	}
+
+	var p dnsmessage.Parser
+	if _, err := p.Start(m); err != nil {
+		return nil
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return nil
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return nil
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return nil
+		}
+		if h.Type != dnsmessage.TypeOPT {
+			if err := p.SkipAdditional(); err != nil {
+				return nil
+			}
+			continue
+		}
+		opt, err := p.OPTResource()
+		if err != nil {
+			return nil
+		}
+		return opt.Options
+	}
+}
+
+// Append the EDNS option (code and data) to the message, adding an OPT
+// record if missing, and return the new message.
+// This works on the wire format directly, so it's much cheaper than
+// NewQueryMsg() + Build() and keeps the other records intact.
+func (m RawMsg) AppendOption(code uint16, data []byte) ([]byte, error) {
+	if len(m) < 12 {
+		return nil, errors.New("message too short")
+	}
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(m[4+2*i:]))
+	}
+
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		if off = skipName(m, off); off < 0 || off+4 > len(m) {
+			return nil, errors.New("invalid question")
+		}
+		off += 4 // type, class
+	}
+	optLenOff, optEnd := -1, -1 // offset of OPT RDLENGTH and RDATA end
+	nrr := counts[1] + counts[2] + counts[3]
+	for i := 0; i < nrr; i++ {
+		if off = skipName(m, off); off < 0 || off+10 > len(m) {
+			return nil, errors.New("invalid resource record")
+		}
+		rtype := dnsmessage.Type(binary.BigEndian.Uint16(m[off:]))
+		rdlen := int(binary.BigEndian.Uint16(m[off+8:]))
+		end := off + 10 + rdlen
+		if end > len(m) {
+			return nil, errors.New("invalid resource record")
+		}
+		if i >= counts[1]+counts[2] && rtype == dnsmessage.TypeOPT {
+			optLenOff, optEnd = off+8, end
+		}
+		off = end
+	}
+
+	// Option format: code (2B), length (2B), data
+	option := make([]byte, 0, 4+len(data))
+	option = binary.BigEndian.AppendUint16(option, code)
+	option = binary.BigEndian.AppendUint16(option, uint16(len(data)))
+	option = append(option, data...)
+
+	if optLenOff < 0 {
+		out := make([]byte, 0, len(m)+11+len(option))
+		out = append(out, m...)
+		out = append(out, 0) // root name
+		out = binary.BigEndian.AppendUint16(out, uint16(dnsmessage.TypeOPT))
+		out = binary.BigEndian.AppendUint16(out, maxPayloadSize) // class
+		out = binary.BigEndian.AppendUint32(out, 0)              // TTL
+		out = binary.BigEndian.AppendUint16(out, uint16(len(option)))
+		out = append(out, option...)
+		binary.BigEndian.PutUint16(out[10:], uint16(counts[3]+1))
+		return out, nil
+	}
+
+	rdlen := int(binary.BigEndian.Uint16(m[optLenOff:])) + len(option)
+	if rdlen > 0xffff {
+		return nil, errors.New("OPT record too large")
+	}
+	out := make([]byte, 0, len(m)+len(option))
+	out = append(out, m[:optEnd]...)
+	out = append(out, option...)
+	out = append(out, m[optEnd:]...)
+	binary.BigEndian.PutUint16(out[optLenOff:], uint16(rdlen))
+	return out, nil
+}
+
+// Cut the last additional record off the message, e.g., the TSIG record
+// that must be the last (RFC 8945, Section 5.1), and return a copy of the
+// message without it (i.e., with ARCOUNT decreased).
+func (m RawMsg) CutLastAdditional() (RawMsg, error) {
+	if len(m) < headerSize {
+		return nil, errors.New("message too short")
+	}
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(m[4+2*i:]))
+	}
+	if counts[3] == 0 {
+		return nil, errors.New("no additional record")
+	}
+
+	off := headerSize
+	for range counts[0] {
+		if off = skipName(m, off); off < 0 || off+4 > len(m) {
+			return nil, errors.New("invalid question")
+		}
+		off += 4 // type, class
+	}
+	last := -1
+	nrr := counts[1] + counts[2] + counts[3]
+	for range nrr {
+		last = off
+		if off = skipName(m, off); off < 0 || off+10 > len(m) {
+			return nil, errors.New("invalid resource record")
+		}
+		off += 10 + int(binary.BigEndian.Uint16(m[off+8:]))
+		if off > len(m) {
+			return nil, errors.New("invalid resource record")
+		}
+	}
+	if off != len(m) {
+		return nil, errors.New("trailing data")
+	}
+
+	out := bytes.Clone(m[:last])
+	binary.BigEndian.PutUint16(out[10:], uint16(counts[3]-1))
+	return out, nil
+}
+
+// Get the minimum TTL of the records in the answer and authority sections,
+// with a boolean indicating whether any record is found in the valid
+// message.
+func (m RawMsg) MinTTL() (uint32, bool) {
+	offsets, ok := m.ttlOffsets()
+	if !ok || len(offsets) == 0 {
+		return 0, false
+	}
+	ttl := uint32(math.MaxUint32)
+	for _, off := range offsets {
+		ttl = min(ttl, binary.BigEndian.Uint32(m[off:]))
+	}
+	return ttl, true
+}
+
+// Get the TTLs of the records in the answer and authority sections in
+// order; nil if the message is invalid.
+func (m RawMsg) AllTTLs() []uint32 {
+	offsets, ok := m.ttlOffsets()
+	if !ok {
+		return nil
+	}
+	ttls := make([]uint32, len(offsets))
+	for i, off := range offsets {
+		ttls[i] = binary.BigEndian.Uint32(m[off:])
+	}
+	return ttls
+}
+
+// Get the offsets of the TTL fields of the records in the answer and
+// authority sections, by walking the message once without unpacking;
+// false if the message is invalid.
+// NOTE: The additional section is skipped, where the TTL field of the OPT
+// record holds the extended RCODE and flags.
+func (m RawMsg) ttlOffsets() ([]int, bool) {
+	if len(m) < headerSize {
+		return nil, false
+	}
+	qdcount := int(binary.BigEndian.Uint16(m[4:]))
+	nrr := int(binary.BigEndian.Uint16(m[6:])) + int(binary.BigEndian.Uint16(m[8:]))
+
+	off := headerSize
+	for range qdcount {
+		if off = skipName(m, off); off < 0 || off+4 > len(m) {
+			return nil, false
+		}
+		off += 4 // type, class
+	}
+	offsets := make([]int, 0, nrr)
+	for range nrr {
+		if off = skipName(m, off); off < 0 || off+10 > len(m) {
+			return nil, false
+		}
+		offsets = append(offsets, off+4) // after type, class
+		off += 10 + int(binary.BigEndian.Uint16(m[off+8:]))
+		if off > len(m) {
+			return nil, false
+		}
+	}
+	return offsets, true
+}
+
+// Skip the name starting at offset (off) in the message (m).
+// Return the offset after the name, or -1 if invalid.
+func skipName(m []byte, off int) int {
+	for {
+		if off >= len(m) {
+			return -1
+		}
+		c := int(m[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				return off + 1 // root label
+			}
+			off += 1 + c
+		case 0xC0:
+			return off + 2 // compression pointer ends the name
+		default:
+			return -1 // reserved label types
+		}
+	}
+}
+
+// Truncate the message (should be a response) to only the header (with the
+// TC bit set), the questions and the OPT record if exists, which tells the
+// client to retry over TCP.
+func (m RawMsg) Truncate() ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(m)
+	if err != nil {
+		return nil, &nestedError{"invalid message", err}
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, &nestedError{"invalid question", err}
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return nil, &nestedError{"skip answers error", err}
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return nil, &nestedError{"skip authorities error", err}
+	}
+
+	var optHeader *dnsmessage.ResourceHeader
+	var opt dnsmessage.OPTResource
+	for {
+		h, err := p.AdditionalHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, &nestedError{"invalid additional header", err}
+		}
+		if h.Type != dnsmessage.TypeOPT {
+			if err := p.SkipAdditional(); err != nil {
+				return nil, &nestedError{"skip additional error", err}
+			}
+			continue
+		}
+		opt, err = p.OPTResource()
+		if err != nil {
+			return nil, &nestedError{"invalid OPT resource", err}
+		}
+		optHeader = &h
+		break
+	}
+
+	header.Truncated = true
+	b := dnsmessage.NewBuilder(make([]byte, 0, buildBufferSize), header)
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, q := range questions {
+		if err := b.Question(q); err != nil {
+			return nil, err
+		}
+	}
+	if optHeader != nil {
+		if err := b.StartAdditionals(); err != nil {
+			return nil, err
+		}
+		if err := b.OPTResource(*optHeader, opt); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// Header flags, i.e., the bits in the second 16-bit word of the header
+// other than the OPCODE and RCODE. RFC 1035, RFC 4035
+type Flags uint16
+
+const (
+	FlagQR Flags = 1 << 15 // response
+	FlagAA Flags = 1 << 10 // authoritative answer
+	FlagTC Flags = 1 << 9  // truncated
+	FlagRD Flags = 1 << 8  // recursion desired
+	FlagRA Flags = 1 << 7  // recursion available
+	FlagAD Flags = 1 << 5  // authentic data
+	FlagCD Flags = 1 << 4  // checking disabled
+
+	flagsMask = FlagQR | FlagAA | FlagTC | FlagRD | FlagRA | 1<<6 /* Z */ | FlagAD | FlagCD
+)
+
+// Get the header flags; 0 if the message is shorter than the header.
+func (m RawMsg) Flags() Flags {
+	if len(m) < headerSize {
+		return 0
+	}
+	return Flags(binary.BigEndian.Uint16(m[2:])) & flagsMask
+}
+
+// Set the header flags (set) and clear the others (clear).
+// It does nothing if the message is shorter than the header, and so do
+// the other header setters below.
+func (m RawMsg) SetFlags(set, clear Flags) {
+	if len(m) < headerSize {
+		return
+	}
+	v := Flags(binary.BigEndian.Uint16(m[2:]))
+	v = v&^(clear&flagsMask) | set&flagsMask
+	binary.BigEndian.PutUint16(m[2:], uint16(v))
+}
+
+// Set the QR bit, i.e., make it a response.
+func (m RawMsg) SetResponse() {
+	m.SetFlags(FlagQR, 0)
+}
+
+// Set or clear the TC bit, i.e., mark it truncated or not.
+func (m RawMsg) SetTC(truncated bool) {
+	if truncated {
+		m.SetFlags(FlagTC, 0)
+	} else {
+		m.SetFlags(0, FlagTC)
+	}
+}
+
+// Set the QR bit and the RCode (the lower 4 bits only; the extended ones
+// are in the OPT record), replacing the previous RCode.
 func (m RawMsg) SetRCode(rcode dnsmessage.RCode) {
-	m[2] |= 0x80 // Set QR bit -> response
-	m[3] |= byte(rcode & 0xF)
+	if len(m) < headerSize {
+		return
+	}
+	m.SetResponse()
+	m[3] = m[3]&^0xF | byte(rcode&0xF)
+}
+
+// Zero the counts of the answer, authority and additional records, and
+// return the message cut after the questions, i.e., dropping the records.
+// The counts are zeroed anyway even if the questions are malformed, in
+// which case the message is returned as is.
+func (m RawMsg) ZeroCounts() RawMsg {
+	if len(m) < headerSize {
+		return m
+	}
+	clear(m[6:headerSize])
+	qdcount := int(binary.BigEndian.Uint16(m[4:]))
+	off := headerSize
+	for range qdcount {
+		off = skipName(m, off)
+		if off < 0 || off+4 > len(m) {
+			return m
+		}
+		off += 4 // type and class
+	}
+	return m[:off]
 }
 
 // Get the query ID.
@@ -103,6 +704,9 @@ type QueryMsg struct {
 	Header   dnsmessage.Header
 	Question dnsmessage.Question
 	// EDNS pseudo resource
+	// NOTE: All the options (including unknown ones, e.g., cookie, padding)
+	// are kept as is and sent along in Build(); only the ECS option would
+	// be replaced by SetEdnsSubnet().
 	OPT struct {
 		Header  *dnsmessage.ResourceHeader
 		Options []dnsmessage.Option
@@ -183,6 +787,21 @@ func (m *QueryMsg) QName() string {
 	return m.Question.Name.String()
 }
 
+// Get the max UDP payload size that the client accepts, i.e., the EDNS(0)
+// payload size or 512 if no EDNS.
+func (m *QueryMsg) UDPSize() int {
+	if m.OPT.Header == nil {
+		return minPayloadSize
+	}
+	return udpSize(m.OPT.Header)
+}
+
+// Get the UDP payload size from the OPT header (h), which is stored in the
+// class field and shouldn't be less than 512.
+func udpSize(h *dnsmessage.ResourceHeader) int {
+	return max(int(h.Class), minPayloadSize)
+}
+
 // Compose the session key.
 func (m *QueryMsg) SessionKey() string {
 	s := &querySession{
@@ -193,34 +812,157 @@ func (m *QueryMsg) SessionKey() string {
 	return s.String()
 }
 
+// Set the EDNS client subnet option with the address (ip) cut to the source
+// prefix length (prefixLen), replacing the existing one if any.
+// The default prefix length (/24 for IPv4 and /56 for IPv6) is used if
+// prefixLen is out of range.
 func (m *QueryMsg) SetEdnsSubnet(ip netip.Addr, prefixLen int) error {
 	if !ip.IsValid() || ip.IsUnspecified() {
 		return ErrInvalidIP
 	}
 
+	m.ensureOPT()
+	if ip.Is4() {
+		if prefixLen <= 0 || prefixLen > 32 {
+			prefixLen = ipv4PrefixLength
+		}
+	} else {
+		if prefixLen <= 0 || prefixLen > 128 {
+			prefixLen = ipv6PrefixLength
+		}
+	}
+	m.setOption(newEdnsSubnetOption(ip, prefixLen))
+
+	return nil
+}
+
+// Request the name server identifier (NSID) by the empty option, e.g., to
+// tell which anycast node of the upstream answers.
+func (m *QueryMsg) SetEdnsNSID() {
+	m.ensureOPT()
+	m.setOption(dnsmessage.Option{Code: optionCodeNSID, Data: []byte{}})
+}
+
+// Add the OPT record with the default payload size if not exists.
+func (m *QueryMsg) ensureOPT() {
 	if m.OPT.Header == nil {
 		rh := dnsmessage.ResourceHeader{}
 		rh.SetEDNS0(maxPayloadSize, 0 /* extRCode */, false /* dnssecOK */)
 		m.OPT.Header = &rh
 	}
+}
+
+// Limit the precision of the existing EDNS client subnet option (e.g., sent
+// by the client) to at most maxV4/maxV6 bits for IPv4/IPv6.
+// Return true if the option has been changed.
+func (m *QueryMsg) LimitEdnsSubnet(maxV4, maxV6 int) bool {
+	for _, op := range m.OPT.Options {
+		if op.Code != optionCodeSubnet {
+			continue
+		}
+		prefix, ok := parseEdnsSubnet(op.Data)
+		if !ok {
+			return false
+		}
+		limit := maxV6
+		if prefix.Addr().Is4() {
+			limit = maxV4
+		}
+		if prefix.Bits() <= limit {
+			return false
+		}
+		m.setOption(newEdnsSubnetOption(prefix.Addr(), limit))
+		return true
+	}
+	return false
+}
+
+// Set the option (option), replacing the existing one with the same code.
+func (m *QueryMsg) setOption(option dnsmessage.Option) {
+	for i := 0; i < len(m.OPT.Options); i++ {
+		op := &m.OPT.Options[i]
+		if op.Code == option.Code {
+			op.Data = option.Data
+			return
+		}
+	}
+	m.OPT.Options = append(m.OPT.Options, option)
+}
+
+// Remove the malformed known EDNS options (see validOption()), which would
+// otherwise be sent along in Build() and make a broken query.
+// Return the codes of the removed options.
+func (m *QueryMsg) RemoveInvalidOptions() []uint16 {
+	var codes []uint16
+	m.OPT.Options = slices.DeleteFunc(m.OPT.Options, func(op dnsmessage.Option) bool {
+		if validOption(op) {
+			return false
+		}
+		codes = append(codes, op.Code)
+		return true
+	})
+	return codes
+}
+
+// Check the data of the known EDNS option (op) in a query is well-formed,
+// i.e., the ECS (RFC 7871, Section 6) of a known family has the address
+// of exactly the source prefix length without any bits set beyond, and a
+// zero scope prefix length; and the cookie (RFC 7873, Section 4) is of
+// either the client cookie alone or with a server cookie.
+// The unknown options are always valid.
+func validOption(op dnsmessage.Option) bool {
+	switch op.Code {
+	case optionCodeSubnet:
+		if len(op.Data) < 4 || op.Data[3] != 0 {
+			return false
+		}
+		family, bits, address := binary.BigEndian.Uint16(op.Data), int(op.Data[2]), op.Data[4:]
+		maxBits := 0
+		switch family {
+		case 1:
+			maxBits = 32
+		case 2:
+			maxBits = 128
+		default:
+			return false
+		}
+		if bits > maxBits || len(address) != (bits+7)/8 {
+			return false
+		}
+		if bits%8 != 0 && address[len(address)-1]&(0xff>>(bits%8)) != 0 {
+			return false
+		}
+		return true
+	case optionCodeCookie:
+		n := len(op.Data) - clientCookieSize
+		return n == 0 || (n >= minServerCookieLen && n <= maxServerCookieLen)
+	default:
+		return true
+	}
+}
 
-	// Client Subnet (RFC 7871)
+// Remove the option (code) if exists.
+// Return true if the option has been removed.
+func (m *QueryMsg) RemoveOption(code uint16) bool {
+	n := len(m.OPT.Options)
+	m.OPT.Options = slices.DeleteFunc(m.OPT.Options, func(op dnsmessage.Option) bool {
+		return op.Code == code
+	})
+	return len(m.OPT.Options) != n
+}
+
+// Make the EDNS client subnet option (RFC 7871) with the address (ip) cut to
+// the source prefix length (prefixLen).
+func newEdnsSubnetOption(ip netip.Addr, prefixLen int) dnsmessage.Option {
 	var family uint16
 	var address []byte
+	prefix, _ := ip.Prefix(prefixLen)
 	if ip.Is4() {
 		family = uint16(1)
-		if prefixLen <= 0 || prefixLen > 32 {
-			prefixLen = ipv4PrefixLength
-		}
-		prefix, _ := ip.Prefix(prefixLen)
 		a4 := prefix.Addr().As4()
 		address = a4[:((prefixLen + 7) / 8)]
 	} else {
 		family = uint16(2)
-		if prefixLen <= 0 || prefixLen > 128 {
-			prefixLen = ipv6PrefixLength
-		}
-		prefix, _ := ip.Prefix(prefixLen)
 		a16 := prefix.Addr().As16()
 		address = a16[:((prefixLen + 7) / 8)]
 	}
@@ -235,39 +977,61 @@ func (m *QueryMsg) SetEdnsSubnet(ip netip.Addr, prefixLen int) error {
 	buf = append(buf, byte(prefixLen)) // source prefix length
 	buf = append(buf, byte(0))         // scope prefix length
 	buf = append(buf, address...)
-	option := dnsmessage.Option{
+	return dnsmessage.Option{
 		Code: optionCodeSubnet,
 		Data: buf,
 	}
+}
 
-	exists := false
-	for i := 0; i < len(m.OPT.Options); i++ {
-		op := &m.OPT.Options[i]
-		if op.Code == option.Code {
-			op.Data = option.Data
-			exists = true
-			break
-		}
+// Parse the EDNS client subnet option data (data) into the source prefix.
+func parseEdnsSubnet(data []byte) (netip.Prefix, bool) {
+	if len(data) < 4 {
+		return netip.Prefix{}, false
 	}
-	if !exists {
-		m.OPT.Options = append(m.OPT.Options, option)
+	family, bits, address := binary.BigEndian.Uint16(data), int(data[2]), data[4:]
+	var addr netip.Addr
+	switch family {
+	case 1:
+		var a4 [4]byte
+		if len(address) > len(a4) {
+			return netip.Prefix{}, false
+		}
+		copy(a4[:], address)
+		addr = netip.AddrFrom4(a4)
+	case 2:
+		var a16 [16]byte
+		if len(address) > len(a16) {
+			return netip.Prefix{}, false
+		}
+		copy(a16[:], address)
+		addr = netip.AddrFrom16(a16)
+	default:
+		return netip.Prefix{}, false
 	}
-
-	return nil
+	prefix := netip.PrefixFrom(addr, bits)
+	return prefix, prefix.IsValid()
 }
 
+// Build the query message.
+// NOTE: Use the builder without name compression, which is pointless for a
+// query with only one question but would allocate the compression map.
 func (m *QueryMsg) Build() ([]byte, error) {
-	msg := dnsmessage.Message{
-		Header:    m.Header,
-		Questions: []dnsmessage.Question{m.Question},
+	b := dnsmessage.NewBuilder(make([]byte, 0, buildBufferSize), m.Header)
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(m.Question); err != nil {
+		return nil, err
 	}
 	if m.OPT.Header != nil {
-		r := dnsmessage.Resource{
-			Header: *m.OPT.Header,
-			Body:   &dnsmessage.OPTResource{Options: m.OPT.Options},
+		if err := b.StartAdditionals(); err != nil {
+			return nil, err
+		}
+		r := dnsmessage.OPTResource{Options: m.OPT.Options}
+		if err := b.OPTResource(*m.OPT.Header, r); err != nil {
+			return nil, err
 		}
-		msg.Additionals = []dnsmessage.Resource{r}
 	}
 
-	return msg.Pack()
+	return b.Finish()
 }
@@ -8,10 +8,12 @@
 package dnsmsg
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net/netip"
+	"slices"
 	"testing"
 
 	"golang.org/x/net/dns/dnsmessage"
@@ -39,12 +41,22 @@ func TestRawMsg1(t *testing.T) {
 		t.Errorf(`GetID() = 0x%x; want 0x%x`, id, qid)
 	}
 
-	sessionKey := fmt.Sprintf("%d:%s:%s", qid, qtype, qname)
+	sessionKey := fmt.Sprintf("%d:%s:%s", qid, qtype, "www.example.com")
 	if skey, err := rmsg.SessionKey(); err != nil || skey != sessionKey {
 		t.Errorf(`SessionKey() = (%q, %v); want (%q, nil)`,
 			skey, err, sessionKey)
 	}
 
+	if h, q, err := rmsg.Question(); err != nil {
+		t.Errorf(`Question() failed: %v`, err)
+	} else if h.ID != qid || q.Type != qtype || q.Name.String() != qname {
+		t.Errorf(`Question() = (%+v, %+v); want ID=0x%x, Type=%s, Name=%s`,
+			h, q, qid, qtype, qname)
+	}
+	if _, _, err := RawMsg(buf[:12]).Question(); err == nil {
+		t.Errorf(`Question() on header only = nil; want error`)
+	}
+
 	qid = uint16(0x4321)
 	rmsg.SetID(qid)
 	if id := rmsg.GetID(); id != qid {
@@ -52,6 +64,191 @@ func TestRawMsg1(t *testing.T) {
 	}
 }
 
+func TestUDPSize(t *testing.T) {
+	question := dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("www.example.com."),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	}
+	newOPT := func(size uint16) dnsmessage.Resource {
+		rh := dnsmessage.ResourceHeader{}
+		rh.SetEDNS0(int(size), 0, false)
+		return dnsmessage.Resource{Header: rh, Body: &dnsmessage.OPTResource{}}
+	}
+
+	tests := []struct {
+		additionals []dnsmessage.Resource
+		size        int
+	}{
+		{nil, 512},
+		{[]dnsmessage.Resource{newOPT(1232)}, 1232},
+		{[]dnsmessage.Resource{newOPT(4096)}, 4096},
+		{[]dnsmessage.Resource{newOPT(100)}, 512}, // lower bound
+	}
+	for i, tc := range tests {
+		dmsg := dnsmessage.Message{
+			Header:      dnsmessage.Header{ID: 0x1234},
+			Questions:   []dnsmessage.Question{question},
+			Additionals: tc.additionals,
+		}
+		buf, err := dmsg.Pack()
+		if err != nil {
+			t.Fatalf("[%d] failed to pack: %v", i, err)
+		}
+		if size := RawMsg(buf).UDPSize(); size != tc.size {
+			t.Errorf(`[%d] RawMsg.UDPSize() = %d; want %d`, i, size, tc.size)
+		}
+		qmsg, err := NewQueryMsg(buf)
+		if err != nil {
+			t.Fatalf("[%d] NewQueryMsg() failed: %v", i, err)
+		}
+		if size := qmsg.UDPSize(); size != tc.size {
+			t.Errorf(`[%d] QueryMsg.UDPSize() = %d; want %d`, i, size, tc.size)
+		}
+	}
+
+	if size := RawMsg([]byte{0x1, 0x2}).UDPSize(); size != 512 {
+		t.Errorf(`UDPSize() on junk = %d; want 512`, size)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	name := dnsmessage.MustNewName("www.example.com.")
+	rh := dnsmessage.ResourceHeader{}
+	rh.SetEDNS0(1232, 0, false)
+	dmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0x1234, Response: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		},
+		Additionals: []dnsmessage.Resource{
+			{Header: rh, Body: &dnsmessage.OPTResource{}},
+		},
+	}
+	for i := 0; i < 50; i++ {
+		dmsg.Answers = append(dmsg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  name,
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   300,
+			},
+			Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, byte(i)}},
+		})
+	}
+	buf, _ := dmsg.Pack()
+
+	tbuf, err := RawMsg(buf).Truncate()
+	if err != nil {
+		t.Fatalf(`Truncate() failed: %v`, err)
+	}
+	var tmsg dnsmessage.Message
+	if err := tmsg.Unpack(tbuf); err != nil {
+		t.Fatalf(`failed to unpack truncated message: %v`, err)
+	}
+	if !tmsg.Header.Truncated || tmsg.Header.ID != 0x1234 {
+		t.Errorf(`Header = %+v; want ID=0x1234 with TC set`, tmsg.Header)
+	}
+	if len(tmsg.Questions) != 1 || len(tmsg.Answers) != 0 {
+		t.Errorf(`len(Questions/Answers) = %d/%d; want 1/0`,
+			len(tmsg.Questions), len(tmsg.Answers))
+	}
+	if len(tmsg.Additionals) != 1 || tmsg.Additionals[0].Header.Type != dnsmessage.TypeOPT {
+		t.Errorf(`Additionals = %+v; want OPT only`, tmsg.Additionals)
+	}
+}
+
+func TestRawMsgHeader(t *testing.T) {
+	name := dnsmessage.MustNewName("www.example.com.")
+	dmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               0x1234,
+			OpCode:           2,
+			Authoritative:    true,
+			RecursionDesired: true,
+			RCode:            dnsmessage.RCodeNameError,
+		},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		},
+		Answers: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{
+					Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET,
+				},
+				Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			},
+		},
+	}
+	buf, _ := dmsg.Pack()
+	rmsg := RawMsg(buf)
+
+	if f := rmsg.Flags(); f != FlagAA|FlagRD {
+		t.Errorf(`Flags() = 0x%x; want 0x%x`, f, FlagAA|FlagRD)
+	}
+
+	rmsg.SetTC(true)
+	rmsg.SetFlags(FlagRA|FlagCD, FlagAA)
+	rmsg.SetRCode(dnsmessage.RCodeServerFailure) // replacing NXDOMAIN; QR set
+	rmsg = rmsg.ZeroCounts()
+
+	// Compare with the fully parsed equivalent.
+	want := dmsg
+	want.Header.Response = true
+	want.Header.Truncated = true
+	want.Header.RecursionAvailable = true
+	want.Header.CheckingDisabled = true
+	want.Header.Authoritative = false
+	want.Header.RCode = dnsmessage.RCodeServerFailure
+	want.Answers = nil
+	wbuf, _ := want.Pack()
+
+	var got dnsmessage.Message
+	if err := got.Unpack(rmsg); err != nil {
+		t.Fatalf(`failed to unpack message: %v`, err)
+	}
+	if got.Header != want.Header {
+		t.Errorf(`Header = %+v; want %+v`, got.Header, want.Header)
+	}
+	if string(rmsg) != string(wbuf) {
+		t.Errorf(`message = %x; want %x`, []byte(rmsg), wbuf)
+	}
+
+	// The OPCODE is never touched.
+	rmsg.SetFlags(0xffff, 0)
+	if h, _, _ := rmsg.Question(); h.OpCode != 2 || h.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf(`Header = %+v; want OpCode=2, RCode=ServerFailure`, h)
+	}
+
+	rmsg.SetTC(false)
+	if f := rmsg.Flags(); f&FlagTC != 0 {
+		t.Errorf(`Flags() = 0x%x after SetTC(false); want TC cleared`, f)
+	}
+
+	// Short buffers: untouched without panic.
+	for n := range 12 {
+		short := RawMsg(make([]byte, n))
+		short.SetRCode(dnsmessage.RCodeServerFailure)
+		short.SetTC(true)
+		short.SetFlags(FlagQR, 0)
+		if f := short.Flags(); f != 0 || len(short.ZeroCounts()) != n {
+			t.Errorf(`[%d] short message modified`, n)
+		}
+		for _, b := range short {
+			if b != 0 {
+				t.Errorf(`[%d] short message modified: %x`, n, []byte(short))
+				break
+			}
+		}
+	}
+
+	// Malformed questions: only the counts are zeroed.
+	bad := RawMsg(append([]byte{}, buf[:14]...))
+	if z := bad.ZeroCounts(); len(z) != len(bad) {
+		t.Errorf(`ZeroCounts() on malformed = %d bytes; want %d`, len(z), len(bad))
+	}
+}
+
 func TestQueryMsg1(t *testing.T) {
 	// Nil message must not panic.
 	if q, err := NewQueryMsg(nil); q != nil || err == nil {
@@ -95,12 +292,143 @@ func TestQueryMsg2(t *testing.T) {
 		t.Errorf(`NewQueryMsg() = (%v, %v); want (!nil, nil)`, q, err)
 	}
 
-	sessionKey := fmt.Sprintf("%d:%s:%s", qid, qtype, qname)
+	sessionKey := fmt.Sprintf("%d:%s:%s", qid, qtype, "www.example.com")
 	if skey := q.SessionKey(); skey != sessionKey {
 		t.Errorf(`SessionKey() = %q; want %q`, skey, sessionKey)
 	}
 }
 
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "", expected: ""},
+		{name: ".", expected: ""},
+		{name: "com", expected: "com"},
+		{name: "COM.", expected: "com"},
+		{name: "www.Example.COM.", expected: "www.example.com"},
+		{name: "www.example.com", expected: "www.example.com"},
+		{name: "www.Bücher.example.", expected: "www.xn--bcher-kva.example"},
+	}
+	for _, tc := range tests {
+		if n := NormalizeName(tc.name); n != tc.expected {
+			t.Errorf(`NormalizeName(%q) = %q; want %q`, tc.name, n, tc.expected)
+		}
+	}
+}
+
+func TestParseType(t *testing.T) {
+	tests := []struct {
+		s     string
+		qtype dnsmessage.Type
+		ok    bool
+	}{
+		{"A", dnsmessage.TypeA, true},
+		{"aaaa", dnsmessage.TypeAAAA, true},
+		{"Cname", dnsmessage.TypeCNAME, true},
+		{"TYPE65", dnsmessage.Type(65), true},
+		{"type28", dnsmessage.TypeAAAA, true},
+		{"64", dnsmessage.Type(64), true},
+		{"https", dnsmessage.Type(65), true},
+		{"SVCB", dnsmessage.Type(64), true},
+		{"", 0, false},
+		{"TypeA", 0, false},
+		{"BOGUS", 0, false},
+		{"TYPE", 0, false},
+		{"65536", 0, false},
+	}
+	for _, tc := range tests {
+		qtype, err := ParseType(tc.s)
+		if ok := err == nil; ok != tc.ok || (ok && qtype != tc.qtype) {
+			t.Errorf(`ParseType(%q) = (%v, %v); want (%v, ok=%t)`,
+				tc.s, qtype, err, tc.qtype, tc.ok)
+		}
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	names := []string{
+		"www.example.com.",
+		"www.Example.com.",
+		"WWW.EXAMPLE.COM.",
+		"wWw.eXaMpLe.CoM.",
+	}
+	keys := map[string]struct{}{}
+	for i, name := range names {
+		dmsg := dnsmessage.Message{
+			Header: dnsmessage.Header{ID: uint16(i)},
+			Questions: []dnsmessage.Question{
+				{
+					Name:  dnsmessage.MustNewName(name),
+					Type:  dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET,
+				},
+			},
+		}
+		msg, _ := dmsg.Pack()
+		key, err := RawMsg(msg).CacheKey()
+		if err != nil || key != "TypeA:www.example.com" {
+			t.Errorf(`CacheKey(%q) = (%q, %v); want %q`, name, key, err, "TypeA:www.example.com")
+		}
+		keys[key] = struct{}{}
+	}
+	if len(keys) != 1 {
+		t.Errorf(`CacheKey() => %d distinct keys; want 1`, len(keys))
+	}
+
+	// The CD bit, EDNS and the DO bit are distinguished.
+	for _, tc := range []struct {
+		cd, edns, do bool
+		key          string
+	}{
+		{cd: true, key: "TypeA:www.example.com+cd"},
+		{edns: true, key: "TypeA:www.example.com+edns"},
+		{edns: true, do: true, key: "TypeA:www.example.com+edns+do"},
+		{cd: true, edns: true, do: true, key: "TypeA:www.example.com+cd+edns+do"},
+	} {
+		dmsg := dnsmessage.Message{
+			Header: dnsmessage.Header{CheckingDisabled: tc.cd},
+			Questions: []dnsmessage.Question{
+				{
+					Name:  dnsmessage.MustNewName("www.example.com."),
+					Type:  dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET,
+				},
+			},
+		}
+		if tc.edns {
+			rh := dnsmessage.ResourceHeader{}
+			rh.SetEDNS0(1232, 0 /* extRCode */, tc.do)
+			dmsg.Additionals = []dnsmessage.Resource{
+				{Header: rh, Body: &dnsmessage.OPTResource{}},
+			}
+		}
+		msg, _ := dmsg.Pack()
+		if key, err := RawMsg(msg).CacheKey(); err != nil || key != tc.key {
+			t.Errorf(`CacheKey() = (%q, %v); want %q`, key, err, tc.key)
+		}
+	}
+
+	// The class is distinguished if not IN.
+	dmsg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{
+			{
+				Name:  dnsmessage.MustNewName("version.bind."),
+				Type:  dnsmessage.TypeTXT,
+				Class: dnsmessage.ClassCHAOS,
+			},
+		},
+	}
+	msg, _ := dmsg.Pack()
+	if key, err := RawMsg(msg).CacheKey(); err != nil || key != "TypeTXT/CH:version.bind" {
+		t.Errorf(`CacheKey() = (%q, %v); want %q`, key, err, "TypeTXT/CH:version.bind")
+	}
+	if _, err := RawMsg([]byte{0x12}).CacheKey(); err == nil {
+		t.Errorf(`CacheKey() of invalid message = nil error; want error`)
+	}
+}
+
 func TestQueryMsg3(t *testing.T) {
 	resOPT1 := dnsmessage.Resource{
 		Header: dnsmessage.ResourceHeader{
@@ -336,6 +664,350 @@ func TestSetEdnsSubnet1(t *testing.T) {
 	}
 }
 
+func TestSetEdnsSubnet2(t *testing.T) {
+	// EDNS options from the client that must survive the rebuild.
+	options := []dnsmessage.Option{
+		{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}, // cookie
+		{Code: 11, Data: []byte{}},                       // tcp-keepalive
+		{Code: 12, Data: []byte{0, 0, 0, 0}},             // padding
+		{Code: 65001, Data: []byte("unknown")},           // local/experimental
+	}
+	rh := dnsmessage.ResourceHeader{}
+	rh.SetEDNS0(4096, 0 /* extRCode */, true /* dnssecOK */)
+	dmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(0x1234)},
+		Questions: []dnsmessage.Question{
+			{
+				Name:  dnsmessage.MustNewName("www.example.com."),
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+			},
+		},
+		Additionals: []dnsmessage.Resource{
+			{
+				Header: rh,
+				Body:   &dnsmessage.OPTResource{Options: options},
+			},
+		},
+	}
+	msg, _ := dmsg.Pack()
+
+	qmsg, err := NewQueryMsg(msg)
+	if err != nil {
+		t.Fatalf(`NewQueryMsg() failed: %v`, err)
+	}
+	addr := netip.MustParseAddr("1.2.3.4")
+	if err := qmsg.SetEdnsSubnet(addr, 0); err != nil {
+		t.Fatalf(`SetEdnsSubnet() failed: %v`, err)
+	}
+	msg, err = qmsg.Build()
+	if err != nil {
+		t.Fatalf(`Build() failed: %v`, err)
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		t.Fatalf(`Unpack() failed: %v`, err)
+	}
+	if n := len(m.Additionals); n != 1 {
+		t.Fatalf(`len(Additionals) = %d; want 1`, n)
+	}
+	opt := m.Additionals[0]
+	if !opt.Header.DNSSECAllowed() || opt.Header.Class != 4096 {
+		t.Errorf(`OPT header = %+v; want DO bit and payload 4096`, opt.Header)
+	}
+	got := opt.Body.(*dnsmessage.OPTResource).Options
+	if n := len(got); n != len(options)+1 {
+		t.Fatalf(`len(Options) = %d; want %d`, n, len(options)+1)
+	}
+	for i, op := range options {
+		if got[i].Code != op.Code || string(got[i].Data) != string(op.Data) {
+			t.Errorf(`Options[%d] = %+v; want %+v`, i, got[i], op)
+		}
+	}
+	if ecs, err := getEdnsSubnet(msg); err != nil || ecs != "1.2.3.0/24" {
+		t.Errorf(`ECS = (%q, %v); want "1.2.3.0/24"`, ecs, err)
+	}
+}
+
+func TestSetEdnsNSID(t *testing.T) {
+	qmsg := &QueryMsg{
+		Header: dnsmessage.Header{ID: uint16(0x1234)},
+		Question: dnsmessage.Question{
+			Name:  dnsmessage.MustNewName("www.example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		},
+	}
+	// Both in the same OPT record, regardless of the order.
+	qmsg.SetEdnsNSID()
+	qmsg.SetEdnsSubnet(netip.MustParseAddr("1.2.3.4"), 0)
+	qmsg.SetEdnsNSID() // no duplicate
+	msg, err := qmsg.Build()
+	if err != nil {
+		t.Fatalf(`Build() failed: %v`, err)
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		t.Fatalf(`Unpack() failed: %v`, err)
+	}
+	if n := len(m.Additionals); n != 1 {
+		t.Fatalf(`len(Additionals) = %d; want 1`, n)
+	}
+	if n := len(m.Additionals[0].Body.(*dnsmessage.OPTResource).Options); n != 2 {
+		t.Errorf(`len(Options) = %d; want 2 (NSID and ECS)`, n)
+	}
+	if data, ok := RawMsg(msg).Option(optionCodeNSID); !ok || len(data) != 0 {
+		t.Errorf(`NSID option = (%v, %v); want empty`, data, ok)
+	}
+	if ecs, err := getEdnsSubnet(msg); err != nil || ecs != "1.2.3.0/24" {
+		t.Errorf(`ECS = (%q, %v); want "1.2.3.0/24"`, ecs, err)
+	}
+	// The empty request is not an NSID.
+	if nsid, ok := RawMsg(msg).NSID(); ok {
+		t.Errorf(`NSID() = (%q, true); want not found`, nsid)
+	}
+
+	// Response carrying the NSID.
+	qmsg.OPT.Options = []dnsmessage.Option{{Code: optionCodeNSID, Data: []byte("sin1")}}
+	msg, _ = qmsg.Build()
+	if nsid, ok := RawMsg(msg).NSID(); !ok || string(nsid) != "sin1" {
+		t.Errorf(`NSID() = (%q, %v); want "sin1"`, nsid, ok)
+	}
+}
+
+func TestLimitEdnsSubnet(t *testing.T) {
+	newQuery := func(prefix string) *QueryMsg {
+		q := &QueryMsg{
+			Header: dnsmessage.Header{ID: uint16(0x1234)},
+			Question: dnsmessage.Question{
+				Name:  dnsmessage.MustNewName("www.example.com."),
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+			},
+		}
+		if prefix != "" {
+			p := netip.MustParsePrefix(prefix)
+			q.SetEdnsSubnet(p.Addr(), p.Bits())
+		}
+		return q
+	}
+
+	tests := []struct {
+		prefix   string
+		changed  bool
+		expected string
+	}{
+		{"", false, ""},
+		{"1.2.3.4/32", true, "1.2.3.0/24"},
+		{"1.2.3.4/24", false, "1.2.3.0/24"},
+		{"1.2.3.4/16", false, "1.2.0.0/16"},
+		{"fd00:11:22:33:1:2:3:4/128", true, "fd00:11:22::/56"},
+		{"fd00:11:22:33:1:2:3:4/48", false, "fd00:11:22::/48"},
+	}
+	for i, tc := range tests {
+		q := newQuery(tc.prefix)
+		if changed := q.LimitEdnsSubnet(24, 56); changed != tc.changed {
+			t.Errorf(`[%d] LimitEdnsSubnet() = %v; want %v`, i, changed, tc.changed)
+		}
+		msg, err := q.Build()
+		if err != nil {
+			t.Fatalf(`[%d] Build() failed: %v`, i, err)
+		}
+		if ecs, err := getEdnsSubnet(msg); err != nil || ecs != tc.expected {
+			t.Errorf(`[%d] ECS = (%q, %v); want %q`, i, ecs, err, tc.expected)
+		}
+		prefix, ok := RawMsg(msg).EdnsSubnet()
+		if ok != (tc.expected != "") || (ok && prefix.String() != tc.expected) {
+			t.Errorf(`[%d] EdnsSubnet() = (%v, %v); want %q`, i, prefix, ok, tc.expected)
+		}
+	}
+}
+
+func TestOption(t *testing.T) {
+	q := &QueryMsg{
+		Header: dnsmessage.Header{ID: uint16(0x1234)},
+		Question: dnsmessage.Question{
+			Name:  dnsmessage.MustNewName("www.example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		},
+	}
+	msg, _ := q.Build()
+	if _, ok := RawMsg(msg).Option(11); ok {
+		t.Errorf(`Option(11) without OPT = true; want false`)
+	}
+
+	q.SetEdnsSubnet(netip.MustParseAddr("1.2.3.4"), 24)
+	q.OPT.Options = append(q.OPT.Options, dnsmessage.Option{Code: 11})
+	msg, err := q.Build()
+	if err != nil {
+		t.Fatalf(`Build() failed: %v`, err)
+	}
+	if data, ok := RawMsg(msg).Option(11); !ok || len(data) != 0 {
+		t.Errorf(`Option(11) = (%v, %t); want ([], true)`, data, ok)
+	}
+	if _, ok := RawMsg(msg).Option(12); ok {
+		t.Errorf(`Option(12) = true; want false`)
+	}
+
+	if !q.RemoveOption(11) || q.RemoveOption(11) {
+		t.Errorf(`RemoveOption(11) twice; want true then false`)
+	}
+	msg, _ = q.Build()
+	if _, ok := RawMsg(msg).Option(11); ok {
+		t.Errorf(`Option(11) after RemoveOption() = true; want false`)
+	}
+	if prefix, ok := RawMsg(msg).EdnsSubnet(); !ok || prefix.String() != "1.2.3.0/24" {
+		t.Errorf(`EdnsSubnet() = (%v, %t); want 1.2.3.0/24`, prefix, ok)
+	}
+	if scope, ok := RawMsg(msg).EdnsSubnetScope(); !ok || scope != 0 {
+		t.Errorf(`EdnsSubnetScope() = (%d, %t); want (0, true)`, scope, ok)
+	}
+}
+
+func TestAppendOption(t *testing.T) {
+	q := &QueryMsg{
+		Header: dnsmessage.Header{ID: uint16(0x1234)},
+		Question: dnsmessage.Question{
+			Name:  dnsmessage.MustNewName("www.example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		},
+	}
+	plain, _ := q.Build()
+	q.SetEdnsSubnet(netip.MustParseAddr("1.2.3.4"), 24)
+	edns, _ := q.Build()
+
+	for i, msg := range [][]byte{plain, edns} {
+		out, err := RawMsg(msg).AppendOption(65001, []byte("nonce"))
+		if err != nil {
+			t.Fatalf(`[%d] AppendOption() = %v; want nil`, i, err)
+		}
+		out, err = RawMsg(out).AppendOption(65001, []byte("other"))
+		if err != nil {
+			t.Fatalf(`[%d] AppendOption() = %v; want nil`, i, err)
+		}
+		qmsg, err := NewQueryMsg(out)
+		if err != nil {
+			t.Fatalf(`[%d] NewQueryMsg() = %v; want nil`, i, err)
+		}
+		if qmsg.Question != q.Question || qmsg.OPT.Header == nil {
+			t.Errorf(`[%d] query = %+v; want same question with OPT`, i, qmsg)
+		}
+		data := RawMsg(out).Options(65001)
+		if len(data) != 2 || string(data[0]) != "nonce" || string(data[1]) != "other" {
+			t.Errorf(`[%d] Options() = %q; want ["nonce" "other"]`, i, data)
+		}
+		_, hasECS := RawMsg(out).EdnsSubnet()
+		if hasECS != (i == 1) {
+			t.Errorf(`[%d] EdnsSubnet() = %t; want %t`, i, hasECS, i == 1)
+		}
+	}
+
+	if _, err := RawMsg(plain[:20]).AppendOption(65001, nil); err == nil {
+		t.Errorf(`AppendOption() on truncated message = nil; want error`)
+	}
+}
+
+func TestCutLastAdditional(t *testing.T) {
+	q := &QueryMsg{
+		Header: dnsmessage.Header{ID: uint16(0x1234)},
+		Question: dnsmessage.Question{
+			Name:  dnsmessage.MustNewName("www.example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		},
+	}
+	plain, _ := q.Build()
+	if _, err := RawMsg(plain).CutLastAdditional(); err == nil {
+		t.Errorf(`CutLastAdditional() without additional = nil; want error`)
+	}
+
+	q.SetEdnsSubnet(netip.MustParseAddr("1.2.3.4"), 24)
+	edns, _ := q.Build()
+	out, err := RawMsg(edns).CutLastAdditional()
+	if err != nil {
+		t.Fatalf(`CutLastAdditional() = %v; want nil`, err)
+	}
+	if !bytes.Equal(out, plain) {
+		t.Errorf(`CutLastAdditional() = %x; want %x`, out, plain)
+	}
+	if &out[0] == &edns[0] {
+		t.Errorf(`CutLastAdditional() shares the message; want a copy`)
+	}
+
+	if _, err := RawMsg(edns[:len(edns)-1]).CutLastAdditional(); err == nil {
+		t.Errorf(`CutLastAdditional() on truncated message = nil; want error`)
+	}
+	if _, err := RawMsg(append(edns, 0)).CutLastAdditional(); err == nil {
+		t.Errorf(`CutLastAdditional() with trailing data = nil; want error`)
+	}
+}
+
+func TestMinTTL(t *testing.T) {
+	name := dnsmessage.MustNewName("www.example.com.")
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x1234, Response: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	b.StartAnswers()
+	for _, ttl := range []uint32{300, 60, 120} {
+		hdr := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: ttl}
+		b.AResource(hdr, dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}})
+	}
+	b.StartAuthorities()
+	hdr := dnsmessage.ResourceHeader{
+		Name:  dnsmessage.MustNewName("example.com."),
+		Class: dnsmessage.ClassINET,
+		TTL:   90,
+	}
+	b.NSResource(hdr, dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns.example.com.")})
+	b.StartAdditionals()
+	// The OPT TTL holds the extended RCODE and flags; must be skipped.
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, true)
+	b.OPTResource(opt, dnsmessage.OPTResource{})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatalf(`Finish() failed: %v`, err)
+	}
+
+	if ttl, ok := RawMsg(msg).MinTTL(); !ok || ttl != 60 {
+		t.Errorf(`MinTTL() = %d, %t; want 60, true`, ttl, ok)
+	}
+	want := []uint32{300, 60, 120, 90}
+	if ttls := RawMsg(msg).AllTTLs(); !slices.Equal(ttls, want) {
+		t.Errorf(`AllTTLs() = %v; want %v`, ttls, want)
+	}
+
+	q := &QueryMsg{
+		Header: dnsmessage.Header{ID: uint16(0x1234)},
+		Question: dnsmessage.Question{
+			Name:  name,
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		},
+	}
+	query, _ := q.Build()
+	if ttl, ok := RawMsg(query).MinTTL(); ok {
+		t.Errorf(`MinTTL() without records = %d, true; want false`, ttl)
+	}
+	if ttls := RawMsg(query).AllTTLs(); ttls == nil || len(ttls) != 0 {
+		t.Errorf(`AllTTLs() without records = %v; want empty`, ttls)
+	}
+
+	for _, n := range []int{5, 20, len(msg) - 30} {
+		if ttl, ok := RawMsg(msg[:n]).MinTTL(); ok {
+			t.Errorf(`MinTTL() on truncated message (%d) = %d, true; want false`, n, ttl)
+		}
+		if ttls := RawMsg(msg[:n]).AllTTLs(); ttls != nil {
+			t.Errorf(`AllTTLs() on truncated message (%d) = %v; want nil`, n, ttls)
+		}
+	}
+}
+
 func getEdnsSubnet(msg []byte) (string, error) {
 	var dmsg dnsmessage.Message
 	if err := dmsg.Unpack(msg); err != nil {
@@ -386,3 +1058,72 @@ func getEdnsSubnet(msg []byte) (string, error) {
 	ecs := fmt.Sprintf("%s/%d", addr.String(), sourcePlen)
 	return ecs, nil
 }
+
+func TestInvalidOptions(t *testing.T) {
+	ecs := func(data ...byte) dnsmessage.Option {
+		return dnsmessage.Option{Code: optionCodeSubnet, Data: data}
+	}
+	cookie := func(n int) dnsmessage.Option {
+		return dnsmessage.Option{Code: optionCodeCookie, Data: make([]byte, n)}
+	}
+	tests := []struct {
+		option dnsmessage.Option
+		valid  bool
+	}{
+		{ecs(0, 1, 24, 0, 1, 2, 3), true},
+		{ecs(0, 1, 0, 0), true}, // opt out
+		{ecs(0, 2, 56, 0, 0xfd, 0, 0, 0x11, 0, 0x22, 0), true},
+		{ecs(0, 1, 23, 0, 1, 2, 2), true},
+		{ecs(0, 1, 24), false},                        // truncated
+		{ecs(0, 3, 24, 0, 1, 2, 3), false},            // unknown family
+		{ecs(0, 1, 33, 0, 1, 2, 3, 4, 5), false},      // prefix too long
+		{ecs(0, 1, 24, 0, 1, 2), false},               // address too short
+		{ecs(0, 1, 16, 0, 1, 2, 3), false},            // address too long
+		{ecs(0, 1, 23, 0, 1, 2, 3), false},            // bits beyond the prefix
+		{ecs(0, 1, 24, 24, 1, 2, 3), false},           // nonzero scope
+		{ecs(0, 2, 8, 0, 0xfd, 0, 0, 0, 0, 0), false}, // address too long
+		{cookie(8), true},
+		{cookie(16), true},
+		{cookie(40), true},
+		{cookie(0), false},
+		{cookie(7), false},
+		{cookie(12), false},
+		{cookie(41), false},
+		{dnsmessage.Option{Code: 65001, Data: []byte{1}}, true},
+	}
+	for i, tc := range tests {
+		q := &QueryMsg{
+			Header: dnsmessage.Header{ID: uint16(0x1234)},
+			Question: dnsmessage.Question{
+				Name:  dnsmessage.MustNewName("www.example.com."),
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+			},
+		}
+		q.ensureOPT()
+		q.OPT.Options = []dnsmessage.Option{
+			{Code: optionCodeNSID, Data: []byte{}},
+			tc.option,
+		}
+		msg, err := q.Build()
+		if err != nil {
+			t.Fatalf(`[%d] Build() failed: %v`, i, err)
+		}
+		if invalid := RawMsg(msg).HasInvalidOption(); invalid == tc.valid {
+			t.Errorf(`[%d] HasInvalidOption(%x) = %v; want %v`, i, tc.option.Data, invalid, !tc.valid)
+		}
+
+		q, err = NewQueryMsg(msg)
+		if err != nil {
+			t.Fatalf(`[%d] NewQueryMsg() failed: %v`, i, err)
+		}
+		codes := q.RemoveInvalidOptions()
+		if tc.valid && (len(codes) != 0 || len(q.OPT.Options) != 2) {
+			t.Errorf(`[%d] RemoveInvalidOptions() = %v; want none`, i, codes)
+		}
+		if !tc.valid && (len(codes) != 1 || codes[0] != tc.option.Code ||
+			len(q.OPT.Options) != 1 || q.OPT.Options[0].Code != optionCodeNSID) {
+			t.Errorf(`[%d] RemoveInvalidOptions() = %v; want [%d]`, i, codes, tc.option.Code)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Format the DNS messages in the dig-like presentation format.
+//
+
+package dnsmsg
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Name of the record type (e.g., "AAAA"), or the generic form (e.g.,
+// "TYPE65"; RFC 3597) if unknown.
+func TypeString(t dnsmessage.Type) string {
+	for _, kt := range knownTypes {
+		if t == kt {
+			return strings.TrimPrefix(t.String(), "Type")
+		}
+	}
+	for name, et := range extraTypes {
+		if t == et {
+			return name
+		}
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// Name of the class (e.g., "IN"), or the generic form (e.g., "CLASS3").
+func classString(c dnsmessage.Class) string {
+	switch c {
+	case dnsmessage.ClassINET:
+		return "IN"
+	case dnsmessage.ClassCHAOS:
+		return "CH"
+	case dnsmessage.ClassANY:
+		return "ANY"
+	default:
+		return "CLASS" + strconv.Itoa(int(c))
+	}
+}
+
+// Name of the response code (e.g., "NXDOMAIN").
+func RCodeString(rc dnsmessage.RCode) string {
+	switch rc {
+	case dnsmessage.RCodeSuccess:
+		return "NOERROR"
+	case dnsmessage.RCodeFormatError:
+		return "FORMERR"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeNotImplemented:
+		return "NOTIMP"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	default:
+		return "RCODE" + strconv.Itoa(int(rc))
+	}
+}
+
+// Parse the response code from its name (case-insensitive, e.g.,
+// "nxdomain") or the generic form (e.g., "RCODE9").
+func ParseRCode(s string) (dnsmessage.RCode, error) {
+	for rc := dnsmessage.RCodeSuccess; rc <= dnsmessage.RCodeRefused; rc++ {
+		if strings.EqualFold(s, RCodeString(rc)) {
+			return rc, nil
+		}
+	}
+	if len(s) > 5 && strings.EqualFold(s[:5], "RCODE") {
+		if n, err := strconv.ParseUint(s[5:], 10, 4); err == nil {
+			return dnsmessage.RCode(n), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid rcode [%s]", s)
+}
+
+// Format the message (msg) like the dig output, e.g., for the command line.
+func Format(msg []byte) (string, error) {
+	var dmsg dnsmessage.Message
+	if err := dmsg.Unpack(msg); err != nil {
+		return "", &nestedError{"invalid message", err}
+	}
+
+	var b strings.Builder
+	h := &dmsg.Header
+	opcode := "QUERY"
+	if h.OpCode != 0 {
+		opcode = "OPCODE" + strconv.Itoa(int(h.OpCode))
+	}
+	fmt.Fprintf(&b, ";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n",
+		opcode, RCodeString(h.RCode), h.ID)
+	flags := []string{}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"qr", h.Response}, {"aa", h.Authoritative}, {"tc", h.Truncated},
+		{"rd", h.RecursionDesired}, {"ra", h.RecursionAvailable},
+		{"ad", h.AuthenticData}, {"cd", h.CheckingDisabled},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	fmt.Fprintf(&b, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(flags, " "), len(dmsg.Questions), len(dmsg.Answers),
+		len(dmsg.Authorities), len(dmsg.Additionals))
+
+	var additionals []dnsmessage.Resource
+	for _, rr := range dmsg.Additionals {
+		if opt, ok := rr.Body.(*dnsmessage.OPTResource); ok {
+			fmt.Fprintf(&b, "\n;; OPT PSEUDOSECTION:\n")
+			fmt.Fprintf(&b, "; EDNS: version: %d, udp: %d\n",
+				(rr.Header.TTL>>16)&0xff, uint16(rr.Header.Class))
+			for _, o := range opt.Options {
+				fmt.Fprintf(&b, "; OPT=%d: %s\n", o.Code, hex.EncodeToString(o.Data))
+			}
+		} else {
+			additionals = append(additionals, rr)
+		}
+	}
+
+	fmt.Fprintf(&b, "\n;; QUESTION SECTION:\n")
+	for _, q := range dmsg.Questions {
+		fmt.Fprintf(&b, ";%s\t\t%s\t%s\n", q.Name, classString(q.Class), TypeString(q.Type))
+	}
+	for _, section := range []struct {
+		name string
+		rrs  []dnsmessage.Resource
+	}{
+		{"ANSWER", dmsg.Answers},
+		{"AUTHORITY", dmsg.Authorities},
+		{"ADDITIONAL", additionals},
+	} {
+		if len(section.rrs) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n;; %s SECTION:\n", section.name)
+		for _, rr := range section.rrs {
+			fmt.Fprintf(&b, "%s\t%d\t%s\t%s\t%s\n", rr.Header.Name, rr.Header.TTL,
+				classString(rr.Header.Class), TypeString(rr.Header.Type),
+				FormatRData(rr.Body))
+		}
+	}
+
+	return b.String(), nil
+}
+
+// Format the record data (body) in the presentation format, e.g.,
+// "192.0.2.1" for A and "10 mx.example.com." for MX.
+func FormatRData(body dnsmessage.ResourceBody) string {
+	switch rb := body.(type) {
+	case *dnsmessage.AResource:
+		return netip.AddrFrom4(rb.A).String()
+	case *dnsmessage.AAAAResource:
+		return netip.AddrFrom16(rb.AAAA).String()
+	case *dnsmessage.CNAMEResource:
+		return rb.CNAME.String()
+	case *dnsmessage.NSResource:
+		return rb.NS.String()
+	case *dnsmessage.PTRResource:
+		return rb.PTR.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", rb.Pref, rb.MX)
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", rb.Priority, rb.Weight, rb.Port, rb.Target)
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", rb.NS, rb.MBox, rb.Serial,
+			rb.Refresh, rb.Retry, rb.Expire, rb.MinTTL)
+	case *dnsmessage.TXTResource:
+		txts := make([]string, len(rb.TXT))
+		for i, s := range rb.TXT {
+			txts[i] = strconv.Quote(s)
+		}
+		return strings.Join(txts, " ")
+	case *dnsmessage.UnknownResource:
+		// RFC 3597, Section 5
+		return fmt.Sprintf(`\# %d %s`, len(rb.Data), hex.EncodeToString(rb.Data))
+	default:
+		return fmt.Sprintf("%+v", body)
+	}
+}
+
+// Dump the message in hex (like "hexdump -C") after a one-line summary of
+// the header and question, which tolerates the malformed messages, for the
+// protocol-level debugging.
+func (m RawMsg) HexDump() string {
+	return m.summary() + "\n" + strings.TrimSuffix(hex.Dump(m), "\n")
+}
+
+// Summarize the message, e.g.,
+// "response id=0x1234 www.example.com. A NOERROR qd=1 an=1 ns=0 ar=0 (49 bytes)".
+func (m RawMsg) summary() string {
+	if len(m) < headerSize {
+		return fmt.Sprintf("malformed (%d bytes)", len(m))
+	}
+	kind := "query"
+	if m.Flags()&FlagQR != 0 {
+		kind = "response"
+	}
+	question := "(no question)"
+	if _, q, err := m.Question(); err == nil {
+		question = q.Name.String() + " " + TypeString(q.Type)
+	} else if binary.BigEndian.Uint16(m[4:]) > 0 {
+		question = "(invalid question)"
+	}
+	return fmt.Sprintf("%s id=0x%04x %s %s qd=%d an=%d ns=%d ar=%d (%d bytes)",
+		kind, m.GetID(), question, RCodeString(dnsmessage.RCode(m[3]&0xF)),
+		binary.BigEndian.Uint16(m[4:]), binary.BigEndian.Uint16(m[6:]),
+		binary.BigEndian.Uint16(m[8:]), binary.BigEndian.Uint16(m[10:]), len(m))
+}
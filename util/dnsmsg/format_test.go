@@ -0,0 +1,163 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Format the DNS messages - tests
+//
+
+package dnsmsg
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestTypeString(t *testing.T) {
+	tests := []struct {
+		qtype dnsmessage.Type
+		s     string
+	}{
+		{dnsmessage.TypeA, "A"},
+		{dnsmessage.TypeAAAA, "AAAA"},
+		{dnsmessage.Type(65), "HTTPS"},
+		{dnsmessage.Type(999), "TYPE999"},
+	}
+	for _, tc := range tests {
+		if s := TypeString(tc.qtype); s != tc.s {
+			t.Errorf(`TypeString(%d) = %q; want %q`, tc.qtype, s, tc.s)
+		}
+		if qtype, err := ParseType(tc.s); err != nil || qtype != tc.qtype {
+			t.Errorf(`ParseType(%q) = (%v, %v); want %v`, tc.s, qtype, err, tc.qtype)
+		}
+	}
+}
+
+func TestParseRCode(t *testing.T) {
+	tests := []struct {
+		s     string
+		rcode dnsmessage.RCode
+		ok    bool
+	}{
+		{"NOERROR", dnsmessage.RCodeSuccess, true},
+		{"nxdomain", dnsmessage.RCodeNameError, true},
+		{"Refused", dnsmessage.RCodeRefused, true},
+		{"RCODE9", dnsmessage.RCode(9), true},
+		{"RCODE16", 0, false},
+		{"bogus", 0, false},
+	}
+	for _, tc := range tests {
+		rcode, err := ParseRCode(tc.s)
+		if (err == nil) != tc.ok || rcode != tc.rcode {
+			t.Errorf(`ParseRCode(%q) = (%v, %v); want (%v, ok=%v)`, tc.s, rcode, err, tc.rcode, tc.ok)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	name := dnsmessage.MustNewName("www.example.com.")
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, false)
+	dmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID: 0x1234, Response: true, RecursionDesired: true,
+			RecursionAvailable: true, RCode: dnsmessage.RCodeSuccess,
+		},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		},
+		Answers: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{
+					Name: name, Type: dnsmessage.TypeCNAME,
+					Class: dnsmessage.ClassINET, TTL: 600,
+				},
+				Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("cdn.example.net.")},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{
+					Name: dnsmessage.MustNewName("cdn.example.net."), Type: dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET, TTL: 60,
+				},
+				Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{
+					Name: name, Type: 65, Class: dnsmessage.ClassINET, TTL: 60,
+				},
+				Body: &dnsmessage.UnknownResource{Type: 65, Data: []byte{0, 1, 0}},
+			},
+		},
+		Additionals: []dnsmessage.Resource{
+			{Header: opt, Body: &dnsmessage.OPTResource{}},
+		},
+	}
+	msg, err := dmsg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack message: %v", err)
+	}
+
+	out, err := Format(msg)
+	if err != nil {
+		t.Fatalf(`Format() = %v; want nil`, err)
+	}
+	for _, want := range []string{
+		";; ->>HEADER<<- opcode: QUERY, status: NOERROR, id: 4660\n",
+		";; flags: qr rd ra; QUERY: 1, ANSWER: 3, AUTHORITY: 0, ADDITIONAL: 1\n",
+		"; EDNS: version: 0, udp: 1232\n",
+		";www.example.com.\t\tIN\tA\n",
+		"www.example.com.\t600\tIN\tCNAME\tcdn.example.net.\n",
+		"cdn.example.net.\t60\tIN\tA\t192.0.2.1\n",
+		"www.example.com.\t60\tIN\tHTTPS\t\\# 3 000100\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf(`Format() = %s; want containing %q`, out, want)
+		}
+	}
+	if strings.Contains(out, "ADDITIONAL SECTION") {
+		t.Errorf(`Format() = %s; want OPT only in pseudosection`, out)
+	}
+
+	if _, err := Format([]byte{0x12}); err == nil {
+		t.Errorf(`Format(invalid) = nil; want error`)
+	}
+}
+
+func TestHexDump(t *testing.T) {
+	dmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0x1234, Response: true, RCode: dnsmessage.RCodeNameError},
+		Questions: []dnsmessage.Question{
+			{
+				Name:  dnsmessage.MustNewName("www.example.com."),
+				Type:  dnsmessage.TypeAAAA,
+				Class: dnsmessage.ClassINET,
+			},
+		},
+	}
+	msg, err := dmsg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack message: %v", err)
+	}
+
+	tests := []struct {
+		msg     []byte
+		summary string
+	}{
+		{msg, "response id=0x1234 www.example.com. AAAA NXDOMAIN qd=1 an=0 ns=0 ar=0 (33 bytes)"},
+		{msg[:20], "response id=0x1234 (invalid question) NXDOMAIN qd=1 an=0 ns=0 ar=0 (20 bytes)"},
+		{make([]byte, 12), "query id=0x0000 (no question) NOERROR qd=0 an=0 ns=0 ar=0 (12 bytes)"},
+		{[]byte{0x12}, "malformed (1 bytes)"},
+	}
+	for _, tc := range tests {
+		dump := RawMsg(tc.msg).HexDump()
+		summary, hexdump, _ := strings.Cut(dump, "\n")
+		if summary != tc.summary {
+			t.Errorf(`HexDump() summary = %q; want %q`, summary, tc.summary)
+		}
+		if lines := strings.Count(hexdump, "\n") + 1; lines != (len(tc.msg)+15)/16 ||
+			!strings.HasPrefix(hexdump, "00000000  ") {
+			t.Errorf(`HexDump() = %q; want %d lines of hex`, hexdump, (len(tc.msg)+15)/16)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Convert the internationalized domain names (IDN) to the ASCII form.
+//
+
+package dnsmsg
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Convert the name (name) with the UTF-8 labels (U-labels) into the ASCII
+// form, i.e., the punycoded labels (A-labels) with the "xn--" prefix (RFC
+// 5890), so that it matches the zones configured in the ASCII form.
+// The ASCII names are returned as is without allocation, which is the
+// common case.
+//
+// NOTE: Only the lowercase mapping is applied, without the full IDNA2008
+// validation and Unicode normalization (which golang.org/x/net/idna does
+// with the golang.org/x/text tables), because the clients sending the
+// U-labels are rare and the name is only used for the matching.
+func ToASCII(name string) string {
+	i := 0
+	for i < len(name) && name[i] < utf8.RuneSelf {
+		i++
+	}
+	if i == len(name) {
+		return name
+	}
+
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if !isASCII(label) && utf8.ValidString(label) {
+			if s, ok := punycode(strings.ToLower(label)); ok {
+				labels[i] = "xn--" + s
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Parameters of the Punycode for IDNA; see RFC 3492, Section 5.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+	punyMaxInt      = 1<<31 - 1 // overflow guard
+)
+
+// Encode the string (s) in Punycode (RFC 3492, Section 6.3), without the
+// ACE prefix. Return false upon overflow.
+func punycode(s string) (string, bool) {
+	runes := []rune(s)
+	out := make([]byte, 0, len(s)+8)
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	b := len(out)
+	h := b
+	if b > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for h < len(runes) {
+		// The next smallest code point to encode
+		m := rune(utf8.MaxRune + 1)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		if int(m-n) > (punyMaxInt-delta)/(h+1) {
+			return "", false
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+
+		for _, r := range runes {
+			if r < n {
+				delta++
+				if delta > punyMaxInt {
+					return "", false
+				}
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out), true
+}
+
+// Encode the digit (d) in [0, 36) as "a"-"z" and "0"-"9".
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// Adapt the bias; see RFC 3492, Section 6.1.
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
@@ -0,0 +1,64 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Convert the internationalized domain names - tests
+//
+
+package dnsmsg
+
+import (
+	"testing"
+)
+
+func TestToASCII(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"", ""},
+		{"www.example.com.", "www.example.com."},
+		{"www.Example.COM.", "www.Example.COM."}, // ASCII as is
+		{"bücher.example.", "xn--bcher-kva.example."},
+		{"www.BÜCHER.example", "www.xn--bcher-kva.example"},
+		{"münchen.de.", "xn--mnchen-3ya.de."},
+		{"中国.", "xn--fiqs8s."},
+		{"例え.テスト.", "xn--r8jz45g.xn--zckzah."},
+		{"правительство.рф.", "xn--80aealotwbjpid2k.xn--p1ai."},
+		// Invalid UTF-8 as is
+		{"\xff.example.", "\xff.example."},
+	}
+	for _, tc := range tests {
+		if s := ToASCII(tc.name); s != tc.expected {
+			t.Errorf(`ToASCII(%q) = %q; want %q`, tc.name, s, tc.expected)
+		}
+	}
+}
+
+// RFC 3492, Section 7.1
+func TestPunycode(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected string
+	}{
+		{"ليهمابتكلموش" +
+			"عربي؟", "egbpdaj6bu4bxfgehfvwxn"},
+		{"他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+		{"3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},
+		{"ひとつ屋根の下2", "2-u9tlzr9756bt3uc0v"},
+	}
+	for _, tc := range tests {
+		if s, ok := punycode(tc.s); !ok || s != tc.expected {
+			t.Errorf(`punycode(%q) = (%q, %v); want %q`, tc.s, s, ok, tc.expected)
+		}
+	}
+}
+
+func TestToASCIIAllocs(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		ToASCII("www.example.com.")
+	})
+	if allocs != 0 {
+		t.Errorf(`ToASCII(ASCII) allocs = %v; want 0`, allocs)
+	}
+}
@@ -8,11 +8,21 @@
 package dnstrie
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
 	"strings"
 
 	"kexuedns/util/critbit"
 )
 
+// Size of the key buffer on stack for Match(), enough for any valid name
+// (max 253 characters in text format without the final dot).
+const maxKeyBuffer = 256
+
+var dot = []byte{'.'}
+
 // A table to speed up the transformation of DNS keys to lower case.
 var keyXTable [256]byte
 
@@ -42,6 +52,13 @@ func init() {
 //  3. reverse the order
 //  4. append a dot
 //
+// A zone may also be added as "**.example.com" to match only its subdomains,
+// as "*.example.com" to match only the subdomains of exactly one more label
+// (e.g., "www.example.com" but not "a.www.example.com"), or as "=example.com"
+// to match only itself (i.e., not the subdomains).
+// Such an entry is stored along with the default one under the same key,
+// and a name not matched by the entry falls back to the parent zones.
+//
 // NOTE: Similar to critbit.Tree, it's the consumer's responsibility to
 // protect concurrent accesses if it's needed.
 type DNSTrie struct {
@@ -55,13 +72,22 @@ type dkey []byte
 // The input (dname) is decoded and in text format, but not needed to
 // be normalized to lower case, e.g., "www.Example.COM."
 func newDkey(dname string) dkey {
+	return dkey(AppendKey(nil, dname))
+}
+
+// Append the trie lookup key of the DNS name (dname) to the buffer (dst)
+// and return the extended buffer, which can be reused across the lookups
+// to avoid the allocation per lookup, e.g., on the query hot path.
+func AppendKey(dst []byte, dname string) []byte {
 	// 1. remove the final dot if exists
 	dname = strings.TrimSuffix(dname, ".")
 
 	// 2. convert to lower case
 	// 3. reverse the order
 	l := len(dname)
-	key := make([]byte, l+1)
+	dst = slices.Grow(dst, l+1)
+	off := len(dst)
+	key := dst[off : off+l+1]
 	for i, c := range []byte(dname) {
 		key[l-i-1] = keyXTable[c]
 	}
@@ -69,7 +95,7 @@ func newDkey(dname string) dkey {
 	// 4. append a dot
 	key[l] = '.'
 
-	return dkey(key)
+	return dst[:off+l+1]
 }
 
 func (k dkey) String() string {
@@ -82,61 +108,249 @@ func (k dkey) String() string {
 	return string(name[1:]) // exclude the appended dot
 }
 
-type node struct {
-	name  string
+// Kinds of names an entry matches, decided by the form of the added zone.
+const (
+	matchApex = 1 << iota // the zone name itself
+	matchSub              // the subdomains of the zone
+	matchWild             // the subdomains of exactly one more label
+	matchAll  = matchApex | matchSub
+)
+
+// Parse the zone (name) as added into the bare zone name and the match kind:
+//   - "example.com": the zone itself and its subdomains
+//   - "**.example.com": only the subdomains, e.g., "a.www.example.com"
+//   - "*.example.com": only the single-label subdomains, e.g., "www.example.com"
+//   - "=example.com": only the zone itself, i.e., "example.com"
+func parseZone(name string) (string, int) {
+	if zone, ok := strings.CutPrefix(name, "**."); ok {
+		return zone, matchSub
+	}
+	if zone, ok := strings.CutPrefix(name, "*."); ok {
+		return zone, matchWild
+	}
+	if zone, ok := strings.CutPrefix(name, "="); ok {
+		return zone, matchApex
+	}
+	return name, matchAll
+}
+
+type entry struct {
+	name  string // the original name for Export()
+	kind  int
 	value any
 }
 
+// A trie node holds the entries matching the zone itself (apex), its
+// subdomains (sub), and its single-label subdomains (wild), where apex and
+// sub point to the same entry for the default form.  The wild entry takes
+// precedence over the sub one for the single-label subdomains.
+// NOTE: A later added entry overrides the former ones of the same kind,
+// e.g., "=example.com" takes the apex from "example.com", which then only
+// matches the subdomains.
+type node struct {
+	apex *entry
+	sub  *entry
+	wild *entry
+}
+
+// Get the distinct entries of the node.
+func (n *node) entries() []*entry {
+	entries := make([]*entry, 0, 3)
+	for _, e := range []*entry{n.apex, n.sub, n.wild} {
+		if e != nil && !slices.Contains(entries, e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Show the entries in the trie dump.
+func (n *node) String() string {
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, e := range n.entries() {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%s: %v", e.name, e.value)
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// Get the entry of the exact form (kind).
+func (n *node) get(kind int) *entry {
+	var e *entry
+	switch {
+	case kind&matchApex != 0:
+		e = n.apex
+	case kind == matchWild:
+		e = n.wild
+	default:
+		e = n.sub
+	}
+	if e != nil && e.kind == kind {
+		return e
+	}
+	return nil
+}
+
 // Add the zone (zone) with value (value) to the Trie.
 // Return the old value if the key existed, and a boolean indicating whether
 // the key has been updated (true) or created (false).
+// The zone may be in the form of "**.example.com" to match only the
+// subdomains, "*.example.com" to match only the single-label subdomains,
+// or "=example.com" to match only the zone itself.
 func (t *DNSTrie) AddZone(name string, value any) (oldValue any, updated bool) {
-	key := newDkey(name)
-	vnode := &node{
-		name:  name, // store the original name for Export()
-		value: value,
+	zone, kind := parseZone(name)
+	key := newDkey(zone)
+	var vnode *node
+	if v, ok := t.tree.Get(key); ok {
+		vnode = v.(*node)
+	} else {
+		vnode = &node{}
+		t.tree.Set(key, vnode)
 	}
-	old, updated := t.tree.Set(key, vnode)
-	if updated {
-		oldValue = old.(*node).value
+
+	e := &entry{name: name, kind: kind, value: value}
+	if kind == matchWild {
+		if vnode.wild != nil {
+			oldValue, updated = vnode.wild.value, true
+		}
+		vnode.wild = e
+	}
+	if kind&matchApex != 0 {
+		if vnode.apex != nil {
+			oldValue, updated = vnode.apex.value, true
+		}
+		vnode.apex = e
+	}
+	if kind&matchSub != 0 {
+		if vnode.sub != nil && !updated {
+			oldValue, updated = vnode.sub.value, true
+		}
+		vnode.sub = e
 	}
 	return
 }
 
 func (t *DNSTrie) GetZone(name string) (value any, ok bool) {
-	key := newDkey(name)
-	vnode, ok := t.tree.Get(key)
-	if ok {
-		value = vnode.(*node).value
+	zone, kind := parseZone(name)
+	vnode, ok := t.tree.Get(newDkey(zone))
+	if !ok {
+		return nil, false
 	}
-	return
+	if e := vnode.(*node).get(kind); e != nil {
+		return e.value, true
+	}
+	return nil, false
 }
 
 func (t *DNSTrie) DeleteZone(name string) (value any, ok bool) {
-	key := newDkey(name)
-	vnode, ok := t.tree.Delete(key)
-	if ok {
-		value = vnode.(*node).value
+	zone, kind := parseZone(name)
+	key := newDkey(zone)
+	v, ok := t.tree.Get(key)
+	if !ok {
+		return nil, false
 	}
-	return
+	vnode := v.(*node)
+	e := vnode.get(kind)
+	if e == nil {
+		return nil, false
+	}
+	if vnode.apex == e {
+		vnode.apex = nil
+	}
+	if vnode.sub == e {
+		vnode.sub = nil
+	}
+	if vnode.wild == e {
+		vnode.wild = nil
+	}
+	if vnode.apex == nil && vnode.sub == nil && vnode.wild == nil {
+		t.tree.Delete(key)
+	}
+	return e.value, true
+}
+
+// Find the entry of the longest matched zone for the name.
+func (t *DNSTrie) match(name string) *entry {
+	var buf [maxKeyBuffer]byte // on stack unless the name is too long
+	return t.matchKey(AppendKey(buf[:0], name))
+}
+
+// Find the entry of the longest matched zone for the key.
+func (t *DNSTrie) matchKey(key []byte) *entry {
+	for len(key) > 0 {
+		k, v, ok := t.tree.LongestPrefix(key)
+		if !ok {
+			return nil
+		}
+		vnode := v.(*node)
+		if len(k) == len(key) {
+			if vnode.apex != nil {
+				return vnode.apex
+			}
+		} else {
+			// The rest of the key is the reversed labels below the zone,
+			// each followed by a dot.
+			if vnode.wild != nil && bytes.Count(key[len(k):], dot) == 1 {
+				return vnode.wild
+			}
+			if vnode.sub != nil {
+				return vnode.sub
+			}
+		}
+		// The zone doesn't match this name, so try the shorter zones,
+		// i.e., the parents.
+		key = key[:len(k)-1]
+	}
+	return nil
 }
 
 // Match the name to find the longest matched zone.
 func (t *DNSTrie) Match(name string) (value any, ok bool) {
-	key := newDkey(name)
-	_, vnode, ok := t.tree.LongestPrefix(key)
-	if ok {
-		value = vnode.(*node).value
+	if e := t.match(name); e != nil {
+		return e.value, true
 	}
-	return
+	return nil, false
+}
+
+// Similar to Match(), but with the key made by AppendKey(), so that the key
+// can be made once to match multiple tries.
+func (t *DNSTrie) MatchKey(key []byte) (value any, ok bool) {
+	if e := t.matchKey(key); e != nil {
+		return e.value, true
+	}
+	return nil, false
+}
+
+// Similar to Match(), but also return the matched zone as it was added.
+func (t *DNSTrie) MatchZone(name string) (zone string, value any, ok bool) {
+	if e := t.match(name); e != nil {
+		return e.name, e.value, true
+	}
+	return "", nil, false
 }
 
 func (t *DNSTrie) Export() map[string]any {
 	zones := map[string]any{}
 	t.tree.Walk(func(_ []byte, value any) bool {
-		vnode := value.(*node)
-		zones[vnode.name] = vnode.value
+		for _, e := range value.(*node).entries() {
+			zones[e.name] = e.value
+		}
 		return true
 	})
 	return zones
 }
+
+// Remove all the zones from the trie, e.g., to reload the zones in place.
+func (t *DNSTrie) Clear() {
+	t.tree.Clear()
+}
+
+// Print the underlying crit-bit tree for debugging.
+// NOTE: The keys are shown in the transformed form, e.g., "moc.elpmaxe.".
+func (t *DNSTrie) Dump(w io.Writer) {
+	t.tree.Dump(w)
+}
@@ -8,6 +8,11 @@
 package dnstrie
 
 import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -200,6 +205,201 @@ func TestMatch2(t *testing.T) {
 	}
 }
 
+func TestMatchZone(t *testing.T) {
+	trie := &DNSTrie{}
+	trie.AddZone("Example.com", 1)
+	trie.AddZone("www.example.com", 2)
+
+	tests := []struct {
+		name  string
+		zone  string
+		value any
+		ok    bool
+	}{
+		{"example.com.", "Example.com", 1, true},
+		{"abc.EXAMPLE.com", "Example.com", 1, true},
+		{"a.www.example.com", "www.example.com", 2, true},
+		{"example.net", "", nil, false},
+	}
+	for _, tc := range tests {
+		zone, v, ok := trie.MatchZone(tc.name)
+		if zone != tc.zone || v != tc.value || ok != tc.ok {
+			t.Errorf(`MatchZone(%q) = (%q, %v, %t); want (%q, %v, %t)`,
+				tc.name, zone, v, ok, tc.zone, tc.value, tc.ok)
+		}
+	}
+}
+
+func TestMatchKind(t *testing.T) {
+	trie := &DNSTrie{}
+	trie.AddZone("com", 1)
+	trie.AddZone("=apex.com", 2)
+	trie.AddZone("**.sub.com", 3)
+	trie.AddZone("both.com", 4)
+	trie.AddZone("=split.com", 5)
+	trie.AddZone("**.split.com", 6)
+
+	tests := []struct {
+		name  string
+		zone  string
+		value any
+	}{
+		// apex only: the subdomains fall back to the parent
+		{"apex.com", "=apex.com", 2},
+		{"www.apex.com", "com", 1},
+		// subdomains only: the apex falls back to the parent
+		{"sub.com", "com", 1},
+		{"www.sub.com", "**.sub.com", 3},
+		{"a.b.sub.com", "**.sub.com", 3},
+		// inclusive
+		{"both.com", "both.com", 4},
+		{"www.both.com", "both.com", 4},
+		// apex and subdomains with different values
+		{"split.com", "=split.com", 5},
+		{"www.split.com", "**.split.com", 6},
+	}
+	for _, tc := range tests {
+		zone, v, ok := trie.MatchZone(tc.name)
+		if zone != tc.zone || v != tc.value || !ok {
+			t.Errorf(`MatchZone(%q) = (%q, %v, %t); want (%q, %v, true)`,
+				tc.name, zone, v, ok, tc.zone, tc.value)
+		}
+	}
+
+	// No parent to fall back to.
+	trie.DeleteZone("com")
+	if zone, v, ok := trie.MatchZone("www.apex.com"); ok {
+		t.Errorf(`MatchZone("www.apex.com") = (%q, %v, true); want no match`, zone, v)
+	}
+
+	// The forms are distinct entries.
+	if v, ok := trie.GetZone("split.com"); ok {
+		t.Errorf(`GetZone("split.com") = (%v, true); want (nil, false)`, v)
+	}
+	if v, ok := trie.GetZone("**.split.com"); v != 6 || !ok {
+		t.Errorf(`GetZone("**.split.com") = (%v, %t); want (6, true)`, v, ok)
+	}
+	if v, ok := trie.DeleteZone("=split.com"); v != 5 || !ok {
+		t.Errorf(`DeleteZone("=split.com") = (%v, %t); want (5, true)`, v, ok)
+	}
+	if _, _, ok := trie.MatchZone("split.com"); ok {
+		t.Errorf(`MatchZone("split.com") after delete = true; want false`)
+	}
+	if zone, _, ok := trie.MatchZone("www.split.com"); !ok || zone != "**.split.com" {
+		t.Errorf(`MatchZone("www.split.com") = (%q, %t); want ("**.split.com", true)`, zone, ok)
+	}
+
+	// Overriding the apex of an inclusive entry.
+	if v, updated := trie.AddZone("=both.com", 7); v != 4 || !updated {
+		t.Errorf(`AddZone("=both.com") = (%v, %t); want (4, true)`, v, updated)
+	}
+	for name, want := range map[string]any{"both.com": 7, "www.both.com": 4} {
+		if v, _ := trie.Match(name); v != want {
+			t.Errorf(`Match(%q) = %v; want %v`, name, v, want)
+		}
+	}
+
+	zones := trie.Export()
+	want := map[string]any{
+		"=apex.com": 2, "**.sub.com": 3, "both.com": 4, "=both.com": 7, "**.split.com": 6,
+	}
+	if len(zones) != len(want) {
+		t.Errorf(`Export() = %v; want %v`, zones, want)
+	}
+	for name, v := range want {
+		if zones[name] != v {
+			t.Errorf(`Export()[%q] = %v; want %v`, name, zones[name], v)
+		}
+	}
+}
+
+func TestMatchWildcard(t *testing.T) {
+	trie := &DNSTrie{}
+	trie.AddZone("example.com", 1)
+	trie.AddZone("*.cdn.example.com", 2)
+	trie.AddZone("*.Edge.example.com", 3)
+	trie.AddZone("edge.example.com", 4)
+	trie.AddZone("*.a.b.example.com", 5)
+
+	tests := []struct {
+		name  string
+		zone  string
+		value any
+	}{
+		// exactly one more label
+		{"a.cdn.example.com", "*.cdn.example.com", 2},
+		{"A.CDN.Example.COM.", "*.cdn.example.com", 2},
+		{"x-1.cdn.example.com.", "*.cdn.example.com", 2},
+		// the apex and deeper names fall back to the parent
+		{"cdn.example.com", "example.com", 1},
+		{"a.b.cdn.example.com", "example.com", 1},
+		{"xcdn.example.com", "example.com", 1},
+		// along with an inclusive entry of the same zone
+		{"www.edge.example.com", "*.Edge.example.com", 3},
+		{"edge.example.com", "edge.example.com", 4},
+		{"a.www.edge.example.com", "edge.example.com", 4},
+		// the intermediate names are not matched
+		{"b.example.com", "example.com", 1},
+		{"a.b.example.com", "example.com", 1},
+		{"x.a.b.example.com", "*.a.b.example.com", 5},
+		{"y.x.a.b.example.com", "example.com", 1},
+	}
+	for _, tc := range tests {
+		zone, v, ok := trie.MatchZone(tc.name)
+		if zone != tc.zone || v != tc.value || !ok {
+			t.Errorf(`MatchZone(%q) = (%q, %v, %t); want (%q, %v, true)`,
+				tc.name, zone, v, ok, tc.zone, tc.value)
+		}
+	}
+
+	// The wildcard takes precedence over the subdomain-only entry.
+	trie.AddZone("**.cdn.example.com", 6)
+	for name, want := range map[string]any{
+		"a.cdn.example.com":   2,
+		"a.b.cdn.example.com": 6,
+		"cdn.example.com":     1,
+	} {
+		if v, _ := trie.Match(name); v != want {
+			t.Errorf(`Match(%q) = %v; want %v`, name, v, want)
+		}
+	}
+
+	// The forms are distinct entries.
+	if v, updated := trie.AddZone("*.cdn.example.com", 7); v != 2 || !updated {
+		t.Errorf(`AddZone("*.cdn.example.com") = (%v, %t); want (2, true)`, v, updated)
+	}
+	if v, ok := trie.GetZone("*.cdn.example.com"); v != 7 || !ok {
+		t.Errorf(`GetZone("*.cdn.example.com") = (%v, %t); want (7, true)`, v, ok)
+	}
+	if v, ok := trie.GetZone("cdn.example.com"); ok {
+		t.Errorf(`GetZone("cdn.example.com") = (%v, true); want (nil, false)`, v)
+	}
+	if v, ok := trie.DeleteZone("*.cdn.example.com"); v != 7 || !ok {
+		t.Errorf(`DeleteZone("*.cdn.example.com") = (%v, %t); want (7, true)`, v, ok)
+	}
+	if v, _ := trie.Match("a.cdn.example.com"); v != 6 {
+		t.Errorf(`Match("a.cdn.example.com") after delete = %v; want 6`, v)
+	}
+	trie.DeleteZone("**.cdn.example.com")
+	if v, _ := trie.Match("a.cdn.example.com"); v != 1 {
+		t.Errorf(`Match("a.cdn.example.com") after delete = %v; want 1`, v)
+	}
+
+	zones := trie.Export()
+	want := map[string]any{
+		"example.com": 1, "*.Edge.example.com": 3, "edge.example.com": 4,
+		"*.a.b.example.com": 5,
+	}
+	if len(zones) != len(want) {
+		t.Errorf(`Export() = %v; want %v`, zones, want)
+	}
+	for name, v := range want {
+		if zones[name] != v {
+			t.Errorf(`Export()[%q] = %v; want %v`, name, zones[name], v)
+		}
+	}
+}
+
 func TestExport(t *testing.T) {
 	trie := &DNSTrie{}
 
@@ -237,3 +437,169 @@ func TestExport(t *testing.T) {
 		}
 	}
 }
+
+func TestClear(t *testing.T) {
+	trie := &DNSTrie{}
+	trie.AddZone("example.com", 1)
+	trie.AddZone("=example.net", 2)
+	trie.AddZone("*.cdn.example.org", 3)
+	trie.Clear()
+
+	for _, name := range []string{"example.com", "www.example.com", "example.net", "a.cdn.example.org"} {
+		if v, ok := trie.Match(name); ok {
+			t.Errorf(`Match(%q) = (%v, true); want no match`, name, v)
+		}
+	}
+	if v, ok := trie.GetZone("example.com"); ok {
+		t.Errorf(`GetZone("example.com") = (%v, true); want (nil, false)`, v)
+	}
+	if zones := trie.Export(); len(zones) != 0 {
+		t.Errorf(`Export() = %v; want empty`, zones)
+	}
+
+	// Reusable after clear.
+	if _, updated := trie.AddZone("example.com", 4); updated {
+		t.Errorf(`AddZone("example.com") after clear updated; want created`)
+	}
+	if v, ok := trie.Match("www.example.com"); v != 4 || !ok {
+		t.Errorf(`Match("www.example.com") = (%v, %t); want (4, true)`, v, ok)
+	}
+}
+
+func TestDump(t *testing.T) {
+	trie := &DNSTrie{}
+	buf := &bytes.Buffer{}
+	trie.Dump(buf)
+	if s := buf.String(); s != "(empty)\n" {
+		t.Errorf(`Dump() = %q; want "(empty)\n"`, s)
+	}
+
+	trie.AddZone("Example.com", 1)
+	trie.AddZone("example.net", 2)
+	buf.Reset()
+	trie.Dump(buf)
+	t.Logf("dump:\n%s", buf.String())
+	for _, key := range []string{`"moc.elpmaxe."`, `"ten.elpmaxe."`} {
+		if !strings.Contains(buf.String(), key) {
+			t.Errorf(`Dump() missing key %s`, key)
+		}
+	}
+}
+
+// ----------------------------------------------------------
+
+var benchTLDs = []string{"com", "net", "org", "cn", "io", "example"}
+
+// Generate a random realistic domain name of (labels) labels under a TLD.
+func randomDomain(r *rand.Rand, labels int) string {
+	const charset = "abcdefghijklmnopqrstuvwxyz0123456789-"
+	var sb strings.Builder
+	for i := 0; i < labels; i++ {
+		n := 3 + r.Intn(10)
+		for j := 0; j < n; j++ {
+			sb.WriteByte(charset[r.Intn(len(charset)-1)]) // no leading '-'
+		}
+		sb.WriteByte('.')
+	}
+	sb.WriteString(benchTLDs[r.Intn(len(benchTLDs))])
+	return sb.String()
+}
+
+// Build a trie of (n) zones and the query names, half of which are the
+// subdomains of the zones and the other half are not matched.
+func newBenchTrie(n int) (*DNSTrie, []string) {
+	r := rand.New(rand.NewSource(42))
+	trie := &DNSTrie{}
+	zones := make([]string, n)
+	for i := range zones {
+		zones[i] = randomDomain(r, 1+r.Intn(2))
+		trie.AddZone(zones[i], i)
+	}
+	queries := make([]string, 1000)
+	for i := range queries {
+		if i%2 == 0 {
+			queries[i] = "www." + zones[r.Intn(n)] + "."
+		} else {
+			queries[i] = randomDomain(r, 2+r.Intn(2)) + "."
+		}
+	}
+	return trie, queries
+}
+
+// Guard against the allocation regressions on the query hot path.
+func TestMatchAllocs(t *testing.T) {
+	trie, queries := newBenchTrie(1000)
+	i := 0
+	allocs := testing.AllocsPerRun(1000, func() {
+		trie.Match(queries[i%len(queries)])
+		i++
+	})
+	if allocs > 0 {
+		t.Errorf(`Match() allocs = %v; want 0`, allocs)
+	}
+
+	var buf []byte
+	allocs = testing.AllocsPerRun(1000, func() {
+		buf = AppendKey(buf[:0], queries[i%len(queries)])
+		trie.MatchKey(buf)
+		i++
+	})
+	if allocs > 0 {
+		t.Errorf(`AppendKey() + MatchKey() allocs = %v; want 0`, allocs)
+	}
+}
+
+func TestAppendKey(t *testing.T) {
+	names := []string{"", ".", "com", "www.Example.COM.", "a.b.c.d"}
+	prefix := []byte("prefix")
+	for _, name := range names {
+		want := string(newDkey(name))
+		if got := AppendKey(nil, name); string(got) != want {
+			t.Errorf(`AppendKey(nil, %q) = %q; want %q`, name, got, want)
+		}
+		got := AppendKey(slices.Clone(prefix), name)
+		if string(got) != string(prefix)+want {
+			t.Errorf(`AppendKey(%q, %q) = %q; want %q`, prefix, name, got, string(prefix)+want)
+		}
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	for _, n := range []int{1_000, 100_000, 1_000_000} {
+		if n > 100_000 && testing.Short() {
+			continue
+		}
+		trie, queries := newBenchTrie(n)
+		b.Run(fmt.Sprintf("zones=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				trie.Match(queries[i%len(queries)])
+			}
+		})
+	}
+}
+
+func BenchmarkAppendKey(b *testing.B) {
+	name := "a-fairly-long-label.another-label.sub.Example.COM."
+	b.ReportAllocs()
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		buf = AppendKey(buf[:0], name)
+	}
+}
+
+func BenchmarkNewDkey(b *testing.B) {
+	names := []string{
+		"com.",
+		"www.example.com.",
+		"a-fairly-long-label.another-label.sub.Example.COM.",
+	}
+	for _, name := range names {
+		b.Run(fmt.Sprintf("len=%d", len(name)), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				newDkey(name)
+			}
+		})
+	}
+}
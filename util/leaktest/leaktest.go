@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Detect the goroutines leaked by the tests, e.g., the workers and cleaners
+// not stopped upon Close().
+//
+
+package leaktest
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Time to wait for the goroutines to exit after the component is closed.
+var timeout = 2 * time.Second
+
+// Snapshot the number of the goroutines, and return the function to check
+// that it drops back to the snapshot in time, e.g.:
+//
+//	defer leaktest.Check(t)()
+//	r := NewResolver()
+//	defer r.Close()
+//
+// so that the check runs after the component is closed; otherwise, fail
+// the test with the stacks of all the goroutines.
+// NOTE: The tests must not run in parallel, nor leave the goroutines of the
+// other components (e.g., the test servers) running across the check.
+func Check(t testing.TB) func() {
+	t.Helper()
+	baseline := runtime.NumGoroutine()
+	return func() {
+		t.Helper()
+		deadline := time.Now().Add(timeout)
+		for {
+			n := runtime.NumGoroutine()
+			if n <= baseline {
+				return
+			}
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				buf = buf[:runtime.Stack(buf, true)]
+				t.Errorf("leaked %d goroutines (%d; baseline %d):\n%s",
+					n-baseline, n, baseline, buf)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
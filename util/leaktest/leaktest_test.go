@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Goroutine leak detector - tests
+//
+
+package leaktest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// A testing.TB recording the failure instead of failing the test.
+type recordingTB struct {
+	testing.TB
+	failure string
+}
+
+func (tb *recordingTB) Helper() {}
+
+func (tb *recordingTB) Errorf(format string, args ...any) {
+	tb.failure = fmt.Sprintf(format, args...)
+}
+
+func TestCheck(t *testing.T) {
+	defer func(d time.Duration) { timeout = d }(timeout)
+	timeout = 100 * time.Millisecond
+
+	// Stopped in time.
+	tb := &recordingTB{TB: t}
+	check := Check(tb)
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		<-done
+	}()
+	time.AfterFunc(20*time.Millisecond, func() { close(done) })
+	check()
+	<-exited
+	if tb.failure != "" {
+		t.Errorf(`Check() failed: %s; want passed`, tb.failure)
+	}
+
+	// Leaked until the check gives up.
+	tb = &recordingTB{TB: t}
+	check = Check(tb)
+	stop, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		<-stop
+	}()
+	check()
+	close(stop)
+	<-exited
+	if tb.failure == "" {
+		t.Errorf(`Check() passed; want the leak reported`)
+	}
+}
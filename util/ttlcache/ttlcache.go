@@ -8,9 +8,11 @@
 package ttlcache
 
 import (
+	"container/heap"
 	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,23 +21,62 @@ const (
 	NoTTL      = -1 // no expiration
 )
 
-const defaultInterval = 5 * time.Second // default cleanup interval
-var nopEviction = func(string, any) {}  // default nop eviction callback
+// Cleanup interval to schedule the cleanups adaptively by the nearest
+// expiry instead of the fixed interval.
+const AdaptiveInterval time.Duration = -1
+
+const (
+	defaultInterval = 5 * time.Second        // default cleanup interval
+	minInterval     = 100 * time.Millisecond // min adaptive cleanup interval
+)
+
+var nopEviction = func(string, any) {} // default nop eviction callback
 
 var ErrKeyExists = errors.New("key already exists")
 
 type Cache struct {
 	items      map[string]*cacheItem
+	expiry     expiryHeap   // items with TTL ordered by the expiry
 	lock       sync.RWMutex // protect concurrent cleanups
 	defaultTTL time.Duration
 	onEviction func(string, any)
 	cancel     context.CancelFunc
 	wg         sync.WaitGroup
+
+	// Adaptive cleanup: the channel to wake up the cleaner when the
+	// nearest expiry becomes earlier.
+	adaptive bool
+	wake     chan struct{}
+
+	// In-progress computes of GetOrComputeCtx() by the key.
+	computes    map[string]*compute
+	computeLock sync.Mutex
+
+	// Statistics counters
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// Statistics of the cache.
+type Stats struct {
+	Size      int    // number of items, including the expired ones not cleaned yet
+	Hits      uint64 // number of Get() found
+	Misses    uint64 // number of Get() not found or expired
+	Evictions uint64 // number of items cleaned up upon expiry
+}
+
+type compute struct {
+	done  chan struct{} // closed upon the compute finished
+	value any
+	err   error
 }
 
 type cacheItem struct {
+	key      string
 	value    any
 	expireAt int64 // UnixNano
+	index    int   // index in the expiry heap; -1 if not in it
 }
 
 func (i *cacheItem) isExpired(now int64) bool {
@@ -44,10 +85,42 @@ func (i *cacheItem) isExpired(now int64) bool {
 
 var itemPool = sync.Pool{
 	New: func() any {
-		return &cacheItem{}
+		return &cacheItem{index: -1}
 	},
 }
 
+// Min-heap of the items by the expiry, so that the cleanup only touches the
+// expired items instead of scanning all of them.
+type expiryHeap []*cacheItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expireAt < h[j].expireAt }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	item := x.(*cacheItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
+
+// Create the cache with the default TTL, cleaning up the expired items
+// every interval, or adaptively upon the nearest expiry if the interval is
+// AdaptiveInterval.
 func New(
 	defaultTTL time.Duration,
 	interval time.Duration,
@@ -72,7 +145,13 @@ func New(
 	}
 
 	c.wg.Add(1)
-	go c.clean(ctx, interval)
+	if interval == AdaptiveInterval {
+		c.adaptive = true
+		c.wake = make(chan struct{}, 1)
+		go c.cleanAdaptive(ctx)
+	} else {
+		go c.clean(ctx, interval)
+	}
 
 	return c
 }
@@ -93,12 +172,7 @@ func (c *Cache) Add(key string, value any, ttl time.Duration) error {
 		return ErrKeyExists
 	}
 
-	if item == nil {
-		item = itemPool.Get().(*cacheItem)
-	}
-	item.value = value
-	item.expireAt = c.getExpireAt(ttl)
-	c.items[key] = item
+	c.setLocked(key, item, value, ttl)
 	return nil
 }
 
@@ -107,28 +181,155 @@ func (c *Cache) Set(key string, value any, ttl time.Duration) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	item := itemPool.Get().(*cacheItem)
+	c.setLocked(key, c.items[key], value, ttl)
+}
+
+// Set the value and TTL of the existing item (item), or a new one if nil.
+// NOTE: The lock must be held.
+func (c *Cache) setLocked(key string, item *cacheItem, value any, ttl time.Duration) {
+	if item == nil {
+		item = itemPool.Get().(*cacheItem)
+		item.key = key
+		c.items[key] = item
+	}
 	item.value = value
 	item.expireAt = c.getExpireAt(ttl)
-	c.items[key] = item
+
+	switch {
+	case item.expireAt <= 0 && item.index >= 0:
+		heap.Remove(&c.expiry, item.index)
+	case item.expireAt <= 0:
+		// no expiration
+	case item.index >= 0:
+		heap.Fix(&c.expiry, item.index)
+	default:
+		heap.Push(&c.expiry, item)
+	}
+
+	if c.adaptive && item.index == 0 {
+		// Nearest expiry changed; wake up the cleaner to reschedule.
+		select {
+		case c.wake <- struct{}{}:
+		default: // already pending
+		}
+	}
+}
+
+// Remove the item from the map and the expiry heap, and put it back to the
+// pool.
+// NOTE: The lock must be held.
+func (c *Cache) removeLocked(item *cacheItem) {
+	delete(c.items, item.key)
+	if item.index >= 0 {
+		heap.Remove(&c.expiry, item.index)
+	}
+	item.key, item.value = "", nil
+	itemPool.Put(item)
 }
 
 // Get the value of key, with a boolean indicating whether it was found.
 func (c *Cache) Get(key string) (value any, exists bool) {
+	value, exists = c.lookup(key)
+	if exists {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return
+}
+
+// Get the value of key without counting the statistics.
+func (c *Cache) lookup(key string) (value any, exists bool) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
 	item, exists := c.items[key]
-	if !exists {
-		return nil, false
-	}
-	if item.isExpired(time.Now().UnixNano()) {
-		// Leave and let clean() routine clean it.
+	if !exists || item.isExpired(time.Now().UnixNano()) {
+		// Leave the expired one and let clean() routine clean it.
 		return nil, false
 	}
 	return item.value, true
 }
 
+// Get the value of key, or compute it by fn and add it with the TTL if not
+// found.  The concurrent callers of the same key wait for the one compute.
+// The compute is aborted if the context (ctx) is done, e.g., the client
+// disconnected, and then nothing is stored; the waiters retry the compute
+// themselves, so a failed compute never blocks the future lookups.
+func (c *Cache) GetOrComputeCtx(
+	ctx context.Context,
+	key string,
+	ttl time.Duration,
+	fn func(ctx context.Context) (any, error),
+) (any, error) {
+	if value, ok := c.Get(key); ok {
+		return value, nil
+	}
+
+	for {
+		c.computeLock.Lock()
+		// Recheck in case a compute just finished.
+		if value, ok := c.lookup(key); ok {
+			c.computeLock.Unlock()
+			return value, nil
+		}
+		cp, ok := c.computes[key]
+		if !ok {
+			cp = &compute{done: make(chan struct{})}
+			if c.computes == nil {
+				c.computes = make(map[string]*compute)
+			}
+			c.computes[key] = cp
+			c.computeLock.Unlock()
+			c.doCompute(ctx, key, ttl, cp, fn)
+			return cp.value, cp.err
+		}
+		c.computeLock.Unlock()
+
+		select {
+		case <-cp.done:
+			if cp.err == nil {
+				return cp.value, nil
+			}
+			// Failed or aborted; retry unless also done.
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *Cache) doCompute(
+	ctx context.Context,
+	key string,
+	ttl time.Duration,
+	cp *compute,
+	fn func(ctx context.Context) (any, error),
+) {
+	// Always remove the compute, even if fn panics.
+	defer func() {
+		c.computeLock.Lock()
+		delete(c.computes, key)
+		c.computeLock.Unlock()
+		close(cp.done)
+	}()
+
+	cp.err = errors.New("compute panicked") // unless finished
+	value, err := fn(ctx)
+	if err == nil {
+		// The result may be partial if the context is done meanwhile.
+		err = ctx.Err()
+	}
+	if err != nil {
+		cp.value, cp.err = nil, err
+		return
+	}
+	c.Set(key, value, ttl)
+	cp.value, cp.err = value, nil
+}
+
 // Similar to Get() but also remove it.
 // NOTE: The eviction callback will be skipped; otherwise, it might simply
 // destroy the returned value.
@@ -141,15 +342,15 @@ func (c *Cache) Pop(key string) (value any, exists bool) {
 		return nil, false
 	}
 
-	delete(c.items, key)
+	expired := item.isExpired(time.Now().UnixNano())
+	value = item.value
 	// Skip calling the eviction callback to ensure the value valid.
-	itemPool.Put(item)
+	c.removeLocked(item)
 
-	if item.isExpired(time.Now().UnixNano()) {
+	if expired {
 		return nil, false
 	}
-
-	return item.value, true
+	return value, true
 }
 
 // Remove the item of key and invoke the eviction callback.
@@ -159,12 +360,70 @@ func (c *Cache) Delete(key string) {
 
 	item, exists := c.items[key]
 	if exists {
-		delete(c.items, key)
 		c.onEviction(key, item.value)
+		c.removeLocked(item)
+	}
+}
+
+// Remove all items and invoke the eviction callback for each of them.
+func (c *Cache) Flush() {
+	c.lock.Lock()
+	items := c.items
+	c.items = make(map[string]*cacheItem)
+	c.expiry = nil
+	c.lock.Unlock()
+
+	for key, item := range items {
+		c.onEviction(key, item.value)
+		item.key, item.value, item.index = "", nil, -1
 		itemPool.Put(item)
 	}
 }
 
+// Get the statistics.
+func (c *Cache) Stats() Stats {
+	c.lock.RLock()
+	size := len(c.items)
+	c.lock.RUnlock()
+
+	return Stats{
+		Size:      size,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+// Call fn for each unexpired item in no particular order, until fn returns
+// false.
+// NOTE: The read lock is held, so fn must not modify the cache.
+func (c *Cache) Range(fn func(key string, value any) bool) {
+	c.RangeTTL(func(key string, value any, _ time.Duration) bool {
+		return fn(key, value)
+	})
+}
+
+// Same as Range(), but also pass the remaining TTL of each item, or NoTTL
+// if it never expires, e.g., to snapshot the cache.
+func (c *Cache) RangeTTL(fn func(key string, value any, ttl time.Duration) bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	now := time.Now().UnixNano()
+	for key, item := range c.items {
+		if item.isExpired(now) {
+			continue
+		}
+		ttl := time.Duration(NoTTL)
+		if item.expireAt > 0 {
+			ttl = time.Duration(item.expireAt - now)
+		}
+		if !fn(key, item.value, ttl) {
+			return
+		}
+	}
+}
+
 func (c *Cache) getExpireAt(ttl time.Duration) int64 {
 	if ttl < 0 {
 		return NoTTL
@@ -175,40 +434,99 @@ func (c *Cache) getExpireAt(ttl time.Duration) int64 {
 	return time.Now().Add(ttl).UnixNano()
 }
 
-func (c *Cache) clean(ctx context.Context, interval time.Duration) {
-	type kvItem struct {
-		key   string
-		value any
+type kvItem struct {
+	key   string
+	value any
+}
+
+// Remove the expired items and invoke the eviction callback for them.
+// Return the nearest expiry of the remaining items (0 if none).
+func (c *Cache) evictExpired() int64 {
+	_, next := c.purgeExpired()
+	return next
+}
+
+// Remove all the expired items immediately, e.g., to reclaim the memory on
+// demand between the cleanups, and invoke the eviction callback for them.
+// Return the number of removed items.
+func (c *Cache) Purge() int {
+	n, _ := c.purgeExpired()
+	return n
+}
+
+// Similar to evictExpired() but also return the number of removed items.
+func (c *Cache) purgeExpired() (int, int64) {
+	var evictedItems []kvItem
+	c.lock.Lock()
+	now := time.Now().UnixNano()
+	for len(c.expiry) > 0 && c.expiry[0].isExpired(now) {
+		item := c.expiry[0]
+		evictedItems = append(evictedItems, kvItem{
+			key:   item.key,
+			value: item.value,
+		})
+		c.removeLocked(item)
 	}
+	next := c.nextExpireLocked()
+	c.lock.Unlock()
+
+	c.evictions.Add(uint64(len(evictedItems)))
+	for _, kv := range evictedItems {
+		c.onEviction(kv.key, kv.value)
+	}
+	return len(evictedItems), next
+}
+
+// Get the nearest expiry (0 if none).
+// NOTE: The lock must be held.
+func (c *Cache) nextExpireLocked() int64 {
+	if len(c.expiry) == 0 {
+		return 0
+	}
+	return c.expiry[0].expireAt
+}
+
+func (c *Cache) clean(ctx context.Context, interval time.Duration) {
+	defer c.wg.Done()
 
 	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			// ok
+			c.evictExpired()
 		case <-ctx.Done():
-			ticker.Stop()
-			c.wg.Done()
 			return
 		}
+	}
+}
 
-		evictedItems := []*kvItem{}
-		c.lock.Lock()
-		now := time.Now().UnixNano()
-		for key, item := range c.items {
-			if item.isExpired(now) {
-				delete(c.items, key)
-				itemPool.Put(item)
-				evictedItems = append(evictedItems, &kvItem{
-					key:   key,
-					value: item.value,
-				})
-			}
+// Clean up the expired items upon the nearest expiry, but no more often
+// than minInterval to batch the evictions.
+func (c *Cache) cleanAdaptive(ctx context.Context) {
+	defer c.wg.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			c.evictExpired()
+		case <-c.wake:
+			// earlier expiry scheduled
+		case <-ctx.Done():
+			return
 		}
-		c.lock.Unlock()
 
-		for _, kv := range evictedItems {
-			c.onEviction(kv.key, kv.value)
+		c.lock.RLock()
+		next := c.nextExpireLocked()
+		c.lock.RUnlock()
+
+		timer.Stop()
+		if next == 0 {
+			continue // sleep until woken up
 		}
+		wait := time.Duration(next - time.Now().UnixNano() + 1)
+		timer.Reset(max(wait, minInterval))
 	}
 }
@@ -8,9 +8,14 @@
 package ttlcache
 
 import (
+	"context"
+	"errors"
+	"strconv"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"kexuedns/util/leaktest"
 )
 
 func TestAdd1(t *testing.T) {
@@ -144,6 +149,173 @@ func TestNoTTL(t *testing.T) {
 	}
 }
 
+func TestStatsRange(t *testing.T) {
+	cache := New(time.Hour, time.Hour, nil)
+	defer cache.Close()
+
+	cache.Set("a", 1, DefaultTTL)
+	cache.Set("b", 2, DefaultTTL)
+	cache.Set("c", 3, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+
+	cache.Get("a")
+	cache.Get("c") // expired
+	cache.Get("d")
+	want := Stats{Size: 3, Hits: 1, Misses: 2}
+	if s := cache.Stats(); s != want {
+		t.Errorf(`Stats() = %+v; want %+v`, s, want)
+	}
+
+	// Only the unexpired items
+	sum := 0
+	cache.Range(func(key string, value any) bool {
+		sum += value.(int)
+		return true
+	})
+	if sum != 3 {
+		t.Errorf(`Range() sum = %d; want 3`, sum)
+	}
+	// Stop early
+	n := 0
+	cache.Range(func(key string, value any) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf(`Range() called %d times; want 1`, n)
+	}
+	// Remaining TTLs
+	cache.Set("e", 5, NoTTL)
+	cache.RangeTTL(func(key string, value any, ttl time.Duration) bool {
+		switch key {
+		case "a", "b":
+			if ttl <= time.Hour-time.Second || ttl > time.Hour {
+				t.Errorf(`RangeTTL() of %q: ttl = %v; want ~%v`, key, ttl, time.Hour)
+			}
+		case "e":
+			if ttl != NoTTL {
+				t.Errorf(`RangeTTL() of %q: ttl = %v; want NoTTL`, key, ttl)
+			}
+		default:
+			t.Errorf(`RangeTTL() of %q: unexpected`, key)
+		}
+		return true
+	})
+	cache.Delete("e")
+
+	cache.evictExpired()
+	want = Stats{Size: 2, Hits: 1, Misses: 2, Evictions: 1}
+	if s := cache.Stats(); s != want {
+		t.Errorf(`Stats() = %+v; want %+v`, s, want)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	var evicted []string
+	cache := New(time.Hour, time.Hour, func(key string, value any) {
+		evicted = append(evicted, key)
+	})
+	defer cache.Close()
+
+	cache.Set("a", 1, DefaultTTL)
+	cache.Set("b", 2, time.Millisecond)
+	cache.Set("c", 3, time.Millisecond)
+	cache.Set("d", 4, NoTTL)
+	time.Sleep(2 * time.Millisecond)
+
+	if n := cache.Purge(); n != 2 {
+		t.Errorf(`Purge() = %d; want 2`, n)
+	}
+	if len(evicted) != 2 {
+		t.Errorf(`evicted = %v; want [b c]`, evicted)
+	}
+	want := Stats{Size: 2, Evictions: 2}
+	if s := cache.Stats(); s != want {
+		t.Errorf(`Stats() = %+v; want %+v`, s, want)
+	}
+	if n := cache.Purge(); n != 0 {
+		t.Errorf(`Purge() again = %d; want 0`, n)
+	}
+}
+
+func TestGetOrComputeCtx(t *testing.T) {
+	cache := New(time.Hour, time.Hour, nil)
+	defer cache.Close()
+
+	// Cancelled before the compute finished: nothing stored.
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err := cache.GetOrComputeCtx(ctx, "a", DefaultTTL,
+		func(ctx context.Context) (any, error) {
+			close(started)
+			<-ctx.Done()
+			return "partial", nil
+		})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf(`GetOrComputeCtx() = %v; want %v`, err, context.Canceled)
+	}
+	if v, ok := cache.Get("a"); ok {
+		t.Errorf(`Get() = %v; want not found after cancelled compute`, v)
+	}
+
+	// Failed compute: nothing stored.
+	errFetch := errors.New("fetch failed")
+	_, err = cache.GetOrComputeCtx(context.Background(), "a", DefaultTTL,
+		func(ctx context.Context) (any, error) { return nil, errFetch })
+	if !errors.Is(err, errFetch) {
+		t.Errorf(`GetOrComputeCtx() = %v; want %v`, err, errFetch)
+	}
+
+	// No placeholder left behind to block the next compute.
+	var calls atomic.Int32
+	fn := func(ctx context.Context) (any, error) {
+		calls.Add(1)
+		return 1, nil
+	}
+	for range 2 {
+		v, err := cache.GetOrComputeCtx(context.Background(), "a", DefaultTTL, fn)
+		if err != nil || v != 1 {
+			t.Errorf(`GetOrComputeCtx() = (%v, %v); want (1, nil)`, v, err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf(`compute called %d times; want 1 (cached)`, n)
+	}
+
+	// The leader cancelled: the waiter computes itself.
+	lctx, lcancel := context.WithCancel(context.Background())
+	entered := make(chan struct{})
+	leader := make(chan error)
+	go func() {
+		_, err := cache.GetOrComputeCtx(lctx, "b", DefaultTTL,
+			func(ctx context.Context) (any, error) {
+				close(entered)
+				<-ctx.Done()
+				return nil, ctx.Err()
+			})
+		leader <- err
+	}()
+	<-entered
+	waiter := make(chan any)
+	go func() {
+		v, _ := cache.GetOrComputeCtx(context.Background(), "b", DefaultTTL,
+			func(ctx context.Context) (any, error) { return 2, nil })
+		waiter <- v
+	}()
+	time.Sleep(10 * time.Millisecond) // let the waiter wait
+	lcancel()
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Errorf(`leader GetOrComputeCtx() = %v; want %v`, err, context.Canceled)
+	}
+	if v := <-waiter; v != 2 {
+		t.Errorf(`waiter GetOrComputeCtx() = %v; want 2`, v)
+	}
+}
+
 func TestEviction1(t *testing.T) {
 	var evicted atomic.Uint32
 	cache := New(10*time.Millisecond, 20*time.Millisecond,
@@ -213,3 +385,154 @@ func TestEviction3(t *testing.T) {
 		t.Errorf(`(b) evicted = %d; want 1`, n)
 	}
 }
+
+func TestFlush(t *testing.T) {
+	var evicted atomic.Int32
+	cache := New(10*time.Second, 10*time.Second, func(key string, value any) {
+		evicted.Add(1)
+	})
+	defer cache.Close()
+
+	keys := []string{"a", "b", "c"}
+	for _, key := range keys {
+		cache.Set(key, key, DefaultTTL)
+	}
+	cache.Flush()
+	for _, key := range keys {
+		if v, ok := cache.Get(key); ok || v != nil {
+			t.Errorf(`Get(%q) = (%v, %t); want (nil, false)`, key, v, ok)
+		}
+	}
+	if n := evicted.Load(); n != int32(len(keys)) {
+		t.Errorf(`evicted = %d; want %d`, n, len(keys))
+	}
+
+	// Still usable after flush.
+	cache.Set("a", 1, DefaultTTL)
+	if v, ok := cache.Get("a"); !ok || v != 1 {
+		t.Errorf(`Get("a") = (%v, %t); want (1, true)`, v, ok)
+	}
+}
+
+func TestEvictionAdaptive(t *testing.T) {
+	var evicted atomic.Uint32
+	cache := New(time.Hour, AdaptiveInterval,
+		func(key string, value any) { evicted.Add(1) })
+	defer cache.Close()
+
+	// No expiry scheduled: the cleaner sleeps.
+	cache.Set("forever", 1, NoTTL)
+	cache.Set("long", 2, DefaultTTL)
+	cache.lock.RLock()
+	next := cache.nextExpireLocked()
+	cache.lock.RUnlock()
+	if want := cache.items["long"].expireAt; next != want {
+		t.Errorf(`nextExpire = %d; want %d`, next, want)
+	}
+
+	// An earlier expiry wakes up the cleaner.
+	cache.Set("short", 3, 10*time.Millisecond)
+	time.Sleep(minInterval + 50*time.Millisecond)
+	if n := evicted.Load(); n != 1 {
+		t.Errorf(`evicted = %d; want 1`, n)
+	}
+	if _, ok := cache.Get("long"); !ok {
+		t.Errorf(`Get("long") = false; want true`)
+	}
+
+	cache.lock.RLock()
+	next = cache.nextExpireLocked()
+	n := len(cache.items)
+	cache.lock.RUnlock()
+	if want := time.Now().Add(30 * time.Minute).UnixNano(); next < want {
+		t.Errorf(`nextExpire = %d; want the one of "long"`, next)
+	}
+	if n != 2 {
+		t.Errorf(`len(items) = %d; want 2`, n)
+	}
+}
+
+func TestCloseLeak(t *testing.T) {
+	for _, interval := range []time.Duration{10 * time.Millisecond, AdaptiveInterval} {
+		func() {
+			defer leaktest.Check(t)()
+			cache := New(time.Second, interval, nil)
+			defer cache.Close()
+			cache.Set("hello", 1, 5*time.Millisecond)
+			time.Sleep(20 * time.Millisecond)
+		}()
+	}
+}
+
+func TestExpiryHeap(t *testing.T) {
+	cache := New(time.Hour, time.Hour, nil)
+	defer cache.Close()
+
+	check := func(step string, keys ...string) {
+		t.Helper()
+		if len(cache.expiry) != len(keys) {
+			t.Fatalf(`(%s) len(expiry) = %d; want %d`, step, len(cache.expiry), len(keys))
+		}
+		for i, item := range cache.expiry {
+			if item.index != i {
+				t.Errorf(`(%s) expiry[%d].index = %d`, step, i, item.index)
+			}
+		}
+		if len(keys) > 0 && cache.expiry[0].key != keys[0] {
+			t.Errorf(`(%s) nearest = %q; want %q`, step, cache.expiry[0].key, keys[0])
+		}
+	}
+
+	cache.Set("a", 1, 30*time.Minute)
+	cache.Set("b", 2, 10*time.Minute)
+	cache.Set("c", 3, NoTTL)
+	check("set", "b", "a")
+
+	cache.Set("a", 1, time.Minute) // earlier
+	check("update", "a", "b")
+	cache.Set("a", 1, NoTTL) // no more expiry
+	check("no ttl", "b")
+	cache.Set("c", 3, time.Second) // gets expiry
+	check("ttl", "c", "b")
+
+	cache.Delete("c")
+	check("delete", "b")
+	if v, ok := cache.Pop("b"); !ok || v != 2 {
+		t.Errorf(`Pop("b") = (%v, %t); want (2, true)`, v, ok)
+	}
+	check("pop")
+
+	cache.Set("d", 4, time.Nanosecond)
+	cache.Set("e", 5, time.Hour)
+	time.Sleep(time.Millisecond)
+	if next := cache.evictExpired(); next != cache.items["e"].expireAt {
+		t.Errorf(`evictExpired() = %d; want the expiry of "e"`, next)
+	}
+	check("evict", "e")
+	if _, ok := cache.items["d"]; ok {
+		t.Errorf(`item "d" not evicted`)
+	}
+
+	cache.Flush()
+	check("flush")
+}
+
+// Clean up 100 expired items among 100k ones.
+func BenchmarkEvictExpired(b *testing.B) {
+	cache := New(time.Hour, time.Hour, nil)
+	defer cache.Close()
+	for i := range 100000 {
+		cache.Set(strconv.Itoa(i), i, DefaultTTL)
+	}
+
+	b.ResetTimer()
+	for i := range b.N {
+		b.StopTimer()
+		for j := range 100 {
+			cache.Set("expired-"+strconv.Itoa(i*100+j), j, time.Nanosecond)
+		}
+		time.Sleep(time.Microsecond)
+		b.StartTimer()
+		cache.evictExpired()
+	}
+}
@@ -0,0 +1,412 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Zone file parser (RFC 1035, Section 5) for a small subset of record types.
+//
+
+package zonefile
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Default TTL if neither $TTL nor the record gives one.
+const DefaultTTL = 3600 // seconds
+
+var (
+	ErrUnbalancedParen = errors.New("unbalanced parentheses")
+	ErrUnclosedQuote   = errors.New("unclosed quote")
+)
+
+// Parse the zone file (path) with the origin (origin).
+func ParseFile(path string, origin string) ([]dnsmessage.Resource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f, origin)
+}
+
+// Parse the zone data from the reader (r) with the initial origin (origin),
+// which may be changed by the $ORIGIN directive.
+//
+// Supported record types: SOA, NS, A, AAAA, CNAME, PTR, MX, TXT, SRV.
+// Supported directives: $ORIGIN, $TTL.
+// The class can only be IN, and the TTLs must be in seconds.
+func Parse(r io.Reader, origin string) ([]dnsmessage.Resource, error) {
+	p := &parser{
+		origin: fqdn(origin),
+		ttl:    -1,
+	}
+
+	scanner := bufio.NewScanner(r)
+	var entry []string // tokens of the current (maybe multi-line) entry
+	var blankOwner bool
+	depth, lineno, start := 0, 0, 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if depth == 0 {
+			start = lineno
+			blankOwner = len(line) > 0 && (line[0] == ' ' || line[0] == '\t')
+		}
+
+		tokens, d, err := tokenize(line, depth)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		entry = append(entry, tokens...)
+		depth = d
+		if depth > 0 {
+			continue // entry continues on next line
+		}
+
+		if len(entry) > 0 {
+			if err := p.parseEntry(entry, blankOwner); err != nil {
+				return nil, fmt.Errorf("line %d: %w", start, err)
+			}
+		}
+		entry = entry[:0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("line %d: %w", start, ErrUnbalancedParen)
+	}
+
+	return p.records, nil
+}
+
+type parser struct {
+	origin  string // current origin in FQDN
+	ttl     int    // default TTL by $TTL; -1 if unset
+	owner   string // owner of the last record
+	lastTTL int    // TTL of the last record
+	records []dnsmessage.Resource
+}
+
+// Split the line into tokens, with the current parentheses depth (depth).
+// Return the tokens and the new depth.
+// Quoted strings are returned with the quotes to be distinguished from
+// the bare words (e.g., for TXT).
+func tokenize(line string, depth int) ([]string, int, error) {
+	var tokens []string
+	i := 0
+	for i < len(line) {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == ';':
+			return tokens, depth, nil // comment till line end
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			if depth == 0 {
+				return nil, 0, ErrUnbalancedParen
+			}
+			depth--
+			i++
+		case c == '"':
+			var sb strings.Builder
+			sb.WriteByte('"')
+			j := i + 1
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] == '\\' && j+1 < len(line) {
+					j++
+				}
+				sb.WriteByte(line[j])
+			}
+			if j >= len(line) {
+				return nil, 0, ErrUnclosedQuote
+			}
+			sb.WriteByte('"')
+			tokens = append(tokens, sb.String())
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(line); j++ {
+				if strings.IndexByte(" \t\r;()\"", line[j]) >= 0 {
+					break
+				}
+			}
+			tokens = append(tokens, line[i:j])
+			i = j
+		}
+	}
+	return tokens, depth, nil
+}
+
+// Parse one entry (tokens), which is either a directive or a record.
+// The owner is omitted (i.e., same as the last record) if blankOwner is true.
+func (p *parser) parseEntry(tokens []string, blankOwner bool) error {
+	switch strings.ToUpper(tokens[0]) {
+	case "$ORIGIN":
+		if len(tokens) != 2 {
+			return errors.New("invalid $ORIGIN")
+		}
+		p.origin = p.absName(tokens[1])
+		return nil
+	case "$TTL":
+		if len(tokens) != 2 {
+			return errors.New("invalid $TTL")
+		}
+		ttl, err := parseTTL(tokens[1])
+		if err != nil {
+			return err
+		}
+		p.ttl = ttl
+		return nil
+	case "$INCLUDE", "$GENERATE":
+		return fmt.Errorf("unsupported directive: %s", tokens[0])
+	}
+
+	owner := p.owner
+	if !blankOwner {
+		owner = p.absName(tokens[0])
+		tokens = tokens[1:]
+	}
+	if owner == "" {
+		return errors.New("missing owner")
+	}
+
+	// Optional TTL and class in either order
+	ttl := -1
+	for len(tokens) > 0 {
+		if t, err := parseTTL(tokens[0]); err == nil && ttl < 0 {
+			ttl = t
+		} else if strings.EqualFold(tokens[0], "IN") {
+			// ok
+		} else {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return errors.New("missing type")
+	}
+	if ttl < 0 {
+		if p.ttl >= 0 {
+			ttl = p.ttl
+		} else if len(p.records) > 0 {
+			ttl = p.lastTTL
+		} else {
+			ttl = DefaultTTL
+		}
+	}
+
+	name, err := dnsmessage.NewName(owner)
+	if err != nil {
+		return fmt.Errorf("invalid owner [%s]: %w", owner, err)
+	}
+	rtype, rdata := strings.ToUpper(tokens[0]), tokens[1:]
+	body, err := p.parseRData(rtype, rdata)
+	if err != nil {
+		return fmt.Errorf("invalid %s record: %w", rtype, err)
+	}
+	if soa, ok := body.(*dnsmessage.SOAResource); ok && p.ttl < 0 {
+		// Use the SOA minimum as the default TTL if no $TTL, as the
+		// original RFC 1035 semantics.
+		p.ttl = int(soa.MinTTL)
+	}
+
+	p.records = append(p.records, dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  name,
+			Type:  recordTypes[rtype],
+			Class: dnsmessage.ClassINET,
+			TTL:   uint32(ttl),
+		},
+		Body: body,
+	})
+	p.owner = owner
+	p.lastTTL = ttl
+	return nil
+}
+
+// Supported record types
+var recordTypes = map[string]dnsmessage.Type{
+	"SOA":   dnsmessage.TypeSOA,
+	"NS":    dnsmessage.TypeNS,
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"PTR":   dnsmessage.TypePTR,
+	"MX":    dnsmessage.TypeMX,
+	"TXT":   dnsmessage.TypeTXT,
+	"SRV":   dnsmessage.TypeSRV,
+}
+
+// Number of RDATA fields of the record types; variable if absent.
+var rdataFields = map[string]int{
+	"SOA": 7, "NS": 1, "A": 1, "AAAA": 1, "CNAME": 1, "PTR": 1,
+	"MX": 2, "SRV": 4,
+}
+
+func (p *parser) parseRData(rtype string, rdata []string) (dnsmessage.ResourceBody, error) {
+	if n, ok := rdataFields[rtype]; ok && len(rdata) != n {
+		return nil, fmt.Errorf("want %d fields but got %d", n, len(rdata))
+	}
+
+	switch rtype {
+	case "A":
+		addr, err := netip.ParseAddr(rdata[0])
+		if err != nil || !addr.Is4() {
+			return nil, fmt.Errorf("invalid IPv4 address [%s]", rdata[0])
+		}
+		return &dnsmessage.AResource{A: addr.As4()}, nil
+
+	case "AAAA":
+		addr, err := netip.ParseAddr(rdata[0])
+		if err != nil || !addr.Is6() || addr.Is4In6() {
+			return nil, fmt.Errorf("invalid IPv6 address [%s]", rdata[0])
+		}
+		return &dnsmessage.AAAAResource{AAAA: addr.As16()}, nil
+
+	case "CNAME", "NS", "PTR":
+		name, err := p.newName(rdata[0])
+		if err != nil {
+			return nil, err
+		}
+		switch rtype {
+		case "CNAME":
+			return &dnsmessage.CNAMEResource{CNAME: name}, nil
+		case "NS":
+			return &dnsmessage.NSResource{NS: name}, nil
+		default:
+			return &dnsmessage.PTRResource{PTR: name}, nil
+		}
+
+	case "MX":
+		pref, err := parseUint16(rdata[0])
+		if err != nil {
+			return nil, err
+		}
+		mx, err := p.newName(rdata[1])
+		if err != nil {
+			return nil, err
+		}
+		return &dnsmessage.MXResource{Pref: pref, MX: mx}, nil
+
+	case "SRV":
+		var nums [3]uint16
+		for i := range nums {
+			n, err := parseUint16(rdata[i])
+			if err != nil {
+				return nil, err
+			}
+			nums[i] = n
+		}
+		target, err := p.newName(rdata[3])
+		if err != nil {
+			return nil, err
+		}
+		return &dnsmessage.SRVResource{
+			Priority: nums[0],
+			Weight:   nums[1],
+			Port:     nums[2],
+			Target:   target,
+		}, nil
+
+	case "TXT":
+		if len(rdata) == 0 {
+			return nil, errors.New("missing text")
+		}
+		txt := make([]string, 0, len(rdata))
+		for _, s := range rdata {
+			s = strings.TrimPrefix(strings.TrimSuffix(s, `"`), `"`)
+			if len(s) > 255 {
+				return nil, errors.New("text longer than 255")
+			}
+			txt = append(txt, s)
+		}
+		return &dnsmessage.TXTResource{TXT: txt}, nil
+
+	case "SOA":
+		ns, err := p.newName(rdata[0])
+		if err != nil {
+			return nil, err
+		}
+		mbox, err := p.newName(rdata[1])
+		if err != nil {
+			return nil, err
+		}
+		var nums [5]uint32
+		for i := range nums {
+			n, err := strconv.ParseUint(rdata[2+i], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number [%s]", rdata[2+i])
+			}
+			nums[i] = uint32(n)
+		}
+		return &dnsmessage.SOAResource{
+			NS:      ns,
+			MBox:    mbox,
+			Serial:  nums[0],
+			Refresh: nums[1],
+			Retry:   nums[2],
+			Expire:  nums[3],
+			MinTTL:  nums[4],
+		}, nil
+	}
+
+	return nil, errors.New("unsupported type")
+}
+
+// Convert the name (name) to be absolute, i.e., FQDN.
+func (p *parser) absName(name string) string {
+	if name == "@" {
+		return p.origin
+	}
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	if p.origin == "." {
+		return name + "."
+	}
+	return name + "." + p.origin
+}
+
+func (p *parser) newName(name string) (dnsmessage.Name, error) {
+	n, err := dnsmessage.NewName(p.absName(name))
+	if err != nil {
+		return n, fmt.Errorf("invalid name [%s]: %w", name, err)
+	}
+	return n, nil
+}
+
+func parseTTL(s string) (int, error) {
+	n, err := strconv.ParseUint(s, 10, 31)
+	if err != nil {
+		return 0, fmt.Errorf("invalid TTL [%s]", s)
+	}
+	return int(n), nil
+}
+
+func parseUint16(s string) (uint16, error) {
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number [%s]", s)
+	}
+	return uint16(n), nil
+}
+
+func fqdn(name string) string {
+	if name == "" || name == "." {
+		return "."
+	}
+	return strings.TrimSuffix(name, ".") + "."
+}
@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2026 Aaron LI
+//
+// Zone file parser - tests
+//
+
+package zonefile
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testZone = `
+$ORIGIN home.example.
+$TTL 300
+@	IN	SOA	ns1 admin.home.example. (
+		2026010101 ; serial
+		3600 1200 604800 60 )
+	IN	NS	ns1
+ns1	IN	A	192.168.1.1
+www	600	IN	A	192.168.1.10
+	IN	AAAA	fd00::10
+alias	CNAME	www
+@	MX	10 mail.home.example.
+txt	TXT	"hello world" "quoted \" and ; semicolon" bare
+_http._tcp	SRV	0 5 80 www
+$ORIGIN sub.home.example.
+host	3600	A	192.168.2.1
+`
+
+func TestParse(t *testing.T) {
+	records, err := Parse(strings.NewReader(testZone), "home.example")
+	if err != nil {
+		t.Fatalf(`Parse() = %v; want nil`, err)
+	}
+
+	expected := []struct {
+		name  string
+		rtype dnsmessage.Type
+		ttl   uint32
+	}{
+		{"home.example.", dnsmessage.TypeSOA, 300},
+		{"home.example.", dnsmessage.TypeNS, 300},
+		{"ns1.home.example.", dnsmessage.TypeA, 300},
+		{"www.home.example.", dnsmessage.TypeA, 600},
+		{"www.home.example.", dnsmessage.TypeAAAA, 300},
+		{"alias.home.example.", dnsmessage.TypeCNAME, 300},
+		{"home.example.", dnsmessage.TypeMX, 300},
+		{"txt.home.example.", dnsmessage.TypeTXT, 300},
+		{"_http._tcp.home.example.", dnsmessage.TypeSRV, 300},
+		{"host.sub.home.example.", dnsmessage.TypeA, 3600},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf(`len(records) = %d; want %d`, len(records), len(expected))
+	}
+	for i, e := range expected {
+		h := records[i].Header
+		if h.Name.String() != e.name || h.Type != e.rtype || h.TTL != e.ttl {
+			t.Errorf(`[%d] record = %s %d %s; want %s %d %s`,
+				i, h.Name, h.TTL, h.Type, e.name, e.ttl, e.rtype)
+		}
+	}
+
+	soa := records[0].Body.(*dnsmessage.SOAResource)
+	if soa.Serial != 2026010101 || soa.MinTTL != 60 ||
+		soa.NS.String() != "ns1.home.example." {
+		t.Errorf(`SOA = %+v; unexpected`, soa)
+	}
+	txt := records[7].Body.(*dnsmessage.TXTResource)
+	want := []string{"hello world", `quoted " and ; semicolon`, "bare"}
+	if strings.Join(txt.TXT, "|") != strings.Join(want, "|") {
+		t.Errorf(`TXT = %q; want %q`, txt.TXT, want)
+	}
+	srv := records[8].Body.(*dnsmessage.SRVResource)
+	if srv.Port != 80 || srv.Target.String() != "www.home.example." {
+		t.Errorf(`SRV = %+v; unexpected`, srv)
+	}
+}
+
+func TestParseDefaultTTL(t *testing.T) {
+	// No $TTL: the SOA minimum applies to the later records.
+	zone := "@ 100 SOA ns admin 1 2 3 4 60\nwww A 10.0.0.1\n"
+	records, err := Parse(strings.NewReader(zone), "example.")
+	if err != nil {
+		t.Fatalf(`Parse() = %v; want nil`, err)
+	}
+	if ttl := records[1].Header.TTL; ttl != 60 {
+		t.Errorf(`TTL = %d; want 60`, ttl)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	zones := []string{
+		"www A 300.0.0.1",
+		"www AAAA 10.0.0.1",
+		"www A",
+		"www MX mail",
+		"www HINFO a b",
+		"www TXT \"unclosed",
+		"@ SOA ns admin ( 1 2 3 4 5",
+		"www A 10.0.0.1 )",
+		"$INCLUDE other.zone",
+		"$TTL abc",
+	}
+	for i, zone := range zones {
+		if _, err := Parse(strings.NewReader(zone), "example."); err == nil {
+			t.Errorf(`[%d] Parse(%q) = nil; want error`, i, zone)
+		}
+	}
+
+	_, err := Parse(strings.NewReader("@ SOA ns admin ( 1 2 3 4 5"), "example.")
+	if !errors.Is(err, ErrUnbalancedParen) {
+		t.Errorf(`Parse() = %v; want %v`, err, ErrUnbalancedParen)
+	}
+}